@@ -0,0 +1,258 @@
+// Package client is a Go client for the background removal API
+package client
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPollInterval is used by Wait when the server sends no polling hint
+const DefaultPollInterval = 2 * time.Second
+
+// Client calls the API at BaseURL
+type Client struct {
+	BaseURL      string
+	HTTPClient   *http.Client
+	PollInterval time.Duration
+
+	// hints holds the status hint of each submitted job until it's done
+	hints sync.Map
+}
+
+// New creates a client for the API served at baseURL, e.g. "http://localhost:8080"
+func New(baseURL string) *Client {
+	return &Client{
+		BaseURL:      strings.TrimRight(baseURL, "/"),
+		HTTPClient:   &http.Client{Timeout: 60 * time.Second},
+		PollInterval: DefaultPollInterval,
+	}
+}
+
+// Warning is a non-fatal issue reported for a job
+type Warning struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Params  map[string]string `json:"params,omitempty"`
+}
+
+// Result is the status of a job as reported by the API
+type Result struct {
+	JobID        string    `json:"job_id"`
+	Status       string    `json:"status"`
+	ResultURL    string    `json:"result_url,omitempty"`
+	Error        string    `json:"error,omitempty"`
+	Warnings     []Warning `json:"warnings,omitempty"`
+	RetryAfterMs int64     `json:"retry_after_ms,omitempty"`
+	QueueWaitMs  int64     `json:"queue_wait_ms,omitempty"`
+	ProcessingMs int64     `json:"processing_ms,omitempty"`
+	// QueuedDurationMs and ProcessingDurationMs are how long a completed
+	// job waited and was processed across every attempt, from its status
+	// changes; zero for jobs stored before they were recorded
+	QueuedDurationMs     int64 `json:"queued_duration_ms,omitempty"`
+	ProcessingDurationMs int64 `json:"processing_duration_ms,omitempty"`
+	// Attempts is how many times the job has been tried; above one, a retry
+	// after a transient failure is in progress or has happened
+	Attempts    int `json:"attempts,omitempty"`
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// ExpiresAt is when the job and its result are removed, in RFC 3339
+	ExpiresAt string `json:"expires_at,omitempty"`
+	// StatusHint is returned on submission and sent back with status polls,
+	// so polls racing the submission report pending rather than not found
+	StatusHint string `json:"status_hint,omitempty"`
+	// CancelRequested is set while a job being processed waits for its
+	// worker to stop it
+	CancelRequested bool `json:"cancel_requested,omitempty"`
+	// QueuePaused is set while a pending job waits for workers, which are
+	// paused from claiming new jobs
+	QueuePaused bool `json:"queue_paused,omitempty"`
+	// Metadata is what the job was submitted with in its metadata field
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Archive is where a job with status archived was moved to cold
+	// storage at the end of its retention
+	Archive string `json:"archive,omitempty"`
+}
+
+// Done reports whether the job reached a terminal status
+func (r *Result) Done() bool {
+	return r.Status == "completed" || r.Status == "failed" || r.Status == "cancelled" || r.Status == "archived"
+}
+
+// APIError is returned for non-2xx responses
+type APIError struct {
+	StatusCode int
+	Message    string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("api error %d: %s", e.StatusCode, e.Message)
+}
+
+// Submit uploads an image for processing
+func (c *Client) Submit(ctx context.Context, filename string, image io.Reader) (*Result, error) {
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("image", filename)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(part, image); err != nil {
+		return nil, err
+	}
+	if err := form.Close(); err != nil {
+		return nil, err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"/api/process", &body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", form.FormDataContentType())
+
+	var result Result
+	if err := c.do(req, &result); err != nil {
+		return nil, err
+	}
+	if result.StatusHint != "" {
+		c.hints.Store(result.JobID, result.StatusHint)
+	}
+	return &result, nil
+}
+
+// Result fetches the current status of a job
+func (c *Client) Result(ctx context.Context, jobID string) (*Result, error) {
+	query := url.Values{"id": {jobID}}
+	if hint, ok := c.hints.Load(jobID); ok {
+		query.Set("hint", hint.(string))
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+"/api/result?"+query.Encode(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result Result
+	if err := c.do(req, &result); err != nil {
+		return nil, err
+	}
+	if result.Done() {
+		c.hints.Delete(jobID)
+	}
+	return &result, nil
+}
+
+// Cancel cancels a job that hasn't finished. A job being processed is
+// stopped by its worker shortly after, so the result may still be
+// processing with CancelRequested set. Finished jobs fail with a 409 APIError.
+func (c *Client) Cancel(ctx context.Context, jobID string) (*Result, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.BaseURL+"/api/job/"+url.PathEscape(jobID)+"/cancel", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var result Result
+	if err := c.do(req, &result); err != nil {
+		return nil, err
+	}
+	if result.Done() {
+		c.hints.Delete(jobID)
+	}
+	return &result, nil
+}
+
+// Delete purges a job and its files before its retention ends. A job being
+// processed fails with a 409 APIError unless force is set.
+func (c *Client) Delete(ctx context.Context, jobID string, force bool) error {
+	endpoint := c.BaseURL + "/api/job/" + url.PathEscape(jobID)
+	if force {
+		endpoint += "?force=true"
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodDelete, endpoint, nil)
+	if err != nil {
+		return err
+	}
+
+	var body struct{}
+	if err := c.do(req, &body); err != nil {
+		return err
+	}
+	c.hints.Delete(jobID)
+	return nil
+}
+
+// Download writes the processed image of a completed job to w
+func (c *Client) Download(ctx context.Context, jobID string, w io.Writer) (int64, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.BaseURL+"/api/download/"+url.PathEscape(jobID), nil)
+	if err != nil {
+		return 0, err
+	}
+
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return 0, decodeError(resp)
+	}
+	return io.Copy(w, resp.Body)
+}
+
+// Wait polls until the job reaches a terminal status or ctx is done,
+// honoring the server's retry_after_ms hint between polls
+func (c *Client) Wait(ctx context.Context, jobID string) (*Result, error) {
+	for {
+		result, err := c.Result(ctx, jobID)
+		if err != nil {
+			return nil, err
+		}
+		if result.Done() {
+			return result, nil
+		}
+
+		delay := c.PollInterval
+		if result.RetryAfterMs > 0 {
+			delay = time.Duration(result.RetryAfterMs) * time.Millisecond
+		}
+
+		select {
+		case <-ctx.Done():
+			return result, ctx.Err()
+		case <-time.After(delay):
+		}
+	}
+}
+
+// do sends the request and decodes a JSON response into out
+func (c *Client) do(req *http.Request, out interface{}) error {
+	resp, err := c.HTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return decodeError(resp)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// decodeError builds an APIError from an error response
+func decodeError(resp *http.Response) error {
+	var body struct {
+		Error string `json:"error"`
+	}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if json.Unmarshal(data, &body) != nil || body.Error == "" {
+		body.Error = strings.TrimSpace(string(data))
+	}
+	return &APIError{StatusCode: resp.StatusCode, Message: body.Error}
+}
@@ -0,0 +1,56 @@
+package client
+
+import (
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// EventSchemaVersion is the newest lifecycle event schema ParseEvent reads
+const EventSchemaVersion = 1
+
+// Event is a job lifecycle event, published by the API and the workers on
+// the JOB_EVENTS_CHANNEL Redis Pub/Sub channel when PUBLISH_JOB_EVENTS is
+// set
+type Event struct {
+	Version int    `json:"v"`
+	Type    string `json:"type"`
+	JobID   string `json:"job_id"`
+	Status  string `json:"status"`
+	Owner   string `json:"owner,omitempty"`
+	Model   string `json:"model"`
+	// InputBytes is the upload's size, and OutputBytes the result's once
+	// the job completed
+	InputBytes   int64  `json:"input_bytes,omitempty"`
+	OutputBytes  int64  `json:"output_bytes,omitempty"`
+	Error        string `json:"error,omitempty"`
+	ErrorCode    string `json:"error_code,omitempty"`
+	DurationMs   int64  `json:"duration_ms"`
+	QueueWaitMs  int64  `json:"queue_wait_ms,omitempty"`
+	ProcessingMs int64  `json:"processing_ms,omitempty"`
+	// Transfer is set on transferred events
+	Transfer  *EventTransfer `json:"transfer,omitempty"`
+	Timestamp time.Time      `json:"ts"`
+}
+
+// EventTransfer describes the change of owner a transferred event reports
+type EventTransfer struct {
+	From  string    `json:"from"`
+	To    string    `json:"to"`
+	Actor string    `json:"actor"`
+	At    time.Time `json:"at"`
+}
+
+// ParseEvent decodes a lifecycle event payload. It fails for a schema
+// version newer than EventSchemaVersion, whose fields may have changed
+// meaning.
+func ParseEvent(payload []byte) (*Event, error) {
+	var event Event
+	if err := json.Unmarshal(payload, &event); err != nil {
+		return nil, fmt.Errorf("invalid lifecycle event: %w", err)
+	}
+	if event.Version > EventSchemaVersion {
+		return nil, fmt.Errorf("lifecycle event schema version %d is newer than %d", event.Version, EventSchemaVersion)
+	}
+	return &event, nil
+}
@@ -0,0 +1,60 @@
+package client
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"rembg-v2/api/internal/queue"
+)
+
+func TestParseEventReadsQueueEvents(t *testing.T) {
+	at := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	payload, err := json.Marshal(queue.LifecycleEvent{
+		Version:     queue.EventSchemaVersion,
+		Type:        queue.EventCompleted,
+		JobID:       "job-1",
+		Status:      queue.StatusCompleted,
+		Owner:       "oidc:alice",
+		Model:       "isnet-general-use",
+		InputBytes:  2048,
+		OutputBytes: 4096,
+		DurationMs:  1500,
+		Timestamp:   at,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	event, err := ParseEvent(payload)
+	if err != nil {
+		t.Fatalf("ParseEvent: %v", err)
+	}
+	want := Event{
+		Version:     EventSchemaVersion,
+		Type:        "completed",
+		JobID:       "job-1",
+		Status:      "completed",
+		Owner:       "oidc:alice",
+		Model:       "isnet-general-use",
+		InputBytes:  2048,
+		OutputBytes: 4096,
+		DurationMs:  1500,
+		Timestamp:   at,
+	}
+	if *event != want {
+		t.Fatalf("got %+v, want %+v", *event, want)
+	}
+	if queue.EventSchemaVersion != EventSchemaVersion {
+		t.Fatalf("client reads schema %d, the queue publishes %d", EventSchemaVersion, queue.EventSchemaVersion)
+	}
+}
+
+func TestParseEventRejectsNewerSchema(t *testing.T) {
+	if _, err := ParseEvent([]byte(`{"v": 2, "type": "completed"}`)); err == nil {
+		t.Fatal("parsed an event of a newer schema")
+	}
+	if _, err := ParseEvent([]byte(`not json`)); err == nil {
+		t.Fatal("parsed an invalid payload")
+	}
+}
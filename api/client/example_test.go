@@ -0,0 +1,34 @@
+package client_test
+
+import (
+	"context"
+	"log"
+
+	"github.com/redis/go-redis/v9"
+
+	"rembg-v2/api/client"
+)
+
+// A consumer of job lifecycle events, such as a billing service, counting
+// the megabytes each owner had processed
+func ExampleParseEvent() {
+	ctx := context.Background()
+	rdb := redis.NewClient(&redis.Options{Addr: "localhost:6379"})
+	defer rdb.Close()
+
+	sub := rdb.Subscribe(ctx, "events:jobs")
+	defer sub.Close()
+
+	processed := make(map[string]int64)
+	for msg := range sub.Channel() {
+		event, err := client.ParseEvent([]byte(msg.Payload))
+		if err != nil {
+			log.Printf("Skipping event: %v", err)
+			continue
+		}
+		if event.Type == "completed" {
+			processed[event.Owner] += event.InputBytes
+			log.Printf("%s: job %s on %s, %d MB so far", event.Owner, event.JobID, event.Model, processed[event.Owner]>>20)
+		}
+	}
+}
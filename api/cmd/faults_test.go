@@ -0,0 +1,146 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"rembg-v2/api/internal/fault"
+)
+
+// setFault stores a rule through the admin API of a replica
+func setFault(t *testing.T, r replica, rule string) {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/faults", strings.NewReader(rule))
+	req.Header.Set("Content-Type", "application/json")
+	if w := serveRequest(r.router, req, testAdminKey); w.Code != http.StatusOK {
+		t.Fatalf("setting %s: got %d: %s", rule, w.Code, w.Body)
+	}
+}
+
+// clearFault removes the rule of a point through the admin API of a replica
+func clearFault(t *testing.T, r replica, point string) {
+	t.Helper()
+	if w := serve(r.router, http.MethodDelete, "/api/admin/faults/"+point, testAdminKey); w.Code != http.StatusOK {
+		t.Fatalf("clearing %s: got %d: %s", point, w.Code, w.Body)
+	}
+}
+
+// newFaultReplica starts a replica with fault injection enabled and no rules
+func newFaultReplica(t *testing.T) replica {
+	t.Helper()
+	t.Setenv("UPLOAD_DIR", t.TempDir())
+	t.Setenv("RESULTS_DIR", t.TempDir())
+	t.Setenv("ADMIN_API_KEY", testAdminKey)
+	fault.Enable()
+	fault.SetRules(nil)
+	t.Cleanup(func() { fault.SetRules(nil) })
+	replicas, _ := newReplicas(t, 1)
+	return replicas[0]
+}
+
+func TestFaultInjectionStorageSave(t *testing.T) {
+	r := newFaultReplica(t)
+
+	// A rule for another owner leaves this client's uploads alone
+	setFault(t, r, `{"point": "storage.save", "probability": 1, "fail": true, "match": {"owner": "10.0.0.7"}}`)
+	if w := r.submit(t, ""); w.Code != http.StatusAccepted {
+		t.Fatalf("upload with a rule for another owner: got %d: %s", w.Code, w.Body)
+	}
+
+	// Failed writes get 500, and after 3 in a row storage is reported down
+	setFault(t, r, `{"point": "storage.save", "probability": 1, "fail": true}`)
+	for i := 1; i <= 3; i++ {
+		if w := r.submit(t, ""); w.Code != http.StatusInternalServerError {
+			t.Fatalf("failed upload %d: got %d: %s", i, w.Code, w.Body)
+		}
+	}
+	w := r.submit(t, "")
+	var body struct {
+		ErrorCode string `json:"error_code"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusServiceUnavailable || body.ErrorCode != "storage_unavailable" || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("upload once storage is down: got %d %s, want 503 storage_unavailable", w.Code, w.Body)
+	}
+
+	// The injected faults are counted per point
+	vars := serve(r.router, http.MethodGet, "/debug/vars", testAdminKey)
+	var counters struct {
+		Injected map[string]int `json:"faults_injected"`
+	}
+	if err := json.Unmarshal(vars.Body.Bytes(), &counters); err != nil || counters.Injected[fault.StorageSave] < 3 {
+		t.Fatalf("faults_injected = %v, %v, want at least 3 for %s", counters.Injected, err, fault.StorageSave)
+	}
+}
+
+func TestFaultInjectionRedis(t *testing.T) {
+	r := newFaultReplica(t)
+	submitted := r.submit(t, "")
+	var job struct {
+		JobID string `json:"job_id"`
+	}
+	if err := json.Unmarshal(submitted.Body.Bytes(), &job); err != nil || job.JobID == "" {
+		t.Fatalf("submission: got %d: %s", submitted.Code, submitted.Body)
+	}
+	result := "/api/result?id=" + job.JobID
+
+	// Latency alone delays the request without failing it
+	setFault(t, r, `{"point": "redis", "probability": 1, "latency_ms": 50, "match": {"job_id": "`+job.JobID+`"}}`)
+	started := time.Now()
+	if w := serve(r.router, http.MethodGet, result, ""); w.Code != http.StatusOK {
+		t.Fatalf("result with added latency: got %d: %s", w.Code, w.Body)
+	}
+	if took := time.Since(started); took < 50*time.Millisecond {
+		t.Fatalf("result with 50ms of added latency took %s", took)
+	}
+
+	// Failed reads of the job are reported as the queue being down rather
+	// than the job missing
+	setFault(t, r, `{"point": "redis", "probability": 1, "fail": true, "match": {"job_id": "`+job.JobID+`"}}`)
+	w := serve(r.router, http.MethodGet, result, "")
+	var body struct {
+		ErrorCode string `json:"error_code"`
+	}
+	json.Unmarshal(w.Body.Bytes(), &body)
+	if w.Code != http.StatusServiceUnavailable || body.ErrorCode != "queue_unavailable" || w.Header().Get("Retry-After") == "" {
+		t.Fatalf("result with failing reads: got %d %s, want 503 queue_unavailable", w.Code, w.Body)
+	}
+
+	// Other jobs are untouched, but submissions can't queue their job
+	if w := r.submit(t, ""); w.Code != http.StatusAccepted {
+		t.Fatalf("submission with a rule for another job: got %d: %s", w.Code, w.Body)
+	}
+	setFault(t, r, `{"point": "redis", "probability": 1, "fail": true}`)
+	if w := r.submit(t, ""); w.Code != http.StatusInternalServerError {
+		t.Fatalf("submission with failing writes: got %d: %s", w.Code, w.Body)
+	}
+
+	// Clearing the rule restores the job
+	clearFault(t, r, fault.Redis)
+	if w := serve(r.router, http.MethodGet, result, ""); w.Code != http.StatusOK {
+		t.Fatalf("result after clearing the rule: got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestFaultInjectionRejectsInvalidRules(t *testing.T) {
+	r := newFaultReplica(t)
+	for _, rule := range []string{
+		`{"point": "storage.load", "probability": 1, "fail": true}`,
+		`{"point": "redis", "probability": 0, "fail": true}`,
+		`{"point": "redis", "probability": 1}`,
+		`{"point": "redis", "probability": 1, "latency_ms": -1, "fail": true}`,
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/admin/faults", strings.NewReader(rule))
+		req.Header.Set("Content-Type", "application/json")
+		if w := serveRequest(r.router, req, testAdminKey); w.Code != http.StatusBadRequest {
+			t.Errorf("%s: got %d, want %d", rule, w.Code, http.StatusBadRequest)
+		}
+	}
+	if rules := fault.Rules(); len(rules) != 0 {
+		t.Fatalf("invalid rules were applied: %v", rules)
+	}
+}
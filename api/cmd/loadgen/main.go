@@ -0,0 +1,420 @@
+// Command loadgen drives a configurable mix of submissions, status polls, and
+// downloads against the API and checks the results against SLOs
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"io"
+	"log"
+	"math/rand"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"rembg-v2/api/client"
+)
+
+// Operation names
+const (
+	opSubmit   = "submit"
+	opPoll     = "poll"
+	opDownload = "download"
+)
+
+func main() {
+	target := flag.String("target", "http://localhost:8080", "Base URL of the API")
+	rps := flag.Float64("rps", 10, "Operations per second")
+	duration := flag.Duration("duration", time.Minute, "How long to run")
+	concurrency := flag.Int("concurrency", 50, "Maximum in-flight operations")
+	mix := flag.String("mix", "submit=1,poll=5,download=1", "Relative weights of operations")
+	sizes := flag.String("sizes", "512x512,1920x1080", "Comma-separated WxH sizes of synthetic images")
+	soak := flag.Bool("soak", false, "Track target memory and goroutine growth via /debug/vars")
+	adminKey := flag.String("admin-key", os.Getenv("ADMIN_API_KEY"), "Admin key /debug/vars requires, for -soak")
+	maxErrorRate := flag.Float64("max-error-rate", 0.01, "Fail if the error rate exceeds this fraction")
+	maxP99 := flag.Duration("max-p99", 2*time.Second, "Fail if any operation's p99 latency exceeds this")
+	flag.Parse()
+
+	weights, err := parseMix(*mix)
+	if err != nil {
+		log.Fatalf("Invalid -mix: %v", err)
+	}
+	images, err := syntheticImages(*sizes)
+	if err != nil {
+		log.Fatalf("Invalid -sizes: %v", err)
+	}
+
+	api := client.New(*target)
+	gen := &generator{
+		api:     api,
+		images:  images,
+		weights: weights,
+		stats:   newStats(),
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *duration)
+	defer cancel()
+
+	var samples []soakSample
+	if *soak {
+		samples = append(samples, sampleTarget(*target, *adminKey))
+	}
+
+	start := time.Now()
+	gen.run(ctx, *rps, *concurrency, func() {
+		if *soak {
+			samples = append(samples, sampleTarget(*target, *adminKey))
+		}
+	})
+	elapsed := time.Since(start)
+
+	ok := gen.stats.report(os.Stdout, elapsed, *maxErrorRate, *maxP99)
+	if *soak {
+		reportSoak(os.Stdout, samples)
+	}
+	if !ok {
+		os.Exit(1)
+	}
+}
+
+// generator issues operations and records their outcomes
+type generator struct {
+	api     *client.Client
+	images  [][]byte
+	weights map[string]int
+	stats   *stats
+
+	mu        sync.Mutex
+	submitted []string
+	completed []string
+}
+
+// run issues operations at rps until ctx is done, calling tick every 10 seconds
+func (g *generator) run(ctx context.Context, rps float64, concurrency int, tick func()) {
+	interval := time.Duration(float64(time.Second) / rps)
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	progress := time.NewTicker(10 * time.Second)
+	defer progress.Stop()
+
+	sem := make(chan struct{}, concurrency)
+	var wg sync.WaitGroup
+
+	for {
+		select {
+		case <-ctx.Done():
+			wg.Wait()
+			return
+		case <-progress.C:
+			tick()
+		case <-ticker.C:
+			select {
+			case sem <- struct{}{}:
+			default:
+				// Too many operations in flight; count as a client-side drop
+				g.stats.record("dropped", 0, errors.New("concurrency limit"))
+				continue
+			}
+
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				defer func() { <-sem }()
+				g.do(ctx, g.pick())
+			}()
+		}
+	}
+}
+
+// pick chooses an operation by weight, falling back to submit when there is nothing to poll
+func (g *generator) pick() string {
+	total := 0
+	for _, w := range g.weights {
+		total += w
+	}
+
+	n := rand.Intn(total)
+	for _, op := range []string{opSubmit, opPoll, opDownload} {
+		if n < g.weights[op] {
+			return op
+		}
+		n -= g.weights[op]
+	}
+	return opSubmit
+}
+
+// do runs one operation and records its latency and outcome
+func (g *generator) do(ctx context.Context, op string) {
+	switch op {
+	case opPoll:
+		if jobID := g.randomJob(&g.submitted); jobID != "" {
+			start := time.Now()
+			result, err := g.api.Result(ctx, jobID)
+			g.stats.record(op, time.Since(start), err)
+			if err == nil && result.Status == "completed" {
+				g.addJob(&g.completed, jobID)
+			}
+			return
+		}
+	case opDownload:
+		if jobID := g.randomJob(&g.completed); jobID != "" {
+			start := time.Now()
+			_, err := g.api.Download(ctx, jobID, io.Discard)
+			g.stats.record(op, time.Since(start), err)
+			return
+		}
+	}
+
+	img := g.images[rand.Intn(len(g.images))]
+	start := time.Now()
+	result, err := g.api.Submit(ctx, "loadgen.png", bytes.NewReader(img))
+	g.stats.record(opSubmit, time.Since(start), err)
+	if err == nil {
+		g.addJob(&g.submitted, result.JobID)
+	}
+}
+
+func (g *generator) addJob(list *[]string, jobID string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	*list = append(*list, jobID)
+}
+
+func (g *generator) randomJob(list *[]string) string {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if len(*list) == 0 {
+		return ""
+	}
+	return (*list)[rand.Intn(len(*list))]
+}
+
+// stats collects latencies and outcomes per operation
+type stats struct {
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+	errors    map[string]int
+	total     int
+	failed    int
+}
+
+func newStats() *stats {
+	return &stats{
+		latencies: make(map[string][]time.Duration),
+		errors:    make(map[string]int),
+	}
+}
+
+func (s *stats) record(op string, latency time.Duration, err error) {
+	// Context cancellation at the end of the run isn't a target failure
+	if errors.Is(err, context.DeadlineExceeded) || errors.Is(err, context.Canceled) {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.total++
+	if op != "dropped" {
+		s.latencies[op] = append(s.latencies[op], latency)
+	}
+	if err == nil {
+		return
+	}
+
+	s.failed++
+	var apiErr *client.APIError
+	if errors.As(err, &apiErr) {
+		s.errors[strconv.Itoa(apiErr.StatusCode)]++
+	} else if op == "dropped" {
+		s.errors["dropped"]++
+	} else {
+		s.errors["transport"]++
+	}
+}
+
+// report prints the summary and returns whether the SLOs were met
+func (s *stats) report(w io.Writer, elapsed time.Duration, maxErrorRate float64, maxP99 time.Duration) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ok := true
+	fmt.Fprintf(w, "Ran %d operations in %v (%.1f ops/s)\n", s.total, elapsed.Round(time.Millisecond), float64(s.total)/elapsed.Seconds())
+
+	fmt.Fprintf(w, "%-10s %8s %10s %10s %10s\n", "operation", "count", "p50", "p90", "p99")
+	for _, op := range []string{opSubmit, opPoll, opDownload} {
+		latencies := s.latencies[op]
+		if len(latencies) == 0 {
+			continue
+		}
+		sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+		p99 := percentile(latencies, 0.99)
+		fmt.Fprintf(w, "%-10s %8d %10v %10v %10v\n", op, len(latencies),
+			percentile(latencies, 0.50), percentile(latencies, 0.90), p99)
+
+		if p99 > maxP99 {
+			fmt.Fprintf(w, "SLO violated: %s p99 %v exceeds %v\n", op, p99, maxP99)
+			ok = false
+		}
+	}
+
+	errorRate := 0.0
+	if s.total > 0 {
+		errorRate = float64(s.failed) / float64(s.total)
+	}
+	fmt.Fprintf(w, "Errors: %d (%.2f%%)\n", s.failed, errorRate*100)
+	for code, n := range s.errors {
+		fmt.Fprintf(w, "  %s: %d\n", code, n)
+	}
+	if errorRate > maxErrorRate {
+		fmt.Fprintf(w, "SLO violated: error rate %.2f%% exceeds %.2f%%\n", errorRate*100, maxErrorRate*100)
+		ok = false
+	}
+
+	return ok
+}
+
+// percentile returns the p-th percentile of sorted latencies
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	i := int(float64(len(sorted)-1) * p)
+	return sorted[i].Round(time.Millisecond)
+}
+
+// soakSample is a snapshot of the target's runtime state
+type soakSample struct {
+	At         time.Time
+	HeapAlloc  uint64
+	Goroutines int
+	Err        error
+}
+
+// sampleTarget reads memory and goroutine counts from the target's
+// /debug/vars, which needs the admin key
+func sampleTarget(target, adminKey string) soakSample {
+	sample := soakSample{At: time.Now()}
+
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(target, "/")+"/debug/vars", nil)
+	if err != nil {
+		sample.Err = err
+		return sample
+	}
+	req.Header.Set("X-Admin-Key", adminKey)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		sample.Err = err
+		return sample
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		sample.Err = fmt.Errorf("/debug/vars: %s", resp.Status)
+		return sample
+	}
+
+	var vars struct {
+		Memstats struct {
+			HeapAlloc uint64 `json:"HeapAlloc"`
+		} `json:"memstats"`
+		Goroutines int `json:"goroutines"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&vars); err != nil {
+		sample.Err = err
+		return sample
+	}
+
+	sample.HeapAlloc = vars.Memstats.HeapAlloc
+	sample.Goroutines = vars.Goroutines
+	return sample
+}
+
+// reportSoak prints the growth of memory and goroutines over the run
+func reportSoak(w io.Writer, samples []soakSample) {
+	var valid []soakSample
+	for _, s := range samples {
+		if s.Err == nil {
+			valid = append(valid, s)
+		}
+	}
+	if len(valid) < 2 {
+		fmt.Fprintln(w, "Soak: not enough samples from /debug/vars")
+		return
+	}
+
+	first, last := valid[0], valid[len(valid)-1]
+	fmt.Fprintf(w, "Soak: heap %d -> %d bytes, goroutines %d -> %d over %v\n",
+		first.HeapAlloc, last.HeapAlloc, first.Goroutines, last.Goroutines,
+		last.At.Sub(first.At).Round(time.Second))
+}
+
+// parseMix parses "op=weight,..." into operation weights
+func parseMix(value string) (map[string]int, error) {
+	weights := make(map[string]int)
+	for _, entry := range strings.Split(value, ",") {
+		op, weight, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			return nil, fmt.Errorf("entry %q is not op=weight", entry)
+		}
+		if op != opSubmit && op != opPoll && op != opDownload {
+			return nil, fmt.Errorf("unknown operation %q", op)
+		}
+		n, err := strconv.Atoi(weight)
+		if err != nil || n < 0 {
+			return nil, fmt.Errorf("invalid weight %q", weight)
+		}
+		weights[op] = n
+	}
+	if weights[opSubmit] == 0 {
+		return nil, errors.New("submit weight must be positive")
+	}
+	return weights, nil
+}
+
+// syntheticImages generates one PNG per "WxH" size
+func syntheticImages(value string) ([][]byte, error) {
+	var images [][]byte
+	for _, size := range strings.Split(value, ",") {
+		ws, hs, ok := strings.Cut(strings.TrimSpace(size), "x")
+		w, errW := strconv.Atoi(ws)
+		h, errH := strconv.Atoi(hs)
+		if !ok || errW != nil || errH != nil || w <= 0 || h <= 0 {
+			return nil, fmt.Errorf("invalid size %q", size)
+		}
+
+		// A gradient with a centered disc gives the model a subject to find
+		img := image.NewNRGBA(image.Rect(0, 0, w, h))
+		cx, cy, r := w/2, h/2, minInt(w, h)/3
+		for y := 0; y < h; y++ {
+			for x := 0; x < w; x++ {
+				c := color.NRGBA{R: uint8(x * 255 / w), G: uint8(y * 255 / h), B: 128, A: 255}
+				if (x-cx)*(x-cx)+(y-cy)*(y-cy) < r*r {
+					c = color.NRGBA{R: 240, G: 60, B: 40, A: 255}
+				}
+				img.SetNRGBA(x, y, c)
+			}
+		}
+
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, err
+		}
+		images = append(images, buf.Bytes())
+	}
+	return images, nil
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -2,49 +2,223 @@ package main
 
 import (
 	"context"
+	"encoding/json"
+	"expvar"
+	"flag"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"runtime"
+	"strconv"
+	"strings"
 	"syscall"
 	"time"
 
 	"github.com/gin-contrib/cors"
 	"github.com/gin-gonic/gin"
 
+	"rembg-v2/api/internal/anomaly"
+	"rembg-v2/api/internal/auth"
+	"rembg-v2/api/internal/coldstorage"
+	"rembg-v2/api/internal/config"
+	"rembg-v2/api/internal/delivery"
+	"rembg-v2/api/internal/fault"
+	"rembg-v2/api/internal/filecache"
 	"rembg-v2/api/internal/handlers"
+	"rembg-v2/api/internal/maintenance"
 	"rembg-v2/api/internal/queue"
 )
 
 func main() {
-	// Setup Redis connection for job queue
-	jobQueue, err := queue.NewRedisQueue(getEnv("REDIS_URL", "localhost:6379"), 0)
+	dryRun := flag.Bool("dry-run", false, "Report pending queue migrations without applying them, then exit")
+	flag.Parse()
+
+	// Keep jobs in Redis, in SQS and DynamoDB, in NATS JetStream, or in
+	// process memory for local development
+	backend, err := config.QueueBackend()
 	if err != nil {
-		log.Fatalf("Failed to connect to Redis: %v", err)
+		log.Fatalf("Invalid queue configuration: %v", err)
+	}
+	var jobs queue.JobQueue
+	var jobQueue *queue.RedisQueue
+	switch backend {
+	case config.BackendMemory:
+		memoryQueue := config.OpenMemoryQueue()
+		defer memoryQueue.Close()
+		jobs = memoryQueue
+		log.Printf("Warning: jobs are kept in memory, lost on exit, and can't be claimed by workers in other processes")
+	case config.BackendSQS:
+		if jobs, err = config.OpenSQSQueue(context.Background()); err != nil {
+			log.Fatalf("Failed to open the SQS queue: %v", err)
+		}
+	case config.BackendNATS:
+		natsQueue, err := config.OpenNATSQueue()
+		if err != nil {
+			log.Fatalf("Failed to connect to NATS: %v", err)
+		}
+		defer natsQueue.Close()
+		jobs = natsQueue
+	default:
+		// Setup Redis connection for job queue
+		jobQueue, err = config.OpenQueue()
+		if err != nil {
+			log.Fatalf("Failed to open the Redis queue: %v", err)
+		}
+		jobs = jobQueue
+	}
+
+	// Bring stored queue data up to the current format; only Redis data
+	// has migrations
+	if jobQueue != nil {
+		results, err := jobQueue.Migrate(context.Background(), *dryRun)
+		if err != nil {
+			log.Fatalf("Failed to migrate queue data: %v", err)
+		}
+		if *dryRun {
+			report, _ := json.MarshalIndent(results, "", "  ")
+			log.Printf("Pending migrations:\n%s", report)
+			return
+		}
+	} else if *dryRun {
+		log.Printf("The %s backend has no queue data migrations", backend)
+		return
 	}
 
 	// Initialize router
-	router := gin.Default()
+	router, err := newRouter(getEnv("TRUSTED_PROXIES", ""))
+	if err != nil {
+		log.Fatalf("Invalid TRUSTED_PROXIES: %v", err)
+	}
 
-	// Configure CORS
-	router.Use(cors.New(cors.Config{
-		AllowOrigins:     []string{"*"},
-		AllowMethods:     []string{"GET", "POST", "OPTIONS"},
-		AllowHeaders:     []string{"Origin", "Content-Type", "Accept"},
-		ExposeHeaders:    []string{"Content-Length"},
-		AllowCredentials: true,
-		MaxAge:           12 * time.Hour,
+	// Expose connection pool statistics and goroutine count
+	if jobQueue != nil {
+		expvar.Publish("redis_pool", expvar.Func(func() any {
+			return jobQueue.PoolStats()
+		}))
+	}
+	expvar.Publish("goroutines", expvar.Func(func() any {
+		return runtime.NumGoroutine()
 	}))
 
+	// Fault injection stays inert unless explicitly enabled
+	if getEnv("FAULT_INJECTION", "false") == "true" {
+		fault.Enable()
+		log.Printf("Warning: fault injection is enabled")
+	}
+
+	// Accept bearer tokens from an OIDC issuer when one is configured
+	var handlerOpts []handlers.Option
+	if issuer := getEnv("OIDC_ISSUER", ""); issuer != "" {
+		audience := getEnv("OIDC_AUDIENCE", "")
+		if audience == "" {
+			log.Fatalf("OIDC_AUDIENCE is required when OIDC_ISSUER is set")
+		}
+		verifier := auth.NewVerifier(auth.Config{
+			Issuer:     issuer,
+			Audience:   audience,
+			OwnerClaim: getEnv("OIDC_OWNER_CLAIM", auth.DefaultOwnerClaim),
+			TierClaim:  getEnv("OIDC_TIER_CLAIM", ""),
+			ClockSkew:  time.Duration(getEnvInt("OIDC_CLOCK_SKEW_SECONDS", int(auth.DefaultClockSkew/time.Second))) * time.Second,
+		})
+		handlerOpts = append(handlerOpts, handlers.WithBearerAuth(verifier, getEnv("AUTH_REQUIRED", "false") == "true"))
+	}
+
+	// In privacy mode, filenames are only indexed as a keyed hash
+	if getEnv("PRIVACY_MODE", "false") == "true" {
+		key := getEnv("FILENAME_INDEX_KEY", "")
+		if key == "" {
+			log.Fatalf("FILENAME_INDEX_KEY is required when PRIVACY_MODE is enabled")
+		}
+		handlerOpts = append(handlerOpts, handlers.WithFilenamePrivacy([]byte(key)))
+	}
+
+	// Buffer submissions in memory through brief Redis outages, at the risk
+	// of losing them if the process crashes
+	if getEnv("WRITE_BEHIND", "false") == "true" {
+		handlerOpts = append(handlerOpts, handlers.WithWriteBehind(getEnvInt("WRITE_BEHIND_CAPACITY", 100)))
+	}
+
+	// Keep hot results on local disk in front of shared storage
+	if dir := getEnv("RESULT_CACHE_DIR", ""); dir != "" {
+		cache, err := filecache.Open(dir, int64(getEnvInt("RESULT_CACHE_MAX_BYTES", 1<<30)))
+		if err != nil {
+			log.Fatalf("Failed to open result cache: %v", err)
+		}
+		handlerOpts = append(handlerOpts, handlers.WithResultCache(cache))
+	}
+
+	// Archive completed jobs to cold storage before they're torn down
+	if dir := getEnv("ARCHIVE_DIR", ""); dir != "" {
+		archiver, err := coldstorage.NewDirArchiver(dir)
+		if err != nil {
+			log.Fatalf("Failed to open the archive directory: %v", err)
+		}
+		handlerOpts = append(handlerOpts, handlers.WithArchiver(archiver))
+	}
+
+	// Watch failure rates, from the outcome counters kept in Redis, and
+	// alert operators on spikes
+	var watcher *anomaly.Watcher
+	if jobQueue != nil {
+		alerter, err := anomaly.NewAlerter(getEnv("ALERTER", anomaly.AlerterLog), getEnv("ALERT_WEBHOOK_URL", ""))
+		if err != nil {
+			log.Fatalf("Invalid alerter configuration: %v", err)
+		}
+		watcher = anomaly.NewWatcher(anomalyConfigFromEnv(), jobQueue, alerter)
+		handlerOpts = append(handlerOpts, handlers.WithAnomalyWatcher(watcher))
+	}
+
+	// Pause the queue during scheduled maintenance windows
+	windows, err := maintenance.ParseWindows(getEnv("MAINTENANCE_WINDOWS", ""))
+	if err != nil {
+		log.Fatalf("Invalid MAINTENANCE_WINDOWS: %v", err)
+	}
+	var scheduler *maintenance.Scheduler
+	if jobQueue != nil {
+		scheduler = maintenance.NewScheduler(windows, jobQueue, queue.SystemClock{})
+		if len(windows) > 0 {
+			handlerOpts = append(handlerOpts, handlers.WithMaintenanceScheduler(scheduler))
+		}
+	} else if len(windows) > 0 {
+		log.Fatalf("MAINTENANCE_WINDOWS needs the Redis queue backend")
+	}
+
 	// Create handler with queue dependency
-	h := handlers.NewHandler(jobQueue)
+	h := handlers.NewHandler(jobs, handlerOpts...)
 
-	// Define API endpoints
-	api := router.Group("/api")
-	{
-		api.POST("/process", h.ProcessImage)
-		api.GET("/result", h.GetResult)
+	// Pre-warm connections and storage directories before taking traffic
+	warmCtx, cancelWarm := context.WithTimeout(context.Background(), 10*time.Second)
+	if err := h.Warm(warmCtx); err != nil {
+		log.Printf("Warm-up failed: %v", err)
 	}
+	cancelWarm()
+
+	registerRoutes(router, h)
+
+	// Stop the background tasks on shutdown
+	ctx, stop := context.WithCancel(context.Background())
+	defer stop()
+
+	// Run the sweeps, promotions, and deliveries that work through Redis
+	if jobQueue != nil {
+		runRedisTasks(ctx, jobQueue, h, watcher, scheduler)
+	}
+
+	// Write submissions buffered during Redis outages
+	go h.RunWriteBehind(ctx)
+
+	// Pick up fault injection rules set on any replica
+	go h.WatchFaults(ctx)
+
+	// Register this replica so operators can see every live API instance
+	go h.RunInstanceHeartbeat(ctx)
+
+	// Probe storage and Redis so degraded dependencies recover automatically
+	go h.MonitorHealth(ctx)
+
+	// Refresh cached capabilities when feature flags or warm models change
+	go h.WatchCapabilities(ctx)
 
 	// Create server with graceful shutdown
 	srv := &http.Server{
@@ -67,12 +241,21 @@ func main() {
 	log.Println("Shutting down server...")
 
 	// Graceful shutdown with timeout
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	stop()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
-	if err := srv.Shutdown(ctx); err != nil {
+	err = srv.Shutdown(shutdownCtx)
+	// Handlers still running won't finish; don't leave their uploads behind
+	h.AbortUploads()
+	if err != nil {
 		log.Fatalf("Server forced to shutdown: %v", err)
 	}
 
+	// Write any buffered submissions before exiting
+	drainCtx, cancelDrain := context.WithTimeout(context.Background(), time.Duration(getEnvInt("WRITE_BEHIND_DRAIN_SECONDS", 10))*time.Second)
+	defer cancelDrain()
+	h.DrainWriteBehind(drainCtx)
+
 	log.Println("Server exited properly")
 }
 
@@ -83,4 +266,255 @@ func getEnv(key, defaultValue string) string {
 		return defaultValue
 	}
 	return value
-} 
\ No newline at end of file
+}
+
+// anomalyConfigFromEnv reads the failure-rate alert thresholds
+func anomalyConfigFromEnv() anomaly.Config {
+	cfg := anomaly.DefaultConfig()
+	seconds := func(key string, d time.Duration) time.Duration {
+		return time.Duration(getEnvInt(key, int(d/time.Second))) * time.Second
+	}
+	cfg.Window = seconds("ANOMALY_WINDOW_SECONDS", cfg.Window)
+	cfg.Baseline = seconds("ANOMALY_BASELINE_SECONDS", cfg.Baseline)
+	cfg.Cooldown = seconds("ANOMALY_COOLDOWN_SECONDS", cfg.Cooldown)
+	cfg.MinJobs = int64(getEnvInt("ANOMALY_MIN_JOBS", int(cfg.MinJobs)))
+	if rate, err := strconv.ParseFloat(getEnv("ANOMALY_MIN_RATE", ""), 64); err == nil {
+		cfg.MinRate = rate
+	}
+	if factor, err := strconv.ParseFloat(getEnv("ANOMALY_SPIKE_FACTOR", ""), 64); err == nil {
+		cfg.SpikeFactor = factor
+	}
+	return cfg
+}
+
+// getEnvInt returns the environment variable as an int or a default if not set or invalid
+func getEnvInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// newRouter creates the router with the global middleware. Client IPs are
+// taken from X-Forwarded-For only on requests from trustedProxies, a
+// comma-separated list of IPs and CIDR ranges; with none, anyone could
+// claim another client's IP, and with it their anonymous quota.
+func newRouter(trustedProxies string) (*gin.Engine, error) {
+	router := gin.New()
+	var proxies []string
+	for _, proxy := range strings.Split(trustedProxies, ",") {
+		if proxy = strings.TrimSpace(proxy); proxy != "" {
+			proxies = append(proxies, proxy)
+		}
+	}
+	if err := router.SetTrustedProxies(proxies); err != nil {
+		return nil, err
+	}
+
+	// Trailing slashes and case variants are redirected by h.CanonicalRoutes.
+	// Gin's own RedirectTrailingSlash answers with 301 or 307, never 308,
+	// ignores case, and redirects before any middleware runs, so clients
+	// would get no CORS headers and no authentication check
+	router.RedirectTrailingSlash = false
+	router.Use(handlers.AccessLogger(), gin.Recovery())
+
+	// Configure CORS
+	router.Use(cors.New(cors.Config{
+		AllowOrigins:     []string{"*"},
+		AllowMethods:     []string{"GET", "POST", "DELETE", "OPTIONS"},
+		AllowHeaders:     []string{"Origin", "Content-Type", "Accept", "Authorization", "Idempotency-Key", "X-Admin-Key"},
+		ExposeHeaders:    []string{"Content-Length"},
+		AllowCredentials: true,
+		MaxAge:           12 * time.Hour,
+	}))
+	return router, nil
+}
+
+// registerRoutes defines the API's routes on router. Health probes are
+// open to all, the API authenticates its caller, and the admin endpoints
+// and internal counters need the admin key.
+func registerRoutes(router *gin.Engine, h *handlers.Handler) {
+	// Health checks stay unauthenticated for probes
+	router.GET("/api/health", h.GetHealth)
+	router.GET("/healthz", h.GetLiveness)
+	router.GET("/readyz", h.GetReadiness)
+
+	// Define API endpoints
+	api := router.Group("/api", h.Authenticate)
+	{
+		api.POST("/process", h.ProcessImage)
+		api.POST("/process/fanout", h.ProcessFanout)
+		api.POST("/process/archive", h.ProcessArchive)
+		api.GET("/fanout/:id", h.GetFanout)
+		api.GET("/jobs/search", h.SearchJobs)
+		api.GET("/result", h.GetResult)
+		api.GET("/job/:id/timeline", h.GetJobTimeline)
+		api.POST("/job/:id/transfer", h.TransferJob)
+		api.POST("/job/:id/cancel", h.CancelJob)
+		api.DELETE("/job/:id", h.DeleteJob)
+		api.GET("/usage", h.GetUsage)
+		api.GET("/capabilities", h.GetCapabilities)
+		api.GET("/models", h.GetModels)
+		api.GET("/download/batch", h.DownloadBatch)
+		api.GET("/download/:id", h.DownloadResult)
+		api.GET("/download/:id/preview", h.DownloadPreview)
+		api.POST("/download/:id/token", h.CreateDownloadToken)
+		api.POST("/download/:id/limits", h.SetDownloadLimits)
+		api.GET("/download/by-token/:token", h.DownloadByToken)
+		api.GET("/keys", h.ListAPIKeys)
+		api.POST("/keys/rotate", h.RotateAPIKey)
+	}
+
+	// Define admin endpoints, open only to requests with the admin key
+	admin := api.Group("/admin", h.RequireAdmin)
+	{
+		admin.GET("/diff", h.DiffResults)
+		admin.GET("/redis-usage", h.RedisUsage)
+		admin.POST("/repair/formats", h.RepairFormats)
+		admin.POST("/warm", h.WarmPools)
+		admin.POST("/requeue-failed", h.RequeueFailedJobs)
+		admin.GET("/top-downloads", h.TopDownloads)
+		admin.GET("/stats", h.AdminStats)
+		admin.GET("/history", h.JobHistory)
+		admin.GET("/audit", h.AuditLog)
+		admin.POST("/pause", h.PauseQueue)
+		admin.POST("/resume", h.ResumeQueue)
+		admin.GET("/breaker", h.BreakerState)
+		admin.POST("/breaker/reset", h.ResetBreaker)
+		admin.GET("/dead", h.ListDeadJobs)
+		admin.GET("/faults", h.ListFaults)
+		admin.POST("/faults", h.SetFault)
+		admin.DELETE("/faults/:point", h.ClearFault)
+		admin.GET("/jobs", h.ListJobs)
+		admin.GET("/jobs/:id/timeline", h.AdminJobTimeline)
+		admin.POST("/jobs/:id/transfer", h.AdminTransferJob)
+		admin.GET("/owners/:key/policy", h.GetOwnerPolicy)
+		admin.PUT("/owners/:key/policy", h.SetOwnerPolicy)
+		admin.DELETE("/owners/:key/policy", h.ClearOwnerPolicy)
+		admin.POST("/owners/:key/keys", h.CreateOwnerAPIKey)
+	}
+
+	// Expose internal counters to monitoring that holds the admin key
+	router.GET("/debug/vars", h.RequireAdmin, gin.WrapH(expvar.Handler()))
+
+	// Redirect non-canonical spellings of the routes above
+	router.NoRoute(h.CanonicalRoutes(router))
+}
+
+// runRedisTasks starts the background tasks of the Redis backend, each
+// running on one replica at a time unless it's per replica, until ctx is done
+func runRedisTasks(ctx context.Context, jobQueue *queue.RedisQueue, h *handlers.Handler, watcher *anomaly.Watcher, scheduler *maintenance.Scheduler) {
+	// Periodically sample key usage so per-feature caps are enforced
+	if getEnv("REDIS_KEY_CAPS", "") != "" {
+		go runEvery(ctx, 5*time.Minute, func() {
+			if _, err := jobQueue.KeyUsage(ctx); err != nil {
+				log.Printf("Failed to sample Redis key usage: %v", err)
+			}
+		})
+	}
+
+	// Watch failure rates and alert operators on spikes
+	go watcher.Run(ctx)
+
+	// Remove shared fanout inputs once their last job has expired, on one replica at a time
+	go runExclusive(ctx, jobQueue, "reap_shared_inputs", 10*time.Minute, func() {
+		h.ReapSharedInputs(ctx)
+	})
+
+	// Remove jobs and files past their retention, on one replica at a time
+	go runExclusive(ctx, jobQueue, "sweep_expired", time.Minute, func() {
+		h.SweepExpired(ctx)
+	})
+
+	// Remove stored files whose job has expired or is past the maximum file
+	// age, on one replica at a time
+	if interval := getEnvInt("ORPHAN_SWEEP_INTERVAL_SECONDS", 3600); interval > 0 {
+		go runExclusive(ctx, jobQueue, "sweep_orphaned_files", time.Duration(interval)*time.Second, func() {
+			h.SweepOrphanedFiles(ctx)
+		})
+	}
+
+	// Queue scheduled jobs once they're due, on one replica at a time
+	go runExclusive(ctx, jobQueue, "promote_scheduled", 5*time.Second, func() {
+		h.PromoteScheduledJobs(ctx)
+	})
+
+	// Set the maintenance flags as windows start and end, and hand flags
+	// whose manual override was cleared back to the schedule, on one replica at a time
+	go runExclusive(ctx, jobQueue, "maintenance_windows", 15*time.Second, func() {
+		if err := scheduler.Evaluate(ctx); err != nil {
+			log.Printf("Failed to apply maintenance windows: %v", err)
+		}
+	})
+
+	// Stop jobs still unfinished at the end of their lifetime, on one replica at a time
+	go runExclusive(ctx, jobQueue, "enforce_lifetimes", time.Minute, func() {
+		h.EnforceLifetimes(ctx)
+	})
+
+	// Drop the status index entries of expired jobs and the history entries
+	// of expired summaries, on one replica at a time
+	go runExclusive(ctx, jobQueue, "prune_status_indexes", time.Minute, func() {
+		if _, err := jobQueue.PruneStatusIndexes(ctx); err != nil {
+			log.Printf("Failed to prune the job status indexes: %v", err)
+		}
+		if _, err := jobQueue.TrimHistory(ctx); err != nil {
+			log.Printf("Failed to trim the job history: %v", err)
+		}
+	})
+
+	// Requeue jobs claimed by workers that died before finishing them, on one replica at a time
+	go runExclusive(ctx, jobQueue, "recover_claims", queue.HeartbeatTTL, func() {
+		h.RecoverAbandonedJobs(ctx)
+	})
+
+	// Requeue or fail jobs stuck processing past the stale-job timeout, on one replica at a time
+	if timeout := getEnvInt("STALE_JOB_TIMEOUT_SECONDS", 1800); timeout > 0 {
+		interval := time.Duration(getEnvInt("STALE_JOB_REAP_INTERVAL_SECONDS", 60)) * time.Second
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		go runExclusive(ctx, jobQueue, "reap_stale_jobs", interval, func() {
+			h.ReapStaleJobs(ctx, time.Duration(timeout)*time.Second)
+		})
+	}
+
+	// Push completed results to their external destinations
+	maxDeliveryAttempts := getEnvInt("MAX_DELIVERY_ATTEMPTS", 5)
+	for i := 0; i < getEnvInt("DELIVERY_WORKERS", 1); i++ {
+		go delivery.NewWorker(jobQueue, maxDeliveryAttempts).Run(ctx)
+	}
+}
+
+// runEvery calls fn on every tick of interval until ctx is done
+func runEvery(ctx context.Context, interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
+}
+
+// runExclusive calls fn on every tick of interval on whichever replica
+// takes the named lock first. The lock is kept until it expires shortly
+// before the next tick, so replicas whose tickers are offset don't repeat
+// the run within the same interval.
+func runExclusive(ctx context.Context, jobQueue *queue.RedisQueue, name string, interval time.Duration, fn func()) {
+	runEvery(ctx, interval, func() {
+		lock, err := jobQueue.TryLock(ctx, name, interval*9/10)
+		if err != nil {
+			log.Printf("Failed to take the %s lock: %v", name, err)
+			return
+		}
+		if lock != nil {
+			fn()
+		}
+	})
+}
@@ -0,0 +1,309 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"gopkg.in/yaml.v3"
+
+	"rembg-v2/api/internal/handlers"
+	"rembg-v2/api/internal/queue"
+)
+
+const testAdminKey = "test-admin-key"
+
+// newTestRouter registers the API's routes on a handler over an in-memory
+// queue, with ADMIN_API_KEY set to adminKey
+func newTestRouter(t *testing.T, adminKey string) *gin.Engine {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	t.Setenv("UPLOAD_DIR", t.TempDir())
+	t.Setenv("RESULTS_DIR", t.TempDir())
+	t.Setenv("ADMIN_API_KEY", adminKey)
+
+	jobs := queue.NewMemoryQueue(queue.Options{})
+	t.Cleanup(func() { jobs.Close() })
+	router := gin.New()
+	registerRoutes(router, handlers.NewHandler(jobs))
+	return router
+}
+
+// newRedisTestRouter is newTestRouter over a Redis queue on an in-process
+// Redis server, for the admin endpoints only the Redis backend has
+func newRedisTestRouter(t *testing.T) (*gin.Engine, *queue.RedisQueue) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	t.Setenv("UPLOAD_DIR", t.TempDir())
+	t.Setenv("RESULTS_DIR", t.TempDir())
+	t.Setenv("ADMIN_API_KEY", testAdminKey)
+
+	server := miniredis.RunT(t)
+	jobs, err := queue.NewRedisQueueWithClient(redis.NewClient(&redis.Options{Addr: server.Addr()}), queue.Options{})
+	if err != nil {
+		t.Fatalf("NewRedisQueueWithClient: %v", err)
+	}
+	t.Cleanup(func() { jobs.Close() })
+	router := gin.New()
+	registerRoutes(router, handlers.NewHandler(jobs))
+	return router, jobs
+}
+
+// adminRoutes returns the routes that must need the admin key
+func adminRoutes(router *gin.Engine) []gin.RouteInfo {
+	var routes []gin.RouteInfo
+	for _, route := range router.Routes() {
+		if strings.HasPrefix(route.Path, "/api/admin/") || route.Path == "/debug/vars" {
+			routes = append(routes, route)
+		}
+	}
+	return routes
+}
+
+// serve sends a request without a body to router, with the admin key
+// header set unless adminKey is empty
+func serve(router *gin.Engine, method, path, adminKey string) *httptest.ResponseRecorder {
+	return serveRequest(router, httptest.NewRequest(method, path, nil), adminKey)
+}
+
+// serveRequest sends req to router, with the admin key header set unless
+// adminKey is empty
+func serveRequest(router *gin.Engine, req *http.Request, adminKey string) *httptest.ResponseRecorder {
+	if adminKey != "" {
+		req.Header.Set("X-Admin-Key", adminKey)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+func TestAdminRoutesRequireAdminKey(t *testing.T) {
+	router := newTestRouter(t, testAdminKey)
+	routes := adminRoutes(router)
+	if len(routes) < 2 {
+		t.Fatalf("only %d admin routes registered", len(routes))
+	}
+	for _, route := range routes {
+		for _, tc := range []struct {
+			name string
+			key  string
+		}{
+			{"missing key", ""},
+			{"wrong key", "not-the-admin-key"},
+			{"key prefix", testAdminKey[:4]},
+		} {
+			if w := serve(router, route.Method, route.Path, tc.key); w.Code != http.StatusUnauthorized {
+				t.Errorf("%s %s with %s: got %d, want %d", route.Method, route.Path, tc.name, w.Code, http.StatusUnauthorized)
+			}
+		}
+	}
+}
+
+func TestAdminRoutesFailClosedWithoutAdminKey(t *testing.T) {
+	router := newTestRouter(t, "")
+	for _, route := range adminRoutes(router) {
+		for _, key := range []string{"", testAdminKey} {
+			if w := serve(router, route.Method, route.Path, key); w.Code != http.StatusForbidden {
+				t.Errorf("%s %s with key %q: got %d, want %d", route.Method, route.Path, key, w.Code, http.StatusForbidden)
+			}
+		}
+	}
+}
+
+func TestAdminRoutesAdmitAdminKey(t *testing.T) {
+	router := newTestRouter(t, testAdminKey)
+	for _, path := range []string{"/api/admin/stats", "/debug/vars"} {
+		if w := serve(router, http.MethodGet, path, testAdminKey); w.Code != http.StatusOK {
+			t.Fatalf("GET %s with the admin key: got %d, want %d: %s", path, w.Code, http.StatusOK, w.Body)
+		}
+	}
+}
+
+func TestPublicRoutesNeedNoAdminKey(t *testing.T) {
+	router := newTestRouter(t, testAdminKey)
+	for _, path := range []string{"/healthz", "/api/capabilities"} {
+		if w := serve(router, http.MethodGet, path, ""); w.Code == http.StatusUnauthorized || w.Code == http.StatusForbidden {
+			t.Errorf("GET %s: got %d without the admin key", path, w.Code)
+		}
+	}
+}
+
+func TestCreateOwnerAPIKeyRequiresAdminKey(t *testing.T) {
+	router, jobs := newRedisTestRouter(t)
+	ctx := context.Background()
+
+	// An owner's own API key doesn't make it an admin
+	_, ownKey, err := jobs.CreateAPIKey(ctx, "mallory", "", time.Now())
+	if err != nil {
+		t.Fatalf("CreateAPIKey: %v", err)
+	}
+	for _, tc := range []struct {
+		name     string
+		bearer   string
+		adminKey string
+	}{
+		{"anonymous", "", ""},
+		{"owner key", ownKey, ""},
+		{"owner key and wrong admin key", ownKey, "guess"},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/api/admin/owners/mallory/keys", strings.NewReader(`{"tier": "enterprise"}`))
+		req.Header.Set("Content-Type", "application/json")
+		if tc.bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.bearer)
+		}
+		if w := serveRequest(router, req, tc.adminKey); w.Code != http.StatusUnauthorized {
+			t.Errorf("%s: got %d, want %d", tc.name, w.Code, http.StatusUnauthorized)
+		}
+	}
+	keys, err := jobs.OwnerAPIKeys(ctx, "mallory")
+	if err != nil {
+		t.Fatalf("OwnerAPIKeys: %v", err)
+	}
+	if len(keys) != 1 {
+		t.Fatalf("mallory has %d keys after rejected requests, want 1", len(keys))
+	}
+
+	req := httptest.NewRequest(http.MethodPost, "/api/admin/owners/alice/keys", strings.NewReader(`{"tier": "pro"}`))
+	req.Header.Set("Content-Type", "application/json")
+	if w := serveRequest(router, req, testAdminKey); w.Code != http.StatusCreated {
+		t.Fatalf("with the admin key: got %d, want %d: %s", w.Code, http.StatusCreated, w.Body)
+	}
+}
+
+func TestClientIPIgnoresForwardedForFromUntrustedPeers(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		trusted string
+		want    string
+	}{
+		{"no trusted proxies", "", "203.0.113.7"},
+		{"another proxy trusted", "198.51.100.0/24", "203.0.113.7"},
+		{"the peer trusted", "10.0.0.1, 203.0.113.0/24", "192.0.2.1"},
+	} {
+		router, err := newRouter(tc.trusted)
+		if err != nil {
+			t.Fatalf("%s: newRouter: %v", tc.name, err)
+		}
+		router.GET("/ip", func(c *gin.Context) { c.String(http.StatusOK, c.ClientIP()) })
+
+		req := httptest.NewRequest(http.MethodGet, "/ip", nil)
+		req.RemoteAddr = "203.0.113.7:41000"
+		req.Header.Set("X-Forwarded-For", "192.0.2.1")
+		if w := serveRequest(router, req, ""); w.Body.String() != tc.want {
+			t.Errorf("%s: client IP = %s, want %s", tc.name, w.Body, tc.want)
+		}
+	}
+}
+
+func TestNewRouterRejectsInvalidTrustedProxies(t *testing.T) {
+	if _, err := newRouter("10.0.0.1, not-an-ip"); err == nil {
+		t.Fatalf("newRouter accepted an invalid trusted proxy")
+	}
+}
+
+func TestCanonicalRedirects(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("UPLOAD_DIR", t.TempDir())
+	t.Setenv("RESULTS_DIR", t.TempDir())
+	t.Setenv("ADMIN_API_KEY", testAdminKey)
+	router, err := newRouter("")
+	if err != nil {
+		t.Fatalf("newRouter: %v", err)
+	}
+	jobs := queue.NewMemoryQueue(queue.Options{})
+	t.Cleanup(func() { jobs.Close() })
+	registerRoutes(router, handlers.NewHandler(jobs))
+
+	for _, tc := range []struct {
+		method   string
+		path     string
+		bearer   string
+		code     int
+		location string
+	}{
+		{http.MethodPost, "/api/process/", "", http.StatusPermanentRedirect, "/api/process"},
+		{http.MethodGet, "/API/Result?id=x", "", http.StatusPermanentRedirect, "/api/result?id=x"},
+		{http.MethodGet, "/api/download/AbC12/", "", http.StatusPermanentRedirect, "/api/download/AbC12"},
+		{http.MethodGet, "/api/DOWNLOAD/AbC12/Preview", "", http.StatusPermanentRedirect, "/api/download/AbC12/preview"},
+		{http.MethodDelete, "/api/Job/AbC12/", "", http.StatusPermanentRedirect, "/api/job/AbC12"},
+		{http.MethodGet, "/api/health/", "", http.StatusPermanentRedirect, "/api/health"},
+		{http.MethodGet, "/Healthz", "", http.StatusPermanentRedirect, "/healthz"},
+		// Credentials the target would reject are rejected before redirecting
+		{http.MethodPost, "/api/process/", "rk_bogus", http.StatusUnauthorized, ""},
+		// The health check takes no credentials, so none are checked
+		{http.MethodGet, "/api/health/", "rk_bogus", http.StatusPermanentRedirect, "/api/health"},
+		{http.MethodGet, "/api/nowhere/", "", http.StatusNotFound, ""},
+		// A route spelled right but for another method is not redirected
+		{http.MethodGet, "/api/process/", "", http.StatusNotFound, ""},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		req.Header.Set("Origin", "https://app.example")
+		if tc.bearer != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.bearer)
+		}
+		w := serveRequest(router, req, "")
+		if w.Code != tc.code {
+			t.Errorf("%s %s: got %d, want %d: %s", tc.method, tc.path, w.Code, tc.code, w.Body)
+			continue
+		}
+		if got := w.Header().Get("Location"); got != tc.location {
+			t.Errorf("%s %s: Location = %q, want %q", tc.method, tc.path, got, tc.location)
+		}
+		if got := w.Header().Get("Access-Control-Allow-Origin"); got == "" {
+			t.Errorf("%s %s: no CORS headers", tc.method, tc.path)
+		}
+	}
+}
+
+func TestOpenAPISpecMatchesRoutes(t *testing.T) {
+	data, err := os.ReadFile("../openapi.yaml")
+	if err != nil {
+		t.Fatalf("read spec: %v", err)
+	}
+	var spec struct {
+		Paths map[string]map[string]struct {
+			Summary   string                    `yaml:"summary"`
+			Responses map[string]map[string]any `yaml:"responses"`
+		} `yaml:"paths"`
+	}
+	if err := yaml.Unmarshal(data, &spec); err != nil {
+		t.Fatalf("parse spec: %v", err)
+	}
+
+	var documented []string
+	for path, operations := range spec.Paths {
+		for method, op := range operations {
+			documented = append(documented, strings.ToUpper(method)+" "+path)
+			if op.Summary == "" {
+				t.Errorf("%s %s has no summary", method, path)
+			}
+			if _, ok := op.Responses["308"]; !ok {
+				t.Errorf("%s %s does not document its canonical redirect", method, path)
+			}
+		}
+	}
+	var registered []string
+	for _, route := range newTestRouter(t, testAdminKey).Routes() {
+		path := route.Path
+		for _, segment := range strings.Split(path, "/") {
+			if strings.HasPrefix(segment, ":") {
+				path = strings.Replace(path, segment, "{"+segment[1:]+"}", 1)
+			}
+		}
+		registered = append(registered, route.Method+" "+path)
+	}
+	sort.Strings(documented)
+	sort.Strings(registered)
+	if strings.Join(documented, "\n") != strings.Join(registered, "\n") {
+		t.Errorf("openapi.yaml is out of date\ndocumented:\n%s\n\nregistered:\n%s",
+			strings.Join(documented, "\n"), strings.Join(registered, "\n"))
+	}
+}
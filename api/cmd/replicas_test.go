@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+
+	"rembg-v2/api/internal/handlers"
+	"rembg-v2/api/internal/queue"
+)
+
+// replica is one API replica of a deployment sharing a Redis server
+type replica struct {
+	router  *gin.Engine
+	handler *handlers.Handler
+	jobs    *queue.RedisQueue
+}
+
+// newReplicas starts n API replicas over the same in-process Redis server
+// and upload directories, configured by the environment set before
+func newReplicas(t *testing.T, n int) ([]replica, *miniredis.Miniredis) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	server := miniredis.RunT(t)
+	replicas := make([]replica, n)
+	for i := range replicas {
+		jobs, err := queue.NewRedisQueueWithClient(redis.NewClient(&redis.Options{Addr: server.Addr()}), queue.Options{})
+		if err != nil {
+			t.Fatalf("NewRedisQueueWithClient: %v", err)
+		}
+		t.Cleanup(func() { jobs.Close() })
+		h := handlers.NewHandler(jobs)
+		router := gin.New()
+		registerRoutes(router, h)
+		replicas[i] = replica{router: router, handler: h, jobs: jobs}
+	}
+	return replicas, server
+}
+
+// submit uploads a 1x1 PNG to a replica, with an Idempotency-Key unless key is empty
+func (r replica) submit(t *testing.T, key string) *httptest.ResponseRecorder {
+	t.Helper()
+	var img bytes.Buffer
+	if err := png.Encode(&img, image.NewRGBA(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatalf("encoding the PNG: %v", err)
+	}
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile("image", "photo.png")
+	if err != nil {
+		t.Fatalf("CreateFormFile: %v", err)
+	}
+	part.Write(img.Bytes())
+	form.WriteField("dedupe", "false")
+	form.Close()
+
+	req := httptest.NewRequest(http.MethodPost, "/api/process", &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	if key != "" {
+		req.Header.Set("Idempotency-Key", key)
+	}
+	return serveRequest(r.router, req, "")
+}
+
+func TestTwoReplicasShareState(t *testing.T) {
+	t.Setenv("UPLOAD_DIR", t.TempDir())
+	t.Setenv("RESULTS_DIR", t.TempDir())
+	t.Setenv("ADMIN_API_KEY", testAdminKey)
+	t.Setenv("QUOTA_REQUESTS_PER_DAY", "2")
+	replicas, _ := newReplicas(t, 2)
+	a, b := replicas[0], replicas[1]
+
+	// A retry sent to the other replica replays the job
+	first := a.submit(t, "retry-me")
+	if first.Code != http.StatusAccepted {
+		t.Fatalf("submission to A: got %d: %s", first.Code, first.Body)
+	}
+	var created struct {
+		JobID string `json:"job_id"`
+	}
+	json.Unmarshal(first.Body.Bytes(), &created)
+	retry := b.submit(t, "retry-me")
+	var replayed struct {
+		JobID string `json:"job_id"`
+	}
+	json.Unmarshal(retry.Body.Bytes(), &replayed)
+	if retry.Header().Get("Idempotent-Replayed") != "true" || replayed.JobID != created.JobID {
+		t.Fatalf("retry to B: got %d %s, want a replay of %s", retry.Code, retry.Body, created.JobID)
+	}
+
+	// Either replica serves the job
+	if w := serve(b.router, http.MethodGet, "/api/result?id="+created.JobID, ""); w.Code != http.StatusOK {
+		t.Fatalf("job created on A, read from B: got %d: %s", w.Code, w.Body)
+	}
+
+	// The quota counts submissions to both replicas
+	if w := b.submit(t, ""); w.Code != http.StatusAccepted {
+		t.Fatalf("second submission, to B: got %d: %s", w.Code, w.Body)
+	}
+	if w := a.submit(t, ""); w.Code != http.StatusTooManyRequests {
+		t.Fatalf("third submission, to A, past a quota of 2: got %d: %s", w.Code, w.Body)
+	}
+}
+
+func TestTwoReplicasListEachOther(t *testing.T) {
+	t.Setenv("UPLOAD_DIR", t.TempDir())
+	t.Setenv("RESULTS_DIR", t.TempDir())
+	t.Setenv("ADMIN_API_KEY", testAdminKey)
+	replicas, _ := newReplicas(t, 2)
+
+	ctxA, stopA := context.WithCancel(context.Background())
+	ctxB, stopB := context.WithCancel(context.Background())
+	stoppedA := make(chan struct{})
+	stoppedB := make(chan struct{})
+	defer func() {
+		stopA()
+		<-stoppedA
+	}()
+	go func() {
+		defer close(stoppedA)
+		replicas[0].handler.RunInstanceHeartbeat(ctxA)
+	}()
+	go func() {
+		defer close(stoppedB)
+		replicas[1].handler.RunInstanceHeartbeat(ctxB)
+	}()
+
+	instances := func(r replica) int {
+		w := serve(r.router, http.MethodGet, "/api/admin/stats", testAdminKey)
+		var stats struct {
+			Instances []queue.InstanceHeartbeat `json:"api_instances"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &stats); err != nil {
+			t.Fatalf("stats: %d %s", w.Code, w.Body)
+		}
+		return len(stats.Instances)
+	}
+	deadline := time.Now().Add(2 * time.Second)
+	for instances(replicas[0]) < 2 && time.Now().Before(deadline) {
+		time.Sleep(5 * time.Millisecond)
+	}
+	for i, r := range replicas {
+		if n := instances(r); n != 2 {
+			t.Fatalf("replica %d lists %d replicas, want 2", i, n)
+		}
+	}
+
+	// A replica shutting down leaves the list at once
+	stopB()
+	<-stoppedB
+	if n := instances(replicas[0]); n != 1 {
+		t.Fatalf("after B stopped, A lists %d replicas, want 1", n)
+	}
+}
+
+func TestTwoReplicasRunExclusiveTasksOnce(t *testing.T) {
+	t.Setenv("UPLOAD_DIR", t.TempDir())
+	t.Setenv("RESULTS_DIR", t.TempDir())
+	replicas, server := newReplicas(t, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// Both replicas try the task every interval; the lock lets one run it
+	// until the lock expires, which the test controls with the Redis clock
+	const interval = 10 * time.Millisecond
+	var runs [2]atomic.Int64
+	for i := range replicas {
+		i := i
+		go runExclusive(ctx, replicas[i].jobs, "test_task", interval, func() { runs[i].Add(1) })
+	}
+	total := func() int64 { return runs[0].Load() + runs[1].Load() }
+
+	var seen int64
+	for period := 0; period < 5; period++ {
+		time.Sleep(10 * interval)
+		now := total()
+		if now-seen > 1 {
+			t.Fatalf("period %d: the task ran %d times, want at most once", period, now-seen)
+		}
+		seen = now
+		server.FastForward(interval)
+	}
+	if seen < 3 {
+		t.Fatalf("the task ran %d times in 5 lock periods, want at least 3", seen)
+	}
+}
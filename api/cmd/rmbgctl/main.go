@@ -0,0 +1,455 @@
+// Command rmbgctl inspects and repairs the job queue during incidents. It
+// reads the same REDIS_URL and JOB_* settings as the API and changes jobs
+// only through the queue package, so events, quota refunds, and outcome
+// counters stay consistent.
+//
+//	rmbgctl queue depth
+//	rmbgctl queue peek [--n 20] [--model u2net]
+//	rmbgctl job show <id>
+//	rmbgctl job requeue <id> --yes
+//	rmbgctl job fail <id> [--code manual] [--message text] --yes
+//	rmbgctl dead list [--error-code code] [--limit 50]
+//	rmbgctl dead requeue --error-code code [--limit 100] --yes
+//	rmbgctl maintenance status
+//	rmbgctl maintenance pause|resume|clear [--scope consumption|submissions|both] --yes
+//
+// Every command takes -o table|json; commands that change state need --yes.
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"rembg-v2/api/internal/config"
+	"rembg-v2/api/internal/maintenance"
+	"rembg-v2/api/internal/queue"
+)
+
+// commandTimeout bounds one invocation, including a full dead-letter scan
+const commandTimeout = 2 * time.Minute
+
+// errUsage reports a malformed command line
+var errUsage = errors.New("usage")
+
+// output is a command's result, printed as a table or as JSON
+type output struct {
+	headers []string
+	rows    [][]string
+	// data is what -o json prints
+	data interface{}
+}
+
+// command is one rmbgctl subcommand
+type command struct {
+	path    string
+	args    string
+	summary string
+	// mutates commands need --yes
+	mutates bool
+	// setup registers the command's flags and returns its implementation
+	setup func(fs *flag.FlagSet) func(ctx context.Context, q *queue.RedisQueue, args []string) (*output, error)
+}
+
+var commands = []command{
+	{path: "queue depth", summary: "Count pending jobs per model", setup: queueDepth},
+	{path: "queue peek", summary: "Show the oldest pending jobs", setup: queuePeek},
+	{path: "job show", args: "<id>", summary: "Show a job", setup: jobShow},
+	{path: "job requeue", args: "<id>", summary: "Put a job back on its pending list", mutates: true, setup: jobRequeue},
+	{path: "job fail", args: "<id>", summary: "Mark a job failed and refund its quota", mutates: true, setup: jobFail},
+	{path: "dead list", summary: "List failed jobs", setup: deadList},
+	{path: "dead requeue", summary: "Requeue failed jobs with an error code", mutates: true, setup: deadRequeue},
+	{path: "maintenance status", summary: "Report what's paused and what's overridden by hand", setup: maintenanceStatus},
+	{path: "maintenance pause", summary: "Pause consumption or submissions until cleared", mutates: true, setup: maintenanceSet("pause")},
+	{path: "maintenance resume", summary: "Resume consumption or submissions until cleared", mutates: true, setup: maintenanceSet("resume")},
+	{path: "maintenance clear", summary: "Hand a paused or resumed scope back to the schedule", mutates: true, setup: maintenanceSet("clear")},
+}
+
+func main() {
+	err := run(os.Args[1:], os.Stdout)
+	if errors.Is(err, errUsage) {
+		printUsage(os.Stderr)
+		os.Exit(2)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "rmbgctl: %v\n", err)
+		os.Exit(1)
+	}
+}
+
+// run finds the command named by the leading arguments, parses its flags
+// wherever they appear, and prints its output
+func run(argv []string, w io.Writer) error {
+	if len(argv) < 2 {
+		return errUsage
+	}
+	var cmd *command
+	for i := range commands {
+		if commands[i].path == argv[0]+" "+argv[1] {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		return errUsage
+	}
+
+	fs := flag.NewFlagSet("rmbgctl "+cmd.path, flag.ContinueOnError)
+	format := fs.String("o", "table", "Output format: table or json")
+	yes := fs.Bool("yes", false, "Confirm a command that changes queue state")
+	impl := cmd.setup(fs)
+	args, err := parseInterspersed(fs, argv[2:])
+	if errors.Is(err, flag.ErrHelp) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if *format != "table" && *format != "json" {
+		return fmt.Errorf("unknown output format %q", *format)
+	}
+	if cmd.mutates && !*yes {
+		return fmt.Errorf("%q changes queue state; re-run with --yes", cmd.path)
+	}
+
+	q, err := config.OpenQueue()
+	if err != nil {
+		return fmt.Errorf("failed to open the Redis queue: %w", err)
+	}
+	defer q.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), commandTimeout)
+	defer cancel()
+	out, err := impl(ctx, q, args)
+	if err != nil {
+		return err
+	}
+	if *format == "json" {
+		enc := json.NewEncoder(w)
+		enc.SetIndent("", "  ")
+		return enc.Encode(out.data)
+	}
+	return printTable(w, out)
+}
+
+// parseInterspersed parses flags that may come before or after positional
+// arguments, e.g. "job fail <id> --code manual", returning the positionals
+func parseInterspersed(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func printUsage(w io.Writer) {
+	fmt.Fprintln(w, "Usage: rmbgctl <command> [flags]")
+	fmt.Fprintln(w)
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	for _, cmd := range commands {
+		confirm := ""
+		if cmd.mutates {
+			confirm = " (needs --yes)"
+		}
+		fmt.Fprintf(tw, "  %s %s\t%s%s\n", cmd.path, cmd.args, cmd.summary, confirm)
+	}
+	tw.Flush()
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "Every command takes -o table|json. Run a command with -h for its flags.")
+}
+
+func printTable(w io.Writer, out *output) error {
+	tw := tabwriter.NewWriter(w, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, strings.Join(out.headers, "\t"))
+	for _, row := range out.rows {
+		fmt.Fprintln(tw, strings.Join(row, "\t"))
+	}
+	return tw.Flush()
+}
+
+// jobID returns the single job ID argument
+func jobID(args []string) (string, error) {
+	if len(args) != 1 {
+		return "", errors.New("expected exactly one job ID")
+	}
+	return args[0], nil
+}
+
+// loadJob reads a job, treating a missing one as an error
+func loadJob(ctx context.Context, q *queue.RedisQueue, args []string) (*queue.Job, error) {
+	id, err := jobID(args)
+	if err != nil {
+		return nil, err
+	}
+	job, err := q.GetJob(ctx, id)
+	if queue.JobMissing(job, err) {
+		return nil, fmt.Errorf("job %s not found", id)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return job, nil
+}
+
+// jobHeaders and jobRow describe jobs in listings
+var jobHeaders = []string{"JOB", "STATUS", "MODEL", "PRIORITY", "OWNER", "TIER", "UPDATED", "ERROR CODE"}
+
+func jobRow(job *queue.Job) []string {
+	model := job.Model
+	if model == "" {
+		model = queue.ModelDefault
+	}
+	priority := job.Priority
+	if priority == "" {
+		priority = queue.PriorityNormal
+	}
+	return []string{job.ID, string(job.Status), model, priority, job.Owner, job.Tier, job.UpdatedAt.Format(time.RFC3339), job.ErrorCode}
+}
+
+func jobsOutput(jobs []*queue.Job, data interface{}) *output {
+	out := &output{headers: jobHeaders, data: data}
+	for _, job := range jobs {
+		out.rows = append(out.rows, jobRow(job))
+	}
+	return out
+}
+
+func queueDepth(fs *flag.FlagSet) func(context.Context, *queue.RedisQueue, []string) (*output, error) {
+	return func(ctx context.Context, q *queue.RedisQueue, args []string) (*output, error) {
+		depths, err := q.PendingDepths(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		models := make([]string, 0, len(depths))
+		var total int64
+		for model, n := range depths {
+			models = append(models, model)
+			total += n
+		}
+		sort.Strings(models)
+
+		out := &output{headers: []string{"MODEL", "PENDING"}, data: map[string]interface{}{"models": depths, "total": total}}
+		for _, model := range models {
+			out.rows = append(out.rows, []string{model, strconv.FormatInt(depths[model], 10)})
+		}
+		out.rows = append(out.rows, []string{"total", strconv.FormatInt(total, 10)})
+		return out, nil
+	}
+}
+
+func queuePeek(fs *flag.FlagSet) func(context.Context, *queue.RedisQueue, []string) (*output, error) {
+	n := fs.Int64("n", 20, "Number of jobs to show")
+	model := fs.String("model", "", "Only this model's pending list (default: every list)")
+	return func(ctx context.Context, q *queue.RedisQueue, args []string) (*output, error) {
+		models := append([]string{queue.ModelAuto}, queue.Models...)
+		if *model != "" {
+			if !queue.IsModel(*model) {
+				return nil, fmt.Errorf("unknown model %q", *model)
+			}
+			models = []string{*model}
+		}
+
+		jobs := []*queue.Job{}
+		for _, m := range models {
+			peeked, err := q.PeekPending(ctx, m, *n)
+			if err != nil {
+				return nil, err
+			}
+			jobs = append(jobs, peeked...)
+		}
+		// Merged in the order workers claim them
+		sort.SliceStable(jobs, func(i, j int) bool {
+			if ri, rj := queue.PriorityRank(jobs[i].Priority), queue.PriorityRank(jobs[j].Priority); ri != rj {
+				return ri < rj
+			}
+			return jobs[i].EnqueuedAtMs < jobs[j].EnqueuedAtMs
+		})
+		if int64(len(jobs)) > *n {
+			jobs = jobs[:*n]
+		}
+		return jobsOutput(jobs, jobs), nil
+	}
+}
+
+func jobShow(fs *flag.FlagSet) func(context.Context, *queue.RedisQueue, []string) (*output, error) {
+	return func(ctx context.Context, q *queue.RedisQueue, args []string) (*output, error) {
+		job, err := loadJob(ctx, q, args)
+		if err != nil {
+			return nil, err
+		}
+
+		out := &output{headers: []string{"FIELD", "VALUE"}, data: job}
+		for i, header := range jobHeaders {
+			out.rows = append(out.rows, []string{strings.ToLower(header), jobRow(job)[i]})
+		}
+		out.rows = append(out.rows,
+			[]string{"created", job.CreatedAt.Format(time.RFC3339)},
+			[]string{"input", job.InputPath},
+			[]string{"output", job.OutputPath},
+			[]string{"error", job.Error},
+		)
+		return out, nil
+	}
+}
+
+func jobRequeue(fs *flag.FlagSet) func(context.Context, *queue.RedisQueue, []string) (*output, error) {
+	return func(ctx context.Context, q *queue.RedisQueue, args []string) (*output, error) {
+		job, err := loadJob(ctx, q, args)
+		if err != nil {
+			return nil, err
+		}
+		// A pending job is already on its list; pushing it again would run it twice
+		if job.Status == queue.StatusPending {
+			return nil, fmt.Errorf("job %s is already pending", job.ID)
+		}
+		if err := q.RequeueJob(ctx, job); err != nil {
+			return nil, err
+		}
+		return jobsOutput([]*queue.Job{job}, job), nil
+	}
+}
+
+func jobFail(fs *flag.FlagSet) func(context.Context, *queue.RedisQueue, []string) (*output, error) {
+	code := fs.String("code", queue.ErrorCodeManual, "Error code recorded on the job")
+	message := fs.String("message", "Failed by an operator", "Error message recorded on the job")
+	return func(ctx context.Context, q *queue.RedisQueue, args []string) (*output, error) {
+		job, err := loadJob(ctx, q, args)
+		if err != nil {
+			return nil, err
+		}
+		if job.Status == queue.StatusFailed {
+			return nil, fmt.Errorf("job %s has already failed", job.ID)
+		}
+		if err := q.FailJob(ctx, job, *code, *message); err != nil {
+			return nil, err
+		}
+		return jobsOutput([]*queue.Job{job}, job), nil
+	}
+}
+
+// failedJobs scans for failed jobs, warning when the scan stopped early
+func failedJobs(ctx context.Context, q *queue.RedisQueue, errorCode string, limit int) ([]*queue.Job, error) {
+	jobs, complete, err := q.FailedJobs(ctx, errorCode, limit)
+	if err != nil {
+		return nil, err
+	}
+	if !complete {
+		fmt.Fprintf(os.Stderr, "rmbgctl: stopped after %d jobs; more may match\n", len(jobs))
+	}
+	return jobs, nil
+}
+
+func deadList(fs *flag.FlagSet) func(context.Context, *queue.RedisQueue, []string) (*output, error) {
+	errorCode := fs.String("error-code", "", "Only jobs that failed with this code")
+	limit := fs.Int("limit", 50, "Most jobs to list")
+	return func(ctx context.Context, q *queue.RedisQueue, args []string) (*output, error) {
+		jobs, err := failedJobs(ctx, q, *errorCode, *limit)
+		if err != nil {
+			return nil, err
+		}
+		return jobsOutput(jobs, jobs), nil
+	}
+}
+
+func deadRequeue(fs *flag.FlagSet) func(context.Context, *queue.RedisQueue, []string) (*output, error) {
+	errorCode := fs.String("error-code", "", "Requeue jobs that failed with this code (required)")
+	limit := fs.Int("limit", 100, "Most jobs to requeue")
+	return func(ctx context.Context, q *queue.RedisQueue, args []string) (*output, error) {
+		if *errorCode == "" {
+			return nil, errors.New("--error-code is required")
+		}
+		jobs, err := failedJobs(ctx, q, *errorCode, *limit)
+		if err != nil {
+			return nil, err
+		}
+		for i, job := range jobs {
+			if err := q.RequeueJob(ctx, job); err != nil {
+				return nil, fmt.Errorf("requeued %d jobs, then failed on %s: %w", i, job.ID, err)
+			}
+		}
+		return jobsOutput(jobs, jobs), nil
+	}
+}
+
+func maintenanceOutput(ctx context.Context, q *queue.RedisQueue) (*output, error) {
+	overrides, err := q.MaintenanceOverrides(ctx)
+	if err != nil {
+		return nil, err
+	}
+	out := &output{headers: []string{"FLAG", "PAUSED", "OVERRIDE"}}
+	data := make(map[string]interface{}, len(queue.MaintenanceFlags))
+	for _, flag := range queue.MaintenanceFlags {
+		paused, err := q.MaintenancePaused(ctx, flag)
+		if err != nil {
+			return nil, err
+		}
+		override := overrides[flag]
+		shown := override
+		if shown == "" {
+			shown = "schedule"
+		}
+		out.rows = append(out.rows, []string{flag, strconv.FormatBool(paused), shown})
+		data[flag] = map[string]interface{}{"paused": paused, "override": override}
+	}
+	out.data = data
+	return out, nil
+}
+
+func maintenanceStatus(fs *flag.FlagSet) func(context.Context, *queue.RedisQueue, []string) (*output, error) {
+	return func(ctx context.Context, q *queue.RedisQueue, args []string) (*output, error) {
+		return maintenanceOutput(ctx, q)
+	}
+}
+
+// actor names who is running rmbgctl, for the audit log
+func actor() string {
+	if user := os.Getenv("USER"); user != "" {
+		return "rmbgctl:" + user
+	}
+	return "rmbgctl"
+}
+
+// maintenanceSet pauses, resumes, or clears the override of the flags in a
+// scope, recording the change in the audit log
+func maintenanceSet(action string) func(fs *flag.FlagSet) func(context.Context, *queue.RedisQueue, []string) (*output, error) {
+	return func(fs *flag.FlagSet) func(context.Context, *queue.RedisQueue, []string) (*output, error) {
+		scope := fs.String("scope", maintenance.ScopeConsumption, "What to "+action+": consumption, submissions, or both")
+		return func(ctx context.Context, q *queue.RedisQueue, args []string) (*output, error) {
+			flags := maintenance.ScopeFlags(*scope)
+			if flags == nil {
+				return nil, fmt.Errorf("unknown scope %q", *scope)
+			}
+			for _, flag := range flags {
+				var err error
+				if action == "clear" {
+					err = q.ClearMaintenanceOverride(ctx, flag)
+				} else {
+					err = q.OverrideMaintenance(ctx, flag, action == "pause")
+				}
+				if err != nil {
+					return nil, err
+				}
+				entry := queue.AuditEntry{At: time.Now(), Actor: actor(), Action: action, Target: flag}
+				if err := q.RecordAudit(ctx, entry); err != nil {
+					return nil, fmt.Errorf("%s %s succeeded, then recording it in the audit log failed: %w", action, flag, err)
+				}
+			}
+			return maintenanceOutput(ctx, q)
+		}
+	}
+}
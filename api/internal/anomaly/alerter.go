@@ -0,0 +1,103 @@
+package anomaly
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Alerter kinds
+const (
+	AlerterLog     = "log"
+	AlerterWebhook = "webhook"
+	AlerterSlack   = "slack"
+)
+
+// Alert describes a failure-rate spike
+type Alert struct {
+	Dimension     string        `json:"dimension"`
+	Failures      int64         `json:"failures"`
+	Total         int64         `json:"total"`
+	Rate          float64       `json:"rate"`
+	BaselineRate  float64       `json:"baseline_rate"`
+	Window        time.Duration `json:"-"`
+	ExampleJobIDs []string      `json:"example_job_ids"`
+	FiredAt       time.Time     `json:"fired_at"`
+}
+
+// Alerter notifies operators of a spike
+type Alerter interface {
+	Alert(ctx context.Context, a Alert) error
+}
+
+// NewAlerter creates the alerter of the given kind; webhook and slack post to url
+func NewAlerter(kind, url string) (Alerter, error) {
+	switch kind {
+	case "", AlerterLog:
+		return LogAlerter{}, nil
+	case AlerterWebhook, AlerterSlack:
+		if url == "" {
+			return nil, fmt.Errorf("the %s alerter needs a URL", kind)
+		}
+		return &httpAlerter{url: url, slack: kind == AlerterSlack, http: &http.Client{Timeout: 10 * time.Second}}, nil
+	}
+	return nil, fmt.Errorf("unknown alerter %q, want %s, %s, or %s", kind, AlerterLog, AlerterWebhook, AlerterSlack)
+}
+
+// LogAlerter writes alerts to the log
+type LogAlerter struct{}
+
+// Alert logs the alert summary and example jobs
+func (LogAlerter) Alert(ctx context.Context, a Alert) error {
+	log.Printf("ALERT: %s; recent failed jobs: %s", a.Summary(), strings.Join(a.ExampleJobIDs, ", "))
+	return nil
+}
+
+// httpAlerter posts alerts as JSON, either the alert itself or a Slack
+// incoming-webhook message
+type httpAlerter struct {
+	url   string
+	slack bool
+	http  *http.Client
+}
+
+// Alert posts the alert, failing on non-2xx responses
+func (h *httpAlerter) Alert(ctx context.Context, a Alert) error {
+	var payload interface{} = struct {
+		Alert
+		Summary       string `json:"summary"`
+		WindowSeconds int64  `json:"window_seconds"`
+	}{a, a.Summary(), int64(a.Window / time.Second)}
+	if h.slack {
+		text := ":rotating_light: " + a.Summary()
+		if len(a.ExampleJobIDs) > 0 {
+			text += "\nRecent failed jobs: `" + strings.Join(a.ExampleJobIDs, "`, `") + "`"
+		}
+		payload = map[string]string{"text": text}
+	}
+
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, h.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := h.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("alert webhook answered %s", resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+// Package anomaly watches job failure rates per error code and per model
+// and alerts operators when a short window spikes above its baseline
+package anomaly
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Config holds the thresholds of the watcher
+type Config struct {
+	// Window is the short window whose failure rate is checked
+	Window time.Duration
+	// Baseline is the period before the window the rate is compared against
+	Baseline time.Duration
+	// MinJobs is the fewest jobs in the window for a rate to count
+	MinJobs int64
+	// MinRate is the failure rate below which nothing alerts, however
+	// quiet the baseline was
+	MinRate float64
+	// SpikeFactor is how many times the baseline rate the window must reach
+	SpikeFactor float64
+	// Cooldown is the least time between two alerts for one dimension
+	Cooldown time.Duration
+	// Interval is how often the rates are checked
+	Interval time.Duration
+}
+
+// DefaultConfig returns the thresholds used unless configured otherwise
+func DefaultConfig() Config {
+	return Config{
+		Window:      5 * time.Minute,
+		Baseline:    time.Hour,
+		MinJobs:     20,
+		MinRate:     0.2,
+		SpikeFactor: 3,
+		Cooldown:    30 * time.Minute,
+		Interval:    time.Minute,
+	}
+}
+
+// Source provides the outcome counters the watcher reads
+type Source interface {
+	OutcomeCounts(ctx context.Context, from, to time.Time) (map[string]int64, error)
+	FailureExamples(ctx context.Context, dimension string) ([]string, error)
+	ClaimAlert(ctx context.Context, dimension string, cooldown time.Duration) (bool, error)
+}
+
+// DimensionState is the current failure rate of one error code or model
+type DimensionState struct {
+	Dimension    string     `json:"dimension"`
+	Failures     int64      `json:"failures"`
+	Total        int64      `json:"total"`
+	Rate         float64    `json:"rate"`
+	BaselineRate float64    `json:"baseline_rate"`
+	Firing       bool       `json:"firing"`
+	FiringSince  *time.Time `json:"firing_since,omitempty"`
+	LastAlertAt  *time.Time `json:"last_alert_at,omitempty"`
+}
+
+// Watcher compares short-window failure rates against their baseline
+type Watcher struct {
+	cfg     Config
+	source  Source
+	alerter Alerter
+	now     func() time.Time
+
+	mu     sync.Mutex
+	states map[string]*DimensionState
+}
+
+// NewWatcher creates a watcher reading source and notifying alerter
+func NewWatcher(cfg Config, source Source, alerter Alerter) *Watcher {
+	return &Watcher{
+		cfg:     cfg,
+		source:  source,
+		alerter: alerter,
+		now:     time.Now,
+		states:  make(map[string]*DimensionState),
+	}
+}
+
+// Run checks the rates every interval until ctx is done
+func (w *Watcher) Run(ctx context.Context) {
+	ticker := time.NewTicker(w.cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := w.Check(ctx); err != nil {
+				log.Printf("Failed to check failure rates: %v", err)
+			}
+		}
+	}
+}
+
+// Check evaluates every dimension once, alerting on those that started firing
+func (w *Watcher) Check(ctx context.Context) error {
+	now := w.now()
+	windowStart := now.Add(-w.cfg.Window)
+	current, err := w.source.OutcomeCounts(ctx, windowStart, now)
+	if err != nil {
+		return err
+	}
+	baseline, err := w.source.OutcomeCounts(ctx, windowStart.Add(-w.cfg.Baseline), windowStart)
+	if err != nil {
+		return err
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	seen := make(map[string]bool)
+	for _, dim := range dimensions(current, baseline) {
+		seen[dim] = true
+		failures, total := rateInputs(current, dim)
+		baseFailures, baseTotal := rateInputs(baseline, dim)
+
+		state, ok := w.states[dim]
+		if !ok {
+			state = &DimensionState{Dimension: dim}
+			w.states[dim] = state
+		}
+		state.Failures, state.Total = failures, total
+		state.Rate, state.BaselineRate = ratio(failures, total), ratio(baseFailures, baseTotal)
+
+		breached := total >= w.cfg.MinJobs && state.Rate >= w.cfg.MinRate && state.Rate >= w.cfg.SpikeFactor*state.BaselineRate
+		switch {
+		case breached && !state.Firing:
+			state.Firing, state.FiringSince = true, &now
+			w.alert(ctx, state)
+		case !breached && state.Firing:
+			log.Printf("Failure rate of %s recovered to %.1f%% after firing since %s", dim, state.Rate*100, state.FiringSince.Format(time.RFC3339))
+			state.Firing, state.FiringSince = false, nil
+		}
+	}
+
+	// Dimensions without jobs in either period have nothing left to report
+	for dim, state := range w.states {
+		if !seen[dim] {
+			if state.Firing {
+				log.Printf("Failure rate of %s recovered, no jobs since %s", dim, state.FiringSince.Format(time.RFC3339))
+			}
+			delete(w.states, dim)
+		}
+	}
+	return nil
+}
+
+// alert notifies the alerter unless this dimension alerted within the
+// cooldown, on any replica, which keeps flapping rates from storming
+func (w *Watcher) alert(ctx context.Context, state *DimensionState) {
+	claimed, err := w.source.ClaimAlert(ctx, state.Dimension, w.cfg.Cooldown)
+	if err != nil {
+		log.Printf("Failed to claim alert for %s: %v", state.Dimension, err)
+		return
+	}
+	if !claimed {
+		return
+	}
+
+	examples, err := w.source.FailureExamples(ctx, state.Dimension)
+	if err != nil {
+		log.Printf("Failed to read failed jobs for %s: %v", state.Dimension, err)
+	}
+	alertedAt := w.now()
+	state.LastAlertAt = &alertedAt
+
+	a := Alert{
+		Dimension:     state.Dimension,
+		Failures:      state.Failures,
+		Total:         state.Total,
+		Rate:          state.Rate,
+		BaselineRate:  state.BaselineRate,
+		Window:        w.cfg.Window,
+		ExampleJobIDs: examples,
+		FiredAt:       *state.FiringSince,
+	}
+	if err := w.alerter.Alert(ctx, a); err != nil {
+		log.Printf("Failed to send alert for %s: %v", state.Dimension, err)
+	}
+}
+
+// States returns the current state of every dimension, sorted by name
+func (w *Watcher) States() []DimensionState {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	states := make([]DimensionState, 0, len(w.states))
+	for _, state := range w.states {
+		states = append(states, *state)
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Dimension < states[j].Dimension })
+	return states
+}
+
+// dimensions lists the error codes and models present in either count set
+func dimensions(sets ...map[string]int64) []string {
+	found := make(map[string]bool)
+	for _, counts := range sets {
+		for field := range counts {
+			switch {
+			case strings.HasPrefix(field, "code:"):
+				found[field] = true
+			case strings.HasPrefix(field, "model:") && strings.HasSuffix(field, ":total"):
+				found[strings.TrimSuffix(field, ":total")] = true
+			}
+		}
+	}
+
+	dims := make([]string, 0, len(found))
+	for dim := range found {
+		dims = append(dims, dim)
+	}
+	sort.Strings(dims)
+	return dims
+}
+
+// rateInputs returns the failures and job total a dimension's rate is computed from:
+// an error code's failures out of all jobs, or a model's out of its own jobs
+func rateInputs(counts map[string]int64, dim string) (int64, int64) {
+	if strings.HasPrefix(dim, "model:") {
+		return counts[dim+":failed"], counts[dim+":total"]
+	}
+	return counts[dim], counts["total"]
+}
+
+// ratio returns failures/total, or 0 without jobs
+func ratio(failures, total int64) float64 {
+	if total == 0 {
+		return 0
+	}
+	return float64(failures) / float64(total)
+}
+
+// Summary describes an alert in one line
+func (a Alert) Summary() string {
+	return fmt.Sprintf("Failure rate of %s is %.1f%% (%d/%d jobs) over the last %s, baseline %.1f%%",
+		a.Dimension, a.Rate*100, a.Failures, a.Total, a.Window, a.BaselineRate*100)
+}
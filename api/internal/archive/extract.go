@@ -0,0 +1,201 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+)
+
+// ratioFloor is the decompressed size below which an entry's compression
+// ratio isn't checked, since small files of flat color compress very well
+const ratioFloor = 1 << 20
+
+// sniffLength is how many leading bytes of an entry are checked for the
+// signature of a nested archive
+const sniffLength = 8
+
+// archiveExtensions are the extensions of archive formats, rejected inside
+// an archive regardless of their contents
+var archiveExtensions = map[string]bool{
+	".zip": true, ".jar": true, ".gz": true, ".tgz": true, ".tar": true,
+	".bz2": true, ".xz": true, ".zst": true, ".7z": true, ".rar": true,
+}
+
+// archiveSignatures are the leading bytes of archive and compressed formats
+var archiveSignatures = [][]byte{
+	[]byte("PK\x03\x04"),
+	[]byte("PK\x05\x06"),
+	{0x1f, 0x8b},
+	[]byte("BZh"),
+	{0xfd, '7', 'z', 'X', 'Z', 0x00},
+	{0x28, 0xb5, 0x2f, 0xfd},
+	{'7', 'z', 0xbc, 0xaf, 0x27, 0x1c},
+	[]byte("Rar!\x1a\x07"),
+}
+
+// Limits bound what extracting one uploaded archive may produce; every
+// limit must be positive. Sizes are enforced on the bytes actually
+// decompressed, not the sizes the archive declares.
+type Limits struct {
+	// MaxEntries caps the number of entries, directories included
+	MaxEntries int `json:"max_entries"`
+	// MaxEntryBytes caps the decompressed size of one entry
+	MaxEntryBytes int64 `json:"max_entry_bytes"`
+	// MaxTotalBytes caps the decompressed size of all entries together
+	MaxTotalBytes int64 `json:"max_total_bytes"`
+	// MaxRatio caps an entry's decompressed size over its compressed size
+	MaxRatio float64 `json:"max_compression_ratio"`
+}
+
+// DefaultLimits are the limits used unless a deployment configures its own
+var DefaultLimits = Limits{
+	MaxEntries:    100,
+	MaxEntryBytes: 50 << 20,
+	MaxTotalBytes: 500 << 20,
+	MaxRatio:      100,
+}
+
+// ErrNestedArchive is returned for an archive containing another archive
+var ErrNestedArchive = errors.New("archives inside archives are not allowed")
+
+// LimitError reports the limit an archive exceeded
+type LimitError struct {
+	// Limit is the JSON name of the exceeded limit in Limits
+	Limit string
+	// Entry is the entry being extracted, if the limit is per entry
+	Entry string
+	Max   float64
+}
+
+func (e *LimitError) Error() string {
+	if e.Entry != "" {
+		return fmt.Sprintf("archive entry %q exceeds %s of %v", e.Entry, e.Limit, e.Max)
+	}
+	return fmt.Sprintf("archive exceeds %s of %v", e.Limit, e.Max)
+}
+
+// TooLarge reports whether the archive was rejected for its size rather
+// than its contents
+func (e *LimitError) TooLarge() bool {
+	return e.Limit != "max_compression_ratio"
+}
+
+// Extract streams each file in the ZIP archive r, of size bytes, to the
+// writer create returns for it, in archive order. On any error, including
+// a tripped limit or a nested archive, the files already created are
+// passed to remove and nothing is kept. It returns the names that were
+// passed to create.
+func Extract(r io.ReaderAt, size int64, limits Limits, create func(name string) (io.WriteCloser, error), remove func(name string)) ([]string, error) {
+	zr, err := zip.NewReader(r, size)
+	if err != nil {
+		return nil, err
+	}
+	if len(zr.File) > limits.MaxEntries {
+		return nil, &LimitError{Limit: "max_entries", Max: float64(limits.MaxEntries)}
+	}
+
+	// Reject what the central directory already gives away before writing anything
+	var declared uint64
+	for _, f := range zr.File {
+		if archiveExtensions[strings.ToLower(path.Ext(f.Name))] {
+			return nil, ErrNestedArchive
+		}
+		if f.UncompressedSize64 > uint64(limits.MaxEntryBytes) {
+			return nil, &LimitError{Limit: "max_entry_bytes", Entry: f.Name, Max: float64(limits.MaxEntryBytes)}
+		}
+		if declared += f.UncompressedSize64; declared > uint64(limits.MaxTotalBytes) {
+			return nil, &LimitError{Limit: "max_total_bytes", Max: float64(limits.MaxTotalBytes)}
+		}
+	}
+
+	var created []string
+	fail := func(err error) ([]string, error) {
+		for _, name := range created {
+			remove(name)
+		}
+		return nil, err
+	}
+
+	buf := make([]byte, 32<<10)
+	var total int64
+	for _, f := range zr.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+		n, err := extractEntry(f, limits, limits.MaxTotalBytes-total, buf, func() (io.WriteCloser, error) {
+			w, err := create(f.Name)
+			if err == nil {
+				created = append(created, f.Name)
+			}
+			return w, err
+		})
+		if err != nil {
+			return fail(err)
+		}
+		total += n
+	}
+	return created, nil
+}
+
+// extractEntry copies one entry to the writer open returns, stopping as
+// soon as it passes a limit or turns out to be an archive itself
+func extractEntry(f *zip.File, limits Limits, remaining int64, buf []byte, open func() (io.WriteCloser, error)) (int64, error) {
+	rc, err := f.Open()
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	head := make([]byte, sniffLength)
+	m, err := io.ReadFull(rc, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return 0, err
+	}
+	for _, sig := range archiveSignatures {
+		if bytes.HasPrefix(head[:m], sig) {
+			return 0, ErrNestedArchive
+		}
+	}
+
+	w, err := open()
+	if err != nil {
+		return 0, err
+	}
+	dst := &limitedWriter{w: w, f: f, limits: limits, remaining: remaining}
+	_, err = dst.Write(head[:m])
+	if err == nil {
+		_, err = io.CopyBuffer(dst, rc, buf)
+	}
+	if closeErr := w.Close(); err == nil {
+		err = closeErr
+	}
+	return dst.n, err
+}
+
+// limitedWriter fails a write that takes an entry past its limits
+type limitedWriter struct {
+	w         io.Writer
+	f         *zip.File
+	limits    Limits
+	remaining int64
+	n         int64
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	n := l.n + int64(len(p))
+	switch {
+	case n > l.limits.MaxEntryBytes:
+		return 0, &LimitError{Limit: "max_entry_bytes", Entry: l.f.Name, Max: float64(l.limits.MaxEntryBytes)}
+	case n > l.remaining:
+		return 0, &LimitError{Limit: "max_total_bytes", Max: float64(l.limits.MaxTotalBytes)}
+	case n > ratioFloor && float64(n) > l.limits.MaxRatio*float64(l.f.CompressedSize64):
+		return 0, &LimitError{Limit: "max_compression_ratio", Entry: l.f.Name, Max: l.limits.MaxRatio}
+	}
+	written, err := l.w.Write(p)
+	l.n += int64(written)
+	return written, err
+}
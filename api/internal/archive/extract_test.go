@@ -0,0 +1,255 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"testing"
+)
+
+// memStorage is a fake storage backend recording what extraction writes
+// and the most it held at once
+type memStorage struct {
+	files map[string]*bytes.Buffer
+	held  int64
+	peak  int64
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{files: make(map[string]*bytes.Buffer)}
+}
+
+func (s *memStorage) create(name string) (io.WriteCloser, error) {
+	if _, ok := s.files[name]; ok {
+		return nil, fmt.Errorf("%s created twice", name)
+	}
+	buf := &bytes.Buffer{}
+	s.files[name] = buf
+	return &memFile{s: s, buf: buf}, nil
+}
+
+func (s *memStorage) remove(name string) {
+	s.held -= int64(s.files[name].Len())
+	delete(s.files, name)
+}
+
+type memFile struct {
+	s   *memStorage
+	buf *bytes.Buffer
+}
+
+func (f *memFile) Write(p []byte) (int, error) {
+	f.s.held += int64(len(p))
+	if f.s.held > f.s.peak {
+		f.s.peak = f.s.held
+	}
+	return f.buf.Write(p)
+}
+
+func (f *memFile) Close() error { return nil }
+
+// entry is a file to put in a generated archive
+type entry struct {
+	name string
+	data []byte
+}
+
+// buildZip deflates the entries into a ZIP archive
+func buildZip(t *testing.T, entries ...entry) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, e := range entries {
+		w, err := zw.Create(e.name)
+		if err != nil {
+			t.Fatalf("creating %s: %v", e.name, err)
+		}
+		if _, err := w.Write(e.data); err != nil {
+			t.Fatalf("writing %s: %v", e.name, err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("closing the archive: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func randomBytes(t *testing.T, n int) []byte {
+	t.Helper()
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		t.Fatalf("reading random bytes: %v", err)
+	}
+	return b
+}
+
+func gzipped(t *testing.T, data []byte) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write(data)
+	if err := zw.Close(); err != nil {
+		t.Fatalf("gzipping: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestExtract(t *testing.T) {
+	small := Limits{MaxEntries: 10, MaxEntryBytes: 64 << 10, MaxTotalBytes: 128 << 10, MaxRatio: 100}
+
+	manyTiny := make([]entry, DefaultLimits.MaxEntries+1)
+	for i := range manyTiny {
+		manyTiny[i] = entry{name: fmt.Sprintf("%04d.png", i), data: []byte{byte(i)}}
+	}
+
+	tests := []struct {
+		name      string
+		archive   []byte
+		limits    Limits
+		want      []string
+		wantErr   error
+		wantLimit string
+	}{
+		{
+			name:    "within limits",
+			archive: buildZip(t, entry{"a.png", randomBytes(t, 1000)}, entry{"dir/b.png", randomBytes(t, 2000)}, entry{"c.png", nil}),
+			limits:  small,
+			want:    []string{"a.png", "dir/b.png", "c.png"},
+		},
+		{
+			name:    "flat color under the ratio floor",
+			archive: buildZip(t, entry{"white.png", bytes.Repeat([]byte{0xff}, 32<<10)}),
+			limits:  small,
+			want:    []string{"white.png"},
+		},
+		{
+			name:      "many tiny entries",
+			archive:   buildZip(t, manyTiny...),
+			limits:    DefaultLimits,
+			wantLimit: "max_entries",
+		},
+		{
+			name:      "entry too large",
+			archive:   buildZip(t, entry{"a.png", randomBytes(t, 1000)}, entry{"big.png", randomBytes(t, 65<<10)}),
+			limits:    small,
+			wantLimit: "max_entry_bytes",
+		},
+		{
+			name:      "entries too large together",
+			archive:   buildZip(t, entry{"a.png", randomBytes(t, 60<<10)}, entry{"b.png", randomBytes(t, 60<<10)}, entry{"c.png", randomBytes(t, 60<<10)}),
+			limits:    small,
+			wantLimit: "max_total_bytes",
+		},
+		{
+			name:    "nested zip",
+			archive: buildZip(t, entry{"a.png", randomBytes(t, 100)}, entry{"inner.zip", buildZip(t, entry{"b.png", nil})}),
+			limits:  small,
+			wantErr: ErrNestedArchive,
+		},
+		{
+			name:    "nested zip with an image name",
+			archive: buildZip(t, entry{"a.png", randomBytes(t, 100)}, entry{"b.png", buildZip(t, entry{"c.png", nil})}),
+			limits:  small,
+			wantErr: ErrNestedArchive,
+		},
+		{
+			name:    "nested gzip with an image name",
+			archive: buildZip(t, entry{"a.png", randomBytes(t, 100)}, entry{"b.png", gzipped(t, randomBytes(t, 100))}),
+			limits:  small,
+			wantErr: ErrNestedArchive,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			storage := newMemStorage()
+			got, err := Extract(bytes.NewReader(tt.archive), int64(len(tt.archive)), tt.limits, storage.create, storage.remove)
+
+			var limitErr *LimitError
+			switch {
+			case tt.wantLimit != "":
+				if !errors.As(err, &limitErr) || limitErr.Limit != tt.wantLimit {
+					t.Fatalf("Extract error = %v, want %s exceeded", err, tt.wantLimit)
+				}
+			case !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil):
+				t.Fatalf("Extract error = %v, want %v", err, tt.wantErr)
+			}
+			if storage.peak > tt.limits.MaxTotalBytes {
+				t.Fatalf("extraction held %d bytes at once, over the %d byte limit", storage.peak, tt.limits.MaxTotalBytes)
+			}
+
+			if err != nil {
+				if got != nil || len(storage.files) != 0 {
+					t.Fatalf("failed extraction kept %v, %d files in storage", got, len(storage.files))
+				}
+				return
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Fatalf("Extract = %v, want %v", got, tt.want)
+			}
+			if len(storage.files) != len(tt.want) {
+				t.Fatalf("storage holds %d files, want %d", len(storage.files), len(tt.want))
+			}
+		})
+	}
+}
+
+func TestExtractHighRatioStopsEarly(t *testing.T) {
+	// 16 MiB of zeros deflates to some 16 KiB, a ratio of about 1000
+	bomb := buildZip(t, entry{name: "bomb.png", data: make([]byte, 16<<20)})
+	storage := newMemStorage()
+	_, err := Extract(bytes.NewReader(bomb), int64(len(bomb)), DefaultLimits, storage.create, storage.remove)
+	var limitErr *LimitError
+	if !errors.As(err, &limitErr) || limitErr.Limit != "max_compression_ratio" {
+		t.Fatalf("Extract error = %v, want max_compression_ratio exceeded", err)
+	}
+	if limitErr.TooLarge() {
+		t.Fatalf("a compression ratio error reports TooLarge, want it rejected for its contents")
+	}
+	// Writing stops within a copy buffer of the ratio limit
+	if max := int64(DefaultLimits.MaxRatio)*int64(len(bomb)) + 32<<10; storage.peak > max {
+		t.Fatalf("extraction wrote %d bytes of a %d byte bomb, want at most %d", storage.peak, len(bomb), max)
+	}
+}
+
+func TestExtractDeclaredSizeLie(t *testing.T) {
+	// An entry declaring 1 KiB that inflates to 16 MiB, which a check of
+	// the central directory alone would let through
+	data := make([]byte, 16<<20)
+	var compressed bytes.Buffer
+	fw, _ := flate.NewWriter(&compressed, flate.BestCompression)
+	fw.Write(data)
+	fw.Close()
+
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	w, err := zw.CreateRaw(&zip.FileHeader{
+		Name:               "liar.png",
+		Method:             zip.Deflate,
+		CRC32:              crc32.ChecksumIEEE(data),
+		CompressedSize64:   uint64(compressed.Len()),
+		UncompressedSize64: 1 << 10,
+	})
+	if err != nil {
+		t.Fatalf("CreateRaw: %v", err)
+	}
+	w.Write(compressed.Bytes())
+	zw.Close()
+
+	storage := newMemStorage()
+	limits := Limits{MaxEntries: 10, MaxEntryBytes: 1 << 20, MaxTotalBytes: 1 << 20, MaxRatio: 100}
+	if _, err := Extract(bytes.NewReader(buf.Bytes()), int64(buf.Len()), limits, storage.create, storage.remove); err == nil {
+		t.Fatalf("Extract of an entry larger than it declared succeeded")
+	}
+	if storage.peak > limits.MaxEntryBytes {
+		t.Fatalf("extraction wrote %d bytes, over the %d byte entry limit", storage.peak, limits.MaxEntryBytes)
+	}
+	if len(storage.files) != 0 {
+		t.Fatalf("failed extraction kept %d files", len(storage.files))
+	}
+}
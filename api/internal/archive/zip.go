@@ -0,0 +1,131 @@
+// Package archive writes ZIP archives whose entry names extract cleanly on
+// every common platform and extractor, and extracts uploaded ones within
+// size limits
+package archive
+
+import (
+	"archive/zip"
+	"fmt"
+	"io"
+	"path"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// maxNameLength caps entry names in bytes, below common filesystem limits
+const maxNameLength = 200
+
+// maxCommentLength caps the entry comment holding the original name
+const maxCommentLength = 1024
+
+// utf8Flag is general purpose bit 11: names and comments are UTF-8
+const utf8Flag = 0x800
+
+// reservedNames are device names Windows won't create files for, with any extension
+var reservedNames = map[string]bool{
+	"CON": true, "PRN": true, "AUX": true, "NUL": true,
+	"COM1": true, "COM2": true, "COM3": true, "COM4": true, "COM5": true,
+	"COM6": true, "COM7": true, "COM8": true, "COM9": true,
+	"LPT1": true, "LPT2": true, "LPT3": true, "LPT4": true, "LPT5": true,
+	"LPT6": true, "LPT7": true, "LPT8": true, "LPT9": true,
+}
+
+// ZipWriter writes flat ZIP archives with sanitized, unique entry names
+type ZipWriter struct {
+	zw *zip.Writer
+	// used holds the case-folded names already written, since extracting
+	// onto a case-insensitive filesystem would merge names differing by case
+	used map[string]bool
+}
+
+// NewZipWriter creates a ZipWriter writing to w
+func NewZipWriter(w io.Writer) *ZipWriter {
+	return &ZipWriter{zw: zip.NewWriter(w), used: make(map[string]bool)}
+}
+
+// Create adds an entry for a file originally called name and returns a
+// writer for its contents. The stored name is sanitized and made unique;
+// the original name is kept in the entry comment. Contents are stored
+// uncompressed, since results are already compressed images.
+func (z *ZipWriter) Create(name string, modified time.Time) (io.Writer, error) {
+	header := &zip.FileHeader{
+		Name:     z.unique(SanitizeName(name)),
+		Comment:  truncate(strings.ToValidUTF8(name, "\uFFFD"), maxCommentLength),
+		Method:   zip.Store,
+		Modified: modified,
+	}
+	header.Flags |= utf8Flag
+	return z.zw.CreateHeader(header)
+}
+
+// Close finishes the archive
+func (z *ZipWriter) Close() error {
+	return z.zw.Close()
+}
+
+// unique appends " (2)", " (3)", ... before the extension until the name is unused
+func (z *ZipWriter) unique(name string) string {
+	candidate := name
+	for n := 2; z.used[strings.ToLower(candidate)]; n++ {
+		ext := path.Ext(name)
+		suffix := fmt.Sprintf(" (%d)", n)
+		candidate = truncate(strings.TrimSuffix(name, ext), maxNameLength-len(suffix)-len(ext)) + suffix + ext
+	}
+	z.used[strings.ToLower(candidate)] = true
+	return candidate
+}
+
+// SanitizeName turns an arbitrary filename into a single safe path element:
+// valid NFC UTF-8 without separators, control characters, characters
+// reserved on Windows, reserved device names, or trailing dots and spaces,
+// capped at maxNameLength bytes with its extension preserved
+func SanitizeName(name string) string {
+	name = norm.NFC.String(strings.ToValidUTF8(name, "_"))
+
+	var b strings.Builder
+	for _, r := range name {
+		switch {
+		case r < 0x20 || r == 0x7f:
+			b.WriteRune('_')
+		case strings.ContainsRune(`/\<>:"|?*`, r):
+			b.WriteRune('_')
+		default:
+			b.WriteRune(r)
+		}
+	}
+	name = strings.TrimRight(strings.TrimSpace(b.String()), ". ")
+
+	if name == "" || strings.Trim(name, ".") == "" {
+		name = "file"
+	}
+	base := name
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	if reservedNames[strings.ToUpper(strings.TrimSpace(base))] {
+		name = "_" + name
+	}
+
+	if len(name) > maxNameLength {
+		ext := path.Ext(name)
+		if len(ext) > maxNameLength/4 {
+			ext = ""
+		}
+		name = truncate(strings.TrimSuffix(name, ext), maxNameLength-len(ext)) + ext
+	}
+	return name
+}
+
+// truncate cuts s to at most n bytes without splitting a character
+func truncate(s string, n int) string {
+	if len(s) <= n {
+		return s
+	}
+	for n > 0 && !utf8.RuneStart(s[n]) {
+		n--
+	}
+	return s[:n]
+}
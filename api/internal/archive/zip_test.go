@@ -0,0 +1,181 @@
+package archive
+
+import (
+	"archive/zip"
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// hostileNames are filenames as uploads arrive with them: non-ASCII,
+// decomposed, invalid UTF-8, path traversals, Windows device names,
+// reserved characters, and names colliding once sanitized
+var hostileNames = []string{
+	"photo.png",
+	"photo.png",
+	"PHOTO.png",
+	"写真.png",
+	"写真.png",
+	"😀🎉.png",
+	"café.png",       // precomposed é
+	"cafe\u0301.png", // decomposed é, the same name once in NFC
+	"Ｆｕｌｌｗｉｄｔｈ.png",
+	"../../etc/passwd",
+	"..\\..\\windows\\system32\\config",
+	"/absolute/path.png",
+	"C:\\Users\\me\\photo.png",
+	"a/b\\c:d*e?f\"g<h>i|j.png",
+	"tab\there\nnewline\x00nul.png",
+	"\x7fdel.png",
+	"CON",
+	"con.png",
+	"Com1.tar.gz",
+	"LPT9 .png",
+	"trailing dots...",
+	"trailing spaces   ",
+	"  leading and trailing  ",
+	".",
+	"..",
+	"...",
+	"",
+	" ",
+	".hidden",
+	"bad\xff\xfeutf8.png",
+	"\xc3",
+	strings.Repeat("a", 300) + ".png",
+	strings.Repeat("写", 150) + ".png",
+	strings.Repeat("😀", 80) + ".png",
+	strings.Repeat("a", 300) + "." + strings.Repeat("b", 100),
+	strings.Repeat("a", 300) + ".png",
+	"\u202Egnp.exe",
+	"ﬁle.png",
+}
+
+func TestZipWriterHostileNames(t *testing.T) {
+	var buf bytes.Buffer
+	zw := NewZipWriter(&buf)
+	modified := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	for i, name := range hostileNames {
+		w, err := zw.Create(name, modified)
+		if err != nil {
+			t.Fatalf("Create(%q): %v", name, err)
+		}
+		fmt.Fprintf(w, "entry %d", i)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	zr, err := zip.NewReader(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatalf("zip.NewReader: %v", err)
+	}
+	if len(zr.File) != len(hostileNames) {
+		t.Fatalf("archive has %d entries, want %d", len(zr.File), len(hostileNames))
+	}
+	seen := make(map[string]string)
+	for i, f := range zr.File {
+		original := hostileNames[i]
+		checkSafeName(t, original, f.Name)
+		if f.Flags&utf8Flag == 0 {
+			t.Errorf("entry %q is missing the UTF-8 flag", f.Name)
+		}
+		if f.NonUTF8 {
+			t.Errorf("entry %q read back as non-UTF-8", f.Name)
+		}
+		if want := strings.ToValidUTF8(original, "\uFFFD"); f.Comment != want {
+			t.Errorf("entry %q comment = %q, want the original name %q", f.Name, f.Comment, want)
+		}
+		folded := strings.ToLower(f.Name)
+		if other, ok := seen[folded]; ok {
+			t.Errorf("entries %q and %q collide", other, f.Name)
+		}
+		seen[folded] = f.Name
+
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("opening entry %q: %v", f.Name, err)
+		}
+		contents, err := io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("reading entry %q: %v", f.Name, err)
+		}
+		if want := fmt.Sprintf("entry %d", i); string(contents) != want {
+			t.Errorf("entry %q holds %q, want %q", f.Name, contents, want)
+		}
+	}
+}
+
+func TestSanitizeNameHostileNames(t *testing.T) {
+	for _, name := range hostileNames {
+		got := SanitizeName(name)
+		checkSafeName(t, name, got)
+		if again := SanitizeName(got); again != got {
+			t.Errorf("SanitizeName(%q) = %q, but sanitizing that again gives %q", name, got, again)
+		}
+	}
+}
+
+func TestSanitizeName(t *testing.T) {
+	tests := []struct {
+		name string
+		want string
+	}{
+		{"photo.png", "photo.png"},
+		{"写真.png", "写真.png"},
+		{"cafe\u0301.png", "café.png"},
+		{"../../etc/passwd", ".._.._etc_passwd"},
+		{"a/b\\c:d*e?f\"g<h>i|j.png", "a_b_c_d_e_f_g_h_i_j.png"},
+		{"tab\there.png", "tab_here.png"},
+		{"CON", "_CON"},
+		{"con.png", "_con.png"},
+		{"Com1.tar.gz", "_Com1.tar.gz"},
+		{"trailing dots...", "trailing dots"},
+		{"  padded  ", "padded"},
+		{"..", "file"},
+		{"", "file"},
+		{"bad\xffutf8.png", "bad_utf8.png"},
+		{strings.Repeat("a", 300) + ".png", strings.Repeat("a", maxNameLength-4) + ".png"},
+	}
+	for _, tt := range tests {
+		if got := SanitizeName(tt.name); got != tt.want {
+			t.Errorf("SanitizeName(%q) = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+// checkSafeName fails the test if name, sanitized from original, isn't a
+// single portable path element
+func checkSafeName(t *testing.T, original, name string) {
+	t.Helper()
+	switch {
+	case name == "" || name == "." || name == "..":
+		t.Errorf("%q sanitized to the unusable name %q", original, name)
+	case !utf8.ValidString(name):
+		t.Errorf("%q sanitized to invalid UTF-8 %q", original, name)
+	case !norm.NFC.IsNormalString(name):
+		t.Errorf("%q sanitized to %q, which isn't NFC", original, name)
+	case len(name) > maxNameLength:
+		t.Errorf("%q sanitized to %d bytes, over the %d byte cap", original, len(name), maxNameLength)
+	case strings.ContainsAny(name, `/\<>:"|?*`):
+		t.Errorf("%q sanitized to %q, which has a separator or reserved character", original, name)
+	case strings.IndexFunc(name, func(r rune) bool { return r < 0x20 || r == 0x7f }) >= 0:
+		t.Errorf("%q sanitized to %q, which has a control character", original, name)
+	case strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") || strings.HasPrefix(name, " "):
+		t.Errorf("%q sanitized to %q, which Windows would trim", original, name)
+	}
+	base := name
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	if reservedNames[strings.ToUpper(strings.TrimSpace(base))] {
+		t.Errorf("%q sanitized to the Windows device name %q", original, name)
+	}
+}
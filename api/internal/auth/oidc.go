@@ -0,0 +1,463 @@
+// Package auth authenticates API requests. Bearer JWTs are validated
+// against the signing keys an OIDC issuer publishes, so customers can use
+// their existing identity provider.
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"log"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Token validation errors
+var (
+	ErrMalformed  = errors.New("malformed token")
+	ErrAlgorithm  = errors.New("unsupported signing algorithm")
+	ErrUnknownKey = errors.New("unknown signing key")
+	ErrSignature  = errors.New("invalid signature")
+	ErrIssuer     = errors.New("wrong issuer")
+	ErrAudience   = errors.New("wrong audience")
+	ErrExpired    = errors.New("token expired")
+	ErrNotYet     = errors.New("token not valid yet")
+	ErrNoOwner    = errors.New("token has no owner claim")
+)
+
+const (
+	// DefaultOwnerClaim identifies the owner when no claim is configured
+	DefaultOwnerClaim = "sub"
+	// DefaultClockSkew is tolerated between the issuer's clock and ours
+	DefaultClockSkew = time.Minute
+	// jwksTTL is how long fetched signing keys are trusted before refreshing
+	jwksTTL = time.Hour
+	// jwksMinRefresh limits refetches triggered by unknown key IDs, so
+	// tokens with made-up key IDs can't hammer the issuer
+	jwksMinRefresh = 30 * time.Second
+	// jwksFetchTimeout bounds a refresh, which runs on behalf of every
+	// request waiting for it rather than under any one's context
+	jwksFetchTimeout = 10 * time.Second
+	// minRSABits is the smallest RSA modulus accepted for signing keys
+	minRSABits = 2048
+)
+
+// Config describes the trusted OIDC issuer
+type Config struct {
+	// Issuer is the issuer URL; its discovery document names the JWKS URL
+	Issuer string
+	// Audience must appear in the token's aud claim
+	Audience string
+	// OwnerClaim is the claim mapped to the job owner, e.g. sub or org_id
+	OwnerClaim string
+	// TierClaim is the claim naming the caller's service tier; empty
+	// leaves every caller on the default tier
+	TierClaim string
+	// ClockSkew is tolerated when checking exp and nbf
+	ClockSkew time.Duration
+}
+
+// Verifier validates bearer tokens issued by one OIDC issuer
+type Verifier struct {
+	cfg  Config
+	http *http.Client
+	now  func() time.Time
+
+	mu        sync.RWMutex
+	jwksURI   string
+	keys      map[string]publishedKey
+	fetchedAt time.Time
+	// refreshing is the refresh in flight, which requests needing one wait
+	// for rather than starting their own
+	refreshing *refresh
+}
+
+// publishedKey is a signing key and the algorithm its JWK restricts it to,
+// if any
+type publishedKey struct {
+	key crypto.PublicKey
+	alg string
+}
+
+// refresh is a fetch of the signing keys; err is set once done is closed
+type refresh struct {
+	done chan struct{}
+	err  error
+}
+
+// NewVerifier creates a verifier for cfg. Keys are fetched on first use.
+func NewVerifier(cfg Config) *Verifier {
+	if cfg.OwnerClaim == "" {
+		cfg.OwnerClaim = DefaultOwnerClaim
+	}
+	cfg.Issuer = strings.TrimSuffix(cfg.Issuer, "/")
+	return &Verifier{
+		cfg:  cfg,
+		http: &http.Client{Timeout: 10 * time.Second},
+		now:  time.Now,
+	}
+}
+
+// header is the JOSE header of a token
+type header struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid"`
+}
+
+// Identity is who a validated token belongs to
+type Identity struct {
+	Owner string
+	// Tier is the lowercased value of the tier claim, or empty
+	Tier string
+}
+
+// Identify validates token and returns the values of its owner and tier claims
+func (v *Verifier) Identify(ctx context.Context, token string) (Identity, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return Identity{}, ErrMalformed
+	}
+
+	var hdr header
+	if err := decodeSegment(parts[0], &hdr); err != nil {
+		return Identity{}, ErrMalformed
+	}
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return Identity{}, ErrMalformed
+	}
+
+	key, err := v.key(ctx, hdr.Kid)
+	if err != nil {
+		return Identity{}, err
+	}
+	// A key published for one algorithm isn't trusted with another
+	if key.alg != "" && key.alg != hdr.Alg {
+		return Identity{}, ErrAlgorithm
+	}
+	if err := verifySignature(hdr.Alg, key.key, parts[0]+"."+parts[1], signature); err != nil {
+		return Identity{}, err
+	}
+
+	var claims map[string]interface{}
+	if err := decodeSegment(parts[1], &claims); err != nil {
+		return Identity{}, ErrMalformed
+	}
+	if err := v.checkClaims(claims); err != nil {
+		return Identity{}, err
+	}
+
+	var identity Identity
+	switch owner := claims[v.cfg.OwnerClaim].(type) {
+	case string:
+		identity.Owner = owner
+	case float64:
+		identity.Owner = fmt.Sprintf("%.0f", owner)
+	}
+	if identity.Owner == "" {
+		return Identity{}, ErrNoOwner
+	}
+	if v.cfg.TierClaim != "" {
+		tier, _ := claims[v.cfg.TierClaim].(string)
+		identity.Tier = strings.ToLower(tier)
+	}
+	return identity, nil
+}
+
+// checkClaims enforces the issuer, audience, and validity window
+func (v *Verifier) checkClaims(claims map[string]interface{}) error {
+	if iss, _ := claims["iss"].(string); strings.TrimSuffix(iss, "/") != v.cfg.Issuer {
+		return ErrIssuer
+	}
+	if !hasAudience(claims["aud"], v.cfg.Audience) {
+		return ErrAudience
+	}
+
+	now := v.now()
+	exp, ok := claims["exp"].(float64)
+	if !ok || now.After(time.Unix(int64(exp), 0).Add(v.cfg.ClockSkew)) {
+		return ErrExpired
+	}
+	if nbf, ok := claims["nbf"].(float64); ok && now.Add(v.cfg.ClockSkew).Before(time.Unix(int64(nbf), 0)) {
+		return ErrNotYet
+	}
+	return nil
+}
+
+// hasAudience reports whether the aud claim, a string or a list, contains audience
+func hasAudience(aud interface{}, audience string) bool {
+	switch aud := aud.(type) {
+	case string:
+		return aud == audience
+	case []interface{}:
+		for _, a := range aud {
+			if a == audience {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// key returns the signing key with the given ID, refreshing the JWKS when
+// it is stale or doesn't contain the key, which is how rotations show up
+func (v *Verifier) key(ctx context.Context, kid string) (publishedKey, error) {
+	v.mu.RLock()
+	key, ok := v.keys[kid]
+	age := v.now().Sub(v.fetchedAt)
+	fetched := v.keys != nil
+	v.mu.RUnlock()
+	if ok && age < jwksTTL {
+		return key, nil
+	}
+	if !ok && fetched && age < jwksMinRefresh {
+		return publishedKey{}, ErrUnknownKey
+	}
+
+	if err := v.refresh(ctx); err != nil {
+		// Keep serving the keys we have during an issuer outage
+		if ok {
+			return key, nil
+		}
+		return publishedKey{}, ErrUnknownKey
+	}
+	v.mu.RLock()
+	defer v.mu.RUnlock()
+	if key, ok = v.keys[kid]; !ok {
+		return publishedKey{}, ErrUnknownKey
+	}
+	return key, nil
+}
+
+// refresh fetches the issuer's signing keys, or waits for the fetch
+// already in flight, so a burst of tokens signed with a new key makes one
+// request to the issuer. The fetch runs without v.mu held, so tokens signed
+// with known keys are verified meanwhile, and under a context of its own,
+// so one request giving up doesn't fail the others waiting for it.
+func (v *Verifier) refresh(ctx context.Context) error {
+	v.mu.Lock()
+	r := v.refreshing
+	if r == nil {
+		r = &refresh{done: make(chan struct{})}
+		v.refreshing = r
+		go v.fetch(r)
+	}
+	v.mu.Unlock()
+
+	select {
+	case <-r.done:
+		return r.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// fetch fetches the signing keys for r, replacing the known ones if it
+// succeeds; either way the keys aren't fetched again for a while
+func (v *Verifier) fetch(r *refresh) {
+	ctx, cancel := context.WithTimeout(context.Background(), jwksFetchTimeout)
+	defer cancel()
+	v.mu.RLock()
+	jwksURI := v.jwksURI
+	v.mu.RUnlock()
+	keys, jwksURI, err := v.fetchKeys(ctx, jwksURI)
+	if err != nil {
+		log.Printf("Failed to refresh OIDC signing keys: %v", err)
+	}
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.fetchedAt = v.now()
+	v.jwksURI = jwksURI
+	if err == nil {
+		v.keys = keys
+	}
+	v.refreshing = nil
+	r.err = err
+	close(r.done)
+}
+
+// fetchKeys fetches the issuer's signing keys from jwksURI, discovering it
+// first if it's empty, and returns them with the URI
+func (v *Verifier) fetchKeys(ctx context.Context, jwksURI string) (map[string]publishedKey, string, error) {
+	if jwksURI == "" {
+		var discovery struct {
+			JWKSURI string `json:"jwks_uri"`
+		}
+		if err := v.getJSON(ctx, v.cfg.Issuer+"/.well-known/openid-configuration", &discovery); err != nil {
+			return nil, "", err
+		}
+		if discovery.JWKSURI == "" {
+			return nil, "", errors.New("discovery document has no jwks_uri")
+		}
+		jwksURI = discovery.JWKSURI
+	}
+
+	var set struct {
+		Keys []jwk `json:"keys"`
+	}
+	if err := v.getJSON(ctx, jwksURI, &set); err != nil {
+		return nil, jwksURI, err
+	}
+
+	keys := make(map[string]publishedKey, len(set.Keys))
+	for _, k := range set.Keys {
+		if k.Use != "" && k.Use != "sig" {
+			continue
+		}
+		key, err := k.publicKey()
+		if err != nil {
+			log.Printf("Skipping OIDC signing key %q: %v", k.Kid, err)
+			continue
+		}
+		keys[k.Kid] = publishedKey{key: key, alg: k.Alg}
+	}
+	return keys, jwksURI, nil
+}
+
+// getJSON fetches url and decodes its JSON body into dst
+func (v *Verifier) getJSON(ctx context.Context, url string, dst interface{}) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := v.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("GET %s: %s", url, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(dst)
+}
+
+// jwk is one key of a JSON Web Key Set
+type jwk struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	Crv string `json:"crv"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+// publicKey converts an RSA or EC JWK to a public key
+func (k jwk) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := decodeInt(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := decodeInt(k.E)
+		if err != nil {
+			return nil, err
+		}
+		if n.BitLen() < minRSABits {
+			return nil, fmt.Errorf("RSA key of %d bits is under the %d required", n.BitLen(), minRSABits)
+		}
+		if !e.IsInt64() || e.Int64() < 3 || e.Int64() > 1<<31-1 {
+			return nil, errors.New("invalid RSA exponent")
+		}
+		return &rsa.PublicKey{N: n, E: int(e.Int64())}, nil
+	case "EC":
+		var curve elliptic.Curve
+		switch k.Crv {
+		case "P-256":
+			curve = elliptic.P256()
+		case "P-384":
+			curve = elliptic.P384()
+		default:
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := decodeInt(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := decodeInt(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		if !curve.IsOnCurve(x, y) {
+			return nil, errors.New("point is not on the curve")
+		}
+		return &ecdsa.PublicKey{Curve: curve, X: x, Y: y}, nil
+	}
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
+
+// verifySignature checks a JWS signature with an RSA or ECDSA algorithm;
+// symmetric and unsigned tokens are always rejected
+func verifySignature(alg string, key crypto.PublicKey, signed string, signature []byte) error {
+	var (
+		h      hash.Hash
+		hashID crypto.Hash
+	)
+	switch alg {
+	case "RS256", "ES256":
+		h, hashID = sha256.New(), crypto.SHA256
+	case "RS384", "ES384":
+		h, hashID = sha512.New384(), crypto.SHA384
+	case "RS512":
+		h, hashID = sha512.New(), crypto.SHA512
+	default:
+		return ErrAlgorithm
+	}
+	h.Write([]byte(signed))
+	digest := h.Sum(nil)
+
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg[0] != 'R' || rsa.VerifyPKCS1v15(key, hashID, digest, signature) != nil {
+			return ErrSignature
+		}
+	case *ecdsa.PublicKey:
+		size := (key.Curve.Params().BitSize + 7) / 8
+		if alg[0] != 'E' || len(signature) != 2*size {
+			return ErrSignature
+		}
+		r := new(big.Int).SetBytes(signature[:size])
+		s := new(big.Int).SetBytes(signature[size:])
+		if !ecdsa.Verify(key, digest, r, s) {
+			return ErrSignature
+		}
+	default:
+		return ErrSignature
+	}
+	return nil
+}
+
+// decodeSegment decodes a base64url JSON segment of a token into dst
+func decodeSegment(segment string, dst interface{}) error {
+	data, err := base64.RawURLEncoding.DecodeString(segment)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, dst)
+}
+
+// decodeInt decodes a base64url big-endian integer
+func decodeInt(s string) (*big.Int, error) {
+	data, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(data) == 0 {
+		return nil, errors.New("invalid integer")
+	}
+	return new(big.Int).SetBytes(data), nil
+}
@@ -0,0 +1,502 @@
+package auth
+
+import (
+	"context"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testAudience = "rmbg-api"
+
+// testIssuer is an in-process OIDC issuer publishing a JWKS that tests
+// can rotate
+type testIssuer struct {
+	server *httptest.Server
+
+	mu      sync.Mutex
+	keys    []jwk
+	fetches int
+	// gate, while set, holds JWKS requests until it's closed, announcing
+	// each on arrived
+	gate    chan struct{}
+	arrived chan struct{}
+}
+
+func newTestIssuer(t *testing.T) *testIssuer {
+	t.Helper()
+	issuer := &testIssuer{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/.well-known/openid-configuration", func(w http.ResponseWriter, r *http.Request) {
+		json.NewEncoder(w).Encode(map[string]string{"issuer": issuer.server.URL, "jwks_uri": issuer.server.URL + "/jwks"})
+	})
+	mux.HandleFunc("/jwks", func(w http.ResponseWriter, r *http.Request) {
+		issuer.mu.Lock()
+		issuer.fetches++
+		gate, arrived := issuer.gate, issuer.arrived
+		issuer.mu.Unlock()
+		if gate != nil {
+			arrived <- struct{}{}
+			<-gate
+		}
+		issuer.mu.Lock()
+		defer issuer.mu.Unlock()
+		json.NewEncoder(w).Encode(map[string][]jwk{"keys": issuer.keys})
+	})
+	issuer.server = httptest.NewServer(mux)
+	t.Cleanup(issuer.server.Close)
+	return issuer
+}
+
+// publish replaces the issuer's signing keys
+func (i *testIssuer) publish(keys ...jwk) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	i.keys = keys
+}
+
+// hold makes JWKS requests wait until release is called, and returns a
+// channel receiving a value as each arrives
+func (i *testIssuer) hold() (arrived <-chan struct{}, release func()) {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	gate, ch := make(chan struct{}), make(chan struct{}, 16)
+	i.gate, i.arrived = gate, ch
+	return ch, func() {
+		i.mu.Lock()
+		i.gate = nil
+		i.mu.Unlock()
+		close(gate)
+	}
+}
+
+func (i *testIssuer) jwksFetches() int {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.fetches
+}
+
+// signingKey is a private key and the JWK publishing it
+type signingKey struct {
+	kid     string
+	alg     string
+	private crypto.Signer
+}
+
+func newRSAKey(t *testing.T, kid string) signingKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatalf("generating an RSA key: %v", err)
+	}
+	return signingKey{kid: kid, alg: "RS256", private: key}
+}
+
+func newWeakRSAKey(t *testing.T, kid string) signingKey {
+	t.Helper()
+	key, err := rsa.GenerateKey(rand.Reader, 1024)
+	if err != nil {
+		t.Fatalf("generating an RSA key: %v", err)
+	}
+	return signingKey{kid: kid, alg: "RS256", private: key}
+}
+
+func newECKey(t *testing.T, kid string) signingKey {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("generating an EC key: %v", err)
+	}
+	return signingKey{kid: kid, alg: "ES256", private: key}
+}
+
+func encodeInt(n *big.Int) string {
+	return base64.RawURLEncoding.EncodeToString(n.Bytes())
+}
+
+func (k signingKey) jwk() jwk {
+	switch key := k.private.(type) {
+	case *rsa.PrivateKey:
+		return jwk{Kty: "RSA", Kid: k.kid, Use: "sig", N: encodeInt(key.N), E: encodeInt(big.NewInt(int64(key.E)))}
+	case *ecdsa.PrivateKey:
+		return jwk{Kty: "EC", Kid: k.kid, Use: "sig", Crv: "P-256", X: encodeInt(key.X), Y: encodeInt(key.Y)}
+	}
+	panic("unsupported key")
+}
+
+// sign returns a token with the claims signed by the key, under the header
+// alg, which tests may set to another than the key's
+func (k signingKey) sign(t *testing.T, alg string, claims map[string]interface{}) string {
+	t.Helper()
+	segment := func(v interface{}) string {
+		data, err := json.Marshal(v)
+		if err != nil {
+			t.Fatalf("encoding a token segment: %v", err)
+		}
+		return base64.RawURLEncoding.EncodeToString(data)
+	}
+	signed := segment(header{Alg: alg, Kid: k.kid}) + "." + segment(claims)
+	digest := sha256.Sum256([]byte(signed))
+
+	var signature []byte
+	switch key := k.private.(type) {
+	case *rsa.PrivateKey:
+		var err error
+		if signature, err = rsa.SignPKCS1v15(rand.Reader, key, crypto.SHA256, digest[:]); err != nil {
+			t.Fatalf("signing: %v", err)
+		}
+	case *ecdsa.PrivateKey:
+		r, s, err := ecdsa.Sign(rand.Reader, key, digest[:])
+		if err != nil {
+			t.Fatalf("signing: %v", err)
+		}
+		signature = make([]byte, 64)
+		r.FillBytes(signature[:32])
+		s.FillBytes(signature[32:])
+	}
+	return signed + "." + base64.RawURLEncoding.EncodeToString(signature)
+}
+
+// testClock is a clock tests move by hand
+type testClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *testClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newTestVerifier(issuer *testIssuer, clock *testClock) *Verifier {
+	v := NewVerifier(Config{
+		Issuer:    issuer.server.URL + "/",
+		Audience:  testAudience,
+		TierClaim: "tier",
+		ClockSkew: DefaultClockSkew,
+	})
+	v.now = clock.Now
+	return v
+}
+
+func TestIdentify(t *testing.T) {
+	issuer := newTestIssuer(t)
+	rsaKey, ecKey := newRSAKey(t, "rsa-1"), newECKey(t, "ec-1")
+	issuer.publish(rsaKey.jwk(), ecKey.jwk())
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	v := newTestVerifier(issuer, clock)
+
+	claims := func(change func(map[string]interface{})) map[string]interface{} {
+		c := map[string]interface{}{
+			"iss":  issuer.server.URL,
+			"aud":  testAudience,
+			"sub":  "alice",
+			"tier": "Pro",
+			"exp":  clock.Now().Add(time.Hour).Unix(),
+			"nbf":  clock.Now().Add(-time.Minute).Unix(),
+		}
+		if change != nil {
+			change(c)
+		}
+		return c
+	}
+
+	tests := []struct {
+		name    string
+		token   string
+		want    Identity
+		wantErr error
+	}{
+		{
+			name:  "RS256",
+			token: rsaKey.sign(t, "RS256", claims(nil)),
+			want:  Identity{Owner: "alice", Tier: "pro"},
+		},
+		{
+			name:  "ES256",
+			token: ecKey.sign(t, "ES256", claims(nil)),
+			want:  Identity{Owner: "alice", Tier: "pro"},
+		},
+		{
+			name:  "audience among several",
+			token: rsaKey.sign(t, "RS256", claims(func(c map[string]interface{}) { c["aud"] = []string{"other", testAudience} })),
+			want:  Identity{Owner: "alice", Tier: "pro"},
+		},
+		{
+			name:  "expired within the clock skew",
+			token: rsaKey.sign(t, "RS256", claims(func(c map[string]interface{}) { c["exp"] = clock.Now().Add(-30 * time.Second).Unix() })),
+			want:  Identity{Owner: "alice", Tier: "pro"},
+		},
+		{
+			name:    "wrong audience",
+			token:   rsaKey.sign(t, "RS256", claims(func(c map[string]interface{}) { c["aud"] = "other" })),
+			wantErr: ErrAudience,
+		},
+		{
+			name:    "no audience",
+			token:   rsaKey.sign(t, "RS256", claims(func(c map[string]interface{}) { delete(c, "aud") })),
+			wantErr: ErrAudience,
+		},
+		{
+			name:    "wrong issuer",
+			token:   rsaKey.sign(t, "RS256", claims(func(c map[string]interface{}) { c["iss"] = "https://evil.example" })),
+			wantErr: ErrIssuer,
+		},
+		{
+			name:    "expired",
+			token:   rsaKey.sign(t, "RS256", claims(func(c map[string]interface{}) { c["exp"] = clock.Now().Add(-2 * time.Minute).Unix() })),
+			wantErr: ErrExpired,
+		},
+		{
+			name:    "no expiry",
+			token:   rsaKey.sign(t, "RS256", claims(func(c map[string]interface{}) { delete(c, "exp") })),
+			wantErr: ErrExpired,
+		},
+		{
+			name:    "not valid yet",
+			token:   rsaKey.sign(t, "RS256", claims(func(c map[string]interface{}) { c["nbf"] = clock.Now().Add(5 * time.Minute).Unix() })),
+			wantErr: ErrNotYet,
+		},
+		{
+			name:    "no owner",
+			token:   rsaKey.sign(t, "RS256", claims(func(c map[string]interface{}) { delete(c, "sub") })),
+			wantErr: ErrNoOwner,
+		},
+		{
+			name:    "symmetric algorithm",
+			token:   rsaKey.sign(t, "HS256", claims(nil)),
+			wantErr: ErrAlgorithm,
+		},
+		{
+			name:    "unsigned",
+			token:   rsaKey.sign(t, "none", claims(nil)),
+			wantErr: ErrAlgorithm,
+		},
+		{
+			name:    "algorithm of another key type",
+			token:   ecKey.sign(t, "RS256", claims(nil)),
+			wantErr: ErrSignature,
+		},
+		{
+			name:    "tampered claims",
+			token:   tamper(rsaKey.sign(t, "RS256", claims(nil)), claims(func(c map[string]interface{}) { c["sub"] = "mallory" })),
+			wantErr: ErrSignature,
+		},
+		{
+			name:    "malformed",
+			token:   "not.a-token",
+			wantErr: ErrMalformed,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := v.Identify(context.Background(), tt.token)
+			if !errors.Is(err, tt.wantErr) || (tt.wantErr == nil && err != nil) {
+				t.Fatalf("Identify error = %v, want %v", err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Fatalf("Identify = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+// tamper replaces a token's claims, keeping its header and signature
+func tamper(token string, claims map[string]interface{}) string {
+	parts := strings.Split(token, ".")
+	data, _ := json.Marshal(claims)
+	parts[1] = base64.RawURLEncoding.EncodeToString(data)
+	return strings.Join(parts, ".")
+}
+
+func TestIdentifyFollowsKeyRotation(t *testing.T) {
+	issuer := newTestIssuer(t)
+	oldKey, newKey := newRSAKey(t, "2024"), newRSAKey(t, "2025")
+	issuer.publish(oldKey.jwk())
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	v := newTestVerifier(issuer, clock)
+	ctx := context.Background()
+	claims := func() map[string]interface{} {
+		return map[string]interface{}{
+			"iss": issuer.server.URL,
+			"aud": testAudience,
+			"sub": "alice",
+			"exp": clock.Now().Add(time.Hour).Unix(),
+		}
+	}
+
+	if _, err := v.Identify(ctx, oldKey.sign(t, "RS256", claims())); err != nil {
+		t.Fatalf("Identify with the published key: %v", err)
+	}
+
+	// The issuer starts signing with a new key
+	issuer.publish(oldKey.jwk(), newKey.jwk())
+	fetches := issuer.jwksFetches()
+	if _, err := v.Identify(ctx, newKey.sign(t, "RS256", claims())); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Identify with a new key right after a fetch = %v, want ErrUnknownKey", err)
+	}
+	if issuer.jwksFetches() != fetches {
+		t.Fatalf("an unknown key ID refetched the JWKS within %v", jwksMinRefresh)
+	}
+	clock.Advance(jwksMinRefresh)
+	if _, err := v.Identify(ctx, newKey.sign(t, "RS256", claims())); err != nil {
+		t.Fatalf("Identify with the rotated-in key: %v", err)
+	}
+	if issuer.jwksFetches() != fetches+1 {
+		t.Fatalf("JWKS fetched %d times for the new key, want once", issuer.jwksFetches()-fetches)
+	}
+
+	// The old key is retired; it's dropped once the keys go stale
+	issuer.publish(newKey.jwk())
+	clock.Advance(jwksTTL)
+	if _, err := v.Identify(ctx, oldKey.sign(t, "RS256", claims())); !errors.Is(err, ErrUnknownKey) {
+		t.Fatalf("Identify with a retired key = %v, want ErrUnknownKey", err)
+	}
+	if _, err := v.Identify(ctx, newKey.sign(t, "RS256", claims())); err != nil {
+		t.Fatalf("Identify with the current key: %v", err)
+	}
+}
+
+func TestIdentifyKeepsKeysThroughIssuerOutage(t *testing.T) {
+	issuer := newTestIssuer(t)
+	key := newECKey(t, "ec-1")
+	issuer.publish(key.jwk())
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	v := newTestVerifier(issuer, clock)
+	token := func() string {
+		return key.sign(t, "ES256", map[string]interface{}{
+			"iss": issuer.server.URL,
+			"aud": testAudience,
+			"sub": "alice",
+			"exp": clock.Now().Add(time.Hour).Unix(),
+		})
+	}
+	if _, err := v.Identify(context.Background(), token()); err != nil {
+		t.Fatalf("Identify: %v", err)
+	}
+
+	issuer.server.Close()
+	clock.Advance(jwksTTL)
+	if _, err := v.Identify(context.Background(), token()); err != nil {
+		t.Fatalf("Identify with stale keys while the issuer is down: %v", err)
+	}
+}
+
+func TestIdentifyRejectsKeysUnfitForTheToken(t *testing.T) {
+	issuer := newTestIssuer(t)
+	weak, restricted, encryption := newWeakRSAKey(t, "weak"), newRSAKey(t, "rs384-only"), newRSAKey(t, "enc")
+	restrictedJWK, encryptionJWK := restricted.jwk(), encryption.jwk()
+	restrictedJWK.Alg = "RS384"
+	encryptionJWK.Use = "enc"
+	pinned := newRSAKey(t, "rs256-only")
+	pinnedJWK := pinned.jwk()
+	pinnedJWK.Alg = "RS256"
+	issuer.publish(weak.jwk(), restrictedJWK, encryptionJWK, pinnedJWK)
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	v := newTestVerifier(issuer, clock)
+	claims := map[string]interface{}{
+		"iss": issuer.server.URL,
+		"aud": testAudience,
+		"sub": "alice",
+		"exp": clock.Now().Add(time.Hour).Unix(),
+	}
+
+	for _, tc := range []struct {
+		name    string
+		token   string
+		wantErr error
+	}{
+		{"RSA key under 2048 bits", weak.sign(t, "RS256", claims), ErrUnknownKey},
+		{"algorithm other than the key's", restricted.sign(t, "RS256", claims), ErrAlgorithm},
+		{"key published for encryption", encryption.sign(t, "RS256", claims), ErrUnknownKey},
+		{"algorithm the key is published for", pinned.sign(t, "RS256", claims), nil},
+	} {
+		if _, err := v.Identify(context.Background(), tc.token); !errors.Is(err, tc.wantErr) || (tc.wantErr == nil && err != nil) {
+			t.Fatalf("%s: Identify error = %v, want %v", tc.name, err, tc.wantErr)
+		}
+	}
+}
+
+func TestIdentifyRefreshesKeysOnce(t *testing.T) {
+	issuer := newTestIssuer(t)
+	oldKey, newKey := newRSAKey(t, "2024"), newRSAKey(t, "2025")
+	issuer.publish(oldKey.jwk())
+	clock := &testClock{now: time.Unix(1700000000, 0)}
+	v := newTestVerifier(issuer, clock)
+	ctx := context.Background()
+	token := func(key signingKey) string {
+		return key.sign(t, "RS256", map[string]interface{}{
+			"iss": issuer.server.URL,
+			"aud": testAudience,
+			"sub": "alice",
+			"exp": clock.Now().Add(time.Hour).Unix(),
+		})
+	}
+	if _, err := v.Identify(ctx, token(oldKey)); err != nil {
+		t.Fatalf("Identify: %v", err)
+	}
+
+	// A burst of tokens signed with a new key arrives while the issuer is slow
+	issuer.publish(oldKey.jwk(), newKey.jwk())
+	clock.Advance(jwksMinRefresh)
+	fetches := issuer.jwksFetches()
+	arrived, release := issuer.hold()
+	const burst = 10
+	errs := make(chan error, burst)
+	for i := 0; i < burst; i++ {
+		go func() {
+			_, err := v.Identify(ctx, token(newKey))
+			errs <- err
+		}()
+	}
+	select {
+	case <-arrived:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("the new key never made the verifier fetch the JWKS")
+	}
+
+	// Tokens signed with a known key don't wait for the fetch
+	done := make(chan error, 1)
+	go func() {
+		_, err := v.Identify(ctx, token(oldKey))
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatalf("Identify with a known key during a fetch: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Identify with a known key waited for the JWKS fetch")
+	}
+
+	release()
+	for i := 0; i < burst; i++ {
+		if err := <-errs; err != nil {
+			t.Fatalf("Identify with the new key: %v", err)
+		}
+	}
+	if n := issuer.jwksFetches() - fetches; n != 1 {
+		t.Fatalf("JWKS fetched %d times for the burst, want once", n)
+	}
+}
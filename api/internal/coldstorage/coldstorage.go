@@ -0,0 +1,123 @@
+// Package coldstorage keeps the records and results of completed jobs once
+// their retention ends, outside Redis and the results directory, for as
+// long as compliance requires
+package coldstorage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// tmpSuffix marks archive files still being written
+const tmpSuffix = ".tmp"
+
+// recordName is the name of the job record in a job's archive
+const recordName = "job.json"
+
+// Archiver copies completed jobs to cold storage before they're torn down
+type Archiver interface {
+	// Archive writes the job's record and the result file at resultPath,
+	// returning where they were archived. Archiving a job again writes the
+	// same location, and a result already gone from resultPath, as after
+	// an interrupted teardown removed it, keeps the earlier copy, so a
+	// teardown can resume from any step.
+	Archive(ctx context.Context, job *queue.Job, resultPath string) (string, error)
+}
+
+// DirArchiver archives jobs to a local directory, each under
+// YYYY/MM/DD/<job ID>/ by the day it was created
+type DirArchiver struct {
+	root string
+}
+
+// NewDirArchiver returns an archiver writing under root, creating it
+func NewDirArchiver(root string) (*DirArchiver, error) {
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return nil, err
+	}
+	return &DirArchiver{root: root}, nil
+}
+
+// Location returns the directory the job is archived in. It depends only on
+// the job's ID and creation time, so it's the same on every attempt.
+func (a *DirArchiver) Location(job *queue.Job) string {
+	return filepath.Join(a.root, job.CreatedAt.UTC().Format("2006/01/02"), job.ID)
+}
+
+// Archive writes the job's record and result under Location
+func (a *DirArchiver) Archive(ctx context.Context, job *queue.Job, resultPath string) (string, error) {
+	dir := a.Location(job)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return "", err
+	}
+
+	if resultPath != "" {
+		if err := a.copyResult(dir, resultPath); err != nil {
+			return "", fmt.Errorf("archiving the result of job %s: %w", job.ID, err)
+		}
+	}
+
+	// The record goes last, so an archive with one is complete
+	data, err := json.MarshalIndent(job, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	if err := writeFile(filepath.Join(dir, recordName), func(w io.Writer) error {
+		_, err := w.Write(data)
+		return err
+	}); err != nil {
+		return "", fmt.Errorf("archiving the record of job %s: %w", job.ID, err)
+	}
+	return dir, nil
+}
+
+// copyResult copies the result file into dir, keeping whatever copy an
+// earlier attempt made if the file is gone
+func (a *DirArchiver) copyResult(dir, resultPath string) error {
+	name := "result" + filepath.Ext(resultPath)
+	src, err := os.Open(resultPath)
+	if os.IsNotExist(err) {
+		// Removed after an earlier attempt copied it, or lost before the
+		// job expired; either way there's nothing left to copy
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	return writeFile(filepath.Join(dir, name), func(w io.Writer) error {
+		_, err := io.Copy(w, src)
+		return err
+	})
+}
+
+// writeFile writes a file through a temporary copy renamed into place, so
+// an interrupted write never leaves a partial file under the final name
+func writeFile(path string, write func(w io.Writer) error) error {
+	tmp := path + tmpSuffix
+	f, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := write(f); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		os.Remove(tmp)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, path)
+}
@@ -0,0 +1,211 @@
+// Package config reads the settings shared by the API server and the
+// operator tools, so both see the same queue the same way
+package config
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	awsconfig "github.com/aws/aws-sdk-go-v2/config"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// Getenv returns the environment variable value or a default if not set
+func Getenv(key, defaultValue string) string {
+	value := os.Getenv(key)
+	if value == "" {
+		return defaultValue
+	}
+	return value
+}
+
+// GetenvInt returns the environment variable as an int or a default if not set or invalid
+func GetenvInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
+}
+
+// getenvMillis returns the environment variable as a duration in
+// milliseconds, or zero if not set or invalid
+func getenvMillis(key string) time.Duration {
+	return time.Duration(GetenvInt(key, 0)) * time.Millisecond
+}
+
+// Queue backends selected by QUEUE_BACKEND
+const (
+	BackendRedis  = "redis"
+	BackendMemory = "memory"
+	BackendSQS    = "sqs"
+	BackendNATS   = "nats"
+)
+
+// QueueBackend returns the queue backend named by QUEUE_BACKEND, Redis
+// unless it's set. The processor claims jobs from Redis only, so the SQS
+// and NATS backends are refused unless QUEUE_EXTERNAL_WORKERS says other
+// workers claim their jobs through the Go queue package; otherwise the
+// jobs would stay pending forever.
+func QueueBackend() (string, error) {
+	switch backend := Getenv("QUEUE_BACKEND", BackendRedis); backend {
+	case BackendRedis, BackendMemory:
+		return backend, nil
+	case BackendSQS, BackendNATS:
+		if Getenv("QUEUE_EXTERNAL_WORKERS", "false") != "true" {
+			return "", fmt.Errorf("QUEUE_BACKEND=%s has no workers: the processor claims jobs from Redis only; set QUEUE_EXTERNAL_WORKERS=true if workers of your own claim them through the Go queue package", backend)
+		}
+		return backend, nil
+	default:
+		return "", fmt.Errorf("unknown QUEUE_BACKEND %q, want %s, %s, %s, or %s", backend, BackendRedis, BackendMemory, BackendSQS, BackendNATS)
+	}
+}
+
+// OpenQueue connects to the job queue named by REDIS_URL, configured by
+// the PUBLISH_JOB_EVENTS, JOB_*, and REDIS_* settings, including the
+// connection pool, timeouts, retries, and whether pending jobs are queued
+// on streams, ordered for claiming by QUEUE_SCHEDULING, and the BREAKER_*
+// circuit breaker
+func OpenQueue() (*queue.RedisQueue, error) {
+	// Large job records are compressed in Redis when enabled
+	compression, err := queue.ParseCompression(Getenv("JOB_COMPRESSION", queue.CompressionNone))
+	if err != nil {
+		return nil, fmt.Errorf("invalid JOB_COMPRESSION: %w", err)
+	}
+	scheduling, err := queue.ParseScheduling(Getenv("QUEUE_SCHEDULING", string(queue.SchedulingFIFO)))
+	if err != nil {
+		return nil, fmt.Errorf("invalid QUEUE_SCHEDULING: %w", err)
+	}
+	breaker, err := breakerConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	opts := recordOptions()
+	opts.PublishEvents = Getenv("PUBLISH_JOB_EVENTS", "false") == "true"
+	opts.EventsChannel = Getenv("JOB_EVENTS_CHANNEL", queue.DefaultEventsChannel)
+	opts.KeyCaps = parseKeyCaps(Getenv("REDIS_KEY_CAPS", ""))
+	opts.KeyPrefix = Getenv("REDIS_KEY_PREFIX", "")
+	opts.MinIdleConns = GetenvInt("REDIS_MIN_IDLE_CONNS", 4)
+	opts.PoolSize = GetenvInt("REDIS_POOL_SIZE", 0)
+	opts.PoolTimeout = getenvMillis("REDIS_POOL_TIMEOUT_MS")
+	opts.DialTimeout = getenvMillis("REDIS_DIAL_TIMEOUT_MS")
+	opts.ReadTimeout = getenvMillis("REDIS_READ_TIMEOUT_MS")
+	opts.WriteTimeout = getenvMillis("REDIS_WRITE_TIMEOUT_MS")
+	opts.CommandTimeout = getenvMillis("REDIS_COMMAND_TIMEOUT_MS")
+	opts.MaxRetries = GetenvInt("REDIS_MAX_RETRIES", 0)
+	opts.MinRetryBackoff = getenvMillis("REDIS_MIN_RETRY_BACKOFF_MS")
+	opts.MaxRetryBackoff = getenvMillis("REDIS_MAX_RETRY_BACKOFF_MS")
+	opts.PendingStreams = Getenv("REDIS_PENDING_STREAMS", "false") == "true"
+	opts.StreamGroup = Getenv("REDIS_STREAM_GROUP", queue.DefaultStreamGroup)
+	opts.StreamClaimIdle = time.Duration(GetenvInt("REDIS_STREAM_CLAIM_IDLE_SECONDS", 0)) * time.Second
+	opts.Scheduling = scheduling
+	opts.Breaker = breaker
+	opts.Codec = queue.Codec{
+		Algorithm: compression,
+		Threshold: GetenvInt("JOB_COMPRESSION_THRESHOLD", queue.DefaultCompressionThreshold),
+	}
+	return queue.NewRedisQueue(Getenv("REDIS_URL", "localhost:6379"), 0, opts)
+}
+
+// breakerConfig reads the circuit breaker settings: BREAKER_WINDOW finished
+// jobs, 0 to disable it, of which BREAKER_FAILURE_RATE failing stops claims
+// for BREAKER_COOLDOWN_SECONDS
+func breakerConfig() (queue.BreakerConfig, error) {
+	c := queue.BreakerConfig{
+		Window:      GetenvInt("BREAKER_WINDOW", 0),
+		FailureRate: 0.5,
+		Cooldown:    time.Duration(GetenvInt("BREAKER_COOLDOWN_SECONDS", 60)) * time.Second,
+	}
+	if !c.Enabled() {
+		return c, nil
+	}
+	if value := Getenv("BREAKER_FAILURE_RATE", ""); value != "" {
+		rate, err := strconv.ParseFloat(value, 64)
+		if err != nil || rate <= 0 || rate > 1 {
+			return c, fmt.Errorf("invalid BREAKER_FAILURE_RATE %q, want a fraction above 0 and at most 1", value)
+		}
+		c.FailureRate = rate
+	}
+	if c.Cooldown <= 0 {
+		return c, fmt.Errorf("invalid BREAKER_COOLDOWN_SECONDS, want a positive number of seconds")
+	}
+	return c, nil
+}
+
+// OpenMemoryQueue creates an empty in-memory job queue, keeping records as
+// long as the JOB_*_TTL_SECONDS settings say
+func OpenMemoryQueue() *queue.MemoryQueue {
+	return queue.NewMemoryQueue(recordOptions())
+}
+
+// OpenSQSQueue creates a job queue on the SQS queue at SQS_QUEUE_URL, with
+// the job records in the DynamoDB table DYNAMODB_JOBS_TABLE, using the AWS
+// SDK's standard credentials and region settings
+func OpenSQSQueue(ctx context.Context) (*queue.SQSQueue, error) {
+	queueURL := Getenv("SQS_QUEUE_URL", "")
+	if queueURL == "" {
+		return nil, fmt.Errorf("SQS_QUEUE_URL is required for the %s backend", BackendSQS)
+	}
+	table := Getenv("DYNAMODB_JOBS_TABLE", "")
+	if table == "" {
+		return nil, fmt.Errorf("DYNAMODB_JOBS_TABLE is required for the %s backend", BackendSQS)
+	}
+	awsCfg, err := awsconfig.LoadDefaultConfig(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("loading AWS configuration: %w", err)
+	}
+
+	opts := recordOptions()
+	store := queue.NewDynamoStore(dynamodb.NewFromConfig(awsCfg), table, opts)
+	return queue.NewSQSQueue(sqs.NewFromConfig(awsCfg), queue.SQSConfig{
+		QueueURL:          queueURL,
+		VisibilityTimeout: time.Duration(GetenvInt("SQS_VISIBILITY_TIMEOUT_SECONDS", 0)) * time.Second,
+		Store:             store,
+	}, opts), nil
+}
+
+// OpenNATSQueue connects to the NATS JetStream job queue at NATS_URL
+func OpenNATSQueue() (*queue.NATSQueue, error) {
+	return queue.NewNATSQueue(queue.NATSConfig{
+		URL:     Getenv("NATS_URL", "nats://localhost:4222"),
+		AckWait: time.Duration(GetenvInt("NATS_ACK_WAIT_SECONDS", 0)) * time.Second,
+	}, recordOptions())
+}
+
+// recordOptions reads how long job records are kept by status, and their
+// summaries once finished
+func recordOptions() queue.Options {
+	return queue.Options{
+		PendingTTL:   time.Duration(GetenvInt("JOB_PENDING_TTL_SECONDS", 0)) * time.Second,
+		CompletedTTL: time.Duration(GetenvInt("JOB_COMPLETED_TTL_SECONDS", 0)) * time.Second,
+		FailedTTL:    time.Duration(GetenvInt("JOB_FAILED_TTL_SECONDS", 0)) * time.Second,
+		HistoryTTL:   time.Duration(GetenvInt("JOB_HISTORY_TTL_SECONDS", 0)) * time.Second,
+	}
+}
+
+// parseKeyCaps parses a "feature=count,feature=count" list of Redis key caps
+func parseKeyCaps(value string) map[string]int64 {
+	caps := make(map[string]int64)
+	for _, entry := range strings.Split(value, ",") {
+		name, limit, ok := strings.Cut(strings.TrimSpace(entry), "=")
+		if !ok {
+			continue
+		}
+		n, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil {
+			log.Printf("Ignoring invalid Redis key cap %q", entry)
+			continue
+		}
+		caps[name] = n
+	}
+	return caps
+}
@@ -0,0 +1,28 @@
+package config
+
+import "testing"
+
+func TestQueueBackendRefusesBackendsWithoutWorkers(t *testing.T) {
+	for _, tc := range []struct {
+		backend  string
+		external string
+		wantErr  bool
+	}{
+		{"", "", false},
+		{BackendRedis, "", false},
+		{BackendMemory, "", false},
+		{BackendSQS, "", true},
+		{BackendSQS, "false", true},
+		{BackendSQS, "true", false},
+		{BackendNATS, "", true},
+		{BackendNATS, "true", false},
+		{"kafka", "true", true},
+	} {
+		t.Setenv("QUEUE_BACKEND", tc.backend)
+		t.Setenv("QUEUE_EXTERNAL_WORKERS", tc.external)
+		backend, err := QueueBackend()
+		if (err != nil) != tc.wantErr {
+			t.Errorf("QUEUE_BACKEND=%q QUEUE_EXTERNAL_WORKERS=%q: got %q, %v", tc.backend, tc.external, backend, err)
+		}
+	}
+}
@@ -0,0 +1,278 @@
+// Package delivery pushes completed results to the external destinations
+// attached to a job, retrying each destination independently
+package delivery
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"time"
+
+	"rembg-v2/api/internal/errclass"
+	"rembg-v2/api/internal/fault"
+	"rembg-v2/api/internal/queue"
+)
+
+// Retry backoff between delivery rounds of a job
+const (
+	minBackoff = 10 * time.Second
+	maxBackoff = 10 * time.Minute
+)
+
+// idleInterval is how long a worker sleeps when no deliveries are due
+const idleInterval = time.Second
+
+// maxRecordRetries bounds the times a job's delivery outcomes are applied
+// again to a job that changed while its destinations were tried
+const maxRecordRetries = 5
+
+// deliveryOutcomes counts delivery attempts by outcome
+var deliveryOutcomes = expvar.NewMap("delivery_attempts")
+
+// Queue is the subset of the job queue the delivery worker needs
+type Queue interface {
+	GetJob(ctx context.Context, jobID string) (*queue.Job, error)
+	UpdateJob(ctx context.Context, job *queue.Job) error
+	ScheduleDelivery(ctx context.Context, jobID string, at time.Time) error
+	ClaimDueDelivery(ctx context.Context) (string, error)
+}
+
+// Worker executes the deliveries of completed jobs
+type Worker struct {
+	clock queue.Clock
+	jobs  Queue
+	http  *http.Client
+	// maxAttempts caps the delivery attempts of a job across all its destinations
+	maxAttempts int
+}
+
+// NewWorker creates a delivery worker allowing maxAttempts attempts per job
+func NewWorker(jobs Queue, maxAttempts int) *Worker {
+	return &Worker{
+		clock:       queue.SystemClock{},
+		jobs:        jobs,
+		http:        newClient(forbiddenIP),
+		maxAttempts: maxAttempts,
+	}
+}
+
+// Run processes due deliveries until ctx is done
+func (w *Worker) Run(ctx context.Context) {
+	for {
+		jobID, err := w.jobs.ClaimDueDelivery(ctx)
+		if err != nil && ctx.Err() == nil {
+			log.Printf("Failed to claim delivery: %v", err)
+		}
+		if jobID == "" {
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(idleInterval):
+			}
+			continue
+		}
+
+		w.deliver(ctx, jobID)
+	}
+}
+
+// deliver attempts every pending destination of a job once, then
+// reschedules the job if any destination is still pending
+func (w *Worker) deliver(ctx context.Context, jobID string) {
+	job, err := queue.NilIfNotFound(w.jobs.GetJob(ctx, jobID))
+	if err != nil {
+		log.Printf("Failed to load job %s for delivery: %v", jobID, err)
+		w.reschedule(ctx, jobID, errclass.Delay(err, minBackoff))
+		return
+	}
+	if job == nil || job.Status != queue.StatusCompleted {
+		return
+	}
+
+	attempts := 0
+	for _, d := range job.Deliveries {
+		attempts += d.Attempts
+	}
+
+	pending := false
+	var delay time.Duration
+	for i := range job.Deliveries {
+		d := &job.Deliveries[i]
+		if d.Status != queue.DeliveryPending {
+			continue
+		}
+		if attempts >= w.maxAttempts {
+			d.Status = queue.DeliveryFailed
+			d.LastError = "attempt_limit_reached"
+			continue
+		}
+
+		attempts++
+		d.Attempts++
+		err := w.send(ctx, job, d)
+		if err != nil {
+			log.Printf("Delivery %d of job %s failed: %v", i, job.ID, err)
+		}
+		switch {
+		case err == nil:
+			now := w.clock.Now()
+			d.Status = queue.DeliveryDelivered
+			d.DeliveredAt = &now
+			d.LastError = ""
+			deliveryOutcomes.Add("delivered", 1)
+		// A send interrupted by shutdown wasn't refused by the destination
+		case errclass.Retryable(err) || ctx.Err() != nil:
+			d.LastError = lastError(err)
+			pending = true
+			// Wait as long as the most demanding destination asks
+			if wait := errclass.Delay(err, backoff(attempts)); wait > delay {
+				delay = wait
+			}
+			if errclass.Classify(err) == errclass.Throttled {
+				deliveryOutcomes.Add("throttled", 1)
+			} else {
+				deliveryOutcomes.Add("retried", 1)
+			}
+		default:
+			d.Status = queue.DeliveryFailed
+			d.LastError = lastError(err)
+			deliveryOutcomes.Add("failed", 1)
+		}
+	}
+
+	if err := w.record(ctx, job); err != nil {
+		log.Printf("Failed to record deliveries of job %s: %v", job.ID, err)
+	}
+	if pending {
+		w.reschedule(ctx, job.ID, delay)
+	}
+}
+
+// record writes the outcomes of a job's deliveries. A job written since it
+// was read, as by a transfer replacing its pending deliveries, is read again
+// and the outcomes applied to its deliveries to the same destinations.
+func (w *Worker) record(ctx context.Context, job *queue.Job) error {
+	outcomes := job.Deliveries
+	for i := 0; ; i++ {
+		err := w.jobs.UpdateJob(ctx, job)
+		if !errors.Is(err, queue.ErrVersionConflict) || i == maxRecordRetries {
+			return err
+		}
+		if job, err = queue.NilIfNotFound(w.jobs.GetJob(ctx, job.ID)); err != nil || job == nil {
+			return err
+		}
+		for j := range job.Deliveries {
+			d := &job.Deliveries[j]
+			for _, o := range outcomes {
+				if o.Type == d.Type && o.URL == d.URL && d.Status == queue.DeliveryPending {
+					*d = o
+				}
+			}
+		}
+	}
+}
+
+// backoff returns the exponential backoff after a job's attempts
+func backoff(attempts int) time.Duration {
+	d := minBackoff << (attempts - 1)
+	if d <= 0 || d > maxBackoff {
+		d = maxBackoff
+	}
+	return d
+}
+
+// reschedule makes the job due again after delay
+func (w *Worker) reschedule(ctx context.Context, jobID string, delay time.Duration) {
+	if err := w.jobs.ScheduleDelivery(ctx, jobID, w.clock.Now().Add(delay)); err != nil {
+		log.Printf("Failed to reschedule deliveries of job %s: %v", jobID, err)
+	}
+}
+
+// lastError is the error class recorded on a failed delivery, which the
+// job's owner can read. It says what went wrong without echoing resolver,
+// dial, or TLS details of the network the destination sits in.
+func lastError(err error) string {
+	var status *statusError
+	switch {
+	case errors.Is(err, ErrForbiddenDestination):
+		return "forbidden_destination"
+	case errors.Is(err, errResultUnavailable):
+		return "result_unavailable"
+	case errors.As(err, &status):
+		return fmt.Sprintf("http_%d", status.code)
+	}
+	return string(errclass.Classify(err)) + "_error"
+}
+
+// statusError is a destination's non-2xx response
+type statusError struct {
+	error
+	code int
+}
+
+func (e *statusError) Unwrap() error { return e.error }
+
+// send pushes the result to one destination. Whether a failure is worth
+// retrying, and how soon, is left to errclass.
+func (w *Worker) send(ctx context.Context, job *queue.Job, d *queue.Delivery) error {
+	if err := fault.Maybe(ctx, fault.DeliverySend, "job_id", job.ID, "owner", job.Owner); err != nil {
+		return err
+	}
+
+	// Deliveries submitted before https was required are refused here
+	if u, err := url.Parse(d.URL); err != nil || u.Scheme != "https" {
+		return errclass.New(ErrForbiddenDestination, errclass.Permanent)
+	}
+
+	f, err := os.Open(job.OutputPath)
+	if err != nil {
+		return fmt.Errorf("%w: %w", errResultUnavailable, err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	method := http.MethodPut
+	if d.Type == queue.DeliveryWebhook {
+		method = http.MethodPost
+	}
+	req, err := http.NewRequestWithContext(ctx, method, d.URL, f)
+	if err != nil {
+		return errclass.New(err, errclass.Permanent)
+	}
+	req.ContentLength = info.Size()
+	if contentType := queue.FormatMediaType(job.ResultFormat()); contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+	if d.Type == queue.DeliveryWebhook {
+		req.Header.Set("X-Job-ID", job.ID)
+	}
+
+	resp, err := w.http.Do(req)
+	if err != nil {
+		// Don't record the URL, which may carry a presigned signature
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			err = urlErr.Err
+		}
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+
+	// Client errors other than timeouts and throttling won't fix themselves,
+	// and redirects aren't followed, so a 3xx fails the delivery too
+	if err := errclass.HTTPStatus(resp, w.clock.Now()); err != nil {
+		return &statusError{error: err, code: resp.StatusCode}
+	}
+	return nil
+}
@@ -0,0 +1,91 @@
+package delivery
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"syscall"
+	"time"
+
+	"rembg-v2/api/internal/errclass"
+)
+
+// ErrForbiddenDestination is returned for delivery URLs that aren't https
+// or that reach an address inside the service's own network
+var ErrForbiddenDestination = errors.New("delivery destination not allowed")
+
+// errResultUnavailable is returned when a job's result can't be read
+var errResultUnavailable = errors.New("result unavailable")
+
+// forbiddenIP reports whether ip is loopback, private, link-local,
+// unspecified, or multicast, none of which a delivery may reach
+func forbiddenIP(ip net.IP) bool {
+	if v4 := ip.To4(); v4 != nil {
+		ip = v4
+	}
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || ip.IsMulticast()
+}
+
+// ValidateURL checks a delivery URL when it's submitted: it must be https,
+// carry no credentials, and its host must resolve only to public addresses.
+// The worker checks the address again when it dials, since DNS may change.
+func ValidateURL(ctx context.Context, raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil || u.Scheme != "https" || u.Hostname() == "" || u.User != nil {
+		return fmt.Errorf("%w: delivery url must be an absolute https URL", ErrForbiddenDestination)
+	}
+
+	host := u.Hostname()
+	if ip := net.ParseIP(host); ip != nil {
+		if forbiddenIP(ip) {
+			return fmt.Errorf("%w: %s is not a public address", ErrForbiddenDestination, host)
+		}
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil || len(addrs) == 0 {
+		return fmt.Errorf("%w: %s does not resolve", ErrForbiddenDestination, host)
+	}
+	for _, addr := range addrs {
+		if forbiddenIP(addr.IP) {
+			return fmt.Errorf("%w: %s resolves to a non-public address", ErrForbiddenDestination, host)
+		}
+	}
+	return nil
+}
+
+// newClient returns the HTTP client deliveries are sent with. It dials
+// only addresses forbidden doesn't reject, never uses a proxy, and doesn't
+// follow redirects, whose 3xx response fails the delivery instead.
+func newClient(forbidden func(net.IP) bool) *http.Client {
+	dialer := &net.Dialer{
+		Timeout: 10 * time.Second,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			if ip := net.ParseIP(host); ip == nil || forbidden(ip) {
+				return errclass.New(ErrForbiddenDestination, errclass.Permanent)
+			}
+			return nil
+		},
+	}
+	return &http.Client{
+		Timeout: 30 * time.Second,
+		Transport: &http.Transport{
+			DialContext:         dialer.DialContext,
+			TLSHandshakeTimeout: 10 * time.Second,
+			MaxIdleConns:        100,
+			IdleConnTimeout:     90 * time.Second,
+		},
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
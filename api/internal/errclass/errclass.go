@@ -0,0 +1,297 @@
+// Package errclass sorts failures from Redis, storage, and HTTP
+// destinations by whether retrying can help, so every retry loop and the
+// health tracking make the same call for the same error. Errors are
+// classified by their types and sentinel values, looking through wrapped
+// and joined errors.
+package errclass
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"rembg-v2/api/internal/fault"
+)
+
+// Class is how a failure should be retried
+type Class string
+
+const (
+	// Transient failures are likely to clear on their own and are retried
+	// with the caller's usual backoff
+	Transient Class = "transient"
+	// Throttled failures are the backend asking callers to slow down; they
+	// are retried after a longer backoff or the backend's Retry-After
+	Throttled Class = "throttled"
+	// Permanent failures won't clear by retrying, such as bad credentials
+	// or a destination that doesn't exist
+	Permanent Class = "permanent"
+)
+
+// rank orders classes from most to least retryable
+var rank = map[Class]int{Transient: 0, Throttled: 1, Permanent: 2}
+
+// ThrottleFactor is how much longer than their usual backoff callers wait
+// after a throttled failure without a Retry-After
+const ThrottleFactor = 4
+
+// maxRetryAfter caps the Retry-After a backend can impose
+const maxRetryAfter = time.Hour
+
+// poolTimeout is the message of go-redis's connection pool timeout, whose
+// error value lives in an internal package and can't be compared against
+const poolTimeout = "redis: connection pool timeout"
+
+// Redis reply codes, the first word of an error reply
+var redisReplies = map[string]Class{
+	"LOADING":     Transient,
+	"READONLY":    Transient,
+	"TRYAGAIN":    Transient,
+	"CLUSTERDOWN": Transient,
+	"MASTERDOWN":  Transient,
+	"BUSY":        Transient,
+	"OOM":         Throttled,
+	"NOAUTH":      Permanent,
+	"WRONGPASS":   Permanent,
+	"NOPERM":      Permanent,
+	"WRONGTYPE":   Permanent,
+	"NOSCRIPT":    Permanent,
+}
+
+// errnos classifies system call failures from storage and the network
+var errnos = map[syscall.Errno]Class{
+	syscall.ECONNREFUSED: Transient,
+	syscall.ECONNRESET:   Transient,
+	syscall.ECONNABORTED: Transient,
+	syscall.ETIMEDOUT:    Transient,
+	syscall.EPIPE:        Transient,
+	syscall.EHOSTUNREACH: Transient,
+	syscall.ENETUNREACH:  Transient,
+	syscall.ENETDOWN:     Transient,
+	syscall.EAGAIN:       Transient,
+	syscall.EINTR:        Transient,
+	syscall.EBUSY:        Transient,
+	syscall.EIO:          Transient,
+	syscall.ENOSPC:       Throttled,
+	syscall.EDQUOT:       Throttled,
+	syscall.EMFILE:       Throttled,
+	syscall.ENFILE:       Throttled,
+	syscall.EACCES:       Permanent,
+	syscall.EPERM:        Permanent,
+	syscall.EROFS:        Permanent,
+	syscall.ENOENT:       Permanent,
+	syscall.EEXIST:       Permanent,
+	syscall.ENOTDIR:      Permanent,
+	syscall.EISDIR:       Permanent,
+	syscall.EINVAL:       Permanent,
+	syscall.ENAMETOOLONG: Permanent,
+}
+
+// Error is a failure whose class its producer already knows, such as an
+// HTTP status, with how long the backend asked callers to wait
+type Error struct {
+	Err   error
+	Class Class
+	// RetryAfter is the backend's requested delay, if it gave one
+	RetryAfter time.Duration
+}
+
+func (e *Error) Error() string { return e.Err.Error() }
+
+func (e *Error) Unwrap() error { return e.Err }
+
+// New marks err as being of class
+func New(err error, class Class) error {
+	if err == nil {
+		return nil
+	}
+	return &Error{Err: err, Class: class}
+}
+
+// Classify returns the class of err, or "" for nil. Errors it doesn't
+// recognize are permanent, so unknown failures aren't retried forever. A
+// joined error is as bad as the worst of the parts it recognizes.
+func Classify(err error) Class {
+	if err == nil {
+		return ""
+	}
+	class, _ := classify(err)
+	return class
+}
+
+// Retryable reports whether err is worth retrying
+func Retryable(err error) bool {
+	class := Classify(err)
+	return class == Transient || class == Throttled
+}
+
+// RetryAfter returns the delay the backend asked for, anywhere in err's chain
+func RetryAfter(err error) (time.Duration, bool) {
+	var classified *Error
+	if errors.As(err, &classified) && classified.RetryAfter > 0 {
+		return classified.RetryAfter, true
+	}
+	return 0, false
+}
+
+// Delay returns how long to wait before retrying err, given the caller's
+// usual backoff: the backend's Retry-After if it is longer, and for
+// throttled failures without one, ThrottleFactor times the backoff
+func Delay(err error, backoff time.Duration) time.Duration {
+	if after, ok := RetryAfter(err); ok {
+		if after > backoff {
+			return after
+		}
+		return backoff
+	}
+	if Classify(err) == Throttled {
+		return backoff * ThrottleFactor
+	}
+	return backoff
+}
+
+// classify returns the class of err and whether it was recognized
+func classify(err error) (Class, bool) {
+	if class, ok := classifyValue(err); ok {
+		return class, true
+	}
+	switch wrapped := err.(type) {
+	case interface{ Unwrap() []error }:
+		return worst(wrapped.Unwrap())
+	case interface{ Unwrap() error }:
+		if inner := wrapped.Unwrap(); inner != nil {
+			return classify(inner)
+		}
+	}
+	return Permanent, false
+}
+
+// worst returns the least retryable class among the errs it recognizes
+func worst(errs []error) (Class, bool) {
+	var result Class
+	for _, err := range errs {
+		if err == nil {
+			continue
+		}
+		if class, ok := classify(err); ok && (result == "" || rank[class] > rank[result]) {
+			result = class
+		}
+	}
+	if result == "" {
+		return Permanent, false
+	}
+	return result, true
+}
+
+// classifyValue classifies err by its own type or value, without looking
+// at the errors it wraps
+func classifyValue(err error) (Class, bool) {
+	switch err {
+	case fault.ErrInjected:
+		// Injected faults stand in for outages, so they exercise the same handling
+		return Transient, true
+	case context.DeadlineExceeded, io.EOF, io.ErrUnexpectedEOF:
+		return Transient, true
+	case context.Canceled, redis.Nil, redis.ErrClosed, http.ErrUseLastResponse:
+		return Permanent, true
+	case fs.ErrNotExist, fs.ErrExist, fs.ErrPermission:
+		return Permanent, true
+	}
+
+	switch e := err.(type) {
+	case *Error:
+		return e.Class, true
+	case syscall.Errno:
+		class, ok := errnos[e]
+		return class, ok
+	case *net.DNSError:
+		if e.IsNotFound {
+			return Permanent, true
+		}
+		return Transient, true
+	case *net.OpError:
+		// Dial, read, and write failures are transient unless the
+		// underlying error says otherwise
+		if class, ok := classify(e.Err); ok {
+			return class, true
+		}
+		return Transient, true
+	case *url.Error:
+		return classify(e.Err)
+	case x509.UnknownAuthorityError, x509.CertificateInvalidError, x509.HostnameError, *tls.CertificateVerificationError, tls.RecordHeaderError:
+		return Permanent, true
+	case redis.Error:
+		code, _, _ := strings.Cut(e.Error(), " ")
+		if class, ok := redisReplies[code]; ok {
+			return class, true
+		}
+		// Other error replies reject the command itself
+		return Permanent, true
+	case net.Error:
+		if e.Timeout() {
+			return Transient, true
+		}
+	}
+	if err.Error() == poolTimeout {
+		return Transient, true
+	}
+	return "", false
+}
+
+// HTTPStatus returns the failure an HTTP response describes, or nil for a
+// 2xx. 429s and 503s are throttled when the response carries a Retry-After.
+func HTTPStatus(resp *http.Response, now time.Time) error {
+	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+		return nil
+	}
+	failure := &Error{Err: fmt.Errorf("destination returned %s", resp.Status), Class: Permanent}
+	retryAfter, hasRetryAfter := ParseRetryAfter(resp.Header.Get("Retry-After"), now)
+	switch {
+	case resp.StatusCode == http.StatusTooManyRequests:
+		failure.Class = Throttled
+	case resp.StatusCode == http.StatusServiceUnavailable && hasRetryAfter:
+		failure.Class = Throttled
+	case resp.StatusCode >= 500, resp.StatusCode == http.StatusRequestTimeout:
+		failure.Class = Transient
+	}
+	if failure.Class != Permanent && hasRetryAfter {
+		failure.RetryAfter = retryAfter
+	}
+	return failure
+}
+
+// ParseRetryAfter parses a Retry-After header, in seconds or as an HTTP
+// date, capped at an hour
+func ParseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	var after time.Duration
+	if seconds, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+		after = time.Duration(seconds) * time.Second
+	} else if at, err := http.ParseTime(value); err == nil {
+		after = at.Sub(now)
+	} else {
+		return 0, false
+	}
+	if after <= 0 {
+		return 0, false
+	}
+	if after > maxRetryAfter {
+		after = maxRetryAfter
+	}
+	return after, true
+}
@@ -0,0 +1,232 @@
+package errclass
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"rembg-v2/api/internal/fault"
+)
+
+// redisReply is an error reply as go-redis returns it
+type redisReply string
+
+func (e redisReply) Error() string { return string(e) }
+
+func (redisReply) RedisError() {}
+
+// timeoutError is a net.Error that timed out
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "i/o timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestClassifyRedisReplies(t *testing.T) {
+	for code, want := range redisReplies {
+		reply := redisReply(code + " something went wrong")
+		if got := Classify(reply); got != want {
+			t.Errorf("%s reply: got %s, want %s", code, got, want)
+		}
+		if got := Classify(fmt.Errorf("updating job: %w", reply)); got != want {
+			t.Errorf("wrapped %s reply: got %s, want %s", code, got, want)
+		}
+	}
+	// Replies the table doesn't know reject the command itself
+	for _, reply := range []string{"ERR unknown command 'FOO'", "EXECABORT Transaction discarded", "LOADINGX not a code"} {
+		if got := Classify(redisReply(reply)); got != Permanent {
+			t.Errorf("%q: got %s, want %s", reply, got, Permanent)
+		}
+	}
+}
+
+func TestClassifyErrnos(t *testing.T) {
+	for errno, want := range errnos {
+		for name, err := range map[string]error{
+			"bare":    errno,
+			"path":    &os.PathError{Op: "open", Path: "/uploads/a.png", Err: errno},
+			"syscall": os.NewSyscallError("write", errno),
+			"dial":    &net.OpError{Op: "dial", Net: "tcp", Err: os.NewSyscallError("connect", errno)},
+		} {
+			if got := Classify(err); got != want {
+				t.Errorf("%v %s: got %s, want %s", errno, name, got, want)
+			}
+		}
+	}
+	// Errnos the table doesn't know are permanent, except behind a
+	// network operation, which is transient unless its cause says otherwise
+	if got := Classify(syscall.ENOEXEC); got != Permanent {
+		t.Errorf("unknown errno: got %s, want %s", got, Permanent)
+	}
+	if got := Classify(&net.OpError{Op: "read", Net: "tcp", Err: syscall.ENOEXEC}); got != Transient {
+		t.Errorf("unknown errno in a network operation: got %s, want %s", got, Transient)
+	}
+}
+
+func TestClassifyPoolTimeout(t *testing.T) {
+	if got := Classify(errors.New(poolTimeout)); got != Transient {
+		t.Errorf("pool timeout: got %s, want %s", got, Transient)
+	}
+	if got := Classify(fmt.Errorf("claiming a job: %w", errors.New(poolTimeout))); got != Transient {
+		t.Errorf("wrapped pool timeout: got %s, want %s", got, Transient)
+	}
+	if got := Classify(errors.New(poolTimeout + " after 4s")); got != Permanent {
+		t.Errorf("another message: got %s, want %s", got, Permanent)
+	}
+}
+
+func TestClassify(t *testing.T) {
+	certificate := &x509.Certificate{}
+	for _, tc := range []struct {
+		name string
+		err  error
+		want Class
+	}{
+		{"nil", nil, ""},
+		{"unknown", errors.New("boom"), Permanent},
+		{"injected fault", fmt.Errorf("redis: %w", fault.ErrInjected), Transient},
+		{"deadline", context.DeadlineExceeded, Transient},
+		{"cancelled", context.Canceled, Permanent},
+		{"EOF", io.EOF, Transient},
+		{"unexpected EOF", io.ErrUnexpectedEOF, Transient},
+		{"redis nil", redis.Nil, Permanent},
+		{"redis closed", redis.ErrClosed, Permanent},
+		{"redirect refused", http.ErrUseLastResponse, Permanent},
+		{"not exist", fs.ErrNotExist, Permanent},
+		{"exist", fs.ErrExist, Permanent},
+		{"permission", fs.ErrPermission, Permanent},
+		{"classified", New(errors.New("slow down"), Throttled), Throttled},
+		{"classified and wrapped", fmt.Errorf("delivering: %w", New(errors.New("gone"), Permanent)), Permanent},
+		{"host not found", &net.DNSError{Err: "no such host", Name: "nowhere.example", IsNotFound: true}, Permanent},
+		{"DNS server failure", &net.DNSError{Err: "server misbehaving", Name: "example.com"}, Transient},
+		{"network timeout", timeoutError{}, Transient},
+		{"network operation", &net.OpError{Op: "read", Net: "tcp", Err: errors.New("broken")}, Transient},
+		{"URL wrapping a timeout", &url.Error{Op: "Post", URL: "https://example.com", Err: timeoutError{}}, Transient},
+		{"URL wrapping unknown", &url.Error{Op: "Post", URL: "https://example.com", Err: errors.New("boom")}, Permanent},
+		{"unknown authority", x509.UnknownAuthorityError{Cert: certificate}, Permanent},
+		{"invalid certificate", x509.CertificateInvalidError{Cert: certificate, Reason: x509.Expired}, Permanent},
+		{"wrong host", x509.HostnameError{Certificate: certificate, Host: "example.com"}, Permanent},
+		{"verification", &tls.CertificateVerificationError{Err: errors.New("expired")}, Permanent},
+		{"not TLS", tls.RecordHeaderError{Msg: "first record does not look like a TLS handshake"}, Permanent},
+		{"joined, worst wins", errors.Join(syscall.ECONNRESET, syscall.EACCES), Permanent},
+		{"joined, throttled over transient", errors.Join(io.EOF, syscall.ENOSPC), Throttled},
+		{"joined, unknown parts ignored", errors.Join(errors.New("boom"), io.EOF), Transient},
+		{"joined, nothing known", errors.Join(errors.New("boom"), errors.New("bang")), Permanent},
+	} {
+		if got := Classify(tc.err); got != tc.want {
+			t.Errorf("%s: got %q, want %q", tc.name, got, tc.want)
+		}
+		if tc.err == nil {
+			continue
+		}
+		retryable := tc.want == Transient || tc.want == Throttled
+		if got := Retryable(tc.err); got != retryable {
+			t.Errorf("%s: Retryable = %v, want %v", tc.name, got, retryable)
+		}
+	}
+}
+
+func TestNew(t *testing.T) {
+	if err := New(nil, Transient); err != nil {
+		t.Fatalf("New(nil) = %v, want nil", err)
+	}
+	cause := errors.New("slow down")
+	err := New(cause, Throttled)
+	if !errors.Is(err, cause) || err.Error() != cause.Error() {
+		t.Fatalf("New(%v) = %v, want it to wrap the cause", cause, err)
+	}
+}
+
+func TestHTTPStatus(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, tc := range []struct {
+		status     int
+		retryAfter string
+		want       Class
+		after      time.Duration
+	}{
+		{http.StatusOK, "", "", 0},
+		{http.StatusNoContent, "", "", 0},
+		{http.StatusMovedPermanently, "", Permanent, 0},
+		{http.StatusBadRequest, "", Permanent, 0},
+		{http.StatusNotFound, "30", Permanent, 0},
+		{http.StatusRequestTimeout, "", Transient, 0},
+		{http.StatusTooManyRequests, "", Throttled, 0},
+		{http.StatusTooManyRequests, "30", Throttled, 30 * time.Second},
+		{http.StatusInternalServerError, "", Transient, 0},
+		{http.StatusBadGateway, "5", Transient, 5 * time.Second},
+		{http.StatusServiceUnavailable, "", Transient, 0},
+		{http.StatusServiceUnavailable, now.Add(2 * time.Minute).Format(http.TimeFormat), Throttled, 2 * time.Minute},
+	} {
+		resp := &http.Response{StatusCode: tc.status, Status: http.StatusText(tc.status), Header: http.Header{}}
+		if tc.retryAfter != "" {
+			resp.Header.Set("Retry-After", tc.retryAfter)
+		}
+		err := HTTPStatus(resp, now)
+		if got := Classify(err); got != tc.want {
+			t.Errorf("%d with Retry-After %q: got %q, want %q", tc.status, tc.retryAfter, got, tc.want)
+		}
+		after, _ := RetryAfter(err)
+		if after != tc.after {
+			t.Errorf("%d with Retry-After %q: RetryAfter = %s, want %s", tc.status, tc.retryAfter, after, tc.after)
+		}
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	for _, tc := range []struct {
+		value string
+		want  time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"120", 2 * time.Minute, true},
+		{" 7 ", 7 * time.Second, true},
+		{"0", 0, false},
+		{"-5", 0, false},
+		{"soon", 0, false},
+		{now.Add(90 * time.Second).Format(http.TimeFormat), 90 * time.Second, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, false},
+		{"86400", maxRetryAfter, true},
+		{now.Add(48 * time.Hour).Format(http.TimeFormat), maxRetryAfter, true},
+	} {
+		got, ok := ParseRetryAfter(tc.value, now)
+		if got != tc.want || ok != tc.ok {
+			t.Errorf("ParseRetryAfter(%q) = %s, %v, want %s, %v", tc.value, got, ok, tc.want, tc.ok)
+		}
+	}
+}
+
+func TestDelay(t *testing.T) {
+	const backoff = time.Second
+	for _, tc := range []struct {
+		name string
+		err  error
+		want time.Duration
+	}{
+		{"transient", io.EOF, backoff},
+		{"permanent", syscall.EACCES, backoff},
+		{"throttled", syscall.ENOSPC, backoff * ThrottleFactor},
+		{"longer Retry-After", &Error{Err: io.EOF, Class: Throttled, RetryAfter: time.Minute}, time.Minute},
+		{"shorter Retry-After", &Error{Err: io.EOF, Class: Throttled, RetryAfter: time.Millisecond}, backoff},
+		{"wrapped Retry-After", fmt.Errorf("delivering: %w", &Error{Err: io.EOF, Class: Transient, RetryAfter: 3 * time.Second}), 3 * time.Second},
+	} {
+		if got := Delay(tc.err, backoff); got != tc.want {
+			t.Errorf("%s: got %s, want %s", tc.name, got, tc.want)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+// Package fault injects failures at named points for resilience testing.
+// It does nothing unless enabled, which the API does with FAULT_INJECTION=true;
+// rules are then configured at runtime and shared through Redis.
+package fault
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Injection points
+const (
+	// StorageSave fails writing uploads
+	StorageSave = "storage.save"
+	// Redis delays or fails job reads and writes
+	Redis = "redis"
+	// DeliverySend fails pushing results to delivery destinations
+	DeliverySend = "delivery.send"
+	// WorkerProcess crashes a worker mid-job; injected by the processor
+	WorkerProcess = "worker.process"
+)
+
+// Points lists the injection points rules may target
+var Points = []string{StorageSave, Redis, DeliverySend, WorkerProcess}
+
+// ErrInjected is wrapped by every injected failure
+var ErrInjected = errors.New("injected fault")
+
+// injected counts the faults injected per point
+var injected = expvar.NewMap("faults_injected")
+
+// Rule configures the faults injected at one point
+type Rule struct {
+	Point string `json:"point"`
+	// Probability is the chance in [0, 1] that a matching call is faulted
+	Probability float64 `json:"probability"`
+	// LatencyMs delays faulted calls before they fail or proceed
+	LatencyMs int `json:"latency_ms,omitempty"`
+	// Fail makes faulted calls return an error after any latency
+	Fail bool `json:"fail,omitempty"`
+	// Match restricts the rule to calls whose labels have these values,
+	// e.g. {"owner": "10.0.0.7"} or {"job_id": "..."}
+	Match map[string]string `json:"match,omitempty"`
+}
+
+// Validate reports whether the rule targets a known point with a usable effect
+func (r Rule) Validate() error {
+	known := false
+	for _, p := range Points {
+		known = known || p == r.Point
+	}
+	switch {
+	case !known:
+		return fmt.Errorf("unknown fault point %q", r.Point)
+	case r.Probability <= 0 || r.Probability > 1:
+		return fmt.Errorf("probability must be in (0, 1]")
+	case r.LatencyMs < 0:
+		return fmt.Errorf("latency_ms must not be negative")
+	case !r.Fail && r.LatencyMs == 0:
+		return fmt.Errorf("a rule must fail or add latency")
+	}
+	return nil
+}
+
+var (
+	enabled atomic.Bool
+
+	mu    sync.RWMutex
+	rules = map[string]Rule{}
+	roll  = rand.Float64
+)
+
+// Enable turns fault injection on for this process
+func Enable() {
+	enabled.Store(true)
+}
+
+// Enabled reports whether fault injection is on
+func Enabled() bool {
+	return enabled.Load()
+}
+
+// SetRules replaces the active rules
+func SetRules(list []Rule) {
+	next := make(map[string]Rule, len(list))
+	for _, r := range list {
+		next[r.Point] = r
+	}
+	mu.Lock()
+	rules = next
+	mu.Unlock()
+}
+
+// Rules returns the active rules sorted by point
+func Rules() []Rule {
+	mu.RLock()
+	defer mu.RUnlock()
+	list := make([]Rule, 0, len(rules))
+	for _, r := range rules {
+		list = append(list, r)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Point < list[j].Point })
+	return list
+}
+
+// Maybe injects the fault configured for point, if any. Labels are
+// alternating names and values matched against the rule, e.g.
+// Maybe(ctx, fault.Redis, "job_id", id). It returns nil when disabled.
+func Maybe(ctx context.Context, point string, labels ...string) error {
+	if !enabled.Load() {
+		return nil
+	}
+	mu.RLock()
+	rule, ok := rules[point]
+	mu.RUnlock()
+	if !ok || !matches(rule.Match, labels) || roll() >= rule.Probability {
+		return nil
+	}
+
+	injected.Add(point, 1)
+	if rule.LatencyMs > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(rule.LatencyMs) * time.Millisecond):
+		}
+	}
+	if rule.Fail {
+		return fmt.Errorf("%s: %w", point, ErrInjected)
+	}
+	return nil
+}
+
+// matches reports whether every match criterion has its value among the labels
+func matches(match map[string]string, labels []string) bool {
+	for name, want := range match {
+		found := false
+		for i := 0; i+1 < len(labels); i += 2 {
+			if labels[i] == name && labels[i+1] == want {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
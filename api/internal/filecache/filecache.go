@@ -0,0 +1,274 @@
+// Package filecache keeps local copies of files from slower storage in a
+// directory bounded by total size, evicting the least recently used first
+package filecache
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// tmpSuffix marks copies still being written, which are never served
+const tmpSuffix = ".tmp"
+
+// keyHashLength is the length of the key half of a cached file's name
+const keyHashLength = 32
+
+// Cache is a directory of local copies, each named for the key and version
+// of the file it copies, so the index can be rebuilt from the directory
+type Cache struct {
+	dir      string
+	maxBytes int64
+
+	mu sync.Mutex
+	// lru holds entries most recently used first
+	lru     *list.List
+	entries map[string]*list.Element // by key hash
+	size    int64
+
+	evictions int64
+	fills     map[string]*fill
+}
+
+// entry is one cached copy
+type entry struct {
+	keyHash string
+	name    string
+	size    int64
+}
+
+// fill is a copy in progress, shared by concurrent misses for its key
+type fill struct {
+	done chan struct{}
+	err  error
+}
+
+// Stats describe a cache's contents
+type Stats struct {
+	Entries   int
+	Bytes     int64
+	MaxBytes  int64
+	Evictions int64
+}
+
+// ErrTooLarge is returned by Get for files that could never fit
+var ErrTooLarge = errors.New("file is larger than the cache")
+
+// Open returns the cache in dir holding up to maxBytes, indexing the copies
+// left by a previous run with their modification times as last use
+func Open(dir string, maxBytes int64) (*Cache, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("cache size must be positive, got %d", maxBytes)
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	dirEntries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	type found struct {
+		entry
+		used time.Time
+	}
+	var copies []found
+	for _, de := range dirEntries {
+		name := de.Name()
+		if !de.Type().IsRegular() {
+			continue
+		}
+		if strings.HasSuffix(name, tmpSuffix) || len(name) < keyHashLength {
+			// Left by an interrupted fill, or not ours
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		info, err := de.Info()
+		if err != nil {
+			continue
+		}
+		copies = append(copies, found{entry{name[:keyHashLength], name, info.Size()}, info.ModTime()})
+	}
+	sort.Slice(copies, func(i, j int) bool { return copies[i].used.After(copies[j].used) })
+
+	c := &Cache{
+		dir:      dir,
+		maxBytes: maxBytes,
+		lru:      list.New(),
+		entries:  make(map[string]*list.Element),
+		fills:    make(map[string]*fill),
+	}
+	for _, f := range copies {
+		if _, ok := c.entries[f.keyHash]; ok {
+			// An older version of a key already indexed
+			os.Remove(filepath.Join(dir, f.name))
+			continue
+		}
+		e := f.entry
+		c.entries[e.keyHash] = c.lru.PushBack(&e)
+		c.size += e.size
+	}
+	c.evict()
+	return c, nil
+}
+
+// Get returns an open local copy of version of the file at key, calling
+// read to copy it in on a miss. Concurrent misses for a key share one read.
+// The copy stays readable even if it's evicted while open.
+func (c *Cache) Get(key, version string, read func(w io.Writer) error) (f *os.File, hit bool, err error) {
+	keyHash := hashString(key, keyHashLength)
+	name := keyHash + hashString(version, 16) + path.Ext(key)
+
+	for {
+		if f := c.open(keyHash, name); f != nil {
+			return f, true, nil
+		}
+
+		c.mu.Lock()
+		if inFlight, ok := c.fills[keyHash]; ok {
+			c.mu.Unlock()
+			<-inFlight.done
+			if inFlight.err != nil {
+				return nil, false, inFlight.err
+			}
+			continue
+		}
+		current := &fill{done: make(chan struct{})}
+		c.fills[keyHash] = current
+		c.mu.Unlock()
+
+		current.err = c.fill(keyHash, name, read)
+		c.mu.Lock()
+		delete(c.fills, keyHash)
+		c.mu.Unlock()
+		close(current.done)
+		if current.err != nil {
+			return nil, false, current.err
+		}
+		if f := c.open(keyHash, name); f != nil {
+			return f, false, nil
+		}
+		// Evicted or invalidated before it could be opened
+		return nil, false, os.ErrNotExist
+	}
+}
+
+// open returns the cached copy named name, marking it used, or nil on a miss
+func (c *Cache) open(keyHash, name string) *os.File {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	elem, ok := c.entries[keyHash]
+	if !ok || elem.Value.(*entry).name != name {
+		return nil
+	}
+	f, err := os.Open(filepath.Join(c.dir, name))
+	if err != nil {
+		// Removed behind our back
+		c.remove(elem)
+		return nil
+	}
+	c.lru.MoveToFront(elem)
+	now := time.Now()
+	os.Chtimes(f.Name(), now, now)
+	return f
+}
+
+// fill copies a file in and indexes it, replacing other versions of its key
+func (c *Cache) fill(keyHash, name string, read func(w io.Writer) error) error {
+	tmp, err := os.CreateTemp(c.dir, keyHash+"-*"+tmpSuffix)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	counter := &countingWriter{w: tmp}
+	err = read(counter)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	if counter.n > c.maxBytes {
+		return ErrTooLarge
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if err := os.Rename(tmp.Name(), filepath.Join(c.dir, name)); err != nil {
+		return err
+	}
+	if elem, ok := c.entries[keyHash]; ok {
+		if elem.Value.(*entry).name == name {
+			c.size -= elem.Value.(*entry).size
+			c.lru.Remove(elem)
+			delete(c.entries, keyHash)
+		} else {
+			c.remove(elem)
+		}
+	}
+	c.entries[keyHash] = c.lru.PushFront(&entry{keyHash: keyHash, name: name, size: counter.n})
+	c.size += counter.n
+	c.evict()
+	return nil
+}
+
+// Invalidate drops every cached version of the file at key
+func (c *Cache) Invalidate(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if elem, ok := c.entries[hashString(key, keyHashLength)]; ok {
+		c.remove(elem)
+	}
+}
+
+// Stats returns the cache's current contents
+func (c *Cache) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Stats{Entries: len(c.entries), Bytes: c.size, MaxBytes: c.maxBytes, Evictions: c.evictions}
+}
+
+// evict removes the least recently used copies until the cache fits
+func (c *Cache) evict() {
+	for c.size > c.maxBytes {
+		c.remove(c.lru.Back())
+		c.evictions++
+	}
+}
+
+// remove deletes a copy and its index entry. The caller holds mu.
+func (c *Cache) remove(elem *list.Element) {
+	e := c.lru.Remove(elem).(*entry)
+	delete(c.entries, e.keyHash)
+	c.size -= e.size
+	os.Remove(filepath.Join(c.dir, e.name))
+}
+
+// hashString returns the first n hex digits of the SHA-256 of s
+func hashString(s string, n int) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])[:n]
+}
+
+// countingWriter counts the bytes written through it
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	n, err := w.w.Write(p)
+	w.n += int64(n)
+	return n, err
+}
@@ -0,0 +1,218 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"image"
+	_ "image/jpeg"
+	"image/png"
+	"log"
+	"net/http"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/anomaly"
+	"rembg-v2/api/internal/imagediff"
+	"rembg-v2/api/internal/queue"
+)
+
+// keyUsageReporter is implemented by queues that can report their Redis footprint
+type keyUsageReporter interface {
+	KeyUsage(ctx context.Context) (*queue.KeyUsageReport, error)
+}
+
+// maxDiffPixels caps the size of each image the diff endpoint will decode
+const maxDiffPixels = 50_000_000
+
+// DiffResults compares the outputs of two completed jobs
+func (h *Handler) DiffResults(c *gin.Context) {
+	jobA, ok := h.completedJob(c, c.Query("job_a"))
+	if !ok {
+		return
+	}
+	jobB, ok := h.completedJob(c, c.Query("job_b"))
+	if !ok {
+		return
+	}
+
+	imgA, err := h.decodeBounded(jobA.OutputPath)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": fmt.Sprintf("Failed to decode result of job %s: %v", jobA.ID, err)})
+		return
+	}
+	imgB, err := h.decodeBounded(jobB.OutputPath)
+	if err != nil {
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": fmt.Sprintf("Failed to decode result of job %s: %v", jobB.ID, err)})
+		return
+	}
+
+	visual := c.Query("visual") == "true"
+	report, diff := imagediff.Compare(imgA, imgB, visual)
+
+	result := gin.H{
+		"job_a":  jobA.ID,
+		"job_b":  jobB.ID,
+		"report": report,
+	}
+
+	// Attach the visual diff to a synthetic completed job so it can be downloaded
+	if diff != nil {
+		diffJob, err := h.saveDiffImage(c, diff)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save diff image"})
+			return
+		}
+		result["diff_job_id"] = diffJob.ID
+		result["diff_url"] = fmt.Sprintf("/api/download/%s", diffJob.ID)
+	}
+
+	c.JSON(http.StatusOK, result)
+}
+
+// completedJob loads a job to compare, writing an error response if it has no result
+func (h *Handler) completedJob(c *gin.Context, jobID string) (*queue.Job, bool) {
+	if jobID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "job_a and job_b are required"})
+		return nil, false
+	}
+	return h.downloadableJob(c, jobID)
+}
+
+// saveDiffImage writes the diff image and records it as a completed job
+func (h *Handler) saveDiffImage(c *gin.Context, diff image.Image) (*queue.Job, error) {
+	jobID, err := generateID()
+	if err != nil {
+		return nil, err
+	}
+
+	outputPath := filepath.Join(h.resultsDir, jobID+"-diff.png")
+	f, err := h.fs.Create(outputPath)
+	if err != nil {
+		return nil, err
+	}
+	if err := png.Encode(f, diff); err != nil {
+		f.Close()
+		h.fs.Remove(outputPath)
+		return nil, err
+	}
+	if err := f.Close(); err != nil {
+		h.fs.Remove(outputPath)
+		return nil, err
+	}
+
+	job := &queue.Job{
+		ID:           jobID,
+		Status:       queue.StatusCompleted,
+		OutputPath:   outputPath,
+		OutputFormat: queue.FormatPNG,
+	}
+	if err := h.jobQueue.AddJob(c.Request.Context(), job); err != nil {
+		h.fs.Remove(outputPath)
+		return nil, err
+	}
+
+	return job, nil
+}
+
+// decodeBounded decodes an image after checking its dimensions against maxDiffPixels
+func (h *Handler) decodeBounded(path string) (image.Image, error) {
+	f, err := h.fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return nil, err
+	}
+	if cfg.Width*cfg.Height > maxDiffPixels {
+		return nil, fmt.Errorf("image is %dx%d, larger than the comparison limit", cfg.Width, cfg.Height)
+	}
+
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(f)
+	return img, err
+}
+
+// RedisUsage reports the approximate Redis key count and memory per feature
+func (h *Handler) RedisUsage(c *gin.Context) {
+	reporter, ok := h.jobQueue.(keyUsageReporter)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Queue backend does not report key usage"})
+		return
+	}
+
+	report, err := reporter.KeyUsage(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to sample Redis keys"})
+		return
+	}
+
+	c.JSON(http.StatusOK, report)
+}
+
+// outcomeStore is implemented by queues that count job outcomes
+type outcomeStore interface {
+	RecordOutcome(ctx context.Context, job *queue.Job) error
+	OutcomeCounts(ctx context.Context, from, to time.Time) (map[string]int64, error)
+}
+
+// WithAnomalyWatcher exposes the watcher's alert state on the admin stats endpoint
+func WithAnomalyWatcher(w *anomaly.Watcher) Option {
+	return func(h *Handler) {
+		h.anomalies = w
+	}
+}
+
+// recordOutcome counts a job the API moved to a terminal status
+func (h *Handler) recordOutcome(ctx context.Context, job *queue.Job) {
+	if store, ok := h.jobQueue.(outcomeStore); ok {
+		if err := store.RecordOutcome(ctx, job); err != nil {
+			log.Printf("Failed to record outcome of job %s: %v", job.ID, err)
+		}
+	}
+}
+
+// AdminStats reports the queue's depth and throughput, job outcomes over a
+// recent window if the queue counts them, the failure-rate alert state, the
+// live API replicas, and maintenance
+func (h *Handler) AdminStats(c *gin.Context) {
+	minutes, err := strconv.Atoi(c.DefaultQuery("minutes", "60"))
+	if err != nil || minutes <= 0 || minutes > 24*60 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "minutes must be between 1 and 1440"})
+		return
+	}
+
+	stats, err := h.jobQueue.Stats(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read queue stats"})
+		return
+	}
+
+	response := gin.H{"minutes": minutes, "queue": stats, "instance_id": h.instance.InstanceID}
+	if store, ok := h.jobQueue.(outcomeStore); ok {
+		now := h.clock.Now()
+		counts, err := store.OutcomeCounts(c.Request.Context(), now.Add(-time.Duration(minutes)*time.Minute), now)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read job outcomes"})
+			return
+		}
+		response["outcomes"] = counts
+	}
+	if h.anomalies != nil {
+		response["anomalies"] = h.anomalies.States()
+	}
+	if instances := h.liveInstances(c.Request.Context()); instances != nil {
+		response["api_instances"] = instances
+	}
+	if status := h.maintenanceStatus(c.Request.Context()); status != nil {
+		response["maintenance"] = status
+	}
+	c.JSON(http.StatusOK, response)
+}
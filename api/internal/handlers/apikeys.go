@@ -0,0 +1,241 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// apiKeyContextKey holds the API key a request authenticated with
+const apiKeyContextKey = "api_key"
+
+// apiKeyTouchInterval is how often one replica records a key's last use, so
+// busy keys don't cost a write per request
+const apiKeyTouchInterval = time.Minute
+
+// apiKeyTouchMax bounds the keys a replica remembers touching before it
+// forgets those touched longer than apiKeyTouchInterval ago
+const apiKeyTouchMax = 10000
+
+// apiKeyStore is implemented by queues that issue API keys
+type apiKeyStore interface {
+	CreateAPIKey(ctx context.Context, owner, tier string, now time.Time) (*queue.APIKey, string, error)
+	APIKey(ctx context.Context, hash string) (*queue.APIKey, error)
+	RotateAPIKey(ctx context.Context, hash, owner string, grace time.Duration, now time.Time) (*queue.APIKey, string, error)
+	TouchAPIKey(ctx context.Context, hash string, at time.Time) error
+	OwnerAPIKeys(ctx context.Context, owner string) ([]*queue.APIKey, error)
+}
+
+// apiKeyAuth is the API key a request authenticated with
+type apiKeyAuth struct {
+	hash string
+	key  *queue.APIKey
+}
+
+// keyTouches remembers when this replica last recorded each key's use
+type keyTouches struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// due reports whether the key's use at now should be recorded, and if so
+// remembers it
+func (t *keyTouches) due(hash string, now time.Time) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if at, ok := t.last[hash]; ok && now.Sub(at) < apiKeyTouchInterval {
+		return false
+	}
+	if t.last == nil {
+		t.last = make(map[string]time.Time)
+	}
+	if len(t.last) >= apiKeyTouchMax {
+		for key, at := range t.last {
+			if now.Sub(at) >= apiKeyTouchInterval {
+				delete(t.last, key)
+			}
+		}
+	}
+	t.last[hash] = now
+	return true
+}
+
+// authenticateKey resolves the request's owner from an API key, writing a
+// 401 if the key is unknown or past its grace period. Rotated keys still in
+// their grace period get an X-Key-Deprecated header.
+func (h *Handler) authenticateKey(c *gin.Context, secret string) bool {
+	store, ok := h.jobQueue.(apiKeyStore)
+	if !ok {
+		h.rejectKey(c, "API keys are not supported")
+		return false
+	}
+	ctx := c.Request.Context()
+	hash := queue.HashAPIKey(secret)
+	key, err := store.APIKey(ctx, hash)
+	if err != nil {
+		log.Printf("Failed to look up API key: %v", err)
+		c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": "Failed to verify API key"})
+		return false
+	}
+	now := h.clock.Now()
+	if key == nil || key.Expired(now) {
+		h.rejectKey(c, queue.ErrAPIKeyUnknown.Error())
+		return false
+	}
+
+	if key.ExpiresAt != nil {
+		c.Header("X-Key-Deprecated", fmt.Sprintf("rotated; replaced_by=%s; expires_at=%s", key.ReplacedBy, key.ExpiresAt.Format(time.RFC3339)))
+	}
+	if h.keyTouches.due(hash, now) {
+		if err := store.TouchAPIKey(ctx, hash, now); err != nil {
+			log.Printf("Failed to record use of API key %s: %v", key.ID, err)
+		}
+	}
+	c.Set(ownerContextKey, key.Owner)
+	c.Set(apiKeyContextKey, apiKeyAuth{hash: hash, key: key})
+	if queue.IsTier(key.Tier) {
+		c.Set(tierContextKey, key.Tier)
+	}
+	return true
+}
+
+// rejectKey writes a 401 for an API key that can't be used
+func (h *Handler) rejectKey(c *gin.Context, reason string) {
+	authFailures.Add("api key: "+reason, 1)
+	c.Header("WWW-Authenticate", `Bearer realm="api", error="invalid_token", error_description="`+reason+`"`)
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid API key: " + reason})
+}
+
+// apiKeys returns the key store, writing a 404 if the queue has none
+func (h *Handler) apiKeys(c *gin.Context) (apiKeyStore, bool) {
+	store, ok := h.jobQueue.(apiKeyStore)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "API keys are not supported"})
+		return nil, false
+	}
+	return store, true
+}
+
+// RotateAPIKey issues a replacement for the API key the request is
+// authenticated with. Both keys work during the grace period, after which
+// the old one is revoked.
+func (h *Handler) RotateAPIKey(c *gin.Context) {
+	store, ok := h.apiKeys(c)
+	if !ok {
+		return
+	}
+	current, ok := c.Get(apiKeyContextKey)
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Authenticate with the API key to rotate"})
+		return
+	}
+	auth := current.(apiKeyAuth)
+
+	now := h.clock.Now()
+	key, secret, err := store.RotateAPIKey(c.Request.Context(), auth.hash, ownerID(c), h.keyGrace, now)
+	switch {
+	case errors.Is(err, queue.ErrAPIKeyRotated):
+		c.JSON(http.StatusConflict, gin.H{"error": "API key was already rotated; rotate its replacement instead", "replaced_by": auth.key.ReplacedBy})
+		return
+	case errors.Is(err, queue.ErrAPIKeyUnknown):
+		h.rejectKey(c, err.Error())
+		return
+	case err != nil:
+		log.Printf("Failed to rotate API key %s: %v", auth.key.ID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to rotate API key"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"id":         key.ID,
+		"key":        secret,
+		"owner":      key.Owner,
+		"created_at": key.CreatedAt.Format(time.RFC3339),
+		"previous": gin.H{
+			"id":         auth.key.ID,
+			"expires_at": now.Add(h.keyGrace).UTC().Format(time.RFC3339),
+		},
+	})
+}
+
+// ListAPIKeys lists the caller's API keys that are still valid
+func (h *Handler) ListAPIKeys(c *gin.Context) {
+	store, ok := h.apiKeys(c)
+	if !ok {
+		return
+	}
+	keys, err := store.OwnerAPIKeys(c.Request.Context(), ownerID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list API keys"})
+		return
+	}
+
+	var currentID string
+	if current, ok := c.Get(apiKeyContextKey); ok {
+		currentID = current.(apiKeyAuth).key.ID
+	}
+	now := h.clock.Now()
+	listed := make([]gin.H, 0, len(keys))
+	for _, key := range keys {
+		if key.Expired(now) {
+			continue
+		}
+		listed = append(listed, gin.H{
+			"id":           key.ID,
+			"created_at":   key.CreatedAt,
+			"last_used_at": key.LastUsedAt,
+			"expires_at":   key.ExpiresAt,
+			"replaced_by":  key.ReplacedBy,
+			"current":      key.ID == currentID,
+		})
+	}
+	c.JSON(http.StatusOK, gin.H{"owner": ownerID(c), "keys": listed})
+}
+
+// CreateOwnerAPIKey issues an owner's first API key, e.g. {"tier": "pro"}.
+// Later keys come from rotating it. Only requests RequireAdmin admitted may,
+// wherever the route is mounted.
+func (h *Handler) CreateOwnerAPIKey(c *gin.Context) {
+	if !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Issuing API keys needs the admin key"})
+		return
+	}
+	store, ok := h.apiKeys(c)
+	if !ok {
+		return
+	}
+	var request struct {
+		Tier string `json:"tier"`
+	}
+	if c.Request.ContentLength != 0 {
+		if err := c.ShouldBindJSON(&request); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid request: " + err.Error()})
+			return
+		}
+	}
+	if request.Tier != "" && !queue.IsTier(request.Tier) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Unknown tier %q", request.Tier), "tiers": queue.Tiers})
+		return
+	}
+
+	key, secret, err := store.CreateAPIKey(c.Request.Context(), c.Param("key"), request.Tier, h.clock.Now())
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create API key"})
+		return
+	}
+	c.JSON(http.StatusCreated, gin.H{
+		"id":         key.ID,
+		"key":        secret,
+		"owner":      key.Owner,
+		"tier":       key.Tier,
+		"created_at": key.CreatedAt.Format(time.RFC3339),
+	})
+}
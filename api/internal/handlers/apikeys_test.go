@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestCreateOwnerAPIKeyOutsideAdminGroup(t *testing.T) {
+	h, jobs := newRedisTestHandler(t)
+	router := gin.New()
+	// Mounted by mistake outside the admin group
+	router.POST("/owners/:key/keys", h.Authenticate, h.CreateOwnerAPIKey)
+
+	w := serveTest(router, http.MethodPost, "/owners/mallory/keys", strings.NewReader(`{"tier": "enterprise"}`), testAdminKey)
+	if w.Code != http.StatusForbidden {
+		t.Fatalf("got %d, want %d: %s", w.Code, http.StatusForbidden, w.Body)
+	}
+	keys, err := jobs.OwnerAPIKeys(context.Background(), "mallory")
+	if err != nil || len(keys) != 0 {
+		t.Fatalf("keys after a rejected request: %v, %v", keys, err)
+	}
+}
@@ -0,0 +1,264 @@
+package handlers
+
+import (
+	"errors"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/archive"
+	"rembg-v2/api/internal/queue"
+)
+
+// Error codes of archives rejected by their limits
+const (
+	errorCodeArchiveTooLarge = "archive_too_large"
+	errorCodeArchiveRejected = "archive_rejected"
+)
+
+// archiveLimitsFromEnv reads the limits on extracting uploaded archives,
+// keeping the default of any limit that isn't set to a positive number
+func archiveLimitsFromEnv() archive.Limits {
+	limits := archive.DefaultLimits
+	if n := getEnvInt("ARCHIVE_MAX_ENTRIES", 0); n > 0 {
+		limits.MaxEntries = n
+	}
+	if n := getEnvInt("ARCHIVE_MAX_ENTRY_BYTES", 0); n > 0 {
+		limits.MaxEntryBytes = int64(n)
+	}
+	if n := getEnvInt("ARCHIVE_MAX_TOTAL_BYTES", 0); n > 0 {
+		limits.MaxTotalBytes = int64(n)
+	}
+	if ratio, err := strconv.ParseFloat(getEnv("ARCHIVE_MAX_COMPRESSION_RATIO", ""), 64); err == nil && ratio > 0 {
+		limits.MaxRatio = ratio
+	}
+	return limits
+}
+
+// extractedFile is an archive entry stored as the input of a job
+type extractedFile struct {
+	name  string
+	jobID string
+	path  string
+}
+
+// ProcessArchive handles a ZIP archive of images, queueing a job for each
+// file in it with the same options. The archive is extracted within the
+// deployment's archive limits and rejected whole, keeping nothing, if it
+// passes one or holds another archive: with 413 if it's too large, and
+// with 422 for a suspicious compression ratio, a nested archive, or a file
+// that isn't a ZIP archive.
+func (h *Handler) ProcessArchive(c *gin.Context) {
+	if !h.storageAvailable(c) {
+		return
+	}
+	if !h.admitPending(c) {
+		return
+	}
+	slot, ok := h.beginUpload(c)
+	if !ok {
+		return
+	}
+	defer slot.finish()
+
+	file, err := c.FormFile("archive")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No archive provided"})
+		return
+	}
+	options, pipeline, err := parsePostProcessing(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	metadata, err := parseMetadata(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	model, ok := h.parseModel(c)
+	if !ok {
+		return
+	}
+	priority, ok := parsePriority(c)
+	if !ok {
+		return
+	}
+	retention, lifetime, ok := h.jobLifecycle(c, nil)
+	if !ok {
+		return
+	}
+	if !h.submissionsOpen(c) {
+		return
+	}
+
+	files, ok := h.extractArchive(c, slot, file)
+	if !ok {
+		return
+	}
+	tier := callerTier(c)
+	if !h.admitSubmission(c, tier, len(files)) {
+		return
+	}
+
+	jobs := make([]*queue.Job, len(files))
+	for i, f := range files {
+		var size int64
+		if info, err := h.fs.Stat(f.path); err == nil {
+			size = info.Size()
+		}
+		jobs[i] = &queue.Job{
+			ID:          f.jobID,
+			Status:      queue.StatusPending,
+			InputPath:   f.path,
+			Filename:    path.Base(f.name),
+			InputBytes:  size,
+			InputFormat: h.sniffFile(f.path),
+			Owner:       ownerID(c),
+			Tier:        tier,
+			Options:     options,
+			Pipeline:    pipeline,
+			Metadata:    metadata,
+			Model:       model,
+			Priority:    priority,
+		}
+		jobRetention := *retention
+		jobs[i].Retention = &jobRetention
+		jobs[i].MaxLifetimeSeconds = lifetime
+		jobs[i].MaxAttempts = h.maxAttempts
+		jobs[i].OptionsVersion = jobs[i].RequiredOptionsVersion()
+		for _, w := range inspectUpload(h.fs, f.path) {
+			jobs[i].AddWarning(w)
+		}
+	}
+
+	// Charge every job, returning earlier charges if a later one is denied
+	if h.quotasEnabled() {
+		for i, job := range jobs {
+			if !h.reserveQuota(c, job) {
+				h.failJobs(c.Request.Context(), jobs[:i])
+				return
+			}
+		}
+	}
+
+	jobIDs := make([]string, len(jobs))
+	for i, job := range jobs {
+		jobIDs[i] = job.ID
+	}
+	h.rememberJobs(c.Request.Context(), jobIDs...)
+	for i, job := range jobs {
+		if err := h.jobQueue.AddJob(c.Request.Context(), job); err != nil {
+			// Jobs already queued keep their inputs and run; drop the rest
+			for _, rest := range jobs[i:] {
+				h.forgetJob(c.Request.Context(), rest.ID)
+				h.fs.Remove(rest.InputPath)
+			}
+			h.failJobs(c.Request.Context(), jobs[i:])
+			slot.keep()
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add job to queue", "job_ids": jobIDs[:i]})
+			return
+		}
+		h.indexJob(c.Request.Context(), job)
+	}
+	slot.keep()
+	tierSubmissions.Add(tier, int64(len(jobs)))
+
+	entries := make([]gin.H, len(jobs))
+	for i, job := range jobs {
+		entries[i] = gin.H{"job_id": job.ID, "filename": files[i].name}
+	}
+	c.JSON(http.StatusAccepted, gin.H{
+		"job_ids": jobIDs,
+		"jobs":    entries,
+		"status":  string(queue.StatusPending),
+	})
+}
+
+// extractArchive stores each file of the uploaded archive as the input of
+// a new job, writing an error response and keeping nothing if it can't
+func (h *Handler) extractArchive(c *gin.Context, slot *upload, file *multipart.FileHeader) ([]extractedFile, bool) {
+	src, err := file.Open()
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No archive provided"})
+		return nil, false
+	}
+	defer src.Close()
+
+	var files []extractedFile
+	var storeErr error
+	create := func(name string) (io.WriteCloser, error) {
+		jobID, err := generateID()
+		if err != nil {
+			storeErr = err
+			return nil, err
+		}
+		// Entries are named after their job, never after their path in the archive
+		f := extractedFile{name: name, jobID: jobID, path: filepath.Join(h.uploadDir, jobID+storageExt(name))}
+		slot.track(f.path)
+		w, err := h.fs.Create(f.path)
+		h.recordStorage(err)
+		if err != nil {
+			storeErr = err
+			return nil, err
+		}
+		files = append(files, f)
+		return storageWriter{w, &storeErr}, nil
+	}
+	remove := func(name string) {
+		for _, f := range files {
+			if f.name == name {
+				h.fs.Remove(f.path)
+			}
+		}
+	}
+	_, err = archive.Extract(src, file.Size, h.archiveLimits, create, remove)
+
+	var limitErr *archive.LimitError
+	switch {
+	case storeErr != nil:
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save the uploaded file"})
+		return nil, false
+	case errors.As(err, &limitErr) && limitErr.TooLarge():
+		c.JSON(http.StatusRequestEntityTooLarge, gin.H{"error": err.Error(), "error_code": errorCodeArchiveTooLarge, "limit": limitErr.Limit})
+		return nil, false
+	case errors.As(err, &limitErr):
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": err.Error(), "error_code": errorCodeArchiveRejected, "limit": limitErr.Limit})
+		return nil, false
+	case err != nil:
+		c.JSON(http.StatusUnprocessableEntity, gin.H{"error": "Invalid archive: " + err.Error(), "error_code": errorCodeArchiveRejected})
+		return nil, false
+	case len(files) == 0:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The archive holds no files"})
+		return nil, false
+	}
+	return files, true
+}
+
+// storageWriter records the first failure writing an extracted file, so it
+// can be told apart from the archive being rejected
+type storageWriter struct {
+	io.WriteCloser
+	err *error
+}
+
+func (w storageWriter) Write(p []byte) (int, error) {
+	n, err := w.WriteCloser.Write(p)
+	if err != nil && *w.err == nil {
+		*w.err = err
+	}
+	return n, err
+}
+
+func (w storageWriter) Close() error {
+	err := w.WriteCloser.Close()
+	if err != nil && *w.err == nil {
+		*w.err = err
+	}
+	return err
+}
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// zipOf builds a ZIP archive of the named files, in order
+func zipOf(t *testing.T, files ...interface{}) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for i := 0; i < len(files); i += 2 {
+		w, err := zw.Create(files[i].(string))
+		if err != nil {
+			t.Fatalf("creating %s: %v", files[i], err)
+		}
+		w.Write(files[i+1].([]byte))
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatalf("closing the archive: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func TestProcessArchive(t *testing.T) {
+	h, jobs := newRedisTestHandler(t)
+	router := gin.New()
+	router.POST("/process/archive", h.Authenticate, h.ProcessArchive)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, fileRequest(t, "/process/archive", "archive", "photos.zip", zipOf(t,
+		"a.png", testPNG(t),
+		"../../nested/b.png", testPNG(t),
+	)))
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("got %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+	var got struct {
+		JobIDs []string `json:"job_ids"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || len(got.JobIDs) != 2 {
+		t.Fatalf("response %s, want two job IDs", w.Body)
+	}
+	for i, want := range []string{"a.png", "b.png"} {
+		job, err := jobs.GetJob(context.Background(), got.JobIDs[i])
+		if err != nil {
+			t.Fatalf("GetJob: %v", err)
+		}
+		if job.Status != queue.StatusPending || job.Filename != want || job.InputFormat != queue.FormatPNG {
+			t.Fatalf("job %d = %+v, want a pending PNG named %s", i, job, want)
+		}
+		if _, err := os.Stat(job.InputPath); err != nil {
+			t.Fatalf("input of job %d: %v", i, err)
+		}
+	}
+}
+
+func TestProcessArchiveRejectsBombs(t *testing.T) {
+	t.Setenv("ARCHIVE_MAX_ENTRIES", "3")
+	t.Setenv("ARCHIVE_MAX_TOTAL_BYTES", "65536")
+	h, jobs := newRedisTestHandler(t)
+	router := gin.New()
+	router.POST("/process/archive", h.Authenticate, h.ProcessArchive)
+
+	random := make([]byte, 40<<10)
+	rand.Read(random)
+	for _, tc := range []struct {
+		name    string
+		archive []byte
+		want    int
+		code    string
+		limit   string
+	}{
+		{"too many entries", zipOf(t, "a.png", testPNG(t), "b.png", testPNG(t), "c.png", testPNG(t), "d.png", testPNG(t)), http.StatusRequestEntityTooLarge, errorCodeArchiveTooLarge, "max_entries"},
+		{"too large together", zipOf(t, "a.png", testPNG(t), "b.png", random, "c.png", random), http.StatusRequestEntityTooLarge, errorCodeArchiveTooLarge, "max_total_bytes"},
+		{"bomb past the size limits", zipOf(t, "bomb.png", make([]byte, 16<<20)), http.StatusRequestEntityTooLarge, errorCodeArchiveTooLarge, "max_total_bytes"},
+		{"nested archive", zipOf(t, "a.png", testPNG(t), "inner.png", zipOf(t, "b.png", testPNG(t))), http.StatusUnprocessableEntity, errorCodeArchiveRejected, ""},
+		{"not an archive", testPNG(t), http.StatusUnprocessableEntity, errorCodeArchiveRejected, ""},
+	} {
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, fileRequest(t, "/process/archive", "archive", "photos.zip", tc.archive))
+		if w.Code != tc.want {
+			t.Fatalf("%s: got %d, want %d: %s", tc.name, w.Code, tc.want, w.Body)
+		}
+		var got struct {
+			ErrorCode string `json:"error_code"`
+			Limit     string `json:"limit"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || got.ErrorCode != tc.code || got.Limit != tc.limit {
+			t.Fatalf("%s: body %s, want error_code %s and limit %q", tc.name, w.Body, tc.code, tc.limit)
+		}
+		if entries, _ := os.ReadDir(h.uploadDir); len(entries) != 0 {
+			t.Fatalf("%s: %d files kept in the upload directory, want none", tc.name, len(entries))
+		}
+	}
+	if pending, _, err := jobs.ListJobs(context.Background(), queue.StatusPending, 0, 10); err != nil || len(pending) != 0 {
+		t.Fatalf("ListJobs(pending) = %d jobs, %v, want none queued", len(pending), err)
+	}
+}
+
+func TestProcessArchiveRejectsHighRatioEntries(t *testing.T) {
+	h, _ := newRedisTestHandler(t)
+	router := gin.New()
+	router.POST("/process/archive", h.Authenticate, h.ProcessArchive)
+
+	// 16 MiB of zeros deflates some thousandfold, within the default size limits
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, fileRequest(t, "/process/archive", "archive", "photos.zip", zipOf(t, "bomb.png", make([]byte, 16<<20))))
+	if w.Code != http.StatusUnprocessableEntity {
+		t.Fatalf("got %d, want %d: %s", w.Code, http.StatusUnprocessableEntity, w.Body)
+	}
+	var got struct {
+		Limit string `json:"limit"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || got.Limit != "max_compression_ratio" {
+		t.Fatalf("body %s, want the max_compression_ratio limit", w.Body)
+	}
+	if entries, _ := os.ReadDir(h.uploadDir); len(entries) != 0 {
+		t.Fatalf("%d files kept in the upload directory, want none", len(entries))
+	}
+}
+
+func TestCapabilitiesReportArchiveLimits(t *testing.T) {
+	t.Setenv("ARCHIVE_MAX_ENTRIES", "7")
+	t.Setenv("ARCHIVE_MAX_COMPRESSION_RATIO", "50")
+	h, _ := newRedisTestHandler(t)
+	router := gin.New()
+	router.GET("/capabilities", h.GetCapabilities)
+
+	w := serveTest(router, http.MethodGet, "/capabilities", nil, "")
+	var got struct {
+		ArchiveLimits map[string]float64 `json:"archive_limits"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding the capabilities: %v: %s", err, w.Body)
+	}
+	if got.ArchiveLimits["max_entries"] != 7 || got.ArchiveLimits["max_compression_ratio"] != 50 || got.ArchiveLimits["max_total_bytes"] == 0 {
+		t.Fatalf("archive_limits = %v, want the configured limits with the default sizes", got.ArchiveLimits)
+	}
+}
@@ -0,0 +1,149 @@
+package handlers
+
+import (
+	"crypto/subtle"
+	"expvar"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/auth"
+	"rembg-v2/api/internal/queue"
+)
+
+// ownerContextKey holds the authenticated owner of a request
+const ownerContextKey = "owner"
+
+// tierContextKey holds the service tier named by the request's credentials
+const tierContextKey = "tier"
+
+// oidcOwnerPrefix keeps token owners apart from anonymous client IPs
+const oidcOwnerPrefix = "oidc:"
+
+// adminContextKey marks a request RequireAdmin admitted
+const adminContextKey = "admin"
+
+// adminKeyHeader carries the admin credential, apart from the
+// Authorization header that names the request's owner
+const adminKeyHeader = "X-Admin-Key"
+
+// authFailures counts rejected credentials by reason
+var authFailures = expvar.NewMap("auth_failures")
+
+// WithBearerAuth validates Bearer tokens with verifier. When required,
+// requests without a valid token are rejected; otherwise they fall back
+// to being identified by client IP.
+func WithBearerAuth(verifier *auth.Verifier, required bool) Option {
+	return func(h *Handler) {
+		h.verifier = verifier
+		h.authRequired = required
+	}
+}
+
+// Authenticate resolves the request's owner from its credentials, an API
+// key or an OIDC token. Jobs, quotas, and usage are all keyed by that owner,
+// never by the credential, so they carry over when a key is rotated.
+func (h *Handler) Authenticate(c *gin.Context) {
+	scheme, token, _ := strings.Cut(c.GetHeader("Authorization"), " ")
+	token = strings.TrimSpace(token)
+	if strings.EqualFold(scheme, "Bearer") && strings.HasPrefix(token, queue.APIKeyPrefix) {
+		if h.authenticateKey(c, token) {
+			c.Next()
+		}
+		return
+	}
+	if h.verifier == nil || !strings.EqualFold(scheme, "Bearer") || token == "" {
+		if h.authRequired {
+			c.Header("WWW-Authenticate", `Bearer realm="api"`)
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required"})
+			return
+		}
+		c.Next()
+		return
+	}
+
+	identity, err := h.verifier.Identify(c.Request.Context(), token)
+	if err != nil {
+		authFailures.Add(err.Error(), 1)
+		c.Header("WWW-Authenticate", `Bearer realm="api", error="invalid_token", error_description="`+err.Error()+`"`)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid token: " + err.Error()})
+		return
+	}
+	c.Set(ownerContextKey, oidcOwnerPrefix+identity.Owner)
+	if queue.IsTier(identity.Tier) {
+		c.Set(tierContextKey, identity.Tier)
+	}
+	c.Next()
+}
+
+// RequireAdmin admits only requests carrying ADMIN_API_KEY in the
+// X-Admin-Key header. With no admin key configured every request is
+// refused, so the admin endpoints are never left open by default.
+func (h *Handler) RequireAdmin(c *gin.Context) {
+	if len(h.adminKey) == 0 {
+		authFailures.Add("admin_disabled", 1)
+		c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "Admin endpoints are disabled; set ADMIN_API_KEY to enable them"})
+		return
+	}
+	key := c.GetHeader(adminKeyHeader)
+	if key == "" {
+		authFailures.Add("admin_key_missing", 1)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Admin credential required in " + adminKeyHeader})
+		return
+	}
+	if subtle.ConstantTimeCompare([]byte(key), h.adminKey) != 1 {
+		authFailures.Add("admin_key_invalid", 1)
+		c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid admin credential"})
+		return
+	}
+	c.Set(adminContextKey, true)
+	c.Next()
+}
+
+// isAdmin reports whether RequireAdmin admitted the request
+func isAdmin(c *gin.Context) bool {
+	return c.GetBool(adminContextKey)
+}
+
+// authenticatedOwner returns the owner named by the request's credentials,
+// or "" for an anonymous request
+func authenticatedOwner(c *gin.Context) string {
+	return c.GetString(ownerContextKey)
+}
+
+// hasAdminKey reports whether the request carries the admin key, on routes
+// outside the admin group too
+func (h *Handler) hasAdminKey(c *gin.Context) bool {
+	if isAdmin(c) {
+		return true
+	}
+	key := c.GetHeader(adminKeyHeader)
+	return len(h.adminKey) > 0 && key != "" && subtle.ConstantTimeCompare([]byte(key), h.adminKey) == 1
+}
+
+// requireCredentials admits requests that may act on existing jobs: those
+// with an API key or token, or with the admin key. Anonymous callers are
+// known only by a client IP that others behind the same proxy share, so
+// they may submit jobs and fetch results but never change or list them.
+// It writes a 401 and returns false otherwise.
+func (h *Handler) requireCredentials(c *gin.Context) bool {
+	if authenticatedOwner(c) != "" || h.hasAdminKey(c) {
+		return true
+	}
+	authFailures.Add("credentials_missing", 1)
+	c.Header("WWW-Authenticate", `Bearer realm="api"`)
+	c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Authentication required to manage jobs"})
+	return false
+}
+
+// mayManage reports whether the request may act on job: its authenticated
+// owner may, and so may the admin key. Jobs owned by a client IP can only
+// be managed with the admin key.
+func (h *Handler) mayManage(c *gin.Context, job *queue.Job) bool {
+	if h.hasAdminKey(c) {
+		return true
+	}
+	owner := authenticatedOwner(c)
+	return owner != "" && job.Owner == owner
+}
@@ -0,0 +1,95 @@
+package handlers
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/archive"
+	"rembg-v2/api/internal/queue"
+)
+
+// maxBatchDownload caps the number of results in one batch ZIP
+const maxBatchDownload = 50
+
+// DownloadBatch serves the results of several completed jobs as one ZIP,
+// with entries named after the files the client uploaded
+func (h *Handler) DownloadBatch(c *gin.Context) {
+	if !h.directDownloads() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Direct downloads are disabled, request a download token"})
+		return
+	}
+
+	var ids []string
+	for _, id := range strings.Split(c.Query("ids"), ",") {
+		if id = strings.TrimSpace(id); id != "" {
+			ids = append(ids, id)
+		}
+	}
+	if len(ids) == 0 || len(ids) > maxBatchDownload {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("ids must list between 1 and %d job IDs", maxBatchDownload)})
+		return
+	}
+
+	if !h.storageAvailable(c) {
+		return
+	}
+
+	// Check every job before streaming, so failures can still get a JSON error
+	var (
+		jobs        []*queue.Job
+		unavailable []string
+	)
+	for _, id := range ids {
+		job, err := queue.NilIfNotFound(h.jobQueue.GetJob(c.Request.Context(), id))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve job"})
+			return
+		}
+		if job == nil || job.Status != queue.StatusCompleted || !h.resultExists(job) {
+			unavailable = append(unavailable, id)
+			continue
+		}
+		jobs = append(jobs, job)
+	}
+	if len(unavailable) > 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Some results are not available", "job_ids": unavailable})
+		return
+	}
+
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", `attachment; filename="results.zip"`)
+	c.Header("Referrer-Policy", "no-referrer")
+	c.Status(http.StatusOK)
+
+	zw := archive.NewZipWriter(c.Writer)
+	for _, job := range jobs {
+		if err := h.addToArchive(zw, job); err != nil {
+			log.Printf("Failed to add job %s to batch download: %v", job.ID, err)
+			return
+		}
+	}
+	if err := zw.Close(); err != nil {
+		log.Printf("Failed to finish batch download: %v", err)
+	}
+}
+
+// addToArchive writes one job's result to the archive
+func (h *Handler) addToArchive(zw *archive.ZipWriter, job *queue.Job) error {
+	f, err := h.fs.Open(job.OutputPath)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	w, err := zw.Create(resultFilename(job, job.ResultFormat()), job.UpdatedAt)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, f)
+	return err
+}
@@ -0,0 +1,92 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// breakerStore is implemented by queues with a circuit breaker on dispatch
+type breakerStore interface {
+	BreakerState(ctx context.Context) (queue.BreakerState, error)
+	ResetBreaker(ctx context.Context) error
+}
+
+// BreakerState reports whether the circuit breaker has stopped workers
+// claiming new jobs, with the failures that opened it and its settings
+func (h *Handler) BreakerState(c *gin.Context) {
+	store, ok := h.jobQueue.(breakerStore)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Queue backend does not support a circuit breaker"})
+		return
+	}
+	state, err := store.BreakerState(c.Request.Context())
+	if err != nil {
+		log.Printf("Failed to read the circuit breaker: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read the circuit breaker"})
+		return
+	}
+	c.JSON(http.StatusOK, breakerResponse(state))
+}
+
+// ResetBreaker closes the circuit breaker before its cool-down ends, as
+// once the cause of the failures is fixed, recording it in the audit log.
+// Only requests RequireAdmin admitted may, wherever the route is mounted.
+func (h *Handler) ResetBreaker(c *gin.Context) {
+	if !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Resetting the circuit breaker needs the admin key"})
+		return
+	}
+	store, ok := h.jobQueue.(breakerStore)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Queue backend does not support a circuit breaker"})
+		return
+	}
+	ctx := c.Request.Context()
+	if err := store.ResetBreaker(ctx); err != nil {
+		log.Printf("Failed to reset the circuit breaker: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reset the circuit breaker"})
+		return
+	}
+	if auditor, ok := h.jobQueue.(auditRecorder); ok {
+		entry := queue.AuditEntry{At: h.clock.Now(), Actor: "api:" + ownerID(c), Action: "reset", Target: "breaker"}
+		if err := auditor.RecordAudit(ctx, entry); err != nil {
+			log.Printf("Failed to record the circuit breaker reset: %v", err)
+		}
+	}
+
+	state, err := store.BreakerState(ctx)
+	if err != nil {
+		log.Printf("Failed to read the circuit breaker after its reset: %v", err)
+		c.JSON(http.StatusOK, gin.H{"open": false})
+		return
+	}
+	c.JSON(http.StatusOK, breakerResponse(state))
+}
+
+// breakerResponse describes the breaker's state and settings
+func breakerResponse(state queue.BreakerState) gin.H {
+	response := gin.H{
+		"enabled":  state.Config.Enabled(),
+		"open":     state.Open,
+		"failed":   state.Failed,
+		"finished": state.Finished,
+		"trips":    state.Trips,
+	}
+	if state.OpenedAt != nil {
+		response["opened_at"] = state.OpenedAt
+	}
+	if state.OpenUntil != nil {
+		response["open_until"] = state.OpenUntil
+	}
+	if state.Config.Enabled() {
+		response["window"] = state.Config.Window
+		response["failure_rate"] = state.Config.FailureRate
+		response["cooldown_seconds"] = state.Config.Cooldown.Seconds()
+	}
+	return response
+}
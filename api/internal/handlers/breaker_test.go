@@ -0,0 +1,62 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+func TestResetBreakerNeedsAdmin(t *testing.T) {
+	h, jobs := newRedisTestHandlerWith(t, queue.Options{
+		Breaker: queue.BreakerConfig{Window: 4, FailureRate: 0.5, Cooldown: time.Minute},
+	})
+	ctx := context.Background()
+	for i := 0; i < 4; i++ {
+		job := &queue.Job{ID: fmt.Sprintf("job-%d", i), Status: queue.StatusFailed, ErrorCode: "processing_error"}
+		if err := jobs.RecordOutcome(ctx, job); err != nil {
+			t.Fatalf("RecordOutcome: %v", err)
+		}
+	}
+	if state, err := jobs.BreakerState(ctx); err != nil || !state.Open {
+		t.Fatalf("breaker after a window of failures: %+v, %v", state, err)
+	}
+
+	router := gin.New()
+	router.POST("/open/breaker/reset", h.ResetBreaker)
+	admin := router.Group("/admin", h.RequireAdmin)
+	admin.GET("/breaker", h.BreakerState)
+	admin.POST("/breaker/reset", h.ResetBreaker)
+
+	for _, tc := range []struct {
+		name     string
+		method   string
+		path     string
+		adminKey string
+		want     int
+	}{
+		{"reset outside the admin group", http.MethodPost, "/open/breaker/reset", testAdminKey, http.StatusForbidden},
+		{"reset without the key", http.MethodPost, "/admin/breaker/reset", "", http.StatusUnauthorized},
+		{"reset with a wrong key", http.MethodPost, "/admin/breaker/reset", "guess", http.StatusUnauthorized},
+		{"state without the key", http.MethodGet, "/admin/breaker", "", http.StatusUnauthorized},
+	} {
+		if w := serveTest(router, tc.method, tc.path, nil, tc.adminKey); w.Code != tc.want {
+			t.Errorf("%s: got %d, want %d: %s", tc.name, w.Code, tc.want, w.Body)
+		}
+	}
+	if state, err := jobs.BreakerState(ctx); err != nil || !state.Open {
+		t.Fatalf("breaker after rejected resets: %+v, %v", state, err)
+	}
+
+	if w := serveTest(router, http.MethodPost, "/admin/breaker/reset", nil, testAdminKey); w.Code != http.StatusOK {
+		t.Fatalf("reset with the admin key: got %d: %s", w.Code, w.Body)
+	}
+	if state, err := jobs.BreakerState(ctx); err != nil || state.Open {
+		t.Fatalf("breaker after the admin reset: %+v, %v", state, err)
+	}
+}
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// docRefreshTimeout bounds a background rebuild of a cached document
+const docRefreshTimeout = 5 * time.Second
+
+// docCache holds one JSON document with stale-while-revalidate semantics:
+// a stale or invalidated document is served immediately while a single
+// background rebuild runs, and concurrent cold requests share one build.
+type docCache struct {
+	ttl   time.Duration
+	clock queue.Clock
+	build func(ctx context.Context) (interface{}, error)
+
+	mu         sync.Mutex
+	body       []byte
+	etag       string
+	builtAt    time.Time
+	stale      bool
+	refreshing bool
+	// generation counts invalidations, so one landing mid-build isn't lost
+	generation uint64
+	// building is closed when the in-flight cold build finishes
+	building chan struct{}
+}
+
+func newDocCache(ttl time.Duration, clock queue.Clock, build func(ctx context.Context) (interface{}, error)) *docCache {
+	return &docCache{ttl: ttl, clock: clock, build: build}
+}
+
+// get returns the document and its ETag, building it only if none exists yet
+func (c *docCache) get(ctx context.Context) ([]byte, string, error) {
+	c.mu.Lock()
+	if c.body != nil {
+		body, etag := c.body, c.etag
+		if (c.stale || c.clock.Now().Sub(c.builtAt) > c.ttl) && !c.refreshing {
+			c.refreshing = true
+			go c.refresh()
+		}
+		c.mu.Unlock()
+		return body, etag, nil
+	}
+
+	// Cold cache: the first caller builds, the others wait for it
+	if c.building != nil {
+		building := c.building
+		c.mu.Unlock()
+		select {
+		case <-building:
+		case <-ctx.Done():
+			return nil, "", ctx.Err()
+		}
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.body == nil {
+			return nil, "", errDocUnavailable
+		}
+		return c.body, c.etag, nil
+	}
+	c.building = make(chan struct{})
+	c.mu.Unlock()
+
+	err := c.rebuild(ctx)
+
+	c.mu.Lock()
+	close(c.building)
+	c.building = nil
+	body, etag := c.body, c.etag
+	c.mu.Unlock()
+	return body, etag, err
+}
+
+// invalidate marks the document stale so the next request triggers a rebuild
+func (c *docCache) invalidate() {
+	c.mu.Lock()
+	c.stale = true
+	c.generation++
+	c.mu.Unlock()
+}
+
+// refresh rebuilds the document in the background
+func (c *docCache) refresh() {
+	ctx, cancel := context.WithTimeout(context.Background(), docRefreshTimeout)
+	defer cancel()
+
+	if err := c.rebuild(ctx); err != nil {
+		log.Printf("Failed to refresh cached document: %v", err)
+	}
+
+	c.mu.Lock()
+	c.refreshing = false
+	c.mu.Unlock()
+}
+
+// rebuild builds and stores a new document, keeping the old one on failure
+func (c *docCache) rebuild(ctx context.Context) error {
+	c.mu.Lock()
+	generation := c.generation
+	c.mu.Unlock()
+
+	doc, err := c.build(ctx)
+	if err != nil {
+		return err
+	}
+	body, err := json.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(body)
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.body = body
+	c.etag = `"` + hex.EncodeToString(sum[:8]) + `"`
+	c.builtAt = c.clock.Now()
+	c.stale = c.generation != generation
+	return nil
+}
+
+// errDocUnavailable is returned to callers that waited on a failed cold build
+var errDocUnavailable = errors.New("document build failed")
+
+// serveDoc writes a cached document, answering 304 when the client's ETag matches
+func serveDoc(c *gin.Context, cache *docCache) {
+	body, etag, err := cache.get(c.Request.Context())
+	if err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Document temporarily unavailable"})
+		return
+	}
+
+	c.Header("ETag", etag)
+	c.Header("Cache-Control", "no-cache")
+	if c.GetHeader("If-None-Match") == etag {
+		c.Status(http.StatusNotModified)
+		return
+	}
+	c.Data(http.StatusOK, "application/json; charset=utf-8", body)
+}
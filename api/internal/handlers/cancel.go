@@ -0,0 +1,103 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// cancelChecker is implemented by queues that can tell whether a job was
+// asked to stop
+type cancelChecker interface {
+	CancelRequested(ctx context.Context, jobID string) (bool, error)
+}
+
+// CancelJob cancels one of the caller's jobs. A job waiting to run is
+// cancelled at once and its input removed. A job being processed is stopped
+// by its worker at the next pipeline stage, so the response is 202 and the
+// job reports cancelled once the worker has stopped it. Only the job's
+// authenticated owner or the admin key may cancel it.
+func (h *Handler) CancelJob(c *gin.Context) {
+	jobID := c.Param("id")
+	if h.rejectCaseVariant(c, jobID) || !h.requireCredentials(c) {
+		return
+	}
+
+	ctx := c.Request.Context()
+	job, err := queue.NilIfNotFound(h.jobQueue.GetJob(ctx, jobID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve job"})
+		return
+	}
+	// Another owner's job is reported as missing, not forbidden
+	if job == nil || h.expired(job) || !h.mayManage(c, job) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+
+	err = h.jobQueue.CancelJob(ctx, jobID)
+	switch {
+	case errors.Is(err, queue.ErrJobNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	case errors.Is(err, queue.ErrCancelConflict):
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusConflict, gin.H{"error": "The job changed during the cancellation, try again"})
+		return
+	case err != nil && !errors.Is(err, queue.ErrJobFinished):
+		log.Printf("Failed to cancel job %s: %v", jobID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to cancel job"})
+		return
+	}
+
+	// Report the status the cancellation left, falling back to the first read
+	if current, readErr := h.jobQueue.GetJob(ctx, jobID); readErr == nil && current != nil {
+		job = current
+	}
+	if err != nil {
+		c.JSON(http.StatusConflict, gin.H{"error": "Job has already finished", "job_id": job.ID, "status": string(job.Status)})
+		return
+	}
+	if job.Status != queue.StatusCancelled {
+		c.JSON(http.StatusAccepted, gin.H{"job_id": job.ID, "status": string(job.Status), "cancel_requested": true})
+		return
+	}
+
+	h.removeCancelledInput(ctx, job)
+	c.JSON(http.StatusOK, gin.H{"job_id": job.ID, "status": string(job.Status)})
+}
+
+// removeCancelledInput removes the input of a job cancelled before it ran,
+// and the files that go with it. Shared fanout inputs are only released.
+// Failures are logged; the retention sweep removes what's left.
+func (h *Handler) removeCancelledInput(ctx context.Context, job *queue.Job) {
+	if job.FanoutID != "" {
+		if store, ok := h.jobQueue.(fanoutStore); ok {
+			h.releaseInputs(ctx, store, []*queue.Job{job})
+		}
+	} else if err := h.removeFile(job.InputPath); err != nil {
+		log.Printf("Failed to remove input of cancelled job %s: %v", job.ID, err)
+	}
+	if err := h.removeOutputs(job); err != nil {
+		log.Printf("Failed to remove outputs of cancelled job %s: %v", job.ID, err)
+	}
+}
+
+// cancelRequested reports whether a job being processed was asked to stop
+func (h *Handler) cancelRequested(ctx context.Context, job *queue.Job) bool {
+	checker, ok := h.jobQueue.(cancelChecker)
+	if !ok || job.Status != queue.StatusProcessing {
+		return false
+	}
+	requested, err := checker.CancelRequested(ctx, job.ID)
+	if err != nil {
+		log.Printf("Failed to check whether job %s was cancelled: %v", job.ID, err)
+		return false
+	}
+	return requested
+}
@@ -0,0 +1,70 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+func TestCancelJobNeedsItsOwner(t *testing.T) {
+	h, jobs := newRedisTestHandler(t)
+	ctx := context.Background()
+	for _, job := range []*queue.Job{
+		{ID: "alice-job", Status: queue.StatusPending, Owner: "alice"},
+		{ID: "anonymous-job", Status: queue.StatusPending, Owner: "192.0.2.1"},
+	} {
+		if err := jobs.AddJob(ctx, job); err != nil {
+			t.Fatalf("AddJob: %v", err)
+		}
+	}
+	alice, bob := newTestAPIKey(t, jobs, "alice"), newTestAPIKey(t, jobs, "bob")
+
+	router := gin.New()
+	router.POST("/job/:id/cancel", h.Authenticate, h.CancelJob)
+
+	for _, tc := range []struct {
+		name   string
+		jobID  string
+		secret string
+		want   int
+	}{
+		{"anonymous", "alice-job", "", http.StatusUnauthorized},
+		{"anonymous for a job submitted anonymously", "anonymous-job", "", http.StatusUnauthorized},
+		{"another owner", "alice-job", bob, http.StatusNotFound},
+		{"an owner for a job submitted anonymously", "anonymous-job", bob, http.StatusNotFound},
+		{"an unknown job", "no-such-job", alice, http.StatusNotFound},
+	} {
+		if w := serveAs(router, http.MethodPost, "/job/"+tc.jobID+"/cancel", nil, tc.secret); w.Code != tc.want {
+			t.Errorf("%s: got %d, want %d: %s", tc.name, w.Code, tc.want, w.Body)
+		}
+	}
+	for _, jobID := range []string{"alice-job", "anonymous-job"} {
+		job, err := jobs.GetJob(ctx, jobID)
+		if err != nil {
+			t.Fatalf("GetJob: %v", err)
+		}
+		if job.Status != queue.StatusPending {
+			t.Fatalf("%s is %s after refused cancellations, want pending", jobID, job.Status)
+		}
+	}
+
+	if w := serveAs(router, http.MethodPost, "/job/alice-job/cancel", nil, alice); w.Code != http.StatusOK {
+		t.Fatalf("owner: got %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if w := serveTest(router, http.MethodPost, "/job/anonymous-job/cancel", nil, testAdminKey); w.Code != http.StatusOK {
+		t.Fatalf("admin key: got %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	for _, jobID := range []string{"alice-job", "anonymous-job"} {
+		job, err := jobs.GetJob(ctx, jobID)
+		if err != nil {
+			t.Fatalf("GetJob: %v", err)
+		}
+		if job.Status != queue.StatusCancelled {
+			t.Fatalf("%s is %s after its cancellation, want cancelled", jobID, job.Status)
+		}
+	}
+}
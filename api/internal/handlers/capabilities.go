@@ -0,0 +1,252 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// Timing of the capabilities and models caches
+const (
+	capabilitiesTTL = 30 * time.Second
+	// capabilitiesWatchInterval is how often feature flags and worker
+	// heartbeats are checked for changes that invalidate the caches
+	capabilitiesWatchInterval = 5 * time.Second
+)
+
+// heartbeatReader is implemented by queues that track worker liveness
+type heartbeatReader interface {
+	WorkerHeartbeats(ctx context.Context) ([]queue.WorkerHeartbeat, error)
+}
+
+// featureGate is implemented by queues that can disable optional features
+type featureGate interface {
+	DisabledFeatures() []string
+}
+
+// initDocCaches sets up the cached models document and a capabilities
+// document per tier
+func (h *Handler) initDocCaches() {
+	h.capabilities = make(map[string]*docCache, len(queue.Tiers))
+	for _, tier := range queue.Tiers {
+		tier := tier
+		h.capabilities[tier] = newDocCache(capabilitiesTTL, h.clock, func(ctx context.Context) (interface{}, error) {
+			return h.buildCapabilities(ctx, tier)
+		})
+	}
+	h.models = newDocCache(capabilitiesTTL, h.clock, h.buildModels)
+}
+
+// GetCapabilities describes the options this deployment supports and the
+// limits of the caller's tier
+func (h *Handler) GetCapabilities(c *gin.Context) {
+	serveDoc(c, h.capabilities[callerTier(c)])
+}
+
+// GetModels lists the models workers have loaded and whether each is warm
+func (h *Handler) GetModels(c *gin.Context) {
+	serveDoc(c, h.models)
+}
+
+// deliveryRules are the restrictions on delivery destinations. s3://
+// destinations aren't written to; a presigned_put URL to the bucket does
+// the same without giving the service credentials.
+var deliveryRules = gin.H{
+	"schemes":               []string{"https"},
+	"public_addresses_only": true,
+	"follows_redirects":     false,
+	"unsupported_types":     []string{"s3"},
+}
+
+func (h *Handler) buildCapabilities(ctx context.Context, tier string) (interface{}, error) {
+	var disabled []string
+	if gate, ok := h.jobQueue.(featureGate); ok {
+		disabled = gate.DisabledFeatures()
+	}
+	autoModel, err := h.autoModelAvailable(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	doc := gin.H{
+		"options_version":   queue.OptionsVersion,
+		"input_formats":     []string{"png", "jpeg", "gif", "webp"},
+		"output_formats":    []string{"png", "webp"},
+		"pipeline_stages":   stageTransitions,
+		"max_output_size":   maxOutputSize,
+		"models":            queue.Models,
+		"auto_model":        autoModel,
+		"priorities":        queue.Priorities,
+		"delivery_types":    []string{queue.DeliveryPresignedPut, queue.DeliveryWebhook},
+		"max_deliveries":    h.maxDeliveries,
+		"delivery_rules":    deliveryRules,
+		"archive_limits":    h.archiveLimits,
+		"download_mode":     h.downloadMode,
+		"quotas":            h.quotasEnabled(),
+		"disabled_features": disabled,
+		"tier":              tier,
+		"limits":            h.tierLimits(tier),
+	}
+	if h.maintenance != nil {
+		doc["maintenance"] = h.maintenanceWindows()
+	}
+	return doc, nil
+}
+
+func (h *Handler) buildModels(ctx context.Context) (interface{}, error) {
+	workers := make(map[string]int)
+	if reader, ok := h.jobQueue.(heartbeatReader); ok {
+		heartbeats, err := reader.WorkerHeartbeats(ctx)
+		if err != nil {
+			return nil, err
+		}
+		for _, hb := range heartbeats {
+			for _, model := range hb.LoadedModels() {
+				workers[model]++
+			}
+		}
+	}
+
+	models := make([]gin.H, 0, len(queue.Models))
+	for _, name := range queue.Models {
+		models = append(models, gin.H{
+			"name":    name,
+			"default": name == queue.ModelDefault,
+			"warm":    workers[name] > 0,
+			"workers": workers[name],
+		})
+	}
+	return gin.H{"models": models}, nil
+}
+
+// autoModelAvailable reports whether a live worker has every model loaded,
+// which is needed to process model=auto jobs
+func (h *Handler) autoModelAvailable(ctx context.Context) (bool, error) {
+	reader, ok := h.jobQueue.(heartbeatReader)
+	if !ok {
+		return false, nil
+	}
+	heartbeats, err := reader.WorkerHeartbeats(ctx)
+	if err != nil {
+		return false, err
+	}
+	for _, hb := range heartbeats {
+		if hb.HasAllModels() {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// parseModel reads the requested model from the submission form, writing an
+// error response if it is unknown or auto mode has no worker to run it
+func (h *Handler) parseModel(c *gin.Context) (string, bool) {
+	model := c.PostForm("model")
+	if model == "" || model == queue.ModelDefault {
+		return "", true
+	}
+	if !queue.IsModel(model) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown model", "models": queue.Models})
+		return "", false
+	}
+
+	if model == queue.ModelAuto {
+		available, err := h.autoModelAvailable(c.Request.Context())
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check worker models"})
+			return "", false
+		}
+		if !available {
+			c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Automatic model selection is not available"})
+			return "", false
+		}
+	}
+	return model, true
+}
+
+// parsePriority reads the requested priority from the submission form,
+// writing an error response if it is unknown
+func parsePriority(c *gin.Context) (string, bool) {
+	priority := c.PostForm("priority")
+	if priority == "" || priority == queue.PriorityNormal {
+		return "", true
+	}
+	if !queue.IsPriority(priority) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Unknown priority", "priorities": queue.Priorities})
+		return "", false
+	}
+	return priority, true
+}
+
+// capabilitiesState summarizes what the cached documents depend on beyond
+// static configuration: disabled features and which models are warm
+func (h *Handler) capabilitiesState(ctx context.Context) (string, error) {
+	var parts []string
+	if gate, ok := h.jobQueue.(featureGate); ok {
+		parts = append(parts, "disabled="+strings.Join(gate.DisabledFeatures(), ","))
+	}
+	if reader, ok := h.jobQueue.(heartbeatReader); ok {
+		heartbeats, err := reader.WorkerHeartbeats(ctx)
+		if err != nil {
+			return "", err
+		}
+		warm := make(map[string]bool)
+		for _, hb := range heartbeats {
+			for _, model := range hb.LoadedModels() {
+				warm[model] = true
+			}
+			if hb.HasAllModels() {
+				warm[queue.ModelAuto] = true
+			}
+		}
+		models := make([]string, 0, len(warm))
+		for model := range warm {
+			models = append(models, model)
+		}
+		sort.Strings(models)
+		parts = append(parts, "warm="+strings.Join(models, ","))
+	}
+	if h.maintenance != nil {
+		parts = append(parts, "maintenance="+h.activeWindowNames())
+	}
+	return strings.Join(parts, ";"), nil
+}
+
+// WatchCapabilities invalidates the capabilities and models caches when a
+// feature flag flips or a model goes warm or cold, until ctx is done
+func (h *Handler) WatchCapabilities(ctx context.Context) {
+	ticker := time.NewTicker(capabilitiesWatchInterval)
+	defer ticker.Stop()
+
+	var last string
+	known := false
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		state, err := h.capabilitiesState(ctx)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Failed to check capabilities state: %v", err)
+			}
+			continue
+		}
+		if known && state != last {
+			for _, cache := range h.capabilities {
+				cache.invalidate()
+			}
+			h.models.invalidate()
+		}
+		last, known = state, true
+	}
+}
@@ -0,0 +1,68 @@
+package handlers
+
+import (
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// Job IDs and every storage key derived from them are lowercase by
+// construction, so case-insensitive storage such as APFS on macOS can't
+// map two artifacts to the same file.
+
+// storageExt returns the extension of a client-supplied name, lowercased
+func storageExt(name string) string {
+	return strings.ToLower(filepath.Ext(name))
+}
+
+// caseInsensitive reports whether dir resolves names that differ only in
+// case to the same file, by creating a lowercase probe and looking it up uppercased
+func caseInsensitive(fsys FS, dir string) (bool, error) {
+	probe := filepath.Join(dir, ".case-probe")
+	f, err := fsys.Create(probe)
+	if err != nil {
+		return false, err
+	}
+	f.Close()
+	defer fsys.Remove(probe)
+
+	_, err = fsys.Stat(filepath.Join(dir, ".CASE-PROBE"))
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// rejectCaseVariant answers 400 when a client-supplied job ID differs only
+// by case from an existing job, rather than treating it as another job.
+// It returns false, writing nothing, for any other ID.
+func (h *Handler) rejectCaseVariant(c *gin.Context, jobID string) bool {
+	canonical := strings.ToLower(jobID)
+	if canonical == jobID {
+		return false
+	}
+	job, err := queue.NilIfNotFound(h.jobQueue.GetJob(c.Request.Context(), canonical))
+	if err != nil || job == nil {
+		return false
+	}
+	c.JSON(http.StatusBadRequest, gin.H{"error": "Job IDs are lowercase; use " + canonical, "job_id": canonical})
+	return true
+}
+
+// logCaseInsensitive warns when a storage root is case-insensitive
+func (h *Handler) logCaseInsensitive(dir string) {
+	insensitive, err := caseInsensitive(h.fs, dir)
+	if err != nil {
+		log.Printf("Failed to probe case sensitivity of %s: %v", dir, err)
+		return
+	}
+	if insensitive {
+		log.Printf("Warning: storage root %s is case-insensitive; generated storage keys are lowercase, so files placed there by hand must be too", dir)
+	}
+}
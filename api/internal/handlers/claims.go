@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"time"
+)
+
+// recoveredClaims counts jobs returned to the pending lists after their
+// worker died holding them
+var recoveredClaims = expvar.NewInt("recovered_claims")
+
+// reapedJobs and reapedJobsFailed count jobs found stuck processing past
+// the stale-job timeout, requeued and failed for good respectively
+var (
+	reapedJobs       = expvar.NewInt("reaped_jobs")
+	reapedJobsFailed = expvar.NewInt("reaped_jobs_failed")
+)
+
+// claimStore is implemented by queues whose workers claim jobs onto
+// per-worker processing lists
+type claimStore interface {
+	RecoverAbandonedClaims(ctx context.Context) (int, error)
+}
+
+// RecoverAbandonedJobs requeues the jobs claimed by workers that stopped
+// heartbeating before finishing them
+func (h *Handler) RecoverAbandonedJobs(ctx context.Context) {
+	store, ok := h.jobQueue.(claimStore)
+	if !ok {
+		return
+	}
+	recovered, err := store.RecoverAbandonedClaims(ctx)
+	recoveredClaims.Add(int64(recovered))
+	if recovered > 0 {
+		log.Printf("Requeued %d jobs claimed by workers that stopped", recovered)
+	}
+	if err != nil {
+		log.Printf("Failed to recover jobs claimed by stopped workers: %v", err)
+	}
+}
+
+// staleJobReaper is implemented by queues that can find jobs left
+// processing too long
+type staleJobReaper interface {
+	ReapStaleJobs(ctx context.Context, timeout time.Duration) (int, int, error)
+}
+
+// ReapStaleJobs requeues, or fails once out of attempts, the jobs processing
+// unchanged for longer than timeout, whose workers are alive but stuck
+func (h *Handler) ReapStaleJobs(ctx context.Context, timeout time.Duration) {
+	reaper, ok := h.jobQueue.(staleJobReaper)
+	if !ok {
+		return
+	}
+	requeued, failed, err := reaper.ReapStaleJobs(ctx, timeout)
+	reapedJobs.Add(int64(requeued))
+	reapedJobsFailed.Add(int64(failed))
+	if requeued > 0 || failed > 0 {
+		log.Printf("Reaped jobs processing for over %s: %d requeued, %d failed", timeout, requeued, failed)
+	}
+	if err != nil {
+		log.Printf("Failed to reap stale jobs: %v", err)
+	}
+}
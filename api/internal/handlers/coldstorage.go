@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"context"
+	"expvar"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/coldstorage"
+	"rembg-v2/api/internal/queue"
+)
+
+// statusArchived is reported for a job whose retention has ended and whose
+// record and result were moved to cold storage
+const statusArchived = "archived"
+
+// archivedJobs counts completed jobs archived before their teardown
+var archivedJobs = expvar.NewInt("archived_jobs")
+
+// WithArchiver copies completed jobs to cold storage before the sweeper
+// tears them down at the end of their retention
+func WithArchiver(archiver coldstorage.Archiver) Option {
+	return func(h *Handler) {
+		h.archiver = archiver
+	}
+}
+
+// archiveJob archives an expiring job if it completed and an archiver is
+// configured, returning where it went, or "" if it wasn't archived
+func (h *Handler) archiveJob(ctx context.Context, job *queue.Job) (string, error) {
+	if h.archiver == nil || job.Status != queue.StatusCompleted {
+		return "", nil
+	}
+	location, err := h.archiver.Archive(ctx, job, job.OutputPath)
+	if err != nil {
+		return "", err
+	}
+	archivedJobs.Add(1)
+	return location, nil
+}
+
+// archivedJob writes the response for a job that was archived at the end
+// of its retention: where it went instead of the 410 of a removed job
+func archivedJob(c *gin.Context, jobID string, tombstone *queue.Tombstone) {
+	c.JSON(http.StatusOK, gin.H{
+		"job_id":     jobID,
+		"status":     statusArchived,
+		"archive":    tombstone.Archive,
+		"expired_at": tombstone.ExpiredAt.UTC().Format(time.RFC3339),
+	})
+}
@@ -0,0 +1,73 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log"
+	"os"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// resultsMissing counts completed jobs found without their output file
+var resultsMissing = expvar.NewInt("results_missing")
+
+// requeuer is implemented by queues that can put a job back on the pending list
+type requeuer interface {
+	RequeueJob(ctx context.Context, job *queue.Job) error
+}
+
+// resultExists reports whether a completed job's output file is present.
+// Storage errors other than a missing file count as present, so an outage
+// never fails jobs; they are recorded against the storage health instead.
+func (h *Handler) resultExists(job *queue.Job) bool {
+	if job.OutputPath == "" {
+		return false
+	}
+	_, err := h.fs.Stat(job.OutputPath)
+	h.recordStorage(err)
+	return !os.IsNotExist(err)
+}
+
+// handleMissingResult moves a completed job whose output has disappeared
+// out of the completed state: back to pending if reprocessing is enabled
+// and the input still exists, otherwise to failed with result_missing
+func (h *Handler) handleMissingResult(ctx context.Context, job *queue.Job) {
+	// A result moved since the job was read, as the format repair does, isn't missing
+	if current, err := h.jobQueue.GetJob(ctx, job.ID); err == nil && current != nil && current.OutputPath != job.OutputPath {
+		return
+	}
+	resultsMissing.Add(1)
+	log.Printf("Job %s is completed but its result %q is missing", job.ID, job.OutputPath)
+	h.removeVariants(ctx, job)
+	h.invalidateCachedResult(job.OutputPath)
+
+	if r, ok := h.jobQueue.(requeuer); ok && h.requeueMissingResults {
+		if _, err := h.fs.Stat(job.InputPath); err == nil {
+			job.OutputPath = ""
+			err := r.RequeueJob(ctx, job)
+			if err == nil || errors.Is(err, queue.ErrInvalidTransition) || errors.Is(err, queue.ErrVersionConflict) {
+				// Requeued, or reprocessed, failed, or otherwise changed by
+				// another replica meanwhile; the next read checks it afresh
+				return
+			}
+			log.Printf("Failed to requeue job %s: %v", job.ID, err)
+		}
+	}
+
+	job.Status = queue.StatusFailed
+	job.ErrorCode = queue.ErrorCodeResultMissing
+	job.Error = "Result file not found"
+	if err := h.transitionJob(ctx, job, queue.StatusCompleted); errors.Is(err, queue.ErrInvalidTransition) || errors.Is(err, queue.ErrVersionConflict) {
+		return
+	} else if err != nil {
+		log.Printf("Failed to mark job %s as failed: %v", job.ID, err)
+		return
+	}
+	h.refundQuota(ctx, job)
+	h.recordOutcome(ctx, job)
+	if err := h.forgetUpload(ctx, job); err != nil {
+		log.Printf("Failed to forget the upload of job %s: %v", job.ID, err)
+	}
+}
@@ -0,0 +1,219 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// Bounds of one dead-letter listing request
+const (
+	defaultDeadRows = 1000
+	maxDeadRows     = 10000
+	// maxDeadPages bounds the SCAN pages one request reads, so a keyspace
+	// with few failed jobs can't hold a request open indefinitely
+	maxDeadPages = 2000
+)
+
+// failedRequeuer is implemented by queues that can requeue failed jobs in bulk
+type failedRequeuer interface {
+	RequeueFailed(ctx context.Context, since time.Time, requeue func(job *queue.Job) bool) (int, error)
+}
+
+// jobScanner is implemented by queues that can list every stored job
+type jobScanner interface {
+	ScanJobPage(ctx context.Context, cursor uint64, fn func(job *queue.Job) bool) (uint64, bool, error)
+}
+
+// deadRow is one failed job in a dead-letter listing
+type deadRow struct {
+	JobID     string    `json:"job_id"`
+	Owner     string    `json:"owner,omitempty"`
+	Model     string    `json:"model,omitempty"`
+	ErrorCode string    `json:"error_code,omitempty"`
+	Error     string    `json:"error,omitempty"`
+	Attempts  int       `json:"attempts,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	FailedAt  time.Time `json:"failed_at"`
+}
+
+// deadTrailer is the last line of a dead-letter listing. A listing whose
+// last line isn't a trailer was cut off.
+type deadTrailer struct {
+	Complete   bool   `json:"complete"`
+	NextCursor string `json:"next_cursor,omitempty"`
+	Error      string `json:"error,omitempty"`
+}
+
+// deadCursor is where a listing resumes: a SCAN page and how many of its
+// failed jobs were already listed
+type deadCursor struct {
+	page uint64
+	skip int
+}
+
+func (c deadCursor) String() string {
+	return fmt.Sprintf("%d.%d", c.page, c.skip)
+}
+
+// parseDeadCursor parses a cursor written by deadCursor.String; empty starts
+// from the beginning
+func parseDeadCursor(s string) (deadCursor, bool) {
+	if s == "" {
+		return deadCursor{}, true
+	}
+	page, skip, ok := strings.Cut(s, ".")
+	if !ok {
+		return deadCursor{}, false
+	}
+	var c deadCursor
+	var err error
+	if c.page, err = strconv.ParseUint(page, 10, 64); err != nil {
+		return deadCursor{}, false
+	}
+	if c.skip, err = strconv.Atoi(skip); err != nil || c.skip < 0 {
+		return deadCursor{}, false
+	}
+	return c, true
+}
+
+// ListDeadJobs streams failed jobs, only those with error_code if given, as
+// newline-delimited JSON: one line per job, then a trailer line saying
+// whether the listing is complete or where the next request resumes. Jobs
+// are read one SCAN page at a time and written as they're read, so memory
+// stays flat however many are listed, and a client that disconnects stops
+// the scan. An error mid-listing ends it with a trailer carrying the error.
+func (h *Handler) ListDeadJobs(c *gin.Context) {
+	scanner, ok := h.jobQueue.(jobScanner)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Queue backend does not support listing jobs"})
+		return
+	}
+
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultDeadRows)))
+	if err != nil || limit <= 0 || limit > maxDeadRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxDeadRows)})
+		return
+	}
+	cursor, ok := parseDeadCursor(c.Query("cursor"))
+	if !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+		return
+	}
+	errorCode := c.Query("error_code")
+
+	ctx := c.Request.Context()
+	c.Header("Content-Type", "application/x-ndjson")
+	c.Status(http.StatusOK)
+	enc := json.NewEncoder(c.Writer)
+
+	listed := 0
+	var writeErr error
+	for pages := 0; ; pages++ {
+		if ctx.Err() != nil {
+			// The client went away; nobody is reading a trailer
+			return
+		}
+		if pages == maxDeadPages {
+			writeErr = enc.Encode(deadTrailer{NextCursor: cursor.String()})
+			break
+		}
+
+		matched := 0
+		next, whole, err := scanner.ScanJobPage(ctx, cursor.page, func(job *queue.Job) bool {
+			if job.Status != queue.StatusFailed || (errorCode != "" && job.ErrorCode != errorCode) {
+				return true
+			}
+			if matched++; matched <= cursor.skip {
+				return true
+			}
+			if listed == limit {
+				return false
+			}
+			listed++
+			writeErr = enc.Encode(deadRow{
+				JobID:     job.ID,
+				Owner:     job.Owner,
+				Model:     job.Model,
+				ErrorCode: job.ErrorCode,
+				Error:     job.Error,
+				Attempts:  job.Attempts,
+				CreatedAt: job.CreatedAt,
+				FailedAt:  job.UpdatedAt,
+			})
+			return writeErr == nil
+		})
+		if writeErr != nil {
+			return
+		}
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("Failed to list failed jobs: %v", err)
+				enc.Encode(deadTrailer{Error: "Failed to read jobs", NextCursor: cursor.String()})
+			}
+			return
+		}
+		c.Writer.Flush()
+
+		if !whole {
+			// The limit was reached within this page; resume after what was listed
+			cursor.skip = matched - 1
+			writeErr = enc.Encode(deadTrailer{NextCursor: cursor.String()})
+			break
+		}
+		if next == 0 {
+			writeErr = enc.Encode(deadTrailer{Complete: true})
+			break
+		}
+		cursor = deadCursor{page: next}
+	}
+	if writeErr == nil {
+		c.Writer.Flush()
+	}
+}
+
+// RequeueFailedJobs puts the jobs that failed at or after ?since, or every
+// failed job without it, back on their pending lists to be processed again
+// from their original inputs. Jobs whose input has been removed can't be,
+// and are listed in input_missing instead.
+func (h *Handler) RequeueFailedJobs(c *gin.Context) {
+	requeuer, ok := h.jobQueue.(failedRequeuer)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Queue backend does not support requeueing failed jobs"})
+		return
+	}
+	since, err := historyTime(c, "since", time.Time{})
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "since must be an RFC 3339 timestamp"})
+		return
+	}
+
+	missing := []string{}
+	requeued, err := requeuer.RequeueFailed(c.Request.Context(), since, func(job *queue.Job) bool {
+		// Storage errors other than a missing file count as present, as
+		// they do for results
+		_, err := h.fs.Stat(job.InputPath)
+		h.recordStorage(err)
+		if os.IsNotExist(err) {
+			missing = append(missing, job.ID)
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		log.Printf("Failed to requeue failed jobs after %d: %v", requeued, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to requeue failed jobs", "requeued": requeued, "input_missing": missing})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"requeued": requeued, "input_missing": missing})
+}
@@ -0,0 +1,128 @@
+package handlers
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"expvar"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// dedupedSubmissions counts uploads answered with an existing job instead
+// of a new one
+var dedupedSubmissions = expvar.NewInt("deduplicated_submissions")
+
+// uploadDedupeStore is implemented by queues that remember jobs by the
+// fingerprint of their upload
+type uploadDedupeStore interface {
+	RememberUpload(ctx context.Context, job *queue.Job) error
+	FindUpload(ctx context.Context, fingerprint string) (string, error)
+	ForgetUpload(ctx context.Context, fingerprint, jobID string) error
+}
+
+// uploadFingerprint identifies what a job would produce: its owner's upload
+// processed by the same model and post-processing. Jobs with deliveries or
+// a schedule have effects of their own and get none, so they're never
+// answered with another job.
+func uploadFingerprint(job *queue.Job) string {
+	if len(job.Deliveries) > 0 || job.ProcessAt != nil {
+		return ""
+	}
+	// Map keys are encoded sorted, so equal options encode equally. A job
+	// with other metadata is another job; none leaves the fingerprints of
+	// jobs submitted before metadata was as they were.
+	encoded, err := json.Marshal(struct {
+		Owner     string            `json:"owner"`
+		InputHash string            `json:"input_hash"`
+		Model     string            `json:"model"`
+		Options   map[string]string `json:"options"`
+		Pipeline  []string          `json:"pipeline"`
+		Metadata  map[string]string `json:"metadata,omitempty"`
+	}{job.Owner, job.InputHash, job.Model, job.Options, job.Pipeline, job.Metadata})
+	if err != nil {
+		return ""
+	}
+	sum := sha256.Sum256(encoded)
+	return hex.EncodeToString(sum[:])
+}
+
+// findDuplicate returns the job last submitted with the same fingerprint as
+// job, if it's still in flight or completed with its result stored, or nil.
+// A mapping to any other job is dropped.
+func (h *Handler) findDuplicate(ctx context.Context, store uploadDedupeStore, job *queue.Job) *queue.Job {
+	jobID, err := store.FindUpload(ctx, job.UploadFingerprint)
+	if err != nil {
+		log.Printf("Failed to look up duplicate uploads of job %s: %v", job.ID, err)
+		return nil
+	}
+	if jobID == "" {
+		return nil
+	}
+	existing, err := queue.NilIfNotFound(h.jobQueue.GetJob(ctx, jobID))
+	if err != nil {
+		log.Printf("Failed to read job %s to deduplicate against: %v", jobID, err)
+		return nil
+	}
+	if existing != nil && existing.UploadFingerprint == job.UploadFingerprint && h.reusable(existing) {
+		return existing
+	}
+	if err := store.ForgetUpload(ctx, job.UploadFingerprint, jobID); err != nil {
+		log.Printf("Failed to forget the upload of job %s: %v", jobID, err)
+	}
+	return nil
+}
+
+// reusable reports whether a job can answer a duplicate submission: it's
+// still to run or running, or it completed and its result is still stored
+func (h *Handler) reusable(job *queue.Job) bool {
+	switch job.Status {
+	case queue.StatusPending, queue.StatusProcessing, queue.StatusRetrying:
+		return true
+	case queue.StatusCompleted:
+		return !h.expired(job) && h.resultExists(job)
+	}
+	return false
+}
+
+// rememberUpload makes a queued job findable by its upload fingerprint
+func (h *Handler) rememberUpload(ctx context.Context, job *queue.Job) {
+	store, ok := h.jobQueue.(uploadDedupeStore)
+	if !ok || job.UploadFingerprint == "" {
+		return
+	}
+	if err := store.RememberUpload(ctx, job); err != nil {
+		log.Printf("Failed to remember the upload of job %s: %v", job.ID, err)
+	}
+}
+
+// forgetUpload stops answering submissions with a job whose result is gone
+func (h *Handler) forgetUpload(ctx context.Context, job *queue.Job) error {
+	store, ok := h.jobQueue.(uploadDedupeStore)
+	if !ok || job.UploadFingerprint == "" {
+		return nil
+	}
+	return store.ForgetUpload(ctx, job.UploadFingerprint, job.ID)
+}
+
+// answerDuplicate answers a submission with the existing job it duplicates
+func (h *Handler) answerDuplicate(c *gin.Context, job *queue.Job) {
+	dedupedSubmissions.Add(1)
+	response := gin.H{
+		"job_id":       job.ID,
+		"status":       string(job.Status),
+		"deduplicated": true,
+	}
+	if len(job.Warnings) > 0 {
+		response["warnings"] = job.Warnings
+	}
+	if h.previewAvailable(job) {
+		response["preview_url"] = previewURL(job.ID)
+	}
+	c.JSON(http.StatusAccepted, response)
+}
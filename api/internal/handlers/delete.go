@@ -0,0 +1,113 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// deletedJobs counts jobs purged by their owners before their retention ended
+var deletedJobs = expvar.NewInt("jobs_deleted")
+
+// jobRemover is implemented by queues that can delete a job only if it isn't
+// being processed, in the same transaction, and report the record deleted
+type jobRemover interface {
+	RemoveJob(ctx context.Context, jobID string, force bool) (*queue.Job, error)
+}
+
+// DeleteJob purges one of the caller's jobs at once: its record and queue
+// entries, then its input, result, and other files. A job being processed
+// is refused with 409 unless ?force=true, which also asks its worker to
+// stop; the worker finds the record gone and drops its result. Only the
+// job's authenticated owner or the admin key may delete it.
+func (h *Handler) DeleteJob(c *gin.Context) {
+	jobID := c.Param("id")
+	if h.rejectCaseVariant(c, jobID) || !h.requireCredentials(c) {
+		return
+	}
+	force := c.Query("force") == "true"
+
+	ctx := c.Request.Context()
+	job, err := queue.NilIfNotFound(h.jobQueue.GetJob(ctx, jobID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve job"})
+		return
+	}
+	// Another owner's job is reported as missing, not forbidden
+	if job == nil || h.expired(job) || !h.mayManage(c, job) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+
+	// The status is checked as the record is deleted where the queue can, so
+	// a job a worker claims or finishes meanwhile is handled as it then is
+	removed := job
+	if remover, ok := h.jobQueue.(jobRemover); ok {
+		removed, err = remover.RemoveJob(ctx, jobID, force)
+	} else if job.Status == queue.StatusProcessing && !force {
+		err = queue.ErrJobProcessing
+	} else {
+		err = h.jobQueue.DeleteJob(ctx, jobID)
+	}
+	switch {
+	case errors.Is(err, queue.ErrJobNotFound):
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	case errors.Is(err, queue.ErrJobProcessing):
+		c.JSON(http.StatusConflict, gin.H{"error": "Job is being processed; delete it with force=true to stop it", "job_id": jobID, "status": string(queue.StatusProcessing)})
+		return
+	case errors.Is(err, queue.ErrDeleteConflict):
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusConflict, gin.H{"error": "The job changed during the deletion, try again"})
+		return
+	case err != nil:
+		log.Printf("Failed to delete job %s: %v", jobID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to delete job"})
+		return
+	}
+
+	h.purgeJobFiles(ctx, removed)
+	deletedJobs.Add(1)
+	c.JSON(http.StatusOK, gin.H{"job_id": jobID, "deleted": true})
+}
+
+// purgeJobFiles removes what a deleted job's record pointed to: its index
+// entries, upload fingerprint, files, cached result and variants, and
+// idempotency key. Shared fanout inputs are only released. The record is
+// already gone, so failures are logged and nothing is retried.
+func (h *Handler) purgeJobFiles(ctx context.Context, job *queue.Job) {
+	if err := h.unindexJob(ctx, job); err != nil {
+		log.Printf("Failed to unindex deleted job %s: %v", job.ID, err)
+	}
+	if err := h.forgetUpload(ctx, job); err != nil {
+		log.Printf("Failed to forget the upload of deleted job %s: %v", job.ID, err)
+	}
+
+	if job.FanoutID != "" {
+		if store, ok := h.jobQueue.(fanoutStore); ok {
+			h.releaseInputs(ctx, store, []*queue.Job{job})
+		}
+	} else if err := h.removeFile(job.InputPath); err != nil {
+		log.Printf("Failed to remove input of deleted job %s: %v", job.ID, err)
+	}
+	if err := h.removeOutputs(job); err != nil {
+		log.Printf("Failed to remove outputs of deleted job %s: %v", job.ID, err)
+	}
+	if err := h.removeFile(job.OutputPath); err != nil {
+		log.Printf("Failed to remove result of deleted job %s: %v", job.ID, err)
+	}
+	h.removeVariants(ctx, job)
+	h.invalidateCachedResult(job.OutputPath)
+
+	if idempotency, ok := h.jobQueue.(idempotencyStore); ok && job.IdempotencyKey != "" {
+		if err := idempotency.ForgetIdempotencyKey(ctx, job.Owner, job.IdempotencyKey, job.ID); err != nil {
+			log.Printf("Failed to forget the idempotency key of deleted job %s: %v", job.ID, err)
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+func TestDeleteJobNeedsItsOwner(t *testing.T) {
+	h, jobs := newRedisTestHandler(t)
+	ctx := context.Background()
+	for _, job := range []*queue.Job{
+		{ID: "alice-job", Status: queue.StatusPending, Owner: "alice"},
+		{ID: "anonymous-job", Status: queue.StatusPending, Owner: "192.0.2.1"},
+	} {
+		if err := jobs.AddJob(ctx, job); err != nil {
+			t.Fatalf("AddJob: %v", err)
+		}
+	}
+	alice, bob := newTestAPIKey(t, jobs, "alice"), newTestAPIKey(t, jobs, "bob")
+
+	router := gin.New()
+	router.DELETE("/job/:id", h.Authenticate, h.DeleteJob)
+
+	for _, tc := range []struct {
+		name   string
+		jobID  string
+		secret string
+		want   int
+	}{
+		{"anonymous", "alice-job", "", http.StatusUnauthorized},
+		{"anonymous from the submitting IP", "anonymous-job", "", http.StatusUnauthorized},
+		{"another owner", "alice-job", bob, http.StatusNotFound},
+		{"an owner for a job submitted anonymously", "anonymous-job", bob, http.StatusNotFound},
+	} {
+		// Sent from the IP that owns the anonymous job
+		req := httptest.NewRequest(http.MethodDelete, "/job/"+tc.jobID, nil)
+		req.RemoteAddr = "192.0.2.1:41000"
+		if tc.secret != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.secret)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Errorf("%s: got %d, want %d: %s", tc.name, w.Code, tc.want, w.Body)
+		}
+		if _, err := jobs.GetJob(ctx, tc.jobID); err != nil {
+			t.Fatalf("%s: job deleted: %v", tc.name, err)
+		}
+	}
+
+	if w := serveAs(router, http.MethodDelete, "/job/alice-job", nil, alice); w.Code != http.StatusOK {
+		t.Fatalf("owner: got %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if w := serveTest(router, http.MethodDelete, "/job/anonymous-job", nil, testAdminKey); w.Code != http.StatusOK {
+		t.Fatalf("admin key: got %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	for _, jobID := range []string{"alice-job", "anonymous-job"} {
+		if _, err := jobs.GetJob(ctx, jobID); !errors.Is(err, queue.ErrJobNotFound) {
+			t.Fatalf("GetJob(%s) after the delete = %v, want ErrJobNotFound", jobID, err)
+		}
+	}
+}
+
+func TestDeleteJobRacingWorkerCompletion(t *testing.T) {
+	h, jobs := newRedisTestHandler(t)
+	ctx := context.Background()
+	alice := newTestAPIKey(t, jobs, "alice")
+	router := gin.New()
+	router.DELETE("/job/:id", h.Authenticate, h.DeleteJob)
+
+	const rounds = 20
+	for round := 0; round < rounds; round++ {
+		jobID := fmt.Sprintf("job-%d", round)
+		input := filepath.Join(h.uploadDir, jobID+".png")
+		output := filepath.Join(h.resultsDir, jobID+".png")
+		if err := os.WriteFile(input, []byte("input"), 0644); err != nil {
+			t.Fatalf("writing the input: %v", err)
+		}
+		if err := jobs.AddJob(ctx, &queue.Job{ID: jobID, Owner: "alice", InputPath: input}); err != nil {
+			t.Fatalf("AddJob: %v", err)
+		}
+		if err := jobs.TransitionJob(ctx, jobID, queue.StatusPending, queue.StatusProcessing, nil); err != nil {
+			t.Fatalf("TransitionJob to processing: %v", err)
+		}
+
+		var (
+			wg        sync.WaitGroup
+			code      int
+			workerErr error
+		)
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			code = serveAs(router, http.MethodDelete, "/job/"+jobID+"?force=true", nil, alice).Code
+		}()
+		go func() {
+			defer wg.Done()
+			// The worker finishes later each round, so early rounds see it
+			// win and later ones see the delete win. It writes its result,
+			// then records it on the job, dropping the result if the job
+			// was deleted meanwhile.
+			time.Sleep(time.Duration(round) * 20 * time.Microsecond)
+			if workerErr = os.WriteFile(output, []byte("result"), 0644); workerErr != nil {
+				return
+			}
+			workerErr = jobs.TransitionJob(ctx, jobID, queue.StatusProcessing, queue.StatusCompleted, func(job *queue.Job) {
+				job.OutputPath = output
+			})
+			if workerErr != nil {
+				os.Remove(output)
+			}
+		}()
+		wg.Wait()
+
+		if code != http.StatusOK {
+			t.Fatalf("round %d: delete got %d, want %d whichever finished first", round, code, http.StatusOK)
+		}
+		if workerErr != nil && !errors.Is(workerErr, queue.ErrJobNotFound) {
+			t.Fatalf("round %d: worker completing a deleted job failed with %v, want ErrJobNotFound", round, workerErr)
+		}
+		if _, err := jobs.GetJob(ctx, jobID); !errors.Is(err, queue.ErrJobNotFound) {
+			t.Fatalf("round %d: GetJob after the race = %v, want ErrJobNotFound", round, err)
+		}
+		for _, status := range []queue.JobStatus{queue.StatusProcessing, queue.StatusCompleted} {
+			listed, _, err := jobs.ListJobs(ctx, status, 0, 100)
+			if err != nil {
+				t.Fatalf("ListJobs: %v", err)
+			}
+			for _, job := range listed {
+				if job.ID == jobID {
+					t.Fatalf("round %d: deleted job still listed as %s", round, status)
+				}
+			}
+		}
+		for _, path := range []string{input, output} {
+			if _, err := os.Stat(path); !os.IsNotExist(err) {
+				t.Fatalf("round %d: %s left behind after the delete (worker error %v)", round, filepath.Base(filepath.Dir(path)), workerErr)
+			}
+		}
+	}
+}
@@ -0,0 +1,94 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/delivery"
+	"rembg-v2/api/internal/queue"
+)
+
+// parseDeliveries reads the optional JSON list of result destinations from
+// the submission form, e.g. [{"type":"webhook","url":"https://..."}]
+func (h *Handler) parseDeliveries(c *gin.Context) ([]queue.Delivery, error) {
+	value := c.PostForm("deliveries")
+	if value == "" {
+		return nil, nil
+	}
+	return h.decodeDeliveries(c.Request.Context(), value)
+}
+
+// decodeDeliveries validates a JSON array of {type, url} destinations. URLs
+// must be https and resolve to public addresses only.
+func (h *Handler) decodeDeliveries(ctx context.Context, value string) ([]queue.Delivery, error) {
+	var requested []struct {
+		Type string `json:"type"`
+		URL  string `json:"url"`
+	}
+	if err := json.Unmarshal([]byte(value), &requested); err != nil {
+		return nil, fmt.Errorf("deliveries must be a JSON array of {type, url} objects")
+	}
+	if len(requested) > h.maxDeliveries {
+		return nil, fmt.Errorf("at most %d deliveries are allowed per job", h.maxDeliveries)
+	}
+
+	deliveries := make([]queue.Delivery, 0, len(requested))
+	for _, r := range requested {
+		switch r.Type {
+		case queue.DeliveryPresignedPut, queue.DeliveryWebhook:
+		case "s3":
+			return nil, fmt.Errorf("s3 deliveries are not supported, use a presigned_put URL")
+		default:
+			return nil, fmt.Errorf("unknown delivery type %q", r.Type)
+		}
+
+		if err := delivery.ValidateURL(ctx, r.URL); err != nil {
+			return nil, err
+		}
+
+		deliveries = append(deliveries, queue.Delivery{
+			Type:   r.Type,
+			URL:    r.URL,
+			Status: queue.DeliveryPending,
+		})
+	}
+	return deliveries, nil
+}
+
+// deliveryStatuses describes a job's deliveries without their query
+// strings, which may carry presigned signatures
+func deliveryStatuses(deliveries []queue.Delivery) []gin.H {
+	statuses := make([]gin.H, 0, len(deliveries))
+	for _, d := range deliveries {
+		status := gin.H{
+			"type":     d.Type,
+			"url":      redactQuery(d.URL),
+			"status":   string(d.Status),
+			"attempts": d.Attempts,
+		}
+		if d.LastError != "" {
+			status["error"] = d.LastError
+		}
+		if d.DeliveredAt != nil {
+			status["delivered_at"] = d.DeliveredAt.Format(time.RFC3339)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses
+}
+
+// redactQuery strips the query string and credentials from a URL
+func redactQuery(raw string) string {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return ""
+	}
+	u.RawQuery = ""
+	u.User = nil
+	return u.String()
+}
@@ -0,0 +1,35 @@
+package handlers
+
+import (
+	"context"
+	"strings"
+	"testing"
+)
+
+func TestDecodeDeliveriesRejectsInternalDestinations(t *testing.T) {
+	h, _ := newRedisTestHandler(t)
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name, value, want string
+	}{
+		{"plain http", `[{"type":"webhook","url":"http://93.184.216.34/hook"}]`, "https"},
+		{"loopback", `[{"type":"webhook","url":"https://127.0.0.1:8080/admin"}]`, "not a public address"},
+		{"localhost", `[{"type":"webhook","url":"https://localhost/hook"}]`, "non-public address"},
+		{"private", `[{"type":"presigned_put","url":"https://10.0.0.5/key"}]`, "not a public address"},
+		{"metadata", `[{"type":"webhook","url":"https://169.254.169.254/latest/meta-data"}]`, "not a public address"},
+		{"unspecified", `[{"type":"webhook","url":"https://[::]/hook"}]`, "not a public address"},
+		{"s3", `[{"type":"s3","url":"s3://bucket/key"}]`, "presigned_put"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := h.decodeDeliveries(ctx, tc.value)
+			if err == nil || !strings.Contains(err.Error(), tc.want) {
+				t.Errorf("decodeDeliveries = %v, want an error mentioning %q", err, tc.want)
+			}
+		})
+	}
+
+	deliveries, err := h.decodeDeliveries(ctx, `[{"type":"webhook","url":"https://93.184.216.34/hook"}]`)
+	if err != nil || len(deliveries) != 1 {
+		t.Fatalf("decodeDeliveries of a public https URL = %v, %v", deliveries, err)
+	}
+}
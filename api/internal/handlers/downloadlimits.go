@@ -0,0 +1,115 @@
+package handlers
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// maxTopDownloads caps how many jobs the top downloads report lists
+const maxTopDownloads = 100
+
+// downloadsLimited counts downloads rejected by a job's download limits, and
+// downloads let through because the limits couldn't be checked
+var downloadsLimited = expvar.NewMap("downloads_limited")
+
+// downloadLimiter is implemented by queues that can count downloads per job
+type downloadLimiter interface {
+	BeginDownload(ctx context.Context, jobID string, defaults queue.DownloadLimits) (bool, func(), error)
+	SetDownloadLimits(ctx context.Context, jobID string, limits queue.DownloadLimits) error
+	TopDownloads(ctx context.Context, n int64) ([]queue.JobDownloads, error)
+}
+
+// beginDownload checks the job's download limits, writing a 429 response if
+// they are exceeded. When Redis is unavailable the download is allowed, so a
+// blip never blocks legitimate downloads. Call release when the download ends.
+func (h *Handler) beginDownload(c *gin.Context, job *queue.Job) (func(), bool) {
+	limiter, ok := h.jobQueue.(downloadLimiter)
+	if !ok {
+		return func() {}, true
+	}
+
+	allowed, release, err := limiter.BeginDownload(c.Request.Context(), job.ID, h.downloadLimits)
+	if err != nil {
+		downloadsLimited.Add("fail_open", 1)
+		log.Printf("Failed to check download limits for job %s, allowing download: %v", job.ID, err)
+		return func() {}, true
+	}
+	if !allowed {
+		downloadsLimited.Add("rejected", 1)
+		c.Header("Retry-After", "60")
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Download limit exceeded for this result"})
+		return nil, false
+	}
+	return release, true
+}
+
+// SetDownloadLimits lets a job's authenticated owner, or the admin key,
+// raise or lower its download limits
+func (h *Handler) SetDownloadLimits(c *gin.Context) {
+	limiter, ok := h.jobQueue.(downloadLimiter)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Download limits are not supported"})
+		return
+	}
+	if !h.requireCredentials(c) {
+		return
+	}
+
+	var limits queue.DownloadLimits
+	if err := c.ShouldBindJSON(&limits); err != nil || limits.Concurrent < 0 || limits.Daily < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Body must be {\"concurrent\": n, \"daily\": n} with non-negative limits, 0 for unlimited"})
+		return
+	}
+
+	if h.rejectCaseVariant(c, c.Param("id")) {
+		return
+	}
+	job, err := queue.NilIfNotFound(h.jobQueue.GetJob(c.Request.Context(), c.Param("id")))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve job"})
+		return
+	}
+	if job == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	if !h.mayManage(c, job) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Only the job's owner can change its download limits"})
+		return
+	}
+
+	if err := limiter.SetDownloadLimits(c.Request.Context(), job.ID, limits); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to set download limits"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"job_id": job.ID, "download_limits": limits})
+}
+
+// TopDownloads lists the jobs with the most download attempts today, to spot hotlinking
+func (h *Handler) TopDownloads(c *gin.Context) {
+	limiter, ok := h.jobQueue.(downloadLimiter)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Download counting is not supported"})
+		return
+	}
+
+	n, err := strconv.ParseInt(c.DefaultQuery("n", "10"), 10, 64)
+	if err != nil || n <= 0 || n > maxTopDownloads {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "n must be between 1 and 100"})
+		return
+	}
+
+	top, err := limiter.TopDownloads(c.Request.Context(), n)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve top downloads"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"jobs": top})
+}
@@ -0,0 +1,66 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+func TestSetDownloadLimitsNeedsTheJobsOwner(t *testing.T) {
+	h, jobs := newRedisTestHandler(t)
+	ctx := context.Background()
+	for _, job := range []*queue.Job{
+		{ID: "alice-job", Status: queue.StatusCompleted, Owner: "alice"},
+		{ID: "anonymous-job", Status: queue.StatusCompleted, Owner: "192.0.2.1"},
+	} {
+		if err := jobs.AddJob(ctx, job); err != nil {
+			t.Fatalf("AddJob: %v", err)
+		}
+	}
+	alice, bob := newTestAPIKey(t, jobs, "alice"), newTestAPIKey(t, jobs, "bob")
+
+	router := gin.New()
+	router.POST("/download/:id/limits", h.Authenticate, h.SetDownloadLimits)
+	const oneDownload = `{"concurrent": 1, "daily": 1}`
+
+	for _, tc := range []struct {
+		name   string
+		jobID  string
+		secret string
+		want   int
+	}{
+		{"anonymous", "alice-job", "", http.StatusUnauthorized},
+		{"anonymous for a job submitted anonymously", "anonymous-job", "", http.StatusUnauthorized},
+		{"another owner", "alice-job", bob, http.StatusForbidden},
+		{"an owner for a job submitted anonymously", "anonymous-job", bob, http.StatusForbidden},
+	} {
+		if w := serveAs(router, http.MethodPost, "/download/"+tc.jobID+"/limits", strings.NewReader(oneDownload), tc.secret); w.Code != tc.want {
+			t.Errorf("%s: got %d, want %d: %s", tc.name, w.Code, tc.want, w.Body)
+		}
+	}
+	// Unchanged limits leave downloads unlimited
+	for _, jobID := range []string{"alice-job", "anonymous-job"} {
+		for i := 0; i < 2; i++ {
+			if allowed, _, err := jobs.BeginDownload(ctx, jobID, queue.DownloadLimits{}); err != nil || !allowed {
+				t.Fatalf("download %d of %s = %v, %v, want allowed with its limits unchanged", i+1, jobID, allowed, err)
+			}
+		}
+	}
+
+	if w := serveAs(router, http.MethodPost, "/download/alice-job/limits", strings.NewReader(oneDownload), alice); w.Code != http.StatusOK {
+		t.Fatalf("owner: got %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	if w := serveTest(router, http.MethodPost, "/download/anonymous-job/limits", strings.NewReader(oneDownload), testAdminKey); w.Code != http.StatusOK {
+		t.Fatalf("admin key: got %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	for _, jobID := range []string{"alice-job", "anonymous-job"} {
+		if allowed, _, err := jobs.BeginDownload(ctx, jobID, queue.DownloadLimits{}); err != nil || allowed {
+			t.Fatalf("download of %s past its new daily limit = %v, %v, want refused", jobID, allowed, err)
+		}
+	}
+}
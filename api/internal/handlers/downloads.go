@@ -0,0 +1,172 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// Download modes selectable per deployment with DOWNLOAD_MODE
+const (
+	// DownloadModeDirect serves results at /api/download/:id
+	DownloadModeDirect = "direct"
+	// DownloadModeToken serves results only through single-use tokens
+	DownloadModeToken = "token"
+	// DownloadModeBoth enables both flows
+	DownloadModeBoth = "both"
+)
+
+// downloadTokenTTL is how long a download token stays redeemable
+const downloadTokenTTL = 5 * time.Minute
+
+// downloadTokenStore is implemented by queues that can issue download tokens
+type downloadTokenStore interface {
+	CreateDownloadToken(ctx context.Context, jobID string, ttl time.Duration) (string, error)
+	RedeemDownloadToken(ctx context.Context, token string) (string, error)
+}
+
+// directDownloads reports whether results can be downloaded by job ID
+func (h *Handler) directDownloads() bool {
+	return h.downloadMode != DownloadModeToken
+}
+
+// tokenDownloads reports whether results can be downloaded with a token
+func (h *Handler) tokenDownloads() bool {
+	if _, ok := h.jobQueue.(downloadTokenStore); !ok {
+		return false
+	}
+	return h.downloadMode == DownloadModeToken || h.downloadMode == DownloadModeBoth
+}
+
+// CreateDownloadToken issues a single-use token for downloading a job's result
+func (h *Handler) CreateDownloadToken(c *gin.Context) {
+	if !h.tokenDownloads() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token downloads are disabled"})
+		return
+	}
+
+	job, ok := h.downloadableJob(c, c.Param("id"))
+	if !ok {
+		return
+	}
+
+	token, err := h.jobQueue.(downloadTokenStore).CreateDownloadToken(c.Request.Context(), job.ID, downloadTokenTTL)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to create download token"})
+		return
+	}
+
+	c.JSON(http.StatusCreated, gin.H{
+		"download_url": fmt.Sprintf("/api/download/by-token/%s", token),
+		"expires_at":   h.clock.Now().Add(downloadTokenTTL).Format(time.RFC3339),
+	})
+}
+
+// DownloadByToken redeems a single-use token and serves the job's result
+func (h *Handler) DownloadByToken(c *gin.Context) {
+	if !h.tokenDownloads() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Token downloads are disabled"})
+		return
+	}
+
+	jobID, err := h.jobQueue.(downloadTokenStore).RedeemDownloadToken(c.Request.Context(), c.Param("token"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to redeem download token"})
+		return
+	}
+	if jobID == "" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Download token is invalid, expired, or already used"})
+		return
+	}
+
+	job, ok := h.downloadableJob(c, jobID)
+	if !ok {
+		return
+	}
+	h.serveResult(c, job)
+}
+
+// downloadableJob loads a completed job with a result, writing an error response if not
+func (h *Handler) downloadableJob(c *gin.Context, jobID string) (*queue.Job, bool) {
+	if jobID == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Job ID is required"})
+		return nil, false
+	}
+	if h.rejectCaseVariant(c, jobID) {
+		return nil, false
+	}
+
+	job, err := h.jobQueue.GetJob(c.Request.Context(), jobID)
+	if err != nil && !errors.Is(err, queue.ErrJobNotFound) {
+		jobLookupFailed(c)
+		return nil, false
+	}
+
+	if queue.JobMissing(job, err) || job.Status != queue.StatusCompleted || job.OutputPath == "" || h.expired(job) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Result not available"})
+		return nil, false
+	}
+	if !h.storageAvailable(c) {
+		return nil, false
+	}
+
+	// The queue says completed but the file is gone
+	if !h.resultExists(job) {
+		h.handleMissingResult(c.Request.Context(), job)
+		c.JSON(http.StatusNotFound, gin.H{"error": "Result not available", "error_code": queue.ErrorCodeResultMissing})
+		return nil, false
+	}
+
+	return job, true
+}
+
+// serveResult writes the job's output file, in the format negotiated from
+// the Accept header and described by that format whatever the file is
+// named, within the job's download limits, keeping the URL out of Referer
+// headers
+func (h *Handler) serveResult(c *gin.Context, job *queue.Job) {
+	release, ok := h.beginDownload(c, job)
+	if !ok {
+		return
+	}
+	defer release()
+
+	c.Header("Referrer-Policy", "no-referrer")
+	c.Header("Vary", "Accept")
+	path, format := h.negotiatedResult(c.Request.Context(), job, c.GetHeader("Accept"))
+	setResultHeaders(c, job, format)
+	if h.resultCache != nil && h.serveCachedResult(c, path) {
+		return
+	}
+	if !h.serveFile(c, path) {
+		h.handleMissingResult(c.Request.Context(), job)
+		c.Writer.Header().Del("Content-Disposition")
+		c.Header("Content-Type", "application/json; charset=utf-8")
+		c.JSON(http.StatusNotFound, gin.H{"error": "Result not available", "error_code": queue.ErrorCodeResultMissing})
+	}
+}
+
+// serveFile writes the file at path read through the handler's FS,
+// answering range and conditional requests, and returns false without
+// writing anything if it can't be opened
+func (h *Handler) serveFile(c *gin.Context, path string) bool {
+	f, err := h.fs.Open(path)
+	h.recordStorage(err)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return false
+	}
+	http.ServeContent(c.Writer, c.Request, filepath.Base(path), info.ModTime(), f)
+	return true
+}
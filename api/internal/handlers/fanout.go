@@ -0,0 +1,339 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// fanoutStore is implemented by queues that can share one input between jobs
+type fanoutStore interface {
+	RetainInput(ctx context.Context, inputPath string, jobIDs []string) error
+	ReleaseInput(ctx context.Context, inputPath, jobID string) (int64, error)
+	AddFanout(ctx context.Context, fanout *queue.Fanout) error
+	GetFanout(ctx context.Context, id string) (*queue.Fanout, error)
+	ReconcileInputs(ctx context.Context) ([]string, error)
+}
+
+// parseOptionSets reads the fanout's JSON array of option sets, each an
+// object of the post-processing form fields, e.g. [{"format":"webp"},{"background":"#ffffff"}]
+func (h *Handler) parseOptionSets(c *gin.Context) ([]map[string]string, [][]string, error) {
+	var sets []map[string]interface{}
+	if err := json.Unmarshal([]byte(c.PostForm("option_sets")), &sets); err != nil {
+		return nil, nil, fmt.Errorf("option_sets must be a JSON array of option objects")
+	}
+	if len(sets) == 0 || len(sets) > h.maxFanout {
+		return nil, nil, fmt.Errorf("option_sets must have between 1 and %d entries", h.maxFanout)
+	}
+
+	options := make([]map[string]string, len(sets))
+	pipelines := make([][]string, len(sets))
+	for i, set := range sets {
+		var err error
+		options[i], pipelines[i], err = parseOptionSet(func(name string) string {
+			switch value := set[name].(type) {
+			case string:
+				return value
+			case bool:
+				return strconv.FormatBool(value)
+			case float64:
+				return strconv.FormatFloat(value, 'f', -1, 64)
+			case nil:
+				return ""
+			default:
+				encoded, _ := json.Marshal(value)
+				return string(encoded)
+			}
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("option_sets[%d]: %v", i, err)
+		}
+	}
+	return options, pipelines, nil
+}
+
+// ProcessFanout handles one upload processed with several option sets.
+// The input is stored once and shared by the jobs, which track it with a
+// reference count so it outlives every one of them.
+func (h *Handler) ProcessFanout(c *gin.Context) {
+	store, ok := h.jobQueue.(fanoutStore)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Fanout processing is not supported"})
+		return
+	}
+	if !h.storageAvailable(c) {
+		return
+	}
+	if !h.admitPending(c) {
+		return
+	}
+	slot, ok := h.beginUpload(c)
+	if !ok {
+		return
+	}
+	defer slot.finish()
+
+	file, err := c.FormFile("image")
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "No image provided"})
+		return
+	}
+	optionSets, pipelines, err := h.parseOptionSets(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	deliveries, err := h.parseDeliveries(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	metadata, err := parseMetadata(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	model, ok := h.parseModel(c)
+	if !ok {
+		return
+	}
+	priority, ok := parsePriority(c)
+	if !ok {
+		return
+	}
+	retention, lifetime, ok := h.jobLifecycle(c, deliveries)
+	if !ok {
+		return
+	}
+	if !h.submissionsOpen(c) {
+		return
+	}
+	tier := callerTier(c)
+	if !h.admitSubmission(c, tier, len(optionSets)) {
+		return
+	}
+
+	fanoutID, err := generateID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate job ID"})
+		return
+	}
+	inputFormat := sniffUpload(file)
+	uploadPath := filepath.Join(h.uploadDir, fanoutID+inputExt(inputFormat, file.Filename))
+	inputHash, err := h.saveUpload(c, slot, file, uploadPath)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save the uploaded file"})
+		return
+	}
+	warnings := inspectUpload(h.fs, uploadPath)
+
+	fanout := &queue.Fanout{ID: fanoutID, InputPath: uploadPath}
+	jobs := make([]*queue.Job, len(optionSets))
+	for i := range optionSets {
+		jobID, err := generateID()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate job ID"})
+			return
+		}
+		jobs[i] = &queue.Job{
+			ID:          jobID,
+			Status:      queue.StatusPending,
+			InputPath:   uploadPath,
+			Filename:    file.Filename,
+			InputBytes:  file.Size,
+			InputHash:   inputHash,
+			Owner:       ownerID(c),
+			Tier:        tier,
+			Options:     optionSets[i],
+			Pipeline:    pipelines[i],
+			Deliveries:  append([]queue.Delivery(nil), deliveries...),
+			Metadata:    metadata,
+			Model:       model,
+			Priority:    priority,
+			FanoutID:    fanoutID,
+			InputFormat: inputFormat,
+		}
+		jobRetention := *retention
+		jobs[i].Retention = &jobRetention
+		jobs[i].MaxLifetimeSeconds = lifetime
+		jobs[i].MaxAttempts = h.maxAttempts
+		jobs[i].OptionsVersion = jobs[i].RequiredOptionsVersion()
+		for _, w := range warnings {
+			jobs[i].AddWarning(w)
+		}
+		fanout.JobIDs = append(fanout.JobIDs, jobID)
+	}
+
+	// Charge every job, returning earlier charges if a later one is denied
+	if h.quotasEnabled() {
+		for i, job := range jobs {
+			if !h.reserveQuota(c, job) {
+				h.failJobs(c.Request.Context(), jobs[:i])
+				return
+			}
+		}
+	}
+
+	// Reference the input before any job can be picked up
+	if err := store.RetainInput(c.Request.Context(), uploadPath, fanout.JobIDs); err != nil {
+		h.failJobs(c.Request.Context(), jobs)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to reference the uploaded file"})
+		return
+	}
+	// From here the reference count decides when the input is removed
+	slot.keep()
+	if err := store.AddFanout(c.Request.Context(), fanout); err != nil {
+		h.failJobs(c.Request.Context(), jobs)
+		h.releaseInputs(c.Request.Context(), store, jobs)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add job to queue"})
+		return
+	}
+	h.rememberJobs(c.Request.Context(), fanout.JobIDs...)
+	for i, job := range jobs {
+		if err := h.jobQueue.AddJob(c.Request.Context(), job); err != nil {
+			// Jobs already queued keep their references and run; drop the rest
+			for _, id := range fanout.JobIDs[i:] {
+				h.forgetJob(c.Request.Context(), id)
+			}
+			h.failJobs(c.Request.Context(), jobs[i:])
+			h.releaseInputs(c.Request.Context(), store, jobs[i:])
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add job to queue", "fanout_id": fanoutID, "job_ids": fanout.JobIDs[:i]})
+			return
+		}
+		h.indexJob(c.Request.Context(), job)
+	}
+	tierSubmissions.Add(tier, int64(len(jobs)))
+
+	response := gin.H{
+		"fanout_id": fanoutID,
+		"job_ids":   fanout.JobIDs,
+		"status":    string(queue.StatusPending),
+	}
+	if len(jobs[0].Warnings) > 0 {
+		response["warnings"] = jobs[0].Warnings
+	}
+	c.JSON(http.StatusAccepted, response)
+}
+
+// failJobs refunds the quota charged to jobs that won't be queued
+func (h *Handler) failJobs(ctx context.Context, jobs []*queue.Job) {
+	for _, job := range jobs {
+		if job.QuotaDay == "" {
+			continue
+		}
+		job.Status = queue.StatusFailed
+		h.refundQuota(ctx, job)
+	}
+}
+
+// releaseInputs drops the jobs' references to their shared input, removing
+// the file once nothing references it
+func (h *Handler) releaseInputs(ctx context.Context, store fanoutStore, jobs []*queue.Job) {
+	for _, job := range jobs {
+		remaining, err := store.ReleaseInput(ctx, job.InputPath, job.ID)
+		if err != nil {
+			// Reconciliation releases it later
+			log.Printf("Failed to release input of job %s: %v", job.ID, err)
+			continue
+		}
+		if remaining == 0 {
+			h.fs.Remove(job.InputPath)
+		}
+	}
+}
+
+// GetFanout reports the status of every job in a fanout and their aggregate status
+func (h *Handler) GetFanout(c *gin.Context) {
+	store, ok := h.jobQueue.(fanoutStore)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Fanout processing is not supported"})
+		return
+	}
+
+	fanout, err := store.GetFanout(c.Request.Context(), c.Param("id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve fanout"})
+		return
+	}
+	if fanout == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Fanout not found"})
+		return
+	}
+
+	counts := make(map[string]int)
+	jobs := make([]gin.H, 0, len(fanout.JobIDs))
+	for _, id := range fanout.JobIDs {
+		job, err := queue.NilIfNotFound(h.jobQueue.GetJob(c.Request.Context(), id))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve job"})
+			return
+		}
+		entry := gin.H{"job_id": id}
+		if job == nil {
+			entry["status"] = "expired"
+		} else {
+			entry["status"] = string(job.Status)
+			entry["options"] = job.Options
+			if job.ErrorCode != "" {
+				entry["error_code"] = job.ErrorCode
+			}
+		}
+		counts[entry["status"].(string)]++
+		jobs = append(jobs, entry)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"fanout_id": fanout.ID,
+		"status":    fanoutStatus(counts, len(fanout.JobIDs)),
+		"counts":    counts,
+		"jobs":      jobs,
+	})
+}
+
+// fanoutStatus aggregates job statuses: completed, failed, or cancelled
+// when every job ended that way, partial when they ended mixed, and otherwise processing
+// once any job has started
+func fanoutStatus(counts map[string]int, total int) string {
+	switch {
+	case counts[string(queue.StatusCompleted)] == total:
+		return string(queue.StatusCompleted)
+	case counts[string(queue.StatusFailed)] == total:
+		return string(queue.StatusFailed)
+	case counts[string(queue.StatusCancelled)] == total:
+		return string(queue.StatusCancelled)
+	case counts[string(queue.StatusPending)]+counts[string(queue.StatusProcessing)]+counts[string(queue.StatusRetrying)] == 0:
+		return "partial"
+	case counts[string(queue.StatusPending)] == total:
+		return string(queue.StatusPending)
+	}
+	return string(queue.StatusProcessing)
+}
+
+// ReapSharedInputs releases shared-input references of jobs that have
+// expired and removes inputs no job references any more
+func (h *Handler) ReapSharedInputs(ctx context.Context) {
+	store, ok := h.jobQueue.(fanoutStore)
+	if !ok {
+		return
+	}
+
+	freed, err := store.ReconcileInputs(ctx)
+	if err != nil {
+		log.Printf("Failed to reconcile shared inputs: %v", err)
+	}
+	for _, path := range freed {
+		if err := h.fs.Remove(path); err != nil && !os.IsNotExist(err) {
+			h.recordStorage(err)
+			log.Printf("Failed to remove shared input %q: %v", path, err)
+		}
+	}
+}
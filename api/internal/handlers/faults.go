@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/fault"
+)
+
+// faultSyncInterval is how often replicas pick up fault rules set elsewhere
+const faultSyncInterval = 5 * time.Second
+
+// faultStore is implemented by queues that share fault injection rules
+type faultStore interface {
+	SetFaultRule(ctx context.Context, rule fault.Rule) error
+	ClearFaultRule(ctx context.Context, point string) error
+	FaultRules(ctx context.Context) ([]fault.Rule, error)
+}
+
+// faultAdmin returns the rule store, writing a 404 unless fault injection
+// is enabled and supported, and a 403 unless RequireAdmin admitted the
+// request, wherever the fault routes are mounted
+func (h *Handler) faultAdmin(c *gin.Context) (faultStore, bool) {
+	if !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Fault injection needs the admin key"})
+		return nil, false
+	}
+	store, ok := h.jobQueue.(faultStore)
+	if !fault.Enabled() || !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Fault injection is disabled"})
+		return nil, false
+	}
+	return store, true
+}
+
+// syncFaults loads the shared rules into this replica
+func (h *Handler) syncFaults(ctx context.Context, store faultStore) error {
+	rules, err := store.FaultRules(ctx)
+	if err != nil {
+		return err
+	}
+	fault.SetRules(rules)
+	return nil
+}
+
+// WatchFaults keeps this replica's fault rules in sync with Redis until ctx is done
+func (h *Handler) WatchFaults(ctx context.Context) {
+	store, ok := h.jobQueue.(faultStore)
+	if !fault.Enabled() || !ok {
+		return
+	}
+
+	ticker := time.NewTicker(faultSyncInterval)
+	defer ticker.Stop()
+	for {
+		if err := h.syncFaults(ctx, store); err != nil && ctx.Err() == nil {
+			log.Printf("Failed to sync fault rules: %v", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// ListFaults reports the active fault rules and the known injection points
+func (h *Handler) ListFaults(c *gin.Context) {
+	if _, ok := h.faultAdmin(c); !ok {
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"rules": fault.Rules(), "points": fault.Points})
+}
+
+// SetFault stores a fault rule, e.g.
+// {"point": "storage.save", "probability": 0.5, "fail": true, "match": {"owner": "10.0.0.7"}}
+func (h *Handler) SetFault(c *gin.Context) {
+	store, ok := h.faultAdmin(c)
+	if !ok {
+		return
+	}
+
+	var rule fault.Rule
+	if err := c.ShouldBindJSON(&rule); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid fault rule"})
+		return
+	}
+	if err := rule.Validate(); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := store.SetFaultRule(c.Request.Context(), rule); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store fault rule"})
+		return
+	}
+	log.Printf("Fault injection rule set: %+v", rule)
+	h.syncFaults(c.Request.Context(), store)
+	c.JSON(http.StatusOK, gin.H{"rules": fault.Rules()})
+}
+
+// ClearFault removes the fault rule of a point
+func (h *Handler) ClearFault(c *gin.Context) {
+	store, ok := h.faultAdmin(c)
+	if !ok {
+		return
+	}
+
+	if err := store.ClearFaultRule(c.Request.Context(), c.Param("point")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to clear fault rule"})
+		return
+	}
+	log.Printf("Fault injection rule cleared: %s", c.Param("point"))
+	h.syncFaults(c.Request.Context(), store)
+	c.JSON(http.StatusOK, gin.H{"rules": fault.Rules()})
+}
@@ -0,0 +1,57 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/fault"
+)
+
+func TestFaultRulesNeedAdmin(t *testing.T) {
+	fault.Enable()
+	t.Cleanup(func() { fault.SetRules(nil) })
+	h, jobs := newRedisTestHandler(t)
+	ctx := context.Background()
+
+	router := gin.New()
+	router.POST("/open/faults", h.SetFault)
+	admin := router.Group("/admin", h.RequireAdmin)
+	admin.GET("/faults", h.ListFaults)
+	admin.POST("/faults", h.SetFault)
+	admin.DELETE("/faults/:point", h.ClearFault)
+
+	rule := `{"point": "storage.save", "probability": 1, "fail": true}`
+	for _, tc := range []struct {
+		name     string
+		method   string
+		path     string
+		adminKey string
+		want     int
+	}{
+		{"set outside the admin group", http.MethodPost, "/open/faults", testAdminKey, http.StatusForbidden},
+		{"set without the key", http.MethodPost, "/admin/faults", "", http.StatusUnauthorized},
+		{"set with a wrong key", http.MethodPost, "/admin/faults", "guess", http.StatusUnauthorized},
+		{"list without the key", http.MethodGet, "/admin/faults", "", http.StatusUnauthorized},
+	} {
+		if w := serveTest(router, tc.method, tc.path, strings.NewReader(rule), tc.adminKey); w.Code != tc.want {
+			t.Errorf("%s: got %d, want %d: %s", tc.name, w.Code, tc.want, w.Body)
+		}
+	}
+	if rules, err := jobs.FaultRules(ctx); err != nil || len(rules) != 0 {
+		t.Fatalf("rules after rejected requests: %v, %v", rules, err)
+	}
+
+	if w := serveTest(router, http.MethodPost, "/admin/faults", strings.NewReader(rule), testAdminKey); w.Code != http.StatusOK {
+		t.Fatalf("set with the admin key: got %d: %s", w.Code, w.Body)
+	}
+	if w := serveTest(router, http.MethodDelete, "/admin/faults/storage.save", nil, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("clear without the key: got %d", w.Code)
+	}
+	if rules, err := jobs.FaultRules(ctx); err != nil || len(rules) != 1 {
+		t.Fatalf("rules after the admin set and a rejected clear: %v, %v", rules, err)
+	}
+}
@@ -0,0 +1,274 @@
+package handlers
+
+import (
+	"context"
+	"expvar"
+	"image"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"path/filepath"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/archive"
+	"rembg-v2/api/internal/queue"
+)
+
+// formatRepairBatch is how many jobs one repair request changes at most
+const formatRepairBatch = 500
+
+// formatRepairs counts jobs whose formats were recorded or files moved by
+// the repair pass, and those it had to skip
+var formatRepairs = expvar.NewMap("format_repairs")
+
+// formatRepairStore is implemented by queues whose stored jobs can be
+// scanned and their file formats repaired
+type formatRepairStore interface {
+	ScanJobs(ctx context.Context, fn func(job *queue.Job) bool) (bool, error)
+	RepairJobFiles(ctx context.Context, repaired *queue.Job, inputPath, outputPath string) (bool, error)
+}
+
+// sniffFormat returns the format of the image r holds, read from its
+// header, or "" if it isn't an image the API can store
+func sniffFormat(r io.Reader) string {
+	_, format, err := image.DecodeConfig(r)
+	if err != nil || queue.FormatExt(format) == "" {
+		return ""
+	}
+	return format
+}
+
+// sniffUpload returns the format of an uploaded image, whatever its name claims
+func sniffUpload(file *multipart.FileHeader) string {
+	f, err := file.Open()
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	return sniffFormat(f)
+}
+
+// sniffFile returns the format of a stored image
+func (h *Handler) sniffFile(path string) string {
+	f, err := h.fs.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	return sniffFormat(f)
+}
+
+// inputExt returns the extension an upload is stored under: its sniffed
+// format's, or for files the API can't read the one it was uploaded with
+func inputExt(format, filename string) string {
+	if ext := queue.FormatExt(format); ext != "" {
+		return ext
+	}
+	return storageExt(filename)
+}
+
+// resultFilename names a result in format after its upload
+func resultFilename(job *queue.Job, format string) string {
+	ext := queue.FormatExt(format)
+	if ext == "" {
+		ext = filepath.Ext(job.OutputPath)
+	}
+	if job.Filename == "" {
+		return job.ID + ext
+	}
+	return strings.TrimSuffix(job.Filename, filepath.Ext(job.Filename)) + ext
+}
+
+// setResultHeaders describes a result served in format, so its
+// Content-Type and the name it's saved under agree with its contents
+// rather than with whatever the stored file is called
+func setResultHeaders(c *gin.Context, job *queue.Job, format string) {
+	if mediaType := queue.FormatMediaType(format); mediaType != "" {
+		c.Header("Content-Type", mediaType)
+	}
+	disposition := mime.FormatMediaType("inline", map[string]string{"filename": archive.SanitizeName(resultFilename(job, format))})
+	if disposition != "" {
+		c.Header("Content-Disposition", disposition)
+	}
+}
+
+// withExt returns path with its extension replaced by ext
+func withExt(path, ext string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ext
+}
+
+// RepairFormats records the formats of stored jobs that predate format
+// sniffing and moves files whose names disagree with their contents, a batch
+// at a time. Only finished jobs without pending deliveries are repaired, so
+// no worker or delivery is reading the files being moved. With
+// ?dry_run=true nothing is changed.
+func (h *Handler) RepairFormats(c *gin.Context) {
+	store, ok := h.jobQueue.(formatRepairStore)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Queue backend can't repair stored jobs"})
+		return
+	}
+	if !h.storageAvailable(c) {
+		return
+	}
+	dryRun := c.Query("dry_run") == "true"
+
+	// Jobs are repaired as they're found, so those that can't be don't use
+	// up the batch
+	counts := map[string]int{"recorded": 0, "moved": 0, "skipped": 0, "failed": 0}
+	changed := 0
+	complete, err := store.ScanJobs(c.Request.Context(), func(job *queue.Job) bool {
+		if !needsFormatRepair(job) {
+			return true
+		}
+		outcome, err := h.repairFormats(c.Request.Context(), store, job, dryRun)
+		if err != nil {
+			log.Printf("Failed to repair the file formats of job %s: %v", job.ID, err)
+			outcome = "failed"
+		}
+		counts[outcome]++
+		if !dryRun {
+			formatRepairs.Add(outcome, 1)
+		}
+		if outcome == "recorded" || outcome == "moved" {
+			changed++
+		}
+		return changed < formatRepairBatch
+	})
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to scan jobs", "jobs": counts})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"jobs": counts, "dry_run": dryRun, "complete": complete})
+}
+
+// needsFormatRepair reports whether a job has a file whose format isn't
+// recorded or whose name disagrees with its recorded format
+func needsFormatRepair(job *queue.Job) bool {
+	if job.Status != queue.StatusCompleted && job.Status != queue.StatusFailed {
+		return false
+	}
+	if job.InputPath != "" && (job.InputFormat == "" || queue.FormatOfExt(filepath.Ext(job.InputPath)) != job.InputFormat) {
+		return true
+	}
+	return job.OutputPath != "" && (job.OutputFormat == "" || queue.FormatOfExt(filepath.Ext(job.OutputPath)) != job.OutputFormat)
+}
+
+// repairFormats sniffs a job's files, copies those misnamed to names that
+// match their contents, records the formats, and then removes the old copies.
+// A job changed meanwhile is left as it is. It returns the outcome:
+// "recorded", "moved", or "skipped".
+func (h *Handler) repairFormats(ctx context.Context, store formatRepairStore, job *queue.Job, dryRun bool) (string, error) {
+	if h.expired(job) || hasPendingDelivery(job) {
+		return "skipped", nil
+	}
+	repaired := *job
+	var moves [][2]string
+	if job.InputPath != "" {
+		if format := h.sniffFile(job.InputPath); format != "" {
+			repaired.InputFormat = format
+			// Shared fanout inputs are referenced by path from several jobs
+			if queue.FormatOfExt(filepath.Ext(job.InputPath)) != format && job.FanoutID == "" {
+				repaired.InputPath = withExt(job.InputPath, queue.FormatExt(format))
+				moves = append(moves, [2]string{job.InputPath, repaired.InputPath})
+			}
+		}
+	}
+	if job.OutputPath != "" {
+		if format := h.sniffFile(job.OutputPath); format != "" {
+			repaired.OutputFormat = format
+			if queue.FormatOfExt(filepath.Ext(job.OutputPath)) != format {
+				repaired.OutputPath = withExt(job.OutputPath, queue.FormatExt(format))
+				moves = append(moves, [2]string{job.OutputPath, repaired.OutputPath})
+			}
+		}
+	}
+	if repaired.InputFormat == job.InputFormat && repaired.OutputFormat == job.OutputFormat && len(moves) == 0 {
+		// Neither file could be read as an image
+		return "skipped", nil
+	}
+	outcome := "recorded"
+	if len(moves) > 0 {
+		outcome = "moved"
+	}
+	if dryRun {
+		return outcome, nil
+	}
+
+	// Copy first, so the job never points at a file that isn't there
+	for i, move := range moves {
+		if err := h.copyFile(move[0], move[1]); err != nil {
+			for _, done := range moves[:i+1] {
+				h.fs.Remove(done[1])
+			}
+			return "", err
+		}
+	}
+	written, err := store.RepairJobFiles(ctx, &repaired, job.InputPath, job.OutputPath)
+	if err != nil || !written {
+		for _, move := range moves {
+			h.fs.Remove(move[1])
+		}
+		if err != nil {
+			return "", err
+		}
+		return "skipped", nil
+	}
+	if repaired.OutputPath != job.OutputPath {
+		h.removeVariants(ctx, job)
+		h.invalidateCachedResult(job.OutputPath)
+	}
+	for _, move := range moves {
+		if err := h.removeFile(move[0]); err != nil {
+			log.Printf("Failed to remove %q, moved to %q: %v", move[0], move[1], err)
+		}
+	}
+	return outcome, nil
+}
+
+// copyFile copies src to dst, writing dst atomically
+func (h *Handler) copyFile(src, dst string) error {
+	in, err := h.fs.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+
+	suffix, err := generateID()
+	if err != nil {
+		return err
+	}
+	tmp := dst + ".tmp-" + suffix
+	out, err := h.fs.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(out, in); err != nil {
+		out.Close()
+		h.fs.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		h.fs.Remove(tmp)
+		return err
+	}
+	if err := h.fs.Rename(tmp, dst); err != nil {
+		h.fs.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// hasPendingDelivery reports whether any of the job's deliveries is still to be made
+func hasPendingDelivery(job *queue.Job) bool {
+	for _, d := range job.Deliveries {
+		if d.Status == queue.DeliveryPending {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,243 @@
+package handlers
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/png"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// faultyFS is the local filesystem with failures injected: opening the
+// paths in openErr fails, and with writeErr set every created file fails
+// partway through its first write
+type faultyFS struct {
+	osFS
+	openErr  map[string]error
+	writeErr error
+}
+
+func (f *faultyFS) Open(name string) (File, error) {
+	if err := f.openErr[name]; err != nil {
+		return nil, err
+	}
+	return f.osFS.Open(name)
+}
+
+func (f *faultyFS) Create(name string) (io.WriteCloser, error) {
+	w, err := f.osFS.Create(name)
+	if err != nil || f.writeErr == nil {
+		return w, err
+	}
+	return failingWriter{w, f.writeErr}, nil
+}
+
+type failingWriter struct {
+	io.WriteCloser
+	err error
+}
+
+func (w failingWriter) Write(p []byte) (int, error) {
+	n, _ := w.WriteCloser.Write(p[:len(p)/2])
+	return n, w.err
+}
+
+// fixedClock is a Clock stopped at one instant
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+// testPNG returns a 1x1 PNG
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, image.NewRGBA(image.Rect(0, 0, 1, 1))); err != nil {
+		t.Fatalf("encoding the PNG: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// fileRequest builds a multipart POST of data as the file field
+func fileRequest(t *testing.T, path, field, filename string, data []byte) *http.Request {
+	t.Helper()
+	var body bytes.Buffer
+	form := multipart.NewWriter(&body)
+	part, err := form.CreateFormFile(field, filename)
+	if err != nil {
+		t.Fatalf("CreateFormFile: %v", err)
+	}
+	part.Write(data)
+	form.Close()
+	req := httptest.NewRequest(http.MethodPost, path, &body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	return req
+}
+
+// uploadRequest builds a multipart POST of a 1x1 PNG as the image field
+func uploadRequest(t *testing.T, path string) *http.Request {
+	t.Helper()
+	return fileRequest(t, path, "image", "photo.png", testPNG(t))
+}
+
+// addCompletedJob stores a completed job with its result at output
+func addCompletedJob(t *testing.T, jobs *queue.RedisQueue, jobID, output string) {
+	t.Helper()
+	ctx := context.Background()
+	if err := jobs.AddJob(ctx, &queue.Job{ID: jobID, InputPath: jobID + ".png"}); err != nil {
+		t.Fatalf("AddJob: %v", err)
+	}
+	if err := jobs.TransitionJob(ctx, jobID, queue.StatusPending, queue.StatusProcessing, nil); err != nil {
+		t.Fatalf("TransitionJob to processing: %v", err)
+	}
+	if err := jobs.TransitionJob(ctx, jobID, queue.StatusProcessing, queue.StatusCompleted, func(job *queue.Job) {
+		job.OutputPath = output
+	}); err != nil {
+		t.Fatalf("TransitionJob to completed: %v", err)
+	}
+}
+
+func TestGetResultWithMissingResultFile(t *testing.T) {
+	h, jobs := newRedisTestHandler(t)
+	addCompletedJob(t, jobs, "job-1", filepath.Join(h.resultsDir, "job-1.png"))
+
+	router := gin.New()
+	router.GET("/result", h.GetResult)
+	w := serveTest(router, http.MethodGet, "/result?id=job-1", nil, "")
+	if w.Code != http.StatusOK {
+		t.Fatalf("got %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	var got struct {
+		Status    string `json:"status"`
+		ErrorCode string `json:"error_code"`
+		ResultURL string `json:"result_url"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding the response: %v", err)
+	}
+	if got.Status != string(queue.StatusFailed) || got.ErrorCode != queue.ErrorCodeResultMissing || got.ResultURL != "" {
+		t.Fatalf("status response = %s, want failed with %s and no result_url", w.Body, queue.ErrorCodeResultMissing)
+	}
+	job, err := jobs.GetJob(context.Background(), "job-1")
+	if err != nil || job.Status != queue.StatusFailed {
+		t.Fatalf("GetJob after the read = %+v, %v, want failed", job, err)
+	}
+}
+
+func TestDownloadResultReadsThroughFS(t *testing.T) {
+	fs := &faultyFS{}
+	h, jobs := newRedisTestHandler(t, WithFS(fs))
+	output := filepath.Join(h.resultsDir, "job-1.png")
+	if err := os.WriteFile(output, []byte("result"), 0644); err != nil {
+		t.Fatalf("writing the result: %v", err)
+	}
+	addCompletedJob(t, jobs, "job-1", output)
+
+	router := gin.New()
+	router.GET("/download/:id", h.DownloadResult)
+	w := serveTest(router, http.MethodGet, "/download/job-1", nil, "")
+	if w.Code != http.StatusOK || w.Body.String() != "result" {
+		t.Fatalf("got %d %q, want %d %q", w.Code, w.Body, http.StatusOK, "result")
+	}
+
+	// The file disappears after the existence check but before it's read
+	fs.openErr = map[string]error{output: os.ErrNotExist}
+	w = serveTest(router, http.MethodGet, "/download/job-1", nil, "")
+	if w.Code != http.StatusNotFound {
+		t.Fatalf("vanished result: got %d, want %d: %s", w.Code, http.StatusNotFound, w.Body)
+	}
+	var got struct {
+		ErrorCode string `json:"error_code"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil || got.ErrorCode != queue.ErrorCodeResultMissing {
+		t.Fatalf("vanished result: body %s, want error_code %s", w.Body, queue.ErrorCodeResultMissing)
+	}
+	if disposition := w.Header().Get("Content-Disposition"); disposition != "" {
+		t.Fatalf("vanished result: error response has Content-Disposition %q", disposition)
+	}
+}
+
+func TestProcessImageSaveFailureCleansUp(t *testing.T) {
+	h, jobs := newRedisTestHandler(t, WithFS(&faultyFS{writeErr: errors.New("disk full")}))
+	router := gin.New()
+	router.POST("/process", h.Authenticate, h.ProcessImage)
+
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, uploadRequest(t, "/process"))
+	if w.Code != http.StatusInternalServerError {
+		t.Fatalf("got %d, want %d: %s", w.Code, http.StatusInternalServerError, w.Body)
+	}
+	entries, err := os.ReadDir(h.uploadDir)
+	if err != nil {
+		t.Fatalf("ReadDir: %v", err)
+	}
+	if len(entries) != 0 {
+		t.Fatalf("upload directory holds %d files after the failed save, want none", len(entries))
+	}
+	pending, _, err := jobs.ListJobs(context.Background(), queue.StatusPending, 0, 10)
+	if err != nil {
+		t.Fatalf("ListJobs: %v", err)
+	}
+	if len(pending) != 0 {
+		t.Fatalf("%d jobs queued after the failed save, want none", len(pending))
+	}
+}
+
+func TestResponseTimestampsAreRFC3339(t *testing.T) {
+	t.Setenv("DOWNLOAD_MODE", DownloadModeBoth)
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	h, jobs := newRedisTestHandlerWith(t, queue.Options{Clock: fixedClock(now)}, WithClock(fixedClock(now)))
+	output := filepath.Join(h.resultsDir, "job-1.png")
+	if err := os.WriteFile(output, []byte("result"), 0644); err != nil {
+		t.Fatalf("writing the result: %v", err)
+	}
+	addCompletedJob(t, jobs, "job-1", output)
+
+	router := gin.New()
+	router.GET("/result", h.GetResult)
+	router.POST("/download/:id/token", h.CreateDownloadToken)
+
+	var status struct {
+		CompletedAt string `json:"completed_at"`
+		ExpiresAt   string `json:"expires_at"`
+	}
+	w := serveTest(router, http.MethodGet, "/result?id=job-1", nil, "")
+	if err := json.Unmarshal(w.Body.Bytes(), &status); err != nil {
+		t.Fatalf("decoding the status: %v: %s", err, w.Body)
+	}
+	if want := "2024-03-01T12:00:00Z"; status.CompletedAt != want {
+		t.Fatalf("completed_at = %q, want %q", status.CompletedAt, want)
+	}
+	job, err := jobs.GetJob(context.Background(), "job-1")
+	if err != nil {
+		t.Fatalf("GetJob: %v", err)
+	}
+	if want := jobs.JobExpiresAt(job).Format(time.RFC3339); status.ExpiresAt != want {
+		t.Fatalf("expires_at = %q, want %q", status.ExpiresAt, want)
+	}
+
+	var token struct {
+		ExpiresAt string `json:"expires_at"`
+	}
+	w = serveTest(router, http.MethodPost, "/download/job-1/token", nil, "")
+	if err := json.Unmarshal(w.Body.Bytes(), &token); err != nil {
+		t.Fatalf("decoding the token: %v: %s", err, w.Body)
+	}
+	if want := now.Add(downloadTokenTTL).Format(time.RFC3339); token.ExpiresAt != want {
+		t.Fatalf("token expires_at = %q, want %q", token.ExpiresAt, want)
+	}
+}
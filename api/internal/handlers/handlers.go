@@ -2,43 +2,178 @@ package handlers
 
 import (
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
+	"io"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"time"
 
 	"github.com/gin-gonic/gin"
 
+	"rembg-v2/api/internal/anomaly"
+	"rembg-v2/api/internal/archive"
+	"rembg-v2/api/internal/auth"
+	"rembg-v2/api/internal/coldstorage"
+	"rembg-v2/api/internal/fault"
+	"rembg-v2/api/internal/filecache"
+	"rembg-v2/api/internal/health"
+	"rembg-v2/api/internal/maintenance"
 	"rembg-v2/api/internal/queue"
 )
 
 // Handler contains the handlers for the API endpoints
 type Handler struct {
-	jobQueue   queue.JobQueue
-	uploadDir  string
-	resultsDir string
+	jobQueue              queue.JobQueue
+	fs                    FS
+	clock                 queue.Clock
+	uploadDir             string
+	resultsDir            string
+	downloadMode          string
+	requeueMissingResults bool
+	quotaLimits           map[string]queue.QuotaLimits
+	depthLimits           map[string]int64
+	retention             retentionConfig
+	maxDeliveries         int
+	maxFanout             int
+	archiveLimits         archive.Limits
+	downloadLimits        queue.DownloadLimits
+	idempotencyTTL        time.Duration
+	idempotencyWait       time.Duration
+	idempotencyRefresh    time.Duration
+	capabilities          map[string]*docCache
+	models                *docCache
+	health                *health.Registry
+	queueStats            *docCache
+	verifier              *auth.Verifier
+	authRequired          bool
+	adminKey              []byte
+	keyGrace              time.Duration
+	keyTouches            keyTouches
+	anomalies             *anomaly.Watcher
+	maintenance           *maintenance.Scheduler
+	instance              queue.InstanceHeartbeat
+	filenameKey           []byte
+	transcodeDownloads    bool
+	transcodeQuality      int
+	transcodeCacheSize    int
+	variants              flightGroup
+	uploads               *uploadRegistry
+	resultCache           *filecache.Cache
+	archiver              coldstorage.Archiver
+	writeBehind           *writeBehind
+	recent                *recentJobs
+	hintKey               []byte
+	previewMaxPixels      int64
+	maxScheduleDelay      time.Duration
+	maxAttempts           int
+	orphanGrace           time.Duration
+	orphanMaxAge          time.Duration
+	maxPendingJobs        int64
 }
 
-// NewHandler creates a new Handler with the given dependencies
-func NewHandler(jobQueue queue.JobQueue) *Handler {
-	// Create upload and results directories if they don't exist
-	uploadDir := getEnv("UPLOAD_DIR", "uploads")
-	resultsDir := getEnv("RESULTS_DIR", "results")
+// Option configures a Handler
+type Option func(*Handler)
 
-	os.MkdirAll(uploadDir, 0755)
-	os.MkdirAll(resultsDir, 0755)
+// WithFS replaces the filesystem used for uploads and results
+func WithFS(fs FS) Option {
+	return func(h *Handler) {
+		h.fs = fs
+	}
+}
 
-	return &Handler{
-		jobQueue:   jobQueue,
-		uploadDir:  uploadDir,
-		resultsDir: resultsDir,
+// WithClock replaces the clock used for timestamps in responses
+func WithClock(clock queue.Clock) Option {
+	return func(h *Handler) {
+		h.clock = clock
 	}
 }
 
+// NewHandler creates a new Handler with the given dependencies
+func NewHandler(jobQueue queue.JobQueue, opts ...Option) *Handler {
+	h := &Handler{
+		jobQueue:              jobQueue,
+		fs:                    osFS{},
+		clock:                 queue.SystemClock{},
+		uploadDir:             getEnv("UPLOAD_DIR", "uploads"),
+		resultsDir:            getEnv("RESULTS_DIR", "results"),
+		downloadMode:          getEnv("DOWNLOAD_MODE", DownloadModeDirect),
+		requeueMissingResults: getEnv("REQUEUE_MISSING_RESULTS", "false") == "true",
+		quotaLimits:           quotaLimitsFromEnv(),
+		depthLimits:           depthLimitsFromEnv(),
+		retention:             retentionFromEnv(),
+		maxDeliveries:         getEnvInt("MAX_DELIVERIES", 3),
+		maxFanout:             getEnvInt("MAX_FANOUT", 10),
+		archiveLimits:         archiveLimitsFromEnv(),
+		downloadLimits: queue.DownloadLimits{
+			Concurrent: int64(getEnvInt("DOWNLOAD_MAX_CONCURRENT", 10)),
+			Daily:      int64(getEnvInt("DOWNLOAD_MAX_PER_DAY", 1000)),
+		},
+		idempotencyTTL:     time.Duration(getEnvInt("IDEMPOTENCY_TTL_SECONDS", 86400)) * time.Second,
+		idempotencyWait:    time.Duration(getEnvInt("IDEMPOTENCY_WAIT_MS", 2000)) * time.Millisecond,
+		idempotencyRefresh: queue.IdempotencyReservationTTL / 3,
+		transcodeDownloads: getEnv("TRANSCODE_DOWNLOADS", "false") == "true",
+		transcodeQuality:   getEnvInt("TRANSCODE_JPEG_QUALITY", 85),
+		transcodeCacheSize: getEnvInt("TRANSCODE_CACHE_SIZE", 1000),
+		hintKey:            statusHintKeyFromEnv(),
+		uploads:            newUploadRegistry(getEnvInt("MAX_CONCURRENT_UPLOADS", 100)),
+		keyGrace:           time.Duration(getEnvInt("API_KEY_ROTATION_GRACE_SECONDS", 86400)) * time.Second,
+		adminKey:           []byte(getEnv("ADMIN_API_KEY", "")),
+		previewMaxPixels:   int64(getEnvInt("PREVIEW_MAX_PIXELS", 16000000)),
+		maxScheduleDelay:   time.Duration(getEnvInt("MAX_SCHEDULE_DELAY_SECONDS", 86400)) * time.Second,
+		maxAttempts:        getEnvInt("MAX_JOB_ATTEMPTS", 3),
+		orphanGrace:        time.Duration(getEnvInt("ORPHAN_FILE_GRACE_SECONDS", 3600)) * time.Second,
+		orphanMaxAge:       time.Duration(getEnvInt("ORPHAN_FILE_MAX_AGE_SECONDS", 0)) * time.Second,
+		maxPendingJobs:     int64(getEnvInt("MAX_PENDING_JOBS", 0)),
+	}
+	if window := getEnvInt("READ_YOUR_WRITES_SECONDS", 10); window > 0 {
+		h.recent = newRecentJobs(time.Duration(window) * time.Second)
+	}
+	for _, opt := range opts {
+		opt(h)
+	}
+	h.instance = newInstance(h.clock.Now())
+	h.initDocCaches()
+	h.initHealth()
+
+	// Create upload and results directories if they don't exist
+	h.fs.MkdirAll(h.uploadDir, 0755)
+	h.fs.MkdirAll(h.resultsDir, 0755)
+
+	return h
+}
+
 // ProcessImage handles the image upload and creates a new processing job
 func (h *Handler) ProcessImage(c *gin.Context) {
+	// Fail fast rather than deep inside the upload while storage is down
+	if !h.storageAvailable(c) {
+		return
+	}
+
+	// Deduplicate retries sent with an Idempotency-Key
+	claim, ok := h.claimIdempotencyKey(c)
+	if !ok {
+		return
+	}
+	defer claim.release()
+
+	// Refuse work before reading the upload while the queue is full
+	if !h.admitPending(c) {
+		return
+	}
+
+	// Claim an upload slot; the upload is removed unless a job takes it
+	slot, ok := h.beginUpload(c)
+	if !ok {
+		return
+	}
+	defer slot.finish()
+
 	// Get the uploaded file
 	file, err := c.FormFile("image")
 	if err != nil {
@@ -46,6 +181,48 @@ func (h *Handler) ProcessImage(c *gin.Context) {
 		return
 	}
 
+	// Read the post-processing options
+	options, pipeline, err := parsePostProcessing(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	deliveries, err := h.parseDeliveries(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	metadata, err := parseMetadata(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	model, ok := h.parseModel(c)
+	if !ok {
+		return
+	}
+	priority, ok := parsePriority(c)
+	if !ok {
+		return
+	}
+	retention, lifetime, ok := h.jobLifecycle(c, deliveries)
+	if !ok {
+		return
+	}
+	processAt, ok := h.parseSchedule(c, retention)
+	if !ok {
+		return
+	}
+
+	if !h.submissionsOpen(c) {
+		return
+	}
+	// Shed lower-tier work first while the queue is backed up
+	tier := callerTier(c)
+	if !h.admitSubmission(c, tier, 1) {
+		return
+	}
+
 	// Generate a unique job ID
 	jobID, err := generateID()
 	if err != nil {
@@ -53,34 +230,118 @@ func (h *Handler) ProcessImage(c *gin.Context) {
 		return
 	}
 
-	// Create a filename with the job ID
-	filename := jobID + filepath.Ext(file.Filename)
+	// Name the stored upload after the format of its contents, not its name
+	inputFormat := sniffUpload(file)
+	filename := jobID + inputExt(inputFormat, file.Filename)
 	uploadPath := filepath.Join(h.uploadDir, filename)
 
 	// Save the uploaded file
-	if err := c.SaveUploadedFile(file, uploadPath); err != nil {
+	inputHash, err := h.saveUpload(c, slot, file, uploadPath)
+	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to save the uploaded file"})
 		return
 	}
 
 	// Create a new job
 	job := &queue.Job{
-		ID:        jobID,
-		Status:    queue.StatusPending,
-		InputPath: uploadPath,
+		ID:         jobID,
+		Status:     queue.StatusPending,
+		InputPath:  uploadPath,
+		Filename:   file.Filename,
+		InputBytes: file.Size,
+		InputHash:  inputHash,
+		Owner:      ownerID(c),
+		Tier:       tier,
+		Options:    options,
+		Pipeline:   pipeline,
+		Deliveries: deliveries,
+		Model:      model,
+		Retention:  retention,
 	}
+	job.Metadata = metadata
+	job.InputFormat = inputFormat
+	job.Priority = priority
+	if processAt != nil {
+		// Held back until it's due
+		job.Status = queue.StatusScheduled
+		job.ProcessAt = processAt
+	}
+	job.MaxLifetimeSeconds = lifetime
+	job.MaxAttempts = h.maxAttempts
+	job.IdempotencyKey = claim.name()
+	job.OptionsVersion = job.RequiredOptionsVersion()
 
-	// Add the job to the queue
-	if err := h.jobQueue.AddJob(c.Request.Context(), job); err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add job to queue"})
+	// Answer a repeat of an upload with its job, unless the client opts out
+	if store, ok := h.jobQueue.(uploadDedupeStore); ok && c.PostForm("dedupe") != "false" {
+		job.UploadFingerprint = uploadFingerprint(job)
+		if job.UploadFingerprint != "" {
+			if existing := h.findDuplicate(c.Request.Context(), store, job); existing != nil {
+				h.answerDuplicate(c, existing)
+				return
+			}
+		}
+	}
+
+	// Record non-fatal issues found in the upload
+	for _, w := range inspectUpload(h.fs, uploadPath) {
+		job.AddWarning(w)
+	}
+
+	// Make a thumbnail of the input the client can show right away
+	if c.PostForm("preview") == "true" {
+		h.addPreview(slot, job)
+	}
+
+	// Charge the submission to the owner's quota
+	if h.quotasEnabled() && !h.reserveQuota(c, job) {
 		return
 	}
 
+	// Add the job to the queue, buffering it locally through a brief outage.
+	// It's remembered first so status reads racing the write see it as pending.
+	h.rememberJobs(c.Request.Context(), jobID)
+	queuedLocally := false
+	if err := h.jobQueue.AddJob(c.Request.Context(), job); err != nil {
+		queuedLocally = h.bufferSubmission(job, err)
+		if !queuedLocally {
+			h.forgetJob(c.Request.Context(), jobID)
+			job.Status = queue.StatusFailed
+			h.refundQuota(c.Request.Context(), job)
+			if h.writeBehind != nil && queue.IsTransient(err) {
+				c.Header("Retry-After", "1")
+				c.JSON(http.StatusServiceUnavailable, gin.H{"error": "The queue is unavailable and the local buffer is full", "retry_after": 1})
+				return
+			}
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to add job to queue"})
+			return
+		}
+	}
+	claim.commit(jobID)
+	slot.keep()
+	tierSubmissions.Add(tier, 1)
+	if !queuedLocally {
+		h.indexJob(c.Request.Context(), job)
+		h.rememberUpload(c.Request.Context(), job)
+	}
+
 	// Return the job ID to the client
-	c.JSON(http.StatusAccepted, gin.H{
+	response := gin.H{
 		"job_id": jobID,
 		"status": string(job.Status),
-	})
+	}
+	if len(job.Warnings) > 0 {
+		response["warnings"] = job.Warnings
+	}
+	if queuedLocally {
+		response["queued_locally"] = true
+	}
+	if job.Output(queue.OutputInputPreview) != nil {
+		response["preview_url"] = previewURL(jobID)
+	}
+	if h.recent != nil {
+		response["status_hint"] = h.statusHint(jobID, h.clock.Now())
+	}
+	c.JSON(http.StatusAccepted, response)
 }
 
 // GetResult handles retrieving the result of a processing job
@@ -91,72 +352,236 @@ func (h *Handler) GetResult(c *gin.Context) {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "Job ID is required"})
 		return
 	}
+	if h.rejectCaseVariant(c, jobID) {
+		return
+	}
 
 	// Get the job from the queue
 	job, err := h.jobQueue.GetJob(c.Request.Context(), jobID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve job"})
+	if err != nil && !errors.Is(err, queue.ErrJobNotFound) {
+		jobLookupFailed(c)
 		return
 	}
 
-	// Check if the job exists
-	if job == nil {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+	// Check if the job exists, or is still buffered on this replica
+	if queue.JobMissing(job, err) {
+		if buffered := h.bufferedJob(jobID); buffered != nil {
+			c.Header("Retry-After", "1")
+			c.JSON(http.StatusOK, gin.H{"job_id": buffered.ID, "status": string(buffered.Status), "queued_locally": true, "retry_after_ms": 1000})
+			return
+		}
+		if tombstone := h.tombstone(c.Request.Context(), jobID); tombstone != nil {
+			if tombstone.Archive != "" {
+				archivedJob(c, jobID, tombstone)
+				return
+			}
+			expiredJob(c, jobID, tombstone.ExpiredAt)
+			return
+		}
+		if !h.acceptedRecently(c.Request.Context(), jobID, c.Query("hint")) {
+			c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+			return
+		}
+
+		// The read raced the job's first write; never report a job this
+		// deployment just accepted as missing
+		job, err = h.rereadJob(c.Request.Context(), jobID)
+		if err != nil {
+			jobLookupFailed(c)
+			return
+		}
+		if job == nil {
+			c.Header("Retry-After", "1")
+			c.JSON(http.StatusOK, gin.H{"job_id": jobID, "status": string(queue.StatusPending), "retry_after_ms": 1000})
+			return
+		}
+	}
+
+	// Finished jobs past their retention are gone, whether or not the
+	// sweeper has torn them down yet
+	if h.expired(job) {
+		expiredJob(c, job.ID, job.ExpiresAt())
 		return
 	}
 
+	// Reconcile completed jobs whose result file has gone missing, unless
+	// storage is down and can't tell missing files from unreachable ones
+	storageUp := h.health.Healthy(health.Storage)
+	if job.Status == queue.StatusCompleted && storageUp && !h.resultExists(job) {
+		h.handleMissingResult(c.Request.Context(), job)
+	}
+
 	// Return job info
 	result := gin.H{
 		"job_id": job.ID,
 		"status": string(job.Status),
 	}
+	if len(job.Warnings) > 0 {
+		result["warnings"] = job.Warnings
+	}
+	if job.FanoutID != "" {
+		result["fanout_id"] = job.FanoutID
+	}
+	if len(job.Metadata) > 0 {
+		result["metadata"] = job.Metadata
+	}
+	if h.previewAvailable(job) {
+		result["preview_url"] = previewURL(job.ID)
+	}
+	if expiresAt := job.ExpiresAt(); !expiresAt.IsZero() {
+		result["expires_at"] = expiresAt.Format(time.RFC3339)
+		result["retention_source"] = job.Retention.Source
+		if inputExpiresAt := job.InputExpiresAt(); !inputExpiresAt.IsZero() {
+			result["input_expires_at"] = inputExpiresAt.Format(time.RFC3339)
+		}
+	} else if expirer, ok := h.jobQueue.(jobExpirer); ok {
+		// Without retention the record lives for its status's TTL
+		result["expires_at"] = expirer.JobExpiresAt(job).Format(time.RFC3339)
+	}
 
 	// Add additional info based on job status
 	switch job.Status {
 	case queue.StatusCompleted:
-		// Serve the processed image directly if it exists
-		if _, err := os.Stat(job.OutputPath); err == nil {
+		if h.directDownloads() {
 			result["result_url"] = fmt.Sprintf("/api/download/%s", job.ID)
-			result["completed_at"] = job.UpdatedAt.Format(time.RFC3339)
-		} else {
-			result["error"] = "Result file not found"
+		}
+		if h.tokenDownloads() {
+			result["token_url"] = fmt.Sprintf("/api/download/%s/token", job.ID)
+		}
+		if !storageUp {
+			result["result_url"] = nil
+			delete(result, "token_url")
+			result["warnings"] = append(append([]queue.Warning{}, job.Warnings...), storageWarning())
+		}
+		if format := job.ResultFormat(); format != "" {
+			result["format"] = format
+		}
+		result["completed_at"] = job.UpdatedAt.Format(time.RFC3339)
+		result["queue_wait_ms"] = job.QueueWaitMs
+		result["processing_ms"] = job.ProcessingMs
+		// Measured across every attempt from the recorded status changes,
+		// where the worker's figures cover only the last
+		if queued, processing, ok := job.StatusDurations(); ok {
+			result["queued_duration_ms"] = queued.Milliseconds()
+			result["processing_duration_ms"] = processing.Milliseconds()
+		}
+		if len(job.StageTimings) > 0 {
+			result["stage_timings"] = job.StageTimings
+		}
+		if len(job.Deliveries) > 0 {
+			result["deliveries"] = deliveryStatuses(job.Deliveries)
+		}
+		if job.ModelSelection != nil {
+			result["model_selection"] = job.ModelSelection
+		}
+		result["input_has_alpha"] = job.InputHasAlpha
+		if job.CompositeMode != "" {
+			result["composite_mode"] = job.CompositeMode
 		}
 	case queue.StatusFailed:
 		result["error"] = job.Error
+		if job.ErrorCode != "" {
+			result["error_code"] = job.ErrorCode
+		}
+	case queue.StatusCancelled:
+		result["cancelled_at"] = job.UpdatedAt.Format(time.RFC3339)
 	case queue.StatusProcessing:
 		result["started_at"] = job.UpdatedAt.Format(time.RFC3339)
+		if h.cancelRequested(c.Request.Context(), job) {
+			result["cancel_requested"] = true
+		}
+		if h.loadProgress(c.Request.Context(), job) {
+			result["progress"] = job.Progress
+			result["stage"] = job.Stage
+		}
+	case queue.StatusPending:
+		// Explain why a job isn't being picked up
+		if h.queuePaused(c.Request.Context()) {
+			result["queue_paused"] = true
+		}
+	case queue.StatusScheduled:
+		result["process_at"] = job.ScheduledUntil().Format(time.RFC3339)
+	case queue.StatusRetrying:
+		result["retry_at"] = job.ScheduledUntil().Format(time.RFC3339)
+	}
+	// A retry in progress shows as attempts above one
+	if job.Attempts > 0 {
+		maxAttempts := job.MaxAttempts
+		if maxAttempts < 1 {
+			maxAttempts = 1
+		}
+		result["attempts"] = job.Attempts
+		result["max_attempts"] = maxAttempts
 	}
+	if len(job.AttemptHistory) > 0 {
+		result["attempt_history"] = ownerAttempts(job.AttemptHistory)
+	}
+
+	// Unfinished jobs are stopped at the end of their lifetime
+	if job.Status == queue.StatusPending || job.Status == queue.StatusProcessing || job.Status == queue.StatusScheduled || job.Status == queue.StatusRetrying {
+		if remaining, ok := h.remainingLifetime(job); ok {
+			result["remaining_lifetime_seconds"] = int64(remaining / time.Second)
+		}
+	}
+
+	// Tell the client how long to wait before polling again
+	setRetryAfter(c, result, h.pollHint(c.Request.Context(), job))
 
 	c.JSON(http.StatusOK, result)
 }
 
 // DownloadResult serves the processed image file
 func (h *Handler) DownloadResult(c *gin.Context) {
-	// Get the job ID from the URL parameter
-	jobID := c.Param("id")
-	if jobID == "" {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "Job ID is required"})
+	if !h.directDownloads() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Direct downloads are disabled, request a download token"})
 		return
 	}
 
-	// Get the job from the queue
-	job, err := h.jobQueue.GetJob(c.Request.Context(), jobID)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve job"})
+	// Get the completed job from the URL parameter
+	job, ok := h.downloadableJob(c, c.Param("id"))
+	if !ok {
 		return
 	}
 
-	// Check if the job exists and is completed
-	if job == nil || job.Status != queue.StatusCompleted || job.OutputPath == "" {
-		c.JSON(http.StatusNotFound, gin.H{"error": "Result not available"})
-		return
+	// Serve the file
+	h.serveResult(c, job)
+}
+
+// saveUpload writes an uploaded file to path, tracked by slot so a partial
+// file is removed when the request fails or is cancelled, and returns the
+// hex SHA-256 of its contents
+func (h *Handler) saveUpload(c *gin.Context, slot *upload, file *multipart.FileHeader, path string) (string, error) {
+	src, err := file.Open()
+	if err != nil {
+		return "", err
 	}
+	defer src.Close()
 
-	// Serve the file
-	c.File(job.OutputPath)
+	if err := fault.Maybe(c.Request.Context(), fault.StorageSave, "owner", ownerID(c)); err != nil {
+		h.recordStorage(err)
+		return "", err
+	}
+	slot.track(path)
+	dst, err := h.fs.Create(path)
+	h.recordStorage(err)
+	if err != nil {
+		return "", err
+	}
+
+	sum := sha256.New()
+	if _, err := io.Copy(io.MultiWriter(dst, sum), ctxReader{c.Request.Context(), src}); err != nil {
+		dst.Close()
+		return "", err
+	}
+	if err := dst.Close(); err != nil {
+		h.recordStorage(err)
+		return "", err
+	}
+	return hex.EncodeToString(sum.Sum(nil)), nil
 }
 
-// generateID generates a random ID for a job
+// generateID generates a random ID for a job, in lowercase hex so it can
+// never collide by case on case-insensitive storage
 func generateID() (string, error) {
 	b := make([]byte, 8)
 	if _, err := rand.Read(b); err != nil {
@@ -172,4 +597,13 @@ func getEnv(key, defaultValue string) string {
 		return defaultValue
 	}
 	return value
+}
+
+// getEnvInt returns the environment variable as an int or a default if not set or invalid
+func getEnvInt(key string, defaultValue int) int {
+	value, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return defaultValue
+	}
+	return value
 } 
\ No newline at end of file
@@ -0,0 +1,83 @@
+package handlers
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+
+	"rembg-v2/api/internal/queue"
+)
+
+const testAdminKey = "test-admin-key"
+
+// newRedisTestHandler creates a Handler over a Redis queue on an
+// in-process Redis server, with ADMIN_API_KEY set and uploads and results
+// in temporary directories
+func newRedisTestHandler(t *testing.T, opts ...Option) (*Handler, *queue.RedisQueue) {
+	t.Helper()
+	return newRedisTestHandlerWith(t, queue.Options{}, opts...)
+}
+
+// newRedisTestHandlerWith is newRedisTestHandler with queue options
+func newRedisTestHandlerWith(t *testing.T, queueOpts queue.Options, opts ...Option) (*Handler, *queue.RedisQueue) {
+	t.Helper()
+	gin.SetMode(gin.TestMode)
+	t.Setenv("UPLOAD_DIR", t.TempDir())
+	t.Setenv("RESULTS_DIR", t.TempDir())
+	t.Setenv("ADMIN_API_KEY", testAdminKey)
+
+	server := miniredis.RunT(t)
+	jobs, err := queue.NewRedisQueueWithClient(redis.NewClient(&redis.Options{Addr: server.Addr()}), queueOpts)
+	if err != nil {
+		t.Fatalf("NewRedisQueueWithClient: %v", err)
+	}
+	t.Cleanup(func() { jobs.Close() })
+	return NewHandler(jobs, opts...), jobs
+}
+
+// newTestAPIKey issues an API key for owner and returns its secret
+func newTestAPIKey(t *testing.T, jobs *queue.RedisQueue, owner string) string {
+	t.Helper()
+	_, secret, err := jobs.CreateAPIKey(context.Background(), owner, "", time.Now())
+	if err != nil {
+		t.Fatalf("CreateAPIKey: %v", err)
+	}
+	return secret
+}
+
+// serveAs sends a request to router authenticated with the API key secret,
+// or anonymously if it's empty
+func serveAs(router http.Handler, method, path string, body io.Reader, secret string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, body)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if secret != "" {
+		req.Header.Set("Authorization", "Bearer "+secret)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
+
+// serveTest sends a request to router, with the admin key header set
+// unless adminKey is empty
+func serveTest(router http.Handler, method, path string, body io.Reader, adminKey string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(method, path, body)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	if adminKey != "" {
+		req.Header.Set(adminKeyHeader, adminKey)
+	}
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, req)
+	return w
+}
@@ -0,0 +1,221 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/health"
+	"rembg-v2/api/internal/queue"
+)
+
+// healthProbeInterval is how often dependencies are probed
+const healthProbeInterval = 5 * time.Second
+
+// readinessTimeout bounds a readiness check, so probes get an answer even
+// while a dependency hangs
+const readinessTimeout = 2 * time.Second
+
+// errorCodeStorageUnavailable is returned while storage is marked down
+const errorCodeStorageUnavailable = "storage_unavailable"
+
+// errorCodeQueueUnavailable is returned when a job couldn't be read because
+// the queue failed, as opposed to the job not existing
+const errorCodeQueueUnavailable = "queue_unavailable"
+
+// pinger is implemented by queues that can check their connection
+type pinger interface {
+	Ping(ctx context.Context) error
+}
+
+// initHealth registers the handler's dependencies and their probes
+func (h *Handler) initHealth() {
+	h.health = health.NewRegistry()
+	h.queueStats = newDocCache(healthProbeInterval, h.clock, func(ctx context.Context) (interface{}, error) {
+		return h.jobQueue.Stats(ctx)
+	})
+	h.health.Register(health.Storage, h.probeStorage)
+	if p, ok := h.jobQueue.(pinger); ok {
+		h.health.Register(health.Redis, p.Ping)
+	}
+}
+
+// probeStorage checks that uploads can be written and results read
+func (h *Handler) probeStorage(ctx context.Context) error {
+	probe := filepath.Join(h.uploadDir, ".health")
+	f, err := h.fs.Create(probe)
+	if err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := h.fs.Remove(probe); err != nil {
+		return err
+	}
+	_, err = h.fs.Stat(h.resultsDir)
+	return err
+}
+
+// recordStorage reports a storage operation's outcome; missing files are
+// an answer from a working backend, not a failure
+func (h *Handler) recordStorage(err error) {
+	if os.IsNotExist(err) {
+		err = nil
+	}
+	h.health.Record(health.Storage, err)
+}
+
+// storageAvailable writes a 503 response and returns false while storage is down
+func (h *Handler) storageAvailable(c *gin.Context) bool {
+	if h.health.Healthy(health.Storage) {
+		return true
+	}
+	c.Header("Retry-After", "30")
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"error":      "Storage is temporarily unavailable",
+		"error_code": errorCodeStorageUnavailable,
+	})
+	return false
+}
+
+// jobLookupFailed writes the 503 response for a job read that failed with a
+// queue error rather than finding no job, which is a 404
+func jobLookupFailed(c *gin.Context) {
+	c.Header("Retry-After", strconv.Itoa(backpressureRetryAfter))
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"error":      "Failed to retrieve job",
+		"error_code": errorCodeQueueUnavailable,
+	})
+}
+
+// storageWarning is added to result responses while results can't be downloaded
+func storageWarning() queue.Warning {
+	return queue.Warning{
+		Code:    errorCodeStorageUnavailable,
+		Message: "Storage is temporarily unavailable, the result can't be downloaded right now",
+	}
+}
+
+// MonitorHealth probes the dependencies until ctx is done, so marked-down
+// dependencies recover on their own
+func (h *Handler) MonitorHealth(ctx context.Context) {
+	h.health.Run(ctx, healthProbeInterval)
+}
+
+// GetHealth reports the health of each dependency and the queue's stats,
+// read at most every healthProbeInterval. It always answers 200 so liveness
+// checks don't restart replicas during a dependency outage.
+func (h *Handler) GetHealth(c *gin.Context) {
+	status := "ok"
+	dependencies := h.health.Snapshot()
+	for _, d := range dependencies {
+		if !d.Healthy {
+			status = "degraded"
+		}
+	}
+	response := gin.H{"status": status, "dependencies": dependencies}
+	if stats, _, err := h.queueStats.get(c.Request.Context()); err == nil {
+		response["queue"] = json.RawMessage(stats)
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// readinessCheck is the outcome of checking one dependency for readiness
+type readinessCheck struct {
+	Healthy bool   `json:"healthy"`
+	Error   string `json:"error,omitempty"`
+}
+
+// GetLiveness answers 200 whenever the process serves requests, whatever
+// its dependencies' state, so liveness probes only restart a stuck replica
+func (h *Handler) GetLiveness(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"status": "ok"})
+}
+
+// GetReadiness checks that the queue is healthy and that uploads and
+// results can be written, answering 503 with the failed dependencies so
+// readiness probes take the replica out of rotation while any is down. The
+// checks run at once, and those unanswered after readinessTimeout fail, so
+// a hanging dependency can't hang the probe.
+func (h *Handler) GetReadiness(c *gin.Context) {
+	ctx, cancel := context.WithTimeout(c.Request.Context(), readinessTimeout)
+	defer cancel()
+
+	probes := map[string]func(ctx context.Context) error{
+		"queue":   h.jobQueue.HealthCheck,
+		"uploads": func(context.Context) error { return h.probeWritable(h.uploadDir) },
+		"results": func(context.Context) error { return h.probeWritable(h.resultsDir) },
+	}
+	type outcome struct {
+		name string
+		err  error
+	}
+	// Buffered so checks finishing after the deadline don't block
+	outcomes := make(chan outcome, len(probes))
+	checks := make(map[string]readinessCheck, len(probes))
+	for name, probe := range probes {
+		checks[name] = readinessCheck{Error: "no answer within " + readinessTimeout.String()}
+		go func(name string, probe func(ctx context.Context) error) {
+			outcomes <- outcome{name, probe(ctx)}
+		}(name, probe)
+	}
+
+wait:
+	for range probes {
+		select {
+		case o := <-outcomes:
+			if o.err != nil {
+				checks[o.name] = readinessCheck{Error: o.err.Error()}
+			} else {
+				checks[o.name] = readinessCheck{Healthy: true}
+			}
+		case <-ctx.Done():
+			break wait
+		}
+	}
+
+	var failed []string
+	for name, check := range checks {
+		if !check.Healthy {
+			failed = append(failed, name)
+		}
+	}
+	if len(failed) > 0 {
+		sort.Strings(failed)
+		c.JSON(http.StatusServiceUnavailable, gin.H{"status": "not_ready", "failed": failed, "checks": checks})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"status": "ready", "checks": checks})
+}
+
+// probeWritable checks that a file can be written in dir, under a name of
+// its own so concurrent probes don't remove each other's
+func (h *Handler) probeWritable(dir string) error {
+	id, err := generateID()
+	if err != nil {
+		return err
+	}
+	probe := filepath.Join(dir, ".ready-"+id)
+	f, err := h.fs.Create(probe)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write([]byte("ok")); err != nil {
+		f.Close()
+		h.fs.Remove(probe)
+		return err
+	}
+	if err := f.Close(); err != nil {
+		h.fs.Remove(probe)
+		return err
+	}
+	return h.fs.Remove(probe)
+}
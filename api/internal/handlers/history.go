@@ -0,0 +1,74 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+const (
+	// defaultHistoryWindow is how far back a history query without ?since reads
+	defaultHistoryWindow = 24 * time.Hour
+	// defaultHistoryLimit and maxHistoryLimit bound the summaries of one query
+	defaultHistoryLimit = 100
+	maxHistoryLimit     = 1000
+)
+
+// historyStore is implemented by queues that keep summaries of finished jobs
+type historyStore interface {
+	JobHistory(ctx context.Context, since, until time.Time, limit int) ([]*queue.JobSummary, error)
+}
+
+// historyTime parses an RFC 3339 timestamp from the query, or returns def
+// if it's absent
+func historyTime(c *gin.Context, name string, def time.Time) (time.Time, error) {
+	value := c.Query(name)
+	if value == "" {
+		return def, nil
+	}
+	return time.Parse(time.RFC3339, value)
+}
+
+// JobHistory lists the summaries of jobs that completed or failed between
+// ?since and ?until, oldest first, outliving the job records themselves
+func (h *Handler) JobHistory(c *gin.Context) {
+	store, ok := h.jobQueue.(historyStore)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Queue backend does not support job history"})
+		return
+	}
+
+	now := h.clock.Now()
+	since, err := historyTime(c, "since", now.Add(-defaultHistoryWindow))
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "since must be an RFC 3339 timestamp"})
+		return
+	}
+	until, err := historyTime(c, "until", now)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "until must be an RFC 3339 timestamp"})
+		return
+	}
+	if until.Before(since) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "until must not be before since"})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultHistoryLimit)))
+	if err != nil || limit < 1 || limit > maxHistoryLimit {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxHistoryLimit)})
+		return
+	}
+
+	summaries, err := store.JobHistory(c.Request.Context(), since, until, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read the job history"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"jobs": summaries, "since": since.UTC(), "until": until.UTC()})
+}
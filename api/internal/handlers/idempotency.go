@@ -0,0 +1,240 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+const (
+	// maxIdempotencyKeyLength caps the Idempotency-Key header in bytes
+	maxIdempotencyKeyLength = 255
+	// idempotencyPollInterval is how often a duplicate re-checks an in-flight reservation
+	idempotencyPollInterval = 100 * time.Millisecond
+	// idempotencyRetryAfter is suggested to duplicates that gave up waiting
+	idempotencyRetryAfter = time.Second
+)
+
+// idempotencyStore is implemented by queues that can deduplicate submissions
+type idempotencyStore interface {
+	ReserveIdempotencyKey(ctx context.Context, owner, key, token string) (bool, queue.IdempotencyRecord, error)
+	RefreshIdempotencyKey(ctx context.Context, owner, key, token string) (bool, error)
+	CommitIdempotencyKey(ctx context.Context, owner, key, token, jobID string, ttl time.Duration) (bool, error)
+	ReleaseIdempotencyKey(ctx context.Context, owner, key, token string) error
+	ForgetIdempotencyKey(ctx context.Context, owner, key, jobID string) error
+}
+
+// idempotencyClaim is a submission's reservation of its idempotency key,
+// committed once the job is created and released otherwise. It's refreshed
+// until then, so a slow upload doesn't outlast it.
+type idempotencyClaim struct {
+	store idempotencyStore
+	owner string
+	key   string
+	token string
+	jobID string
+	ttl   time.Duration
+	// stop ends the refreshes, which close done once they have
+	stop chan struct{}
+	done chan struct{}
+}
+
+// validIdempotencyKey reports whether key is 1-255 printable ASCII characters
+func validIdempotencyKey(key string) bool {
+	if key == "" || len(key) > maxIdempotencyKeyLength {
+		return false
+	}
+	for i := 0; i < len(key); i++ {
+		if key[i] < 0x21 || key[i] > 0x7e {
+			return false
+		}
+	}
+	return true
+}
+
+// claimIdempotencyKey reserves the request's Idempotency-Key. A key that
+// already created a job replays that job; a key held by a request still in
+// flight is waited on briefly and then answered with 409. It writes the
+// response and returns false if the request must not create a job. The
+// claim is nil when the request has no key or the queue can't deduplicate.
+func (h *Handler) claimIdempotencyKey(c *gin.Context) (*idempotencyClaim, bool) {
+	key := c.GetHeader("Idempotency-Key")
+	if key == "" {
+		return nil, true
+	}
+	store, ok := h.jobQueue.(idempotencyStore)
+	if !ok {
+		return nil, true
+	}
+	if !validIdempotencyKey(key) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Idempotency-Key must be 1-255 printable ASCII characters"})
+		return nil, false
+	}
+
+	token, err := generateID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to generate job ID"})
+		return nil, false
+	}
+	claim := &idempotencyClaim{store: store, owner: ownerID(c), key: key, token: token, ttl: h.idempotencyTTL}
+
+	ctx := c.Request.Context()
+	deadline := time.Now().Add(h.idempotencyWait)
+	for {
+		reserved, record, err := store.ReserveIdempotencyKey(ctx, claim.owner, key, token)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check idempotency key"})
+			return nil, false
+		}
+		if reserved {
+			claim.keepAlive(h.idempotencyRefresh)
+			return claim, true
+		}
+		if record.State == queue.IdempotencyCommitted {
+			if !h.jobExpired(ctx, record.JobID) {
+				h.replayJob(c, record.JobID)
+				return nil, false
+			}
+			// The job is past its retention, so the key is freed now
+			// rather than once the sweeper reaches it
+			if err := store.ForgetIdempotencyKey(ctx, claim.owner, key, record.JobID); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check idempotency key"})
+				return nil, false
+			}
+			continue
+		}
+
+		// Another request holding the key is still being processed
+		if !time.Now().Add(idempotencyPollInterval).Before(deadline) {
+			retryAfter := int(idempotencyRetryAfter / time.Second)
+			c.Header("Retry-After", strconv.Itoa(retryAfter))
+			c.JSON(http.StatusConflict, gin.H{
+				"error":       "A request with this Idempotency-Key is still being processed",
+				"retry_after": retryAfter,
+			})
+			return nil, false
+		}
+		select {
+		case <-ctx.Done():
+			return nil, false
+		case <-time.After(idempotencyPollInterval):
+		}
+	}
+}
+
+// jobExpired reports whether a job is known to be past its retention. A
+// job that can't be read, e.g. one still buffered by write-behind, isn't.
+func (h *Handler) jobExpired(ctx context.Context, jobID string) bool {
+	job, err := queue.NilIfNotFound(h.jobQueue.GetJob(ctx, jobID))
+	if err != nil {
+		return false
+	}
+	if job != nil {
+		return h.expired(job)
+	}
+	return h.tombstone(ctx, jobID) != nil
+}
+
+// replayJob answers a duplicate submission with the job its key created
+func (h *Handler) replayJob(c *gin.Context, jobID string) {
+	c.Header("Idempotent-Replayed", "true")
+	response := gin.H{"job_id": jobID}
+	if job, err := h.jobQueue.GetJob(c.Request.Context(), jobID); err == nil && job != nil {
+		response["status"] = string(job.Status)
+		if len(job.Warnings) > 0 {
+			response["warnings"] = job.Warnings
+		}
+	}
+	c.JSON(http.StatusAccepted, response)
+}
+
+// keepAlive refreshes the reservation every interval until the claim is
+// committed or released, or the reservation is lost
+func (claim *idempotencyClaim) keepAlive(interval time.Duration) {
+	claim.stop = make(chan struct{})
+	claim.done = make(chan struct{})
+	go func() {
+		defer close(claim.done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-claim.stop:
+				return
+			case <-ticker.C:
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			held, err := claim.store.RefreshIdempotencyKey(ctx, claim.owner, claim.key, claim.token)
+			cancel()
+			if err != nil {
+				log.Printf("Failed to refresh idempotency key %q: %v", claim.key, err)
+			} else if !held {
+				return
+			}
+		}
+	}()
+}
+
+// stopKeepAlive ends the refreshes and waits for one in flight to finish
+func (claim *idempotencyClaim) stopKeepAlive() {
+	if claim.stop == nil {
+		return
+	}
+	select {
+	case <-claim.stop:
+	default:
+		close(claim.stop)
+	}
+	<-claim.done
+}
+
+// name returns the key the submission was sent with, or "" without one
+func (claim *idempotencyClaim) name() string {
+	if claim == nil {
+		return ""
+	}
+	return claim.key
+}
+
+// commit records the job created under the key, before the response is
+// written so a duplicate sent after it replays the job
+func (claim *idempotencyClaim) commit(jobID string) {
+	if claim == nil {
+		return
+	}
+	claim.stopKeepAlive()
+	claim.jobID = jobID
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	committed, err := claim.store.CommitIdempotencyKey(ctx, claim.owner, claim.key, claim.token, jobID, claim.ttl)
+	if err != nil {
+		log.Printf("Failed to commit idempotency key %q for job %s: %v", claim.key, jobID, err)
+	} else if !committed {
+		log.Printf("Idempotency key %q expired before job %s was created, retries may duplicate it", claim.key, jobID)
+	}
+}
+
+// release frees the key if the submission didn't create a job, whether it
+// was rejected or failed, so a corrected retry can reuse it
+func (claim *idempotencyClaim) release() {
+	if claim == nil {
+		return
+	}
+	claim.stopKeepAlive()
+	if claim.jobID != "" {
+		return
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	if err := claim.store.ReleaseIdempotencyKey(ctx, claim.owner, claim.key, claim.token); err != nil {
+		log.Printf("Failed to release idempotency key %q, it expires in %s: %v", claim.key, queue.IdempotencyReservationTTL, err)
+	}
+}
@@ -0,0 +1,91 @@
+package handlers
+
+import (
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+
+	"rembg-v2/api/internal/queue"
+)
+
+func TestIdempotencyReservationOutlastsSlowUpload(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("UPLOAD_DIR", t.TempDir())
+	t.Setenv("RESULTS_DIR", t.TempDir())
+	server := miniredis.RunT(t)
+	jobs, err := queue.NewRedisQueueWithClient(redis.NewClient(&redis.Options{Addr: server.Addr()}), queue.Options{})
+	if err != nil {
+		t.Fatalf("NewRedisQueueWithClient: %v", err)
+	}
+	t.Cleanup(func() { jobs.Close() })
+	h := NewHandler(jobs)
+	h.idempotencyRefresh = 10 * time.Millisecond
+	router := gin.New()
+	router.POST("/process", h.Authenticate, h.ProcessImage)
+
+	// Stream the upload, stalling after the part's headers
+	body, upload := io.Pipe()
+	form := multipart.NewWriter(upload)
+	req := httptest.NewRequest(http.MethodPost, "/process", body)
+	req.Header.Set("Content-Type", form.FormDataContentType())
+	req.Header.Set("Idempotency-Key", "slow-upload")
+	w := httptest.NewRecorder()
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		router.ServeHTTP(w, req)
+	}()
+	part, err := form.CreateFormFile("image", "photo.png")
+	if err != nil {
+		t.Fatalf("CreateFormFile: %v", err)
+	}
+
+	reservation := ""
+	for deadline := time.Now().Add(2 * time.Second); reservation == "" && time.Now().Before(deadline); time.Sleep(time.Millisecond) {
+		for _, key := range server.Keys() {
+			if strings.HasPrefix(key, "idempotency:") {
+				reservation = key
+			}
+		}
+	}
+	if reservation == "" {
+		t.Fatalf("no reservation made for the upload")
+	}
+
+	// Let the upload take three times the reservation's TTL
+	for i := 0; i < 6; i++ {
+		server.FastForward(queue.IdempotencyReservationTTL / 2)
+		if !server.Exists(reservation) {
+			t.Fatalf("reservation expired %s into the upload", time.Duration(i+1)*queue.IdempotencyReservationTTL/2)
+		}
+		time.Sleep(5 * h.idempotencyRefresh)
+	}
+
+	part.Write(testPNG(t))
+	form.Close()
+	upload.Close()
+	<-served
+	if w.Code != http.StatusAccepted {
+		t.Fatalf("slow upload: got %d, want %d: %s", w.Code, http.StatusAccepted, w.Body)
+	}
+	if state := server.HGet(reservation, "state"); state != string(queue.IdempotencyCommitted) {
+		t.Fatalf("key state after the upload = %q, want %q", state, queue.IdempotencyCommitted)
+	}
+
+	// A retry replays the job rather than creating another
+	retry := uploadRequest(t, "/process")
+	retry.Header.Set("Idempotency-Key", "slow-upload")
+	replay := httptest.NewRecorder()
+	router.ServeHTTP(replay, retry)
+	if replay.Header().Get("Idempotent-Replayed") != "true" {
+		t.Fatalf("retry was not replayed: %d %s", replay.Code, replay.Body)
+	}
+}
@@ -0,0 +1,76 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"os"
+	"time"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// instanceHeartbeatInterval is how often a replica reports itself, well
+// within queue.InstanceHeartbeatTTL
+const instanceHeartbeatInterval = 10 * time.Second
+
+// instanceRegistry is implemented by queues that track live API replicas
+type instanceRegistry interface {
+	RegisterInstance(ctx context.Context, hb queue.InstanceHeartbeat) error
+	DeregisterInstance(ctx context.Context, instanceID string) error
+	Instances(ctx context.Context) ([]queue.InstanceHeartbeat, error)
+}
+
+// newInstance identifies this replica by its hostname, which is the pod
+// name on Kubernetes, and a random suffix so restarts count as new replicas
+func newInstance(now time.Time) queue.InstanceHeartbeat {
+	hostname, _ := os.Hostname()
+	suffix, _ := generateID()
+	return queue.InstanceHeartbeat{
+		InstanceID: hostname + "-" + suffix[:6],
+		Hostname:   hostname,
+		StartedAt:  now,
+	}
+}
+
+// RunInstanceHeartbeat registers this replica until ctx is done, then
+// deregisters it so the registry shrinks immediately on shutdown
+func (h *Handler) RunInstanceHeartbeat(ctx context.Context) {
+	registry, ok := h.jobQueue.(instanceRegistry)
+	if !ok {
+		return
+	}
+
+	ticker := time.NewTicker(instanceHeartbeatInterval)
+	defer ticker.Stop()
+	for {
+		if err := registry.RegisterInstance(ctx, h.instance); err != nil && ctx.Err() == nil {
+			log.Printf("Failed to register API instance %s: %v", h.instance.InstanceID, err)
+		}
+
+		select {
+		case <-ctx.Done():
+			deregisterCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+			if err := registry.DeregisterInstance(deregisterCtx, h.instance.InstanceID); err != nil {
+				log.Printf("Failed to deregister API instance %s: %v", h.instance.InstanceID, err)
+			}
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// liveInstances lists the API replicas for the admin stats, or nil if the
+// queue doesn't track them
+func (h *Handler) liveInstances(ctx context.Context) []queue.InstanceHeartbeat {
+	registry, ok := h.jobQueue.(instanceRegistry)
+	if !ok {
+		return nil
+	}
+	instances, err := registry.Instances(ctx)
+	if err != nil {
+		log.Printf("Failed to list API instances: %v", err)
+		return nil
+	}
+	return instances
+}
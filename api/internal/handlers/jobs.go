@@ -0,0 +1,132 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// Bounds of one page of a job listing
+const (
+	defaultJobListLimit = 50
+	maxJobListLimit     = 500
+)
+
+// jobPager is implemented by queues that can page through a status's jobs
+// by cursor
+type jobPager interface {
+	ListJobsAfter(ctx context.Context, status queue.JobStatus, after queue.JobCursor, limit int) ([]*queue.Job, int, queue.JobCursor, error)
+}
+
+// jobRow is one job in a listing by status
+type jobRow struct {
+	JobID     string    `json:"job_id"`
+	Owner     string    `json:"owner,omitempty"`
+	Model     string    `json:"model,omitempty"`
+	Priority  string    `json:"priority,omitempty"`
+	Attempts  int       `json:"attempts,omitempty"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// formatJobCursor writes a cursor as parseJobCursor reads it
+func formatJobCursor(cursor queue.JobCursor) string {
+	return fmt.Sprintf("%d.%s", cursor.UpdatedAtMs, cursor.JobID)
+}
+
+// parseJobCursor parses a cursor written by formatJobCursor
+func parseJobCursor(s string) (queue.JobCursor, bool) {
+	ms, id, ok := strings.Cut(s, ".")
+	if !ok || id == "" {
+		return queue.JobCursor{}, false
+	}
+	updatedAtMs, err := strconv.ParseInt(ms, 10, 64)
+	if err != nil {
+		return queue.JobCursor{}, false
+	}
+	return queue.JobCursor{UpdatedAtMs: updatedAtMs, JobID: id}, true
+}
+
+// ListJobs lists every owner's jobs with ?status, the longest unchanged
+// first, with how many have it. Pages are taken by ?offset and ?limit, or
+// for a listing that must not miss jobs while others change status, by the
+// next_cursor of the previous page passed as ?cursor.
+func (h *Handler) ListJobs(c *gin.Context) {
+	status := queue.JobStatus(c.Query("status"))
+	if !queue.ValidStatus(status) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("status must be one of %v", queue.JobStatuses)})
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultJobListLimit)))
+	if err != nil || limit < 1 || limit > maxJobListLimit {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxJobListLimit)})
+		return
+	}
+	offsetParam, cursorParam := c.Query("offset"), c.Query("cursor")
+	if offsetParam != "" && cursorParam != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Page by offset or cursor, not both"})
+		return
+	}
+
+	ctx := c.Request.Context()
+	response := gin.H{"status": string(status)}
+	var jobs []*queue.Job
+	var total int
+	if cursorParam != "" {
+		pager, ok := h.jobQueue.(jobPager)
+		if !ok {
+			c.JSON(http.StatusNotImplemented, gin.H{"error": "Queue backend does not support paging by cursor"})
+			return
+		}
+		cursor, ok := parseJobCursor(cursorParam)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+			return
+		}
+		var next queue.JobCursor
+		if jobs, total, next, err = pager.ListJobsAfter(ctx, status, cursor, limit); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list jobs"})
+			return
+		}
+		response["next_cursor"] = formatJobCursor(next)
+	} else {
+		offset, err := strconv.Atoi(c.DefaultQuery("offset", "0"))
+		if err != nil || offset < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "offset must be a non-negative integer"})
+			return
+		}
+		if jobs, total, err = h.jobQueue.ListJobs(ctx, status, offset, limit); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to list jobs"})
+			return
+		}
+		response["offset"] = offset
+		// The cursor of the last job listed continues without missing any
+		if len(jobs) > 0 {
+			last := jobs[len(jobs)-1]
+			response["next_cursor"] = formatJobCursor(queue.JobCursor{UpdatedAtMs: last.UpdatedAt.UnixMilli(), JobID: last.ID})
+		}
+	}
+
+	rows := make([]jobRow, 0, len(jobs))
+	for _, job := range jobs {
+		rows = append(rows, jobRow{
+			JobID:     job.ID,
+			Owner:     job.Owner,
+			Model:     job.Model,
+			Priority:  job.Priority,
+			Attempts:  job.Attempts,
+			CreatedAt: job.CreatedAt,
+			UpdatedAt: job.UpdatedAt,
+		})
+	}
+	response["jobs"] = rows
+	response["total"] = total
+	c.JSON(http.StatusOK, response)
+}
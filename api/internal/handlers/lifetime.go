@@ -0,0 +1,87 @@
+package handlers
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"log"
+	"time"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// lifetimeBatch is how many overdue jobs one enforcement pass takes on
+const lifetimeBatch = 500
+
+// lifetimeMessage is the error recorded on jobs stopped at their lifetime
+const lifetimeMessage = "Job exceeded its maximum lifetime"
+
+// lifetimeTerminations counts jobs stopped at the end of their lifetime
+var lifetimeTerminations = expvar.NewInt("lifetime_terminations")
+
+// lifetimeStore is implemented by queues that bound how long jobs may stay
+// unfinished
+type lifetimeStore interface {
+	OverdueJobs(ctx context.Context, now time.Time, limit int64) ([]string, error)
+	ClearLifetime(ctx context.Context, jobID string) error
+	TerminateJob(ctx context.Context, job *queue.Job, message string) error
+}
+
+// EnforceLifetimes fails the jobs still pending or processing at the end of
+// their maximum lifetime, however often they were retried or requeued
+func (h *Handler) EnforceLifetimes(ctx context.Context) {
+	store, ok := h.jobQueue.(lifetimeStore)
+	if !ok {
+		return
+	}
+	now := h.clock.Now()
+	jobIDs, err := store.OverdueJobs(ctx, now, lifetimeBatch)
+	if err != nil {
+		log.Printf("Failed to list jobs past their lifetime: %v", err)
+		return
+	}
+	for _, jobID := range jobIDs {
+		if err := h.enforceLifetime(ctx, store, jobID, now); err != nil {
+			log.Printf("Failed to stop job %s at the end of its lifetime: %v", jobID, err)
+		}
+	}
+}
+
+// enforceLifetime stops one overdue job unless it has finished since
+func (h *Handler) enforceLifetime(ctx context.Context, store lifetimeStore, jobID string, now time.Time) error {
+	job, err := queue.NilIfNotFound(h.jobQueue.GetJob(ctx, jobID))
+	if err != nil {
+		return err
+	}
+	if job == nil || job.Status == queue.StatusCompleted || job.Status == queue.StatusFailed || job.Status == queue.StatusCancelled {
+		return store.ClearLifetime(ctx, jobID)
+	}
+	if job.LifetimeEndsAt().After(now) {
+		return nil
+	}
+
+	status := job.Status
+	if err := store.TerminateJob(ctx, job, lifetimeMessage); errors.Is(err, queue.ErrInvalidTransition) || errors.Is(err, queue.ErrVersionConflict) {
+		// It moved on or changed meanwhile; the next pass looks at it again
+		return nil
+	} else if err != nil {
+		return err
+	}
+	lifetimeTerminations.Add(1)
+	log.Printf("Stopped job %s, still %s %s after submission", job.ID, status, now.Sub(job.CreatedAt).Round(time.Second))
+	return nil
+}
+
+// remainingLifetime returns how long an unfinished job has left before it's
+// stopped, and false if its lifetime is unbounded
+func (h *Handler) remainingLifetime(job *queue.Job) (time.Duration, bool) {
+	at := job.LifetimeEndsAt()
+	if at.IsZero() {
+		return 0, false
+	}
+	remaining := at.Sub(h.clock.Now())
+	if remaining < 0 {
+		remaining = 0
+	}
+	return remaining, true
+}
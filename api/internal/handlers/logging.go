@@ -0,0 +1,53 @@
+package handlers
+
+import (
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// redactedQueryParams are query parameters whose values grant access and
+// must not end up in access logs
+var redactedQueryParams = []string{"signature", "sig", "token", "expires", "X-Amz-Signature", "X-Amz-Credential"}
+
+// AccessLogger returns the access-log middleware, which redacts access
+// tokens from logged paths
+func AccessLogger() gin.HandlerFunc {
+	return gin.LoggerWithFormatter(func(param gin.LogFormatterParams) string {
+		return fmt.Sprintf("[GIN] %v | %3d | %13v | %15s | %-7s %#v\n%s",
+			param.TimeStamp.Format(time.RFC3339),
+			param.StatusCode,
+			param.Latency,
+			param.ClientIP,
+			param.Method,
+			redactPath(param.Path),
+			param.ErrorMessage,
+		)
+	})
+}
+
+// redactPath replaces download tokens and signature parameters in a request path
+func redactPath(path string) string {
+	rawPath, rawQuery, hasQuery := strings.Cut(path, "?")
+
+	if prefix := "/api/download/by-token/"; strings.HasPrefix(rawPath, prefix) {
+		rawPath = prefix + "REDACTED"
+	}
+	if !hasQuery {
+		return rawPath
+	}
+
+	query, err := url.ParseQuery(rawQuery)
+	if err != nil {
+		return rawPath + "?REDACTED"
+	}
+	for _, name := range redactedQueryParams {
+		if query.Has(name) {
+			query.Set(name, "REDACTED")
+		}
+	}
+	return rawPath + "?" + query.Encode()
+}
@@ -0,0 +1,233 @@
+package handlers
+
+import (
+	"context"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/maintenance"
+	"rembg-v2/api/internal/queue"
+)
+
+// Audit log page sizes
+const (
+	defaultAuditEntries = 50
+	maxAuditEntries     = 1000
+)
+
+// maintenanceRetryAfter is the Retry-After, in seconds, for submissions
+// rejected by a pause no scheduled window explains
+const maintenanceRetryAfter = 60
+
+// maintenanceStore is implemented by queues with maintenance flags
+type maintenanceStore interface {
+	MaintenancePaused(ctx context.Context, flag string) (bool, error)
+	MaintenanceOverrides(ctx context.Context) (map[string]string, error)
+}
+
+// queuePauser is implemented by queues whose consumption can be paused
+type queuePauser interface {
+	Pause(ctx context.Context) error
+	Resume(ctx context.Context) error
+	IsPaused(ctx context.Context) (bool, error)
+}
+
+// auditReader is implemented by queues that keep an audit log
+type auditReader interface {
+	AuditLog(ctx context.Context, limit int64) ([]queue.AuditEntry, error)
+}
+
+// WithMaintenanceScheduler reports the scheduler's windows in the
+// capabilities document and admin stats
+func WithMaintenanceScheduler(s *maintenance.Scheduler) Option {
+	return func(h *Handler) {
+		h.maintenance = s
+	}
+}
+
+// submissionsOpen rejects a submission while submissions are paused for
+// maintenance. It writes a 503 and returns false when rejected.
+func (h *Handler) submissionsOpen(c *gin.Context) bool {
+	store, ok := h.jobQueue.(maintenanceStore)
+	if !ok {
+		return true
+	}
+	paused, err := store.MaintenancePaused(c.Request.Context(), queue.MaintenanceSubmissions)
+	if err != nil {
+		// The submission's own queue write will surface a real outage
+		log.Printf("Failed to read the maintenance flag, admitting submission: %v", err)
+		return true
+	}
+	if !paused {
+		return true
+	}
+
+	// Retry once the last window pausing submissions ends
+	retryAfter := maintenanceRetryAfter
+	if h.maintenance != nil {
+		now := h.clock.Now()
+		var ends time.Time
+		for _, o := range h.maintenance.Active(now) {
+			if o.Scope != maintenance.ScopeConsumption && o.EndsAt.After(ends) {
+				ends = o.EndsAt
+			}
+		}
+		if !ends.IsZero() {
+			retryAfter = int(math.Ceil(ends.Sub(now).Seconds()))
+		}
+	}
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"error":       "Submissions are paused for maintenance",
+		"retry_after": retryAfter,
+	})
+	return false
+}
+
+// PauseQueue stops workers claiming new jobs while those already claimed
+// finish, until ResumeQueue
+func (h *Handler) PauseQueue(c *gin.Context) {
+	h.setQueuePaused(c, true)
+}
+
+// ResumeQueue lets workers claim new jobs again
+func (h *Handler) ResumeQueue(c *gin.Context) {
+	h.setQueuePaused(c, false)
+}
+
+// setQueuePaused pauses or resumes consumption by hand, recording the change
+// in the audit log, and reports how many jobs are still being processed.
+// Only requests RequireAdmin admitted may, wherever the routes are mounted.
+func (h *Handler) setQueuePaused(c *gin.Context, paused bool) {
+	if !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Pausing the queue needs the admin key"})
+		return
+	}
+	pauser, ok := h.jobQueue.(queuePauser)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Queue backend does not support pausing"})
+		return
+	}
+	ctx := c.Request.Context()
+	action, set := "resume", pauser.Resume
+	if paused {
+		action, set = "pause", pauser.Pause
+	}
+	if err := set(ctx); err != nil {
+		log.Printf("Failed to %s the queue: %v", action, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to " + action + " the queue"})
+		return
+	}
+	if auditor, ok := h.jobQueue.(auditRecorder); ok {
+		entry := queue.AuditEntry{At: h.clock.Now(), Actor: "api:" + ownerID(c), Action: action, Target: queue.MaintenanceConsumption}
+		if err := auditor.RecordAudit(ctx, entry); err != nil {
+			log.Printf("Failed to record the queue %s: %v", action, err)
+		}
+	}
+
+	response := gin.H{"paused": paused}
+	if stats, err := h.jobQueue.Stats(ctx); err == nil {
+		response["processing"] = stats.Processing
+	} else {
+		log.Printf("Failed to read queue stats after the queue %s: %v", action, err)
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// queuePaused reports whether workers are stopped from claiming new jobs,
+// treating a flag that can't be read as not set
+func (h *Handler) queuePaused(ctx context.Context) bool {
+	pauser, ok := h.jobQueue.(queuePauser)
+	if !ok {
+		return false
+	}
+	paused, err := pauser.IsPaused(ctx)
+	if err != nil {
+		log.Printf("Failed to read the consumption maintenance flag: %v", err)
+		return false
+	}
+	return paused
+}
+
+// maintenanceWindows describes the active and upcoming maintenance windows
+func (h *Handler) maintenanceWindows() gin.H {
+	now := h.clock.Now()
+	active := h.maintenance.Active(now)
+	if active == nil {
+		active = []maintenance.Occurrence{}
+	}
+	upcoming := h.maintenance.Upcoming(now)
+	if upcoming == nil {
+		upcoming = []maintenance.Occurrence{}
+	}
+	return gin.H{"active": active, "upcoming": upcoming}
+}
+
+// maintenanceStatus describes the maintenance flags, the manual overrides,
+// and the scheduled windows, or nil if the queue has no maintenance flags
+func (h *Handler) maintenanceStatus(ctx context.Context) gin.H {
+	store, ok := h.jobQueue.(maintenanceStore)
+	if !ok {
+		return nil
+	}
+	status := gin.H{}
+	paused := make(map[string]bool, len(queue.MaintenanceFlags))
+	for _, flag := range queue.MaintenanceFlags {
+		on, err := store.MaintenancePaused(ctx, flag)
+		if err != nil {
+			log.Printf("Failed to read the %s maintenance flag: %v", flag, err)
+			return nil
+		}
+		paused[flag] = on
+	}
+	status["paused"] = paused
+	overrides, err := store.MaintenanceOverrides(ctx)
+	if err != nil {
+		log.Printf("Failed to read maintenance overrides: %v", err)
+		return nil
+	}
+	status["overrides"] = overrides
+	if h.maintenance != nil {
+		for key, value := range h.maintenanceWindows() {
+			status[key] = value
+		}
+	}
+	return status
+}
+
+// activeWindowNames lists the windows active now, for spotting boundaries
+func (h *Handler) activeWindowNames() string {
+	var names []string
+	for _, o := range h.maintenance.Active(h.clock.Now()) {
+		names = append(names, o.Window)
+	}
+	return strings.Join(names, ",")
+}
+
+// AuditLog lists the most recent operational changes, newest first
+func (h *Handler) AuditLog(c *gin.Context) {
+	reader, ok := h.jobQueue.(auditReader)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "The audit log is not supported"})
+		return
+	}
+
+	limit, err := strconv.ParseInt(c.DefaultQuery("limit", strconv.Itoa(defaultAuditEntries)), 10, 64)
+	if err != nil || limit <= 0 || limit > maxAuditEntries {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "limit must be between 1 and 1000"})
+		return
+	}
+
+	entries, err := reader.AuditLog(c.Request.Context(), limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read the audit log"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{"entries": entries})
+}
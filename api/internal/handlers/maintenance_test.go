@@ -0,0 +1,48 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestPauseQueueNeedsAdmin(t *testing.T) {
+	h, jobs := newRedisTestHandler(t)
+	ctx := context.Background()
+
+	router := gin.New()
+	router.POST("/open/pause", h.PauseQueue)
+	admin := router.Group("/admin", h.RequireAdmin)
+	admin.POST("/pause", h.PauseQueue)
+	admin.POST("/resume", h.ResumeQueue)
+
+	for _, tc := range []struct {
+		name     string
+		path     string
+		adminKey string
+		want     int
+	}{
+		{"outside the admin group", "/open/pause", testAdminKey, http.StatusForbidden},
+		{"without the key", "/admin/pause", "", http.StatusUnauthorized},
+		{"with a wrong key", "/admin/pause", "guess", http.StatusUnauthorized},
+	} {
+		if w := serveTest(router, http.MethodPost, tc.path, nil, tc.adminKey); w.Code != tc.want {
+			t.Errorf("%s: got %d, want %d: %s", tc.name, w.Code, tc.want, w.Body)
+		}
+		if paused, err := jobs.IsPaused(ctx); err != nil || paused {
+			t.Fatalf("%s: paused %v, %v", tc.name, paused, err)
+		}
+	}
+
+	if w := serveTest(router, http.MethodPost, "/admin/pause", nil, testAdminKey); w.Code != http.StatusOK {
+		t.Fatalf("pause with the admin key: got %d: %s", w.Code, w.Body)
+	}
+	if w := serveTest(router, http.MethodPost, "/admin/resume", nil, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("resume without the key: got %d", w.Code)
+	}
+	if paused, err := jobs.IsPaused(ctx); err != nil || !paused {
+		t.Fatalf("after the admin pause and a rejected resume: paused %v, %v", paused, err)
+	}
+}
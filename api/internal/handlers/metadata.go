@@ -0,0 +1,44 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+
+	"github.com/gin-gonic/gin"
+)
+
+// maxMetadataBytes bounds a job's metadata, counting every key and value
+const maxMetadataBytes = 4096
+
+// metadataKeyPattern is what a metadata key may look like
+var metadataKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_.-]{1,64}$`)
+
+// parseMetadata reads the optional JSON object of strings the client
+// attaches to a job from the submission form, e.g.
+// {"user_id":"42","correlation_id":"abc"}, returned with the job unchanged
+func parseMetadata(c *gin.Context) (map[string]string, error) {
+	value := c.PostForm("metadata")
+	if value == "" {
+		return nil, nil
+	}
+	var metadata map[string]string
+	if err := json.Unmarshal([]byte(value), &metadata); err != nil || metadata == nil {
+		return nil, fmt.Errorf("metadata must be a JSON object of string values")
+	}
+
+	size := 0
+	for key, v := range metadata {
+		if !metadataKeyPattern.MatchString(key) {
+			return nil, fmt.Errorf("metadata key %q must be 1 to 64 letters, digits, '_', '.', or '-'", key)
+		}
+		size += len(key) + len(v)
+	}
+	if size > maxMetadataBytes {
+		return nil, fmt.Errorf("metadata is %d bytes, more than the %d allowed", size, maxMetadataBytes)
+	}
+	if len(metadata) == 0 {
+		return nil, nil
+	}
+	return metadata, nil
+}
@@ -0,0 +1,108 @@
+package handlers
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// orphanedFiles counts the files the orphan sweep removed and the bytes it
+// reclaimed
+var orphanedFiles = expvar.NewMap("orphaned_files")
+
+// storedFileOwner matches the job or fanout ID every stored file is named
+// after, followed by its extension or a suffix such as -output
+var storedFileOwner = regexp.MustCompile(`^([0-9a-f]{16})[.-]`)
+
+// inputReferencer is implemented by queues that count the jobs sharing an input
+type inputReferencer interface {
+	InputReferenced(ctx context.Context, inputPath string) (bool, error)
+}
+
+// SweepOrphanedFiles removes the files in the upload and results
+// directories whose job no longer exists, which the retention sweep never
+// sees once a record has expired on its own, and, with ORPHAN_FILE_MAX_AGE_SECONDS
+// set, those of finished jobs created longer ago than that. Files younger
+// than ORPHAN_FILE_GRACE_SECONDS are left alone, so an upload saved before
+// its job is queued isn't taken for an orphan, and a file whose job can't
+// be looked up is kept.
+func (h *Handler) SweepOrphanedFiles(ctx context.Context) {
+	now := h.clock.Now()
+	// Whether each ID's files are still wanted, looked up once per sweep
+	live := make(map[string]bool)
+	var files, bytes int64
+	for _, dir := range []string{h.uploadDir, h.resultsDir} {
+		entries, err := h.fs.ReadDir(dir)
+		if err != nil {
+			h.recordStorage(err)
+			log.Printf("Failed to list %s for orphaned files: %v", dir, err)
+			continue
+		}
+		for _, entry := range entries {
+			if ctx.Err() != nil {
+				return
+			}
+			match := storedFileOwner.FindStringSubmatch(entry.Name())
+			if entry.IsDir() || match == nil {
+				continue
+			}
+			info, err := entry.Info()
+			if err != nil || now.Sub(info.ModTime()) < h.orphanGrace {
+				continue
+			}
+
+			path := filepath.Join(dir, entry.Name())
+			wanted, ok := live[match[1]]
+			if !ok {
+				if wanted, err = h.fileWanted(ctx, match[1], path, now); err != nil {
+					log.Printf("Failed to look up the owner of %s: %v", path, err)
+					continue
+				}
+				live[match[1]] = wanted
+			}
+			if wanted {
+				continue
+			}
+
+			if err := h.fs.Remove(path); err != nil && !os.IsNotExist(err) {
+				h.recordStorage(err)
+				log.Printf("Failed to remove orphaned file %s: %v", path, err)
+				continue
+			}
+			h.invalidateCachedResult(path)
+			files++
+			bytes += info.Size()
+		}
+	}
+
+	orphanedFiles.Add("files", files)
+	orphanedFiles.Add("bytes", bytes)
+	if files > 0 {
+		log.Printf("Removed %d orphaned files, reclaiming %d bytes", files, bytes)
+	}
+}
+
+// fileWanted reports whether the files named after id, such as path, still
+// belong to a job: one that exists and, with a maximum age, is unfinished
+// or younger than it. Files named after no job may be shared fanout
+// inputs, kept while any job references them.
+func (h *Handler) fileWanted(ctx context.Context, id, path string, now time.Time) (bool, error) {
+	job, err := queue.NilIfNotFound(h.jobQueue.GetJob(ctx, id))
+	if err != nil {
+		return false, err
+	}
+	if job != nil {
+		finished := job.Status == queue.StatusCompleted || job.Status == queue.StatusFailed || job.Status == queue.StatusCancelled
+		return !(finished && h.orphanMaxAge > 0 && now.Sub(job.CreatedAt) > h.orphanMaxAge), nil
+	}
+	if referencer, ok := h.jobQueue.(inputReferencer); ok {
+		return referencer.InputReferenced(ctx, path)
+	}
+	return false, nil
+}
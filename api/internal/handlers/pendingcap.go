@@ -0,0 +1,90 @@
+package handlers
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+const (
+	// throughputWindow is how far back finished jobs are counted to estimate
+	// when a full queue will have room
+	throughputWindow = 5 * time.Minute
+	// maxPendingRetryAfter caps the Retry-After, in seconds, of submissions
+	// refused while the queue is full
+	maxPendingRetryAfter = 600
+)
+
+// pendingCapRejections counts submissions refused because the pending queue
+// was at MAX_PENDING_JOBS
+var pendingCapRejections = expvar.NewInt("pending_cap_rejections")
+
+// pendingCounter is implemented by queues that can count their pending jobs
+// with a single cheap read
+type pendingCounter interface {
+	PendingCount(ctx context.Context) (int64, error)
+}
+
+// admitPending refuses a submission with 429 while MAX_PENDING_JOBS or more
+// jobs are pending. It runs before the upload is read, so a refused
+// request leaves no file behind, and returns false when it refused.
+func (h *Handler) admitPending(c *gin.Context) bool {
+	counter, ok := h.jobQueue.(pendingCounter)
+	if h.maxPendingJobs <= 0 || !ok {
+		return true
+	}
+
+	ctx := c.Request.Context()
+	pending, err := counter.PendingCount(ctx)
+	if err != nil {
+		// The submission's own queue write will surface a real outage
+		log.Printf("Failed to count pending jobs, admitting submission: %v", err)
+		return true
+	}
+	if pending < h.maxPendingJobs {
+		return true
+	}
+
+	retryAfter := h.pendingRetryAfter(ctx, pending-h.maxPendingJobs+1)
+	pendingCapRejections.Add(1)
+	c.Header("Retry-After", strconv.Itoa(retryAfter))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":       "Too many jobs are pending, try again later",
+		"pending":     pending,
+		"max_pending": h.maxPendingJobs,
+		"retry_after": retryAfter,
+	})
+	return false
+}
+
+// pendingRetryAfter estimates, in seconds, how long the workers take to
+// finish excess jobs at the rate they finished jobs over the last few
+// minutes, or falls back to the backpressure default when the queue doesn't
+// count outcomes or none finished
+func (h *Handler) pendingRetryAfter(ctx context.Context, excess int64) int {
+	store, ok := h.jobQueue.(outcomeStore)
+	if !ok {
+		return backpressureRetryAfter
+	}
+	now := h.clock.Now()
+	counts, err := store.OutcomeCounts(ctx, now.Add(-throughputWindow), now)
+	if err != nil || counts["total"] <= 0 {
+		return backpressureRetryAfter
+	}
+
+	perSecond := float64(counts["total"]) / throughputWindow.Seconds()
+	seconds := int(math.Ceil(float64(excess) / perSecond))
+	if seconds < 1 {
+		return 1
+	}
+	if seconds > maxPendingRetryAfter {
+		return maxPendingRetryAfter
+	}
+	return seconds
+}
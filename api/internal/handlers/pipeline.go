@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+)
+
+// Post-processing stages, in their default order
+const (
+	stageTrim      = "trim"
+	stageShadow    = "shadow"
+	stageComposite = "composite"
+	stageResize    = "resize"
+	stageEncode    = "encode"
+)
+
+// maxPipelineStages bounds explicit pipelines, which may repeat stages
+const maxPipelineStages = 10
+
+// maxOutputSize is the largest max_size a client may request
+const maxOutputSize = 8192
+
+// stageTransitions is the DAG of allowed orderings: each stage lists the
+// stages that may directly follow it. Encode must come last.
+var stageTransitions = map[string][]string{
+	stageTrim:      {stageShadow, stageComposite, stageResize, stageEncode},
+	stageShadow:    {stageComposite, stageResize, stageEncode},
+	stageComposite: {stageResize, stageEncode},
+	stageResize:    {stageTrim, stageShadow, stageComposite, stageResize, stageEncode},
+	stageEncode:    {},
+}
+
+// alphaStages need a transparent image, so they can't run after composite
+var alphaStages = map[string]bool{
+	stageTrim:   true,
+	stageShadow: true,
+}
+
+var hexColor = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+
+// Ways the composite stage blends the image over its background
+const (
+	// compositeLinear blends in linear light, avoiding dark fringes on soft edges
+	compositeLinear = "linear"
+	// compositeFast blends sRGB bytes directly, as before
+	compositeFast = "fast"
+)
+
+// parsePostProcessing reads the post-processing options and optional
+// explicit pipeline from the submission form
+func parsePostProcessing(c *gin.Context) (map[string]string, []string, error) {
+	return parseOptionSet(c.PostForm)
+}
+
+// parseOptionSet reads the post-processing options and optional explicit
+// pipeline with get, which returns "" for options that aren't set
+func parseOptionSet(get func(name string) string) (map[string]string, []string, error) {
+	options := make(map[string]string)
+
+	for _, name := range []string{"trim", "shadow"} {
+		if value := get(name); value != "" {
+			if value != "true" && value != "false" {
+				return nil, nil, fmt.Errorf("%s must be true or false", name)
+			}
+			if value == "true" {
+				options[name] = value
+			}
+		}
+	}
+	if value := get("background"); value != "" {
+		if !hexColor.MatchString(value) {
+			return nil, nil, fmt.Errorf("background must be a #rrggbb color")
+		}
+		options["background"] = strings.ToLower(value)
+	}
+	// Compositing is linear unless the fast path is asked for, so only fast is recorded
+	if value := get("composite_mode"); value != "" {
+		if value != compositeLinear && value != compositeFast {
+			return nil, nil, fmt.Errorf("composite_mode must be %s or %s", compositeLinear, compositeFast)
+		}
+		if value == compositeFast {
+			options["composite_mode"] = value
+		}
+	}
+	if value := get("max_size"); value != "" {
+		n, err := strconv.Atoi(value)
+		if err != nil || n <= 0 || n > maxOutputSize {
+			return nil, nil, fmt.Errorf("max_size must be between 1 and %d", maxOutputSize)
+		}
+		options["max_size"] = value
+	}
+	// Input alpha is respected unless disabled, so only false is recorded
+	if value := get("respect_input_alpha"); value != "" {
+		if value != "true" && value != "false" {
+			return nil, nil, fmt.Errorf("respect_input_alpha must be true or false")
+		}
+		if value == "false" {
+			options["respect_input_alpha"] = value
+		}
+	}
+	if value := get("format"); value != "" {
+		if value != "png" && value != "webp" {
+			return nil, nil, fmt.Errorf("format must be png or webp")
+		}
+		options["format"] = value
+	}
+
+	var pipeline []string
+	if value := get("pipeline"); value != "" {
+		if err := json.Unmarshal([]byte(value), &pipeline); err != nil {
+			return nil, nil, fmt.Errorf("pipeline must be a JSON array of stage names")
+		}
+		if err := validatePipeline(pipeline, options); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	return options, pipeline, nil
+}
+
+// validatePipeline checks an explicit stage order against the allowed
+// transitions and the options the stages need
+func validatePipeline(pipeline []string, options map[string]string) error {
+	if len(pipeline) == 0 || len(pipeline) > maxPipelineStages {
+		return fmt.Errorf("pipeline must have between 1 and %d stages", maxPipelineStages)
+	}
+	if pipeline[len(pipeline)-1] != stageEncode {
+		return fmt.Errorf("pipeline must end with %s", stageEncode)
+	}
+
+	composited := false
+	for i, stage := range pipeline {
+		if _, ok := stageTransitions[stage]; !ok {
+			return fmt.Errorf("unknown pipeline stage %q", stage)
+		}
+		if i > 0 && !allowedAfter(pipeline[i-1], stage) {
+			return fmt.Errorf("stage %s cannot follow %s", stage, pipeline[i-1])
+		}
+		if composited && alphaStages[stage] {
+			return fmt.Errorf("stage %s needs transparency and cannot run after %s", stage, stageComposite)
+		}
+
+		switch stage {
+		case stageComposite:
+			if options["background"] == "" {
+				return fmt.Errorf("stage %s requires a background color", stage)
+			}
+			composited = true
+		case stageResize:
+			if options["max_size"] == "" {
+				return fmt.Errorf("stage %s requires max_size", stage)
+			}
+		}
+	}
+	return nil
+}
+
+func allowedAfter(prev, next string) bool {
+	for _, stage := range stageTransitions[prev] {
+		if stage == next {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,105 @@
+package handlers
+
+import (
+	"context"
+	"expvar"
+	"math"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// Bounds on the polling interval suggested to clients
+const (
+	minPollInterval = 500 * time.Millisecond
+	maxPollInterval = 15 * time.Second
+	// defaultProcessingTime is assumed until workers have reported real timings
+	defaultProcessingTime = 5 * time.Second
+)
+
+var (
+	// resultPolls counts status polls for unfinished jobs
+	resultPolls = expvar.NewInt("result_polls")
+	// resultPollsUntilDone buckets how many polls clients needed per finished job
+	resultPollsUntilDone = expvar.NewMap("result_polls_until_done")
+)
+
+// pollTracker is implemented by queues that can compute polling hints
+type pollTracker interface {
+	QueuePosition(ctx context.Context, job *queue.Job) (int64, error)
+	AverageProcessingTime(ctx context.Context) (time.Duration, error)
+	RecordPoll(ctx context.Context, jobID string) (int64, error)
+	TakePollCount(ctx context.Context, jobID string) (int64, error)
+}
+
+// pollHint records the poll and returns how long the client should wait
+// before polling again, or zero for finished jobs or unsupported queues
+func (h *Handler) pollHint(ctx context.Context, job *queue.Job) time.Duration {
+	tracker, ok := h.jobQueue.(pollTracker)
+	if !ok {
+		return 0
+	}
+
+	switch job.Status {
+	case queue.StatusPending, queue.StatusProcessing, queue.StatusScheduled, queue.StatusRetrying:
+	default:
+		if count, err := tracker.TakePollCount(ctx, job.ID); err == nil && count > 0 {
+			resultPollsUntilDone.Add(pollBucket(count), 1)
+		}
+		return 0
+	}
+
+	resultPolls.Add(1)
+	tracker.RecordPoll(ctx, job.ID)
+
+	avg, err := tracker.AverageProcessingTime(ctx)
+	if err != nil || avg <= 0 {
+		avg = defaultProcessingTime
+	}
+
+	// Poll a few times per expected processing time once running; while
+	// queued, wait roughly for the jobs ahead to drain, and while scheduled
+	// or retrying, until the job is due
+	hint := avg / 4
+	switch job.Status {
+	case queue.StatusPending:
+		if position, err := tracker.QueuePosition(ctx, job); err == nil && position > 0 {
+			hint = time.Duration(position) * avg / 2
+		}
+	case queue.StatusScheduled, queue.StatusRetrying:
+		hint = job.ScheduledUntil().Sub(h.clock.Now())
+	}
+
+	if hint < minPollInterval {
+		hint = minPollInterval
+	}
+	if hint > maxPollInterval {
+		hint = maxPollInterval
+	}
+	return hint
+}
+
+// setRetryAfter adds the polling hint to the response body and headers
+func setRetryAfter(c *gin.Context, result gin.H, hint time.Duration) {
+	if hint <= 0 {
+		return
+	}
+	result["retry_after_ms"] = hint.Milliseconds()
+	c.Header("Retry-After", strconv.Itoa(int(math.Ceil(hint.Seconds()))))
+}
+
+// pollBucket returns the histogram bucket for a poll count
+func pollBucket(count int64) string {
+	switch {
+	case count <= 1:
+		return "1"
+	case count <= 5:
+		return "2-5"
+	case count <= 20:
+		return "6-20"
+	}
+	return "21+"
+}
@@ -0,0 +1,162 @@
+package handlers
+
+import (
+	"expvar"
+	"fmt"
+	"image"
+	"image/png"
+	"net/http"
+	"path/filepath"
+
+	"github.com/gin-gonic/gin"
+	"golang.org/x/image/draw"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// previewSize is the longest side of an input preview, in pixels
+const previewSize = 320
+
+// previews counts input previews made and skipped
+var previews = expvar.NewMap("input_previews")
+
+// previewPath is where a job's input preview is stored
+func (h *Handler) previewPath(jobID string) string {
+	return filepath.Join(h.resultsDir, jobID+".preview.png")
+}
+
+// previewURL is where a job's input preview is downloaded
+func previewURL(jobID string) string {
+	return fmt.Sprintf("/api/download/%s/preview", jobID)
+}
+
+// addPreview makes a thumbnail of the job's input, tracked by slot so it's
+// removed with the upload if the submission fails, and records it as the
+// job's input preview. Inputs that can't be previewed within the pixel limit
+// get a warning instead, so submission latency stays bounded.
+func (h *Handler) addPreview(slot *upload, job *queue.Job) {
+	if err := h.makePreview(slot, job.InputPath, h.previewPath(job.ID)); err != nil {
+		previews.Add("skipped", 1)
+		job.AddWarning(queue.Warning{
+			Code:    queue.WarningPreviewSkipped,
+			Message: "No preview was made: " + err.Error(),
+		})
+		return
+	}
+	previews.Add("made", 1)
+	job.Outputs = append(job.Outputs, queue.Output{Kind: queue.OutputInputPreview, Path: h.previewPath(job.ID)})
+}
+
+// makePreview writes a PNG of the image at src scaled to fit previewSize,
+// checking its dimensions before decoding its pixels
+func (h *Handler) makePreview(slot *upload, src, dst string) error {
+	if !h.directDownloads() {
+		return fmt.Errorf("direct downloads are disabled")
+	}
+	f, err := h.fs.Open(src)
+	if err != nil {
+		return fmt.Errorf("the image can't be read")
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return fmt.Errorf("the image format isn't supported")
+	}
+	if int64(cfg.Width)*int64(cfg.Height) > h.previewMaxPixels {
+		return fmt.Errorf("the image is %dx%d, larger than the preview limit of %d pixels", cfg.Width, cfg.Height, h.previewMaxPixels)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return fmt.Errorf("the image can't be read")
+	}
+	img, _, err := image.Decode(f)
+	if err != nil {
+		return fmt.Errorf("the image can't be decoded")
+	}
+
+	bounds := img.Bounds()
+	width, height := bounds.Dx(), bounds.Dy()
+	if width > previewSize || height > previewSize {
+		if width >= height {
+			width, height = previewSize, height*previewSize/width
+		} else {
+			width, height = width*previewSize/height, previewSize
+		}
+	}
+	// Keep very narrow images at least a pixel across
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	thumbnail := image.NewNRGBA(image.Rect(0, 0, width, height))
+	draw.ApproxBiLinear.Scale(thumbnail, thumbnail.Bounds(), img, bounds, draw.Src, nil)
+
+	slot.track(dst)
+	out, err := h.fs.Create(dst)
+	h.recordStorage(err)
+	if err != nil {
+		return fmt.Errorf("it couldn't be stored")
+	}
+	if err := png.Encode(out, thumbnail); err != nil {
+		out.Close()
+		return fmt.Errorf("it couldn't be stored")
+	}
+	if err := out.Close(); err != nil {
+		h.recordStorage(err)
+		return fmt.Errorf("it couldn't be stored")
+	}
+	return nil
+}
+
+// previewAvailable reports whether the job's input preview can still be
+// downloaded; it's removed along with the input
+func (h *Handler) previewAvailable(job *queue.Job) bool {
+	if job.Output(queue.OutputInputPreview) == nil || h.expired(job) {
+		return false
+	}
+	at := job.InputExpiresAt()
+	return at.IsZero() || h.clock.Now().Before(at)
+}
+
+// DownloadPreview serves the thumbnail of a job's input made at submission,
+// available from the 202 response onwards, before the job is processed
+func (h *Handler) DownloadPreview(c *gin.Context) {
+	if !h.directDownloads() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Direct downloads are disabled"})
+		return
+	}
+	jobID := c.Param("id")
+	if h.rejectCaseVariant(c, jobID) {
+		return
+	}
+	job, err := queue.NilIfNotFound(h.jobQueue.GetJob(c.Request.Context(), jobID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve job"})
+		return
+	}
+	if job == nil || !h.previewAvailable(job) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Preview not available"})
+		return
+	}
+	if !h.storageAvailable(c) {
+		return
+	}
+	c.Header("Referrer-Policy", "no-referrer")
+	c.Header("Content-Type", queue.FormatMediaType(queue.FormatPNG))
+	if !h.serveFile(c, job.Output(queue.OutputInputPreview).Path) {
+		c.Header("Content-Type", "application/json; charset=utf-8")
+		c.JSON(http.StatusNotFound, gin.H{"error": "Preview not available"})
+	}
+}
+
+// removeOutputs deletes the job's other stored files, which go with its input
+func (h *Handler) removeOutputs(job *queue.Job) error {
+	for _, output := range job.Outputs {
+		if err := h.removeFile(output.Path); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package handlers
+
+import (
+	"context"
+	"log"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// progressReader is implemented by queues whose workers report how far
+// each job's processing has got
+type progressReader interface {
+	LoadProgress(ctx context.Context, job *queue.Job) error
+}
+
+// loadProgress fills in the progress reported for a job being processed,
+// and reports whether there was any
+func (h *Handler) loadProgress(ctx context.Context, job *queue.Job) bool {
+	reader, ok := h.jobQueue.(progressReader)
+	if !ok || job.Status != queue.StatusProcessing {
+		return false
+	}
+	if err := reader.LoadProgress(ctx, job); err != nil {
+		log.Printf("Failed to read the progress of job %s: %v", job.ID, err)
+		return false
+	}
+	return job.Stage != ""
+}
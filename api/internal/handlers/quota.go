@@ -0,0 +1,194 @@
+package handlers
+
+import (
+	"context"
+	"image"
+	_ "image/gif"  // register GIF for DecodeConfig
+	_ "image/jpeg" // register JPEG for DecodeConfig
+	_ "image/png"  // register PNG for DecodeConfig
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	_ "golang.org/x/image/webp" // register WebP for DecodeConfig
+
+	"rembg-v2/api/internal/queue"
+)
+
+// quotaStore is implemented by queues that track per-owner usage
+type quotaStore interface {
+	ReserveQuota(ctx context.Context, owner string, milliMegapixels int64, limits queue.QuotaLimits) (bool, queue.QuotaUsage, error)
+	GetQuotaUsage(ctx context.Context, owner string) (queue.QuotaUsage, error)
+	RefundQuota(ctx context.Context, job *queue.Job) error
+}
+
+// quotaLimitsFromEnv reads the daily limits of each tier; megapixels may be
+// fractional. QUOTA_<TIER>_* settings override the shared QUOTA_* limits.
+func quotaLimitsFromEnv() map[string]queue.QuotaLimits {
+	limits := make(map[string]queue.QuotaLimits, len(queue.Tiers))
+	for _, tier := range queue.Tiers {
+		prefix := "QUOTA_" + strings.ToUpper(tier) + "_"
+		requests, _ := strconv.ParseInt(getEnv(prefix+"REQUESTS_PER_DAY", getEnv("QUOTA_REQUESTS_PER_DAY", "0")), 10, 64)
+		megapixels, _ := strconv.ParseFloat(getEnv(prefix+"MEGAPIXELS_PER_DAY", getEnv("QUOTA_MEGAPIXELS_PER_DAY", "0")), 64)
+		limits[tier] = queue.QuotaLimits{
+			Requests:        requests,
+			MilliMegapixels: int64(megapixels * 1000),
+		}
+	}
+	return limits
+}
+
+// quotasEnabled reports whether submissions are charged against a quota
+func (h *Handler) quotasEnabled() bool {
+	if _, ok := h.jobQueue.(quotaStore); !ok {
+		return false
+	}
+	for _, limits := range h.quotaLimits {
+		if limits.Requests > 0 || limits.MilliMegapixels > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// ownerID identifies who a request is charged to: the authenticated
+// owner if there is one, otherwise the client IP. The IP only counts
+// usage; it never authorizes acting on a job, see requireCredentials.
+func ownerID(c *gin.Context) string {
+	if owner := c.GetString(ownerContextKey); owner != "" {
+		return owner
+	}
+	return c.ClientIP()
+}
+
+// imageMilliMegapixels reads the dimensions of the image at path without
+// decoding its pixels and returns its size in thousandths of a megapixel
+func imageMilliMegapixels(fsys FS, path string) (int64, error) {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return 0, err
+	}
+
+	// Round up so tiny images still cost something
+	pixels := int64(cfg.Width) * int64(cfg.Height)
+	return (pixels + 999) / 1000, nil
+}
+
+// reserveQuota charges the job to its owner's quota, recording the
+// reservation on the job so a server-side failure can refund it.
+// It writes the error response and returns false if the job can't be submitted.
+func (h *Handler) reserveQuota(c *gin.Context, job *queue.Job) bool {
+	limits := h.quotaLimits[job.Tier]
+	milliMegapixels, err := imageMilliMegapixels(h.fs, job.InputPath)
+	if err != nil {
+		if limits.MilliMegapixels > 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "Could not read image dimensions", "error_code": queue.ErrorCodeInvalidImage})
+			return false
+		}
+		milliMegapixels = 0
+	}
+
+	now := h.clock.Now()
+	allowed, usage, err := h.jobQueue.(quotaStore).ReserveQuota(c.Request.Context(), job.Owner, milliMegapixels, limits)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to check quota"})
+		return false
+	}
+	setQuotaHeaders(c, limits, usage)
+
+	if !allowed {
+		c.Header("Retry-After", strconv.Itoa(int(usage.ResetAt.Sub(now).Seconds())+1))
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "Daily quota exceeded", "tier": job.Tier, "usage": usageResponse(limits, usage)})
+		return false
+	}
+
+	job.MilliMegapixels = milliMegapixels
+	job.QuotaDay = usage.Day
+	return true
+}
+
+// refundQuota returns a failed job's reservation to its owner. Call it at
+// every transition into the failed status; the queue makes it idempotent.
+func (h *Handler) refundQuota(ctx context.Context, job *queue.Job) {
+	store, ok := h.jobQueue.(quotaStore)
+	if !ok {
+		return
+	}
+	if err := store.RefundQuota(ctx, job); err != nil {
+		log.Printf("Failed to refund quota for job %s: %v", job.ID, err)
+	}
+}
+
+// setQuotaHeaders reports the remaining request and megapixel budgets
+func setQuotaHeaders(c *gin.Context, limits queue.QuotaLimits, usage queue.QuotaUsage) {
+	if limits.Requests > 0 {
+		c.Header("X-Quota-Requests-Limit", strconv.FormatInt(limits.Requests, 10))
+		c.Header("X-Quota-Requests-Remaining", strconv.FormatInt(remaining(limits.Requests, usage.Requests), 10))
+	}
+	if limits.MilliMegapixels > 0 {
+		c.Header("X-Quota-Megapixels-Limit", formatMegapixels(limits.MilliMegapixels))
+		c.Header("X-Quota-Megapixels-Remaining", formatMegapixels(remaining(limits.MilliMegapixels, usage.MilliMegapixels)))
+	}
+	c.Header("X-Quota-Reset", usage.ResetAt.Format(time.RFC3339))
+}
+
+// usageResponse describes usage against both budgets; a null limit is unlimited
+func usageResponse(limits queue.QuotaLimits, usage queue.QuotaUsage) gin.H {
+	requests := gin.H{"used": usage.Requests, "limit": nil, "remaining": nil}
+	if limits.Requests > 0 {
+		requests["limit"] = limits.Requests
+		requests["remaining"] = remaining(limits.Requests, usage.Requests)
+	}
+
+	megapixels := gin.H{"used": float64(usage.MilliMegapixels) / 1000, "limit": nil, "remaining": nil}
+	if limits.MilliMegapixels > 0 {
+		megapixels["limit"] = float64(limits.MilliMegapixels) / 1000
+		megapixels["remaining"] = float64(remaining(limits.MilliMegapixels, usage.MilliMegapixels)) / 1000
+	}
+
+	return gin.H{
+		"requests":   requests,
+		"megapixels": megapixels,
+		"reset_at":   usage.ResetAt.Format(time.RFC3339),
+	}
+}
+
+// GetUsage reports the caller's usage for the current day against their tier's limits
+func (h *Handler) GetUsage(c *gin.Context) {
+	if !h.quotasEnabled() {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Quotas are disabled"})
+		return
+	}
+
+	usage, err := h.jobQueue.(quotaStore).GetQuotaUsage(c.Request.Context(), ownerID(c))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve usage"})
+		return
+	}
+
+	tier := callerTier(c)
+	setQuotaHeaders(c, h.quotaLimits[tier], usage)
+	response := usageResponse(h.quotaLimits[tier], usage)
+	response["tier"] = tier
+	c.JSON(http.StatusOK, response)
+}
+
+func remaining(limit, used int64) int64 {
+	if used >= limit {
+		return 0
+	}
+	return limit - used
+}
+
+func formatMegapixels(milli int64) string {
+	return strconv.FormatFloat(float64(milli)/1000, 'f', -1, 64)
+}
@@ -0,0 +1,188 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"expvar"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// recentReadRetryDelay is how long a status read of a just-accepted job
+// that wasn't found waits before reading it again
+const recentReadRetryDelay = 50 * time.Millisecond
+
+// recentReads counts status reads of just-accepted jobs that weren't found
+// at first, by whether a retry found them or pending was answered instead
+var recentReads = expvar.NewMap("recent_job_reads")
+
+// recentJobStore is implemented by queues that can mark jobs as just
+// accepted, so every replica can vouch for them
+type recentJobStore interface {
+	MarkRecentJobs(ctx context.Context, ttl time.Duration, jobIDs ...string) error
+	ForgetRecentJob(ctx context.Context, jobID string) error
+	IsRecentJob(ctx context.Context, jobID string) (bool, error)
+}
+
+// recentJobs remembers the jobs this replica accepted within the window
+type recentJobs struct {
+	window time.Duration
+
+	mu sync.Mutex
+	// order holds acceptances oldest first, for pruning
+	order []recentJob
+	at    map[string]time.Time
+}
+
+type recentJob struct {
+	id string
+	at time.Time
+}
+
+func newRecentJobs(window time.Duration) *recentJobs {
+	return &recentJobs{window: window, at: make(map[string]time.Time)}
+}
+
+// add records jobs accepted at now, forgetting those past the window
+func (r *recentJobs) add(now time.Time, jobIDs ...string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for len(r.order) > 0 && now.Sub(r.order[0].at) >= r.window {
+		if oldest := r.order[0]; r.at[oldest.id].Equal(oldest.at) {
+			delete(r.at, oldest.id)
+		}
+		r.order = r.order[1:]
+	}
+	for _, id := range jobIDs {
+		r.order = append(r.order, recentJob{id: id, at: now})
+		r.at[id] = now
+	}
+}
+
+// remove forgets a job
+func (r *recentJobs) remove(jobID string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.at, jobID)
+}
+
+// contains reports whether the job was accepted within the window before now
+func (r *recentJobs) contains(now time.Time, jobID string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	at, ok := r.at[jobID]
+	return ok && now.Sub(at) < r.window
+}
+
+// statusHintKeyFromEnv returns the key signing status hints. Without
+// STATUS_HINT_KEY each replica picks its own, so hints only vouch for jobs
+// on the replica that accepted them.
+func statusHintKeyFromEnv() []byte {
+	if key := getEnv("STATUS_HINT_KEY", ""); key != "" {
+		return []byte(key)
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		log.Printf("Failed to generate a status hint key: %v", err)
+	}
+	return key
+}
+
+// rememberJobs marks jobs about to be queued as just accepted
+func (h *Handler) rememberJobs(ctx context.Context, jobIDs ...string) {
+	if h.recent == nil {
+		return
+	}
+	h.recent.add(h.clock.Now(), jobIDs...)
+	if store, ok := h.jobQueue.(recentJobStore); ok {
+		if err := store.MarkRecentJobs(ctx, h.recent.window, jobIDs...); err != nil {
+			log.Printf("Failed to mark jobs as recently accepted: %v", err)
+		}
+	}
+}
+
+// forgetJob unmarks a job that couldn't be queued after all
+func (h *Handler) forgetJob(ctx context.Context, jobID string) {
+	if h.recent == nil {
+		return
+	}
+	h.recent.remove(jobID)
+	if store, ok := h.jobQueue.(recentJobStore); ok {
+		if err := store.ForgetRecentJob(ctx, jobID); err != nil {
+			log.Printf("Failed to unmark job %s as recently accepted: %v", jobID, err)
+		}
+	}
+}
+
+// statusHint returns a signed token vouching that jobID was accepted at at.
+// Clients pass it back as the hint parameter of GET /api/result.
+func (h *Handler) statusHint(jobID string, at time.Time) string {
+	ms := strconv.FormatInt(at.UnixMilli(), 36)
+	return ms + "." + h.statusHintMAC(jobID, ms)
+}
+
+func (h *Handler) statusHintMAC(jobID, ms string) string {
+	mac := hmac.New(sha256.New, h.hintKey)
+	mac.Write([]byte(jobID + "." + ms))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil)[:16])
+}
+
+// validStatusHint reports whether hint vouches for jobID having been
+// accepted within the window, tolerating clock skew between replicas
+func (h *Handler) validStatusHint(jobID, hint string) bool {
+	ms, sig, ok := strings.Cut(hint, ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(h.statusHintMAC(jobID, ms))) {
+		return false
+	}
+	issued, err := strconv.ParseInt(ms, 36, 64)
+	if err != nil {
+		return false
+	}
+	age := h.clock.Now().Sub(time.UnixMilli(issued))
+	return age > -h.recent.window && age < h.recent.window
+}
+
+// acceptedRecently reports whether this deployment accepted the job within
+// the window, by this replica's memory, the client's hint, or the Redis mark
+func (h *Handler) acceptedRecently(ctx context.Context, jobID, hint string) bool {
+	if h.recent == nil {
+		return false
+	}
+	if h.recent.contains(h.clock.Now(), jobID) || h.validStatusHint(jobID, hint) {
+		return true
+	}
+	store, ok := h.jobQueue.(recentJobStore)
+	if !ok {
+		return false
+	}
+	recent, err := store.IsRecentJob(ctx, jobID)
+	return err == nil && recent
+}
+
+// rereadJob reads a just-accepted job again after a short wait, giving a
+// racing write time to land. It returns nil if the job is still not found.
+func (h *Handler) rereadJob(ctx context.Context, jobID string) (*queue.Job, error) {
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-time.After(recentReadRetryDelay):
+	}
+
+	job, err := queue.NilIfNotFound(h.jobQueue.GetJob(ctx, jobID))
+	if err == nil {
+		if job != nil {
+			recentReads.Add("found_on_retry", 1)
+		} else {
+			recentReads.Add("answered_pending", 1)
+		}
+	}
+	return job, err
+}
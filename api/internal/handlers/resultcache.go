@@ -0,0 +1,96 @@
+package handlers
+
+import (
+	"expvar"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/filecache"
+)
+
+var (
+	// resultCacheStats counts downloads by whether the local result cache
+	// had them, along with the bytes each side served
+	resultCacheStats = expvar.NewMap("result_cache")
+	// resultCacheBytes is the size of the local result cache
+	resultCacheBytes = new(expvar.Int)
+	// resultCacheEvictions counts copies dropped to keep the cache in bounds
+	resultCacheEvictions = new(expvar.Int)
+)
+
+func init() {
+	resultCacheStats.Set("bytes", resultCacheBytes)
+	resultCacheStats.Set("evictions", resultCacheEvictions)
+}
+
+// WithResultCache serves downloads from local copies of results kept in
+// cache, reading each from storage only on its first download
+func WithResultCache(cache *filecache.Cache) Option {
+	return func(h *Handler) {
+		h.resultCache = cache
+	}
+}
+
+// serveCachedResult writes the file at path from the result cache, copying
+// it in from storage on a miss. It reports false, having written nothing,
+// when the cache can't serve it.
+func (h *Handler) serveCachedResult(c *gin.Context, path string) bool {
+	info, err := h.fs.Stat(path)
+	if err != nil {
+		return false
+	}
+	// A file rewritten in place, such as a reprocessed result, gets a new
+	// version so the old copy is never served
+	version := fmt.Sprintf("%d-%d", info.Size(), info.ModTime().UnixNano())
+
+	f, hit, err := h.resultCache.Get(path, version, func(w io.Writer) error {
+		src, err := h.fs.Open(path)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+		_, err = io.Copy(w, src)
+		return err
+	})
+	h.recordResultCache()
+	if err != nil {
+		if err != filecache.ErrTooLarge && !os.IsNotExist(err) {
+			log.Printf("Failed to cache result %q: %v", path, err)
+		}
+		resultCacheStats.Add("bypasses", 1)
+		return false
+	}
+	defer f.Close()
+
+	if hit {
+		resultCacheStats.Add("hits", 1)
+		resultCacheStats.Add("hit_bytes_served", info.Size())
+	} else {
+		resultCacheStats.Add("misses", 1)
+		resultCacheStats.Add("miss_bytes_served", info.Size())
+	}
+	http.ServeContent(c.Writer, c.Request, filepath.Base(path), info.ModTime(), f)
+	return true
+}
+
+// invalidateCachedResult drops the cached copy of the file at path
+func (h *Handler) invalidateCachedResult(path string) {
+	if h.resultCache == nil || path == "" {
+		return
+	}
+	h.resultCache.Invalidate(path)
+	h.recordResultCache()
+}
+
+// recordResultCache publishes the result cache's size and evictions
+func (h *Handler) recordResultCache() {
+	stats := h.resultCache.Stats()
+	resultCacheBytes.Set(stats.Bytes)
+	resultCacheEvictions.Set(stats.Evictions)
+}
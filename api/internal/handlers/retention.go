@@ -0,0 +1,434 @@
+package handlers
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// sweepBatch is how many due removals of each kind one sweep takes on
+const sweepBatch = 500
+
+// sweptFiles counts jobs and inputs removed at the end of their retention
+var sweptFiles = expvar.NewMap("retention_sweeps")
+
+// lifecycleStore is implemented by queues that keep per-owner lifecycle
+// policies
+type lifecycleStore interface {
+	SetLifecyclePolicy(ctx context.Context, owner string, policy queue.LifecyclePolicy) error
+	LifecyclePolicy(ctx context.Context, owner string) (*queue.LifecyclePolicy, error)
+	ClearLifecyclePolicy(ctx context.Context, owner string) error
+	RetainOwnerJobs(ctx context.Context, owner string, retention queue.Retention) (int, bool, error)
+}
+
+// removalStore is implemented by queues that schedule the removal of
+// expired jobs' files
+type removalStore interface {
+	DueRemovals(ctx context.Context, kind string, now time.Time, limit int64) ([]string, error)
+	CompleteRemoval(ctx context.Context, kind, jobID string) error
+	RescheduleRemovals(ctx context.Context, job *queue.Job) error
+	RetireJob(ctx context.Context, job *queue.Job, archive string) error
+	Tombstone(ctx context.Context, jobID string) (*queue.Tombstone, error)
+}
+
+// jobExpirer is implemented by queues that can tell when a job's record is
+// removed, whether or not it has a retention snapshot
+type jobExpirer interface {
+	JobExpiresAt(job *queue.Job) time.Time
+}
+
+// retentionConfig is the deployment's default retention and maximum job
+// lifetime, and the bounds every job option and owner policy must stay within
+type retentionConfig struct {
+	resultSeconds   int64
+	inputSeconds    int64
+	lifetimeSeconds int64
+	minSeconds      int64
+	maxSeconds      int64
+}
+
+// retentionFromEnv reads RETENTION_SECONDS, INPUT_RETENTION_SECONDS,
+// MAX_JOB_LIFETIME_SECONDS, and their bounds, RETENTION_MIN_SECONDS and
+// RETENTION_MAX_SECONDS
+func retentionFromEnv() retentionConfig {
+	cfg := retentionConfig{
+		resultSeconds:   int64(getEnvInt("RETENTION_SECONDS", 86400)),
+		inputSeconds:    int64(getEnvInt("INPUT_RETENTION_SECONDS", 0)),
+		lifetimeSeconds: int64(getEnvInt("MAX_JOB_LIFETIME_SECONDS", 6*3600)),
+		minSeconds:      int64(getEnvInt("RETENTION_MIN_SECONDS", 300)),
+		maxSeconds:      int64(getEnvInt("RETENTION_MAX_SECONDS", 30*86400)),
+	}
+	if cfg.resultSeconds < cfg.minSeconds || cfg.resultSeconds > cfg.maxSeconds {
+		log.Printf("RETENTION_SECONDS %d is outside the retention bounds, using %d", cfg.resultSeconds, cfg.maxSeconds)
+		cfg.resultSeconds = cfg.maxSeconds
+	}
+	return cfg
+}
+
+// check returns an error naming field unless seconds is within the bounds.
+// Zero is allowed where it means "use the default".
+func (r retentionConfig) check(field string, seconds int64, zeroOK bool) error {
+	if seconds == 0 && zeroOK {
+		return nil
+	}
+	if seconds < r.minSeconds || seconds > r.maxSeconds {
+		return fmt.Errorf("%s must be between %d and %d", field, r.minSeconds, r.maxSeconds)
+	}
+	return nil
+}
+
+// effective returns the retention a new job gets under policy, which may be nil
+func (r retentionConfig) effective(policy *queue.LifecyclePolicy) queue.Retention {
+	retention := queue.Retention{ResultSeconds: r.resultSeconds, InputSeconds: r.inputSeconds, Source: queue.RetentionFromDefault}
+	if policy == nil {
+		return retention
+	}
+	if policy.ResultRetentionSeconds > 0 {
+		retention.ResultSeconds = policy.ResultRetentionSeconds
+		retention.Source = queue.RetentionFromPolicy
+	}
+	if policy.InputRetentionSeconds > 0 {
+		retention.InputSeconds = policy.InputRetentionSeconds
+		retention.Source = queue.RetentionFromPolicy
+	}
+	return retention
+}
+
+// lifetime returns the maximum lifetime of a new job under policy, which
+// may be nil; 0 is unbounded
+func (r retentionConfig) lifetime(policy *queue.LifecyclePolicy) int64 {
+	if policy != nil && policy.MaxLifetimeSeconds > 0 {
+		return policy.MaxLifetimeSeconds
+	}
+	return r.lifetimeSeconds
+}
+
+// jobLifecycle resolves a submission's retention, its retention_seconds or
+// ttl_seconds option over the owner's policy over the default, and its maximum
+// lifetime, the policy's over the default. It also enforces the policy's
+// submission requirements, writing an error and returning false when the
+// submission can't be accepted.
+func (h *Handler) jobLifecycle(c *gin.Context, deliveries []queue.Delivery) (*queue.Retention, int64, bool) {
+	var policy *queue.LifecyclePolicy
+	if store, ok := h.jobQueue.(lifecycleStore); ok {
+		var err error
+		if policy, err = store.LifecyclePolicy(c.Request.Context(), ownerID(c)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read the lifecycle policy"})
+			return nil, 0, false
+		}
+	}
+	if policy != nil && policy.RequireWebhook && !hasWebhook(deliveries) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Your lifecycle policy requires a webhook delivery"})
+		return nil, 0, false
+	}
+
+	retention := h.retention.effective(policy)
+	field, value := retentionField(c)
+	if field == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "ttl_seconds and retention_seconds must match when both are given"})
+		return nil, 0, false
+	}
+	if value != "" {
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || h.retention.check(field, seconds, false) != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("%s must be between %d and %d", field, h.retention.minSeconds, h.retention.maxSeconds)})
+			return nil, 0, false
+		}
+		retention.ResultSeconds = seconds
+		retention.Source = queue.RetentionFromJob
+	}
+	return &retention, h.retention.lifetime(policy), true
+}
+
+// retentionField returns the submission's retention_seconds, or its
+// ttl_seconds, the same option under the name clients of other job queues
+// know, with the field it came from. The field is "" if both are given
+// and differ.
+func retentionField(c *gin.Context) (string, string) {
+	retention, ttl := c.PostForm("retention_seconds"), c.PostForm("ttl_seconds")
+	switch {
+	case ttl == "":
+		return "retention_seconds", retention
+	case retention == "":
+		return "ttl_seconds", ttl
+	case retention == ttl:
+		return "retention_seconds", retention
+	}
+	return "", ""
+}
+
+// hasWebhook reports whether any delivery is a webhook
+func hasWebhook(deliveries []queue.Delivery) bool {
+	for _, d := range deliveries {
+		if d.Type == queue.DeliveryWebhook {
+			return true
+		}
+	}
+	return false
+}
+
+// expired reports whether a finished job is past its retention and only
+// waiting for the sweeper
+func (h *Handler) expired(job *queue.Job) bool {
+	if job.Status != queue.StatusCompleted && job.Status != queue.StatusFailed && job.Status != queue.StatusCancelled {
+		return false
+	}
+	at := job.ExpiresAt()
+	return !at.IsZero() && !h.clock.Now().Before(at)
+}
+
+// lifecycleAdmin returns the policy store, writing a 404 if the queue has
+// none, and a 403 unless RequireAdmin admitted the request, wherever the
+// policy routes are mounted
+func (h *Handler) lifecycleAdmin(c *gin.Context) (lifecycleStore, bool) {
+	if !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Owner policies need the admin key"})
+		return nil, false
+	}
+	store, ok := h.jobQueue.(lifecycleStore)
+	if !ok {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Lifecycle policies are not supported"})
+		return nil, false
+	}
+	return store, true
+}
+
+// GetOwnerPolicy reports an owner's lifecycle policy and the retention
+// their new jobs get
+func (h *Handler) GetOwnerPolicy(c *gin.Context) {
+	store, ok := h.lifecycleAdmin(c)
+	if !ok {
+		return
+	}
+	policy, err := store.LifecyclePolicy(c.Request.Context(), c.Param("key"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to read the lifecycle policy"})
+		return
+	}
+	c.JSON(http.StatusOK, gin.H{
+		"owner":                c.Param("key"),
+		"policy":               policy,
+		"effective":            h.retention.effective(policy),
+		"max_lifetime_seconds": h.retention.lifetime(policy),
+	})
+}
+
+// SetOwnerPolicy stores an owner's lifecycle policy, e.g.
+// {"result_retention_seconds": 3600, "require_webhook": true}. New jobs
+// snapshot it; with ?apply_to_existing=true the retention of the owner's
+// stored jobs is updated too, except those that asked for their own.
+func (h *Handler) SetOwnerPolicy(c *gin.Context) {
+	store, ok := h.lifecycleAdmin(c)
+	if !ok {
+		return
+	}
+	var policy queue.LifecyclePolicy
+	if err := c.ShouldBindJSON(&policy); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid policy: " + err.Error()})
+		return
+	}
+	for field, seconds := range map[string]int64{
+		"result_retention_seconds": policy.ResultRetentionSeconds,
+		"input_retention_seconds":  policy.InputRetentionSeconds,
+		"max_lifetime_seconds":     policy.MaxLifetimeSeconds,
+	} {
+		if err := h.retention.check(field, seconds, true); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+	policy.UpdatedAt = h.clock.Now()
+
+	owner := c.Param("key")
+	if err := store.SetLifecyclePolicy(c.Request.Context(), owner, policy); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to store the lifecycle policy"})
+		return
+	}
+	effective := h.retention.effective(&policy)
+	response := gin.H{"owner": owner, "policy": policy, "effective": effective, "max_lifetime_seconds": h.retention.lifetime(&policy)}
+
+	if c.Query("apply_to_existing") == "true" {
+		updated, complete, err := store.RetainOwnerJobs(c.Request.Context(), owner, effective)
+		if err != nil {
+			log.Printf("Failed to apply the lifecycle policy of %q to existing jobs: %v", owner, err)
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Policy stored, but failed to apply it to existing jobs", "jobs_updated": updated})
+			return
+		}
+		response["jobs_updated"] = updated
+		response["complete"] = complete
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// ClearOwnerPolicy removes an owner's lifecycle policy; existing jobs keep
+// their snapshot
+func (h *Handler) ClearOwnerPolicy(c *gin.Context) {
+	store, ok := h.lifecycleAdmin(c)
+	if !ok {
+		return
+	}
+	if err := store.ClearLifecyclePolicy(c.Request.Context(), c.Param("key")); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to remove the lifecycle policy"})
+		return
+	}
+	c.Status(http.StatusNoContent)
+}
+
+// SweepExpired removes the inputs and results of jobs past their
+// retention, then the finished jobs themselves
+func (h *Handler) SweepExpired(ctx context.Context) {
+	store, ok := h.jobQueue.(removalStore)
+	if !ok {
+		return
+	}
+	now := h.clock.Now()
+	for _, kind := range []string{queue.RemovalInputs, queue.RemovalResults} {
+		jobIDs, err := store.DueRemovals(ctx, kind, now, sweepBatch)
+		if err != nil {
+			log.Printf("Failed to list expired %s: %v", kind, err)
+			continue
+		}
+		for _, jobID := range jobIDs {
+			if err := h.sweepJob(ctx, store, kind, jobID, now); err != nil {
+				log.Printf("Failed to remove the expired %s of job %s: %v", kind, jobID, err)
+			}
+		}
+	}
+}
+
+// sweepJob carries out one due removal, going by the retention stored on
+// the job rather than the schedule, which a concurrent write may have left
+// behind
+func (h *Handler) sweepJob(ctx context.Context, store removalStore, kind, jobID string, now time.Time) error {
+	job, err := queue.NilIfNotFound(h.jobQueue.GetJob(ctx, jobID))
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		// Its files can't be found any more
+		return store.CompleteRemoval(ctx, kind, jobID)
+	}
+
+	due := job.ExpiresAt()
+	if kind == queue.RemovalInputs {
+		due = job.InputExpiresAt()
+	}
+	if due.IsZero() || due.After(now) {
+		return store.RescheduleRemovals(ctx, job)
+	}
+	// Never pull files out from under a worker; try again next sweep
+	if job.Status == queue.StatusPending || job.Status == queue.StatusProcessing || job.Status == queue.StatusScheduled || job.Status == queue.StatusRetrying {
+		return nil
+	}
+
+	if kind == queue.RemovalResults {
+		return h.teardownJob(ctx, store, job)
+	}
+	// Shared fanout inputs are removed once no job references them
+	if job.FanoutID == "" {
+		if err := h.removeFile(job.InputPath); err != nil {
+			return err
+		}
+	}
+	if err := h.removeOutputs(job); err != nil {
+		return err
+	}
+	if err := store.CompleteRemoval(ctx, kind, jobID); err != nil {
+		return err
+	}
+	sweptFiles.Add(kind, 1)
+	return nil
+}
+
+// teardownJob removes an expired job in order: a completed job is first
+// archived if an archiver is configured, then the indexes and upload
+// fingerprint pointing to it, its files, the idempotency key it was
+// submitted under, and finally its record, replaced by a tombstone. Every
+// step is idempotent and the record goes last, so a teardown interrupted at
+// any step is resumed from the record by the next sweep. Reads treat the job as gone from the moment it
+// expires, so the steps in between are never observed.
+func (h *Handler) teardownJob(ctx context.Context, store removalStore, job *queue.Job) error {
+	archive, err := h.archiveJob(ctx, job)
+	if err != nil {
+		return err
+	}
+	if err := h.unindexJob(ctx, job); err != nil {
+		return err
+	}
+	if err := h.forgetUpload(ctx, job); err != nil {
+		return err
+	}
+
+	// Shared fanout inputs are removed once no job references them
+	if job.FanoutID == "" {
+		if err := h.removeFile(job.InputPath); err != nil {
+			return err
+		}
+	}
+	if err := h.removeOutputs(job); err != nil {
+		return err
+	}
+	if err := h.removeFile(job.OutputPath); err != nil {
+		return err
+	}
+	h.removeVariants(ctx, job)
+	h.invalidateCachedResult(job.OutputPath)
+
+	if idempotency, ok := h.jobQueue.(idempotencyStore); ok && job.IdempotencyKey != "" {
+		if err := idempotency.ForgetIdempotencyKey(ctx, job.Owner, job.IdempotencyKey, job.ID); err != nil {
+			return err
+		}
+	}
+
+	if err := store.RetireJob(ctx, job, archive); err != nil {
+		return err
+	}
+	sweptFiles.Add(queue.RemovalResults, 1)
+	return nil
+}
+
+// expiredJob writes the 410 for a job past its retention, whether it's
+// still being torn down or only its tombstone is left
+func expiredJob(c *gin.Context, jobID string, at time.Time) {
+	response := gin.H{"error": "Job expired", "job_id": jobID}
+	if !at.IsZero() {
+		response["expired_at"] = at.UTC().Format(time.RFC3339)
+	}
+	c.JSON(http.StatusGone, response)
+}
+
+// tombstone returns the tombstone of an expired job, or nil if there is
+// none or it can't be read
+func (h *Handler) tombstone(ctx context.Context, jobID string) *queue.Tombstone {
+	store, ok := h.jobQueue.(removalStore)
+	if !ok {
+		return nil
+	}
+	tombstone, err := store.Tombstone(ctx, jobID)
+	if err != nil {
+		log.Printf("Failed to read the tombstone of job %s: %v", jobID, err)
+		return nil
+	}
+	return tombstone
+}
+
+// removeFile removes a stored file, if there is one
+func (h *Handler) removeFile(path string) error {
+	if path == "" {
+		return nil
+	}
+	if err := h.fs.Remove(path); err != nil && !os.IsNotExist(err) {
+		h.recordStorage(err)
+		return err
+	}
+	return nil
+}
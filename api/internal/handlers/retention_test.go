@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestOwnerPolicyNeedsAdmin(t *testing.T) {
+	h, jobs := newRedisTestHandler(t)
+	ctx := context.Background()
+
+	router := gin.New()
+	router.PUT("/open/owners/:key/policy", h.SetOwnerPolicy)
+	admin := router.Group("/admin", h.RequireAdmin)
+	admin.GET("/owners/:key/policy", h.GetOwnerPolicy)
+	admin.PUT("/owners/:key/policy", h.SetOwnerPolicy)
+	admin.DELETE("/owners/:key/policy", h.ClearOwnerPolicy)
+
+	body := `{"result_retention_seconds": 3600}`
+	for _, tc := range []struct {
+		name     string
+		method   string
+		path     string
+		adminKey string
+		want     int
+	}{
+		{"set outside the admin group", http.MethodPut, "/open/owners/alice/policy", testAdminKey, http.StatusForbidden},
+		{"set without the key", http.MethodPut, "/admin/owners/alice/policy", "", http.StatusUnauthorized},
+		{"set with a wrong key", http.MethodPut, "/admin/owners/alice/policy", "guess", http.StatusUnauthorized},
+		{"read without the key", http.MethodGet, "/admin/owners/alice/policy", "", http.StatusUnauthorized},
+	} {
+		if w := serveTest(router, tc.method, tc.path, strings.NewReader(body), tc.adminKey); w.Code != tc.want {
+			t.Errorf("%s: got %d, want %d: %s", tc.name, w.Code, tc.want, w.Body)
+		}
+	}
+	if policy, err := jobs.LifecyclePolicy(ctx, "alice"); err != nil || policy != nil {
+		t.Fatalf("policy after rejected requests: %+v, %v", policy, err)
+	}
+
+	if w := serveTest(router, http.MethodPut, "/admin/owners/alice/policy", strings.NewReader(body), testAdminKey); w.Code != http.StatusOK {
+		t.Fatalf("set with the admin key: got %d: %s", w.Code, w.Body)
+	}
+	if w := serveTest(router, http.MethodDelete, "/admin/owners/alice/policy", nil, ""); w.Code != http.StatusUnauthorized {
+		t.Fatalf("clear without the key: got %d", w.Code)
+	}
+	policy, err := jobs.LifecyclePolicy(ctx, "alice")
+	if err != nil || policy == nil || policy.ResultRetentionSeconds != 3600 {
+		t.Fatalf("policy after the admin set and a rejected clear: %+v, %v", policy, err)
+	}
+}
@@ -0,0 +1,106 @@
+package handlers
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// publicRoutes are the routes under /api reachable without credentials
+var publicRoutes = map[string]bool{"/api/health": true}
+
+// CanonicalRoutes returns the NoRoute handler that redirects a request for
+// a route spelled with a trailing slash or differently cased fixed segments
+// to the route's canonical form, e.g. /API/Download/Ab12/ to
+// /api/download/Ab12. Parameter segments such as job IDs are kept as sent.
+//
+// Redirects use 308 so clients repeat POSTs with their bodies, and run after
+// the global middleware so they carry CORS headers. Redirects to
+// authenticated routes are only given to requests that would pass
+// authentication. Anything else falls through to gin's 404.
+func (h *Handler) CanonicalRoutes(router *gin.Engine) gin.HandlerFunc {
+	var (
+		once   sync.Once
+		routes gin.RoutesInfo
+	)
+	return func(c *gin.Context) {
+		// Routes are all registered before the first request arrives
+		once.Do(func() { routes = router.Routes() })
+
+		target, ok := canonicalPath(routes, c.Request.Method, c.Request.URL.Path)
+		if !ok || target == c.Request.URL.Path {
+			return
+		}
+		if strings.HasPrefix(target, "/api/") && !publicRoutes[target] {
+			h.Authenticate(c)
+			if c.IsAborted() {
+				return
+			}
+		}
+
+		location := (&url.URL{Path: target, RawQuery: c.Request.URL.RawQuery}).String()
+		c.Redirect(http.StatusPermanentRedirect, location)
+		c.Abort()
+	}
+}
+
+// canonicalPath returns the canonical spelling of requestPath if it names a
+// route registered for method. Fixed segments match regardless of case and
+// take the route's spelling; parameters keep the request's. Where several
+// routes match, the one with a fixed segment earliest wins, as gin's router
+// would pick it.
+func canonicalPath(routes gin.RoutesInfo, method, requestPath string) (string, bool) {
+	trimmed := strings.TrimRight(requestPath, "/")
+	if trimmed == "" {
+		return "", false
+	}
+	segments := strings.Split(trimmed, "/")
+
+	var best, bestRank string
+	for _, route := range routes {
+		if route.Method != method {
+			continue
+		}
+		target, rank, ok := matchRoute(strings.Split(route.Path, "/"), segments)
+		if ok && (best == "" || rank > bestRank) {
+			best, bestRank = target, rank
+		}
+	}
+	return best, best != ""
+}
+
+// matchRoute matches request segments against a route's pattern segments,
+// returning the canonical path and a rank with 's' for each fixed segment
+// and 'p' for each parameter
+func matchRoute(pattern, segments []string) (string, string, bool) {
+	canonical := make([]string, 0, len(segments))
+	rank := make([]byte, 0, len(pattern))
+	for i, p := range pattern {
+		switch {
+		case strings.HasPrefix(p, "*"):
+			canonical = append(canonical, segments[i:]...)
+			rank = append(rank, 'p')
+			return strings.Join(canonical, "/"), string(rank), true
+		case i >= len(segments):
+			return "", "", false
+		case strings.HasPrefix(p, ":"):
+			if segments[i] == "" {
+				return "", "", false
+			}
+			canonical = append(canonical, segments[i])
+			rank = append(rank, 'p')
+		case strings.EqualFold(p, segments[i]):
+			canonical = append(canonical, p)
+			rank = append(rank, 's')
+		default:
+			return "", "", false
+		}
+	}
+	if len(pattern) != len(segments) {
+		return "", "", false
+	}
+	return strings.Join(canonical, "/"), string(rank), true
+}
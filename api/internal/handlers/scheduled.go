@@ -0,0 +1,93 @@
+package handlers
+
+import (
+	"context"
+	"expvar"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// scheduledPromotions counts scheduled jobs queued once they were due
+var scheduledPromotions = expvar.NewInt("scheduled_promotions")
+
+// scheduleStore is implemented by queues that can hold jobs until they're due
+type scheduleStore interface {
+	PromoteDueJobs(ctx context.Context) (int, error)
+}
+
+// parseSchedule reads when the job should be queued from the submission
+// form, as delay_seconds or an RFC 3339 process_at, writing an error
+// response if it's malformed, further out than MAX_SCHEDULE_DELAY_SECONDS,
+// or after the job's files are removed. It returns nil for a job queued on
+// submission, including one whose process_at has already passed.
+func (h *Handler) parseSchedule(c *gin.Context, retention *queue.Retention) (*time.Time, bool) {
+	delay, at := c.PostForm("delay_seconds"), c.PostForm("process_at")
+	if delay == "" && at == "" {
+		return nil, true
+	}
+	if _, ok := h.jobQueue.(scheduleStore); !ok {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Scheduled processing is not supported"})
+		return nil, false
+	}
+	if delay != "" && at != "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Pass delay_seconds or process_at, not both"})
+		return nil, false
+	}
+
+	now := h.clock.Now()
+	var processAt time.Time
+	if delay != "" {
+		seconds, err := strconv.ParseInt(delay, 10, 64)
+		if err != nil || seconds < 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "delay_seconds must be a non-negative number of seconds"})
+			return nil, false
+		}
+		processAt = now.Add(time.Duration(seconds) * time.Second)
+	} else {
+		parsed, err := time.Parse(time.RFC3339, at)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "process_at must be an RFC 3339 timestamp"})
+			return nil, false
+		}
+		processAt = parsed
+	}
+	if !processAt.After(now) {
+		return nil, true
+	}
+
+	if processAt.Sub(now) > h.maxScheduleDelay {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("Jobs can be scheduled at most %d seconds ahead", int64(h.maxScheduleDelay/time.Second))})
+		return nil, false
+	}
+	// The upload must still be there when the job is due
+	keep := retention.ResultSeconds
+	if retention.InputSeconds > 0 && retention.InputSeconds < keep {
+		keep = retention.InputSeconds
+	}
+	if !processAt.Before(now.Add(time.Duration(keep) * time.Second)) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("The job would be due after its upload is removed, %d seconds after submission", keep)})
+		return nil, false
+	}
+	processAt = processAt.UTC()
+	return &processAt, true
+}
+
+// PromoteScheduledJobs queues the scheduled jobs that are due
+func (h *Handler) PromoteScheduledJobs(ctx context.Context) {
+	store, ok := h.jobQueue.(scheduleStore)
+	if !ok {
+		return
+	}
+	n, err := store.PromoteDueJobs(ctx)
+	scheduledPromotions.Add(int64(n))
+	if err != nil {
+		log.Printf("Failed to queue due scheduled jobs: %v", err)
+	}
+}
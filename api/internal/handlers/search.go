@@ -0,0 +1,154 @@
+package handlers
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// searchStore is implemented by queues that index jobs for search
+type searchStore interface {
+	IndexJob(ctx context.Context, owner, kind, value, jobID string) error
+	UnindexJob(ctx context.Context, owner, kind, value, jobID string) error
+	SearchJobs(ctx context.Context, owner, kind, value string) ([]string, error)
+}
+
+// inputHashPattern matches a hex SHA-256 digest
+var inputHashPattern = regexp.MustCompile(`^[0-9a-f]{64}$`)
+
+// WithFilenamePrivacy stores filenames in the search index as a keyed hash
+// instead of plaintext, so the index reveals nothing without the key
+func WithFilenamePrivacy(key []byte) Option {
+	return func(h *Handler) {
+		h.filenameKey = key
+	}
+}
+
+// filenameIndexValue normalizes a filename for exact-match search and, in
+// privacy mode, replaces it with its HMAC
+func (h *Handler) filenameIndexValue(name string) string {
+	normalized := strings.ToLower(strings.TrimSpace(name))
+	if normalized == "" || h.filenameKey == nil {
+		return normalized
+	}
+	mac := hmac.New(sha256.New, h.filenameKey)
+	mac.Write([]byte(normalized))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// indexJob makes a queued job findable by its input hash and filename
+func (h *Handler) indexJob(ctx context.Context, job *queue.Job) {
+	store, ok := h.jobQueue.(searchStore)
+	if !ok {
+		return
+	}
+	if job.InputHash != "" {
+		if err := store.IndexJob(ctx, job.Owner, queue.SearchByHash, job.InputHash, job.ID); err != nil {
+			log.Printf("Failed to index input hash of job %s: %v", job.ID, err)
+		}
+	}
+	if value := h.filenameIndexValue(job.Filename); value != "" {
+		if err := store.IndexJob(ctx, job.Owner, queue.SearchByFilename, value, job.ID); err != nil {
+			log.Printf("Failed to index filename of job %s: %v", job.ID, err)
+		}
+	}
+}
+
+// unindexJob removes an expired job from the indexes indexJob added it to
+func (h *Handler) unindexJob(ctx context.Context, job *queue.Job) error {
+	store, ok := h.jobQueue.(searchStore)
+	if !ok {
+		return nil
+	}
+	if job.InputHash != "" {
+		if err := store.UnindexJob(ctx, job.Owner, queue.SearchByHash, job.InputHash, job.ID); err != nil {
+			return err
+		}
+	}
+	if value := h.filenameIndexValue(job.Filename); value != "" {
+		return store.UnindexJob(ctx, job.Owner, queue.SearchByFilename, value, job.ID)
+	}
+	return nil
+}
+
+// SearchJobs finds the caller's jobs by exact input hash or filename,
+// newest first. Only authenticated owners can search: a client IP doesn't
+// prove which of the clients sharing it submitted a job.
+func (h *Handler) SearchJobs(c *gin.Context) {
+	store, ok := h.jobQueue.(searchStore)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Queue backend does not support job search"})
+		return
+	}
+	owner := authenticatedOwner(c)
+	if owner == "" {
+		authFailures.Add("credentials_missing", 1)
+		c.Header("WWW-Authenticate", `Bearer realm="api"`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Searching jobs needs an API key or token"})
+		return
+	}
+
+	var kind, value string
+	switch hash, filename := strings.ToLower(c.Query("hash")), c.Query("filename"); {
+	case hash != "" && filename != "":
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Search by hash or filename, not both"})
+		return
+	case hash != "":
+		if !inputHashPattern.MatchString(hash) {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "hash must be a hex SHA-256 digest"})
+			return
+		}
+		kind, value = queue.SearchByHash, hash
+	case strings.TrimSpace(filename) != "":
+		kind, value = queue.SearchByFilename, h.filenameIndexValue(filename)
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "A hash or filename is required"})
+		return
+	}
+
+	ids, err := store.SearchJobs(c.Request.Context(), owner, kind, value)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to search jobs"})
+		return
+	}
+
+	var jobs []*queue.Job
+	for _, id := range ids {
+		job, err := queue.NilIfNotFound(h.jobQueue.GetJob(c.Request.Context(), id))
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve job"})
+			return
+		}
+		// Skip expired jobs, and never leak another owner's job
+		if job != nil && job.Owner == owner && !h.expired(job) {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.SliceStable(jobs, func(i, j int) bool { return jobs[i].CreatedAt.After(jobs[j].CreatedAt) })
+
+	results := make([]gin.H, 0, len(jobs))
+	for _, job := range jobs {
+		entry := gin.H{
+			"job_id":     job.ID,
+			"status":     string(job.Status),
+			"filename":   job.Filename,
+			"created_at": job.CreatedAt.Format(time.RFC3339),
+		}
+		if job.InputHash != "" {
+			entry["input_hash"] = job.InputHash
+		}
+		results = append(results, entry)
+	}
+	c.JSON(http.StatusOK, gin.H{"jobs": results})
+}
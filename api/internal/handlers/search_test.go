@@ -0,0 +1,81 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+func TestSearchJobsListsOnlyTheOwnersJobs(t *testing.T) {
+	h, jobs := newRedisTestHandler(t)
+	ctx := context.Background()
+	hash := strings.Repeat("ab", 32)
+	for _, job := range []*queue.Job{
+		{ID: "alice-job", Status: queue.StatusPending, Owner: "alice", InputHash: hash},
+		{ID: "anonymous-job", Status: queue.StatusPending, Owner: "192.0.2.1", InputHash: hash},
+	} {
+		if err := jobs.AddJob(ctx, job); err != nil {
+			t.Fatalf("AddJob: %v", err)
+		}
+		h.indexJob(ctx, job)
+	}
+	alice, bob := newTestAPIKey(t, jobs, "alice"), newTestAPIKey(t, jobs, "bob")
+
+	router := gin.New()
+	router.GET("/jobs/search", h.Authenticate, h.SearchJobs)
+
+	for _, tc := range []struct {
+		name     string
+		secret   string
+		adminKey string
+		want     int
+		wantJobs []string
+	}{
+		// Sent from the IP that owns the anonymous job
+		{"anonymous", "", "", http.StatusUnauthorized, nil},
+		{"the admin key", "", testAdminKey, http.StatusUnauthorized, nil},
+		{"another owner", bob, "", http.StatusOK, []string{}},
+		{"the owner", alice, "", http.StatusOK, []string{"alice-job"}},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/jobs/search?hash="+hash, nil)
+		req.RemoteAddr = "192.0.2.1:41000"
+		if tc.secret != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.secret)
+		}
+		if tc.adminKey != "" {
+			req.Header.Set(adminKeyHeader, tc.adminKey)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Errorf("%s: got %d, want %d: %s", tc.name, w.Code, tc.want, w.Body)
+			continue
+		}
+		if tc.wantJobs == nil {
+			continue
+		}
+
+		var body struct {
+			Jobs []struct {
+				JobID string `json:"job_id"`
+			} `json:"jobs"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("%s: decoding the response: %v", tc.name, err)
+		}
+		got := make([]string, 0, len(body.Jobs))
+		for _, job := range body.Jobs {
+			got = append(got, job.JobID)
+		}
+		if strings.Join(got, ",") != strings.Join(tc.wantJobs, ",") {
+			t.Errorf("%s: found %v, want %v", tc.name, got, tc.wantJobs)
+		}
+	}
+}
@@ -0,0 +1,120 @@
+package handlers
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// backpressureRetryAfter is the Retry-After, in seconds, of shed submissions
+const backpressureRetryAfter = 5
+
+// defaultTierReserves is the share of queue capacity held back for each
+// tier and those above it; the lowest tier has nothing reserved
+var defaultTierReserves = map[string]string{
+	queue.TierPro:        "0.2",
+	queue.TierEnterprise: "0.1",
+}
+
+var (
+	// tierSubmissions counts jobs accepted per tier
+	tierSubmissions = expvar.NewMap("submissions_by_tier")
+	// tierRejections counts submissions shed by backpressure per tier
+	tierRejections = expvar.NewMap("backpressure_rejections")
+)
+
+// depthReader is implemented by queues that can report their backlog
+type depthReader interface {
+	PendingDepth(ctx context.Context) (int64, error)
+}
+
+// callerTier returns the tier named by the request's credentials, or free
+func callerTier(c *gin.Context) string {
+	if tier := c.GetString(tierContextKey); tier != "" {
+		return tier
+	}
+	return queue.TierFree
+}
+
+// depthLimitsFromEnv returns the pending depth at which each tier's
+// submissions are shed, or nil when MAX_QUEUE_DEPTH is unset. The top tier
+// may fill the queue to MAX_QUEUE_DEPTH; TIER_RESERVE_<TIER> holds back that
+// fraction of it for the tier and those above, so lower tiers are shed first.
+func depthLimitsFromEnv() map[string]int64 {
+	maxDepth := getEnvInt("MAX_QUEUE_DEPTH", 0)
+	if maxDepth <= 0 {
+		return nil
+	}
+
+	limits := make(map[string]int64, len(queue.Tiers))
+	reserved := 0.0
+	for i := len(queue.Tiers) - 1; i >= 0; i-- {
+		tier := queue.Tiers[i]
+		limits[tier] = int64(math.Round(float64(maxDepth) * (1 - reserved)))
+		if limits[tier] < 0 {
+			limits[tier] = 0
+		}
+		if i > 0 {
+			reserve, err := strconv.ParseFloat(getEnv("TIER_RESERVE_"+strings.ToUpper(tier), defaultTierReserves[tier]), 64)
+			if err != nil || reserve < 0 {
+				log.Printf("Ignoring invalid capacity reserve for the %s tier", tier)
+				reserve = 0
+			}
+			reserved += reserve
+		}
+	}
+	return limits
+}
+
+// admitSubmission sheds a submission of n jobs if the backlog would pass
+// the caller's tier limit. It writes a 503 and returns false when shed.
+func (h *Handler) admitSubmission(c *gin.Context, tier string, n int) bool {
+	reader, ok := h.jobQueue.(depthReader)
+	if h.depthLimits == nil || !ok {
+		return true
+	}
+
+	depth, err := reader.PendingDepth(c.Request.Context())
+	if err != nil {
+		// The submission's own queue write will surface a real outage
+		log.Printf("Failed to read queue depth, admitting submission: %v", err)
+		return true
+	}
+	if depth+int64(n) <= h.depthLimits[tier] {
+		return true
+	}
+
+	tierRejections.Add(tier, 1)
+	c.Header("Retry-After", strconv.Itoa(backpressureRetryAfter))
+	c.JSON(http.StatusServiceUnavailable, gin.H{
+		"error":       "The queue is too busy to accept " + tier + " tier submissions",
+		"tier":        tier,
+		"retry_after": backpressureRetryAfter,
+	})
+	return false
+}
+
+// tierLimits describes the limits that apply to a tier's callers; a null
+// limit is unlimited
+func (h *Handler) tierLimits(tier string) gin.H {
+	quota := h.quotaLimits[tier]
+	limits := gin.H{"max_queue_depth": nil, "requests_per_day": nil, "megapixels_per_day": nil}
+	if h.depthLimits != nil {
+		limits["max_queue_depth"] = h.depthLimits[tier]
+	}
+	if quota.Requests > 0 {
+		limits["requests_per_day"] = quota.Requests
+	}
+	if quota.MilliMegapixels > 0 {
+		limits["megapixels_per_day"] = float64(quota.MilliMegapixels) / 1000
+	}
+	return limits
+}
@@ -0,0 +1,409 @@
+package handlers
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+const (
+	// defaultTimelineLimit is the page size of a timeline without ?limit
+	defaultTimelineLimit = 100
+	// maxTimelineLimit caps the page size a caller can ask for
+	maxTimelineLimit = 500
+)
+
+// Timeline entry categories, in the order entries sharing a timestamp are listed
+const (
+	timelineStatus   = "status"
+	timelineStage    = "stage"
+	timelineDelivery = "delivery"
+	timelineDownload = "download"
+)
+
+var timelineRanks = map[string]int{timelineStatus: 0, timelineStage: 1, timelineDelivery: 2, timelineDownload: 3}
+
+// timelineSource is implemented by queues that can report the delivery
+// schedule and download counters a timeline is built from
+type timelineSource interface {
+	DeliveryDueAt(ctx context.Context, jobID string) (time.Time, bool, error)
+	JobDownloadHistory(ctx context.Context, jobID string) (queue.DownloadHistory, error)
+}
+
+// timelineEntry is one event in a job's history
+type timelineEntry struct {
+	Timestamp time.Time `json:"timestamp"`
+	Category  string    `json:"category"`
+	Summary   string    `json:"summary"`
+	Details   gin.H     `json:"details,omitempty"`
+	// internal entries and details are shown to admins only
+	internal        bool
+	internalDetails gin.H
+}
+
+// GetJobTimeline lists the caller's own job's history, without worker
+// internals. It needs the job's authenticated owner or the admin key.
+func (h *Handler) GetJobTimeline(c *gin.Context) {
+	if !h.requireCredentials(c) {
+		return
+	}
+	h.serveTimeline(c, false)
+}
+
+// AdminJobTimeline lists any job's full history
+func (h *Handler) AdminJobTimeline(c *gin.Context) {
+	h.serveTimeline(c, true)
+}
+
+// serveTimeline writes a page of a job's timeline, oldest first. The pages
+// are windows of ?limit entries starting at the offset in ?cursor.
+func (h *Handler) serveTimeline(c *gin.Context, admin bool) {
+	jobID := c.Param("id")
+	if h.rejectCaseVariant(c, jobID) {
+		return
+	}
+	limit, err := strconv.Atoi(c.DefaultQuery("limit", strconv.Itoa(defaultTimelineLimit)))
+	if err != nil || limit < 1 || limit > maxTimelineLimit {
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("limit must be between 1 and %d", maxTimelineLimit)})
+		return
+	}
+	offset, err := strconv.Atoi(c.DefaultQuery("cursor", "0"))
+	if err != nil || offset < 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid cursor"})
+		return
+	}
+
+	job, err := queue.NilIfNotFound(h.jobQueue.GetJob(c.Request.Context(), jobID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve job"})
+		return
+	}
+	// Another owner's job is reported as missing, not forbidden
+	if job == nil || h.expired(job) || (!admin && !h.mayManage(c, job)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+
+	entries, err := h.jobTimeline(c.Request.Context(), job)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to build the job timeline"})
+		return
+	}
+
+	visible := make([]timelineEntry, 0, len(entries))
+	for _, e := range entries {
+		if e.internal && !admin {
+			continue
+		}
+		if admin && len(e.internalDetails) > 0 {
+			if e.Details == nil {
+				e.Details = gin.H{}
+			}
+			for k, v := range e.internalDetails {
+				e.Details[k] = v
+			}
+		}
+		visible = append(visible, e)
+	}
+
+	response := gin.H{"job_id": job.ID, "entries": []timelineEntry{}, "total": len(visible)}
+	// Admins get every recorded attempt, whatever page the entries are on
+	if admin {
+		response["attempt_history"] = job.AttemptHistory
+		if job.AttemptHistory == nil {
+			response["attempt_history"] = []queue.Attempt{}
+		}
+	}
+	if offset < len(visible) {
+		end := offset + limit
+		if end > len(visible) {
+			end = len(visible)
+		}
+		response["entries"] = visible[offset:end]
+		if end < len(visible) {
+			response["next_cursor"] = strconv.Itoa(end)
+		}
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// jobTimeline merges what the job record, its delivery schedule, and its
+// download counters say about the job into one chronological list. Nothing
+// is recorded for timelines, so entries are reconstructed: those whose time
+// is inferred rather than stored are marked approximate. Entries sharing a
+// timestamp keep lifecycle order, so pages are stable between reads.
+func (h *Handler) jobTimeline(ctx context.Context, job *queue.Job) ([]timelineEntry, error) {
+	var entries []timelineEntry
+	add := func(e timelineEntry) { entries = append(entries, e) }
+
+	submitted := timelineEntry{
+		Timestamp: job.CreatedAt,
+		Category:  timelineStatus,
+		Summary:   "Submitted",
+		Details:   gin.H{"status": string(queue.StatusPending)},
+		internalDetails: gin.H{
+			"input_path":      job.InputPath,
+			"owner":           job.Owner,
+			"options_version": job.OptionsVersion,
+		},
+	}
+	if job.Model != "" {
+		submitted.Details["model"] = job.Model
+	}
+	if job.ProcessAt != nil {
+		submitted.Details["status"] = string(queue.StatusScheduled)
+		submitted.Details["process_at"] = job.ProcessAt
+	}
+	if job.Tier != "" {
+		submitted.Details["tier"] = job.Tier
+	}
+	if len(job.Options) > 0 {
+		submitted.Details["options"] = job.Options
+	}
+	add(submitted)
+
+	// The worker measures queue wait against the Redis clock the enqueue
+	// time was stamped with, so the start time is derived from those
+	var started time.Time
+	if job.EnqueuedAtMs > 0 && job.QueueWaitMs > 0 {
+		started = time.UnixMilli(job.EnqueuedAtMs + job.QueueWaitMs)
+		add(timelineEntry{
+			Timestamp:       started,
+			Category:        timelineStatus,
+			Summary:         fmt.Sprintf("Started after waiting %d ms in the queue", job.QueueWaitMs),
+			Details:         gin.H{"status": string(queue.StatusProcessing), "queue_wait_ms": job.QueueWaitMs},
+			internalDetails: gin.H{"enqueued_at_ms": job.EnqueuedAtMs},
+		})
+	} else if job.Status == queue.StatusProcessing {
+		started = job.UpdatedAt
+		add(timelineEntry{
+			Timestamp: started,
+			Category:  timelineStatus,
+			Summary:   "Started",
+			Details:   gin.H{"status": string(queue.StatusProcessing)},
+		})
+	}
+
+	if !started.IsZero() {
+		at := started
+		for _, stage := range job.StageTimings {
+			add(timelineEntry{
+				Timestamp: at,
+				Category:  timelineStage,
+				Summary:   fmt.Sprintf("Ran %s in %d ms", stage.Stage, stage.Ms),
+				Details:   gin.H{"stage": stage.Stage, "ms": stage.Ms, "approximate_time": true},
+				internal:  true,
+			})
+			at = at.Add(time.Duration(stage.Ms) * time.Millisecond)
+		}
+	}
+
+	// Attempts that failed and were retried; a failed job's last attempt is
+	// its failure below
+	retried := job.AttemptHistory
+	if job.Status == queue.StatusFailed && len(retried) > 0 {
+		retried = retried[:len(retried)-1]
+	}
+	for _, attempt := range retried {
+		e := timelineEntry{
+			Timestamp:       attempt.FailedAt,
+			Category:        timelineStatus,
+			Summary:         fmt.Sprintf("Attempt %d failed, retrying: %s", attempt.Attempt, attempt.Error),
+			Details:         gin.H{"status": string(queue.StatusRetrying), "attempt": attempt.Attempt, "error": attempt.Error, "error_code": attempt.ErrorCode},
+			internalDetails: gin.H{},
+		}
+		if attempt.StartedAt != nil {
+			e.Details["started_at"] = attempt.StartedAt
+		}
+		if attempt.WorkerID != "" {
+			e.internalDetails["worker_id"] = attempt.WorkerID
+		}
+		add(e)
+	}
+
+	// Owners only see that the job changed hands; who held it is internal
+	for _, transfer := range job.Transfers {
+		add(timelineEntry{
+			Timestamp:       transfer.At,
+			Category:        timelineStatus,
+			Summary:         "Transferred to another owner",
+			internalDetails: gin.H{"from": transfer.From, "to": transfer.To, "actor": transfer.Actor},
+		})
+	}
+
+	// A finished job's last update may be a later delivery write, so the
+	// worker's processing time places the end more precisely
+	finished := job.UpdatedAt
+	approximate := true
+	if !started.IsZero() && job.ProcessingMs > 0 {
+		finished = started.Add(time.Duration(job.ProcessingMs) * time.Millisecond)
+		approximate = false
+	}
+	switch job.Status {
+	case queue.StatusCompleted:
+		done := timelineEntry{
+			Timestamp:       finished,
+			Category:        timelineStatus,
+			Summary:         "Completed",
+			Details:         gin.H{"status": string(queue.StatusCompleted), "processing_ms": job.ProcessingMs},
+			internalDetails: gin.H{"output_path": job.OutputPath},
+		}
+		if len(job.Warnings) > 0 {
+			done.Details["warnings"] = job.Warnings
+		}
+		if job.ModelSelection != nil {
+			done.Details["model"] = job.ModelSelection.Model
+			done.internalDetails["model_selection"] = job.ModelSelection
+		}
+		if approximate {
+			done.Details["approximate_time"] = true
+		}
+		add(done)
+	case queue.StatusFailed:
+		failed := timelineEntry{
+			Timestamp: finished,
+			Category:  timelineStatus,
+			Summary:   "Failed: " + job.Error,
+			Details:   gin.H{"status": string(queue.StatusFailed), "error": job.Error, "error_code": job.ErrorCode},
+		}
+		if approximate {
+			failed.Details["approximate_time"] = true
+		}
+		add(failed)
+	case queue.StatusCancelled:
+		// Nothing updates a job after it's cancelled
+		add(timelineEntry{
+			Timestamp: job.UpdatedAt,
+			Category:  timelineStatus,
+			Summary:   "Cancelled",
+			Details:   gin.H{"status": string(queue.StatusCancelled)},
+		})
+	}
+
+	source, ok := h.jobQueue.(timelineSource)
+	if !ok {
+		sortTimeline(entries)
+		return entries, nil
+	}
+
+	if len(job.Deliveries) > 0 {
+		dueAt, scheduled, err := source.DeliveryDueAt(ctx, job.ID)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range job.Deliveries {
+			add(deliveryEntry(d, job.UpdatedAt, dueAt, scheduled))
+		}
+	}
+
+	history, err := source.JobDownloadHistory(ctx, job.ID)
+	if err != nil {
+		return nil, err
+	}
+	for day, count := range history.Days {
+		at, err := time.Parse("2006-01-02", day)
+		if err != nil {
+			continue
+		}
+		// Nothing can be downloaded before the job finished
+		if at.Before(finished) {
+			at = finished
+		}
+		add(timelineEntry{
+			Timestamp: at,
+			Category:  timelineDownload,
+			Summary:   fmt.Sprintf("Downloaded %d times on %s (UTC)", count, day),
+			Details:   gin.H{"day": day, "count": count, "approximate_time": true},
+		})
+	}
+	if history.Active > 0 {
+		add(timelineEntry{
+			Timestamp: h.clock.Now(),
+			Category:  timelineDownload,
+			Summary:   fmt.Sprintf("Downloads in progress: %d", history.Active),
+			Details:   gin.H{"active": history.Active},
+		})
+	}
+
+	sortTimeline(entries)
+	return entries, nil
+}
+
+// deliveryEntry describes where a delivery stands. Only successes record a
+// time; failures are placed at the job's last update, and a retry still to
+// come at the time it's due.
+func deliveryEntry(d queue.Delivery, updatedAt, dueAt time.Time, scheduled bool) timelineEntry {
+	target := d.Type
+	if u, err := url.Parse(d.URL); err == nil && u.Host != "" {
+		target += " to " + u.Host
+	}
+	e := timelineEntry{
+		Category: timelineDelivery,
+		Details: gin.H{
+			"type":     d.Type,
+			"url":      redactQuery(d.URL),
+			"status":   string(d.Status),
+			"attempts": d.Attempts,
+		},
+	}
+	if d.LastError != "" {
+		e.Details["error"] = d.LastError
+	}
+
+	switch {
+	case d.Status == queue.DeliveryDelivered && d.DeliveredAt != nil:
+		e.Timestamp = *d.DeliveredAt
+		e.Summary = fmt.Sprintf("Delivered %s after %s", target, attemptCount(d.Attempts))
+	case d.Status == queue.DeliveryFailed:
+		e.Timestamp = updatedAt
+		e.Summary = fmt.Sprintf("Gave up delivering %s after %s", target, attemptCount(d.Attempts))
+		e.Details["approximate_time"] = true
+	case scheduled:
+		e.Timestamp = dueAt
+		e.Summary = fmt.Sprintf("Delivery %s due, attempt %d", target, d.Attempts+1)
+	default:
+		e.Timestamp = updatedAt
+		e.Summary = fmt.Sprintf("Delivery %s pending after %s", target, attemptCount(d.Attempts))
+		e.Details["approximate_time"] = true
+	}
+	return e
+}
+
+// ownerAttempts returns a job's attempt history as its owner sees it,
+// without the workers that made the attempts
+func ownerAttempts(history []queue.Attempt) []queue.Attempt {
+	attempts := make([]queue.Attempt, len(history))
+	for i, attempt := range history {
+		attempt.WorkerID = ""
+		attempts[i] = attempt
+	}
+	return attempts
+}
+
+// attemptCount formats a number of delivery attempts
+func attemptCount(n int) string {
+	if n == 1 {
+		return "1 attempt"
+	}
+	return strconv.Itoa(n) + " attempts"
+}
+
+// sortTimeline orders entries by time, then category, keeping the order
+// they were added in for ties, so the same job always lists the same way
+func sortTimeline(entries []timelineEntry) {
+	sort.SliceStable(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if !a.Timestamp.Equal(b.Timestamp) {
+			return a.Timestamp.Before(b.Timestamp)
+		}
+		return timelineRanks[a.Category] < timelineRanks[b.Category]
+	})
+}
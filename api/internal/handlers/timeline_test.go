@@ -0,0 +1,58 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+func TestGetJobTimelineNeedsTheJobsOwner(t *testing.T) {
+	h, jobs := newRedisTestHandler(t)
+	ctx := context.Background()
+	for _, job := range []*queue.Job{
+		{ID: "alice-job", Status: queue.StatusPending, Owner: "alice"},
+		{ID: "anonymous-job", Status: queue.StatusPending, Owner: "192.0.2.1"},
+	} {
+		if err := jobs.AddJob(ctx, job); err != nil {
+			t.Fatalf("AddJob: %v", err)
+		}
+	}
+	alice, bob := newTestAPIKey(t, jobs, "alice"), newTestAPIKey(t, jobs, "bob")
+
+	router := gin.New()
+	router.GET("/job/:id/timeline", h.Authenticate, h.GetJobTimeline)
+
+	for _, tc := range []struct {
+		name     string
+		jobID    string
+		secret   string
+		adminKey string
+		want     int
+	}{
+		{"anonymous", "alice-job", "", "", http.StatusUnauthorized},
+		{"anonymous for a job submitted anonymously", "anonymous-job", "", "", http.StatusUnauthorized},
+		{"another owner", "alice-job", bob, "", http.StatusNotFound},
+		{"an owner for a job submitted anonymously", "anonymous-job", bob, "", http.StatusNotFound},
+		{"the owner", "alice-job", alice, "", http.StatusOK},
+		{"the admin key", "anonymous-job", "", testAdminKey, http.StatusOK},
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/job/"+tc.jobID+"/timeline", nil)
+		req.RemoteAddr = "192.0.2.1:41000"
+		if tc.secret != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.secret)
+		}
+		if tc.adminKey != "" {
+			req.Header.Set(adminKeyHeader, tc.adminKey)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Errorf("%s: got %d, want %d: %s", tc.name, w.Code, tc.want, w.Body)
+		}
+	}
+}
@@ -0,0 +1,267 @@
+package handlers
+
+import (
+	"context"
+	"expvar"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// transcodes counts variant cache hits, misses, and failed transcodes
+var transcodes = expvar.NewMap("download_transcodes")
+
+// variantStore is implemented by queues that bound the transcoded variant cache
+type variantStore interface {
+	TrackVariant(ctx context.Context, path string, max int) ([]string, error)
+	ForgetVariants(ctx context.Context, paths ...string) error
+}
+
+// resultFormat is a format results can be transcoded to on download
+type resultFormat struct {
+	name   string
+	encode func(w io.Writer, img image.Image, quality int) error
+}
+
+// mediaType returns the media type the format is served as
+func (f *resultFormat) mediaType() string {
+	return queue.FormatMediaType(f.name)
+}
+
+// transcodeFormats are the formats downloads can be converted to. WebP
+// results are served as stored, as there is no WebP encoder available.
+var transcodeFormats = []resultFormat{
+	{name: queue.FormatPNG, encode: func(w io.Writer, img image.Image, _ int) error {
+		return png.Encode(w, img)
+	}},
+	{name: queue.FormatJPEG, encode: func(w io.Writer, img image.Image, quality int) error {
+		// JPEG has no alpha, so flatten the cut-out onto white
+		flat := image.NewRGBA(img.Bounds())
+		draw.Draw(flat, flat.Bounds(), image.NewUniform(color.White), image.Point{}, draw.Src)
+		draw.Draw(flat, flat.Bounds(), img, img.Bounds().Min, draw.Over)
+		return jpeg.Encode(w, flat, &jpeg.Options{Quality: quality})
+	}},
+}
+
+// negotiateFormat picks the format to serve for an Accept header: the
+// transcodable format the client prefers most, or nil to serve the stored
+// format, which wins ties and is the fallback when nothing is acceptable
+func negotiateFormat(accept, stored string) *resultFormat {
+	if strings.TrimSpace(accept) == "" {
+		return nil
+	}
+	ranges := parseAccept(accept)
+	best, bestQ := (*resultFormat)(nil), acceptQuality(ranges, stored)
+	for i := range transcodeFormats {
+		f := &transcodeFormats[i]
+		if f.mediaType() == stored {
+			continue
+		}
+		if q := acceptQuality(ranges, f.mediaType()); q > bestQ {
+			best, bestQ = f, q
+		}
+	}
+	return best
+}
+
+// mediaRange is one entry of an Accept header
+type mediaRange struct {
+	mediaType string
+	q         float64
+}
+
+// parseAccept parses an Accept header into media ranges with their quality
+func parseAccept(accept string) []mediaRange {
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		params := strings.Split(part, ";")
+		r := mediaRange{mediaType: strings.ToLower(strings.TrimSpace(params[0])), q: 1}
+		for _, param := range params[1:] {
+			name, value, _ := strings.Cut(strings.TrimSpace(param), "=")
+			if strings.EqualFold(name, "q") {
+				if q, err := strconv.ParseFloat(value, 64); err == nil {
+					r.q = q
+				}
+			}
+		}
+		if r.mediaType != "" {
+			ranges = append(ranges, r)
+		}
+	}
+	return ranges
+}
+
+// acceptQuality returns the quality of the most specific range matching
+// mediaType, or 0 if none does
+func acceptQuality(ranges []mediaRange, mediaType string) float64 {
+	kind, _, _ := strings.Cut(mediaType, "/")
+	q, specificity := 0.0, 0
+	for _, r := range ranges {
+		s := 0
+		switch r.mediaType {
+		case mediaType:
+			s = 3
+		case kind + "/*":
+			s = 2
+		case "*/*":
+			s = 1
+		}
+		if s > specificity {
+			q, specificity = r.q, s
+		}
+	}
+	return q
+}
+
+// variantPath is where a result transcoded to format is cached, next to the result
+func variantPath(outputPath string, format *resultFormat) string {
+	return strings.TrimSuffix(outputPath, filepath.Ext(outputPath)) + ".variant" + queue.FormatExt(format.name)
+}
+
+// negotiatedResult returns the path and format of the file to serve for the
+// request's Accept header, transcoding the result when the client prefers
+// another format. Failures fall back to the stored result.
+func (h *Handler) negotiatedResult(ctx context.Context, job *queue.Job, accept string) (string, string) {
+	if !h.transcodeDownloads {
+		return job.OutputPath, job.ResultFormat()
+	}
+	format := negotiateFormat(accept, queue.FormatMediaType(job.ResultFormat()))
+	if format == nil {
+		return job.OutputPath, job.ResultFormat()
+	}
+
+	path, err := h.variants.do(variantPath(job.OutputPath, format), func(path string) error {
+		return h.transcode(job.OutputPath, path, format)
+	})
+	if err != nil {
+		transcodes.Add("failures", 1)
+		log.Printf("Failed to transcode result of job %s to %s: %v", job.ID, format.mediaType(), err)
+		return job.OutputPath, job.ResultFormat()
+	}
+	h.trackVariant(ctx, path)
+	return path, format.name
+}
+
+// transcode converts the result at src to format, writing dst atomically
+// so concurrent readers never see a partial variant
+func (h *Handler) transcode(src, dst string, format *resultFormat) error {
+	if _, err := h.fs.Stat(dst); err == nil {
+		transcodes.Add("hits", 1)
+		return nil
+	}
+	transcodes.Add("misses", 1)
+
+	img, err := h.decodeBounded(src)
+	if err != nil {
+		return err
+	}
+
+	suffix, err := generateID()
+	if err != nil {
+		return err
+	}
+	tmp := dst + ".tmp-" + suffix
+	out, err := h.fs.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := format.encode(out, img, h.transcodeQuality); err != nil {
+		out.Close()
+		h.fs.Remove(tmp)
+		return err
+	}
+	if err := out.Close(); err != nil {
+		h.fs.Remove(tmp)
+		return err
+	}
+	if err := h.fs.Rename(tmp, dst); err != nil {
+		h.fs.Remove(tmp)
+		return err
+	}
+	return nil
+}
+
+// trackVariant records a variant's use and removes the variants evicted
+// from the bounded cache
+func (h *Handler) trackVariant(ctx context.Context, path string) {
+	store, ok := h.jobQueue.(variantStore)
+	if !ok {
+		return
+	}
+	evicted, err := store.TrackVariant(ctx, path, h.transcodeCacheSize)
+	if err != nil {
+		log.Printf("Failed to track result variant %q: %v", path, err)
+		return
+	}
+	for _, old := range evicted {
+		h.fs.Remove(old)
+		h.invalidateCachedResult(old)
+	}
+}
+
+// removeVariants deletes the cached variants of a job's result along with it
+func (h *Handler) removeVariants(ctx context.Context, job *queue.Job) {
+	if job.OutputPath == "" {
+		return
+	}
+	var paths []string
+	for i := range transcodeFormats {
+		path := variantPath(job.OutputPath, &transcodeFormats[i])
+		h.fs.Remove(path)
+		h.invalidateCachedResult(path)
+		paths = append(paths, path)
+	}
+	if store, ok := h.jobQueue.(variantStore); ok {
+		if err := store.ForgetVariants(ctx, paths...); err != nil {
+			log.Printf("Failed to forget result variants of job %s: %v", job.ID, err)
+		}
+	}
+}
+
+// flightGroup runs one transcode per variant at a time, sharing its
+// outcome with concurrent requests for the same variant
+type flightGroup struct {
+	mu      sync.Mutex
+	flights map[string]*flight
+}
+
+// flight is a transcode in progress
+type flight struct {
+	done chan struct{}
+	err  error
+}
+
+// do runs fn for key unless a run for key is already in flight, in which
+// case it waits for that run. It returns key along with the run's error.
+func (g *flightGroup) do(key string, fn func(key string) error) (string, error) {
+	g.mu.Lock()
+	if g.flights == nil {
+		g.flights = make(map[string]*flight)
+	}
+	if f, ok := g.flights[key]; ok {
+		g.mu.Unlock()
+		<-f.done
+		return key, f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	g.flights[key] = f
+	g.mu.Unlock()
+
+	f.err = fn(key)
+	close(f.done)
+
+	g.mu.Lock()
+	delete(g.flights, key)
+	g.mu.Unlock()
+	return key, f.err
+}
@@ -0,0 +1,235 @@
+package handlers
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// jobTransferrer is implemented by queues that can change a job's owner
+type jobTransferrer interface {
+	TransferJob(ctx context.Context, req queue.TransferRequest) (*queue.Job, error)
+}
+
+// apiKeyFinder is implemented by queues that can look API keys up by ID
+type apiKeyFinder interface {
+	APIKeyByID(ctx context.Context, id string) (*queue.APIKey, error)
+}
+
+// auditRecorder is implemented by queues that keep an audit log
+type auditRecorder interface {
+	RecordAudit(ctx context.Context, entry queue.AuditEntry) error
+}
+
+// transferBody names who a job is given to, by owner or by one of their
+// API keys, and optionally replaces its pending deliveries
+type transferBody struct {
+	Owner      string          `json:"owner"`
+	KeyID      string          `json:"key_id"`
+	Deliveries json.RawMessage `json:"deliveries"`
+}
+
+// TransferJob gives one of the caller's jobs to another owner. Only an
+// authenticated owner can: a client IP doesn't prove who submitted a job,
+// and the admin key transfers through AdminTransferJob.
+func (h *Handler) TransferJob(c *gin.Context) {
+	if authenticatedOwner(c) == "" {
+		authFailures.Add("credentials_missing", 1)
+		c.Header("WWW-Authenticate", `Bearer realm="api"`)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "Transferring a job needs its owner's API key or token"})
+		return
+	}
+	h.transferJob(c, false)
+}
+
+// AdminTransferJob gives any job to another owner. It skips the ownership
+// check only for requests RequireAdmin admitted, so it stays closed even if
+// mounted outside the admin group.
+func (h *Handler) AdminTransferJob(c *gin.Context) {
+	if !isAdmin(c) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "Transferring another owner's job needs the admin key"})
+		return
+	}
+	h.transferJob(c, true)
+}
+
+// transferJob moves a job, its quota charge, and its search index entries
+// to the target owner. Deliveries keep their destinations unless the body
+// replaces them, so an agency's webhooks still fire after a handover.
+func (h *Handler) transferJob(c *gin.Context, admin bool) {
+	transferrer, ok := h.jobQueue.(jobTransferrer)
+	if !ok {
+		c.JSON(http.StatusNotImplemented, gin.H{"error": "Queue backend does not support job transfers"})
+		return
+	}
+	jobID := c.Param("id")
+	if h.rejectCaseVariant(c, jobID) {
+		return
+	}
+
+	var body transferBody
+	if err := c.ShouldBindJSON(&body); err != nil || (body.Owner == "") == (body.KeyID == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "Body must name the target as either owner or key_id"})
+		return
+	}
+	var deliveries []queue.Delivery
+	if len(body.Deliveries) > 0 && string(body.Deliveries) != "null" {
+		var err error
+		if deliveries, err = h.decodeDeliveries(c.Request.Context(), string(body.Deliveries)); err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	ctx := c.Request.Context()
+	target, tier, ok := h.transferTarget(c, body)
+	if !ok {
+		return
+	}
+
+	job, err := queue.NilIfNotFound(h.jobQueue.GetJob(ctx, jobID))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to retrieve job"})
+		return
+	}
+	// Another owner's job is reported as missing, not forbidden
+	if job == nil || h.expired(job) || (!admin && job.Owner != authenticatedOwner(c)) {
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+	if job.Owner == target {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "The job already belongs to that owner"})
+		return
+	}
+
+	req := queue.TransferRequest{
+		JobID:      jobID,
+		From:       job.Owner,
+		To:         target,
+		Actor:      authenticatedOwner(c),
+		Deliveries: deliveries,
+	}
+	if admin {
+		req.Actor = "admin"
+	}
+	if h.quotasEnabled() {
+		req.Limits = h.quotaLimits[tier]
+	}
+	transferred, err := transferrer.TransferJob(ctx, req)
+	switch {
+	case errors.Is(err, queue.ErrTransferQuota):
+		c.JSON(http.StatusConflict, gin.H{"error": "The job doesn't fit in the target owner's daily quota", "tier": tier})
+		return
+	case errors.Is(err, queue.ErrTransferConflict):
+		c.Header("Retry-After", "1")
+		c.JSON(http.StatusConflict, gin.H{"error": "The job changed during the transfer, try again"})
+		return
+	case err != nil:
+		log.Printf("Failed to transfer job %s: %v", jobID, err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to transfer job"})
+		return
+	case transferred == nil:
+		// Gone, or transferred by someone else, since it was read
+		c.JSON(http.StatusNotFound, gin.H{"error": "Job not found"})
+		return
+	}
+
+	h.finishTransfer(ctx, job, transferred)
+	response := gin.H{
+		"job_id":         transferred.ID,
+		"owner":          transferred.Owner,
+		"previous_owner": job.Owner,
+	}
+	if len(transferred.Deliveries) > 0 {
+		response["deliveries"] = deliveryStatuses(transferred.Deliveries)
+	}
+	c.JSON(http.StatusOK, response)
+}
+
+// transferTarget resolves the owner a job is given to and the tier whose
+// quota it's charged against: the named key's tier, or the tier of the
+// owner's newest valid key. Owners without keys are on the free tier. It
+// writes an error response and returns false if the target is unknown.
+func (h *Handler) transferTarget(c *gin.Context, body transferBody) (string, string, bool) {
+	ctx := c.Request.Context()
+	now := h.clock.Now()
+	if body.KeyID != "" {
+		finder, ok := h.jobQueue.(apiKeyFinder)
+		if !ok {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "API keys are not supported"})
+			return "", "", false
+		}
+		key, err := finder.APIKeyByID(ctx, body.KeyID)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up the API key"})
+			return "", "", false
+		}
+		if key == nil || key.Expired(now) {
+			c.JSON(http.StatusNotFound, gin.H{"error": fmt.Sprintf("Unknown API key %s", body.KeyID)})
+			return "", "", false
+		}
+		return key.Owner, keyTier(key), true
+	}
+
+	tier := queue.TierFree
+	if store, ok := h.jobQueue.(apiKeyStore); ok {
+		keys, err := store.OwnerAPIKeys(ctx, body.Owner)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "Failed to look up the owner's API keys"})
+			return "", "", false
+		}
+		// Keys are listed oldest first
+		for _, key := range keys {
+			if !key.Expired(now) {
+				tier = keyTier(key)
+			}
+		}
+	}
+	return body.Owner, tier, true
+}
+
+// keyTier returns the tier an API key authenticates with
+func keyTier(key *queue.APIKey) string {
+	if key.Tier != "" {
+		return key.Tier
+	}
+	return queue.TierFree
+}
+
+// finishTransfer moves what the queue left to the caller: the job's search
+// index entries and the old owner's idempotency key, which would otherwise
+// replay a job they no longer own. It then records the transfer in the
+// audit log. Failures are logged; the transfer itself has happened.
+func (h *Handler) finishTransfer(ctx context.Context, before, after *queue.Job) {
+	if err := h.unindexJob(ctx, before); err != nil {
+		log.Printf("Failed to unindex transferred job %s: %v", before.ID, err)
+	}
+	h.indexJob(ctx, after)
+
+	if idempotency, ok := h.jobQueue.(idempotencyStore); ok && before.IdempotencyKey != "" {
+		if err := idempotency.ForgetIdempotencyKey(ctx, before.Owner, before.IdempotencyKey, before.ID); err != nil {
+			log.Printf("Failed to forget the idempotency key of transferred job %s: %v", before.ID, err)
+		}
+	}
+
+	if auditor, ok := h.jobQueue.(auditRecorder); ok {
+		transfer := after.Transfers[len(after.Transfers)-1]
+		entry := queue.AuditEntry{
+			At:     transfer.At,
+			Actor:  transfer.Actor,
+			Action: "transfer",
+			Target: "job:" + after.ID,
+			Detail: fmt.Sprintf("from %s to %s", transfer.From, transfer.To),
+		}
+		if err := auditor.RecordAudit(ctx, entry); err != nil {
+			log.Printf("Failed to record the transfer of job %s: %v", after.ID, err)
+		}
+	}
+}
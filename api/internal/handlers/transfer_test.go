@@ -0,0 +1,134 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+
+	"rembg-v2/api/internal/queue"
+)
+
+func TestAdminTransferJobNeedsAdmin(t *testing.T) {
+	h, jobs := newRedisTestHandler(t)
+	ctx := context.Background()
+	job := &queue.Job{ID: "job-1", Status: queue.StatusPending, Owner: "alice"}
+	if err := jobs.AddJob(ctx, job); err != nil {
+		t.Fatalf("AddJob: %v", err)
+	}
+
+	router := gin.New()
+	// Mounted by mistake outside the admin group
+	router.POST("/open/jobs/:id/transfer", h.Authenticate, h.AdminTransferJob)
+	admin := router.Group("/admin", h.Authenticate, h.RequireAdmin)
+	admin.POST("/jobs/:id/transfer", h.AdminTransferJob)
+
+	for _, tc := range []struct {
+		name     string
+		path     string
+		adminKey string
+		want     int
+	}{
+		{"outside the admin group", "/open/jobs/job-1/transfer", "", http.StatusForbidden},
+		{"outside the admin group with the key", "/open/jobs/job-1/transfer", testAdminKey, http.StatusForbidden},
+		{"without the key", "/admin/jobs/job-1/transfer", "", http.StatusUnauthorized},
+		{"with a wrong key", "/admin/jobs/job-1/transfer", "guess", http.StatusUnauthorized},
+	} {
+		w := serveTest(router, http.MethodPost, tc.path, strings.NewReader(`{"owner": "mallory"}`), tc.adminKey)
+		if w.Code != tc.want {
+			t.Errorf("%s: got %d, want %d: %s", tc.name, w.Code, tc.want, w.Body)
+		}
+		stored, err := jobs.GetJob(ctx, "job-1")
+		if err != nil {
+			t.Fatalf("GetJob: %v", err)
+		}
+		if stored.Owner != "alice" {
+			t.Fatalf("%s: job transferred to %q", tc.name, stored.Owner)
+		}
+	}
+
+	w := serveTest(router, http.MethodPost, "/admin/jobs/job-1/transfer", strings.NewReader(`{"owner": "bob"}`), testAdminKey)
+	if w.Code != http.StatusOK {
+		t.Fatalf("with the admin key: got %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	stored, err := jobs.GetJob(ctx, "job-1")
+	if err != nil {
+		t.Fatalf("GetJob: %v", err)
+	}
+	if stored.Owner != "bob" {
+		t.Fatalf("job owner is %q after the admin transfer, want bob", stored.Owner)
+	}
+}
+
+func TestTransferJobChecksOwnership(t *testing.T) {
+	h, jobs := newRedisTestHandler(t)
+	ctx := context.Background()
+	job := &queue.Job{ID: "job-1", Status: queue.StatusPending, Owner: "alice"}
+	if err := jobs.AddJob(ctx, job); err != nil {
+		t.Fatalf("AddJob: %v", err)
+	}
+
+	anonymous := &queue.Job{ID: "job-2", Status: queue.StatusPending, Owner: "192.0.2.1"}
+	if err := jobs.AddJob(ctx, anonymous); err != nil {
+		t.Fatalf("AddJob: %v", err)
+	}
+	alice, bob := newTestAPIKey(t, jobs, "alice"), newTestAPIKey(t, jobs, "bob")
+
+	router := gin.New()
+	router.POST("/job/:id/transfer", h.Authenticate, h.TransferJob)
+	for _, tc := range []struct {
+		name     string
+		jobID    string
+		secret   string
+		adminKey string
+		want     int
+	}{
+		// Anonymous requests never own a job, whatever IP they come from
+		{"anonymous", "job-1", "", "", http.StatusUnauthorized},
+		{"anonymous for a job submitted anonymously", "job-2", "", "", http.StatusUnauthorized},
+		{"the admin key outside the admin group", "job-2", "", testAdminKey, http.StatusUnauthorized},
+		{"another owner", "job-1", bob, "", http.StatusNotFound},
+		{"an owner for a job submitted anonymously", "job-2", bob, "", http.StatusNotFound},
+	} {
+		req := httptest.NewRequest(http.MethodPost, "/job/"+tc.jobID+"/transfer", strings.NewReader(`{"owner": "mallory"}`))
+		req.RemoteAddr = "192.0.2.1:41000"
+		if tc.secret != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.secret)
+		}
+		if tc.adminKey != "" {
+			req.Header.Set(adminKeyHeader, tc.adminKey)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		if w.Code != tc.want {
+			t.Errorf("%s: got %d, want %d: %s", tc.name, w.Code, tc.want, w.Body)
+		}
+	}
+	for _, job := range []*queue.Job{job, anonymous} {
+		stored, err := jobs.GetJob(ctx, job.ID)
+		if err != nil {
+			t.Fatalf("GetJob: %v", err)
+		}
+		if stored.Owner != job.Owner {
+			t.Fatalf("%s transferred to %q", job.ID, stored.Owner)
+		}
+	}
+
+	w := serveAs(router, http.MethodPost, "/job/job-1/transfer", strings.NewReader(`{"owner": "bob"}`), alice)
+	if w.Code != http.StatusOK {
+		t.Fatalf("owner: got %d, want %d: %s", w.Code, http.StatusOK, w.Body)
+	}
+	stored, err := jobs.GetJob(ctx, "job-1")
+	if err != nil {
+		t.Fatalf("GetJob: %v", err)
+	}
+	if stored.Owner != "bob" {
+		t.Fatalf("job owner is %q after the transfer, want bob", stored.Owner)
+	}
+	if last := stored.Transfers[len(stored.Transfers)-1]; last.Actor != "alice" {
+		t.Fatalf("transfer recorded as made by %q, want alice", last.Actor)
+	}
+}
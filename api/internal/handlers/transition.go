@@ -0,0 +1,26 @@
+package handlers
+
+import (
+	"context"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// statusTransitioner is implemented by queues that change a job's status
+// only if it's still the one the change was made from
+type statusTransitioner interface {
+	TransitionJob(ctx context.Context, jobID string, from, to queue.JobStatus, mutate func(*queue.Job)) error
+}
+
+// transitionJob writes a job whose status was changed from from, failing
+// with queue.ErrInvalidTransition if the stored job has left that status
+// meanwhile. Queues without transitions write it unconditionally.
+func (h *Handler) transitionJob(ctx context.Context, job *queue.Job, from queue.JobStatus) error {
+	transitioner, ok := h.jobQueue.(statusTransitioner)
+	if !ok {
+		return h.jobQueue.UpdateJob(ctx, job)
+	}
+	return transitioner.TransitionJob(ctx, job.ID, from, job.Status, func(stored *queue.Job) {
+		*stored = *job
+	})
+}
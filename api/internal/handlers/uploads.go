@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"context"
+	"expvar"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+
+	"github.com/gin-gonic/gin"
+)
+
+// uploadRetryAfter is the Retry-After, in seconds, of uploads turned away
+// while every upload slot is taken
+const uploadRetryAfter = 1
+
+// uploadStats tracks uploads in flight, uploads turned away at the limit,
+// and partial or orphaned uploads removed
+var uploadStats = expvar.NewMap("uploads")
+
+// uploadRegistry tracks the uploads being saved, so the file of one whose
+// request is cancelled or fails is removed right away rather than left for
+// the sweeper, and caps how many are in flight at once
+type uploadRegistry struct {
+	mu      sync.Mutex
+	limit   int
+	pending map[*upload]struct{}
+}
+
+// upload is one request's claim on an upload slot
+type upload struct {
+	registry *uploadRegistry
+	fs       FS
+	// paths are the files to remove unless the upload is kept, guarded by registry.mu
+	paths []string
+}
+
+// newUploadRegistry returns a registry allowing limit uploads at once, or
+// any number if limit isn't positive
+func newUploadRegistry(limit int) *uploadRegistry {
+	return &uploadRegistry{limit: limit, pending: make(map[*upload]struct{})}
+}
+
+// begin claims a slot for an upload stored on fsys, or reports false if
+// every slot is taken
+func (r *uploadRegistry) begin(fsys FS) (*upload, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.limit > 0 && len(r.pending) >= r.limit {
+		return nil, false
+	}
+	u := &upload{registry: r, fs: fsys}
+	r.pending[u] = struct{}{}
+	uploadStats.Add("in_flight", 1)
+	return u, true
+}
+
+// track names a file the upload is being saved to, or one made from it
+func (u *upload) track(path string) {
+	u.registry.mu.Lock()
+	u.paths = append(u.paths, path)
+	u.registry.mu.Unlock()
+}
+
+// keep hands the saved files over to the jobs referencing it and frees the slot
+func (u *upload) keep() {
+	u.release()
+}
+
+// finish frees the slot, removing the files unless they were kept. Deferred by
+// every handler that claims a slot, so a cancelled or failed request never
+// leaves its upload behind.
+func (u *upload) finish() {
+	if paths := u.release(); len(paths) > 0 {
+		for _, path := range paths {
+			u.fs.Remove(path)
+		}
+		uploadStats.Add("discarded", 1)
+	}
+}
+
+// release unregisters the upload, returning the files it was tracking, or
+// none if it was already released
+func (u *upload) release() []string {
+	u.registry.mu.Lock()
+	defer u.registry.mu.Unlock()
+	if _, ok := u.registry.pending[u]; !ok {
+		return nil
+	}
+	delete(u.registry.pending, u)
+	uploadStats.Add("in_flight", -1)
+	return u.paths
+}
+
+// abort releases every upload in flight, removing their files, and returns
+// how many files it removed
+func (r *uploadRegistry) abort() int {
+	r.mu.Lock()
+	pending := r.pending
+	r.pending = make(map[*upload]struct{})
+	r.mu.Unlock()
+
+	removed := 0
+	for u := range pending {
+		uploadStats.Add("in_flight", -1)
+		if len(u.paths) > 0 {
+			for _, path := range u.paths {
+				u.fs.Remove(path)
+			}
+			uploadStats.Add("discarded", 1)
+			removed++
+		}
+	}
+	return removed
+}
+
+// beginUpload claims an upload slot for the request, answering 503 when
+// every slot is taken. The caller defers finish on the returned upload.
+func (h *Handler) beginUpload(c *gin.Context) (*upload, bool) {
+	u, ok := h.uploads.begin(h.fs)
+	if !ok {
+		uploadStats.Add("rejected", 1)
+		c.Header("Retry-After", strconv.Itoa(uploadRetryAfter))
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Too many uploads in progress", "retry_after": uploadRetryAfter})
+		return nil, false
+	}
+	return u, true
+}
+
+// AbortUploads removes the files of uploads still being handled. Run at
+// shutdown once the server has stopped waiting for its handlers.
+func (h *Handler) AbortUploads() {
+	if removed := h.uploads.abort(); removed > 0 {
+		log.Printf("Removed %d unfinished uploads", removed)
+	}
+}
+
+// ctxReader stops reading once its context is done, so a cancelled request
+// stops writing its upload to storage mid-copy
+type ctxReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (r ctxReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.r.Read(p)
+}
@@ -0,0 +1,86 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image/gif"
+	"io"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// maxGIFInspectSize caps the GIF size we fully decode to count frames
+const maxGIFInspectSize = 20 << 20
+
+// inspectUpload returns warnings about an uploaded image that don't prevent processing
+func inspectUpload(fsys FS, path string) []queue.Warning {
+	var warnings []queue.Warning
+
+	if isAnimated(fsys, path) {
+		warnings = append(warnings, queue.Warning{
+			Code:    queue.WarningAnimatedInput,
+			Message: "Only the first frame of the animated image is processed",
+		})
+	}
+
+	return warnings
+}
+
+// isAnimated reports whether the file is an animated GIF, PNG, or WebP
+func isAnimated(fsys FS, path string) bool {
+	f, err := fsys.Open(path)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+
+	header := make([]byte, 32)
+	n, _ := io.ReadFull(f, header)
+	header = header[:n]
+
+	switch {
+	case bytes.HasPrefix(header, []byte("GIF8")):
+		info, err := f.Stat()
+		if err != nil || info.Size() > maxGIFInspectSize {
+			return false
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return false
+		}
+		g, err := gif.DecodeAll(f)
+		return err == nil && len(g.Image) > 1
+	case bytes.HasPrefix(header, []byte("\x89PNG\r\n\x1a\n")):
+		if _, err := f.Seek(8, io.SeekStart); err != nil {
+			return false
+		}
+		return hasAPNGControlChunk(f)
+	case len(header) >= 21 && bytes.Equal(header[0:4], []byte("RIFF")) && bytes.Equal(header[8:12], []byte("WEBP")):
+		// The extended VP8X header carries an animation flag
+		return bytes.Equal(header[12:16], []byte("VP8X")) && header[20]&0x02 != 0
+	}
+
+	return false
+}
+
+// hasAPNGControlChunk scans PNG chunks up to the first IDAT for an acTL chunk
+func hasAPNGControlChunk(r io.ReadSeeker) bool {
+	chunk := make([]byte, 8)
+	for {
+		if _, err := io.ReadFull(r, chunk); err != nil {
+			return false
+		}
+
+		length := binary.BigEndian.Uint32(chunk[:4])
+		switch string(chunk[4:8]) {
+		case "acTL":
+			return true
+		case "IDAT", "IEND":
+			return false
+		}
+
+		// Skip the chunk data and CRC
+		if _, err := r.Seek(int64(length)+4, io.SeekCurrent); err != nil {
+			return false
+		}
+	}
+}
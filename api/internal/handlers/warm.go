@@ -0,0 +1,54 @@
+package handlers
+
+import (
+	"context"
+	"net/http"
+	"path/filepath"
+	"time"
+
+	"github.com/gin-gonic/gin"
+)
+
+// warmer is implemented by queues that can pre-open their connections
+type warmer interface {
+	Warm(ctx context.Context) error
+}
+
+// Warm prepares the handler for traffic: it makes sure the storage
+// directories exist and are writable, and pre-dials queue connections
+func (h *Handler) Warm(ctx context.Context) error {
+	for _, dir := range []string{h.uploadDir, h.resultsDir} {
+		if err := h.fs.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+
+		// Touch the directory so the first upload doesn't pay for a cold lookup
+		probe := filepath.Join(dir, ".warm")
+		f, err := h.fs.Create(probe)
+		if err != nil {
+			return err
+		}
+		f.Close()
+		h.fs.Remove(probe)
+		h.logCaseInsensitive(dir)
+	}
+
+	if w, ok := h.jobQueue.(warmer); ok {
+		return w.Warm(ctx)
+	}
+	return nil
+}
+
+// WarmPools re-runs the startup warm-up, e.g. after a configuration change
+func (h *Handler) WarmPools(c *gin.Context) {
+	start := time.Now()
+	if err := h.Warm(c.Request.Context()); err != nil {
+		c.JSON(http.StatusServiceUnavailable, gin.H{"error": "Warm-up failed: " + err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"warmed":      []string{filepath.Clean(h.uploadDir), filepath.Clean(h.resultsDir), "queue"},
+		"duration_ms": time.Since(start).Milliseconds(),
+	})
+}
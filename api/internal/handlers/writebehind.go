@@ -0,0 +1,199 @@
+package handlers
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"sync"
+	"time"
+
+	"rembg-v2/api/internal/errclass"
+	"rembg-v2/api/internal/queue"
+)
+
+const (
+	// writeBehindMinBackoff and writeBehindMaxBackoff bound the wait between flush attempts
+	writeBehindMinBackoff = 100 * time.Millisecond
+	writeBehindMaxBackoff = 5 * time.Second
+)
+
+var (
+	// writeBehindDepth is the number of submissions buffered in this process
+	writeBehindDepth = expvar.NewInt("write_behind_depth")
+	// writeBehindEvents counts buffered, flushed, rejected, and dropped submissions
+	writeBehindEvents = expvar.NewMap("write_behind")
+)
+
+// writeBehind buffers submissions the queue rejected with a transient error,
+// in submission order, until they can be written. Buffered jobs live only
+// in this process and are lost if it crashes.
+type writeBehind struct {
+	capacity int
+	wake     chan struct{}
+	// flushing keeps the background flush and the shutdown drain from
+	// writing the same job twice
+	flushing sync.Mutex
+
+	mu   sync.Mutex
+	jobs []*queue.Job
+}
+
+// WithWriteBehind buffers up to capacity submissions in memory while the
+// queue is briefly unavailable
+func WithWriteBehind(capacity int) Option {
+	return func(h *Handler) {
+		h.writeBehind = &writeBehind{capacity: capacity, wake: make(chan struct{}, 1)}
+	}
+}
+
+// push buffers a job, reporting false when the buffer is full
+func (b *writeBehind) push(job *queue.Job) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.jobs) >= b.capacity {
+		return false
+	}
+	b.jobs = append(b.jobs, job)
+	writeBehindDepth.Set(int64(len(b.jobs)))
+
+	select {
+	case b.wake <- struct{}{}:
+	default:
+	}
+	return true
+}
+
+// get returns the buffered job with the given ID, or nil
+func (b *writeBehind) get(jobID string) *queue.Job {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, job := range b.jobs {
+		if job.ID == jobID {
+			return job
+		}
+	}
+	return nil
+}
+
+// peek returns the oldest buffered job, or nil
+func (b *writeBehind) peek() *queue.Job {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.jobs) == 0 {
+		return nil
+	}
+	return b.jobs[0]
+}
+
+// pop removes the oldest buffered job
+func (b *writeBehind) pop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.jobs = b.jobs[1:]
+	writeBehindDepth.Set(int64(len(b.jobs)))
+}
+
+// bufferSubmission keeps a job the queue couldn't take because of a
+// transient error. It reports false if write-behind is off, the error is
+// permanent, or the buffer is full.
+func (h *Handler) bufferSubmission(job *queue.Job, err error) bool {
+	if h.writeBehind == nil || !queue.IsTransient(err) {
+		return false
+	}
+	if !h.writeBehind.push(job) {
+		writeBehindEvents.Add("rejected", 1)
+		return false
+	}
+	writeBehindEvents.Add("buffered", 1)
+	log.Printf("Buffered job %s locally after a transient queue error: %v", job.ID, err)
+	return true
+}
+
+// bufferedJob returns a submission still waiting in this replica's buffer, or nil
+func (h *Handler) bufferedJob(jobID string) *queue.Job {
+	if h.writeBehind == nil {
+		return nil
+	}
+	return h.writeBehind.get(jobID)
+}
+
+// RunWriteBehind writes buffered submissions to the queue in order until
+// ctx is done, backing off while the queue keeps failing
+func (h *Handler) RunWriteBehind(ctx context.Context) {
+	if h.writeBehind == nil {
+		return
+	}
+
+	backoff := writeBehindMinBackoff
+	for {
+		err := h.flushWriteBehind(ctx)
+		if err == nil {
+			backoff = writeBehindMinBackoff
+			select {
+			case <-ctx.Done():
+				return
+			case <-h.writeBehind.wake:
+			}
+			continue
+		}
+
+		// A throttled queue gets longer to recover
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(errclass.Delay(err, backoff)):
+		}
+		if backoff *= 2; backoff > writeBehindMaxBackoff {
+			backoff = writeBehindMaxBackoff
+		}
+	}
+}
+
+// DrainWriteBehind flushes the buffer until it is empty or ctx is done,
+// logging the IDs of any submissions lost on shutdown
+func (h *Handler) DrainWriteBehind(ctx context.Context) {
+	if h.writeBehind == nil {
+		return
+	}
+
+	for h.flushWriteBehind(ctx) != nil {
+		select {
+		case <-ctx.Done():
+			for job := h.writeBehind.peek(); job != nil; job = h.writeBehind.peek() {
+				writeBehindEvents.Add("dropped", 1)
+				log.Printf("Dropping buffered job %s on shutdown", job.ID)
+				h.writeBehind.pop()
+			}
+			return
+		case <-time.After(writeBehindMinBackoff):
+		}
+	}
+}
+
+// flushWriteBehind writes buffered jobs oldest first, returning nil once the
+// buffer is empty. It stops at the first transient failure, which it
+// returns, to keep order.
+func (h *Handler) flushWriteBehind(ctx context.Context) error {
+	h.writeBehind.flushing.Lock()
+	defer h.writeBehind.flushing.Unlock()
+
+	for job := h.writeBehind.peek(); job != nil; job = h.writeBehind.peek() {
+		err := h.jobQueue.AddJob(ctx, job)
+		if err != nil && (queue.IsTransient(err) || ctx.Err() != nil) {
+			return err
+		}
+
+		if err != nil {
+			// The queue won't ever take it, so return what was charged
+			writeBehindEvents.Add("dropped", 1)
+			log.Printf("Dropping buffered job %s: %v", job.ID, err)
+			job.Status = queue.StatusFailed
+			h.refundQuota(ctx, job)
+		} else {
+			writeBehindEvents.Add("flushed", 1)
+			h.indexJob(ctx, job)
+		}
+		h.writeBehind.pop()
+	}
+	return nil
+}
@@ -0,0 +1,165 @@
+// Package health tracks whether the API's dependencies are usable, from
+// periodic probes and the outcomes of real operations, so handlers can
+// degrade instead of failing deep inside a dependency call
+package health
+
+import (
+	"context"
+	"expvar"
+	"sort"
+	"sync"
+	"time"
+
+	"rembg-v2/api/internal/errclass"
+)
+
+// Dependency names
+const (
+	Storage = "storage"
+	Redis   = "redis"
+)
+
+// failureThreshold is how many consecutive failures mark a dependency down
+const failureThreshold = 3
+
+// probeTimeout bounds a single probe
+const probeTimeout = 5 * time.Second
+
+// transitions counts dependencies going down and recovering
+var transitions = expvar.NewMap("dependency_transitions")
+
+// Probe checks a dependency, returning nil if it is usable
+type Probe func(ctx context.Context) error
+
+// Status is the health of one dependency
+type Status struct {
+	Name      string    `json:"name"`
+	Healthy   bool      `json:"healthy"`
+	LastError string    `json:"last_error,omitempty"`
+	Since     time.Time `json:"since"`
+}
+
+// dependency is the tracked state of one dependency
+type dependency struct {
+	probe    Probe
+	failures int
+	status   Status
+}
+
+// Registry holds the health of every registered dependency. Dependencies
+// start healthy and go down after failureThreshold consecutive failures;
+// a single success brings them back.
+type Registry struct {
+	mu   sync.RWMutex
+	deps map[string]*dependency
+	now  func() time.Time
+}
+
+// NewRegistry creates an empty registry
+func NewRegistry() *Registry {
+	return &Registry{deps: make(map[string]*dependency), now: time.Now}
+}
+
+// Register adds a dependency checked by probe, which may be nil for
+// dependencies tracked only through Record
+func (r *Registry) Register(name string, probe Probe) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.deps[name] = &dependency{probe: probe, status: Status{Name: name, Healthy: true, Since: r.now()}}
+}
+
+// Record reports the outcome of an operation against a dependency.
+// Permanent failures, such as a missing file or a rejected command, are
+// answers from a working dependency and neither count against it nor
+// reset its failures.
+func (r *Registry) Record(name string, err error) {
+	if errclass.Classify(err) == errclass.Permanent {
+		return
+	}
+	r.record(name, err)
+}
+
+// record counts an outcome against a dependency, whatever its class
+func (r *Registry) record(name string, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	d, ok := r.deps[name]
+	if !ok {
+		return
+	}
+	if err == nil {
+		d.failures = 0
+		if !d.status.Healthy {
+			transitions.Add(name+"_up", 1)
+			d.status = Status{Name: name, Healthy: true, Since: r.now()}
+		}
+		return
+	}
+
+	d.failures++
+	d.status.LastError = err.Error()
+	if d.status.Healthy && d.failures >= failureThreshold {
+		transitions.Add(name+"_down", 1)
+		d.status.Healthy = false
+		d.status.Since = r.now()
+	}
+}
+
+// Healthy reports whether a dependency is usable. Unknown dependencies are healthy.
+func (r *Registry) Healthy(name string) bool {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	d, ok := r.deps[name]
+	return !ok || d.status.Healthy
+}
+
+// Snapshot returns the status of every dependency, sorted by name
+func (r *Registry) Snapshot() []Status {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	statuses := make([]Status, 0, len(r.deps))
+	for _, d := range r.deps {
+		statuses = append(statuses, d.status)
+	}
+	sort.Slice(statuses, func(i, j int) bool { return statuses[i].Name < statuses[j].Name })
+	return statuses
+}
+
+// Run probes every dependency each interval until ctx is done
+func (r *Registry) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		r.probeAll(ctx)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// probeAll runs every probe once and records the results
+func (r *Registry) probeAll(ctx context.Context) {
+	r.mu.RLock()
+	probes := make(map[string]Probe, len(r.deps))
+	for name, d := range r.deps {
+		if d.probe != nil {
+			probes[name] = d.probe
+		}
+	}
+	r.mu.RUnlock()
+
+	for name, probe := range probes {
+		probeCtx, cancel := context.WithTimeout(ctx, probeTimeout)
+		err := probe(probeCtx)
+		cancel()
+		if ctx.Err() != nil {
+			return
+		}
+		// A probe failing for any reason means the dependency can't be used
+		r.record(name, err)
+	}
+}
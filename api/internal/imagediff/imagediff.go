@@ -0,0 +1,175 @@
+// Package imagediff compares the alpha masks of two processed images
+package imagediff
+
+import (
+	"image"
+	"image/color"
+	"math"
+)
+
+// maskThreshold is the alpha value at or above which a pixel counts as foreground
+const maskThreshold = 128
+
+// Rect is a bounding box in the comparison grid
+type Rect struct {
+	MinX int `json:"min_x"`
+	MinY int `json:"min_y"`
+	MaxX int `json:"max_x"`
+	MaxY int `json:"max_y"`
+}
+
+// Report summarizes the differences between two images
+type Report struct {
+	DimensionsMatch bool    `json:"dimensions_match"`
+	WidthA          int     `json:"width_a"`
+	HeightA         int     `json:"height_a"`
+	WidthB          int     `json:"width_b"`
+	HeightB         int     `json:"height_b"`
+	CompareWidth    int     `json:"compare_width"`
+	CompareHeight   int     `json:"compare_height"`
+	AlphaIoU        float64 `json:"alpha_iou"`
+	MeanAlphaDiff   float64 `json:"mean_alpha_diff"`
+	BoundsA         *Rect   `json:"bounds_a,omitempty"`
+	BoundsB         *Rect   `json:"bounds_b,omitempty"`
+	BoundsShift     float64 `json:"bounds_shift"`
+}
+
+// Compare compares the alpha channels of a and b. When the dimensions differ
+// both images are sampled onto a grid the size of the smaller one. If visual
+// is true, a diff image is also returned: red where only a is foreground,
+// green where only b is, and grey where the alpha values differ.
+func Compare(a, b image.Image, visual bool) (Report, *image.NRGBA) {
+	ba, bb := a.Bounds(), b.Bounds()
+	w := minInt(ba.Dx(), bb.Dx())
+	h := minInt(ba.Dy(), bb.Dy())
+
+	report := Report{
+		DimensionsMatch: ba.Dx() == bb.Dx() && ba.Dy() == bb.Dy(),
+		WidthA:          ba.Dx(),
+		HeightA:         ba.Dy(),
+		WidthB:          bb.Dx(),
+		HeightB:         bb.Dy(),
+		CompareWidth:    w,
+		CompareHeight:   h,
+	}
+	if w == 0 || h == 0 {
+		return report, nil
+	}
+
+	var diff *image.NRGBA
+	if visual {
+		diff = image.NewNRGBA(image.Rect(0, 0, w, h))
+	}
+
+	var intersection, union int
+	var totalDiff float64
+	var boundsA, boundsB boundsAccumulator
+
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			alphaA := sampleAlpha(a, ba, x, y, w, h)
+			alphaB := sampleAlpha(b, bb, x, y, w, h)
+
+			inA := alphaA >= maskThreshold
+			inB := alphaB >= maskThreshold
+			if inA && inB {
+				intersection++
+			}
+			if inA || inB {
+				union++
+			}
+			if inA {
+				boundsA.add(x, y)
+			}
+			if inB {
+				boundsB.add(x, y)
+			}
+
+			delta := math.Abs(float64(alphaA) - float64(alphaB))
+			totalDiff += delta
+
+			if diff != nil {
+				diff.SetNRGBA(x, y, diffColor(inA, inB, uint8(delta)))
+			}
+		}
+	}
+
+	report.AlphaIoU = 1
+	if union > 0 {
+		report.AlphaIoU = float64(intersection) / float64(union)
+	}
+	report.MeanAlphaDiff = totalDiff / float64(w*h) / 255
+	report.BoundsA = boundsA.rect()
+	report.BoundsB = boundsB.rect()
+	if report.BoundsA != nil && report.BoundsB != nil {
+		report.BoundsShift = centerDistance(*report.BoundsA, *report.BoundsB)
+	}
+
+	return report, diff
+}
+
+// sampleAlpha returns the 8-bit alpha of img at grid position (x, y) of a w×h grid
+func sampleAlpha(img image.Image, bounds image.Rectangle, x, y, w, h int) uint8 {
+	sx := bounds.Min.X + x*bounds.Dx()/w
+	sy := bounds.Min.Y + y*bounds.Dy()/h
+	_, _, _, alpha := img.At(sx, sy).RGBA()
+	return uint8(alpha >> 8)
+}
+
+// diffColor returns the visual diff pixel for a grid position
+func diffColor(inA, inB bool, delta uint8) color.NRGBA {
+	switch {
+	case inA && !inB:
+		return color.NRGBA{R: 255, A: 255}
+	case inB && !inA:
+		return color.NRGBA{G: 255, A: 255}
+	}
+	return color.NRGBA{R: delta, G: delta, B: delta, A: 255}
+}
+
+// boundsAccumulator tracks the bounding box of foreground pixels
+type boundsAccumulator struct {
+	r     Rect
+	found bool
+}
+
+func (b *boundsAccumulator) add(x, y int) {
+	if !b.found {
+		b.r = Rect{MinX: x, MinY: y, MaxX: x, MaxY: y}
+		b.found = true
+		return
+	}
+	b.r.MinX = minInt(b.r.MinX, x)
+	b.r.MinY = minInt(b.r.MinY, y)
+	b.r.MaxX = maxInt(b.r.MaxX, x)
+	b.r.MaxY = maxInt(b.r.MaxY, y)
+}
+
+func (b *boundsAccumulator) rect() *Rect {
+	if !b.found {
+		return nil
+	}
+	r := b.r
+	return &r
+}
+
+// centerDistance returns the distance in pixels between the centers of two boxes
+func centerDistance(a, b Rect) float64 {
+	dx := float64(a.MinX+a.MaxX)/2 - float64(b.MinX+b.MaxX)/2
+	dy := float64(a.MinY+a.MaxY)/2 - float64(b.MinY+b.MaxY)/2
+	return math.Hypot(dx, dy)
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,124 @@
+package imagediff
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// subject draws an opaque square at (x, y) on a transparent w×h image, with
+// a half-transparent border one pixel wide
+func subject(w, h, x, y, size int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for py := y - 1; py <= y+size; py++ {
+		for px := x - 1; px <= x+size; px++ {
+			alpha := uint8(255)
+			if px < x || py < y || px >= x+size || py >= y+size {
+				alpha = 100
+			}
+			img.SetNRGBA(px, py, color.NRGBA{R: 200, G: 100, B: 50, A: alpha})
+		}
+	}
+	return img
+}
+
+// goldenCases are the documented comparisons: identical masks, a shifted
+// subject, a grown subject, a subject against nothing, and a pair of
+// different sizes sampled onto the smaller grid
+var goldenCases = []struct {
+	name string
+	a, b image.Image
+}{
+	{"identical", subject(16, 16, 4, 4, 6), subject(16, 16, 4, 4, 6)},
+	{"shifted", subject(16, 16, 4, 4, 6), subject(16, 16, 7, 5, 6)},
+	{"grown", subject(16, 16, 5, 5, 4), subject(16, 16, 4, 4, 7)},
+	{"empty", subject(16, 16, 4, 4, 6), image.NewNRGBA(image.Rect(0, 0, 16, 16))},
+	{"resized", subject(16, 16, 4, 4, 6), subject(32, 24, 8, 6, 12)},
+}
+
+func TestCompareGolden(t *testing.T) {
+	for _, tc := range goldenCases {
+		t.Run(tc.name, func(t *testing.T) {
+			report, diff := Compare(tc.a, tc.b, true)
+			got, err := json.MarshalIndent(report, "", "  ")
+			if err != nil {
+				t.Fatalf("marshal: %v", err)
+			}
+			got = append(got, '\n')
+			var encoded bytes.Buffer
+			if err := png.Encode(&encoded, diff); err != nil {
+				t.Fatalf("encode: %v", err)
+			}
+
+			reportPath := filepath.Join("testdata", tc.name+".json")
+			diffPath := filepath.Join("testdata", tc.name+"-diff.png")
+			if *update {
+				if err := os.WriteFile(reportPath, got, 0o644); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(diffPath, encoded.Bytes(), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := os.ReadFile(reportPath)
+			if err != nil {
+				t.Fatalf("read golden report (run with -update to create it): %v", err)
+			}
+			if !bytes.Equal(bytes.ReplaceAll(want, []byte("\r\n"), []byte("\n")), got) {
+				t.Errorf("report differs from %s\ngot:\n%s\nwant:\n%s", reportPath, got, want)
+			}
+			assertSameImage(t, diffPath, diff)
+		})
+	}
+}
+
+// assertSameImage compares img pixel by pixel with the golden PNG at path,
+// so the golden doesn't depend on the encoder's byte output
+func assertSameImage(t *testing.T, path string, img *image.NRGBA) {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatalf("read golden diff image (run with -update to create it): %v", err)
+	}
+	defer f.Close()
+	want, err := png.Decode(f)
+	if err != nil {
+		t.Fatalf("decode %s: %v", path, err)
+	}
+	if want.Bounds() != img.Bounds() {
+		t.Fatalf("diff image is %v, %s is %v", img.Bounds(), path, want.Bounds())
+	}
+	for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
+		for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x++ {
+			if got, want := img.NRGBAAt(x, y), color.NRGBAModel.Convert(want.At(x, y)); got != want {
+				t.Fatalf("diff pixel (%d, %d) = %v, %s has %v", x, y, got, path, want)
+			}
+		}
+	}
+}
+
+func TestCompareWithoutVisual(t *testing.T) {
+	report, diff := Compare(subject(16, 16, 4, 4, 6), subject(16, 16, 7, 5, 6), false)
+	if diff != nil {
+		t.Fatalf("Compare without visual returned a diff image")
+	}
+	if report.AlphaIoU <= 0 || report.AlphaIoU >= 1 {
+		t.Fatalf("AlphaIoU = %v, want a partial overlap", report.AlphaIoU)
+	}
+}
+
+func TestCompareEmptyImage(t *testing.T) {
+	report, diff := Compare(image.NewNRGBA(image.Rect(0, 0, 0, 0)), subject(4, 4, 1, 1, 2), true)
+	if diff != nil || report.CompareWidth != 0 || report.DimensionsMatch {
+		t.Fatalf("Compare with an empty image = %+v, %v", report, diff)
+	}
+}
@@ -0,0 +1,235 @@
+// Package maintenance pauses the queue during scheduled maintenance windows,
+// setting the queue's maintenance flags as windows start and end
+package maintenance
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"sort"
+	"strings"
+	"time"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// Scopes a window can pause
+const (
+	ScopeConsumption = "consumption"
+	ScopeSubmissions = "submissions"
+	ScopeBoth        = "both"
+)
+
+// MaxWindowDuration bounds how long one window lasts
+const MaxWindowDuration = 24 * time.Hour
+
+// Window is a recurring maintenance window
+type Window struct {
+	Name     string
+	Schedule *Schedule
+	Duration time.Duration
+	Scope    string
+}
+
+// ScopeFlags returns the maintenance flags a scope pauses, or nil for an
+// unknown scope
+func ScopeFlags(scope string) []string {
+	switch scope {
+	case ScopeConsumption:
+		return []string{queue.MaintenanceConsumption}
+	case ScopeSubmissions:
+		return []string{queue.MaintenanceSubmissions}
+	case ScopeBoth:
+		return queue.MaintenanceFlags
+	}
+	return nil
+}
+
+// Flags returns the maintenance flags the window sets while active
+func (w Window) Flags() []string {
+	return ScopeFlags(w.Scope)
+}
+
+// Occurrence is one run of a window
+type Occurrence struct {
+	Window   string    `json:"window"`
+	Scope    string    `json:"scope"`
+	StartsAt time.Time `json:"starts_at"`
+	EndsAt   time.Time `json:"ends_at"`
+}
+
+// occurrence returns the run of the window starting at start
+func (w Window) occurrence(start time.Time) Occurrence {
+	return Occurrence{Window: w.Name, Scope: w.Scope, StartsAt: start, EndsAt: start.Add(w.Duration)}
+}
+
+// ActiveAt returns the run of the window covering now, the latest if runs
+// overlap, and whether there is one
+func (w Window) ActiveAt(now time.Time) (Occurrence, bool) {
+	earliest := now.Add(-w.Duration)
+	for t := now.UTC().Truncate(time.Minute); t.After(earliest); t = t.Add(-time.Minute) {
+		if w.Schedule.Matches(t) {
+			return w.occurrence(t), true
+		}
+	}
+	return Occurrence{}, false
+}
+
+// ParseWindows parses windows written "name=cron|duration|scope" and
+// separated by semicolons, e.g. "storage=0 2 * * *|2h|both". Scope is
+// consumption, submissions, or both.
+func ParseWindows(spec string) ([]Window, error) {
+	var windows []Window
+	names := make(map[string]bool)
+	for _, entry := range strings.Split(spec, ";") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		name, rest, ok := strings.Cut(entry, "=")
+		parts := strings.Split(rest, "|")
+		if !ok || name == "" || len(parts) != 3 {
+			return nil, fmt.Errorf("window %q must be written name=cron|duration|scope", entry)
+		}
+		if names[name] {
+			return nil, fmt.Errorf("window %q is defined twice", name)
+		}
+		names[name] = true
+
+		schedule, err := ParseSchedule(parts[0])
+		if err != nil {
+			return nil, fmt.Errorf("window %q: %w", name, err)
+		}
+		duration, err := time.ParseDuration(strings.TrimSpace(parts[1]))
+		if err != nil || duration < time.Minute || duration > MaxWindowDuration {
+			return nil, fmt.Errorf("window %q: duration must be between 1m and %s", name, MaxWindowDuration)
+		}
+		scope := strings.TrimSpace(parts[2])
+		if ScopeFlags(scope) == nil {
+			return nil, fmt.Errorf("window %q: scope must be %s, %s, or %s", name, ScopeConsumption, ScopeSubmissions, ScopeBoth)
+		}
+		windows = append(windows, Window{Name: name, Schedule: schedule, Duration: duration, Scope: scope})
+	}
+	return windows, nil
+}
+
+// Store holds the maintenance flags the scheduler sets and the audit log
+// it records transitions in
+type Store interface {
+	MaintenanceOverrides(ctx context.Context) (map[string]string, error)
+	ScheduledMaintenance(ctx context.Context) (map[string]string, map[string]bool, error)
+	ApplyScheduledMaintenance(ctx context.Context, flag, window string, paused bool) (bool, error)
+	RecordAudit(ctx context.Context, entry queue.AuditEntry) error
+}
+
+// Scheduler sets the maintenance flags at the boundaries of the windows.
+// Only transitions are applied, so a flag set or cleared by hand is left
+// alone while no window starts or ends, and a manual override is left alone
+// until it's cleared.
+type Scheduler struct {
+	windows []Window
+	store   Store
+	clock   queue.Clock
+}
+
+// NewScheduler creates a scheduler for windows, reading the time from clock
+func NewScheduler(windows []Window, store Store, clock queue.Clock) *Scheduler {
+	return &Scheduler{windows: windows, store: store, clock: clock}
+}
+
+// Active returns the runs of windows covering now
+func (s *Scheduler) Active(now time.Time) []Occurrence {
+	var active []Occurrence
+	for _, w := range s.windows {
+		if o, ok := w.ActiveAt(now); ok {
+			active = append(active, o)
+		}
+	}
+	return active
+}
+
+// Upcoming returns the next run of each window starting after now, soonest first
+func (s *Scheduler) Upcoming(now time.Time) []Occurrence {
+	var upcoming []Occurrence
+	for _, w := range s.windows {
+		if start := w.Schedule.Next(now); !start.IsZero() {
+			upcoming = append(upcoming, w.occurrence(start))
+		}
+	}
+	sort.SliceStable(upcoming, func(i, j int) bool { return upcoming[i].StartsAt.Before(upcoming[j].StartsAt) })
+	return upcoming
+}
+
+// Evaluate sets each flag not overridden by hand to what the active windows
+// say, if that changed since the last evaluation, and records each change in
+// the audit log. Run it on one replica at a time.
+func (s *Scheduler) Evaluate(ctx context.Context) error {
+	now := s.clock.Now()
+	want := make(map[string]Occurrence)
+	for _, o := range s.Active(now) {
+		for _, flag := range s.window(o.Window).Flags() {
+			// The run ending last decides what's reported
+			if current, ok := want[flag]; !ok || o.EndsAt.After(current.EndsAt) {
+				want[flag] = o
+			}
+		}
+	}
+
+	overrides, err := s.store.MaintenanceOverrides(ctx)
+	if err != nil {
+		return err
+	}
+	applied, forced, err := s.store.ScheduledMaintenance(ctx)
+	if err != nil {
+		return err
+	}
+	for _, flag := range queue.MaintenanceFlags {
+		if _, ok := overrides[flag]; ok {
+			continue
+		}
+		// An inactive flag wants no window, and applied has none for a
+		// flag the schedule cleared
+		o, paused := want[flag]
+		if !forced[flag] && applied[flag] == o.Window {
+			continue
+		}
+		changed, err := s.store.ApplyScheduledMaintenance(ctx, flag, o.Window, paused)
+		if err != nil {
+			return err
+		}
+		if !changed {
+			// Overridden by hand meanwhile
+			continue
+		}
+		entry := queue.AuditEntry{At: now, Actor: "schedule", Action: "resume", Target: flag}
+		switch {
+		case paused:
+			entry.Action = "pause"
+			entry.Detail = fmt.Sprintf("window %s until %s", o.Window, o.EndsAt.Format(time.RFC3339))
+		case applied[flag] != "":
+			entry.Detail = "window " + applied[flag] + " ended"
+		default:
+			entry.Detail = "override cleared outside any window"
+		}
+		s.audit(ctx, entry)
+	}
+	return nil
+}
+
+// audit logs and records a flag the schedule changed
+func (s *Scheduler) audit(ctx context.Context, entry queue.AuditEntry) {
+	log.Printf("Maintenance schedule: %s %s, %s", entry.Action, entry.Target, entry.Detail)
+	if err := s.store.RecordAudit(ctx, entry); err != nil {
+		log.Printf("Failed to record maintenance transition of %s: %v", entry.Target, err)
+	}
+}
+
+// window returns the window named name
+func (s *Scheduler) window(name string) Window {
+	for _, w := range s.windows {
+		if w.Name == name {
+			return w
+		}
+	}
+	return Window{}
+}
@@ -0,0 +1,139 @@
+package maintenance
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// nextSearchLimit bounds how far ahead Next looks for a matching minute
+const nextSearchLimit = 366 * 24 * time.Hour
+
+// Schedule is a five-field cron expression, minute hour day-of-month month
+// day-of-week, evaluated in UTC. Fields take *, numbers, ranges a-b, lists
+// a,b, and steps */n or a-b/n. As in cron, a day matches if either day
+// field matches when both are restricted.
+type Schedule struct {
+	expr                               string
+	minutes, hours, days, months       fieldSet
+	weekdays                           fieldSet
+	daysRestricted, weekdaysRestricted bool
+}
+
+// fieldSet holds the values a cron field matches
+type fieldSet map[int]bool
+
+// ParseSchedule parses a five-field cron expression
+func ParseSchedule(expr string) (*Schedule, error) {
+	fields := strings.Fields(expr)
+	if len(fields) != 5 {
+		return nil, fmt.Errorf("cron expression %q must have 5 fields, has %d", expr, len(fields))
+	}
+	s := &Schedule{expr: strings.Join(fields, " ")}
+	var err error
+	if s.minutes, err = parseField(fields[0], 0, 59); err != nil {
+		return nil, fmt.Errorf("minute: %w", err)
+	}
+	if s.hours, err = parseField(fields[1], 0, 23); err != nil {
+		return nil, fmt.Errorf("hour: %w", err)
+	}
+	if s.days, err = parseField(fields[2], 1, 31); err != nil {
+		return nil, fmt.Errorf("day of month: %w", err)
+	}
+	if s.months, err = parseField(fields[3], 1, 12); err != nil {
+		return nil, fmt.Errorf("month: %w", err)
+	}
+	if s.weekdays, err = parseField(fields[4], 0, 7); err != nil {
+		return nil, fmt.Errorf("day of week: %w", err)
+	}
+	// Sunday is 0 or 7
+	if s.weekdays[7] {
+		s.weekdays[0] = true
+	}
+	s.daysRestricted = fields[2] != "*"
+	s.weekdaysRestricted = fields[4] != "*"
+	return s, nil
+}
+
+// parseField parses one comma-separated cron field within [min, max]
+func parseField(field string, min, max int) (fieldSet, error) {
+	set := make(fieldSet)
+	for _, part := range strings.Split(field, ",") {
+		rangePart, stepPart, hasStep := strings.Cut(part, "/")
+		step := 1
+		if hasStep {
+			n, err := strconv.Atoi(stepPart)
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("invalid step %q", part)
+			}
+			step = n
+		}
+
+		lo, hi := min, max
+		if rangePart != "*" {
+			from, to, isRange := strings.Cut(rangePart, "-")
+			var err error
+			if lo, err = strconv.Atoi(from); err != nil {
+				return nil, fmt.Errorf("invalid value %q", part)
+			}
+			hi = lo
+			if isRange {
+				if hi, err = strconv.Atoi(to); err != nil {
+					return nil, fmt.Errorf("invalid value %q", part)
+				}
+			} else if hasStep {
+				hi = max
+			}
+		}
+		if lo < min || hi > max || lo > hi {
+			return nil, fmt.Errorf("%q is outside %d-%d", part, min, max)
+		}
+		for v := lo; v <= hi; v += step {
+			set[v] = true
+		}
+	}
+	return set, nil
+}
+
+// String returns the expression the schedule was parsed from
+func (s *Schedule) String() string {
+	return s.expr
+}
+
+// matchesDay reports whether t's date matches the day fields
+func (s *Schedule) matchesDay(t time.Time) bool {
+	day, weekday := s.days[t.Day()], s.weekdays[int(t.Weekday())]
+	if s.daysRestricted && s.weekdaysRestricted {
+		return day || weekday
+	}
+	return day && weekday
+}
+
+// Matches reports whether the schedule fires at t's minute
+func (s *Schedule) Matches(t time.Time) bool {
+	t = t.UTC()
+	return s.minutes[t.Minute()] && s.hours[t.Hour()] && s.months[int(t.Month())] && s.matchesDay(t)
+}
+
+// Next returns the first minute after t the schedule fires at, or the zero
+// time if it doesn't fire within a year, e.g. for February 30th
+func (s *Schedule) Next(t time.Time) time.Time {
+	t = t.UTC().Truncate(time.Minute).Add(time.Minute)
+	limit := t.Add(nextSearchLimit)
+	for t.Before(limit) {
+		switch {
+		case !s.months[int(t.Month())]:
+			t = time.Date(t.Year(), t.Month()+1, 1, 0, 0, 0, 0, time.UTC)
+		case !s.matchesDay(t):
+			t = time.Date(t.Year(), t.Month(), t.Day()+1, 0, 0, 0, 0, time.UTC)
+		case !s.hours[t.Hour()]:
+			t = t.Truncate(time.Hour).Add(time.Hour)
+		case !s.minutes[t.Minute()]:
+			t = t.Add(time.Minute)
+		default:
+			return t
+		}
+	}
+	return time.Time{}
+}
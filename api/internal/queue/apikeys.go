@@ -0,0 +1,279 @@
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// APIKeyPrefix starts every API key, telling them apart from OIDC tokens
+const APIKeyPrefix = "rk_"
+
+var (
+	// ErrAPIKeyUnknown means the key doesn't exist or has been revoked
+	ErrAPIKeyUnknown = errors.New("unknown or revoked API key")
+	// ErrAPIKeyRotated means the key was already rotated; only its
+	// replacement can rotate again
+	ErrAPIKeyRotated = errors.New("API key was already rotated")
+)
+
+// APIKey is a stored API key. The secret itself isn't kept, only its hash,
+// so a key can't be listed back.
+type APIKey struct {
+	ID string `json:"id"`
+	// Owner is the identity the key authenticates as; rotated keys share it
+	Owner      string     `json:"owner"`
+	Tier       string     `json:"tier,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	// ExpiresAt is set once the key is rotated, at the end of its grace period
+	ExpiresAt *time.Time `json:"expires_at"`
+	// ReplacedBy is the ID of the key issued when this one was rotated
+	ReplacedBy string `json:"replaced_by,omitempty"`
+}
+
+// Expired reports whether the key is past its expiry at now
+func (k *APIKey) Expired(now time.Time) bool {
+	return k.ExpiresAt != nil && !now.Before(*k.ExpiresAt)
+}
+
+// apiKeyKey returns the Redis hash holding the key whose secret hashes to hash
+func (k redisKeys) apiKeyKey(hash string) string {
+	return k.prefix + "api_key:" + hash
+}
+
+// apiKeyIDKey returns the Redis key holding the hash of the key with an ID
+func (k redisKeys) apiKeyIDKey(id string) string {
+	return k.prefix + "api_key_id:" + id
+}
+
+// ownerAPIKeysKey returns the set of hashes of an owner's keys
+func (k redisKeys) ownerAPIKeysKey(owner string) string {
+	return k.prefix + "api_keys:" + owner
+}
+
+// HashAPIKey returns the hash a key's record is stored under
+func HashAPIKey(secret string) string {
+	sum := sha256.Sum256([]byte(secret))
+	return hex.EncodeToString(sum[:])
+}
+
+// generateAPIKey returns a new key ID and secret
+func generateAPIKey() (string, string, error) {
+	b := make([]byte, 40)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	return "key_" + hex.EncodeToString(b[:8]), APIKeyPrefix + hex.EncodeToString(b[8:]), nil
+}
+
+// rotateAPIKeyScript gives the key at KEYS[1] and its ID at KEYS[4] an
+// expiry and stores its replacement at KEYS[2], indexed by its ID at KEYS[5],
+// with the same owner and tier. Returns 1 on success,
+// 0 if the key is unknown, expired, or not ARGV[1]'s, and -1 if it was
+// already rotated.
+var rotateAPIKeyScript = redis.NewScript(`
+local key = redis.call("HMGET", KEYS[1], "owner", "tier", "expires_at", "replaced_by")
+if not key[1] or key[1] ~= ARGV[1] then
+	return 0
+end
+if key[3] and tonumber(key[3]) <= tonumber(ARGV[4]) then
+	return 0
+end
+if key[4] then
+	return -1
+end
+redis.call("HSET", KEYS[2], "id", ARGV[2], "owner", key[1], "created_at", ARGV[4])
+if key[2] then
+	redis.call("HSET", KEYS[2], "tier", key[2])
+end
+redis.call("HSET", KEYS[1], "expires_at", ARGV[5], "replaced_by", ARGV[2])
+redis.call("PEXPIREAT", KEYS[1], ARGV[5])
+redis.call("SADD", KEYS[3], ARGV[3])
+redis.call("SET", KEYS[5], ARGV[3])
+if redis.call("EXISTS", KEYS[4]) == 1 then
+	redis.call("PEXPIREAT", KEYS[4], ARGV[5])
+end
+return 1
+`)
+
+// touchAPIKeyScript records when the key at KEYS[1] was last used, unless
+// it has been revoked meanwhile
+var touchAPIKeyScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	return 0
+end
+return redis.call("HSET", KEYS[1], "last_used_at", ARGV[1])
+`)
+
+// CreateAPIKey issues a key authenticating as owner, with an optional tier,
+// and returns it with its secret
+func (q *RedisQueue) CreateAPIKey(ctx context.Context, owner, tier string, now time.Time) (*APIKey, string, error) {
+	id, secret, err := generateAPIKey()
+	if err != nil {
+		return nil, "", err
+	}
+	hash := HashAPIKey(secret)
+	fields := []interface{}{"id", id, "owner", owner, "created_at", now.UnixMilli()}
+	if tier != "" {
+		fields = append(fields, "tier", tier)
+	}
+	pipe := q.client.TxPipeline()
+	pipe.HSet(ctx, q.apiKeyKey(hash), fields...)
+	pipe.SAdd(ctx, q.ownerAPIKeysKey(owner), hash)
+	pipe.Set(ctx, q.apiKeyIDKey(id), hash, 0)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, "", err
+	}
+	return &APIKey{ID: id, Owner: owner, Tier: tier, CreatedAt: time.UnixMilli(now.UnixMilli()).UTC()}, secret, nil
+}
+
+// APIKey returns the key whose secret hashes to hash, or nil if there is
+// none. A rotated key is returned until Redis expires it; callers check
+// Expired so the grace period ends at the same instant on every replica.
+func (q *RedisQueue) APIKey(ctx context.Context, hash string) (*APIKey, error) {
+	fields, err := q.client.HGetAll(ctx, q.apiKeyKey(hash)).Result()
+	if err != nil {
+		return nil, err
+	}
+	if fields["owner"] == "" {
+		return nil, nil
+	}
+	return parseAPIKey(fields), nil
+}
+
+// APIKeyByID returns the key with an ID, or nil if there is none. Like
+// APIKey, it returns rotated keys until Redis expires them.
+func (q *RedisQueue) APIKeyByID(ctx context.Context, id string) (*APIKey, error) {
+	hash, err := q.client.Get(ctx, q.apiKeyIDKey(id)).Result()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	key, err := q.APIKey(ctx, hash)
+	if err != nil || key == nil || key.ID != id {
+		return nil, err
+	}
+	return key, nil
+}
+
+// RotateAPIKey replaces the owner's key whose secret hashes to hash. The old
+// key keeps working until now+grace and is then revoked; the new one shares
+// its owner and tier. It returns ErrAPIKeyUnknown or ErrAPIKeyRotated if the
+// old key can't be rotated.
+func (q *RedisQueue) RotateAPIKey(ctx context.Context, hash, owner string, grace time.Duration, now time.Time) (*APIKey, string, error) {
+	id, secret, err := generateAPIKey()
+	if err != nil {
+		return nil, "", err
+	}
+	newHash := HashAPIKey(secret)
+	// A key's ID never changes, so it's safe to read ahead of the script
+	oldID, err := q.client.HGet(ctx, q.apiKeyKey(hash), "id").Result()
+	if err == redis.Nil {
+		return nil, "", ErrAPIKeyUnknown
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	result, err := rotateAPIKeyScript.Run(ctx, q.client,
+		[]string{q.apiKeyKey(hash), q.apiKeyKey(newHash), q.ownerAPIKeysKey(owner), q.apiKeyIDKey(oldID), q.apiKeyIDKey(id)},
+		owner, id, newHash, now.UnixMilli(), now.Add(grace).UnixMilli(),
+	).Int()
+	if err != nil {
+		return nil, "", err
+	}
+	switch result {
+	case 0:
+		return nil, "", ErrAPIKeyUnknown
+	case -1:
+		return nil, "", ErrAPIKeyRotated
+	}
+	key, err := q.APIKey(ctx, newHash)
+	if err != nil {
+		return nil, "", err
+	}
+	if key == nil {
+		return nil, "", ErrAPIKeyUnknown
+	}
+	return key, secret, nil
+}
+
+// TouchAPIKey records that the key whose secret hashes to hash was used at
+func (q *RedisQueue) TouchAPIKey(ctx context.Context, hash string, at time.Time) error {
+	return touchAPIKeyScript.Run(ctx, q.client, []string{q.apiKeyKey(hash)}, at.UnixMilli()).Err()
+}
+
+// OwnerAPIKeys returns an owner's keys, oldest first, and forgets those
+// Redis has revoked
+func (q *RedisQueue) OwnerAPIKeys(ctx context.Context, owner string) ([]*APIKey, error) {
+	hashes, err := q.client.SMembers(ctx, q.ownerAPIKeysKey(owner)).Result()
+	if err != nil {
+		return nil, err
+	}
+	pipe := q.client.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(hashes))
+	for i, hash := range hashes {
+		cmds[i] = pipe.HGetAll(ctx, q.apiKeyKey(hash))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	keys := make([]*APIKey, 0, len(hashes))
+	var revoked []interface{}
+	for i, cmd := range cmds {
+		if fields := cmd.Val(); fields["owner"] == owner {
+			keys = append(keys, parseAPIKey(fields))
+		} else {
+			revoked = append(revoked, hashes[i])
+		}
+	}
+	if len(revoked) > 0 {
+		if err := q.client.SRem(ctx, q.ownerAPIKeysKey(owner), revoked...).Err(); err != nil {
+			return nil, err
+		}
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if !keys[i].CreatedAt.Equal(keys[j].CreatedAt) {
+			return keys[i].CreatedAt.Before(keys[j].CreatedAt)
+		}
+		return keys[i].ID < keys[j].ID
+	})
+	return keys, nil
+}
+
+// parseAPIKey reads a key from its Redis hash
+func parseAPIKey(fields map[string]string) *APIKey {
+	key := &APIKey{
+		ID:         fields["id"],
+		Owner:      fields["owner"],
+		Tier:       fields["tier"],
+		CreatedAt:  parseMillis(fields["created_at"]),
+		ReplacedBy: fields["replaced_by"],
+	}
+	if at := parseMillis(fields["last_used_at"]); !at.IsZero() {
+		key.LastUsedAt = &at
+	}
+	if at := parseMillis(fields["expires_at"]); !at.IsZero() {
+		key.ExpiresAt = &at
+	}
+	return key
+}
+
+// parseMillis parses Unix milliseconds, returning the zero time if value isn't one
+func parseMillis(value string) time.Time {
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.UnixMilli(ms).UTC()
+}
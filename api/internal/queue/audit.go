@@ -0,0 +1,57 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+)
+
+// auditLogMax is how many entries the audit log keeps, oldest dropped first
+const auditLogMax = 1000
+
+// AuditEntry records an operational change to the service, such as a
+// maintenance pause, with who or what made it
+type AuditEntry struct {
+	At time.Time `json:"at"`
+	// Actor made the change, e.g. "schedule" or "rmbgctl:alice"
+	Actor  string `json:"actor"`
+	Action string `json:"action"`
+	// Target is what was changed, e.g. a maintenance flag
+	Target string `json:"target,omitempty"`
+	Detail string `json:"detail,omitempty"`
+}
+
+// auditLogKey returns the Redis list of audit entries, newest first
+func (k redisKeys) auditLogKey() string {
+	return k.prefix + "audit_log"
+}
+
+// RecordAudit appends an entry to the audit log
+func (q *RedisQueue) RecordAudit(ctx context.Context, entry AuditEntry) error {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	pipe := q.client.TxPipeline()
+	pipe.LPush(ctx, q.auditLogKey(), data)
+	pipe.LTrim(ctx, q.auditLogKey(), 0, auditLogMax-1)
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// AuditLog returns up to limit of the most recent audit entries, newest first
+func (q *RedisQueue) AuditLog(ctx context.Context, limit int64) ([]AuditEntry, error) {
+	values, err := q.client.LRange(ctx, q.auditLogKey(), 0, limit-1).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries := make([]AuditEntry, 0, len(values))
+	for _, value := range values {
+		var entry AuditEntry
+		if err := json.Unmarshal([]byte(value), &entry); err != nil {
+			continue
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
@@ -0,0 +1,107 @@
+package queue
+
+import (
+	"context"
+	"strconv"
+
+	"rembg-v2/api/internal/fault"
+)
+
+// AddJobsOneByOne adds jobs through q's AddJob in order, stopping at the
+// first error. It's AddJobs for backends with no cheaper way to write many
+// jobs at once; the jobs added before the error stay queued.
+func AddJobsOneByOne(ctx context.Context, q interface {
+	AddJob(ctx context.Context, job *Job) error
+}, jobs []*Job) error {
+	for _, job := range jobs {
+		if err := q.AddJob(ctx, job); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// AddJobs adds jobs to the queue as AddJob does, sharing one creation time
+// and one Redis enqueue time, in a single pipeline instead of several round
+// trips per job. If the pipeline fails partway, the records, index entries,
+// and queue entries it may have written are removed again and no job is
+// added.
+func (q *RedisQueue) AddJobs(ctx context.Context, jobs []*Job) error {
+	if len(jobs) == 0 {
+		return nil
+	}
+	if err := fault.Maybe(ctx, fault.Redis, "jobs", strconv.Itoa(len(jobs))); err != nil {
+		return err
+	}
+
+	created := q.opts.Clock.Now()
+	var enqueuedAtMs int64
+	for _, job := range jobs {
+		if job.Status == "" {
+			job.Status = StatusPending
+		}
+		if job.Status == StatusPending && enqueuedAtMs == 0 {
+			now, err := q.client.Time(ctx).Result()
+			if err != nil {
+				return err
+			}
+			enqueuedAtMs = now.UnixMilli()
+		}
+	}
+
+	pipe := q.client.Pipeline()
+	for _, job := range jobs {
+		if job.CreatedAt.IsZero() {
+			job.CreatedAt = created
+		}
+		job.UpdatedAt = created
+		job.Version = 1
+		if job.Status == StatusPending {
+			job.EnqueuedAtMs = enqueuedAtMs
+		}
+		job.recordStatus(created)
+		jobJSON, err := q.opts.Codec.Encode(job)
+		if err != nil {
+			return err
+		}
+
+		pipe.Set(ctx, q.jobKey(job.ID), jobJSON, q.jobTTL(job))
+		q.indexStatus(ctx, pipe, job)
+		q.scheduleRemovals(ctx, pipe, job)
+		q.scheduleLifetime(ctx, pipe, job)
+		switch job.Status {
+		case StatusScheduled:
+			q.schedule(ctx, pipe, job)
+		case StatusPending:
+			q.enqueue(ctx, pipe, job)
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		q.unaddJobs(jobs)
+		return err
+	}
+
+	for _, job := range jobs {
+		q.publishEvent(job)
+	}
+	return nil
+}
+
+// unaddJobs removes what a failed AddJobs may have written. It runs on its
+// own context, so a batch abandoned by a cancelled request is still undone.
+func (q *RedisQueue) unaddJobs(jobs []*Job) {
+	ctx, cancel := context.WithTimeout(context.Background(), q.opts.CommandTimeout)
+	defer cancel()
+
+	pipe := q.client.Pipeline()
+	for _, job := range jobs {
+		pipe.Del(ctx, q.jobKey(job.ID))
+		q.unindexStatus(ctx, pipe, job.ID)
+		pipe.ZRem(ctx, q.removalScheduleKey(RemovalResults), job.ID)
+		pipe.ZRem(ctx, q.removalScheduleKey(RemovalInputs), job.ID)
+		pipe.ZRem(ctx, q.lifetimeDeadlinesKey(), job.ID)
+		pipe.ZRem(ctx, q.scheduledJobsKey(), job.ID)
+		pipe.LRem(ctx, q.pendingList(job), 1, job.ID)
+	}
+	pipe.Exec(ctx)
+}
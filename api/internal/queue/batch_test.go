@@ -0,0 +1,43 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"testing"
+)
+
+// BenchmarkAddJobs adds batches of jobs in one pipeline and, for
+// comparison, one AddJob at a time, reporting the round trips and time
+// each job costs
+func BenchmarkAddJobs(b *testing.B) {
+	for _, size := range []int{1, 10, 100, 1000} {
+		for _, mode := range []struct {
+			name string
+			add  func(ctx context.Context, q *RedisQueue, jobs []*Job) error
+		}{
+			{"pipeline", func(ctx context.Context, q *RedisQueue, jobs []*Job) error { return q.AddJobs(ctx, jobs) }},
+			{"one-by-one", func(ctx context.Context, q *RedisQueue, jobs []*Job) error { return AddJobsOneByOne(ctx, q, jobs) }},
+		} {
+			b.Run(fmt.Sprintf("%s/size=%d", mode.name, size), func(b *testing.B) {
+				q, _ := newTestRedisQueue(b, Options{})
+				ctx := context.Background()
+				trips := countRoundTrips(q)
+				b.ReportAllocs()
+				b.ResetTimer()
+				for i := 0; i < b.N; i++ {
+					b.StopTimer()
+					jobs := make([]*Job, size)
+					for j := range jobs {
+						jobs[j] = &Job{ID: fmt.Sprintf("job-%d-%d", i, j), Owner: "owner", InputPath: "input.png"}
+					}
+					b.StartTimer()
+					if err := mode.add(ctx, q, jobs); err != nil {
+						b.Fatalf("adding %d jobs: %v", size, err)
+					}
+				}
+				b.ReportMetric(float64(trips.n.Load())/float64(b.N), "round-trips/op")
+				b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N*size), "ns/job")
+			})
+		}
+	}
+}
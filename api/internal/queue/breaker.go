@@ -0,0 +1,197 @@
+package queue
+
+import (
+	"context"
+	"expvar"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// breakerTrips counts the times this replica opened the circuit breaker
+var breakerTrips = expvar.NewInt("breaker_trips")
+
+// BreakerConfig configures the circuit breaker that stops workers claiming
+// new jobs while most jobs fail, as they do when a model file is corrupted.
+// Once at least FailureRate of the last Window finished jobs failed, claims
+// stop for Cooldown; jobs already claimed finish or fail as usual. A zero
+// Window disables the breaker.
+type BreakerConfig struct {
+	Window      int
+	FailureRate float64
+	Cooldown    time.Duration
+}
+
+// Enabled reports whether the breaker watches outcomes
+func (c BreakerConfig) Enabled() bool {
+	return c.Window > 0
+}
+
+// BreakerState is the circuit breaker's current state
+type BreakerState struct {
+	Config BreakerConfig `json:"-"`
+	// Open is set while workers are stopped from claiming, until OpenUntil
+	Open      bool       `json:"open"`
+	OpenedAt  *time.Time `json:"opened_at,omitempty"`
+	OpenUntil *time.Time `json:"open_until,omitempty"`
+	// Failed and Finished are the outcomes that opened it, or while it's
+	// closed, those of the window so far
+	Failed   int `json:"failed"`
+	Finished int `json:"finished"`
+	// Trips counts the times it opened, by the API or any worker
+	Trips int64 `json:"trips"`
+}
+
+// breakerOutcomesKey returns the Redis list of the latest finished jobs'
+// outcomes, newest first: "1" for a failure and "0" otherwise
+func (k redisKeys) breakerOutcomesKey() string {
+	return k.prefix + "breaker:outcomes"
+}
+
+// breakerOpenKey returns the Redis key that, while set, stops workers
+// claiming new jobs. It holds when it was opened, in Unix milliseconds, and
+// the failed and finished jobs that opened it, and expires after the
+// cool-down.
+func (k redisKeys) breakerOpenKey() string {
+	return k.prefix + "breaker:open"
+}
+
+// breakerConfigKey returns the Redis hash of the breaker's window,
+// failure_rate, and cooldown_ms, written by the API so the workers follow
+// the same settings
+func (k redisKeys) breakerConfigKey() string {
+	return k.prefix + "breaker:config"
+}
+
+// breakerTripsKey returns the Redis counter of the times the breaker opened
+func (k redisKeys) breakerTripsKey() string {
+	return k.prefix + "breaker:trips"
+}
+
+// recordBreakerScript adds outcome ARGV[1] to the window at KEYS[1], sized
+// by the config at KEYS[3], and once the window is full and at least its
+// failure rate failed, opens the breaker at KEYS[2] as of ARGV[2] for the
+// cool-down, counting the trip at KEYS[4] and starting a new window. Returns
+// 1 if it opened the breaker.
+var recordBreakerScript = redis.NewScript(`
+local window = tonumber(redis.call("HGET", KEYS[3], "window") or "0")
+if window <= 0 then
+	return 0
+end
+redis.call("LPUSH", KEYS[1], ARGV[1])
+redis.call("LTRIM", KEYS[1], 0, window - 1)
+if redis.call("EXISTS", KEYS[2]) == 1 then
+	return 0
+end
+local outcomes = redis.call("LRANGE", KEYS[1], 0, -1)
+if #outcomes < window then
+	return 0
+end
+local failed = 0
+for _, outcome in ipairs(outcomes) do
+	if outcome == "1" then
+		failed = failed + 1
+	end
+end
+if failed < window * tonumber(redis.call("HGET", KEYS[3], "failure_rate")) then
+	return 0
+end
+redis.call("SET", KEYS[2], ARGV[2] .. " " .. failed .. " " .. window, "PX", redis.call("HGET", KEYS[3], "cooldown_ms"))
+redis.call("DEL", KEYS[1])
+redis.call("INCR", KEYS[4])
+return 1
+`)
+
+// configureBreaker writes the breaker's settings for the workers, or
+// removes them, disabling it, if it's disabled. Every replica writes its
+// own, so all must be run with the same.
+func (q *RedisQueue) configureBreaker(ctx context.Context) error {
+	c := q.opts.Breaker
+	if !c.Enabled() {
+		return q.client.Del(ctx, q.breakerConfigKey()).Err()
+	}
+	return q.client.HSet(ctx, q.breakerConfigKey(),
+		"window", c.Window,
+		"failure_rate", strconv.FormatFloat(c.FailureRate, 'f', -1, 64),
+		"cooldown_ms", c.Cooldown.Milliseconds(),
+	).Err()
+}
+
+// recordBreakerOutcome adds a finished job to the breaker's window,
+// opening the breaker if too many of the window failed
+func (q *RedisQueue) recordBreakerOutcome(ctx context.Context, job *Job) error {
+	if !q.opts.Breaker.Enabled() {
+		return nil
+	}
+	outcome := "0"
+	if job.Status == StatusFailed {
+		outcome = "1"
+	}
+	now := q.opts.Clock.Now()
+	opened, err := recordBreakerScript.Run(ctx, q.client,
+		[]string{q.breakerOutcomesKey(), q.breakerOpenKey(), q.breakerConfigKey(), q.breakerTripsKey()},
+		outcome, now.UnixMilli(),
+	).Int()
+	if err != nil {
+		return err
+	}
+	if opened == 1 {
+		breakerTrips.Add(1)
+		log.Printf("CIRCUIT BREAKER OPEN: at least %.0f%% of the last %d jobs failed, the latest %s (%s); workers stop claiming jobs for %s",
+			q.opts.Breaker.FailureRate*100, q.opts.Breaker.Window, job.ID, job.ErrorCode, q.opts.Breaker.Cooldown)
+	}
+	return nil
+}
+
+// BreakerState reports whether the circuit breaker is open and why
+func (q *RedisQueue) BreakerState(ctx context.Context) (BreakerState, error) {
+	state := BreakerState{Config: q.opts.Breaker}
+	pipe := q.client.Pipeline()
+	open := pipe.Get(ctx, q.breakerOpenKey())
+	ttl := pipe.PTTL(ctx, q.breakerOpenKey())
+	outcomes := pipe.LRange(ctx, q.breakerOutcomesKey(), 0, -1)
+	trips := pipe.Get(ctx, q.breakerTripsKey())
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return state, err
+	}
+	state.Trips, _ = trips.Int64()
+
+	if fields := strings.Fields(open.Val()); len(fields) == 3 {
+		state.Open = true
+		if ms, err := strconv.ParseInt(fields[0], 10, 64); err == nil {
+			at := time.UnixMilli(ms).UTC()
+			state.OpenedAt = &at
+		}
+		state.Failed, _ = strconv.Atoi(fields[1])
+		state.Finished, _ = strconv.Atoi(fields[2])
+		if remaining := ttl.Val(); remaining > 0 {
+			until := q.opts.Clock.Now().Add(remaining).UTC()
+			state.OpenUntil = &until
+		}
+		return state, nil
+	}
+	for _, outcome := range outcomes.Val() {
+		state.Finished++
+		if outcome == "1" {
+			state.Failed++
+		}
+	}
+	return state, nil
+}
+
+// ResetBreaker closes the circuit breaker and starts a new window, so
+// workers claim jobs again at once
+func (q *RedisQueue) ResetBreaker(ctx context.Context) error {
+	return q.client.Del(ctx, q.breakerOpenKey(), q.breakerOutcomesKey()).Err()
+}
+
+// claimsStopped reports whether workers are stopped from claiming new jobs,
+// by a pause or scheduled maintenance window as IsPaused reports, or by an
+// open circuit breaker
+func (q *RedisQueue) claimsStopped(ctx context.Context) (bool, error) {
+	n, err := q.client.Exists(ctx, q.maintenanceKey(), q.breakerOpenKey()).Result()
+	return n > 0, err
+}
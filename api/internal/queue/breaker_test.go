@@ -0,0 +1,76 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestBreakerStopsClaimsUntilCooldownOrReset(t *testing.T) {
+	q, server := newTestRedisQueue(t, Options{
+		Breaker: BreakerConfig{Window: 4, FailureRate: 0.5, Cooldown: time.Minute},
+	})
+	ctx := context.Background()
+	record := func(status JobStatus) {
+		t.Helper()
+		job := &Job{ID: fmt.Sprintf("finished-%d", time.Now().UnixNano()), Status: status}
+		if err := q.RecordOutcome(ctx, job); err != nil {
+			t.Fatalf("RecordOutcome: %v", err)
+		}
+	}
+
+	// Not a full window yet
+	record(StatusCompleted)
+	record(StatusFailed)
+	record(StatusFailed)
+	if state, err := q.BreakerState(ctx); err != nil || state.Open || state.Finished != 3 || state.Failed != 2 {
+		t.Fatalf("breaker before a full window: %+v, %v", state, err)
+	}
+	record(StatusFailed)
+	state, err := q.BreakerState(ctx)
+	if err != nil || !state.Open || state.Failed != 3 || state.Finished != 4 || state.Trips != 1 {
+		t.Fatalf("breaker after 3 of 4 failed: %+v, %v", state, err)
+	}
+
+	if err := q.AddJob(ctx, &Job{ID: "pending", Status: StatusPending}); err != nil {
+		t.Fatalf("AddJob: %v", err)
+	}
+	if job, err := q.ClaimPendingJob(ctx, "worker-1", []string{ModelDefault}); err != nil || job != nil {
+		t.Fatalf("claim while open: %v, %v", job, err)
+	}
+
+	// The cool-down ends with the open key's expiry
+	server.FastForward(time.Minute)
+	if state, err := q.BreakerState(ctx); err != nil || state.Open || state.Finished != 0 {
+		t.Fatalf("breaker after the cool-down: %+v, %v", state, err)
+	}
+
+	// Opened again, then reset by hand
+	for i := 0; i < 4; i++ {
+		record(StatusFailed)
+	}
+	if state, err := q.BreakerState(ctx); err != nil || !state.Open || state.Trips != 2 {
+		t.Fatalf("breaker after a second window of failures: %+v, %v", state, err)
+	}
+	if err := q.ResetBreaker(ctx); err != nil {
+		t.Fatalf("ResetBreaker: %v", err)
+	}
+	job, err := q.ClaimPendingJob(ctx, "worker-1", []string{ModelDefault})
+	if err != nil || job == nil || job.ID != "pending" {
+		t.Fatalf("claim after the reset: %v, %v", job, err)
+	}
+}
+
+func TestBreakerDisabled(t *testing.T) {
+	q, _ := newTestRedisQueue(t, Options{})
+	ctx := context.Background()
+	for i := 0; i < 10; i++ {
+		if err := q.RecordOutcome(ctx, &Job{ID: fmt.Sprint(i), Status: StatusFailed}); err != nil {
+			t.Fatalf("RecordOutcome: %v", err)
+		}
+	}
+	if state, err := q.BreakerState(ctx); err != nil || state.Open || state.Finished != 0 {
+		t.Fatalf("disabled breaker: %+v, %v", state, err)
+	}
+}
@@ -0,0 +1,118 @@
+package queue
+
+import (
+	"context"
+	"errors"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// maxCancelRetries bounds the attempts at a cancellation racing other
+// writes to the job
+const maxCancelRetries = 5
+
+// cancelledDeliveryError is recorded on the deliveries a cancelled job gives up
+const cancelledDeliveryError = "Job cancelled"
+
+var (
+	// ErrJobNotFound means there is no such job: GetJob returns it, and
+	// changes to a missing job fail with it
+	ErrJobNotFound = errors.New("job not found")
+	// ErrJobFinished means the job completed, failed, or was cancelled
+	// before it could be cancelled
+	ErrJobFinished = errors.New("job already finished")
+	// ErrCancelConflict means the job kept changing during the cancellation
+	ErrCancelConflict = errors.New("job changed during the cancellation")
+)
+
+// cancelKey returns the Redis key that, while set, tells workers to stop
+// the job
+func (k redisKeys) cancelKey(jobID string) string {
+	return k.prefix + "cancel:" + jobID
+}
+
+// CancelJob cancels a job. One waiting to run, whether pending, scheduled,
+// or retrying, is taken off its queue and marked cancelled at once, giving
+// up its undelivered destinations. One being processed keeps its status
+// while a flag asks its worker to stop, which the worker checks between
+// pipeline stages before marking the job cancelled. The flag is set either
+// way, so a worker claiming the job as it's cancelled drops it. Its quota
+// charge isn't refunded. It fails with ErrJobNotFound or ErrJobFinished.
+func (q *RedisQueue) CancelJob(ctx context.Context, jobID string) error {
+	key := q.jobKey(jobID)
+	var cancelled *Job
+	txf := func(tx *redis.Tx) error {
+		cancelled = nil
+		data, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			return ErrJobNotFound
+		}
+		if err != nil {
+			return err
+		}
+		var job Job
+		if err := q.opts.Codec.Decode(data, &job); err != nil {
+			return err
+		}
+
+		switch job.Status {
+		case StatusCompleted, StatusFailed, StatusCancelled:
+			return ErrJobFinished
+		case StatusProcessing:
+			_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.Set(ctx, q.cancelKey(jobID), 1, q.jobTTL(&job))
+				return nil
+			})
+			return err
+		}
+
+		job.Status = StatusCancelled
+		job.UpdatedAt = q.opts.Clock.Now()
+		job.Version++
+		job.recordStatus(job.UpdatedAt)
+		for i := range job.Deliveries {
+			if job.Deliveries[i].Status == DeliveryPending {
+				job.Deliveries[i].Status = DeliveryFailed
+				job.Deliveries[i].LastError = cancelledDeliveryError
+			}
+		}
+		encoded, err := q.opts.Codec.Encode(&job)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, encoded, q.jobTTL(&job))
+			q.indexStatus(ctx, pipe, &job)
+			pipe.Set(ctx, q.cancelKey(jobID), 1, q.jobTTL(&job))
+			pipe.LRem(ctx, q.pendingList(&job), 0, jobID)
+			pipe.ZRem(ctx, q.scheduledJobsKey(), jobID)
+			pipe.ZRem(ctx, q.lifetimeDeadlinesKey(), jobID)
+			return nil
+		})
+		if err == nil {
+			cancelled = &job
+		}
+		return err
+	}
+
+	for i := 0; i < maxCancelRetries; i++ {
+		err := q.client.Watch(ctx, txf, key)
+		if err == redis.TxFailedErr {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if cancelled != nil {
+			q.publishEvent(cancelled)
+		}
+		return nil
+	}
+	return ErrCancelConflict
+}
+
+// CancelRequested reports whether the job was asked to stop
+func (q *RedisQueue) CancelRequested(ctx context.Context, jobID string) (bool, error) {
+	n, err := q.client.Exists(ctx, q.cancelKey(jobID)).Result()
+	return n > 0, err
+}
@@ -0,0 +1,530 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ClaimWait is how long a blocking claim waits in one call to Redis
+const ClaimWait = time.Second
+
+// popWorkerID begins the worker IDs PopPendingJob claims jobs as, one for
+// each call, for the moment between taking a job and releasing the claim
+const popWorkerID = "pop"
+
+const (
+	// ReapBatch is how many stale jobs one ReapStaleJobs call handles at most
+	ReapBatch = 100
+	// maxReapRetries bounds the attempts at reaping a job racing other
+	// writes to it
+	maxReapRetries = 3
+)
+
+// processingKey returns the list of job IDs a worker has claimed but not
+// yet acknowledged
+func (k redisKeys) processingKey(workerID string) string {
+	return k.prefix + "processing:" + workerID
+}
+
+// claimWorkersKey returns the set of worker IDs that may hold claims
+func (k redisKeys) claimWorkersKey() string {
+	return k.prefix + "claim_workers"
+}
+
+// forgetClaimWorkerScript removes worker ARGV[1] from the set at KEYS[2]
+// unless its processing list at KEYS[1] has filled again
+var forgetClaimWorkerScript = redis.NewScript(`
+if redis.call("LLEN", KEYS[1]) > 0 then
+	return 0
+end
+return redis.call("SREM", KEYS[2], ARGV[1])
+`)
+
+// ClaimJob atomically moves the oldest pending job of the default model, from
+// the highest priority list that has one, onto the worker's processing list
+// and returns it, or nil if none is pending. It doesn't wait; workers that
+// would otherwise poll use ClaimJobBlocking. The claim survives the worker
+// crashing before it acknowledges the job with AckJob or returns it with
+// NackJob; RecoverClaims puts it back.
+func (q *RedisQueue) ClaimJob(ctx context.Context, workerID string) (*Job, error) {
+	return q.ClaimPendingJob(ctx, workerID, []string{ModelDefault})
+}
+
+// ClaimJobBlocking is ClaimJob waiting up to timeout for a job, or until ctx
+// is done if timeout is 0, so workers needn't poll. It returns nil, nil on
+// timeout and ctx's error once ctx is done. While the queue is paused it
+// claims nothing and keeps waiting. Redis can't interrupt a blocked
+// command, so the wait is made of calls of up to ClaimWait, the last cut
+// to what's left of timeout, and cancellation is noticed within one.
+func (q *RedisQueue) ClaimJobBlocking(ctx context.Context, workerID string, timeout time.Duration) (*Job, error) {
+	deadline := time.Now().Add(timeout)
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		wait := ClaimWait
+		if timeout > 0 {
+			remaining := time.Until(deadline)
+			if remaining <= 0 {
+				return nil, nil
+			}
+			if remaining < wait {
+				wait = remaining
+			}
+		}
+		job, err := q.claim(ctx, workerID, wait)
+		if err != nil || job != nil {
+			return job, err
+		}
+	}
+}
+
+// claim waits up to wait to claim one default-model job, returning nil if
+// none arrived, the one that arrived had expired, or the queue is paused
+// or its circuit breaker open. Higher priorities are drained first.
+func (q *RedisQueue) claim(ctx context.Context, workerID string, wait time.Duration) (*Job, error) {
+	paused, err := q.claimsStopped(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if paused {
+		waitPaused(ctx, wait)
+		return nil, nil
+	}
+	job, err := q.popPendingJob(ctx, workerID, []string{ModelDefault})
+	if err != nil || job != nil {
+		return job, err
+	}
+	// Redis can block on one list only; jobs of other priorities arriving
+	// meanwhile are seen on the next call
+	jobID, err := q.popPending(ctx, workerID, ModelDefault, PriorityNormal, wait)
+	if err != nil || jobID == "" {
+		return nil, err
+	}
+	return q.claimed(ctx, workerID, jobID)
+}
+
+// popPending moves the oldest job ID of a model's pending list at a
+// priority onto the worker's processing list, with SchedulingFair that of
+// the next owner in turn, or with PendingStreams
+// delivers it from the pending stream, waiting up to block for one if it
+// isn't zero. It returns "" if there was none.
+func (q *RedisQueue) popPending(ctx context.Context, workerID, model, priority string, block time.Duration) (string, error) {
+	if q.opts.PendingStreams {
+		return q.readPendingStream(ctx, workerID, q.pendingStreamKey(model, priority), block)
+	}
+	if q.opts.Scheduling == SchedulingFair {
+		return q.popFair(ctx, workerID, q.pendingKey(model, priority), block)
+	}
+	var jobID string
+	var err error
+	if block > 0 {
+		jobID, err = q.bRPopLPush(ctx, q.pendingKey(model, priority), q.processingKey(workerID), block)
+	} else {
+		jobID, err = q.client.RPopLPush(ctx, q.pendingKey(model, priority), q.processingKey(workerID)).Result()
+	}
+	if err == redis.Nil {
+		return "", nil
+	}
+	return jobID, err
+}
+
+// bRPopLPush is BRPOPLPUSH waiting up to block, which may be a fraction
+// of a second. go-redis rounds waits up to whole seconds, which would
+// overrun a deadline less than one away, so fractions are sent as Redis
+// takes them, in seconds.
+func (q *RedisQueue) bRPopLPush(ctx context.Context, source, destination string, block time.Duration) (string, error) {
+	if block%time.Second == 0 {
+		return q.client.BRPopLPush(ctx, source, destination, block).Result()
+	}
+	return q.client.Do(ctx, "brpoplpush", source, destination, blockSeconds(block)).Text()
+}
+
+// blockSeconds is the timeout argument of a blocking command waiting up to
+// block, to the millisecond and never 0, which would wait forever
+func blockSeconds(block time.Duration) string {
+	if block < time.Millisecond {
+		block = time.Millisecond
+	}
+	return strconv.FormatFloat(block.Seconds(), 'f', 3, 64)
+}
+
+// PopPendingJob removes and returns the oldest pending job of the default
+// model, from the highest priority list that has one, without waiting, or
+// nil if none is pending, the queue is paused, or its circuit breaker is
+// open. Unlike ClaimJob it leaves no claim behind, so a caller that crashes
+// before finishing the job loses it; it's kept for callers of the original
+// queue that track jobs themselves.
+func (q *RedisQueue) PopPendingJob(ctx context.Context) (*Job, error) {
+	return q.pop(ctx, func(workerID string) (*Job, error) {
+		return q.ClaimPendingJob(ctx, workerID, []string{ModelDefault})
+	})
+}
+
+// PopPendingJobBlocking is PopPendingJob waiting up to timeout for a job to
+// arrive, or until ctx is done if timeout is 0, as ClaimJobBlocking waits.
+// It returns nil, nil on timeout and ctx's error once ctx is done; each job
+// is returned to one caller only, however many wait at once.
+func (q *RedisQueue) PopPendingJobBlocking(ctx context.Context, timeout time.Duration) (*Job, error) {
+	return q.pop(ctx, func(workerID string) (*Job, error) {
+		return q.ClaimJobBlocking(ctx, workerID, timeout)
+	})
+}
+
+// pop claims a job with claim as a worker of its own and releases the
+// claim at once. Each call claims under a new worker ID, so concurrent pops
+// never share a processing list whose entries one could release or recover
+// for another. With PendingStreams the ID's consumer is deleted from the
+// group once nothing is left delivered to it.
+func (q *RedisQueue) pop(ctx context.Context, claim func(workerID string) (*Job, error)) (*Job, error) {
+	token, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+	workerID := popWorkerID + ":" + token
+	job, err := claim(workerID)
+	if err == nil && job != nil {
+		err = q.AckJob(ctx, workerID, job.ID)
+	}
+	if err != nil {
+		// A delivery left to the consumer is reclaimed once idle
+		return job, err
+	}
+	return job, q.forgetConsumer(ctx, workerID)
+}
+
+// ClaimPendingJob claims the next pending job for a worker with models
+// loaded without waiting, returning nil if none is pending, the queue is
+// paused, or its circuit breaker is open. IDs of jobs that expired while
+// queued are dropped on the way. Auto jobs are claimed only by a worker with
+// every model. Higher priorities are drained first, across every model;
+// within a priority the models take turns, so a burst of jobs for a slow
+// model doesn't hold back those of a fast one.
+func (q *RedisQueue) ClaimPendingJob(ctx context.Context, workerID string, models []string) (*Job, error) {
+	paused, err := q.claimsStopped(ctx)
+	if err != nil || paused {
+		return nil, err
+	}
+	return q.popPendingJob(ctx, workerID, models)
+}
+
+// popPendingJob is ClaimPendingJob whether or not the queue is paused
+func (q *RedisQueue) popPendingJob(ctx context.Context, workerID string, models []string) (*Job, error) {
+	claimable := claimableModels(models)
+	if len(claimable) == 0 {
+		return nil, nil
+	}
+	turn := int(atomic.LoadUint32(&q.modelTurn) % uint32(len(claimable)))
+	for _, priority := range Priorities {
+		for i := range claimable {
+			model := claimable[(turn+i)%len(claimable)]
+			jobID, err := q.popPending(ctx, workerID, model, priority, 0)
+			if err != nil {
+				return nil, err
+			}
+			if jobID == "" {
+				continue
+			}
+			// The next claim tries the model after this one first
+			atomic.StoreUint32(&q.modelTurn, uint32((turn+i+1)%len(claimable)))
+			job, err := q.claimed(ctx, workerID, jobID)
+			if err != nil || job != nil {
+				return job, err
+			}
+		}
+	}
+	return nil, nil
+}
+
+// claimed returns the job just moved onto the worker's processing list, or
+// nil if it had expired or finished
+func (q *RedisQueue) claimed(ctx context.Context, workerID, jobID string) (*Job, error) {
+	// Recorded after the move, so RecoverAbandonedClaims never finds the
+	// worker listed with an empty list it's about to fill. Stream claims are
+	// found through the consumer group instead. PopPendingJob releases its
+	// claims at once, so they mustn't be recovered meanwhile.
+	if !q.opts.PendingStreams && !strings.HasPrefix(workerID, popWorkerID+":") {
+		if err := q.client.SAdd(ctx, q.claimWorkersKey(), workerID).Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	job, err := NilIfNotFound(q.GetJob(ctx, jobID))
+	if err != nil {
+		return nil, err
+	}
+	if job == nil || job.Status.Finished() {
+		// The job expired while queued, or was cancelled and its stream
+		// entry left behind; there is nothing left to process
+		return nil, q.AckJob(ctx, workerID, jobID)
+	}
+	return job, nil
+}
+
+// AckJob releases the worker's claim on a job it has finished
+func (q *RedisQueue) AckJob(ctx context.Context, workerID, jobID string) error {
+	release, err := q.claimRelease(ctx, workerID, jobID)
+	if err != nil {
+		return err
+	}
+	_, err = q.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		release(pipe)
+		return nil
+	})
+	return err
+}
+
+// NackJob returns a claimed job to its pending list for another worker,
+// reset to pending, adding the attempt to its AttemptHistory if it was being
+// processed. A job that finished or expired meanwhile is only
+// released. The job is pushed back before the claim is removed, so a crash
+// in between leaves a duplicate entry, which workers skip, rather than
+// losing it.
+func (q *RedisQueue) NackJob(ctx context.Context, workerID, jobID string) error {
+	_, err := q.nack(ctx, workerID, jobID)
+	return err
+}
+
+// nack is NackJob, reporting whether the job was requeued
+func (q *RedisQueue) nack(ctx context.Context, workerID, jobID string) (bool, error) {
+	release, err := q.claimRelease(ctx, workerID, jobID)
+	if err != nil {
+		return false, err
+	}
+	return q.requeueClaim(ctx, jobID, release)
+}
+
+// requeueClaim is nack for a claim that release removes in the
+// transaction pushing the job back
+func (q *RedisQueue) requeueClaim(ctx context.Context, jobID string, release func(pipe redis.Pipeliner)) (bool, error) {
+	job, err := NilIfNotFound(q.GetJob(ctx, jobID))
+	if err != nil {
+		return false, err
+	}
+	if job == nil || job.Status == StatusCompleted || job.Status == StatusFailed || job.Status == StatusCancelled {
+		_, err := q.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			release(pipe)
+			return nil
+		})
+		return false, err
+	}
+
+	now, err := q.client.Time(ctx).Result()
+	if err != nil {
+		return false, err
+	}
+	from := job.Status
+	if from == StatusProcessing {
+		// The attempt the worker started is over, unfinished
+		job.Error = "The attempt was abandoned before it finished"
+		job.ErrorCode = ErrorCodeAttemptAbandoned
+		job.recordAttempt(now)
+		job.Error, job.ErrorCode = "", ""
+	}
+	job.Status = StatusPending
+	job.EnqueuedAtMs = now.UnixMilli()
+	if err := q.transition(ctx, job, from); errors.Is(err, ErrInvalidTransition) {
+		// Finished or requeued meanwhile; decided again from its new status
+		return q.requeueClaim(ctx, jobID, release)
+	} else if err != nil {
+		return false, err
+	}
+	pipe := q.client.TxPipeline()
+	q.enqueue(ctx, pipe, job)
+	release(pipe)
+	_, err = pipe.Exec(ctx)
+	return err == nil, err
+}
+
+// RecoverClaims returns every job claimed by a worker to the pending lists,
+// for a worker that died or restarted, and returns how many were requeued.
+func (q *RedisQueue) RecoverClaims(ctx context.Context, workerID string) (int, error) {
+	var jobIDs []string
+	var err error
+	if q.opts.PendingStreams {
+		jobIDs, err = q.client.HKeys(ctx, q.streamClaimsKey(workerID)).Result()
+	} else {
+		jobIDs, err = q.client.LRange(ctx, q.processingKey(workerID), 0, -1).Result()
+	}
+	if err != nil {
+		return 0, err
+	}
+	recovered := 0
+	for _, jobID := range jobIDs {
+		requeued, err := q.nack(ctx, workerID, jobID)
+		if err != nil {
+			return recovered, err
+		}
+		if requeued {
+			recovered++
+		}
+	}
+	return recovered, nil
+}
+
+// RecoverAbandonedClaims recovers the claims of workers without a live
+// heartbeat and forgets workers left without claims. With PendingStreams
+// the consumer group tracks each delivery instead, and the deliveries left
+// unacknowledged for StreamClaimIdle are reclaimed. It returns how many
+// jobs were requeued.
+func (q *RedisQueue) RecoverAbandonedClaims(ctx context.Context) (int, error) {
+	if q.opts.PendingStreams {
+		return q.reclaimStreams(ctx)
+	}
+	workerIDs, err := q.client.SMembers(ctx, q.claimWorkersKey()).Result()
+	if err != nil {
+		return 0, err
+	}
+	heartbeats, err := q.WorkerHeartbeats(ctx)
+	if err != nil {
+		return 0, err
+	}
+	alive := make(map[string]bool, len(heartbeats))
+	for _, hb := range heartbeats {
+		alive[hb.WorkerID] = true
+	}
+
+	recovered := 0
+	for _, workerID := range workerIDs {
+		if alive[workerID] {
+			continue
+		}
+		n, err := q.RecoverClaims(ctx, workerID)
+		recovered += n
+		if err != nil {
+			return recovered, err
+		}
+		// A worker that claims again re-adds itself
+		if err := forgetClaimWorkerScript.Run(ctx, q.client, []string{q.processingKey(workerID), q.claimWorkersKey()}, workerID).Err(); err != nil {
+			return recovered, err
+		}
+	}
+	return recovered, nil
+}
+
+// ReapStaleJobs handles up to ReapBatch jobs left processing, unchanged,
+// for longer than timeout, as when their worker hung without dying, which
+// RecoverAbandonedClaims can't tell. Each is found through the processing
+// status index, so workers needn't register jobs anywhere else. The overrun
+// is added to the job's AttemptHistory; the attempt itself was counted when
+// the worker started it. A job with attempts left is reset to pending and
+// pushed back onto its pending list, and one without is failed with
+// ErrorCodeProcessingTimeout, landing among the dead jobs as FailJob fails
+// any job. Each job is rewritten only if it didn't change meanwhile, so a
+// worker finishing it at the same moment wins. It returns how many jobs
+// were requeued and failed.
+func (q *RedisQueue) ReapStaleJobs(ctx context.Context, timeout time.Duration) (int, int, error) {
+	now, err := q.client.Time(ctx).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+	cutoff := now.Add(-timeout)
+	jobIDs, err := q.client.ZRangeByScore(ctx, q.statusIndexKey(StatusProcessing), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   "(" + strconv.FormatInt(cutoff.UnixMilli(), 10),
+		Count: ReapBatch,
+	}).Result()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	requeued, failed := 0, 0
+	for _, jobID := range jobIDs {
+		job, err := q.reap(ctx, jobID, cutoff, now, timeout)
+		if err != nil {
+			return requeued, failed, err
+		}
+		switch {
+		case job == nil:
+		case job.Status == StatusPending:
+			requeued++
+		default:
+			failed++
+			if err := q.RefundQuota(ctx, job); err != nil {
+				return requeued, failed, err
+			}
+			if err := q.RecordOutcome(ctx, job); err != nil {
+				return requeued, failed, err
+			}
+		}
+	}
+	return requeued, failed, nil
+}
+
+// reap requeues or fails one job if it's still processing unchanged since
+// before cutoff, returning it as written, or nil if it was left alone
+func (q *RedisQueue) reap(ctx context.Context, jobID string, cutoff, now time.Time, timeout time.Duration) (*Job, error) {
+	key := q.jobKey(jobID)
+	var reaped *Job
+	txf := func(tx *redis.Tx) error {
+		reaped = nil
+		data, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			return nil // Expired; the index is pruned separately
+		}
+		if err != nil {
+			return err
+		}
+		var job Job
+		if err := q.opts.Codec.Decode(data, &job); err != nil {
+			return err
+		}
+		if job.Status != StatusProcessing || !job.UpdatedAt.Before(cutoff) {
+			return nil
+		}
+
+		job.Error = fmt.Sprintf("Processing took longer than %s", timeout)
+		job.ErrorCode = ErrorCodeProcessingTimeout
+		job.recordAttempt(now)
+		if job.CanRetry() {
+			job.Status = StatusPending
+			job.Error, job.ErrorCode = "", ""
+			job.EnqueuedAtMs = now.UnixMilli()
+		} else {
+			job.Status = StatusFailed
+		}
+		job.UpdatedAt = q.opts.Clock.Now()
+		job.Version++
+		job.recordStatus(job.UpdatedAt)
+		encoded, err := q.opts.Codec.Encode(&job)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, encoded, q.jobTTL(&job))
+			q.indexStatus(ctx, pipe, &job)
+			q.recordHistory(ctx, pipe, &job)
+			if job.Status == StatusPending {
+				q.enqueue(ctx, pipe, &job)
+			}
+			return nil
+		})
+		if err == nil {
+			reaped = &job
+		}
+		return err
+	}
+
+	for i := 0; i < maxReapRetries; i++ {
+		err := q.client.Watch(ctx, txf, key)
+		if err == redis.TxFailedErr {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if reaped != nil {
+			q.publishEvent(reaped)
+		}
+		return reaped, nil
+	}
+	// Still changing, so not stale; the next pass looks again
+	return nil, nil
+}
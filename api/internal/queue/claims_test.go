@@ -0,0 +1,395 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestPopPendingJobLeavesNoClaim(t *testing.T) {
+	q, _ := newTestRedisQueue(t, Options{})
+	ctx := context.Background()
+	if job, err := q.PopPendingJob(ctx); err != nil || job != nil {
+		t.Fatalf("PopPendingJob on an empty queue: %v, %v", job, err)
+	}
+	for _, job := range []*Job{
+		{ID: "normal", Status: StatusPending},
+		{ID: "high", Status: StatusPending, Priority: PriorityHigh},
+	} {
+		if err := q.AddJob(ctx, job); err != nil {
+			t.Fatalf("AddJob: %v", err)
+		}
+	}
+
+	for _, want := range []string{"high", "normal"} {
+		job, err := q.PopPendingJob(ctx)
+		if err != nil || job == nil || job.ID != want {
+			t.Fatalf("PopPendingJob: got %v, %v, want %s", job, err, want)
+		}
+	}
+	if job, err := q.PopPendingJob(ctx); err != nil || job != nil {
+		t.Fatalf("PopPendingJob on a drained queue: %v, %v", job, err)
+	}
+	if keys, err := q.client.Keys(ctx, q.processingKey("*")).Result(); err != nil || len(keys) != 0 {
+		t.Fatalf("PopPendingJob left claims in %v: %v", keys, err)
+	}
+	if workers, err := q.client.SMembers(ctx, q.claimWorkersKey()).Result(); err != nil || len(workers) != 0 {
+		t.Fatalf("PopPendingJob left claim workers %v: %v", workers, err)
+	}
+}
+
+func TestPopPendingJobLeavesNoStreamConsumers(t *testing.T) {
+	q, _ := newTestRedisQueue(t, Options{PendingStreams: true})
+	ctx := context.Background()
+	for _, id := range []string{"job-1", "job-2"} {
+		if err := q.AddJob(ctx, &Job{ID: id, Status: StatusPending}); err != nil {
+			t.Fatalf("AddJob: %v", err)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		if _, err := q.PopPendingJob(ctx); err != nil {
+			t.Fatalf("PopPendingJob: %v", err)
+		}
+	}
+	for _, priority := range Priorities {
+		key := q.pendingStreamKey(ModelDefault, priority)
+		if consumers, err := q.client.XInfoConsumers(ctx, key, q.opts.StreamGroup).Result(); err != nil || len(consumers) != 0 {
+			t.Fatalf("PopPendingJob left consumers %v on %s: %v", consumers, key, err)
+		}
+	}
+}
+
+func TestClaimSurvivesWorkerCrash(t *testing.T) {
+	q, _ := newTestRedisQueue(t, Options{})
+	ctx := context.Background()
+	if err := q.AddJob(ctx, &Job{ID: "job-1", Status: StatusPending}); err != nil {
+		t.Fatalf("AddJob: %v", err)
+	}
+
+	// The worker claims the job and dies without acknowledging it
+	job, err := q.ClaimPendingJob(ctx, "crashed", []string{ModelDefault})
+	if err != nil || job == nil || job.ID != "job-1" {
+		t.Fatalf("ClaimPendingJob: %v, %v", job, err)
+	}
+	if other, err := q.ClaimPendingJob(ctx, "worker-2", []string{ModelDefault}); err != nil || other != nil {
+		t.Fatalf("claimed job delivered twice: %v, %v", other, err)
+	}
+
+	recovered, err := q.RecoverAbandonedClaims(ctx)
+	if err != nil || recovered != 1 {
+		t.Fatalf("RecoverAbandonedClaims: %d, %v", recovered, err)
+	}
+	job, err = q.ClaimPendingJob(ctx, "worker-2", []string{ModelDefault})
+	if err != nil || job == nil || job.ID != "job-1" {
+		t.Fatalf("claim after recovery: %v, %v", job, err)
+	}
+	if err := q.AckJob(ctx, "worker-2", job.ID); err != nil {
+		t.Fatalf("AckJob: %v", err)
+	}
+	if n, err := q.client.LLen(ctx, q.processingKey("worker-2")).Result(); err != nil || n != 0 {
+		t.Fatalf("%d claims left after AckJob: %v", n, err)
+	}
+}
+
+func TestReclaimedJobFencesTheDeadWorker(t *testing.T) {
+	q, _ := newTestRedisQueue(t, Options{})
+	ctx := context.Background()
+	if err := q.AddJob(ctx, &Job{ID: "job-1"}); err != nil {
+		t.Fatalf("AddJob: %v", err)
+	}
+
+	// The first worker claims and starts the job, then is cut off without
+	// a heartbeat, still holding its copy
+	if job, err := q.ClaimPendingJob(ctx, "worker-1", []string{ModelDefault}); err != nil || job == nil {
+		t.Fatalf("ClaimPendingJob: %v, %v", job, err)
+	}
+	stale, err := q.StartJob(ctx, "job-1", "worker-1")
+	if err != nil {
+		t.Fatalf("StartJob: %v", err)
+	}
+	if recovered, err := q.RecoverAbandonedClaims(ctx); err != nil || recovered != 1 {
+		t.Fatalf("RecoverAbandonedClaims = %d, %v, want the job requeued", recovered, err)
+	}
+
+	// The job is reclaimed and started under a new token
+	if job, err := q.ClaimPendingJob(ctx, "worker-2", []string{ModelDefault}); err != nil || job == nil || job.ID != "job-1" {
+		t.Fatalf("claim after recovery: %v, %v", job, err)
+	}
+	fresh, err := q.StartJob(ctx, "job-1", "worker-2")
+	if err != nil {
+		t.Fatalf("StartJob after recovery: %v", err)
+	}
+	if fresh.ClaimToken == "" || fresh.ClaimToken == stale.ClaimToken || fresh.Attempts != 2 {
+		t.Fatalf("restarted job has token %q and %d attempts, want a new token and 2 attempts", fresh.ClaimToken, fresh.Attempts)
+	}
+
+	// The first worker comes back and finishes under its old token
+	err = q.TransitionJob(ctx, "job-1", StatusProcessing, StatusCompleted, func(job *Job) {
+		job.ClaimToken = stale.ClaimToken
+		job.OutputPath = "stale.png"
+	})
+	if !errors.Is(err, ErrFenced) {
+		t.Fatalf("completing under the stale token = %v, want ErrFenced", err)
+	}
+	stale.OutputPath = "stale.png"
+	if err := q.UpdateJob(ctx, stale); !errors.Is(err, ErrFenced) {
+		t.Fatalf("writing back the stale copy = %v, want ErrFenced", err)
+	}
+
+	// The worker holding the claim finishes it
+	err = q.TransitionJob(ctx, "job-1", StatusProcessing, StatusCompleted, func(job *Job) {
+		job.ClaimToken = fresh.ClaimToken
+		job.OutputPath = "fresh.png"
+	})
+	if err != nil {
+		t.Fatalf("completing under the current token: %v", err)
+	}
+	job, err := q.GetJob(ctx, "job-1")
+	if err != nil || job.Status != StatusCompleted || job.OutputPath != "fresh.png" || job.WorkerID != "worker-2" {
+		t.Fatalf("stored job = %+v, %v, want completed by worker-2", job, err)
+	}
+}
+
+func TestClaimPendingJobTakesModelsInTurn(t *testing.T) {
+	q, _ := newTestRedisQueue(t, Options{})
+	ctx := context.Background()
+	for _, job := range []*Job{
+		{ID: "default-1", Status: StatusPending},
+		{ID: "default-2", Status: StatusPending},
+		{ID: "portrait-1", Status: StatusPending, Model: ModelPortrait},
+	} {
+		if err := q.AddJob(ctx, job); err != nil {
+			t.Fatalf("AddJob: %v", err)
+		}
+	}
+
+	models := []string{ModelDefault, ModelPortrait}
+	var got []string
+	for i := 0; i < 3; i++ {
+		job, err := q.ClaimPendingJob(ctx, "worker-1", models)
+		if err != nil || job == nil {
+			t.Fatalf("ClaimPendingJob %d: %v, %v", i, job, err)
+		}
+		got = append(got, job.ID)
+	}
+	if got[2] == "portrait-1" {
+		t.Fatalf("the portrait job waited behind every default one: %v", got)
+	}
+}
+
+func TestClaimJobDoesNotWait(t *testing.T) {
+	q, _ := newTestRedisQueue(t, Options{})
+	start := time.Now()
+	if job, err := q.ClaimJob(context.Background(), "worker-1"); err != nil || job != nil {
+		t.Fatalf("ClaimJob on an empty queue: %v, %v", job, err)
+	}
+	if waited := time.Since(start); waited >= ClaimWait {
+		t.Fatalf("ClaimJob waited %s for a job", waited)
+	}
+}
+
+func TestPopPendingJobBlockingDeliversEachJobOnce(t *testing.T) {
+	q, _ := newTestRedisQueue(t, Options{})
+	ctx := context.Background()
+	const jobs = 20
+
+	var mu sync.Mutex
+	delivered := make(map[string]int)
+	var wg sync.WaitGroup
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				job, err := q.PopPendingJobBlocking(ctx, 2*ClaimWait)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if job == nil {
+					return
+				}
+				mu.Lock()
+				delivered[job.ID]++
+				mu.Unlock()
+			}
+		}()
+	}
+
+	// Added while both consumers are blocked
+	time.Sleep(50 * time.Millisecond)
+	for i := 0; i < jobs; i++ {
+		if err := q.AddJob(ctx, &Job{ID: fmt.Sprintf("job-%d", i), Status: StatusPending}); err != nil {
+			t.Fatalf("AddJob: %v", err)
+		}
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("PopPendingJobBlocking: %v", err)
+	}
+
+	if len(delivered) != jobs {
+		t.Fatalf("%d jobs delivered, want %d", len(delivered), jobs)
+	}
+	for id, n := range delivered {
+		if n != 1 {
+			t.Errorf("job %s delivered %d times", id, n)
+		}
+	}
+}
+
+func TestClaimJobBlockingReturnsAtDeadline(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		opts    Options
+		timeout time.Duration
+		paused  bool
+	}{
+		{"under ClaimWait", Options{}, ClaimWait / 4, false},
+		{"past ClaimWait", Options{}, ClaimWait + ClaimWait/4, false},
+		{"paused", Options{}, ClaimWait / 4, true},
+		{"fair", Options{Scheduling: SchedulingFair}, ClaimWait / 4, false},
+		{"streams", Options{PendingStreams: true}, ClaimWait / 4, false},
+	} {
+		q, _ := newTestRedisQueue(t, tc.opts)
+		ctx := context.Background()
+		if tc.paused {
+			if err := q.Pause(ctx); err != nil {
+				t.Fatalf("Pause: %v", err)
+			}
+		}
+		start := time.Now()
+		job, err := q.ClaimJobBlocking(ctx, "worker-1", tc.timeout)
+		waited := time.Since(start)
+		if job != nil || err != nil {
+			t.Fatalf("%s: ClaimJobBlocking on an empty queue = %v, %v", tc.name, job, err)
+		}
+		// The last call to Redis waits only what's left, not a whole ClaimWait
+		if waited < tc.timeout || waited > tc.timeout+ClaimWait/4 {
+			t.Fatalf("%s: ClaimJobBlocking waited %s, want %s", tc.name, waited, tc.timeout)
+		}
+	}
+}
+
+func TestClaimJobBlockingClaimsWithinTheLastWait(t *testing.T) {
+	q, _ := newTestRedisQueue(t, Options{})
+	ctx := context.Background()
+	time.AfterFunc(ClaimWait+ClaimWait/10, func() {
+		q.AddJob(ctx, &Job{ID: "job-1", Status: StatusPending})
+	})
+	job, err := q.ClaimJobBlocking(ctx, "worker-1", ClaimWait+ClaimWait/2)
+	if err != nil || job == nil || job.ID != "job-1" {
+		t.Fatalf("ClaimJobBlocking = %v, %v, want the job queued before the deadline", job, err)
+	}
+}
+
+func TestPopPendingJobBlockingStopsWithContext(t *testing.T) {
+	q, _ := newTestRedisQueue(t, Options{})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	start := time.Now()
+	job, err := q.PopPendingJobBlocking(ctx, 0)
+	if job != nil || !errors.Is(err, context.Canceled) {
+		t.Fatalf("PopPendingJobBlocking after cancellation: %v, %v", job, err)
+	}
+	if waited := time.Since(start); waited > 2*ClaimWait {
+		t.Fatalf("cancellation noticed after %s", waited)
+	}
+}
+
+func TestNackJobRecordsAbandonedAttempt(t *testing.T) {
+	q, _ := newTestRedisQueue(t, Options{})
+	ctx := context.Background()
+	if err := q.AddJob(ctx, &Job{ID: "job-1", Status: StatusPending}); err != nil {
+		t.Fatalf("AddJob: %v", err)
+	}
+
+	// Returned before it started: there's no attempt to record
+	if job, err := q.ClaimPendingJob(ctx, "worker-1", []string{ModelDefault}); err != nil || job == nil {
+		t.Fatalf("ClaimPendingJob: %v, %v", job, err)
+	}
+	if err := q.NackJob(ctx, "worker-1", "job-1"); err != nil {
+		t.Fatalf("NackJob: %v", err)
+	}
+	if job, err := q.GetJob(ctx, "job-1"); err != nil || len(job.AttemptHistory) != 0 {
+		t.Fatalf("GetJob after an unstarted nack = %+v, %v, want no attempts", job, err)
+	}
+
+	if job, err := q.ClaimPendingJob(ctx, "worker-1", []string{ModelDefault}); err != nil || job == nil {
+		t.Fatalf("ClaimPendingJob: %v, %v", job, err)
+	}
+	started, err := q.StartJob(ctx, "job-1", "worker-1")
+	if err != nil {
+		t.Fatalf("StartJob: %v", err)
+	}
+	if err := q.NackJob(ctx, "worker-1", "job-1"); err != nil {
+		t.Fatalf("NackJob: %v", err)
+	}
+
+	job, err := q.GetJob(ctx, "job-1")
+	if err != nil {
+		t.Fatalf("GetJob: %v", err)
+	}
+	if job.Status != StatusPending || job.Error != "" || job.ErrorCode != "" {
+		t.Fatalf("nacked job = %s, %q, %q, want pending without an error", job.Status, job.Error, job.ErrorCode)
+	}
+	if len(job.AttemptHistory) != 1 {
+		t.Fatalf("AttemptHistory = %+v, want one attempt", job.AttemptHistory)
+	}
+	attempt := job.AttemptHistory[0]
+	if attempt.Attempt != 1 || attempt.ErrorCode != ErrorCodeAttemptAbandoned || attempt.Error == "" || attempt.WorkerID != "worker-1" {
+		t.Fatalf("attempt = %+v, want attempt 1 abandoned by worker-1", attempt)
+	}
+	if attempt.StartedAt == nil || !attempt.StartedAt.Equal(*started.AttemptStartedAt) || attempt.FailedAt.IsZero() {
+		t.Fatalf("attempt ran %v to %v, want from %v", attempt.StartedAt, attempt.FailedAt, started.AttemptStartedAt)
+	}
+
+	// Pushed back for another worker, with the claim released
+	if n, err := q.client.LLen(ctx, q.processingKey("worker-1")).Result(); err != nil || n != 0 {
+		t.Fatalf("%d claims left after NackJob: %v", n, err)
+	}
+	if again, err := q.ClaimPendingJob(ctx, "worker-2", []string{ModelDefault}); err != nil || again == nil || again.ID != "job-1" {
+		t.Fatalf("claim after NackJob: %v, %v", again, err)
+	}
+}
+
+func TestNackJobCapsAttemptHistory(t *testing.T) {
+	q, _ := newTestRedisQueue(t, Options{})
+	ctx := context.Background()
+	history := make([]Attempt, MaxAttemptHistory)
+	for i := range history {
+		history[i] = Attempt{Attempt: i + 1, Error: "model crashed", FailedAt: time.Now()}
+	}
+	job := &Job{ID: "job-1", Status: StatusPending, Attempts: MaxAttemptHistory, MaxAttempts: 100, AttemptHistory: history}
+	if err := q.AddJob(ctx, job); err != nil {
+		t.Fatalf("AddJob: %v", err)
+	}
+	if job, err := q.ClaimPendingJob(ctx, "worker-1", []string{ModelDefault}); err != nil || job == nil {
+		t.Fatalf("ClaimPendingJob: %v, %v", job, err)
+	}
+	if _, err := q.StartJob(ctx, "job-1", "worker-1"); err != nil {
+		t.Fatalf("StartJob: %v", err)
+	}
+	if err := q.NackJob(ctx, "worker-1", "job-1"); err != nil {
+		t.Fatalf("NackJob: %v", err)
+	}
+
+	job, err := q.GetJob(ctx, "job-1")
+	if err != nil {
+		t.Fatalf("GetJob: %v", err)
+	}
+	if len(job.AttemptHistory) != MaxAttemptHistory {
+		t.Fatalf("AttemptHistory holds %d attempts, want the latest %d", len(job.AttemptHistory), MaxAttemptHistory)
+	}
+	// The oldest is dropped for the one abandoned
+	first, last := job.AttemptHistory[0], job.AttemptHistory[MaxAttemptHistory-1]
+	if first.Attempt != 2 || last.Attempt != MaxAttemptHistory+1 || last.ErrorCode != ErrorCodeAttemptAbandoned {
+		t.Fatalf("AttemptHistory runs from %+v to %+v, want attempts 2 to %d", first, last, MaxAttemptHistory+1)
+	}
+}
@@ -0,0 +1,25 @@
+package queue
+
+import "time"
+
+// Clock provides the current time to the queue, so tests can control it
+type Clock interface {
+	Now() time.Time
+}
+
+// SystemClock is the Clock backed by the system time
+type SystemClock struct{}
+
+// Now returns the current system time
+func (SystemClock) Now() time.Time {
+	return time.Now()
+}
+
+// clampDuration returns ms, or zero if it is negative, counting the clamp
+func clampDuration(ms int64) int64 {
+	if ms < 0 {
+		negativeDurations.Add(1)
+		return 0
+	}
+	return ms
+}
@@ -0,0 +1,110 @@
+package queue
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Compression algorithms for stored job records
+const (
+	// CompressionNone stores every record as plain JSON
+	CompressionNone = "none"
+	// CompressionZlib compresses large records with zlib, which the workers
+	// can read without extra dependencies
+	CompressionZlib = "zlib"
+)
+
+// DefaultCompressionThreshold is the record size in bytes above which records are compressed
+const DefaultCompressionThreshold = 4096
+
+// zlibMarker starts a zlib record. Plain records are JSON objects and
+// always start with '{', so the first byte tells the formats apart and
+// records written before compression was enabled still read.
+const zlibMarker = 'z'
+
+// errUnknownRecordFormat is returned for records in neither format
+var errUnknownRecordFormat = errors.New("unknown job record format")
+
+// Codec encodes job records, compressing those above Threshold bytes.
+// Compressed bytes are base64-encoded after the marker so records stay
+// valid UTF-8 for the workers, whose Redis client decodes responses as text.
+// The zero value stores plain JSON.
+type Codec struct {
+	Algorithm string
+	Threshold int
+}
+
+// ParseCompression validates a compression algorithm name
+func ParseCompression(name string) (string, error) {
+	switch name {
+	case "", CompressionNone:
+		return CompressionNone, nil
+	case CompressionZlib:
+		return CompressionZlib, nil
+	}
+	return "", fmt.Errorf("unknown compression algorithm %q, want %s or %s", name, CompressionNone, CompressionZlib)
+}
+
+// Encode serializes v to a record
+func (c Codec) Encode(v interface{}) ([]byte, error) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+	if c.Algorithm != CompressionZlib || len(data) <= c.Threshold {
+		return data, nil
+	}
+
+	var compressed bytes.Buffer
+	zw := zlib.NewWriter(&compressed)
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+
+	// Keep the plain record if compressing didn't pay for the base64 overhead
+	record := make([]byte, 1+base64.StdEncoding.EncodedLen(compressed.Len()))
+	if len(record) >= len(data) {
+		return data, nil
+	}
+	record[0] = zlibMarker
+	base64.StdEncoding.Encode(record[1:], compressed.Bytes())
+	return record, nil
+}
+
+// Decode deserializes a record in any stored format into v, regardless of
+// the codec's own settings
+func (c Codec) Decode(record []byte, v interface{}) error {
+	if len(record) == 0 {
+		return errUnknownRecordFormat
+	}
+
+	switch record[0] {
+	case '{':
+		return json.Unmarshal(record, v)
+	case zlibMarker:
+		compressed := make([]byte, base64.StdEncoding.DecodedLen(len(record)-1))
+		n, err := base64.StdEncoding.Decode(compressed, record[1:])
+		if err != nil {
+			return err
+		}
+		zr, err := zlib.NewReader(bytes.NewReader(compressed[:n]))
+		if err != nil {
+			return err
+		}
+		defer zr.Close()
+		data, err := io.ReadAll(zr)
+		if err != nil {
+			return err
+		}
+		return json.Unmarshal(data, v)
+	}
+	return errUnknownRecordFormat
+}
@@ -0,0 +1,227 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+// largeJobs is a corpus of job records carrying the option and metadata
+// blobs of video and batch jobs
+func largeJobs() []*Job {
+	created := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+	var jobs []*Job
+	for i := 0; i < 20; i++ {
+		job := &Job{
+			ID:        fmt.Sprintf("job-%04d", i),
+			Status:    StatusPending,
+			InputPath: fmt.Sprintf("uploads/2024/03/01/job-%04d/input.mp4", i),
+			CreatedAt: created,
+			UpdatedAt: created.Add(time.Duration(i) * time.Second),
+			Owner:     fmt.Sprintf("tenant-%d", i%3),
+			Pipeline:  []string{"decode", "segment", "matte", "encode"},
+			Options:   make(map[string]string),
+			Metadata:  make(map[string]string),
+		}
+		for f := 0; f < 50+10*i; f++ {
+			job.Options[fmt.Sprintf("frame_%04d_crop", f)] = fmt.Sprintf("%d,%d,%d,%d", f, f*2, 1920-f, 1080-f)
+			job.Metadata[fmt.Sprintf("batch_item_%04d", f)] = fmt.Sprintf("s3://rmbg-inputs/tenant-%d/batch/%04d/source-%04d.png", i%3, i, f)
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+func TestCodecRoundTrip(t *testing.T) {
+	small := &Job{ID: "job-1", Status: StatusPending, InputPath: "in.png", Options: map[string]string{"model": "u2net"}}
+	jobs := append(largeJobs(), small)
+
+	codecs := []Codec{
+		{},
+		{Algorithm: CompressionNone, Threshold: DefaultCompressionThreshold},
+		{Algorithm: CompressionZlib, Threshold: DefaultCompressionThreshold},
+		{Algorithm: CompressionZlib, Threshold: 0},
+	}
+	for _, writer := range codecs {
+		for _, job := range jobs {
+			record, err := writer.Encode(job)
+			if err != nil {
+				t.Fatalf("%+v Encode(%s): %v", writer, job.ID, err)
+			}
+			// Every codec reads every stored format, so records written
+			// before a deployment changed its settings still read
+			for _, reader := range codecs {
+				var got Job
+				if err := reader.Decode(record, &got); err != nil {
+					t.Fatalf("%+v Decode of a record from %+v: %v", reader, writer, err)
+				}
+				if !reflect.DeepEqual(&got, job) {
+					t.Fatalf("%+v Decode of a record from %+v = %+v, want %+v", reader, writer, got, job)
+				}
+			}
+		}
+	}
+}
+
+func TestCodecCompressesOnlyLargeRecords(t *testing.T) {
+	codec := Codec{Algorithm: CompressionZlib, Threshold: DefaultCompressionThreshold}
+	small := &Job{ID: "job-1", InputPath: "in.png"}
+	record, err := codec.Encode(small)
+	if err != nil {
+		t.Fatalf("Encode: %v", err)
+	}
+	if record[0] != '{' {
+		t.Fatalf("small record stored as %q, want plain JSON", record[:1])
+	}
+
+	for _, job := range largeJobs() {
+		record, err := codec.Encode(job)
+		if err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+		plain, _ := Codec{}.Encode(job)
+		if record[0] != zlibMarker || len(record) >= len(plain) {
+			t.Fatalf("%s stored in %d bytes with marker %q, want fewer than its %d plain bytes compressed", job.ID, len(record), record[:1], len(plain))
+		}
+	}
+}
+
+func TestCodecDecodeRejectsUnknownFormats(t *testing.T) {
+	for _, record := range []string{"", "[]", "x{}", "z!!!not base64", "z" + "AAAA"} {
+		var job Job
+		if err := (Codec{}).Decode([]byte(record), &job); err == nil {
+			t.Fatalf("Decode(%q) succeeded, want an error", record)
+		}
+	}
+}
+
+// BenchmarkCodec reports the bytes stored per record, which is what each
+// record costs in Redis memory and moves over the network per round trip
+func BenchmarkCodec(b *testing.B) {
+	jobs := largeJobs()
+	for _, codec := range []Codec{
+		{Algorithm: CompressionNone},
+		{Algorithm: CompressionZlib, Threshold: DefaultCompressionThreshold},
+	} {
+		records := make([][]byte, len(jobs))
+		stored := 0
+		for i, job := range jobs {
+			record, err := codec.Encode(job)
+			if err != nil {
+				b.Fatalf("Encode: %v", err)
+			}
+			records[i] = record
+			stored += len(record)
+		}
+
+		b.Run("Encode/"+codec.Algorithm, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := codec.Encode(jobs[i%len(jobs)]); err != nil {
+					b.Fatalf("Encode: %v", err)
+				}
+			}
+			b.ReportMetric(float64(stored)/float64(len(jobs)), "stored-B/record")
+		})
+		b.Run("Decode/"+codec.Algorithm, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				var job Job
+				if err := codec.Decode(records[i%len(records)], &job); err != nil {
+					b.Fatalf("Decode: %v", err)
+				}
+			}
+			b.ReportMetric(float64(stored)/float64(len(jobs)), "stored-B/record")
+		})
+	}
+}
+
+// BenchmarkRedisJobRoundTrip stores and reads back the corpus through
+// Redis, reporting the memory the records take there
+func BenchmarkRedisJobRoundTrip(b *testing.B) {
+	jobs := largeJobs()
+	for _, codec := range []Codec{
+		{Algorithm: CompressionNone},
+		{Algorithm: CompressionZlib, Threshold: DefaultCompressionThreshold},
+	} {
+		b.Run(codec.Algorithm, func(b *testing.B) {
+			q, server := newTestRedisQueue(b, Options{Codec: codec})
+			ctx := context.Background()
+			for i := 0; i < b.N; i++ {
+				job := *jobs[i%len(jobs)]
+				job.ID = fmt.Sprintf("%s-%d", job.ID, i)
+				if err := q.AddJob(ctx, &job); err != nil {
+					b.Fatalf("AddJob: %v", err)
+				}
+				if _, err := q.GetJob(ctx, job.ID); err != nil {
+					b.Fatalf("GetJob: %v", err)
+				}
+			}
+			stored := 0
+			for _, key := range server.Keys() {
+				if strings.HasPrefix(key, q.jobKey("")) {
+					value, _ := server.Get(key)
+					stored += len(value)
+				}
+			}
+			b.ReportMetric(float64(stored)/float64(b.N), "redis-B/record")
+		})
+	}
+}
+
+func FuzzCodecRoundTrip(f *testing.F) {
+	f.Add("job-1", "model", "u2net", "source", "upload.png", uint16(0))
+	f.Add("job-2", "frame_0001_crop", strings.Repeat("0,0,1920,1080;", 400), "batch", "s3://bucket/key", uint16(DefaultCompressionThreshold))
+	f.Add("", "", "", "", "", uint16(1))
+	f.Add("写真", "emoji", "😀🎉", "bad", "\xff\xfe", uint16(64))
+	f.Fuzz(func(t *testing.T, id, key, value, metaKey, metaValue string, threshold uint16) {
+		job := &Job{
+			ID:       id,
+			Options:  map[string]string{key: value},
+			Metadata: map[string]string{metaKey: metaValue, "repeat": strings.Repeat(value, 8)},
+		}
+		plain, err := Codec{}.Encode(job)
+		if err != nil {
+			t.Fatalf("plain Encode: %v", err)
+		}
+		codec := Codec{Algorithm: CompressionZlib, Threshold: int(threshold)}
+		record, err := codec.Encode(job)
+		if err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+		if len(record) > len(plain) {
+			t.Fatalf("compressed record is %d bytes, more than its %d plain bytes", len(record), len(plain))
+		}
+
+		// JSON replaces invalid UTF-8, so compare with what the plain
+		// record reads back as rather than with job itself
+		var want, got Job
+		if err := (Codec{}).Decode(plain, &want); err != nil {
+			t.Fatalf("Decode of the plain record: %v", err)
+		}
+		if err := codec.Decode(record, &got); err != nil {
+			t.Fatalf("Decode: %v", err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Fatalf("Decode = %+v, want %+v", got, want)
+		}
+	})
+}
+
+func FuzzCodecDecode(f *testing.F) {
+	for _, job := range largeJobs()[:2] {
+		record, _ := Codec{Algorithm: CompressionZlib}.Encode(job)
+		f.Add(record)
+	}
+	f.Add([]byte(`{"id":"job-1"}`))
+	f.Add([]byte("z"))
+	f.Add([]byte("zeJw="))
+	f.Fuzz(func(t *testing.T, record []byte) {
+		// Corrupt records fail with an error, never a panic
+		var job Job
+		Codec{}.Decode(record, &job)
+	})
+}
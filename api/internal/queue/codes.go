@@ -0,0 +1,25 @@
+package queue
+
+// Error codes recorded on failed jobs
+const (
+	// ErrorCodeResultMissing means the job completed but its output file is gone
+	ErrorCodeResultMissing = "result_missing"
+	// ErrorCodeInvalidImage means the input could not be decoded
+	ErrorCodeInvalidImage = "invalid_image"
+	// ErrorCodeProcessingError means the worker failed while processing
+	ErrorCodeProcessingError = "processing_error"
+	// ErrorCodeManual is the default code of jobs failed by an operator
+	ErrorCodeManual = "manual"
+	// ErrorCodeTimeoutPrefix starts the codes of jobs that ran out of time,
+	// followed by the stage that overran, e.g. timeout_inference or timeout_encode
+	ErrorCodeTimeoutPrefix = "timeout_"
+	// ErrorCodeProcessingTimeout means every attempt at the job stayed
+	// processing past the stale-job timeout, as when its worker hung
+	ErrorCodeProcessingTimeout = ErrorCodeTimeoutPrefix + "processing"
+	// ErrorCodeAttemptAbandoned means an attempt was given up unfinished,
+	// as when its worker crashed, and the job was requeued
+	ErrorCodeAttemptAbandoned = "attempt_abandoned"
+	// ErrorCodeLifetimeExceeded means the job was still unfinished at the
+	// end of its maximum lifetime and was stopped
+	ErrorCodeLifetimeExceeded = "lifetime_exceeded"
+)
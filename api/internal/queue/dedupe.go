@@ -0,0 +1,44 @@
+package queue
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// uploadDedupeKey returns the Redis key naming the job last submitted
+// with an upload fingerprint
+func (k redisKeys) uploadDedupeKey(fingerprint string) string {
+	return k.prefix + "dedupe:" + fingerprint
+}
+
+// forgetUploadScript deletes a fingerprint's mapping if it still names job
+// ARGV[1]
+var forgetUploadScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+return redis.call("DEL", KEYS[1])
+`)
+
+// RememberUpload maps the job's upload fingerprint to it for as long as its
+// record is kept, replacing any earlier job with the same fingerprint
+func (q *RedisQueue) RememberUpload(ctx context.Context, job *Job) error {
+	return q.client.Set(ctx, q.uploadDedupeKey(job.UploadFingerprint), job.ID, q.jobTTL(job)).Err()
+}
+
+// FindUpload returns the ID of the job last submitted with fingerprint, or
+// "" if there is none
+func (q *RedisQueue) FindUpload(ctx context.Context, fingerprint string) (string, error) {
+	jobID, err := q.client.Get(ctx, q.uploadDedupeKey(fingerprint)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return jobID, err
+}
+
+// ForgetUpload deletes the mapping of a fingerprint to a job whose result
+// is gone, unless a later job has taken it over
+func (q *RedisQueue) ForgetUpload(ctx context.Context, fingerprint, jobID string) error {
+	return forgetUploadScript.Run(ctx, q.client, []string{q.uploadDedupeKey(fingerprint)}, jobID).Err()
+}
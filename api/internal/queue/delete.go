@@ -0,0 +1,86 @@
+package queue
+
+import (
+	"context"
+	"errors"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// maxDeleteRetries bounds the attempts at a deletion racing other writes to
+// the job
+const maxDeleteRetries = 5
+
+var (
+	// ErrJobProcessing means the job is being processed and the deletion
+	// wasn't forced
+	ErrJobProcessing = errors.New("job is being processed")
+	// ErrDeleteConflict means the job kept changing during the deletion
+	ErrDeleteConflict = errors.New("job changed during the deletion")
+)
+
+// DeleteJob removes a job whatever its status, as RemoveJob does with force
+func (q *RedisQueue) DeleteJob(ctx context.Context, jobID string) error {
+	_, err := q.RemoveJob(ctx, jobID, true)
+	return err
+}
+
+// RemoveJob deletes a job's record with its queue entries, status index and
+// schedule entries, and per-job keys in one transaction, and returns the job
+// as it was when deleted, so the caller removes the files of the record that
+// was actually deleted even if a worker finished the job meanwhile. A job
+// being processed is only removed if force is set, and its worker is asked
+// to stop; the worker finds the record gone and drops its result. It fails
+// with ErrJobNotFound, ErrJobProcessing, or ErrDeleteConflict.
+func (q *RedisQueue) RemoveJob(ctx context.Context, jobID string, force bool) (*Job, error) {
+	key := q.jobKey(jobID)
+	var removed *Job
+	txf := func(tx *redis.Tx) error {
+		removed = nil
+		data, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			return ErrJobNotFound
+		}
+		if err != nil {
+			return err
+		}
+		var job Job
+		if err := q.opts.Codec.Decode(data, &job); err != nil {
+			return err
+		}
+		if job.Status == StatusProcessing && !force {
+			return ErrJobProcessing
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.LRem(ctx, q.pendingList(&job), 0, jobID)
+			pipe.ZRem(ctx, q.scheduledJobsKey(), jobID)
+			pipe.ZRem(ctx, q.lifetimeDeadlinesKey(), jobID)
+			pipe.ZRem(ctx, q.deliveryQueueKey(), jobID)
+			pipe.ZRem(ctx, q.removalScheduleKey(RemovalResults), jobID)
+			pipe.ZRem(ctx, q.removalScheduleKey(RemovalInputs), jobID)
+			q.unindexStatus(ctx, pipe, jobID)
+			pipe.Del(ctx, q.downloadLimitsKey(jobID), q.pollCountKey(jobID), q.recentJobKey(jobID), q.progressKey(jobID), key)
+			if job.Status == StatusProcessing {
+				pipe.Set(ctx, q.cancelKey(jobID), 1, q.jobTTL(&job))
+			}
+			return nil
+		})
+		if err == nil {
+			removed = &job
+		}
+		return err
+	}
+
+	for i := 0; i < maxDeleteRetries; i++ {
+		err := q.client.Watch(ctx, txf, key)
+		if err == redis.TxFailedErr {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return removed, nil
+	}
+	return nil, ErrDeleteConflict
+}
@@ -0,0 +1,99 @@
+package queue
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Delivery destination types
+const (
+	// DeliveryPresignedPut uploads the result with an HTTP PUT to a presigned URL
+	DeliveryPresignedPut = "presigned_put"
+	// DeliveryWebhook POSTs the result bytes to a webhook
+	DeliveryWebhook = "webhook"
+)
+
+// DeliveryStatus is the state of one delivery destination. It is independent
+// of the job status: a completed job stays completed whatever its deliveries do.
+type DeliveryStatus string
+
+const (
+	DeliveryPending   DeliveryStatus = "pending"
+	DeliveryDelivered DeliveryStatus = "delivered"
+	DeliveryFailed    DeliveryStatus = "failed"
+)
+
+// Delivery is a destination a completed job's result is pushed to
+type Delivery struct {
+	Type        string         `json:"type"`
+	URL         string         `json:"url"`
+	Status      DeliveryStatus `json:"status"`
+	Attempts    int            `json:"attempts"`
+	LastError   string         `json:"last_error,omitempty"`
+	DeliveredAt *time.Time     `json:"delivered_at,omitempty"`
+}
+
+// ExportedDeliveries returns the deliveries that already copied the result
+// outside this service, which deleting the job cannot undo
+func (j *Job) ExportedDeliveries() []Delivery {
+	var exported []Delivery
+	for _, d := range j.Deliveries {
+		if d.Status == DeliveryDelivered {
+			exported = append(exported, d)
+		}
+	}
+	return exported
+}
+
+// deliveryQueueKey returns the sorted set of jobs with deliveries to run,
+// scored by when they are next due in Unix milliseconds
+func (k redisKeys) deliveryQueueKey() string {
+	return k.prefix + "delivery_queue"
+}
+
+// ScheduleDelivery makes a job's pending deliveries due at the given time
+func (q *RedisQueue) ScheduleDelivery(ctx context.Context, jobID string, at time.Time) error {
+	return q.client.ZAdd(ctx, q.deliveryQueueKey(), redis.Z{
+		Score:  float64(at.UnixMilli()),
+		Member: jobID,
+	}).Err()
+}
+
+// DeliveryDueAt returns when a job's pending deliveries are next due, and
+// false if none are scheduled
+func (q *RedisQueue) DeliveryDueAt(ctx context.Context, jobID string) (time.Time, bool, error) {
+	score, err := q.client.ZScore(ctx, q.deliveryQueueKey(), jobID).Result()
+	if err == redis.Nil {
+		return time.Time{}, false, nil
+	}
+	if err != nil {
+		return time.Time{}, false, err
+	}
+	return time.UnixMilli(int64(score)), true, nil
+}
+
+// ClaimDueDelivery removes and returns a job whose deliveries are due, or an
+// empty ID if none are. Removal is atomic, so each due job goes to one worker.
+func (q *RedisQueue) ClaimDueDelivery(ctx context.Context) (string, error) {
+	now := strconv.FormatInt(q.opts.Clock.Now().UnixMilli(), 10)
+	due, err := q.client.ZRangeByScore(ctx, q.deliveryQueueKey(), &redis.ZRangeBy{
+		Min: "-inf", Max: now, Count: 10,
+	}).Result()
+	if err != nil {
+		return "", err
+	}
+
+	for _, jobID := range due {
+		removed, err := q.client.ZRem(ctx, q.deliveryQueueKey(), jobID).Result()
+		if err != nil {
+			return "", err
+		}
+		if removed == 1 {
+			return jobID, nil
+		}
+	}
+	return "", nil
+}
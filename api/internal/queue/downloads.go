@@ -0,0 +1,153 @@
+package queue
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// DownloadLimits bound how often one job's result can be served. Zero means unlimited.
+type DownloadLimits struct {
+	Concurrent int64 `json:"concurrent"`
+	Daily      int64 `json:"daily"`
+}
+
+// JobDownloads is a job's download count for a day
+type JobDownloads struct {
+	JobID string `json:"job_id"`
+	Count int64  `json:"count"`
+}
+
+// DownloadHistory is what's known of one job's downloads: counts per UTC
+// day for as long as the daily counters live, and those in flight
+type DownloadHistory struct {
+	Days   map[string]int64 `json:"days"`
+	Active int64            `json:"active"`
+}
+
+const (
+	// activeDownloadTTL clears the in-flight counter if a replica dies mid-download
+	activeDownloadTTL = 10 * time.Minute
+	// dailyDownloadTTL keeps a day's counters a little longer than the day
+	dailyDownloadTTL = 48 * time.Hour
+	// downloadLimitsTTL matches the lifetime of the job itself
+	downloadLimitsTTL = 24 * time.Hour
+)
+
+// activeDownloadsKey returns the Redis key counting in-flight downloads of a job
+func (k redisKeys) activeDownloadsKey(jobID string) string {
+	return k.prefix + "downloads_active:" + jobID
+}
+
+// dailyDownloadsKey returns the Redis key counting a job's downloads for a day
+func (k redisKeys) dailyDownloadsKey(jobID, day string) string {
+	return k.prefix + "downloads:" + jobID + ":" + day
+}
+
+// topDownloadsKey returns the sorted set ranking jobs by downloads for a day
+func (k redisKeys) topDownloadsKey(day string) string {
+	return k.prefix + "downloads_top:" + day
+}
+
+// downloadLimitsKey returns the Redis hash overriding a job's download limits
+func (k redisKeys) downloadLimitsKey(jobID string) string {
+	return k.prefix + "download_limits:" + jobID
+}
+
+// BeginDownload counts a download of the job against its limits, using the
+// job's override if one is set. It reports whether the download may proceed;
+// if so, release must be called when it finishes. Counting is one pipelined
+// round trip.
+func (q *RedisQueue) BeginDownload(ctx context.Context, jobID string, defaults DownloadLimits) (allowed bool, release func(), err error) {
+	day := q.opts.Clock.Now().UTC().Format("2006-01-02")
+	active, daily := q.activeDownloadsKey(jobID), q.dailyDownloadsKey(jobID, day)
+
+	pipe := q.client.TxPipeline()
+	override := pipe.HMGet(ctx, q.downloadLimitsKey(jobID), "concurrent", "daily")
+	inFlight := pipe.Incr(ctx, active)
+	pipe.Expire(ctx, active, activeDownloadTTL)
+	count := pipe.Incr(ctx, daily)
+	pipe.Expire(ctx, daily, dailyDownloadTTL)
+	// Rank rejected attempts too, since hotlinked jobs are the ones hitting limits
+	pipe.ZIncrBy(ctx, q.topDownloadsKey(day), 1, jobID)
+	pipe.Expire(ctx, q.topDownloadsKey(day), dailyDownloadTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, nil, err
+	}
+
+	limits := defaults
+	if values := override.Val(); len(values) == 2 && values[0] != nil {
+		limits.Concurrent = parseCount(values[0])
+		limits.Daily = parseCount(values[1])
+	}
+
+	release = func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		q.client.Decr(ctx, active)
+	}
+
+	if (limits.Concurrent > 0 && inFlight.Val() > limits.Concurrent) || (limits.Daily > 0 && count.Val() > limits.Daily) {
+		// Rejected downloads don't use up the daily budget
+		pipe := q.client.Pipeline()
+		pipe.Decr(ctx, active)
+		pipe.Decr(ctx, daily)
+		pipe.Exec(ctx)
+		return false, nil, nil
+	}
+
+	return true, release, nil
+}
+
+// JobDownloadHistory returns the job's download counts for today and
+// yesterday, the days whose counters are still kept
+func (q *RedisQueue) JobDownloadHistory(ctx context.Context, jobID string) (DownloadHistory, error) {
+	now := q.opts.Clock.Now().UTC()
+	days := []string{now.AddDate(0, 0, -1).Format("2006-01-02"), now.Format("2006-01-02")}
+	keys := []string{q.activeDownloadsKey(jobID)}
+	for _, day := range days {
+		keys = append(keys, q.dailyDownloadsKey(jobID, day))
+	}
+
+	values, err := q.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return DownloadHistory{}, err
+	}
+	history := DownloadHistory{Days: make(map[string]int64), Active: parseCount(values[0])}
+	for i, day := range days {
+		if count := parseCount(values[i+1]); count > 0 {
+			history.Days[day] = count
+		}
+	}
+	return history, nil
+}
+
+// SetDownloadLimits overrides the download limits of one job
+func (q *RedisQueue) SetDownloadLimits(ctx context.Context, jobID string, limits DownloadLimits) error {
+	pipe := q.client.TxPipeline()
+	pipe.HSet(ctx, q.downloadLimitsKey(jobID),
+		"concurrent", strconv.FormatInt(limits.Concurrent, 10),
+		"daily", strconv.FormatInt(limits.Daily, 10),
+	)
+	pipe.Expire(ctx, q.downloadLimitsKey(jobID), downloadLimitsTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// TopDownloads returns the n jobs with the most download attempts today
+func (q *RedisQueue) TopDownloads(ctx context.Context, n int64) ([]JobDownloads, error) {
+	day := q.opts.Clock.Now().UTC().Format("2006-01-02")
+	entries, err := q.client.ZRevRangeWithScores(ctx, q.topDownloadsKey(day), 0, n-1).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	top := make([]JobDownloads, 0, len(entries))
+	for _, e := range entries {
+		jobID, _ := e.Member.(string)
+		top = append(top, JobDownloads{JobID: jobID, Count: int64(e.Score)})
+	}
+	return top, nil
+}
@@ -0,0 +1,249 @@
+package queue
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb"
+	"github.com/aws/aws-sdk-go-v2/service/dynamodb/types"
+)
+
+// MetadataStore keeps the job records of a queue whose pending list can't
+// look jobs up by ID, such as SQSQueue. Records expire ttl after they're
+// written; a store that removes them late must not return them.
+type MetadataStore interface {
+	// GetJob returns the job's record, or nil if there is none
+	GetJob(ctx context.Context, jobID string) (*Job, error)
+	// PutJob writes the job's record
+	PutJob(ctx context.Context, job *Job, ttl time.Duration) error
+	// ListJobs returns a page of the jobs with a status, the longest
+	// unchanged first, and how many have it
+	ListJobs(ctx context.Context, status JobStatus, offset, limit int) ([]*Job, int, error)
+	// CountJobs returns how many jobs with a status were last updated
+	// after since, or how many have it at all if since is zero
+	CountJobs(ctx context.Context, status JobStatus, since time.Time) (int, error)
+	// RequestCancel flags the job for its worker to stop
+	RequestCancel(ctx context.Context, jobID string, ttl time.Duration) error
+	// CancelRequested reports whether the job was flagged to stop
+	CancelRequested(ctx context.Context, jobID string) (bool, error)
+	// DeleteJob removes the job's record and its cancellation flag
+	DeleteJob(ctx context.Context, jobID string) error
+}
+
+// DynamoStatusIndex is the global secondary index of the jobs table that
+// DynamoStore lists jobs by status through. It's keyed by status and
+// sorted by updated_at, and must project every attribute.
+const DynamoStatusIndex = "status-updated_at-index"
+
+// DynamoStore is a MetadataStore in a DynamoDB table keyed by the string
+// attribute id. Each job is an item holding its encoded record, its status,
+// when it was last updated in Unix milliseconds, and when it expires in
+// Unix seconds as expires_at, which the table's TTL should be set to.
+type DynamoStore struct {
+	client *dynamodb.Client
+	table  string
+	opts   Options
+}
+
+// NewDynamoStore creates a store of job records in table
+func NewDynamoStore(client *dynamodb.Client, table string, opts Options) *DynamoStore {
+	opts.setDefaults()
+	return &DynamoStore{client: client, table: table, opts: opts}
+}
+
+// dynamoCancelID returns the item ID of a job's cancellation flag, kept out
+// of the status index by having no status
+func dynamoCancelID(jobID string) string {
+	return "cancel:" + jobID
+}
+
+// expiresAt returns the expires_at of an item written now to last ttl
+func (s *DynamoStore) expiresAt(ttl time.Duration) types.AttributeValue {
+	return &types.AttributeValueMemberN{Value: strconv.FormatInt(s.opts.Clock.Now().Add(ttl).Unix(), 10)}
+}
+
+// live reports whether an item hasn't expired, which DynamoDB removes up
+// to days late
+func (s *DynamoStore) live(item map[string]types.AttributeValue) bool {
+	attr, ok := item["expires_at"].(*types.AttributeValueMemberN)
+	if !ok {
+		return true
+	}
+	expires, err := strconv.ParseInt(attr.Value, 10, 64)
+	return err != nil || s.opts.Clock.Now().Unix() < expires
+}
+
+// getItem reads an item by ID, or nil if it's missing or expired
+func (s *DynamoStore) getItem(ctx context.Context, id string) (map[string]types.AttributeValue, error) {
+	out, err := s.client.GetItem(ctx, &dynamodb.GetItemInput{
+		TableName:      aws.String(s.table),
+		Key:            map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: id}},
+		ConsistentRead: aws.Bool(true),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if out.Item == nil || !s.live(out.Item) {
+		return nil, nil
+	}
+	return out.Item, nil
+}
+
+// decode returns the job stored in an item
+func (s *DynamoStore) decode(item map[string]types.AttributeValue) (*Job, error) {
+	record, ok := item["record"].(*types.AttributeValueMemberB)
+	if !ok {
+		return nil, errUnknownRecordFormat
+	}
+	var job Job
+	if err := s.opts.Codec.Decode(record.Value, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// GetJob returns the job's record, or nil if there is none
+func (s *DynamoStore) GetJob(ctx context.Context, jobID string) (*Job, error) {
+	item, err := s.getItem(ctx, jobID)
+	if err != nil || item == nil {
+		return nil, err
+	}
+	return s.decode(item)
+}
+
+// PutJob writes the job's record, adding a change of status to its timeline
+func (s *DynamoStore) PutJob(ctx context.Context, job *Job, ttl time.Duration) error {
+	job.recordStatus(job.UpdatedAt)
+	record, err := s.opts.Codec.Encode(job)
+	if err != nil {
+		return err
+	}
+	_, err = s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item: map[string]types.AttributeValue{
+			"id":         &types.AttributeValueMemberS{Value: job.ID},
+			"record":     &types.AttributeValueMemberB{Value: record},
+			"status":     &types.AttributeValueMemberS{Value: string(job.Status)},
+			"updated_at": &types.AttributeValueMemberN{Value: strconv.FormatInt(job.UpdatedAt.UnixMilli(), 10)},
+			"expires_at": s.expiresAt(ttl),
+		},
+	})
+	return err
+}
+
+// ListJobs returns up to limit jobs with status from position offset, the
+// longest unchanged first, and how many jobs have the status. The status
+// index is eventually consistent, so a job updated a moment ago may still
+// be listed under its previous status. Counting reads the whole status.
+func (s *DynamoStore) ListJobs(ctx context.Context, status JobStatus, offset, limit int) ([]*Job, int, error) {
+	jobs := []*Job{}
+	skipped := 0
+	err := s.queryStatus(ctx, status, time.Time{}, types.SelectAllAttributes, func(out *dynamodb.QueryOutput) (bool, error) {
+		for _, item := range out.Items {
+			if skipped < offset {
+				skipped++
+				continue
+			}
+			job, err := s.decode(item)
+			if err != nil {
+				return false, err
+			}
+			jobs = append(jobs, job)
+			if len(jobs) == limit {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, 0, err
+	}
+
+	total, err := s.CountJobs(ctx, status, time.Time{})
+	if err != nil {
+		return nil, 0, err
+	}
+	return jobs, total, nil
+}
+
+// CountJobs returns how many unexpired jobs with status were last updated
+// after since, or how many have it at all if since is zero. It reads every
+// matching entry of the status index.
+func (s *DynamoStore) CountJobs(ctx context.Context, status JobStatus, since time.Time) (int, error) {
+	total := 0
+	err := s.queryStatus(ctx, status, since, types.SelectCount, func(out *dynamodb.QueryOutput) (bool, error) {
+		total += int(out.Count)
+		return true, nil
+	})
+	return total, err
+}
+
+// queryStatus queries the unexpired items with status through the status
+// index, oldest update first and only those updated after since unless it's
+// zero, passing each page to fn until it returns false
+func (s *DynamoStore) queryStatus(ctx context.Context, status JobStatus, since time.Time, sel types.Select, fn func(*dynamodb.QueryOutput) (bool, error)) error {
+	input := &dynamodb.QueryInput{
+		TableName:              aws.String(s.table),
+		IndexName:              aws.String(DynamoStatusIndex),
+		KeyConditionExpression: aws.String("#status = :status"),
+		FilterExpression:       aws.String("expires_at > :now"),
+		ExpressionAttributeNames: map[string]string{
+			"#status": "status",
+		},
+		ExpressionAttributeValues: map[string]types.AttributeValue{
+			":status": &types.AttributeValueMemberS{Value: string(status)},
+			":now":    &types.AttributeValueMemberN{Value: strconv.FormatInt(s.opts.Clock.Now().Unix(), 10)},
+		},
+		ScanIndexForward: aws.Bool(true),
+		Select:           sel,
+	}
+	if !since.IsZero() {
+		input.KeyConditionExpression = aws.String("#status = :status AND updated_at > :since")
+		input.ExpressionAttributeValues[":since"] = &types.AttributeValueMemberN{Value: strconv.FormatInt(since.UnixMilli(), 10)}
+	}
+	for {
+		out, err := s.client.Query(ctx, input)
+		if err != nil {
+			return err
+		}
+		more, err := fn(out)
+		if err != nil || !more || out.LastEvaluatedKey == nil {
+			return err
+		}
+		input.ExclusiveStartKey = out.LastEvaluatedKey
+	}
+}
+
+// RequestCancel flags the job for its worker to stop
+func (s *DynamoStore) RequestCancel(ctx context.Context, jobID string, ttl time.Duration) error {
+	_, err := s.client.PutItem(ctx, &dynamodb.PutItemInput{
+		TableName: aws.String(s.table),
+		Item: map[string]types.AttributeValue{
+			"id":         &types.AttributeValueMemberS{Value: dynamoCancelID(jobID)},
+			"expires_at": s.expiresAt(ttl),
+		},
+	})
+	return err
+}
+
+// CancelRequested reports whether the job was flagged to stop
+func (s *DynamoStore) CancelRequested(ctx context.Context, jobID string) (bool, error) {
+	item, err := s.getItem(ctx, dynamoCancelID(jobID))
+	return item != nil, err
+}
+
+// DeleteJob removes the job's record and its cancellation flag
+func (s *DynamoStore) DeleteJob(ctx context.Context, jobID string) error {
+	for _, id := range []string{jobID, dynamoCancelID(jobID)} {
+		_, err := s.client.DeleteItem(ctx, &dynamodb.DeleteItemInput{
+			TableName: aws.String(s.table),
+			Key:       map[string]types.AttributeValue{"id": &types.AttributeValueMemberS{Value: id}},
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,173 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"expvar"
+	"log"
+	"time"
+)
+
+// EventSchemaVersion is the version of the lifecycle event payload.
+// Bump it whenever a field is removed or changes meaning.
+const EventSchemaVersion = 1
+
+// DefaultEventsChannel is the Pub/Sub channel lifecycle events are published on
+const DefaultEventsChannel = "events:jobs"
+
+// Event types published on the lifecycle channel
+const (
+	EventSubmitted = "submitted"
+	EventScheduled = "scheduled"
+	EventRetrying  = "retrying"
+	EventStarted   = "started"
+	EventCompleted = "completed"
+	EventFailed    = "failed"
+	EventCancelled = "cancelled"
+	// EventTransferred is published when a job is given to another owner
+	EventTransferred = "transferred"
+)
+
+// eventBuffer is how many lifecycle events wait for the publisher before
+// new ones are dropped
+const eventBuffer = 1024
+
+var (
+	// eventPublishFailures counts lifecycle events that could not be published
+	eventPublishFailures = expvar.NewInt("queue_event_publish_failures")
+	// eventsDropped counts lifecycle events dropped because the publisher
+	// fell eventBuffer events behind
+	eventsDropped = expvar.NewInt("queue_events_dropped")
+	// negativeDurations counts durations clamped to zero because clocks disagreed
+	negativeDurations = expvar.NewInt("job_negative_durations")
+)
+
+// LifecycleEvent is the compact payload published for every job transition
+type LifecycleEvent struct {
+	Version int       `json:"v"`
+	Type    string    `json:"type"`
+	JobID   string    `json:"job_id"`
+	Status  JobStatus `json:"status"`
+	Owner   string    `json:"owner,omitempty"`
+	// Model is the model the job runs with, the selected one for auto jobs
+	// once selected
+	Model string `json:"model"`
+	// InputBytes is the upload's size, and OutputBytes the result's once
+	// the job completed
+	InputBytes  int64  `json:"input_bytes,omitempty"`
+	OutputBytes int64  `json:"output_bytes,omitempty"`
+	Error       string `json:"error,omitempty"`
+	ErrorCode   string `json:"error_code,omitempty"`
+	DurationMs  int64  `json:"duration_ms"`
+	// QueueWaitMs and ProcessingMs are set once the worker has measured them
+	QueueWaitMs  int64         `json:"queue_wait_ms,omitempty"`
+	ProcessingMs int64         `json:"processing_ms,omitempty"`
+	StageTimings []StageTiming `json:"stage_timings,omitempty"`
+	// Transfer is set on transferred events
+	Transfer  *Transfer `json:"transfer,omitempty"`
+	Timestamp time.Time `json:"ts"`
+}
+
+// eventType maps a job status to the lifecycle event it represents
+func eventType(status JobStatus) string {
+	switch status {
+	case StatusPending:
+		return EventSubmitted
+	case StatusScheduled:
+		return EventScheduled
+	case StatusRetrying:
+		return EventRetrying
+	case StatusProcessing:
+		return EventStarted
+	case StatusCompleted:
+		return EventCompleted
+	case StatusFailed:
+		return EventFailed
+	case StatusCancelled:
+		return EventCancelled
+	}
+	return string(status)
+}
+
+// newLifecycleEvent builds the event describing the job's current state
+func newLifecycleEvent(job *Job) LifecycleEvent {
+	// Prefer the worker's measurements over cross-machine wall clock arithmetic
+	duration := job.QueueWaitMs + job.ProcessingMs
+	if duration == 0 {
+		duration = clampDuration(job.UpdatedAt.Sub(job.CreatedAt).Milliseconds())
+	}
+
+	return LifecycleEvent{
+		Version:      EventSchemaVersion,
+		Type:         eventType(job.Status),
+		JobID:        job.ID,
+		Status:       job.Status,
+		Owner:        job.Owner,
+		Model:        outcomeModel(job),
+		InputBytes:   job.InputBytes,
+		OutputBytes:  job.OutputBytes,
+		Error:        job.Error,
+		ErrorCode:    job.ErrorCode,
+		DurationMs:   duration,
+		QueueWaitMs:  job.QueueWaitMs,
+		ProcessingMs: job.ProcessingMs,
+		StageTimings: job.StageTimings,
+		Timestamp:    job.UpdatedAt,
+	}
+}
+
+// publishEvent publishes a lifecycle event for the job if events are
+// enabled, and announces to its waiters if it finished. Publishing is
+// fire-and-forget: failures are logged and counted but never returned, so
+// the queue operation that triggered it is unaffected.
+func (q *RedisQueue) publishEvent(job *Job) {
+	q.publish(newLifecycleEvent(job))
+	q.notifyFinished(job)
+}
+
+// publishTransfer publishes a transferred event for the job's last transfer
+func (q *RedisQueue) publishTransfer(job *Job) {
+	event := newLifecycleEvent(job)
+	event.Type = EventTransferred
+	event.Transfer = &job.Transfers[len(job.Transfers)-1]
+	event.Timestamp = event.Transfer.At
+	q.publish(event)
+}
+
+// publish hands a lifecycle event to the publisher if events are enabled,
+// dropping it if the publisher is eventBuffer events behind
+func (q *RedisQueue) publish(event LifecycleEvent) {
+	if !q.opts.PublishEvents {
+		return
+	}
+
+	payload, err := json.Marshal(event)
+	if err != nil {
+		eventPublishFailures.Add(1)
+		return
+	}
+
+	select {
+	case q.events <- payload:
+	default:
+		eventsDropped.Add(1)
+	}
+}
+
+// runPublisher publishes the events handed to publish in order, one at a
+// time, until the queue is closed
+func (q *RedisQueue) runPublisher() {
+	for {
+		select {
+		case <-q.closed:
+			return
+		case payload := <-q.events:
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			if err := q.client.Publish(ctx, q.opts.EventsChannel, payload).Err(); err != nil {
+				eventPublishFailures.Add(1)
+				log.Printf("Failed to publish job event: %v", err)
+			}
+			cancel()
+		}
+	}
+}
@@ -0,0 +1,53 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestLifecycleEventsCarryOwnerModelAndSizes(t *testing.T) {
+	q, _ := newTestRedisQueue(t, Options{PublishEvents: true})
+	ctx := context.Background()
+	sub := q.client.Subscribe(ctx, q.opts.EventsChannel)
+	defer sub.Close()
+	if _, err := sub.Receive(ctx); err != nil {
+		t.Fatalf("Subscribe: %v", err)
+	}
+
+	job := &Job{ID: "job-1", Status: StatusPending, Owner: "alice", Model: "isnet-general-use", InputBytes: 2048}
+	if err := q.AddJob(ctx, job); err != nil {
+		t.Fatalf("AddJob: %v", err)
+	}
+	select {
+	case msg := <-sub.Channel():
+		var event LifecycleEvent
+		if err := json.Unmarshal([]byte(msg.Payload), &event); err != nil {
+			t.Fatalf("invalid event %q: %v", msg.Payload, err)
+		}
+		if event.Type != EventSubmitted || event.JobID != "job-1" || event.Owner != "alice" || event.Model != "isnet-general-use" || event.InputBytes != 2048 {
+			t.Fatalf("unexpected event %+v", event)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("no event published")
+	}
+}
+
+func TestPublishDropsEventsWhenBehind(t *testing.T) {
+	q, _ := newTestRedisQueue(t, Options{})
+	// Events enabled, with room for one and no publisher draining them
+	q.opts.PublishEvents = true
+	q.events = make(chan []byte, 1)
+
+	dropped := eventsDropped.Value()
+	for i := 0; i < 3; i++ {
+		q.publish(newLifecycleEvent(&Job{ID: "job-1", Status: StatusPending}))
+	}
+	if got := eventsDropped.Value() - dropped; got != 2 {
+		t.Fatalf("dropped %d events, want 2", got)
+	}
+	if len(q.events) != 1 {
+		t.Fatalf("%d events buffered, want 1", len(q.events))
+	}
+}
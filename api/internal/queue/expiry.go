@@ -0,0 +1,71 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// TombstoneTTL is how long a removed job's tombstone is kept, so reads can
+// tell an expired job from one that never existed
+const TombstoneTTL = 30 * 24 * time.Hour
+
+// ArchivedTombstoneTTL is how long the tombstone of a job archived to cold
+// storage is kept, so reads point to the archive for its compliance period
+const ArchivedTombstoneTTL = 90 * 24 * time.Hour
+
+// Tombstone is what's left of a job once its retention has ended
+type Tombstone struct {
+	ExpiredAt time.Time `json:"expired_at"`
+	// Archive is where the job was archived to cold storage, if it was
+	Archive string `json:"archive,omitempty"`
+}
+
+// tombstoneKey returns the Redis key left in place of an expired job
+func (k redisKeys) tombstoneKey(jobID string) string {
+	return k.prefix + "tombstone:" + jobID
+}
+
+// RetireJob is the last step of an expired job's teardown: it leaves a
+// tombstone, pointing to archive if the job was archived there, and deletes
+// the job record with its remaining per-job keys and schedule entries, all
+// in one transaction. Callers remove everything the record points to
+// first, so no step can leave a dangling reference.
+func (q *RedisQueue) RetireJob(ctx context.Context, job *Job, archive string) error {
+	data, err := json.Marshal(Tombstone{ExpiredAt: job.ExpiresAt(), Archive: archive})
+	if err != nil {
+		return err
+	}
+	ttl := TombstoneTTL
+	if archive != "" {
+		ttl = ArchivedTombstoneTTL
+	}
+	pipe := q.client.TxPipeline()
+	pipe.Set(ctx, q.tombstoneKey(job.ID), data, ttl)
+	pipe.ZRem(ctx, q.removalScheduleKey(RemovalResults), job.ID)
+	pipe.ZRem(ctx, q.removalScheduleKey(RemovalInputs), job.ID)
+	pipe.ZRem(ctx, q.lifetimeDeadlinesKey(), job.ID)
+	pipe.ZRem(ctx, q.scheduledJobsKey(), job.ID)
+	q.unindexStatus(ctx, pipe, job.ID)
+	pipe.Del(ctx, q.downloadLimitsKey(job.ID), q.pollCountKey(job.ID), q.recentJobKey(job.ID), q.jobKey(job.ID))
+	_, err = pipe.Exec(ctx)
+	return err
+}
+
+// Tombstone returns the tombstone of an expired job, or nil if there is none
+func (q *RedisQueue) Tombstone(ctx context.Context, jobID string) (*Tombstone, error) {
+	data, err := q.client.Get(ctx, q.tombstoneKey(jobID)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var tombstone Tombstone
+	if err := json.Unmarshal(data, &tombstone); err != nil {
+		return nil, err
+	}
+	return &tombstone, nil
+}
@@ -0,0 +1,337 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Scheduling is how jobs waiting at the same model and priority are
+// ordered for claiming
+type Scheduling string
+
+const (
+	// SchedulingFIFO claims every job of a pending list oldest first
+	SchedulingFIFO Scheduling = "fifo"
+	// SchedulingFair keeps a pending list per owner and claims from the
+	// owners with jobs waiting in turn, oldest first within each, so one
+	// owner's burst doesn't hold back everyone else's jobs
+	SchedulingFair Scheduling = "fair"
+)
+
+// fairStaleRetries bounds the times a claim reads the owner rotation again
+// after owners joined it while popFairScript was being called
+const fairStaleRetries = 3
+
+// ErrInvalidScheduling means Options.Scheduling can't be used, as with
+// PendingStreams, whose consumer group reads one stream per list
+var ErrInvalidScheduling = errors.New("invalid queue scheduling")
+
+// ParseScheduling validates a scheduling name, empty meaning FIFO
+func ParseScheduling(name string) (Scheduling, error) {
+	switch Scheduling(name) {
+	case "", SchedulingFIFO:
+		return SchedulingFIFO, nil
+	case SchedulingFair:
+		return SchedulingFair, nil
+	}
+	return "", fmt.Errorf("unknown scheduling %q, want %s or %s", name, SchedulingFIFO, SchedulingFair)
+}
+
+// checkScheduling returns ErrInvalidScheduling for a scheduling the
+// options can't be used with
+func checkScheduling(opts Options) error {
+	if _, err := ParseScheduling(string(opts.Scheduling)); err != nil {
+		return fmt.Errorf("%w: %v", ErrInvalidScheduling, err)
+	}
+	if opts.Scheduling == SchedulingFair && opts.PendingStreams {
+		return fmt.Errorf("%w: fair scheduling needs pending lists, not streams", ErrInvalidScheduling)
+	}
+	return nil
+}
+
+// fairPendingKey returns the list, with SchedulingFair, of an owner's jobs
+// that would wait in the pending list key. Jobs without an owner wait in
+// key itself.
+func fairPendingKey(key, owner string) string {
+	if owner == "" {
+		return key
+	}
+	return fairOwnerListPrefix(key) + owner
+}
+
+// fairOwnerListPrefix begins the owner lists of the pending list key
+func fairOwnerListPrefix(key string) string {
+	return key + ":owner:"
+}
+
+// fairOwnersKey returns the list of owners with jobs waiting in the
+// pending list key's owner lists, the owner claimed from next last
+func fairOwnersKey(key string) string {
+	return key + ":owners"
+}
+
+// fairNotifyKey returns the list holding a token for each job queued in the
+// pending list key's owner lists, which waiting claims block on with BLPOP,
+// as Redis can't block on a changing set of lists
+func fairNotifyKey(key string) string {
+	return key + ":notify"
+}
+
+// enqueueFairScript pushes job ARGV[1] onto owner ARGV[2]'s list at
+// KEYS[1], the owner into the rotation at KEYS[2] unless it's there, and a
+// token onto the notify list at KEYS[3]
+var enqueueFairScript = redis.NewScript(`
+redis.call("LPUSH", KEYS[1], ARGV[1])
+if not redis.call("LPOS", KEYS[2], ARGV[2]) then
+	redis.call("LPUSH", KEYS[2], ARGV[2])
+end
+redis.call("LPUSH", KEYS[3], 1)
+return 1
+`)
+
+// popFairScript moves the oldest job of the next owner in the rotation at
+// KEYS[1] that has one onto the processing list at KEYS[2], rotating the
+// owners as it goes and dropping those left without jobs. The list of owner
+// ARGV[i] is KEYS[4+i], and the jobless owner's is the pending list at
+// KEYS[3], which is drained last of jobs queued before fair scheduling too.
+// A claim takes a token off the notify list at KEYS[4], and finding no job
+// clears the tokens left by jobs removed otherwise. An owner in the rotation
+// but not in ARGV joined it since the caller read it; the rotation is put
+// back and 0 returned, for the caller to read it again.
+var popFairScript = redis.NewScript(`
+local lists = {[""] = KEYS[3]}
+for i, owner in ipairs(ARGV) do
+	lists[owner] = KEYS[4 + i]
+end
+for i = 1, redis.call("LLEN", KEYS[1]) do
+	local owner = redis.call("RPOPLPUSH", KEYS[1], KEYS[1])
+	local list = lists[owner]
+	if not list then
+		redis.call("LPOP", KEYS[1])
+		redis.call("RPUSH", KEYS[1], owner)
+		return 0
+	end
+	local jobID = redis.call("RPOPLPUSH", list, KEYS[2])
+	if redis.call("LLEN", list) == 0 then
+		redis.call("LREM", KEYS[1], 0, owner)
+	end
+	if jobID then
+		redis.call("RPOP", KEYS[4])
+		return jobID
+	end
+end
+local jobID = redis.call("RPOPLPUSH", KEYS[3], KEYS[2])
+if jobID then
+	redis.call("RPOP", KEYS[4])
+else
+	redis.call("DEL", KEYS[4])
+end
+return jobID
+`)
+
+// Scheduling returns how the queue orders the jobs waiting at the same
+// model and priority
+func (q *RedisQueue) Scheduling() Scheduling {
+	return q.opts.Scheduling
+}
+
+// pendingList returns the list the job waits in: its pending list, or with
+// SchedulingFair its owner's list of it
+func (q *RedisQueue) pendingList(job *Job) string {
+	if q.opts.Scheduling == SchedulingFair {
+		return fairPendingKey(q.jobPendingKey(job), job.Owner)
+	}
+	return q.jobPendingKey(job)
+}
+
+// enqueueFair is enqueue with SchedulingFair
+func (q *RedisQueue) enqueueFair(ctx context.Context, c redis.Cmdable, job *Job) redis.Cmder {
+	key := q.jobPendingKey(job)
+	// Eval rather than Run, since c may be a pipeline that can't fall back
+	// on NOSCRIPT
+	return enqueueFairScript.Eval(ctx, c, []string{fairPendingKey(key, job.Owner), fairOwnersKey(key), fairNotifyKey(key)}, job.ID, job.Owner)
+}
+
+// popFair is popPending with SchedulingFair: the oldest job ID of the next
+// owner in turn with jobs in the pending list key, waiting up to block on
+// the key's notify list for one to be queued
+func (q *RedisQueue) popFair(ctx context.Context, workerID, key string, block time.Duration) (string, error) {
+	deadline := time.Now().Add(block)
+	for {
+		jobID, err := q.popFairOnce(ctx, workerID, key)
+		if err != nil || jobID != "" {
+			return jobID, err
+		}
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return "", nil
+		}
+		if wait%time.Second == 0 {
+			err = q.client.BLPop(ctx, wait, fairNotifyKey(key)).Err()
+		} else {
+			// go-redis rounds waits up to whole seconds, as bRPopLPush explains
+			err = q.client.Do(ctx, "blpop", fairNotifyKey(key), blockSeconds(wait)).Err()
+		}
+		if err != nil && err != redis.Nil {
+			return "", err
+		}
+	}
+}
+
+// popFairOnce runs popFairScript on the owner rotation of the pending list
+// key as just read, reading it again if owners joined it in between, and
+// returns "" if no job was waiting
+func (q *RedisQueue) popFairOnce(ctx context.Context, workerID, key string) (string, error) {
+	for i := 0; i < fairStaleRetries; i++ {
+		owners, err := q.client.LRange(ctx, fairOwnersKey(key), 0, -1).Result()
+		if err != nil {
+			return "", err
+		}
+		keys := []string{fairOwnersKey(key), q.processingKey(workerID), key, fairNotifyKey(key)}
+		args := make([]interface{}, 0, len(owners))
+		for _, owner := range owners {
+			if owner != "" {
+				keys = append(keys, fairPendingKey(key, owner))
+				args = append(args, owner)
+			}
+		}
+		reply, err := popFairScript.Run(ctx, q.client, keys, args...).Result()
+		if err == redis.Nil {
+			return "", nil
+		}
+		if err != nil {
+			return "", err
+		}
+		if jobID, ok := reply.(string); ok {
+			return jobID, nil
+		}
+	}
+	return "", nil
+}
+
+// pendingLists returns, for each of the pending lists keys, the lists its
+// jobs wait in: the list itself, or with SchedulingFair the lists of the
+// owners in its rotation, the owner claimed from next first, and the list
+// itself last unless it's among them
+func (q *RedisQueue) pendingLists(ctx context.Context, keys []string) ([][]string, error) {
+	lists := make([][]string, len(keys))
+	if q.opts.Scheduling != SchedulingFair {
+		for i, key := range keys {
+			lists[i] = []string{key}
+		}
+		return lists, nil
+	}
+	pipe := q.client.Pipeline()
+	owners := make([]*redis.StringSliceCmd, len(keys))
+	for i, key := range keys {
+		owners[i] = pipe.LRange(ctx, fairOwnersKey(key), 0, -1)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+	for i, key := range keys {
+		unowned := false
+		names := owners[i].Val()
+		// The rotation is taken from its right
+		for j := len(names) - 1; j >= 0; j-- {
+			lists[i] = append(lists[i], fairPendingKey(key, names[j]))
+			unowned = unowned || names[j] == ""
+		}
+		if !unowned {
+			lists[i] = append(lists[i], key)
+		}
+	}
+	return lists, nil
+}
+
+// nextFairIDs is nextPendingIDs with SchedulingFair: up to n job IDs of
+// the pending list key's owner lists, in the turns they'd be claimed in
+func (q *RedisQueue) nextFairIDs(ctx context.Context, key string, n int64) ([]string, error) {
+	lists, err := q.pendingLists(ctx, []string{key})
+	if err != nil {
+		return nil, err
+	}
+	pipe := q.client.Pipeline()
+	tails := make([]*redis.StringSliceCmd, len(lists[0]))
+	for i, list := range lists[0] {
+		tails[i] = pipe.LRange(ctx, list, -n, -1)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	// Each list is popped from the right, one job a turn
+	var ids []string
+	for turn := 1; int64(len(ids)) < n; turn++ {
+		took := false
+		for _, tail := range tails {
+			if jobs := tail.Val(); turn <= len(jobs) && int64(len(ids)) < n {
+				ids = append(ids, jobs[len(jobs)-turn])
+				took = true
+			}
+		}
+		if !took {
+			break
+		}
+	}
+	return ids, nil
+}
+
+// fairPosition is QueuePosition with SchedulingFair: the jobs waiting at
+// higher priorities, those ahead of the job in its owner's list, and for
+// every other owner as many as get a turn before it, assuming each owner
+// keeps its place in the rotation
+func (q *RedisQueue) fairPosition(ctx context.Context, job *Job) (int64, error) {
+	key := q.jobPendingKey(job)
+	var keys []string
+	for _, k := range q.pendingKeys(job.Model) {
+		keys = append(keys, k)
+		if k == key {
+			break
+		}
+	}
+	lists, err := q.pendingLists(ctx, keys)
+	if err != nil {
+		return 0, err
+	}
+
+	own := q.pendingList(job)
+	pipe := q.client.Pipeline()
+	lengths := make([][]*redis.IntCmd, len(keys))
+	for i := range keys {
+		for _, list := range lists[i] {
+			lengths[i] = append(lengths[i], pipe.LLen(ctx, list))
+		}
+	}
+	ownLength := pipe.LLen(ctx, own)
+	// Jobs are pushed on the left and popped from the right
+	index := pipe.LPos(ctx, own, job.ID, redis.LPosArgs{Rank: -1})
+	if _, err := pipe.Exec(ctx); err != nil {
+		if err == redis.Nil {
+			return -1, nil
+		}
+		return 0, err
+	}
+
+	ahead := ownLength.Val() - 1 - index.Val()
+	position := ahead
+	for i := range keys {
+		for j, n := range lengths[i] {
+			switch {
+			case i < len(keys)-1:
+				position += n.Val()
+			case lists[i][j] != own:
+				if n.Val() < ahead {
+					position += n.Val()
+				} else {
+					position += ahead
+				}
+			}
+		}
+	}
+	return position, nil
+}
@@ -0,0 +1,103 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestPopFairTakesOwnersInTurn(t *testing.T) {
+	q, _ := newTestRedisQueue(t, Options{Scheduling: SchedulingFair})
+	ctx := context.Background()
+	for _, job := range []*Job{
+		{ID: "a-1", Owner: "a"},
+		{ID: "a-2", Owner: "a"},
+		{ID: "a-3", Owner: "a"},
+		{ID: "b-1", Owner: "b"},
+		{ID: "unowned"},
+	} {
+		if err := q.AddJob(ctx, job); err != nil {
+			t.Fatalf("AddJob: %v", err)
+		}
+	}
+
+	key := q.pendingKey(ModelDefault, PriorityNormal)
+	var got []string
+	for {
+		jobID, err := q.popFair(ctx, "worker-1", key, 0)
+		if err != nil {
+			t.Fatalf("popFair: %v", err)
+		}
+		if jobID == "" {
+			break
+		}
+		got = append(got, jobID)
+	}
+	want := []string{"a-1", "b-1", "unowned", "a-2", "a-3"}
+	if len(got) != len(want) {
+		t.Fatalf("popFair took %v, want %v", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("popFair took %v, want %v", got, want)
+		}
+	}
+	if n, err := q.client.LLen(ctx, fairNotifyKey(key)).Result(); err != nil || n != 0 {
+		t.Fatalf("notify tokens left on a drained queue: %d, %v", n, err)
+	}
+}
+
+func TestPopFairWakesOnEnqueue(t *testing.T) {
+	q, _ := newTestRedisQueue(t, Options{Scheduling: SchedulingFair})
+	ctx := context.Background()
+	key := q.pendingKey(ModelDefault, PriorityNormal)
+
+	claimed := make(chan string, 1)
+	started := time.Now()
+	go func() {
+		jobID, err := q.popFair(ctx, "worker-1", key, 10*time.Second)
+		if err != nil {
+			t.Errorf("popFair: %v", err)
+		}
+		claimed <- jobID
+	}()
+	time.Sleep(50 * time.Millisecond)
+	if err := q.AddJob(ctx, &Job{ID: "job-1", Owner: "a"}); err != nil {
+		t.Fatalf("AddJob: %v", err)
+	}
+
+	select {
+	case jobID := <-claimed:
+		if jobID != "job-1" {
+			t.Fatalf("popFair = %q, want job-1", jobID)
+		}
+		if waited := time.Since(started); waited > 5*time.Second {
+			t.Fatalf("popFair took %v to see the job", waited)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("popFair still waiting after a job was queued")
+	}
+}
+
+func TestPopFairRereadsAChangedRotation(t *testing.T) {
+	q, _ := newTestRedisQueue(t, Options{Scheduling: SchedulingFair})
+	ctx := context.Background()
+	if err := q.AddJob(ctx, &Job{ID: "a-1", Owner: "a"}); err != nil {
+		t.Fatalf("AddJob: %v", err)
+	}
+	key := q.pendingKey(ModelDefault, PriorityNormal)
+
+	// Called with a rotation read before owner a joined it
+	reply, err := popFairScript.Run(ctx, q.client, []string{fairOwnersKey(key), q.processingKey("worker-1"), key, fairNotifyKey(key)}).Result()
+	if err != nil || reply != int64(0) {
+		t.Fatalf("popFairScript on a stale rotation = %v, %v, want 0", reply, err)
+	}
+	if owners, err := q.client.LRange(ctx, fairOwnersKey(key), 0, -1).Result(); err != nil || len(owners) != 1 || owners[0] != "a" {
+		t.Fatalf("rotation after a stale call = %v, %v, want it unchanged", owners, err)
+	}
+
+	jobID, err := q.popFair(ctx, "worker-1", key, 0)
+	if err != nil || jobID != "a-1" {
+		t.Fatalf("popFair = %q, %v, want a-1", jobID, err)
+	}
+}
@@ -0,0 +1,187 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// fanoutTTL matches the lifetime of the jobs a fanout groups
+const fanoutTTL = 24 * time.Hour
+
+// Fanout groups the jobs created from one upload processed with several option sets
+type Fanout struct {
+	ID        string    `json:"id"`
+	InputPath string    `json:"input_path"`
+	JobIDs    []string  `json:"job_ids"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// fanoutKey returns the Redis key of a fanout record
+func (k redisKeys) fanoutKey(id string) string {
+	return k.prefix + "fanout:" + id
+}
+
+// inputRefsKey returns the Redis key counting the jobs referencing a shared input
+func (k redisKeys) inputRefsKey(inputPath string) string {
+	return k.prefix + "input_refs:" + inputPath
+}
+
+// inputJobsKey returns the Redis set of the jobs referencing a shared input,
+// which lets reconciliation find references held by purged jobs
+func (k redisKeys) inputJobsKey(inputPath string) string {
+	return k.prefix + "input_jobs:" + inputPath
+}
+
+// retainInputScript adds each job in ARGV as a reference to the input,
+// counting only jobs not already referencing it
+var retainInputScript = redis.NewScript(`
+for i = 1, #ARGV do
+	if redis.call("SADD", KEYS[2], ARGV[i]) == 1 then
+		redis.call("INCR", KEYS[1])
+	end
+end
+return tonumber(redis.call("GET", KEYS[1]) or "0")
+`)
+
+// releaseInputScript drops job ARGV[1]'s reference to the input exactly
+// once. Returns the remaining count, or -1 if the job held no reference.
+var releaseInputScript = redis.NewScript(`
+if redis.call("SREM", KEYS[2], ARGV[1]) == 0 then
+	return -1
+end
+local remaining = redis.call("DECR", KEYS[1])
+if remaining <= 0 then
+	redis.call("DEL", KEYS[1], KEYS[2])
+	return 0
+end
+return remaining
+`)
+
+// resyncInputScript resets the count to the number of referencing jobs,
+// repairing counts leaked by crashes. Returns the count.
+var resyncInputScript = redis.NewScript(`
+local n = redis.call("SCARD", KEYS[2])
+if n == 0 then
+	redis.call("DEL", KEYS[1], KEYS[2])
+	return 0
+end
+redis.call("SET", KEYS[1], n)
+return n
+`)
+
+// RetainInput records jobIDs as references to a shared input file
+func (q *RedisQueue) RetainInput(ctx context.Context, inputPath string, jobIDs []string) error {
+	args := make([]interface{}, len(jobIDs))
+	for i, id := range jobIDs {
+		args[i] = id
+	}
+	return retainInputScript.Run(ctx, q.client, []string{q.inputRefsKey(inputPath), q.inputJobsKey(inputPath)}, args...).Err()
+}
+
+// ReleaseInput drops a job's reference to a shared input. It returns the
+// references left; at zero the caller owns removing the file. Releasing
+// the same job twice is a no-op that returns -1.
+func (q *RedisQueue) ReleaseInput(ctx context.Context, inputPath, jobID string) (int64, error) {
+	return releaseInputScript.Run(ctx, q.client, []string{q.inputRefsKey(inputPath), q.inputJobsKey(inputPath)}, jobID).Int64()
+}
+
+// AddFanout stores a fanout record
+func (q *RedisQueue) AddFanout(ctx context.Context, fanout *Fanout) error {
+	fanout.CreatedAt = q.opts.Clock.Now()
+	data, err := json.Marshal(fanout)
+	if err != nil {
+		return err
+	}
+	return q.client.Set(ctx, q.fanoutKey(fanout.ID), data, fanoutTTL).Err()
+}
+
+// GetFanout retrieves a fanout record, or nil if it doesn't exist
+func (q *RedisQueue) GetFanout(ctx context.Context, id string) (*Fanout, error) {
+	data, err := q.client.Get(ctx, q.fanoutKey(id)).Bytes()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var fanout Fanout
+	if err := json.Unmarshal(data, &fanout); err != nil {
+		return nil, err
+	}
+	return &fanout, nil
+}
+
+// InputReferenced reports whether any job still references a shared input
+func (q *RedisQueue) InputReferenced(ctx context.Context, inputPath string) (bool, error) {
+	n, err := q.client.Exists(ctx, q.inputJobsKey(inputPath)).Result()
+	return n > 0, err
+}
+
+// ReconcileInputs releases the references of jobs that no longer exist
+// and repairs leaked counts. It returns the inputs no job references any
+// more, whose files the caller should remove.
+func (q *RedisQueue) ReconcileInputs(ctx context.Context) ([]string, error) {
+	var freed []string
+	prefix := strings.TrimSuffix(q.inputJobsKey("*"), "*")
+
+	keyspace, err := q.keyspace(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	var cursor uint64
+	for {
+		keys, next, err := keyspace.Scan(ctx, cursor, q.inputJobsKey("*"), keyUsageScanCount).Result()
+		if err != nil {
+			return freed, err
+		}
+
+		for _, key := range keys {
+			inputPath := strings.TrimPrefix(key, prefix)
+			remaining, err := q.reconcileInput(ctx, inputPath)
+			if err != nil {
+				return freed, err
+			}
+			if remaining == 0 {
+				freed = append(freed, inputPath)
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			return freed, nil
+		}
+	}
+}
+
+// reconcileInput releases one input's references held by purged jobs and
+// returns the references left
+func (q *RedisQueue) reconcileInput(ctx context.Context, inputPath string) (int64, error) {
+	jobIDs, err := q.client.SMembers(ctx, q.inputJobsKey(inputPath)).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	pipe := q.client.Pipeline()
+	exists := make([]*redis.IntCmd, len(jobIDs))
+	for i, id := range jobIDs {
+		exists[i] = pipe.Exists(ctx, q.jobKey(id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+
+	for i, id := range jobIDs {
+		if exists[i].Val() == 0 {
+			if _, err := q.ReleaseInput(ctx, inputPath, id); err != nil {
+				return 0, err
+			}
+		}
+	}
+	return resyncInputScript.Run(ctx, q.client, []string{q.inputRefsKey(inputPath), q.inputJobsKey(inputPath)}).Int64()
+}
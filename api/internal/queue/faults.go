@@ -0,0 +1,45 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+
+	"rembg-v2/api/internal/fault"
+)
+
+// faultRulesKey returns the Redis hash of fault injection rules keyed by
+// point, shared by every API replica and worker
+func (k redisKeys) faultRulesKey() string {
+	return k.prefix + "fault_rules"
+}
+
+// SetFaultRule stores the rule for its point, replacing any previous one
+func (q *RedisQueue) SetFaultRule(ctx context.Context, rule fault.Rule) error {
+	data, err := json.Marshal(rule)
+	if err != nil {
+		return err
+	}
+	return q.client.HSet(ctx, q.faultRulesKey(), rule.Point, data).Err()
+}
+
+// ClearFaultRule removes the rule for a point
+func (q *RedisQueue) ClearFaultRule(ctx context.Context, point string) error {
+	return q.client.HDel(ctx, q.faultRulesKey(), point).Err()
+}
+
+// FaultRules returns the stored rules, skipping any that don't parse
+func (q *RedisQueue) FaultRules(ctx context.Context) ([]fault.Rule, error) {
+	entries, err := q.client.HGetAll(ctx, q.faultRulesKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	rules := make([]fault.Rule, 0, len(entries))
+	for _, value := range entries {
+		var rule fault.Rule
+		if err := json.Unmarshal([]byte(value), &rule); err == nil {
+			rules = append(rules, rule)
+		}
+	}
+	return rules, nil
+}
@@ -0,0 +1,51 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+)
+
+// ErrFenced means a write was made under a claim token that's no longer the
+// job's, as by a worker whose job was given to another while it was cut off
+var ErrFenced = errors.New("job is claimed under another token")
+
+// claimsJob reports whether a transition is a worker claiming a job, the only
+// write that may give it a new claim token
+func claimsJob(from, to JobStatus) bool {
+	return from == StatusPending && to == StatusProcessing
+}
+
+// fenced returns ErrFenced for a write of job under token over a stored job
+// claimed under another
+func fenced(jobID, token, stored string) error {
+	if token == stored {
+		return nil
+	}
+	return fmt.Errorf("%w: job %s was written under %q, not %q", ErrFenced, jobID, token, stored)
+}
+
+// StartJob marks a pending job processing by workerID, counting the attempt
+// and giving it a new claim token, as the worker does once it has claimed
+// the job. Later writes carrying an older token, as a worker whose job was
+// requeued and claimed again while it was cut off makes, fail with
+// ErrFenced. It returns the job as written.
+func (q *RedisQueue) StartJob(ctx context.Context, jobID, workerID string) (*Job, error) {
+	token, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+	var started *Job
+	err = q.TransitionJob(ctx, jobID, StatusPending, StatusProcessing, func(job *Job) {
+		now := q.opts.Clock.Now()
+		job.Attempts++
+		job.AttemptStartedAt = &now
+		job.WorkerID = workerID
+		job.ClaimToken = token
+		started = job
+	})
+	if err != nil {
+		return nil, err
+	}
+	return started, nil
+}
@@ -0,0 +1,102 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExpiredLockHolderCannotReleaseItsSuccessor(t *testing.T) {
+	q, server := newTestRedisQueue(t, Options{})
+	ctx := context.Background()
+
+	first, err := q.TryLock(ctx, "sweep", time.Second)
+	if err != nil || first == nil {
+		t.Fatalf("first TryLock = %v, %v", first, err)
+	}
+	if other, err := q.TryLock(ctx, "sweep", time.Second); err != nil || other != nil {
+		t.Fatalf("TryLock while held = %v, %v, want nil", other, err)
+	}
+
+	// The first holder stalls past the lock's TTL and a second takes it
+	server.FastForward(2 * time.Second)
+	second, err := q.TryLock(ctx, "sweep", time.Second)
+	if err != nil || second == nil {
+		t.Fatalf("TryLock after expiry = %v, %v", second, err)
+	}
+
+	// Resuming, the first holder's release leaves the second's lock held
+	if err := first.Release(ctx); err != nil {
+		t.Fatalf("stale Release: %v", err)
+	}
+	if held, _ := server.Get(q.lockKey("sweep")); held != second.token {
+		t.Fatalf("lock after the stale release is held by %q, want the second holder", held)
+	}
+	if other, err := q.TryLock(ctx, "sweep", time.Second); err != nil || other != nil {
+		t.Fatalf("TryLock after the stale release = %v, %v, want nil", other, err)
+	}
+	if err := second.Release(ctx); err != nil {
+		t.Fatalf("Release: %v", err)
+	}
+	if server.Exists(q.lockKey("sweep")) {
+		t.Fatalf("lock still held after its holder released it")
+	}
+}
+
+func TestFencedWriteRejectsStaleHolderInRace(t *testing.T) {
+	q, _ := newTestRedisQueue(t, Options{})
+	ctx := context.Background()
+
+	for round := 0; round < 20; round++ {
+		jobID := fmt.Sprintf("job-%d", round)
+		if err := q.AddJob(ctx, &Job{ID: jobID}); err != nil {
+			t.Fatalf("AddJob: %v", err)
+		}
+
+		// The first holder starts the job, is cut off long enough to have
+		// it requeued, and a second holder starts it again
+		stale, err := q.StartJob(ctx, jobID, "worker-1")
+		if err != nil {
+			t.Fatalf("StartJob: %v", err)
+		}
+		if err := q.TransitionJob(ctx, jobID, StatusProcessing, StatusPending, nil); err != nil {
+			t.Fatalf("requeue: %v", err)
+		}
+		fresh, err := q.StartJob(ctx, jobID, "worker-2")
+		if err != nil {
+			t.Fatalf("StartJob again: %v", err)
+		}
+
+		// Both believe they hold the job and finish it at once
+		holders := []*Job{stale, fresh}
+		errs := make([]error, len(holders))
+		var wg sync.WaitGroup
+		for i, holder := range holders {
+			wg.Add(1)
+			go func(i int, holder *Job) {
+				defer wg.Done()
+				errs[i] = q.TransitionJob(ctx, jobID, StatusProcessing, StatusCompleted, func(job *Job) {
+					job.ClaimToken = holder.ClaimToken
+					job.OutputPath = holder.WorkerID + ".png"
+				})
+			}(i, holder)
+		}
+		wg.Wait()
+
+		// The stale holder loses whichever writes first: fenced if it's
+		// first, or finding the job already finished if it's second
+		if errs[1] != nil {
+			t.Fatalf("round %d: current holder failed: %v", round, errs[1])
+		}
+		if !errors.Is(errs[0], ErrFenced) && !errors.Is(errs[0], ErrInvalidTransition) {
+			t.Fatalf("round %d: stale holder's write = %v, want ErrFenced or ErrInvalidTransition", round, errs[0])
+		}
+		job, err := q.GetJob(ctx, jobID)
+		if err != nil || job.OutputPath != "worker-2.png" {
+			t.Fatalf("round %d: stored job = %+v, %v, want worker-2's output", round, job, err)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package queue
+
+import (
+	"context"
+	"path/filepath"
+	"strings"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Image formats, named as Go's image package names them when sniffing
+const (
+	FormatPNG  = "png"
+	FormatJPEG = "jpeg"
+	FormatGIF  = "gif"
+	FormatWebP = "webp"
+)
+
+// imageFormat is how files of one format are stored and served
+type imageFormat struct {
+	ext       string
+	mediaType string
+}
+
+// imageFormats are the formats inputs and results are stored in
+var imageFormats = map[string]imageFormat{
+	FormatPNG:  {ext: ".png", mediaType: "image/png"},
+	FormatJPEG: {ext: ".jpg", mediaType: "image/jpeg"},
+	FormatGIF:  {ext: ".gif", mediaType: "image/gif"},
+	FormatWebP: {ext: ".webp", mediaType: "image/webp"},
+}
+
+// FormatExt returns the extension files of format are stored under, or ""
+// if the format is unknown
+func FormatExt(format string) string {
+	return imageFormats[format].ext
+}
+
+// FormatMediaType returns the media type files of format are served as, or
+// "" if the format is unknown
+func FormatMediaType(format string) string {
+	return imageFormats[format].mediaType
+}
+
+// FormatOfExt returns the format a file extension stands for, or "" if none
+func FormatOfExt(ext string) string {
+	ext = strings.ToLower(ext)
+	if ext == ".jpeg" {
+		return FormatJPEG
+	}
+	for format, f := range imageFormats {
+		if f.ext == ext {
+			return format
+		}
+	}
+	return ""
+}
+
+// ResultFormat returns the format of the job's result. It's the format the
+// worker reported, and only for results written before workers reported it
+// the one the stored file's extension stands for. Every name, header, and
+// archive entry describing the result derives from it.
+func (j *Job) ResultFormat() string {
+	if j.OutputFormat != "" {
+		return j.OutputFormat
+	}
+	return FormatOfExt(filepath.Ext(j.OutputPath))
+}
+
+// ScanJobs calls fn with every stored job until fn returns false, within a
+// bounded number of SCAN calls. It reports whether every job was seen.
+func (q *RedisQueue) ScanJobs(ctx context.Context, fn func(job *Job) bool) (bool, error) {
+	return q.scanJobs(ctx, fn)
+}
+
+// RepairJobFiles records the sniffed formats and moved file paths of a job
+// read with the given paths. It leaves UpdatedAt and the TTL alone and
+// publishes no event, as the job itself hasn't changed. It reports false,
+// writing nothing, if the job has gone or its paths changed since it was read.
+func (q *RedisQueue) RepairJobFiles(ctx context.Context, repaired *Job, inputPath, outputPath string) (bool, error) {
+	key := q.jobKey(repaired.ID)
+	written := false
+	err := q.client.Watch(ctx, func(tx *redis.Tx) error {
+		data, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var job Job
+		if err := q.opts.Codec.Decode(data, &job); err != nil {
+			return err
+		}
+		if job.InputPath != inputPath || job.OutputPath != outputPath {
+			return nil
+		}
+
+		job.InputPath, job.InputFormat = repaired.InputPath, repaired.InputFormat
+		job.OutputPath, job.OutputFormat = repaired.OutputPath, repaired.OutputFormat
+		job.Version++
+		encoded, err := q.opts.Codec.Encode(&job)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, encoded, redis.KeepTTL)
+			return nil
+		})
+		written = err == nil
+		return err
+	}, key)
+	if err == redis.TxFailedErr {
+		return false, nil
+	}
+	return written, err
+}
@@ -0,0 +1,73 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+
+	"rembg-v2/api/internal/fault"
+)
+
+// healthProbeTTL bounds how long a health check's probe key outlives a
+// check cut off before removing it
+const healthProbeTTL = 30 * time.Second
+
+// healthProbeKey returns the key one health check writes and reads back
+func (k redisKeys) healthProbeKey(token string) string {
+	return k.prefix + "health_probe:" + token
+}
+
+// HealthCheck checks that Redis answers and takes writes: it pings, then
+// writes a probe key of its own and reads it back, so a replica that only
+// serves reads, or a full instance refusing writes, fails too
+func (q *RedisQueue) HealthCheck(ctx context.Context) error {
+	if err := fault.Maybe(ctx, fault.Redis); err != nil {
+		return err
+	}
+	if err := q.client.Ping(ctx).Err(); err != nil {
+		return err
+	}
+
+	token, err := generateToken()
+	if err != nil {
+		return err
+	}
+	key := q.healthProbeKey(token)
+	if err := q.client.Set(ctx, key, token, healthProbeTTL).Err(); err != nil {
+		return err
+	}
+	got, err := q.client.Get(ctx, key).Result()
+	if err != nil {
+		return err
+	}
+	if got != token {
+		return fmt.Errorf("health probe read back %q, not %q", got, token)
+	}
+	return q.client.Del(ctx, key).Err()
+}
+
+// HealthCheck always succeeds: the queue lives in the API's own memory
+func (q *MemoryQueue) HealthCheck(ctx context.Context) error {
+	return nil
+}
+
+// HealthCheck checks that the SQS queue and the record store answer
+func (q *SQSQueue) HealthCheck(ctx context.Context) error {
+	_, err := q.client.GetQueueAttributes(ctx, &sqs.GetQueueAttributesInput{
+		QueueUrl: aws.String(q.cfg.QueueURL),
+	})
+	if err != nil {
+		return err
+	}
+	// No job has the ID, so the store answers without reading a record
+	_, err = q.cfg.Store.GetJob(ctx, "health_probe")
+	return err
+}
+
+// HealthCheck checks that the connection to NATS is up and answers
+func (q *NATSQueue) HealthCheck(ctx context.Context) error {
+	return q.Ping(ctx)
+}
@@ -0,0 +1,76 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// HeartbeatTTL is how long a worker counts as alive after its last heartbeat
+const HeartbeatTTL = 30 * time.Second
+
+// WorkerHeartbeat is the latest liveness report of one worker
+type WorkerHeartbeat struct {
+	WorkerID string    `json:"worker_id"`
+	Model    string    `json:"model"`
+	Models   []string  `json:"models,omitempty"`
+	At       time.Time `json:"ts"`
+}
+
+// LoadedModels returns the models the worker has loaded
+func (hb WorkerHeartbeat) LoadedModels() []string {
+	if len(hb.Models) > 0 {
+		return hb.Models
+	}
+	return []string{hb.Model}
+}
+
+// HasAllModels reports whether the worker can process every model, which
+// is required to claim auto jobs
+func (hb WorkerHeartbeat) HasAllModels() bool {
+	loaded := make(map[string]bool)
+	for _, m := range hb.LoadedModels() {
+		loaded[m] = true
+	}
+	for _, m := range Models {
+		if !loaded[m] {
+			return false
+		}
+	}
+	return true
+}
+
+// heartbeatsKey returns the Redis hash of worker heartbeats, keyed by worker ID
+func (k redisKeys) heartbeatsKey() string {
+	return k.prefix + "worker_heartbeats"
+}
+
+// WorkerHeartbeats returns the workers that reported within HeartbeatTTL,
+// sorted by worker ID. Heartbeats of dead workers are removed.
+func (q *RedisQueue) WorkerHeartbeats(ctx context.Context) ([]WorkerHeartbeat, error) {
+	entries, err := q.client.HGetAll(ctx, q.heartbeatsKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	now := q.opts.Clock.Now()
+	var alive []WorkerHeartbeat
+	var dead []string
+	for id, value := range entries {
+		var hb WorkerHeartbeat
+		if err := json.Unmarshal([]byte(value), &hb); err != nil || now.Sub(hb.At) > HeartbeatTTL {
+			dead = append(dead, id)
+			continue
+		}
+		hb.WorkerID = id
+		alive = append(alive, hb)
+	}
+
+	if len(dead) > 0 {
+		q.client.HDel(ctx, q.heartbeatsKey(), dead...)
+	}
+
+	sort.Slice(alive, func(i, j int) bool { return alive[i].WorkerID < alive[j].WorkerID })
+	return alive, nil
+}
@@ -0,0 +1,132 @@
+package queue
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// defaultHistoryTTL is how long a finished job's summary is kept
+const defaultHistoryTTL = 30 * 24 * time.Hour
+
+// finishedJobsKey returns the sorted set of the IDs of completed and failed
+// jobs, scored by when they finished in Unix milliseconds
+func (k redisKeys) finishedJobsKey() string {
+	return k.prefix + "completed_jobs"
+}
+
+// jobSummaryKey returns the hash summarising a finished job, kept for
+// HistoryTTL after its record has expired
+func (k redisKeys) jobSummaryKey(jobID string) string {
+	return k.prefix + "job_summary:" + jobID
+}
+
+// JobSummary is what the history keeps of a finished job
+type JobSummary struct {
+	JobID           string    `json:"job_id"`
+	Status          JobStatus `json:"status"`
+	Owner           string    `json:"owner,omitempty"`
+	Model           string    `json:"model,omitempty"`
+	ErrorCode       string    `json:"error_code,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+	FinishedAt      time.Time `json:"finished_at"`
+	QueueWaitMs     int64     `json:"queue_wait_ms,omitempty"`
+	ProcessingMs    int64     `json:"processing_ms,omitempty"`
+	InputBytes      int64     `json:"input_bytes,omitempty"`
+	MilliMegapixels int64     `json:"milli_megapixels,omitempty"`
+	Attempts        int       `json:"attempts,omitempty"`
+}
+
+// finished reports whether a job's status belongs in the history
+func finished(status JobStatus) bool {
+	return status == StatusCompleted || status == StatusFailed
+}
+
+// recordHistory adds a job that just completed or failed to the history, as
+// part of the write of its record. Jobs with any other status are skipped.
+func (q *RedisQueue) recordHistory(ctx context.Context, pipe redis.Pipeliner, job *Job) {
+	if !finished(job.Status) {
+		return
+	}
+	key := q.jobSummaryKey(job.ID)
+	pipe.HSet(ctx, key,
+		"status", string(job.Status),
+		"owner", job.Owner,
+		"model", job.Model,
+		"error_code", job.ErrorCode,
+		"created_at", job.CreatedAt.UnixMilli(),
+		"queue_wait_ms", job.QueueWaitMs,
+		"processing_ms", job.ProcessingMs,
+		"input_bytes", job.InputBytes,
+		"milli_megapixels", job.MilliMegapixels,
+		"attempts", job.Attempts,
+	)
+	pipe.Expire(ctx, key, q.opts.HistoryTTL)
+	pipe.ZAdd(ctx, q.finishedJobsKey(), redis.Z{Score: float64(job.UpdatedAt.UnixMilli()), Member: job.ID})
+}
+
+// parseJobSummary reads a summary hash of a job that finished at finishedMs
+func parseJobSummary(jobID string, finishedMs int64, fields map[string]string) *JobSummary {
+	number := func(name string) int64 {
+		n, _ := strconv.ParseInt(fields[name], 10, 64)
+		return n
+	}
+	return &JobSummary{
+		JobID:           jobID,
+		Status:          JobStatus(fields["status"]),
+		Owner:           fields["owner"],
+		Model:           fields["model"],
+		ErrorCode:       fields["error_code"],
+		CreatedAt:       time.UnixMilli(number("created_at")).UTC(),
+		FinishedAt:      time.UnixMilli(finishedMs).UTC(),
+		QueueWaitMs:     number("queue_wait_ms"),
+		ProcessingMs:    number("processing_ms"),
+		InputBytes:      number("input_bytes"),
+		MilliMegapixels: number("milli_megapixels"),
+		Attempts:        int(number("attempts")),
+	}
+}
+
+// JobHistory returns the summaries of up to limit jobs that completed or
+// failed from since until until, oldest first. Entries whose summary has
+// expired are skipped; TrimHistory removes them.
+func (q *RedisQueue) JobHistory(ctx context.Context, since, until time.Time, limit int) ([]*JobSummary, error) {
+	entries, err := q.client.ZRangeByScoreWithScores(ctx, q.finishedJobsKey(), &redis.ZRangeBy{
+		Min:   strconv.FormatInt(since.UnixMilli(), 10),
+		Max:   strconv.FormatInt(until.UnixMilli(), 10),
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	pipe := q.client.Pipeline()
+	cmds := make([]*redis.MapStringStringCmd, len(entries))
+	for i, entry := range entries {
+		cmds[i] = pipe.HGetAll(ctx, q.jobSummaryKey(entry.Member.(string)))
+	}
+	if len(entries) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+			return nil, err
+		}
+	}
+
+	summaries := make([]*JobSummary, 0, len(entries))
+	for i, cmd := range cmds {
+		if fields := cmd.Val(); fields["status"] != "" {
+			summaries = append(summaries, parseJobSummary(entries[i].Member.(string), int64(entries[i].Score), fields))
+		}
+	}
+	return summaries, nil
+}
+
+// TrimHistory removes the history entries of jobs that finished longer than
+// HistoryTTL ago, whose summaries Redis has expired, and returns how many it
+// removed
+func (q *RedisQueue) TrimHistory(ctx context.Context) (int, error) {
+	cutoff := q.opts.Clock.Now().Add(-q.opts.HistoryTTL).UnixMilli()
+	removed, err := q.client.ZRemRangeByScore(ctx, q.finishedJobsKey(), "-inf", "("+strconv.FormatInt(cutoff, 10)).Result()
+	return int(removed), err
+}
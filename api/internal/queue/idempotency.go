@@ -0,0 +1,152 @@
+package queue
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// IdempotencyState is the stage of an idempotency record. A record starts
+// reserved while its request is processed, then is either committed with
+// the created job or released so the key can be reused.
+type IdempotencyState string
+
+const (
+	// IdempotencyReserved means a request holding the key is in flight
+	IdempotencyReserved IdempotencyState = "reserved"
+	// IdempotencyCommitted means the key created a job
+	IdempotencyCommitted IdempotencyState = "committed"
+)
+
+// IdempotencyReservationTTL bounds how long a reservation outlives its
+// request, so a replica crashing between reserve and commit frees the key
+// quickly. Requests refresh their reservation while they run.
+const IdempotencyReservationTTL = 30 * time.Second
+
+// IdempotencyRecord is the state of an idempotency key held by another request
+type IdempotencyRecord struct {
+	State IdempotencyState
+	// JobID is the job created under a committed key
+	JobID string
+	// ExpiresIn is how long the record has left
+	ExpiresIn time.Duration
+}
+
+// idempotencyKey returns the Redis hash recording an owner's idempotency key
+func (k redisKeys) idempotencyKey(owner, key string) string {
+	return k.prefix + "idempotency:" + owner + ":" + key
+}
+
+// reserveIdempotencyScript reserves a free key for the request holding
+// ARGV[1], or returns the existing record as {state, job_id, pttl}
+var reserveIdempotencyScript = redis.NewScript(`
+if redis.call("EXISTS", KEYS[1]) == 0 then
+	redis.call("HSET", KEYS[1], "state", "reserved", "token", ARGV[1])
+	redis.call("PEXPIRE", KEYS[1], ARGV[2])
+	return {"", "", 0}
+end
+local record = redis.call("HMGET", KEYS[1], "state", "job_id")
+return {record[1] or "", record[2] or "", redis.call("PTTL", KEYS[1])}
+`)
+
+// commitIdempotencyScript moves a reservation held by ARGV[1] to committed.
+// Returns 0 if the reservation expired or belongs to another request.
+var commitIdempotencyScript = redis.NewScript(`
+local record = redis.call("HMGET", KEYS[1], "state", "token")
+if record[1] ~= "reserved" or record[2] ~= ARGV[1] then
+	return 0
+end
+redis.call("HSET", KEYS[1], "state", "committed", "job_id", ARGV[2])
+redis.call("HDEL", KEYS[1], "token")
+redis.call("PEXPIRE", KEYS[1], ARGV[3])
+return 1
+`)
+
+// refreshIdempotencyScript extends a reservation held by ARGV[1] by ARGV[2]
+// milliseconds. Returns 0 if the reservation expired, was committed, or
+// belongs to another request.
+var refreshIdempotencyScript = redis.NewScript(`
+local record = redis.call("HMGET", KEYS[1], "state", "token")
+if record[1] ~= "reserved" or record[2] ~= ARGV[1] then
+	return 0
+end
+return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+`)
+
+// releaseIdempotencyScript deletes a reservation held by ARGV[1]; committed
+// records and other requests' reservations are left alone
+var releaseIdempotencyScript = redis.NewScript(`
+local record = redis.call("HMGET", KEYS[1], "state", "token")
+if record[1] ~= "reserved" or record[2] ~= ARGV[1] then
+	return 0
+end
+return redis.call("DEL", KEYS[1])
+`)
+
+// forgetIdempotencyScript deletes a committed record if it still points to
+// job ARGV[1]
+var forgetIdempotencyScript = redis.NewScript(`
+if redis.call("HGET", KEYS[1], "job_id") ~= ARGV[1] then
+	return 0
+end
+return redis.call("DEL", KEYS[1])
+`)
+
+// ReserveIdempotencyKey reserves an owner's key for the request identified
+// by token. It returns true if the key was free; otherwise it returns the
+// record of the request already holding it.
+func (q *RedisQueue) ReserveIdempotencyKey(ctx context.Context, owner, key, token string) (bool, IdempotencyRecord, error) {
+	values, err := reserveIdempotencyScript.Run(ctx, q.client,
+		[]string{q.idempotencyKey(owner, key)},
+		token, IdempotencyReservationTTL.Milliseconds(),
+	).Slice()
+	if err != nil {
+		return false, IdempotencyRecord{}, err
+	}
+
+	state, _ := values[0].(string)
+	if state == "" {
+		return true, IdempotencyRecord{}, nil
+	}
+	jobID, _ := values[1].(string)
+	pttl, _ := values[2].(int64)
+	return false, IdempotencyRecord{
+		State:     IdempotencyState(state),
+		JobID:     jobID,
+		ExpiresIn: time.Duration(pttl) * time.Millisecond,
+	}, nil
+}
+
+// CommitIdempotencyKey records the job created under a reserved key, which
+// then replays that job for ttl. It returns false if the reservation had
+// already expired.
+func (q *RedisQueue) CommitIdempotencyKey(ctx context.Context, owner, key, token, jobID string, ttl time.Duration) (bool, error) {
+	committed, err := commitIdempotencyScript.Run(ctx, q.client,
+		[]string{q.idempotencyKey(owner, key)},
+		token, jobID, ttl.Milliseconds(),
+	).Int()
+	return committed == 1, err
+}
+
+// RefreshIdempotencyKey renews a reservation for another
+// IdempotencyReservationTTL, for requests still running as it nears expiry.
+// It returns false if the reservation is no longer the request's to renew.
+func (q *RedisQueue) RefreshIdempotencyKey(ctx context.Context, owner, key, token string) (bool, error) {
+	refreshed, err := refreshIdempotencyScript.Run(ctx, q.client,
+		[]string{q.idempotencyKey(owner, key)},
+		token, IdempotencyReservationTTL.Milliseconds(),
+	).Int()
+	return refreshed == 1, err
+}
+
+// ReleaseIdempotencyKey frees a reserved key so a corrected retry can use it
+func (q *RedisQueue) ReleaseIdempotencyKey(ctx context.Context, owner, key, token string) error {
+	return releaseIdempotencyScript.Run(ctx, q.client, []string{q.idempotencyKey(owner, key)}, token).Err()
+}
+
+// ForgetIdempotencyKey deletes an owner's key committed to a job that has
+// expired, so a retry creates a new job instead of replaying a removed one
+func (q *RedisQueue) ForgetIdempotencyKey(ctx context.Context, owner, key, jobID string) error {
+	return forgetIdempotencyScript.Run(ctx, q.client, []string{q.idempotencyKey(owner, key)}, jobID).Err()
+}
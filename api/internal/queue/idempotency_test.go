@@ -0,0 +1,31 @@
+package queue
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestRefreshIdempotencyKeyOnlyRenewsOwnReservation(t *testing.T) {
+	jobs, server := newTestRedisQueue(t, Options{})
+	ctx := context.Background()
+
+	if reserved, _, err := jobs.ReserveIdempotencyKey(ctx, "owner", "key", "token-1"); err != nil || !reserved {
+		t.Fatalf("ReserveIdempotencyKey: %v, %v", reserved, err)
+	}
+	server.FastForward(IdempotencyReservationTTL - time.Second)
+	if refreshed, err := jobs.RefreshIdempotencyKey(ctx, "owner", "key", "token-2"); err != nil || refreshed {
+		t.Fatalf("refresh by another request: %v, %v", refreshed, err)
+	}
+	if refreshed, err := jobs.RefreshIdempotencyKey(ctx, "owner", "key", "token-1"); err != nil || !refreshed {
+		t.Fatalf("refresh by the holder: %v, %v", refreshed, err)
+	}
+	server.FastForward(IdempotencyReservationTTL - time.Second)
+	if committed, err := jobs.CommitIdempotencyKey(ctx, "owner", "key", "token-1", "job-1", time.Hour); err != nil || !committed {
+		t.Fatalf("commit after refresh: %v, %v", committed, err)
+	}
+	// A committed key keeps its own TTL
+	if refreshed, err := jobs.RefreshIdempotencyKey(ctx, "owner", "key", "token-1"); err != nil || refreshed {
+		t.Fatalf("refresh of a committed key: %v, %v", refreshed, err)
+	}
+}
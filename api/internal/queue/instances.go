@@ -0,0 +1,68 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"sort"
+	"time"
+)
+
+// InstanceHeartbeatTTL is how long an API replica counts as alive after its last heartbeat
+const InstanceHeartbeatTTL = 30 * time.Second
+
+// InstanceHeartbeat is the latest liveness report of one API replica
+type InstanceHeartbeat struct {
+	InstanceID string    `json:"instance_id"`
+	Hostname   string    `json:"hostname"`
+	StartedAt  time.Time `json:"started_at"`
+	At         time.Time `json:"ts"`
+}
+
+// instancesKey returns the Redis hash of API replica heartbeats, keyed by instance ID
+func (k redisKeys) instancesKey() string {
+	return k.prefix + "api_instances"
+}
+
+// RegisterInstance records a heartbeat for an API replica, stamped with the queue clock
+func (q *RedisQueue) RegisterInstance(ctx context.Context, hb InstanceHeartbeat) error {
+	hb.At = q.opts.Clock.Now()
+	data, err := json.Marshal(hb)
+	if err != nil {
+		return err
+	}
+	return q.client.HSet(ctx, q.instancesKey(), hb.InstanceID, data).Err()
+}
+
+// DeregisterInstance removes an API replica that is shutting down
+func (q *RedisQueue) DeregisterInstance(ctx context.Context, instanceID string) error {
+	return q.client.HDel(ctx, q.instancesKey(), instanceID).Err()
+}
+
+// Instances returns the API replicas that reported within InstanceHeartbeatTTL,
+// sorted by instance ID. Heartbeats of dead replicas are removed.
+func (q *RedisQueue) Instances(ctx context.Context) ([]InstanceHeartbeat, error) {
+	entries, err := q.client.HGetAll(ctx, q.instancesKey()).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	now := q.opts.Clock.Now()
+	var alive []InstanceHeartbeat
+	var dead []string
+	for id, value := range entries {
+		var hb InstanceHeartbeat
+		if err := json.Unmarshal([]byte(value), &hb); err != nil || now.Sub(hb.At) > InstanceHeartbeatTTL {
+			dead = append(dead, id)
+			continue
+		}
+		hb.InstanceID = id
+		alive = append(alive, hb)
+	}
+
+	if len(dead) > 0 {
+		q.client.HDel(ctx, q.instancesKey(), dead...)
+	}
+
+	sort.Slice(alive, func(i, j int) bool { return alive[i].InstanceID < alive[j].InstanceID })
+	return alive, nil
+}
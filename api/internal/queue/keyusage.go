@@ -0,0 +1,251 @@
+package queue
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// KeyFeature groups the Redis keys written by one feature
+type KeyFeature struct {
+	Name string
+	// Prefixes are matched against key names; an entry without a trailing
+	// '*' must match the whole key
+	Prefixes []string
+	// Optional features are disabled when they exceed their cap
+	Optional bool
+}
+
+// unprefixed builds the keys classifyKey matches, those of a queue
+// without a key prefix
+var unprefixed redisKeys
+
+// keyFeatures lists every key family the queue writes, by their keys
+// without the queue's prefix
+var keyFeatures = []KeyFeature{
+	{Name: "jobs", Prefixes: []string{unprefixed.jobKey("*"), unprefixed.recentJobKey("*")}},
+	{Name: "pending", Prefixes: []string{queueName, modelQueueName("*"), unprefixed.processingKey("*"), unprefixed.claimWorkersKey(), unprefixed.pendingStreamKey(ModelDefault, PriorityNormal) + "*", unprefixed.streamClaimsKey("*")}},
+	{Name: "scheduled", Prefixes: []string{unprefixed.scheduledJobsKey(), unprefixed.promotingJobsKey()}},
+	{Name: "locks", Prefixes: []string{unprefixed.lockKey("*")}},
+	{Name: "migrations", Prefixes: []string{unprefixed.schemaVersionKey(), unprefixed.migrationCursorKey()}},
+	{Name: "polls", Prefixes: []string{unprefixed.pollCountKey("*")}},
+	{Name: "stats", Prefixes: []string{"stats:*"}},
+	{Name: "download_tokens", Prefixes: []string{unprefixed.downloadTokenKey("*")}},
+	{Name: "usage", Prefixes: []string{unprefixed.usageKey("*", "*"), unprefixed.refundKey("*")}},
+	{Name: "deliveries", Prefixes: []string{unprefixed.deliveryQueueKey()}},
+	{Name: "heartbeats", Prefixes: []string{unprefixed.heartbeatsKey(), unprefixed.instancesKey()}},
+	{Name: "download_limits", Prefixes: []string{unprefixed.activeDownloadsKey("*"), unprefixed.dailyDownloadsKey("*", "*"), unprefixed.topDownloadsKey("*"), unprefixed.downloadLimitsKey("*")}},
+	{Name: "idempotency", Prefixes: []string{unprefixed.idempotencyKey("*", "*")}},
+	{Name: "outcomes", Prefixes: []string{"outcomes:*", unprefixed.failureExamplesKey("*"), unprefixed.alertCooldownKey("*")}},
+	{Name: "search", Prefixes: []string{unprefixed.searchIndexKey("*", "*"), unprefixed.searchRecentKey("*", "*")}},
+	{Name: "dedupe", Prefixes: []string{unprefixed.uploadDedupeKey("*")}},
+	{Name: "variants", Prefixes: []string{unprefixed.variantsKey()}},
+	{Name: "faults", Prefixes: []string{unprefixed.faultRulesKey()}},
+	{Name: "maintenance", Prefixes: []string{unprefixed.maintenanceKey(), unprefixed.maintenanceFlagKey(MaintenanceSubmissions), unprefixed.maintenanceOverridesKey(), unprefixed.maintenanceScheduleKey()}},
+	{Name: "audit", Prefixes: []string{unprefixed.auditLogKey()}},
+	{Name: "fanout", Prefixes: []string{unprefixed.fanoutKey("*"), unprefixed.inputRefsKey("*"), unprefixed.inputJobsKey("*")}},
+	{Name: "retention", Prefixes: []string{unprefixed.lifecyclePoliciesKey(), unprefixed.removalScheduleKey("*"), unprefixed.tombstoneKey("*")}},
+	{Name: "lifetimes", Prefixes: []string{unprefixed.lifetimeDeadlinesKey()}},
+	{Name: "cancellations", Prefixes: []string{unprefixed.cancelKey("*")}},
+	{Name: "progress", Prefixes: []string{unprefixed.progressKey("*")}},
+	{Name: "status_index", Prefixes: []string{unprefixed.statusIndexKey("*"), unprefixed.statusIndexPruneKey()}},
+	{Name: "history", Prefixes: []string{unprefixed.finishedJobsKey(), unprefixed.jobSummaryKey("*")}},
+	{Name: "api_keys", Prefixes: []string{unprefixed.apiKeyKey("*"), unprefixed.apiKeyIDKey("*"), unprefixed.ownerAPIKeysKey("*")}},
+}
+
+const (
+	// keyUsageMinInterval is the minimum time between two samples
+	keyUsageMinInterval = 30 * time.Second
+	// keyUsageMaxIterations bounds the SCAN calls made by one sample
+	keyUsageMaxIterations = 200
+	// keyUsageScanCount is the SCAN COUNT hint per iteration
+	keyUsageScanCount = 500
+	// keyUsageMemoryEvery runs MEMORY USAGE on one of every N keys
+	keyUsageMemoryEvery = 50
+)
+
+// FeatureUsage is the approximate Redis footprint of one feature
+type FeatureUsage struct {
+	Keys        int64 `json:"keys"`
+	MemoryBytes int64 `json:"memory_bytes"`
+	Cap         int64 `json:"cap,omitempty"`
+	OverCap     bool  `json:"over_cap,omitempty"`
+}
+
+// KeyUsageReport is the result of a bounded sample of the keyspace
+type KeyUsageReport struct {
+	SampledAt   time.Time               `json:"sampled_at"`
+	TotalKeys   int64                   `json:"total_keys"`
+	ScannedKeys int64                   `json:"scanned_keys"`
+	Complete    bool                    `json:"complete"`
+	Features    map[string]FeatureUsage `json:"features"`
+}
+
+// keyUsageState caches the latest report and the features disabled by it
+type keyUsageState struct {
+	// sampling serializes samples so concurrent callers share one scan
+	sampling sync.Mutex
+	mu       sync.Mutex
+	report   *KeyUsageReport
+	disabled map[string]bool
+}
+
+// KeyUsage samples the keyspace and reports approximate counts and memory
+// per feature. Samples are rate-limited; calls within keyUsageMinInterval of
+// the previous sample return the cached report.
+func (q *RedisQueue) KeyUsage(ctx context.Context) (*KeyUsageReport, error) {
+	q.keyUsage.sampling.Lock()
+	defer q.keyUsage.sampling.Unlock()
+
+	q.keyUsage.mu.Lock()
+	cached, wasDisabled := q.keyUsage.report, q.keyUsage.disabled
+	q.keyUsage.mu.Unlock()
+
+	if cached != nil && time.Since(cached.SampledAt) < keyUsageMinInterval {
+		return cached, nil
+	}
+
+	report, err := q.sampleKeyUsage(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	// Disable optional features that exceed their cap
+	disabled := make(map[string]bool)
+	for _, f := range keyFeatures {
+		usage := report.Features[f.Name]
+		limit, ok := q.opts.KeyCaps[f.Name]
+		if !ok || limit <= 0 {
+			continue
+		}
+		usage.Cap = limit
+		usage.OverCap = usage.Keys > limit
+		report.Features[f.Name] = usage
+
+		if usage.OverCap && f.Optional {
+			disabled[f.Name] = true
+			if !wasDisabled[f.Name] {
+				log.Printf("Warning: feature %s has ~%d Redis keys, over its cap of %d; disabling it", f.Name, usage.Keys, limit)
+			}
+		}
+	}
+
+	q.keyUsage.mu.Lock()
+	q.keyUsage.report = report
+	q.keyUsage.disabled = disabled
+	q.keyUsage.mu.Unlock()
+
+	return report, nil
+}
+
+// FeatureEnabled reports whether an optional feature is currently allowed
+// to write new keys, based on the latest key usage sample
+func (q *RedisQueue) FeatureEnabled(name string) bool {
+	q.keyUsage.mu.Lock()
+	defer q.keyUsage.mu.Unlock()
+	return !q.keyUsage.disabled[name]
+}
+
+// DisabledFeatures returns the optional features currently disabled, sorted by name
+func (q *RedisQueue) DisabledFeatures() []string {
+	q.keyUsage.mu.Lock()
+	defer q.keyUsage.mu.Unlock()
+
+	names := make([]string, 0, len(q.keyUsage.disabled))
+	for name := range q.keyUsage.disabled {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// sampleKeyUsage runs a bounded SCAN over the keyspace, classifying keys by
+// feature. Keys outside the queue's KeyPrefix are scanned but not counted.
+func (q *RedisQueue) sampleKeyUsage(ctx context.Context) (*KeyUsageReport, error) {
+	keyspace, err := q.keyspace(ctx)
+	if err != nil {
+		return nil, err
+	}
+	total, err := keyspace.DBSize(ctx).Result()
+	if err != nil {
+		return nil, err
+	}
+
+	report := &KeyUsageReport{
+		SampledAt: time.Now(),
+		TotalKeys: total,
+		Features:  make(map[string]FeatureUsage),
+	}
+
+	var cursor uint64
+	sampled := make(map[string]int64)
+	sampledBytes := make(map[string]int64)
+
+	for i := 0; i < keyUsageMaxIterations; i++ {
+		keys, next, err := keyspace.Scan(ctx, cursor, "", keyUsageScanCount).Result()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, key := range keys {
+			report.ScannedKeys++
+			if !strings.HasPrefix(key, q.prefix) {
+				// Another deployment's key, scanned so the sample's
+				// fraction of the database stays true
+				continue
+			}
+			name := classifyKey(strings.TrimPrefix(key, q.prefix))
+
+			usage := report.Features[name]
+			usage.Keys++
+			report.Features[name] = usage
+
+			if report.ScannedKeys%keyUsageMemoryEvery == 1 {
+				if size, err := q.client.MemoryUsage(ctx, key).Result(); err == nil {
+					sampled[name]++
+					sampledBytes[name] += size
+				}
+			}
+		}
+
+		cursor = next
+		if cursor == 0 {
+			report.Complete = true
+			break
+		}
+	}
+
+	// Extrapolate counts from the scanned fraction and memory from sampled keys
+	scale := 1.0
+	if !report.Complete && report.ScannedKeys > 0 {
+		scale = float64(total) / float64(report.ScannedKeys)
+	}
+	for name, usage := range report.Features {
+		usage.Keys = int64(float64(usage.Keys) * scale)
+		if sampled[name] > 0 {
+			usage.MemoryBytes = sampledBytes[name] / sampled[name] * usage.Keys
+		}
+		report.Features[name] = usage
+	}
+
+	return report, nil
+}
+
+// classifyKey returns the feature that owns a key, or "other"
+func classifyKey(key string) string {
+	for _, f := range keyFeatures {
+		for _, prefix := range f.Prefixes {
+			if p := strings.TrimSuffix(prefix, "*"); p != prefix {
+				if strings.HasPrefix(key, p) {
+					return f.Name
+				}
+			} else if key == prefix {
+				return f.Name
+			}
+		}
+	}
+	return "other"
+}
@@ -0,0 +1,79 @@
+package queue
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// lifetimeDeadlinesKey returns the sorted set of job IDs with a maximum
+// lifetime, scored by when it ends in Unix seconds
+func (k redisKeys) lifetimeDeadlinesKey() string {
+	return k.prefix + "lifetime_deadlines"
+}
+
+// LifetimeEndsAt returns when the job is stopped if it hasn't finished, or
+// the zero time if its lifetime is unbounded. It's counted from submission,
+// or for a scheduled job from when it was due. Requeues and retries don't
+// extend it.
+func (j *Job) LifetimeEndsAt() time.Time {
+	if j.MaxLifetimeSeconds <= 0 {
+		return time.Time{}
+	}
+	start := j.CreatedAt
+	if j.ProcessAt != nil && j.ProcessAt.After(start) {
+		start = *j.ProcessAt
+	}
+	return start.Add(time.Duration(j.MaxLifetimeSeconds) * time.Second)
+}
+
+// scheduleLifetime queues the check of the job at the end of its lifetime
+func (q *RedisQueue) scheduleLifetime(ctx context.Context, pipe redis.Pipeliner, job *Job) {
+	if at := job.LifetimeEndsAt(); !at.IsZero() {
+		pipe.ZAdd(ctx, q.lifetimeDeadlinesKey(), redis.Z{Score: float64(at.Unix()), Member: job.ID})
+	}
+}
+
+// OverdueJobs returns up to limit job IDs whose lifetime ended by now. They
+// may have finished since; the caller checks.
+func (q *RedisQueue) OverdueJobs(ctx context.Context, now time.Time, limit int64) ([]string, error) {
+	return q.client.ZRangeByScore(ctx, q.lifetimeDeadlinesKey(), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now.Unix(), 10),
+		Count: limit,
+	}).Result()
+}
+
+// ClearLifetime stops checking a job's lifetime, once it has finished or expired
+func (q *RedisQueue) ClearLifetime(ctx context.Context, jobID string) error {
+	return q.client.ZRem(ctx, q.lifetimeDeadlinesKey(), jobID).Err()
+}
+
+// TerminateJob stops a job that outlived its lifetime. Its undelivered
+// destinations are given up, it's failed with ErrorCodeLifetimeExceeded as
+// FailJob fails any job, and then it's taken off the pending, scheduled,
+// and delivery queues. It fails with ErrInvalidTransition, leaving the
+// queues alone, if the job's status changed since it was read, as when it
+// completed meanwhile.
+func (q *RedisQueue) TerminateJob(ctx context.Context, job *Job, message string) error {
+	for i := range job.Deliveries {
+		if job.Deliveries[i].Status == DeliveryPending {
+			job.Deliveries[i].Status = DeliveryFailed
+			job.Deliveries[i].LastError = message
+		}
+	}
+	if err := q.FailJob(ctx, job, ErrorCodeLifetimeExceeded, message); err != nil {
+		return err
+	}
+
+	pipe := q.client.TxPipeline()
+	pipe.LRem(ctx, q.pendingList(job), 0, job.ID)
+	pipe.ZRem(ctx, q.scheduledJobsKey(), job.ID)
+	pipe.ZRem(ctx, q.deliveryQueueKey(), job.ID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	return q.ClearLifetime(ctx, job.ID)
+}
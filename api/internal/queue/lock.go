@@ -0,0 +1,79 @@
+package queue
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Lock is a Redis-backed mutual exclusion lock shared by all API replicas
+type Lock struct {
+	client redis.UniversalClient
+	key    string
+	token  string
+}
+
+// releaseLockScript deletes the lock only if it is still held by the caller
+var releaseLockScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// lockKey returns the Redis key for a named lock
+func (k redisKeys) lockKey(name string) string {
+	return k.prefix + "lock:" + name
+}
+
+// TryLock attempts to acquire the named lock without waiting. It returns a
+// nil Lock if another holder currently owns it.
+func (q *RedisQueue) TryLock(ctx context.Context, name string, ttl time.Duration) (*Lock, error) {
+	token, err := generateToken()
+	if err != nil {
+		return nil, err
+	}
+
+	ok, err := q.client.SetNX(ctx, q.lockKey(name), token, ttl).Result()
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, nil
+	}
+
+	return &Lock{client: q.client, key: q.lockKey(name), token: token}, nil
+}
+
+// Lock acquires the named lock, retrying until it is free or ctx is done
+func (q *RedisQueue) Lock(ctx context.Context, name string, ttl time.Duration) (*Lock, error) {
+	for {
+		lock, err := q.TryLock(ctx, name, ttl)
+		if err != nil || lock != nil {
+			return lock, err
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// Release frees the lock if it is still held by this holder
+func (l *Lock) Release(ctx context.Context) error {
+	return releaseLockScript.Run(ctx, l.client, []string{l.key}, l.token).Err()
+}
+
+// generateToken generates a random token identifying a lock holder
+func generateToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -0,0 +1,141 @@
+package queue
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Maintenance flags pausing part of the service
+const (
+	// MaintenanceConsumption stops workers claiming new jobs
+	MaintenanceConsumption = "consumption"
+	// MaintenanceSubmissions rejects new submissions
+	MaintenanceSubmissions = "submissions"
+)
+
+// MaintenanceFlags lists every maintenance flag
+var MaintenanceFlags = []string{MaintenanceConsumption, MaintenanceSubmissions}
+
+// Manual settings of a maintenance flag, which the schedule leaves alone
+const (
+	OverridePaused  = "paused"
+	OverrideResumed = "resumed"
+)
+
+// scheduleForced is recorded as the schedule's last state of a flag whose
+// override was cleared, so the schedule applies again whatever it was
+const scheduleForced = "?"
+
+// scheduleOff is recorded as the schedule's last state of a flag it cleared
+const scheduleOff = "-"
+
+// maintenanceFlagKey returns the Redis key that, while set, pauses what the
+// flag names. Consumption keeps the key workers have always checked.
+func (k redisKeys) maintenanceFlagKey(flag string) string {
+	if flag == MaintenanceConsumption {
+		return k.maintenanceKey()
+	}
+	return k.prefix + "maintenance:" + flag + "_paused"
+}
+
+// maintenanceOverridesKey returns the hash of manual overrides by flag
+func (k redisKeys) maintenanceOverridesKey() string {
+	return k.prefix + "maintenance:overrides"
+}
+
+// maintenanceScheduleKey returns the hash of the state the schedule last set
+// each flag to: the window that set it, or scheduleOff
+func (k redisKeys) maintenanceScheduleKey() string {
+	return k.prefix + "maintenance:schedule"
+}
+
+// applyScheduleScript sets (ARGV[2] = "1") or clears the flag key at
+// KEYS[1] for window ARGV[3], unless flag ARGV[1] is overridden in the hash
+// at KEYS[2], and records the state in the hash at KEYS[3]. Returns whether
+// it was applied.
+var applyScheduleScript = redis.NewScript(`
+if redis.call("HEXISTS", KEYS[2], ARGV[1]) == 1 then
+	return 0
+end
+if ARGV[2] == "1" then
+	redis.call("SET", KEYS[1], "1")
+	redis.call("HSET", KEYS[3], ARGV[1], ARGV[3])
+else
+	redis.call("DEL", KEYS[1])
+	redis.call("HSET", KEYS[3], ARGV[1], "-")
+end
+return 1
+`)
+
+// MaintenancePaused reports whether a maintenance flag is set
+func (q *RedisQueue) MaintenancePaused(ctx context.Context, flag string) (bool, error) {
+	n, err := q.client.Exists(ctx, q.maintenanceFlagKey(flag)).Result()
+	return n > 0, err
+}
+
+// OverrideMaintenance sets or clears a maintenance flag by hand. The
+// schedule leaves it as it is until ClearMaintenanceOverride.
+func (q *RedisQueue) OverrideMaintenance(ctx context.Context, flag string, paused bool) error {
+	pipe := q.client.TxPipeline()
+	if paused {
+		pipe.Set(ctx, q.maintenanceFlagKey(flag), "1", 0)
+		pipe.HSet(ctx, q.maintenanceOverridesKey(), flag, OverridePaused)
+	} else {
+		pipe.Del(ctx, q.maintenanceFlagKey(flag))
+		pipe.HSet(ctx, q.maintenanceOverridesKey(), flag, OverrideResumed)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// ClearMaintenanceOverride hands a flag back to the schedule, which sets it
+// to what the windows say on its next evaluation
+func (q *RedisQueue) ClearMaintenanceOverride(ctx context.Context, flag string) error {
+	pipe := q.client.TxPipeline()
+	pipe.HDel(ctx, q.maintenanceOverridesKey(), flag)
+	pipe.HSet(ctx, q.maintenanceScheduleKey(), flag, scheduleForced)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// MaintenanceOverrides returns the flags set by hand, OverridePaused or
+// OverrideResumed by flag
+func (q *RedisQueue) MaintenanceOverrides(ctx context.Context) (map[string]string, error) {
+	return q.client.HGetAll(ctx, q.maintenanceOverridesKey()).Result()
+}
+
+// ScheduledMaintenance returns, by flag, the window the schedule last set the
+// flag for, or "" if the schedule last cleared it or never touched it. forced
+// lists the flags whose override was cleared since.
+func (q *RedisQueue) ScheduledMaintenance(ctx context.Context) (windows map[string]string, forced map[string]bool, err error) {
+	states, err := q.client.HGetAll(ctx, q.maintenanceScheduleKey()).Result()
+	if err != nil {
+		return nil, nil, err
+	}
+	windows, forced = make(map[string]string), make(map[string]bool)
+	for flag, state := range states {
+		switch state {
+		case scheduleForced:
+			forced[flag] = true
+		case scheduleOff:
+		default:
+			windows[flag] = state
+		}
+	}
+	return windows, forced, nil
+}
+
+// ApplyScheduledMaintenance sets or clears a flag for the schedule, on
+// behalf of window, unless it's overridden by hand. It reports whether the
+// flag was changed.
+func (q *RedisQueue) ApplyScheduledMaintenance(ctx context.Context, flag, window string, paused bool) (bool, error) {
+	on := "0"
+	if paused {
+		on = "1"
+	}
+	return applyScheduleScript.Run(ctx, q.client,
+		[]string{q.maintenanceFlagKey(flag), q.maintenanceOverridesKey(), q.maintenanceScheduleKey()},
+		flag, on, window,
+	).Bool()
+}
@@ -0,0 +1,587 @@
+package queue
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+// memorySweepInterval is how often MemoryQueue drops expired records
+const memorySweepInterval = time.Minute
+
+// memoryRecord is a job as MemoryQueue stores it
+type memoryRecord struct {
+	data      []byte
+	status    JobStatus
+	updatedAt time.Time
+	expiresAt time.Time
+}
+
+// MemoryQueue implements JobQueue in process memory, for local development
+// and tests without Redis. Jobs are encoded on the way in and decoded on the
+// way out, as Redis stores them, so a caller keeping a job's pointer can't
+// change the stored job. Records expire by the same TTLs as RedisQueue's,
+// removed by a background sweep. Everything is lost when the process exits,
+// and workers in other processes can't claim its jobs.
+type MemoryQueue struct {
+	opts Options
+
+	mu      sync.Mutex
+	records map[string]*memoryRecord
+	// pending holds the IDs queued on each pending list, oldest first
+	pending map[string][]string
+	// claims holds the IDs each worker has claimed but not acknowledged
+	claims  map[string][]string
+	cancels map[string]bool
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewMemoryQueue creates an empty in-memory job queue and starts sweeping
+// its expired records until it's closed
+func NewMemoryQueue(opts Options) *MemoryQueue {
+	opts.setDefaults()
+	q := &MemoryQueue{
+		opts:    opts,
+		records: make(map[string]*memoryRecord),
+		pending: make(map[string][]string),
+		claims:  make(map[string][]string),
+		cancels: make(map[string]bool),
+		stop:    make(chan struct{}),
+	}
+	go q.sweep()
+	return q
+}
+
+// Close stops the sweep
+func (q *MemoryQueue) Close() error {
+	q.closeOnce.Do(func() { close(q.stop) })
+	return nil
+}
+
+// sweep removes expired records every memorySweepInterval until closed
+func (q *MemoryQueue) sweep() {
+	ticker := time.NewTicker(memorySweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-ticker.C:
+			q.RemoveExpired()
+		}
+	}
+}
+
+// RemoveExpired removes the records whose TTL has passed, with their pending
+// entries and cancellation flags, and returns how many it removed
+func (q *MemoryQueue) RemoveExpired() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.opts.Clock.Now()
+	removed := 0
+	for id, record := range q.records {
+		if !now.Before(record.expiresAt) {
+			delete(q.records, id)
+			delete(q.cancels, id)
+			removed++
+		}
+	}
+	for key, ids := range q.pending {
+		kept := ids[:0]
+		for _, id := range ids {
+			if _, ok := q.records[id]; ok {
+				kept = append(kept, id)
+			}
+		}
+		q.pending[key] = kept
+	}
+	return removed
+}
+
+// JobExpiresAt returns when the job's record is removed, as
+// RedisQueue.JobExpiresAt does
+func (q *MemoryQueue) JobExpiresAt(job *Job) time.Time {
+	return q.opts.jobExpiresAt(job)
+}
+
+// record returns the live record of a job, dropping it if it has expired.
+// q.mu must be held.
+func (q *MemoryQueue) record(jobID string) *memoryRecord {
+	record, ok := q.records[jobID]
+	if !ok {
+		return nil
+	}
+	if !q.opts.Clock.Now().Before(record.expiresAt) {
+		delete(q.records, jobID)
+		delete(q.cancels, jobID)
+		return nil
+	}
+	return record
+}
+
+// decode returns a copy of the job stored in record
+func (q *MemoryQueue) decode(record *memoryRecord) (*Job, error) {
+	var job Job
+	if err := q.opts.Codec.Decode(record.data, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+// store writes the job's record, kept for its TTL from now, adding a
+// change of status to its timeline. q.mu must be held.
+func (q *MemoryQueue) store(job *Job) error {
+	job.recordStatus(job.UpdatedAt)
+	data, err := q.opts.Codec.Encode(job)
+	if err != nil {
+		return err
+	}
+	q.records[job.ID] = &memoryRecord{
+		data:      data,
+		status:    job.Status,
+		updatedAt: job.UpdatedAt,
+		expiresAt: q.opts.Clock.Now().Add(q.opts.recordTTL(job)),
+	}
+	return nil
+}
+
+// enqueue adds a job to the end of its pending list. q.mu must be held.
+func (q *MemoryQueue) enqueue(job *Job) {
+	key := job.pendingName()
+	q.pending[key] = append(q.pending[key], job.ID)
+}
+
+// dequeue removes a job from every pending list. q.mu must be held.
+func (q *MemoryQueue) dequeue(jobID string) {
+	for key, ids := range q.pending {
+		q.pending[key] = removeID(ids, jobID)
+	}
+}
+
+// removeID returns ids without jobID
+func removeID(ids []string, jobID string) []string {
+	kept := ids[:0]
+	for _, id := range ids {
+		if id != jobID {
+			kept = append(kept, id)
+		}
+	}
+	return kept
+}
+
+// AddJob adds a new job to the queue
+func (q *MemoryQueue) AddJob(ctx context.Context, job *Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.opts.Clock.Now()
+	if job.CreatedAt.IsZero() {
+		job.CreatedAt = now
+	}
+	job.UpdatedAt = now
+	job.Version = 1
+	if job.Status == "" {
+		job.Status = StatusPending
+	}
+	if job.Status == StatusPending {
+		job.EnqueuedAtMs = now.UnixMilli()
+	}
+	if err := q.store(job); err != nil {
+		return err
+	}
+	if job.Status == StatusPending {
+		q.enqueue(job)
+	}
+	return nil
+}
+
+// AddJobs adds jobs one at a time
+func (q *MemoryQueue) AddJobs(ctx context.Context, jobs []*Job) error {
+	return AddJobsOneByOne(ctx, q, jobs)
+}
+
+// GetJob retrieves a job by ID, reporting a missing one as JobQueue says
+func (q *MemoryQueue) GetJob(ctx context.Context, jobID string) (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	record := q.record(jobID)
+	if record == nil {
+		return nil, missingJob(jobID)
+	}
+	return q.decode(record)
+}
+
+// UpdateJob updates an existing job, checking its version and claim token
+// and incrementing the version as RedisQueue does, and failing with
+// ErrJobNotFound as it does if the record is gone
+func (q *MemoryQueue) UpdateJob(ctx context.Context, job *Job) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if record := q.record(job.ID); record == nil {
+		if err := checkMissing(job); err != nil {
+			return err
+		}
+	} else {
+		stored, err := q.decode(record)
+		if err != nil {
+			return err
+		}
+		if err := checkUpdate(job, stored); err != nil {
+			return err
+		}
+	}
+	job.Version++
+	job.UpdatedAt = q.opts.Clock.Now()
+	return q.store(job)
+}
+
+// GetPendingJobs returns up to limit pending jobs, or all of them if limit
+// isn't positive, of every model, the highest priority first and the newest
+// first within a model's list at a priority, and how many listed IDs have no record, which are
+// removed from the pending lists, as RedisQueue does
+func (q *MemoryQueue) GetPendingJobs(ctx context.Context, limit int) ([]*Job, int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	var jobs []*Job
+	var gone []string
+	listed := 0
+	defer func() {
+		for _, jobID := range gone {
+			q.dequeue(jobID)
+		}
+	}()
+	for _, key := range allPendingNames() {
+		ids := q.pending[key]
+		for i := len(ids) - 1; i >= 0; i-- {
+			if limit > 0 && listed == limit {
+				return jobs, len(gone), nil
+			}
+			listed++
+			record := q.record(ids[i])
+			if record == nil {
+				gone = append(gone, ids[i])
+				continue
+			}
+			job, err := q.decode(record)
+			if err != nil {
+				continue // Skip jobs with errors
+			}
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, len(gone), nil
+}
+
+// ClaimJob takes the oldest pending job of the default model, from the
+// highest priority list that has one, for the worker, or nil if none is
+// pending. Scheduled and retrying jobs that are due are queued first, since
+// no background task promotes them.
+func (q *MemoryQueue) ClaimJob(ctx context.Context, workerID string) (*Job, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if err := q.promoteDue(); err != nil {
+		return nil, err
+	}
+	for _, key := range pendingNames(ModelDefault) {
+		for len(q.pending[key]) > 0 {
+			jobID := q.pending[key][0]
+			q.pending[key] = q.pending[key][1:]
+			record := q.record(jobID)
+			if record == nil {
+				// The job expired while queued; there is nothing left to process
+				continue
+			}
+			q.claims[workerID] = append(q.claims[workerID], jobID)
+			return q.decode(record)
+		}
+	}
+	return nil, nil
+}
+
+// PopPendingJob removes and returns the oldest pending job of the default
+// model, from the highest priority list that has one, or nil if none is
+// pending, leaving no claim behind as RedisQueue.PopPendingJob does
+func (q *MemoryQueue) PopPendingJob(ctx context.Context) (*Job, error) {
+	job, err := q.ClaimJob(ctx, popWorkerID)
+	if err != nil || job == nil {
+		return job, err
+	}
+	return job, q.AckJob(ctx, popWorkerID, job.ID)
+}
+
+// promoteDue queues the scheduled and retrying jobs whose time has come.
+// q.mu must be held.
+func (q *MemoryQueue) promoteDue() error {
+	now := q.opts.Clock.Now()
+	var due []*Job
+	for id, record := range q.records {
+		if record.status != StatusScheduled && record.status != StatusRetrying {
+			continue
+		}
+		if q.record(id) == nil {
+			continue
+		}
+		job, err := q.decode(record)
+		if err != nil {
+			return err
+		}
+		if !job.ScheduledUntil().After(now) {
+			due = append(due, job)
+		}
+	}
+	// Queue the longest due first, as the scheduled set orders them
+	sort.Slice(due, func(i, j int) bool {
+		return due[i].ScheduledUntil().Before(due[j].ScheduledUntil())
+	})
+	for _, job := range due {
+		job.Status = StatusPending
+		job.UpdatedAt = now
+		job.Version++
+		job.EnqueuedAtMs = now.UnixMilli()
+		if err := q.store(job); err != nil {
+			return err
+		}
+		q.enqueue(job)
+	}
+	return nil
+}
+
+// AckJob releases the worker's claim on a job it has finished
+func (q *MemoryQueue) AckJob(ctx context.Context, workerID, jobID string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.claims[workerID] = removeID(q.claims[workerID], jobID)
+	return nil
+}
+
+// NackJob returns a claimed job to its pending list for another worker,
+// reset to pending. A job that finished or expired meanwhile is only
+// released.
+func (q *MemoryQueue) NackJob(ctx context.Context, workerID, jobID string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.claims[workerID] = removeID(q.claims[workerID], jobID)
+	record := q.record(jobID)
+	if record == nil {
+		return nil
+	}
+	switch record.status {
+	case StatusCompleted, StatusFailed, StatusCancelled:
+		return nil
+	}
+	job, err := q.decode(record)
+	if err != nil {
+		return err
+	}
+	job.Status = StatusPending
+	job.UpdatedAt = q.opts.Clock.Now()
+	job.Version++
+	job.EnqueuedAtMs = job.UpdatedAt.UnixMilli()
+	if err := q.store(job); err != nil {
+		return err
+	}
+	q.enqueue(job)
+	return nil
+}
+
+// memoryIndexEntry is a job in a listing by status
+type memoryIndexEntry struct {
+	id          string
+	updatedAtMs int64
+	record      *memoryRecord
+}
+
+// byStatus returns the live jobs with status ordered as RedisQueue's status
+// indexes order them: by last update in milliseconds, then by ID. q.mu must
+// be held.
+func (q *MemoryQueue) byStatus(status JobStatus) []memoryIndexEntry {
+	var entries []memoryIndexEntry
+	for id := range q.records {
+		record := q.record(id)
+		if record == nil || record.status != status {
+			continue
+		}
+		entries = append(entries, memoryIndexEntry{id: id, updatedAtMs: record.updatedAt.UnixMilli(), record: record})
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		if entries[i].updatedAtMs != entries[j].updatedAtMs {
+			return entries[i].updatedAtMs < entries[j].updatedAtMs
+		}
+		return entries[i].id < entries[j].id
+	})
+	return entries
+}
+
+// decodeEntries returns copies of the jobs listed in entries
+func (q *MemoryQueue) decodeEntries(entries []memoryIndexEntry) ([]*Job, error) {
+	jobs := make([]*Job, 0, len(entries))
+	for _, entry := range entries {
+		job, err := q.decode(entry.record)
+		if err != nil {
+			return nil, err
+		}
+		jobs = append(jobs, job)
+	}
+	return jobs, nil
+}
+
+// ListJobs returns up to limit jobs with status from position offset, the
+// longest unchanged first, and how many jobs have the status
+func (q *MemoryQueue) ListJobs(ctx context.Context, status JobStatus, offset, limit int) ([]*Job, int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entries := q.byStatus(status)
+	total := len(entries)
+	if offset > total {
+		offset = total
+	}
+	entries = entries[offset:]
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	jobs, err := q.decodeEntries(entries)
+	return jobs, total, err
+}
+
+// ListJobsAfter returns up to limit jobs with status after the cursor, the
+// longest unchanged first, how many jobs have the status, and the cursor
+// after the last job returned, which is the original cursor if none was
+func (q *MemoryQueue) ListJobsAfter(ctx context.Context, status JobStatus, after JobCursor, limit int) ([]*Job, int, JobCursor, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	entries := q.byStatus(status)
+	total := len(entries)
+	if after.JobID != "" {
+		start := sort.Search(len(entries), func(i int) bool {
+			if entries[i].updatedAtMs != after.UpdatedAtMs {
+				return entries[i].updatedAtMs > after.UpdatedAtMs
+			}
+			return entries[i].id > after.JobID
+		})
+		entries = entries[start:]
+	}
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	if len(entries) > 0 {
+		last := entries[len(entries)-1]
+		after = JobCursor{UpdatedAtMs: last.updatedAtMs, JobID: last.id}
+	}
+	jobs, err := q.decodeEntries(entries)
+	return jobs, total, after, err
+}
+
+// Stats counts the live records by status in one pass. Finished jobs are
+// counted by when their record was last updated.
+func (q *MemoryQueue) Stats(ctx context.Context) (QueueStats, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	now := q.opts.Clock.Now()
+	since := now.Add(-statsWindow)
+	var stats QueueStats
+	var oldest time.Time
+	for id := range q.records {
+		record := q.record(id)
+		if record == nil {
+			continue
+		}
+		switch record.status {
+		case StatusPending:
+			stats.Pending++
+			if oldest.IsZero() || record.updatedAt.Before(oldest) {
+				oldest = record.updatedAt
+			}
+		case StatusProcessing:
+			stats.Processing++
+		case StatusCompleted:
+			if record.updatedAt.After(since) {
+				stats.CompletedLastHour++
+			}
+		case StatusFailed:
+			if record.updatedAt.After(since) {
+				stats.FailedLastHour++
+			}
+		}
+	}
+	if !oldest.IsZero() {
+		stats.OldestPendingAgeMs = pendingAge(now, oldest.UnixMilli())
+	}
+	return stats, nil
+}
+
+// CancelJob cancels a job as RedisQueue.CancelJob does: one waiting to run
+// is taken off its queue and marked cancelled at once, and one being
+// processed is flagged for its worker to stop. It fails with
+// ErrJobNotFound or ErrJobFinished.
+func (q *MemoryQueue) CancelJob(ctx context.Context, jobID string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	record := q.record(jobID)
+	if record == nil {
+		return ErrJobNotFound
+	}
+	switch record.status {
+	case StatusCompleted, StatusFailed, StatusCancelled:
+		return ErrJobFinished
+	case StatusProcessing:
+		q.cancels[jobID] = true
+		return nil
+	}
+
+	job, err := q.decode(record)
+	if err != nil {
+		return err
+	}
+	job.Status = StatusCancelled
+	job.UpdatedAt = q.opts.Clock.Now()
+	job.Version++
+	for i := range job.Deliveries {
+		if job.Deliveries[i].Status == DeliveryPending {
+			job.Deliveries[i].Status = DeliveryFailed
+			job.Deliveries[i].LastError = cancelledDeliveryError
+		}
+	}
+	if err := q.store(job); err != nil {
+		return err
+	}
+	q.cancels[jobID] = true
+	q.dequeue(jobID)
+	return nil
+}
+
+// DeleteJob removes a job's record and takes it off its queue, as
+// RedisQueue.DeleteJob does. It fails with ErrJobNotFound.
+func (q *MemoryQueue) DeleteJob(ctx context.Context, jobID string) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.record(jobID) == nil {
+		return ErrJobNotFound
+	}
+	delete(q.records, jobID)
+	delete(q.cancels, jobID)
+	q.dequeue(jobID)
+	return nil
+}
+
+// CancelRequested reports whether the job was asked to stop
+func (q *MemoryQueue) CancelRequested(ctx context.Context, jobID string) (bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	return q.record(jobID) != nil && q.cancels[jobID], nil
+}
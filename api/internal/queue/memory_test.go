@@ -0,0 +1,95 @@
+package queue_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"rembg-v2/api/internal/queue"
+	"rembg-v2/api/internal/queue/queuetest"
+)
+
+// manualClock is a Clock that moves only when told to
+type manualClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestMemoryQueueConformance(t *testing.T) {
+	queuetest.RunConformanceTests(t, func() queue.JobQueue {
+		return queue.NewMemoryQueue(queue.Options{})
+	})
+}
+
+func TestMemoryQueuePopPendingJob(t *testing.T) {
+	q := queue.NewMemoryQueue(queue.Options{})
+	defer q.Close()
+	ctx := context.Background()
+	for _, job := range []*queue.Job{
+		{ID: "normal"},
+		{ID: "high", Priority: queue.PriorityHigh},
+	} {
+		if err := q.AddJob(ctx, job); err != nil {
+			t.Fatalf("AddJob: %v", err)
+		}
+	}
+	for _, want := range []string{"high", "normal"} {
+		job, err := q.PopPendingJob(ctx)
+		if err != nil || job == nil || job.ID != want {
+			t.Fatalf("PopPendingJob: got %v, %v, want %s", job, err, want)
+		}
+	}
+	if job, err := q.PopPendingJob(ctx); err != nil || job != nil {
+		t.Fatalf("PopPendingJob on a drained queue: %v, %v", job, err)
+	}
+}
+
+func TestMemoryQueueRemovesExpiredRecords(t *testing.T) {
+	clock := &manualClock{now: time.Now()}
+	q := queue.NewMemoryQueue(queue.Options{Clock: clock, PendingTTL: time.Hour, CompletedTTL: time.Minute})
+	defer q.Close()
+	ctx := context.Background()
+	for _, id := range []string{"finished", "waiting"} {
+		if err := q.AddJob(ctx, &queue.Job{ID: id}); err != nil {
+			t.Fatalf("AddJob: %v", err)
+		}
+	}
+	completed, err := q.ClaimJob(ctx, "worker-1")
+	if err != nil || completed == nil || completed.ID != "finished" {
+		t.Fatalf("ClaimJob: %v, %v", completed, err)
+	}
+	completed.Status = queue.StatusCompleted
+	if err := q.UpdateJob(ctx, completed); err != nil {
+		t.Fatalf("UpdateJob: %v", err)
+	}
+
+	clock.Advance(2 * time.Minute)
+	if removed := q.RemoveExpired(); removed != 1 {
+		t.Fatalf("RemoveExpired removed %d records, want the completed one", removed)
+	}
+	if job, err := q.GetJob(ctx, "finished"); !queue.JobMissing(job, err) {
+		t.Fatalf("completed job kept past its TTL: %v, %v", job, err)
+	}
+	if job, err := q.GetJob(ctx, "waiting"); err != nil || job == nil {
+		t.Fatalf("pending job removed before its TTL: %v, %v", job, err)
+	}
+
+	// An expired job queued on a pending list is never claimed
+	clock.Advance(time.Hour)
+	if job, err := q.ClaimJob(ctx, "worker-1"); err != nil || job != nil {
+		t.Fatalf("claimed an expired job: %v, %v", job, err)
+	}
+}
@@ -0,0 +1,444 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Migration is a numbered, idempotent change to the data stored in Redis.
+// Run returns the number of keys it changed (or would change in dry-run mode).
+type Migration struct {
+	Version int
+	Name    string
+	Run     func(ctx context.Context, q *RedisQueue, dryRun bool) (int, error)
+}
+
+// MigrationResult reports the outcome of a single migration
+type MigrationResult struct {
+	Version int    `json:"version"`
+	Name    string `json:"name"`
+	Changed int    `json:"changed"`
+	DryRun  bool   `json:"dry_run"`
+}
+
+// migrationLockTTL bounds how long a crashed runner can hold the lock
+const migrationLockTTL = 5 * time.Minute
+
+// migrationScanBatch is the SCAN COUNT hint used by migrations
+const migrationScanBatch = 500
+
+// migrations is the ordered list of known migrations
+var migrations = []Migration{
+	{Version: 1, Name: "backfill_job_created_at", Run: migrateBackfillCreatedAt},
+	{Version: 2, Name: "index_api_key_ids", Run: migrateIndexAPIKeyIDs},
+	{Version: 3, Name: "index_job_statuses", Run: migrateIndexJobStatuses},
+	{Version: 4, Name: "job_hashes_to_records", Run: migrateJobHashes},
+	{Version: 5, Name: "legacy_pending_to_priority_lists", Run: migrateLegacyPending},
+}
+
+// schemaVersionKey returns the Redis key holding the applied schema version
+func (k redisKeys) schemaVersionKey() string {
+	return k.prefix + "schema_version"
+}
+
+// migrationCursorKey returns the Redis hash holding SCAN cursors of unfinished migrations
+func (k redisKeys) migrationCursorKey() string {
+	return k.prefix + "schema_migration_cursors"
+}
+
+// SchemaVersion returns the currently applied schema version
+func (q *RedisQueue) SchemaVersion(ctx context.Context) (int, error) {
+	version, err := q.client.Get(ctx, q.schemaVersionKey()).Int()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return version, err
+}
+
+// Migrate applies all pending migrations in order under a Redis lock. In
+// dry-run mode nothing is written and the results report what would change.
+func (q *RedisQueue) Migrate(ctx context.Context, dryRun bool) ([]MigrationResult, error) {
+	// Wait for any other runner to finish
+	lock, err := q.Lock(ctx, "schema_migrations", migrationLockTTL)
+	if err != nil {
+		return nil, err
+	}
+	defer lock.Release(context.Background())
+
+	current, err := q.SchemaVersion(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	pending := make([]Migration, 0, len(migrations))
+	for _, m := range migrations {
+		if m.Version > current {
+			pending = append(pending, m)
+		}
+	}
+	sort.Slice(pending, func(i, j int) bool { return pending[i].Version < pending[j].Version })
+
+	var results []MigrationResult
+	for _, m := range pending {
+		changed, err := m.Run(ctx, q, dryRun)
+		if err != nil {
+			return results, fmt.Errorf("migration %d (%s): %w", m.Version, m.Name, err)
+		}
+
+		results = append(results, MigrationResult{
+			Version: m.Version,
+			Name:    m.Name,
+			Changed: changed,
+			DryRun:  dryRun,
+		})
+
+		if dryRun {
+			continue
+		}
+
+		if err := q.client.Set(ctx, q.schemaVersionKey(), m.Version, 0).Err(); err != nil {
+			return results, err
+		}
+		log.Printf("Applied migration %d (%s), %d keys changed", m.Version, m.Name, changed)
+	}
+
+	return results, nil
+}
+
+// scanForMigration iterates keys matching pattern, resuming from the cursor
+// saved by a previous interrupted run of the same migration
+func (q *RedisQueue) scanForMigration(ctx context.Context, version int, pattern string, dryRun bool, fn func(key string) error) error {
+	field := strconv.Itoa(version)
+
+	keyspace, err := q.keyspace(ctx)
+	if err != nil {
+		return err
+	}
+
+	var cursor uint64
+	if !dryRun {
+		saved, err := q.client.HGet(ctx, q.migrationCursorKey(), field).Uint64()
+		if err != nil && err != redis.Nil {
+			return err
+		}
+		cursor = saved
+	}
+
+	for {
+		keys, next, err := keyspace.Scan(ctx, cursor, pattern, migrationScanBatch).Result()
+		if err != nil {
+			return err
+		}
+
+		for _, key := range keys {
+			if err := fn(key); err != nil {
+				return err
+			}
+		}
+
+		if next == 0 {
+			break
+		}
+		cursor = next
+
+		if !dryRun {
+			if err := q.client.HSet(ctx, q.migrationCursorKey(), field, cursor).Err(); err != nil {
+				return err
+			}
+		}
+	}
+
+	if dryRun {
+		return nil
+	}
+	return q.client.HDel(ctx, q.migrationCursorKey(), field).Err()
+}
+
+// migrateBackfillCreatedAt sets created_at on job records rewritten by older
+// workers, which dropped the field and broke every duration derived from it
+func migrateBackfillCreatedAt(ctx context.Context, q *RedisQueue, dryRun bool) (int, error) {
+	changed := 0
+	err := q.scanForMigration(ctx, 1, q.jobKey("*"), dryRun, func(key string) error {
+		data, err := q.client.Get(ctx, key).Bytes()
+		if err != nil {
+			if errors.Is(err, redis.Nil) || wrongType(err) {
+				return nil // Expired since the scan returned it, or a hash migration 4 converts
+			}
+			return err
+		}
+
+		var job Job
+		if err := q.opts.Codec.Decode(data, &job); err != nil {
+			return nil // Not a job record we understand, leave it alone
+		}
+		if !job.CreatedAt.IsZero() {
+			return nil
+		}
+
+		changed++
+		if dryRun {
+			return nil
+		}
+
+		job.CreatedAt = job.UpdatedAt
+		jobJSON, err := q.opts.Codec.Encode(&job)
+		if err != nil {
+			return err
+		}
+		return q.client.Set(ctx, key, jobJSON, redis.KeepTTL).Err()
+	})
+	return changed, err
+}
+
+// migrateIndexAPIKeyIDs indexes the API keys issued before keys were
+// indexed by ID, so they can be looked up by ID; rotated keys' entries
+// expire with them
+func migrateIndexAPIKeyIDs(ctx context.Context, q *RedisQueue, dryRun bool) (int, error) {
+	changed := 0
+	err := q.scanForMigration(ctx, 2, q.apiKeyKey("*"), dryRun, func(key string) error {
+		fields, err := q.client.HMGet(ctx, key, "id", "expires_at").Result()
+		if err != nil {
+			return err
+		}
+		id, _ := fields[0].(string)
+		if id == "" {
+			return nil // Expired since the scan returned it
+		}
+		indexed, err := q.client.Exists(ctx, q.apiKeyIDKey(id)).Result()
+		if err != nil || indexed > 0 {
+			return err
+		}
+
+		changed++
+		if dryRun {
+			return nil
+		}
+		hash := strings.TrimPrefix(key, q.apiKeyKey(""))
+		pipe := q.client.TxPipeline()
+		pipe.Set(ctx, q.apiKeyIDKey(id), hash, 0)
+		if expiresAt, _ := fields[1].(string); expiresAt != "" {
+			if at := parseMillis(expiresAt); !at.IsZero() {
+				pipe.PExpireAt(ctx, q.apiKeyIDKey(id), at)
+			}
+		}
+		_, err = pipe.Exec(ctx)
+		return err
+	})
+	return changed, err
+}
+
+// migrateIndexJobStatuses adds the jobs stored before jobs were indexed by
+// status to the index of their status
+func migrateIndexJobStatuses(ctx context.Context, q *RedisQueue, dryRun bool) (int, error) {
+	changed := 0
+	err := q.scanForMigration(ctx, 3, q.jobKey("*"), dryRun, func(key string) error {
+		data, err := q.client.Get(ctx, key).Bytes()
+		if err != nil {
+			if errors.Is(err, redis.Nil) || wrongType(err) {
+				return nil // Expired since the scan returned it, or a hash migration 4 converts
+			}
+			return err
+		}
+
+		var job Job
+		if err := q.opts.Codec.Decode(data, &job); err != nil || !ValidStatus(job.Status) {
+			return nil // Not a job record we understand, leave it alone
+		}
+		_, err = q.client.ZScore(ctx, q.statusIndexKey(job.Status), job.ID).Result()
+		if err != redis.Nil {
+			return err
+		}
+
+		changed++
+		if dryRun {
+			return nil
+		}
+		pipe := q.client.TxPipeline()
+		q.indexStatus(ctx, pipe, &job)
+		_, err = pipe.Exec(ctx)
+		return err
+	})
+	return changed, err
+}
+
+// migrateJobHashes rewrites job records stored as hashes, one field per
+// JSON field, by versions before job records were encoded by the codec.
+// Reads of those records failed, so each is also given the created_at and
+// status index entry migrations 1 and 3 skipped it for.
+func migrateJobHashes(ctx context.Context, q *RedisQueue, dryRun bool) (int, error) {
+	changed := 0
+	err := q.scanForMigration(ctx, 4, q.jobKey("*"), dryRun, func(key string) error {
+		kind, err := q.client.Type(ctx, key).Result()
+		if err != nil || kind != "hash" {
+			return err
+		}
+		fields, err := q.client.HGetAll(ctx, key).Result()
+		if err != nil || len(fields) == 0 {
+			return err // Expired since the scan returned it
+		}
+		var job Job
+		if err := decodeJobHash(fields, &job); err != nil {
+			log.Printf("Leaving job record %s as it is: %v", key, err)
+			return nil
+		}
+
+		changed++
+		if dryRun {
+			return nil
+		}
+		if job.CreatedAt.IsZero() {
+			job.CreatedAt = job.UpdatedAt
+		}
+		record, err := q.opts.Codec.Encode(&job)
+		if err != nil {
+			return err
+		}
+		ttl, err := q.client.PTTL(ctx, key).Result()
+		if err != nil {
+			return err
+		}
+		if ttl < 0 {
+			ttl = 0
+		}
+		pipe := q.client.TxPipeline()
+		pipe.Del(ctx, key)
+		pipe.Set(ctx, key, record, ttl)
+		if ValidStatus(job.Status) {
+			q.indexStatus(ctx, pipe, &job)
+		}
+		_, err = pipe.Exec(ctx)
+		return err
+	})
+	return changed, err
+}
+
+// jobStringFields names the job's JSON fields holding strings, which hash
+// records stored unquoted
+var jobStringFields = func() map[string]bool {
+	fields := make(map[string]bool)
+	t := reflect.TypeOf(Job{})
+	for i := 0; i < t.NumField(); i++ {
+		if f := t.Field(i); f.Type.Kind() == reflect.String {
+			name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+			fields[name] = true
+		}
+	}
+	return fields
+}()
+
+// decodeJobHash reads a job record stored as a hash into job. String
+// fields hold their values as they are, and the rest hold JSON, except
+// timestamps, which may be bare.
+func decodeJobHash(fields map[string]string, job *Job) error {
+	if fields["id"] == "" {
+		return errors.New("no job ID")
+	}
+	values := make(map[string]json.RawMessage, len(fields))
+	for name, value := range fields {
+		if jobStringFields[name] || !json.Valid([]byte(value)) {
+			quoted, err := json.Marshal(value)
+			if err != nil {
+				return err
+			}
+			values[name] = quoted
+		} else {
+			values[name] = json.RawMessage(value)
+		}
+	}
+	data, err := json.Marshal(values)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, job)
+}
+
+// wrongType reports whether err is Redis refusing a command for the type
+// of value its key holds
+func wrongType(err error) bool {
+	var reply redis.Error
+	return errors.As(err, &reply) && strings.HasPrefix(reply.Error(), "WRONGTYPE")
+}
+
+// migrationMoveRetries bounds how often moving one job out of the legacy
+// pending list is retried while workers change the list under it
+const migrationMoveRetries = 10
+
+// migrateLegacyPending moves pending jobs out of the original pending list,
+// which versions before models and priorities had their own lists queued
+// every job on, into the list they're claimed from now: their model's and
+// priority's, their owner's with SchedulingFair, or their pending stream
+// with PendingStreams. Each job moves atomically, so a rerun after an
+// interruption picks up the jobs still left in the list.
+func migrateLegacyPending(ctx context.Context, q *RedisQueue, dryRun bool) (int, error) {
+	legacy := q.pendingKey(ModelDefault, PriorityNormal)
+	// A snapshot, since moving jobs shifts the list's indexes
+	jobIDs, err := q.client.LRange(ctx, legacy, 0, -1).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	changed := 0
+	// Oldest first, so the moved jobs keep their order in their new lists
+	for i := len(jobIDs) - 1; i >= 0; i-- {
+		job, err := q.GetJob(ctx, jobIDs[i])
+		if errors.Is(err, ErrJobNotFound) || wrongType(err) {
+			continue // Skipped by workers when popped
+		}
+		if err != nil {
+			return changed, err
+		}
+		if job.Status != StatusPending || (!q.opts.PendingStreams && q.pendingList(job) == legacy) {
+			continue
+		}
+		if dryRun {
+			changed++
+			continue
+		}
+		moved, err := q.moveFromLegacyPending(ctx, legacy, job)
+		if err != nil {
+			return changed, err
+		}
+		if moved {
+			changed++
+		}
+	}
+	return changed, nil
+}
+
+// moveFromLegacyPending removes the job from the legacy pending list and
+// queues it where it belongs in one transaction, returning false if a
+// worker claimed it first
+func (q *RedisQueue) moveFromLegacyPending(ctx context.Context, legacy string, job *Job) (bool, error) {
+	for i := 0; i < migrationMoveRetries; i++ {
+		moved := false
+		err := q.client.Watch(ctx, func(tx *redis.Tx) error {
+			if err := tx.LPos(ctx, legacy, job.ID, redis.LPosArgs{}).Err(); err != nil {
+				if errors.Is(err, redis.Nil) {
+					return nil
+				}
+				return err
+			}
+			_, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+				pipe.LRem(ctx, legacy, 1, job.ID)
+				q.enqueue(ctx, pipe, job)
+				return nil
+			})
+			moved = err == nil
+			return err
+		}, legacy)
+		if !errors.Is(err, redis.TxFailedErr) {
+			return moved, err
+		}
+	}
+	return false, fmt.Errorf("moving job %s: the pending list kept changing", job.ID)
+}
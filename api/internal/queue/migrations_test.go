@@ -0,0 +1,247 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// pagingScan is a client hook paging SCAN replies by their COUNT, which
+// miniredis ignores, returning every key at once. The cursor is the index
+// of the next key in the sorted keyspace.
+type pagingScan struct{}
+
+func (pagingScan) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (pagingScan) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		scan, ok := cmd.(*redis.ScanCmd)
+		if !ok || cmd.Name() != "scan" {
+			return next(ctx, cmd)
+		}
+		args := cmd.Args()
+		cursor, _ := args[1].(uint64)
+		count, _ := args[len(args)-1].(int64)
+		args[1] = 0
+		if err := next(ctx, cmd); err != nil {
+			return err
+		}
+		keys, _ := scan.Val()
+		end := cursor + uint64(count)
+		if end >= uint64(len(keys)) {
+			scan.SetVal(keys[cursor:], 0)
+		} else {
+			scan.SetVal(keys[cursor:end], end)
+		}
+		return nil
+	}
+}
+
+func (pagingScan) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return next
+}
+
+// addJobHash stores a job record as a hash, as versions before the codec did
+func addJobHash(t *testing.T, server *miniredis.Miniredis, q *RedisQueue, fields map[string]string) {
+	t.Helper()
+	for field, value := range fields {
+		server.HSet(q.jobKey(fields["id"]), field, value)
+	}
+}
+
+// oldFormatFixtures stores a string record from before created_at, two
+// hash records, and a pending list holding jobs queued before models and
+// priorities had lists of their own
+func oldFormatFixtures(t *testing.T, server *miniredis.Miniredis, q *RedisQueue) {
+	t.Helper()
+	server.Set(q.jobKey("string-job"), `{"id":"string-job","status":"completed","input_path":"in.png","updated_at":"2024-03-01T12:00:00Z"}`)
+	addJobHash(t, server, q, map[string]string{
+		"id":           "1234",
+		"status":       "pending",
+		"input_path":   "uploads/1234.png",
+		"updated_at":   "2024-03-01T12:00:00Z",
+		"options":      `{"bg_color":"#ffffff"}`,
+		"max_attempts": "3",
+		"priority":     PriorityHigh,
+	})
+	addJobHash(t, server, q, map[string]string{
+		"id":         "hash-job",
+		"status":     "completed",
+		"input_path": "uploads/hash-job.png",
+		"created_at": "2024-02-29T08:00:00Z",
+		"updated_at": "2024-03-01T12:00:00Z",
+	})
+	server.SetTTL(q.jobKey("hash-job"), time.Hour)
+	for _, job := range []*Job{
+		{ID: "portrait-job", Status: StatusPending, Model: ModelPortrait},
+		{ID: "normal-job", Status: StatusPending},
+	} {
+		data, err := q.opts.Codec.Encode(job)
+		if err != nil {
+			t.Fatalf("Encode: %v", err)
+		}
+		server.Set(q.jobKey(job.ID), string(data))
+	}
+	// Oldest last, as LPUSH leaves them
+	for _, jobID := range []string{"1234", "portrait-job", "normal-job", "gone-job"} {
+		server.Lpush(q.pendingKey(ModelDefault, PriorityNormal), jobID)
+	}
+}
+
+func TestMigrateDryRunChangesNothing(t *testing.T) {
+	q, server := newTestRedisQueue(t, Options{})
+	oldFormatFixtures(t, server, q)
+	before := server.Dump()
+
+	results, err := q.Migrate(context.Background(), true)
+	if err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	changed := make(map[string]int)
+	for _, r := range results {
+		if !r.DryRun {
+			t.Fatalf("migration %d reported as applied in a dry run", r.Version)
+		}
+		changed[r.Name] = r.Changed
+	}
+	// Only the portrait job counts as moving: the high-priority job moves
+	// once its hash is a record, which a dry run never makes it
+	want := map[string]int{
+		"backfill_job_created_at":          3,
+		"index_api_key_ids":                0,
+		"index_job_statuses":               3,
+		"job_hashes_to_records":            2,
+		"legacy_pending_to_priority_lists": 1,
+	}
+	if fmt.Sprint(changed) != fmt.Sprint(want) {
+		t.Fatalf("dry run changes = %v, want %v", changed, want)
+	}
+	if after := server.Dump(); after != before {
+		t.Fatalf("dry run changed the data:\n%s\nwant\n%s", after, before)
+	}
+}
+
+func TestMigrateOldFormatFixtures(t *testing.T) {
+	q, server := newTestRedisQueue(t, Options{})
+	oldFormatFixtures(t, server, q)
+	ctx := context.Background()
+
+	if _, err := q.Migrate(ctx, false); err != nil {
+		t.Fatalf("Migrate: %v", err)
+	}
+	if version, err := q.SchemaVersion(ctx); err != nil || version != len(migrations) {
+		t.Fatalf("SchemaVersion = %d, %v, want %d", version, err, len(migrations))
+	}
+
+	job, err := q.GetJob(ctx, "1234")
+	if err != nil {
+		t.Fatalf("GetJob of a hash record: %v", err)
+	}
+	if job.ID != "1234" || job.Options["bg_color"] != "#ffffff" || job.MaxAttempts != 3 || !job.CreatedAt.Equal(job.UpdatedAt) {
+		t.Fatalf("hash record read back as %+v", job)
+	}
+	job, err = q.GetJob(ctx, "hash-job")
+	if err != nil {
+		t.Fatalf("GetJob of a hash record: %v", err)
+	}
+	if want := time.Date(2024, 2, 29, 8, 0, 0, 0, time.UTC); !job.CreatedAt.Equal(want) {
+		t.Fatalf("created_at = %v, want %v", job.CreatedAt, want)
+	}
+	if ttl := server.TTL(q.jobKey("hash-job")); ttl != time.Hour {
+		t.Fatalf("TTL of the converted record = %v, want its hour kept", ttl)
+	}
+	if job, err := q.GetJob(ctx, "string-job"); err != nil || job.CreatedAt.IsZero() {
+		t.Fatalf("string record read back as %+v, %v, want created_at backfilled", job, err)
+	}
+	completed, _, err := q.ListJobs(ctx, StatusCompleted, 0, 10)
+	if err != nil || len(completed) != 2 {
+		t.Fatalf("ListJobs(completed) = %d jobs, %v, want both completed records indexed", len(completed), err)
+	}
+
+	for key, want := range map[string][]string{
+		q.pendingKey(ModelDefault, PriorityNormal):  {"gone-job", "normal-job"},
+		q.pendingKey(ModelDefault, PriorityHigh):    {"1234"},
+		q.pendingKey(ModelPortrait, PriorityNormal): {"portrait-job"},
+	} {
+		got, _ := server.List(key)
+		if fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Fatalf("%s = %v, want %v", key, got, want)
+		}
+	}
+
+	// Idempotent: rerunning the new migrations finds nothing left to do
+	for _, m := range migrations[3:] {
+		if changed, err := m.Run(ctx, q, false); err != nil || changed != 0 {
+			t.Fatalf("rerun of %s changed %d, %v, want nothing", m.Name, changed, err)
+		}
+	}
+}
+
+func TestMigrateLegacyPendingToOwnerLists(t *testing.T) {
+	q, server := newTestRedisQueue(t, Options{Scheduling: SchedulingFair})
+	ctx := context.Background()
+	data, _ := q.opts.Codec.Encode(&Job{ID: "job-1", Status: StatusPending, Owner: "alice"})
+	server.Set(q.jobKey("job-1"), string(data))
+	server.Lpush(q.pendingKey(ModelDefault, PriorityNormal), "job-1")
+
+	if changed, err := migrateLegacyPending(ctx, q, false); err != nil || changed != 1 {
+		t.Fatalf("migrateLegacyPending = %d, %v, want 1 job moved", changed, err)
+	}
+	claimed, err := q.ClaimJob(ctx, "worker-1")
+	if err != nil || claimed == nil || claimed.ID != "job-1" {
+		t.Fatalf("ClaimJob after the move = %+v, %v, want job-1", claimed, err)
+	}
+}
+
+func TestMigrationResumesFromSavedCursor(t *testing.T) {
+	server := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: server.Addr()})
+	client.AddHook(pagingScan{})
+	q, err := NewRedisQueueWithClient(client, Options{})
+	if err != nil {
+		t.Fatalf("NewRedisQueueWithClient: %v", err)
+	}
+	t.Cleanup(func() { q.Close() })
+	ctx := context.Background()
+	const total = 3 * migrationScanBatch
+	for i := 0; i < total; i++ {
+		addJobHash(t, server, q, map[string]string{"id": fmt.Sprintf("job-%04d", i), "status": "completed"})
+	}
+
+	// A run interrupted once its first batch is done and its cursor saved
+	errInterrupted := errors.New("interrupted")
+	var done []string
+	err = q.scanForMigration(ctx, 4, q.jobKey("*"), false, func(key string) error {
+		if server.Exists(q.migrationCursorKey()) {
+			return errInterrupted
+		}
+		done = append(done, key)
+		return nil
+	})
+	if !errors.Is(err, errInterrupted) || len(done) == 0 || len(done) == total {
+		t.Fatalf("interrupted scan = %v after %d keys, want it stopped between batches", err, len(done))
+	}
+
+	changed, err := migrateJobHashes(ctx, q, false)
+	if err != nil {
+		t.Fatalf("migrateJobHashes: %v", err)
+	}
+	if changed != total-len(done) {
+		t.Fatalf("resumed migration changed %d records, want the %d after the saved cursor", changed, total-len(done))
+	}
+	for _, key := range done {
+		if kind := server.Type(key); kind != "hash" {
+			t.Fatalf("%s before the saved cursor is a %s, want it not visited again", key, kind)
+		}
+	}
+	if server.Exists(q.migrationCursorKey()) {
+		t.Fatalf("cursor left behind by a finished migration")
+	}
+}
@@ -0,0 +1,85 @@
+package queue
+
+// Models workers can load
+const (
+	// ModelDefault is the general-purpose model used unless a job asks otherwise
+	ModelDefault = "u2net"
+	// ModelPortrait is tuned for people
+	ModelPortrait = "u2net_human_seg"
+	// ModelProduct is tuned for objects on plain backgrounds
+	ModelProduct = "isnet-general-use"
+	// ModelAuto lets the worker pick a model from the image content
+	ModelAuto = "auto"
+)
+
+// Models lists the models a job can request explicitly
+var Models = []string{ModelDefault, ModelPortrait, ModelProduct}
+
+// ModelSelection records the model a worker picked for an auto job
+type ModelSelection struct {
+	Model      string  `json:"model"`
+	Confidence float64 `json:"confidence"`
+	Reason     string  `json:"reason,omitempty"`
+}
+
+// modelQueueName returns the pending list, without the queue's key prefix,
+// for jobs requesting a model. Default-model jobs keep using the original
+// list, so workers that predate model routing still claim them; auto jobs
+// get a list of their own that only workers with every model loaded claim.
+func modelQueueName(model string) string {
+	if model == "" || model == ModelDefault {
+		return queueName
+	}
+	return queueName + ":" + model
+}
+
+// queuedModels lists every model with pending lists of its own, auto first
+func queuedModels() []string {
+	return append([]string{ModelAuto}, Models...)
+}
+
+// allPendingNames returns every model's pending lists, without the queue's
+// key prefix, highest priority first
+func allPendingNames() []string {
+	models := queuedModels()
+	names := make([]string, 0, len(Priorities)*len(models))
+	for _, p := range Priorities {
+		for _, model := range models {
+			names = append(names, pendingName(model, p))
+		}
+	}
+	return names
+}
+
+// allPendingKeys returns every model's pending lists, highest priority first
+func (k redisKeys) allPendingKeys() []string {
+	return k.prefixed(allPendingNames())
+}
+
+// claimableModels returns the models whose jobs a worker with models loaded
+// may claim: those, after auto if it has every model, as the processor does
+func claimableModels(models []string) []string {
+	claimable := []string{}
+	if hb := (WorkerHeartbeat{Models: models}); hb.HasAllModels() {
+		claimable = append(claimable, ModelAuto)
+	}
+	for _, m := range models {
+		if m != ModelAuto {
+			claimable = append(claimable, m)
+		}
+	}
+	return claimable
+}
+
+// IsModel reports whether name is a model a job can request, including auto
+func IsModel(name string) bool {
+	if name == ModelAuto {
+		return true
+	}
+	for _, m := range Models {
+		if m == name {
+			return true
+		}
+	}
+	return false
+}
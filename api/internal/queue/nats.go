@@ -0,0 +1,687 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/nats-io/nats.go"
+	"github.com/nats-io/nats.go/jetstream"
+)
+
+const (
+	// natsStream is the work-queue stream of pending job IDs
+	natsStream = "RMBG_PENDING"
+	// natsJobsBucket is the key-value bucket of job records
+	natsJobsBucket = "rmbg_jobs"
+	// natsSweepInterval is how often NATSQueue removes expired records
+	natsSweepInterval = time.Minute
+	// DefaultNATSAckWait is how long a claimed job stays with its worker
+	// unless NATSConfig says otherwise
+	DefaultNATSAckWait = 5 * time.Minute
+)
+
+// NATSConfig configures a NATSQueue
+type NATSConfig struct {
+	// URL is the NATS server, or a comma-separated list of servers
+	URL string
+	// AckWait is how long a claimed job stays with its worker; one not
+	// acknowledged in time is delivered to another
+	AckWait time.Duration
+}
+
+// natsSubject returns the subject jobs queued at a priority are published on
+func natsSubject(priority string) string {
+	if !IsPriority(priority) {
+		priority = PriorityNormal
+	}
+	return "rmbg.pending." + priority
+}
+
+// natsJobKey returns the bucket key of a job's record
+func natsJobKey(jobID string) string {
+	return "job." + jobID
+}
+
+// natsCancelKey returns the bucket key that, until the time it holds in
+// Unix milliseconds, tells workers to stop the job
+func natsCancelKey(jobID string) string {
+	return "cancel." + jobID
+}
+
+// NATSQueue implements JobQueue on NATS JetStream. Pending job IDs are
+// published to a work-queue stream with a subject per priority, each with
+// its own durable pull consumer that ClaimJob drains highest first, and job
+// records live in a key-value bucket. Buckets expire keys only all at the
+// same age, so each record expires by its status's TTL as a RedisQueue's
+// would: reads ignore expired records and a background sweep deletes them.
+// The connection reconnects on its own; calls fail while it's down.
+type NATSQueue struct {
+	conn      *nats.Conn
+	js        jetstream.JetStream
+	kv        jetstream.KeyValue
+	consumers []jetstream.Consumer
+	opts      Options
+
+	mu sync.Mutex
+	// claims holds the messages of claimed jobs by worker and job ID
+	claims map[string]map[string]jetstream.Msg
+
+	stop      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewNATSQueue connects to NATS, creating or updating the stream,
+// consumers, and bucket the queue uses, and starts sweeping expired records
+// until it's closed
+func NewNATSQueue(cfg NATSConfig, opts Options) (*NATSQueue, error) {
+	opts.setDefaults()
+	if cfg.AckWait <= 0 {
+		cfg.AckWait = DefaultNATSAckWait
+	}
+
+	conn, err := nats.Connect(cfg.URL,
+		nats.Name("rmbg-api"),
+		nats.MaxReconnects(-1),
+		nats.DisconnectErrHandler(func(_ *nats.Conn, err error) {
+			if err != nil {
+				log.Printf("Disconnected from NATS: %v", err)
+			}
+		}),
+		nats.ReconnectHandler(func(c *nats.Conn) {
+			log.Printf("Reconnected to NATS at %s", c.ConnectedUrl())
+		}),
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	q, err := newNATSQueue(ctx, conn, cfg, opts)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	go q.sweep()
+	return q, nil
+}
+
+// newNATSQueue sets up the queue's stream, consumers, and bucket on conn
+func newNATSQueue(ctx context.Context, conn *nats.Conn, cfg NATSConfig, opts Options) (*NATSQueue, error) {
+	js, err := jetstream.New(conn)
+	if err != nil {
+		return nil, err
+	}
+	_, err = js.CreateOrUpdateStream(ctx, jetstream.StreamConfig{
+		Name:      natsStream,
+		Subjects:  []string{"rmbg.pending.*"},
+		Retention: jetstream.WorkQueuePolicy,
+		Storage:   jetstream.FileStorage,
+	})
+	if err != nil {
+		return nil, err
+	}
+	q := &NATSQueue{
+		conn:   conn,
+		js:     js,
+		opts:   opts,
+		claims: make(map[string]map[string]jetstream.Msg),
+		stop:   make(chan struct{}),
+	}
+	for _, priority := range Priorities {
+		consumer, err := js.CreateOrUpdateConsumer(ctx, natsStream, jetstream.ConsumerConfig{
+			Durable:       "workers_" + priority,
+			FilterSubject: natsSubject(priority),
+			AckPolicy:     jetstream.AckExplicitPolicy,
+			AckWait:       cfg.AckWait,
+		})
+		if err != nil {
+			return nil, err
+		}
+		q.consumers = append(q.consumers, consumer)
+	}
+	q.kv, err = js.CreateOrUpdateKeyValue(ctx, jetstream.KeyValueConfig{
+		Bucket:  natsJobsBucket,
+		History: 1,
+		Storage: jetstream.FileStorage,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Close stops the sweep and closes the connection
+func (q *NATSQueue) Close() error {
+	q.closeOnce.Do(func() {
+		close(q.stop)
+		q.conn.Close()
+	})
+	return nil
+}
+
+// Ping reports whether the connection to NATS is up
+func (q *NATSQueue) Ping(ctx context.Context) error {
+	if !q.conn.IsConnected() {
+		return nats.ErrConnectionClosed
+	}
+	return q.conn.FlushWithContext(ctx)
+}
+
+// JobExpiresAt returns when the job's record is removed, as for RedisQueue
+func (q *NATSQueue) JobExpiresAt(job *Job) time.Time {
+	return q.opts.jobExpiresAt(job)
+}
+
+// expired reports whether the job's record is past its expiry
+func (q *NATSQueue) expired(job *Job) bool {
+	at := q.opts.jobExpiresAt(job)
+	if job.Retention != nil {
+		at = at.Add(RetentionGrace)
+	}
+	return !q.opts.Clock.Now().Before(at)
+}
+
+// get reads a job's record and its revision, or nil if it's missing or expired
+func (q *NATSQueue) get(ctx context.Context, jobID string) (*Job, uint64, error) {
+	entry, err := q.kv.Get(ctx, natsJobKey(jobID))
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return nil, 0, nil
+	}
+	if err != nil {
+		return nil, 0, err
+	}
+	var job Job
+	if err := q.opts.Codec.Decode(entry.Value(), &job); err != nil {
+		return nil, 0, err
+	}
+	if q.expired(&job) {
+		return nil, 0, nil
+	}
+	return &job, entry.Revision(), nil
+}
+
+// put writes a job's record, adding a change of status to its timeline
+func (q *NATSQueue) put(ctx context.Context, job *Job) error {
+	job.recordStatus(job.UpdatedAt)
+	data, err := q.opts.Codec.Encode(job)
+	if err != nil {
+		return err
+	}
+	_, err = q.kv.Put(ctx, natsJobKey(job.ID), data)
+	return err
+}
+
+// publish queues the job's ID on its priority's subject
+func (q *NATSQueue) publish(ctx context.Context, job *Job) error {
+	_, err := q.js.Publish(ctx, natsSubject(job.Priority), []byte(job.ID))
+	return err
+}
+
+// AddJob adds a new job to the queue
+func (q *NATSQueue) AddJob(ctx context.Context, job *Job) error {
+	now := q.opts.Clock.Now()
+	if job.CreatedAt.IsZero() {
+		job.CreatedAt = now
+	}
+	job.UpdatedAt = now
+	job.Version = 1
+	if job.Status == "" {
+		job.Status = StatusPending
+	}
+	if job.Status == StatusPending {
+		job.EnqueuedAtMs = now.UnixMilli()
+	}
+	if err := q.put(ctx, job); err != nil {
+		return err
+	}
+	// Scheduled jobs are held back by their consumer once claimed early
+	if job.Status == StatusPending || job.Status == StatusScheduled {
+		return q.publish(ctx, job)
+	}
+	return nil
+}
+
+// AddJobs adds jobs one at a time
+func (q *NATSQueue) AddJobs(ctx context.Context, jobs []*Job) error {
+	return AddJobsOneByOne(ctx, q, jobs)
+}
+
+// GetJob retrieves a job by ID, reporting a missing one as JobQueue says
+func (q *NATSQueue) GetJob(ctx context.Context, jobID string) (*Job, error) {
+	job, _, err := q.get(ctx, jobID)
+	if job == nil && err == nil {
+		return nil, missingJob(jobID)
+	}
+	return job, err
+}
+
+// UpdateJob updates an existing job, checking its version and claim token
+// and incrementing the version as RedisQueue does, and failing with
+// ErrJobNotFound as it does if the record is gone. The record is replaced
+// only at the revision it was checked at, failing with ErrVersionConflict
+// if it was written meanwhile.
+func (q *NATSQueue) UpdateJob(ctx context.Context, job *Job) error {
+	stored, revision, err := q.get(ctx, job.ID)
+	if err != nil {
+		return err
+	}
+	written := *job
+	written.Version = job.Version + 1
+	written.UpdatedAt = q.opts.Clock.Now()
+	if stored == nil {
+		if err := checkMissing(job); err != nil {
+			return err
+		}
+		err = q.put(ctx, &written)
+	} else {
+		if err := checkUpdate(job, stored); err != nil {
+			return err
+		}
+		var data []byte
+		written.recordStatus(written.UpdatedAt)
+		if data, err = q.opts.Codec.Encode(&written); err != nil {
+			return err
+		}
+		_, err = q.kv.Update(ctx, natsJobKey(job.ID), data, revision)
+		if errors.Is(err, jetstream.ErrKeyExists) {
+			return fmt.Errorf("%w: job %s was written during the update", ErrVersionConflict, job.ID)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	job.Version, job.UpdatedAt, job.Timeline = written.Version, written.UpdatedAt, written.Timeline
+	return nil
+}
+
+// scan returns every live job with status, reading the whole bucket
+func (q *NATSQueue) scan(ctx context.Context, status JobStatus) ([]*Job, error) {
+	var jobs []*Job
+	err := q.scanAll(ctx, func(job *Job) {
+		if job.Status == status {
+			jobs = append(jobs, job)
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// scanAll calls fn with every live job, reading the whole bucket
+func (q *NATSQueue) scanAll(ctx context.Context, fn func(job *Job)) error {
+	watcher, err := q.kv.Watch(ctx, natsJobKey("*"), jetstream.IgnoreDeletes())
+	if err != nil {
+		return err
+	}
+	defer watcher.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case entry := <-watcher.Updates():
+			// A nil entry follows the last of the current values
+			if entry == nil {
+				return nil
+			}
+			var job Job
+			if err := q.opts.Codec.Decode(entry.Value(), &job); err != nil {
+				continue // Skip jobs with errors
+			}
+			if !q.expired(&job) {
+				fn(&job)
+			}
+		}
+	}
+}
+
+// GetPendingJobs returns up to limit pending jobs, or all of them if limit
+// isn't positive, the highest priority first and the newest first within a
+// priority, as RedisQueue lists them. They're found by their records, so
+// none are dangling.
+func (q *NATSQueue) GetPendingJobs(ctx context.Context, limit int) ([]*Job, int, error) {
+	jobs, err := q.scan(ctx, StatusPending)
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if ri, rj := PriorityRank(jobs[i].Priority), PriorityRank(jobs[j].Priority); ri != rj {
+			return ri < rj
+		}
+		return jobs[i].EnqueuedAtMs > jobs[j].EnqueuedAtMs
+	})
+	if limit > 0 && len(jobs) > limit {
+		jobs = jobs[:limit]
+	}
+	return jobs, 0, nil
+}
+
+// Stats counts the live records by status in one read of the whole
+// bucket. Finished jobs are counted by when their record was last updated.
+func (q *NATSQueue) Stats(ctx context.Context) (QueueStats, error) {
+	now := q.opts.Clock.Now()
+	since := now.Add(-statsWindow)
+	var stats QueueStats
+	var oldest time.Time
+	err := q.scanAll(ctx, func(job *Job) {
+		switch job.Status {
+		case StatusPending:
+			stats.Pending++
+			if oldest.IsZero() || job.UpdatedAt.Before(oldest) {
+				oldest = job.UpdatedAt
+			}
+		case StatusProcessing:
+			stats.Processing++
+		case StatusCompleted:
+			if job.UpdatedAt.After(since) {
+				stats.CompletedLastHour++
+			}
+		case StatusFailed:
+			if job.UpdatedAt.After(since) {
+				stats.FailedLastHour++
+			}
+		}
+	})
+	if err != nil {
+		return QueueStats{}, err
+	}
+	if !oldest.IsZero() {
+		stats.OldestPendingAgeMs = pendingAge(now, oldest.UnixMilli())
+	}
+	return stats, nil
+}
+
+// ClaimJob takes the oldest pending job, from the highest priority that has
+// one, for the worker, or nil if none is pending. The worker
+// must acknowledge it with AckJob, or it's delivered to another worker once
+// the ack wait passes. Scheduled jobs claimed early are handed back to their
+// consumer until due.
+func (q *NATSQueue) ClaimJob(ctx context.Context, workerID string) (*Job, error) {
+	msg, err := q.fetch(ctx)
+	if err != nil || msg == nil {
+		return nil, err
+	}
+
+	job, _, err := q.get(ctx, string(msg.Data()))
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case job == nil || job.Status == StatusCompleted || job.Status == StatusFailed || job.Status == StatusCancelled:
+		// There is nothing left to process
+		return nil, msg.Ack()
+	case job.ScheduledUntil().After(q.opts.Clock.Now()):
+		return nil, msg.NakWithDelay(job.ScheduledUntil().Sub(q.opts.Clock.Now()))
+	case job.Status == StatusScheduled || job.Status == StatusRetrying:
+		job.Status = StatusPending
+		job.EnqueuedAtMs = q.opts.Clock.Now().UnixMilli()
+		if err := q.UpdateJob(ctx, job); err != nil {
+			return nil, err
+		}
+	}
+
+	q.mu.Lock()
+	if q.claims[workerID] == nil {
+		q.claims[workerID] = make(map[string]jetstream.Msg)
+	}
+	q.claims[workerID][job.ID] = msg
+	q.mu.Unlock()
+	return job, nil
+}
+
+// fetch takes the next message from the highest priority consumer that has
+// one without waiting, or returns nil if none has
+func (q *NATSQueue) fetch(ctx context.Context) (jetstream.Msg, error) {
+	for _, consumer := range q.consumers {
+		batch, err := consumer.FetchNoWait(1)
+		if err != nil {
+			return nil, err
+		}
+		if msg := firstMsg(batch); msg != nil {
+			return msg, nil
+		}
+		if err := batch.Error(); err != nil {
+			return nil, err
+		}
+	}
+	return nil, ctx.Err()
+}
+
+// firstMsg returns the first message of a batch of one, or nil if it's empty
+func firstMsg(batch jetstream.MessageBatch) jetstream.Msg {
+	for msg := range batch.Messages() {
+		return msg
+	}
+	return nil
+}
+
+// takeClaim removes and returns the message of the worker's claim on a job
+func (q *NATSQueue) takeClaim(workerID, jobID string) (jetstream.Msg, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	msg, ok := q.claims[workerID][jobID]
+	delete(q.claims[workerID], jobID)
+	if len(q.claims[workerID]) == 0 {
+		delete(q.claims, workerID)
+	}
+	return msg, ok
+}
+
+// AckJob releases the worker's claim on a job it has finished
+func (q *NATSQueue) AckJob(ctx context.Context, workerID, jobID string) error {
+	msg, ok := q.takeClaim(workerID, jobID)
+	if !ok {
+		return errNoClaim
+	}
+	return msg.Ack()
+}
+
+// NackJob returns a claimed job to its consumer for another worker, reset
+// to pending. A job that finished or expired meanwhile is only released.
+func (q *NATSQueue) NackJob(ctx context.Context, workerID, jobID string) error {
+	msg, ok := q.takeClaim(workerID, jobID)
+	if !ok {
+		return errNoClaim
+	}
+	job, _, err := q.get(ctx, jobID)
+	if err != nil {
+		return err
+	}
+	if job == nil || job.Status == StatusCompleted || job.Status == StatusFailed || job.Status == StatusCancelled {
+		return msg.Ack()
+	}
+	job.Status = StatusPending
+	job.EnqueuedAtMs = q.opts.Clock.Now().UnixMilli()
+	if err := q.UpdateJob(ctx, job); err != nil {
+		return err
+	}
+	return msg.Nak()
+}
+
+// ListJobs returns up to limit jobs with status from position offset, the
+// longest unchanged first, and how many jobs have the status. It reads the
+// whole bucket.
+func (q *NATSQueue) ListJobs(ctx context.Context, status JobStatus, offset, limit int) ([]*Job, int, error) {
+	jobs, err := q.scan(ctx, status)
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.Slice(jobs, func(i, j int) bool {
+		if mi, mj := jobs[i].UpdatedAt.UnixMilli(), jobs[j].UpdatedAt.UnixMilli(); mi != mj {
+			return mi < mj
+		}
+		return jobs[i].ID < jobs[j].ID
+	})
+	total := len(jobs)
+	if offset > total {
+		offset = total
+	}
+	jobs = jobs[offset:]
+	if len(jobs) > limit {
+		jobs = jobs[:limit]
+	}
+	return jobs, total, nil
+}
+
+// CancelJob cancels a job as RedisQueue.CancelJob does, writing the record
+// only if no other write came in between: one waiting to run is marked
+// cancelled at once, and its message dropped when it's claimed, and one
+// being processed is flagged for its worker to stop. The flag is set
+// either way. It fails with ErrJobNotFound, ErrJobFinished, or
+// ErrCancelConflict.
+func (q *NATSQueue) CancelJob(ctx context.Context, jobID string) error {
+	for i := 0; i < maxCancelRetries; i++ {
+		job, revision, err := q.get(ctx, jobID)
+		if err != nil {
+			return err
+		}
+		if job == nil {
+			return ErrJobNotFound
+		}
+		switch job.Status {
+		case StatusCompleted, StatusFailed, StatusCancelled:
+			return ErrJobFinished
+		case StatusProcessing:
+			return q.requestCancel(ctx, job)
+		}
+
+		job.Status = StatusCancelled
+		job.UpdatedAt = q.opts.Clock.Now()
+		job.Version++
+		job.recordStatus(job.UpdatedAt)
+		for j := range job.Deliveries {
+			if job.Deliveries[j].Status == DeliveryPending {
+				job.Deliveries[j].Status = DeliveryFailed
+				job.Deliveries[j].LastError = cancelledDeliveryError
+			}
+		}
+		data, err := q.opts.Codec.Encode(job)
+		if err != nil {
+			return err
+		}
+		_, err = q.kv.Update(ctx, natsJobKey(jobID), data, revision)
+		if errors.Is(err, jetstream.ErrKeyExists) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		return q.requestCancel(ctx, job)
+	}
+	return ErrCancelConflict
+}
+
+// requestCancel sets the job's cancellation flag for as long as its record is kept
+func (q *NATSQueue) requestCancel(ctx context.Context, job *Job) error {
+	until := q.opts.Clock.Now().Add(q.opts.recordTTL(job)).UnixMilli()
+	_, err := q.kv.PutString(ctx, natsCancelKey(job.ID), strconv.FormatInt(until, 10))
+	return err
+}
+
+// DeleteJob purges a job's record and cancellation flag, so no revision of
+// them is left in the bucket. Its message is acknowledged when it's next
+// delivered. It fails with ErrJobNotFound.
+func (q *NATSQueue) DeleteJob(ctx context.Context, jobID string) error {
+	job, _, err := q.get(ctx, jobID)
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		return ErrJobNotFound
+	}
+	if err := q.kv.Purge(ctx, natsJobKey(jobID)); err != nil {
+		return err
+	}
+	return q.kv.Purge(ctx, natsCancelKey(jobID))
+}
+
+// CancelRequested reports whether the job was asked to stop
+func (q *NATSQueue) CancelRequested(ctx context.Context, jobID string) (bool, error) {
+	entry, err := q.kv.Get(ctx, natsCancelKey(jobID))
+	if errors.Is(err, jetstream.ErrKeyNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	until, err := strconv.ParseInt(string(entry.Value()), 10, 64)
+	return err == nil && q.opts.Clock.Now().UnixMilli() < until, nil
+}
+
+// sweep removes expired records every natsSweepInterval until closed
+func (q *NATSQueue) sweep() {
+	ticker := time.NewTicker(natsSweepInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-q.stop:
+			return
+		case <-ticker.C:
+			ctx, cancel := context.WithTimeout(context.Background(), natsSweepInterval)
+			if _, err := q.RemoveExpired(ctx); err != nil {
+				log.Printf("Failed to remove expired NATS job records: %v", err)
+			}
+			cancel()
+		}
+	}
+}
+
+// RemoveExpired purges the job records and cancellation flags past their
+// expiry from the bucket and returns how many it removed. A record written
+// since it was found expired is kept.
+func (q *NATSQueue) RemoveExpired(ctx context.Context) (int, error) {
+	watcher, err := q.kv.WatchAll(ctx, jetstream.IgnoreDeletes())
+	if err != nil {
+		return 0, err
+	}
+	defer watcher.Stop()
+
+	expired := make(map[string]uint64)
+	now := q.opts.Clock.Now()
+	for done := false; !done; {
+		select {
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		case entry := <-watcher.Updates():
+			if entry == nil {
+				done = true
+				break
+			}
+			if key := entry.Key(); strings.HasPrefix(key, "cancel.") {
+				until, err := strconv.ParseInt(string(entry.Value()), 10, 64)
+				if err != nil || now.UnixMilli() >= until {
+					expired[key] = entry.Revision()
+				}
+				continue
+			}
+			var job Job
+			if err := q.opts.Codec.Decode(entry.Value(), &job); err == nil && q.expired(&job) {
+				expired[entry.Key()] = entry.Revision()
+			}
+		}
+	}
+
+	removed := 0
+	for key, revision := range expired {
+		err := q.kv.Purge(ctx, key, jetstream.LastRevision(revision))
+		if err != nil && !errors.Is(err, jetstream.ErrKeyExists) {
+			return removed, err
+		}
+		if err == nil {
+			removed++
+		}
+	}
+	// Drop the markers purging leaves behind, once they're old enough that
+	// no reader still needs them
+	return removed, q.kv.PurgeDeletes(ctx)
+}
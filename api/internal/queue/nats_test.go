@@ -0,0 +1,45 @@
+package queue_test
+
+import (
+	"testing"
+	"time"
+
+	natsserver "github.com/nats-io/nats-server/v2/server"
+
+	"rembg-v2/api/internal/queue"
+	"rembg-v2/api/internal/queue/queuetest"
+)
+
+// runNATSServer starts an in-process NATS server with JetStream, stopped
+// when the test ends
+func runNATSServer(t *testing.T) *natsserver.Server {
+	t.Helper()
+	server, err := natsserver.NewServer(&natsserver.Options{
+		Host:      "127.0.0.1",
+		Port:      -1,
+		JetStream: true,
+		StoreDir:  t.TempDir(),
+		NoLog:     true,
+		NoSigs:    true,
+	})
+	if err != nil {
+		t.Fatalf("creating the NATS server: %v", err)
+	}
+	server.Start()
+	if !server.ReadyForConnections(5 * time.Second) {
+		t.Fatalf("NATS server not ready")
+	}
+	t.Cleanup(server.Shutdown)
+	return server
+}
+
+func TestNATSQueueConformance(t *testing.T) {
+	queuetest.RunConformanceTests(t, func() queue.JobQueue {
+		server := runNATSServer(t)
+		q, err := queue.NewNATSQueue(queue.NATSConfig{URL: server.ClientURL()}, queue.Options{})
+		if err != nil {
+			t.Fatalf("NewNATSQueue: %v", err)
+		}
+		return q
+	})
+}
@@ -0,0 +1,28 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+)
+
+// missingJob is what GetJob returns, with a nil job, for a job that doesn't
+// exist
+func missingJob(jobID string) error {
+	return fmt.Errorf("%w: %s", ErrJobNotFound, jobID)
+}
+
+// JobMissing reports whether a GetJob result means the job doesn't exist:
+// ErrJobNotFound, or a nil job with no error from a JobQueue of another
+// package still keeping the old contract
+func JobMissing(job *Job, err error) bool {
+	return errors.Is(err, ErrJobNotFound) || (err == nil && job == nil)
+}
+
+// NilIfNotFound turns ErrJobNotFound from GetJob back into a nil job, for
+// callers that treat a missing job as they do one that expired
+func NilIfNotFound(job *Job, err error) (*Job, error) {
+	if errors.Is(err, ErrJobNotFound) {
+		return nil, nil
+	}
+	return job, err
+}
@@ -0,0 +1,147 @@
+package queue
+
+import "context"
+
+// jobScanMaxIterations bounds the SCAN calls made by one scan of the jobs
+const jobScanMaxIterations = 2000
+
+// maintenanceKey returns the Redis key that, while set, stops workers
+// claiming new jobs
+func (k redisKeys) maintenanceKey() string {
+	return k.prefix + "maintenance:paused"
+}
+
+// PeekPending returns up to n of the next jobs workers will claim from a
+// model's pending lists, in claim order: the highest priority first, and
+// oldest first within a priority. Nothing is claimed. Entries whose job has
+// expired are skipped.
+func (q *RedisQueue) PeekPending(ctx context.Context, model string, n int64) ([]*Job, error) {
+	jobs := make([]*Job, 0, n)
+	for _, p := range Priorities {
+		if int64(len(jobs)) >= n {
+			break
+		}
+		ids, err := q.nextPendingIDs(ctx, model, p, n-int64(len(jobs)))
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			job, err := NilIfNotFound(q.GetJob(ctx, id))
+			if err != nil {
+				return nil, err
+			}
+			if job != nil {
+				jobs = append(jobs, job)
+			}
+		}
+	}
+	return jobs, nil
+}
+
+// nextPendingIDs returns up to n job IDs of a model's pending list or
+// stream at a priority, the next to be claimed first
+func (q *RedisQueue) nextPendingIDs(ctx context.Context, model, priority string, n int64) ([]string, error) {
+	if q.opts.PendingStreams {
+		return q.nextStreamIDs(ctx, q.pendingStreamKey(model, priority), n)
+	}
+	if q.opts.Scheduling == SchedulingFair {
+		return q.nextFairIDs(ctx, q.pendingKey(model, priority), n)
+	}
+	// Jobs are pushed on the left and popped from the right
+	ids, err := q.client.LRange(ctx, q.pendingKey(model, priority), -n, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	for i, j := 0, len(ids)-1; i < j; i, j = i+1, j-1 {
+		ids[i], ids[j] = ids[j], ids[i]
+	}
+	return ids, nil
+}
+
+// FailJob marks a job failed with the given code, refunding its quota
+// reservation and counting its outcome as any other failure is. It fails
+// with ErrInvalidTransition if the job's status changed since it was read.
+func (q *RedisQueue) FailJob(ctx context.Context, job *Job, code, message string) error {
+	from := job.Status
+	job.Status = StatusFailed
+	job.ErrorCode = code
+	job.Error = message
+	if err := q.transition(ctx, job, from); err != nil {
+		return err
+	}
+	if err := q.RefundQuota(ctx, job); err != nil {
+		return err
+	}
+	return q.RecordOutcome(ctx, job)
+}
+
+// FailedJobs scans for failed jobs, only those with errorCode unless it is
+// empty, stopping after limit. It reports whether every job was scanned.
+func (q *RedisQueue) FailedJobs(ctx context.Context, errorCode string, limit int) ([]*Job, bool, error) {
+	jobs := []*Job{}
+	complete, err := q.scanJobs(ctx, func(job *Job) bool {
+		if job.Status != StatusFailed || (errorCode != "" && job.ErrorCode != errorCode) {
+			return true
+		}
+		jobs = append(jobs, job)
+		return len(jobs) < limit
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	return jobs, complete, nil
+}
+
+// scanJobs calls fn with every stored job until fn returns false, within
+// jobScanMaxIterations SCAN calls. It reports whether every job was seen.
+func (q *RedisQueue) scanJobs(ctx context.Context, fn func(job *Job) bool) (bool, error) {
+	var cursor uint64
+	for i := 0; i < jobScanMaxIterations; i++ {
+		next, whole, err := q.ScanJobPage(ctx, cursor, fn)
+		if err != nil || !whole {
+			return false, err
+		}
+		if cursor = next; cursor == 0 {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// ScanJobPage reads one SCAN page of stored jobs, starting at cursor (0 for
+// the first), and calls fn with each until fn returns false. It returns the
+// cursor of the next page, 0 after the last, and whether fn took the whole
+// page. Only one page of jobs is held at a time. As with any SCAN, jobs
+// added or removed meanwhile may be missed or seen twice.
+func (q *RedisQueue) ScanJobPage(ctx context.Context, cursor uint64, fn func(job *Job) bool) (uint64, bool, error) {
+	keyspace, err := q.keyspace(ctx)
+	if err != nil {
+		return 0, false, err
+	}
+	keys, next, err := keyspace.Scan(ctx, cursor, q.jobKey("*"), keyUsageScanCount).Result()
+	if err != nil {
+		return 0, false, err
+	}
+	if len(keys) == 0 {
+		return next, true, nil
+	}
+
+	values, err := q.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return 0, false, err
+	}
+	for _, value := range values {
+		data, ok := value.(string)
+		if !ok {
+			continue
+		}
+		var job Job
+		if err := q.opts.Codec.Decode([]byte(data), &job); err != nil {
+			continue
+		}
+		if !fn(&job) {
+			return next, false, nil
+		}
+	}
+	return next, true, nil
+}
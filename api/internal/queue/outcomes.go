@@ -0,0 +1,112 @@
+package queue
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// outcomeBucket is the granularity of the outcome counters
+	outcomeBucket = time.Minute
+	// outcomesTTL keeps a little over a day of buckets for baselines
+	outcomesTTL = 26 * time.Hour
+	// maxFailureExamples is how many recent failed job IDs are kept per dimension
+	maxFailureExamples = 5
+)
+
+// outcomesKey returns the Redis hash counting job outcomes in the minute containing t.
+// Fields are total, failed, code:<code>, model:<model>:total, and model:<model>:failed.
+func (k redisKeys) outcomesKey(t time.Time) string {
+	return k.prefix + "outcomes:" + t.UTC().Format("200601021504")
+}
+
+// failureExamplesKey returns the Redis list of recent failed job IDs for a
+// dimension such as code:invalid_image or model:u2net
+func (k redisKeys) failureExamplesKey(dimension string) string {
+	return k.prefix + "outcome_examples:" + dimension
+}
+
+// alertCooldownKey returns the Redis key marking an alert as recently sent
+func (k redisKeys) alertCooldownKey(dimension string) string {
+	return k.prefix + "alert_cooldown:" + dimension
+}
+
+// outcomeModel is the model a job ran with, for per-model counters
+func outcomeModel(job *Job) string {
+	if job.ModelSelection != nil {
+		return job.ModelSelection.Model
+	}
+	if job.Model != "" {
+		return job.Model
+	}
+	return ModelDefault
+}
+
+// RecordOutcome counts a job reaching completed or failed, and adds it to
+// the circuit breaker's window. Workers count the jobs they finish; the API
+// counts the failures it decides itself.
+func (q *RedisQueue) RecordOutcome(ctx context.Context, job *Job) error {
+	key := q.outcomesKey(q.opts.Clock.Now())
+	model := outcomeModel(job)
+
+	pipe := q.client.Pipeline()
+	pipe.HIncrBy(ctx, key, "total", 1)
+	pipe.HIncrBy(ctx, key, "model:"+model+":total", 1)
+	if job.Status == StatusFailed {
+		code := job.ErrorCode
+		if code == "" {
+			code = "unknown"
+		}
+		pipe.HIncrBy(ctx, key, "failed", 1)
+		pipe.HIncrBy(ctx, key, "code:"+code, 1)
+		pipe.HIncrBy(ctx, key, "model:"+model+":failed", 1)
+		for _, dimension := range []string{"code:" + code, "model:" + model} {
+			pipe.LPush(ctx, q.failureExamplesKey(dimension), job.ID)
+			pipe.LTrim(ctx, q.failureExamplesKey(dimension), 0, maxFailureExamples-1)
+			pipe.Expire(ctx, q.failureExamplesKey(dimension), outcomesTTL)
+		}
+	}
+	pipe.Expire(ctx, key, outcomesTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+	return q.recordBreakerOutcome(ctx, job)
+}
+
+// OutcomeCounts sums the outcome counters of the minutes in [from, to)
+func (q *RedisQueue) OutcomeCounts(ctx context.Context, from, to time.Time) (map[string]int64, error) {
+	pipe := q.client.Pipeline()
+	var buckets []*redis.MapStringStringCmd
+	for t := from.Truncate(outcomeBucket); t.Before(to); t = t.Add(outcomeBucket) {
+		buckets = append(buckets, pipe.HGetAll(ctx, q.outcomesKey(t)))
+	}
+	if len(buckets) == 0 {
+		return map[string]int64{}, nil
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int64)
+	for _, bucket := range buckets {
+		for field, value := range bucket.Val() {
+			n, _ := strconv.ParseInt(value, 10, 64)
+			counts[field] += n
+		}
+	}
+	return counts, nil
+}
+
+// FailureExamples returns the IDs of recent failed jobs for a dimension, newest first
+func (q *RedisQueue) FailureExamples(ctx context.Context, dimension string) ([]string, error) {
+	return q.client.LRange(ctx, q.failureExamplesKey(dimension), 0, maxFailureExamples-1).Result()
+}
+
+// ClaimAlert reports whether this replica should send the alert for a
+// dimension, allowing one alert per dimension per cooldown across replicas
+func (q *RedisQueue) ClaimAlert(ctx context.Context, dimension string, cooldown time.Duration) (bool, error) {
+	return q.client.SetNX(ctx, q.alertCooldownKey(dimension), q.opts.Clock.Now().UTC().Format(time.RFC3339), cooldown).Result()
+}
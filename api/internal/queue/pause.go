@@ -0,0 +1,37 @@
+package queue
+
+import (
+	"context"
+	"time"
+)
+
+// Pause stops workers claiming new jobs by setting the consumption
+// maintenance flag by hand, as rmbgctl maintenance pause does, so jobs
+// already claimed run to completion and the queue drains. The flag lives in
+// Redis, so it outlives restarts of the API.
+func (q *RedisQueue) Pause(ctx context.Context) error {
+	return q.OverrideMaintenance(ctx, MaintenanceConsumption, true)
+}
+
+// Resume lets workers claim jobs again, overriding the schedule until the
+// override is cleared, as rmbgctl maintenance resume does
+func (q *RedisQueue) Resume(ctx context.Context) error {
+	return q.OverrideMaintenance(ctx, MaintenanceConsumption, false)
+}
+
+// IsPaused reports whether workers are stopped from claiming new jobs, by
+// Pause or by a scheduled maintenance window
+func (q *RedisQueue) IsPaused(ctx context.Context) (bool, error) {
+	return q.MaintenancePaused(ctx, MaintenanceConsumption)
+}
+
+// waitPaused waits out wait, as a blocking claim finding nothing would, so
+// workers polling a paused queue don't spin
+func waitPaused(ctx context.Context, wait time.Duration) {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+	case <-timer.C:
+	}
+}
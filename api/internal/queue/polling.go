@@ -0,0 +1,146 @@
+package queue
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// pollCountTTL bounds how long an abandoned job's poll counter is kept
+const pollCountTTL = 24 * time.Hour
+
+// pollCountKey returns the Redis key counting status polls for a job
+func (k redisKeys) pollCountKey(jobID string) string {
+	return k.prefix + "polls:" + jobID
+}
+
+// avgProcessingKey returns the Redis key holding the rolling average
+// processing time in milliseconds, maintained by the workers
+func (k redisKeys) avgProcessingKey() string {
+	return k.prefix + "stats:avg_processing_ms"
+}
+
+// QueuePosition returns how many pending jobs are ahead of the given job in
+// its model's pending lists, those of higher priorities included, or -1 if
+// the job is not in its list
+func (q *RedisQueue) QueuePosition(ctx context.Context, job *Job) (int64, error) {
+	if q.opts.PendingStreams {
+		return q.streamPosition(ctx, job)
+	}
+	if q.opts.Scheduling == SchedulingFair {
+		return q.fairPosition(ctx, job)
+	}
+	key := q.jobPendingKey(job)
+	pipe := q.client.Pipeline()
+	var ahead []*redis.IntCmd
+	for _, k := range q.pendingKeys(job.Model) {
+		if k == key {
+			break
+		}
+		ahead = append(ahead, pipe.LLen(ctx, k))
+	}
+	length := pipe.LLen(ctx, key)
+	// Jobs are pushed on the left and popped from the right
+	index := pipe.LPos(ctx, key, job.ID, redis.LPosArgs{Rank: -1})
+	if _, err := pipe.Exec(ctx); err != nil {
+		if err == redis.Nil {
+			return -1, nil
+		}
+		return 0, err
+	}
+
+	position := length.Val() - 1 - index.Val()
+	for _, n := range ahead {
+		position += n.Val()
+	}
+	return position, nil
+}
+
+// AverageProcessingTime returns the rolling average time workers spend
+// processing a job, or zero if no job has been processed yet
+func (q *RedisQueue) AverageProcessingTime(ctx context.Context) (time.Duration, error) {
+	ms, err := q.client.Get(ctx, q.avgProcessingKey()).Float64()
+	if err != nil {
+		if err == redis.Nil {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return time.Duration(ms * float64(time.Millisecond)), nil
+}
+
+// RecordPoll increments and returns the number of status polls for a job
+func (q *RedisQueue) RecordPoll(ctx context.Context, jobID string) (int64, error) {
+	pipe := q.client.TxPipeline()
+	count := pipe.Incr(ctx, q.pollCountKey(jobID))
+	pipe.Expire(ctx, q.pollCountKey(jobID), pollCountTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return 0, err
+	}
+	return count.Val(), nil
+}
+
+// TakePollCount returns and clears the number of status polls for a job
+func (q *RedisQueue) TakePollCount(ctx context.Context, jobID string) (int64, error) {
+	count, err := q.client.GetDel(ctx, q.pollCountKey(jobID)).Int64()
+	if err == redis.Nil {
+		return 0, nil
+	}
+	return count, err
+}
+
+// PendingDepths returns how many jobs are waiting in each model's pending
+// lists, including auto, whatever their priority
+func (q *RedisQueue) PendingDepths(ctx context.Context) (map[string]int64, error) {
+	models := append([]string{ModelAuto}, Models...)
+	if q.opts.PendingStreams {
+		return q.streamModelDepths(ctx, models)
+	}
+	pipe := q.client.Pipeline()
+	lengths := make([][]*redis.IntCmd, len(models))
+	for i, model := range models {
+		lists, err := q.pendingLists(ctx, q.pendingKeys(model))
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range lists {
+			for _, key := range l {
+				lengths[i] = append(lengths[i], pipe.LLen(ctx, key))
+			}
+		}
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	depths := make(map[string]int64, len(models))
+	for i, model := range models {
+		for _, n := range lengths[i] {
+			depths[model] += n.Val()
+		}
+	}
+	return depths, nil
+}
+
+// PendingDepth returns how many jobs are waiting across every model's pending list
+func (q *RedisQueue) PendingDepth(ctx context.Context) (int64, error) {
+	depths, err := q.PendingDepths(ctx)
+	if err != nil {
+		return 0, err
+	}
+
+	var depth int64
+	for _, n := range depths {
+		depth += n
+	}
+	return depth, nil
+}
+
+// PendingCount returns how many jobs are pending with a single ZCARD of the
+// pending status index, cheaper than PendingDepth's length of every model's
+// list at every priority. Entries of expired jobs are counted until the
+// index is next pruned.
+func (q *RedisQueue) PendingCount(ctx context.Context) (int64, error) {
+	return q.client.ZCard(ctx, q.statusIndexKey(StatusPending)).Result()
+}
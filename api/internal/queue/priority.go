@@ -0,0 +1,78 @@
+package queue
+
+// Priorities a job can be queued at
+const (
+	// PriorityLow is for bulk work that may wait behind everything else
+	PriorityLow = "low"
+	// PriorityNormal is used unless a job asks otherwise
+	PriorityNormal = "normal"
+	// PriorityHigh is for interactive work claimed ahead of the rest
+	PriorityHigh = "high"
+)
+
+// Priorities lists the priorities from highest to lowest, the order workers
+// drain their pending lists in
+var Priorities = []string{PriorityHigh, PriorityNormal, PriorityLow}
+
+// IsPriority reports whether name is a priority a job can request
+func IsPriority(name string) bool {
+	for _, p := range Priorities {
+		if p == name {
+			return true
+		}
+	}
+	return false
+}
+
+// PriorityRank orders priorities for claiming: 0 is claimed first
+func PriorityRank(priority string) int {
+	for i, p := range Priorities {
+		if p == priority {
+			return i
+		}
+	}
+	return PriorityRank(PriorityNormal)
+}
+
+// pendingName returns the pending list, without the queue's key prefix, for
+// jobs requesting a model at a priority. Normal-priority jobs keep using
+// the model's original list, so workers that predate priorities still claim
+// them.
+func pendingName(model, priority string) string {
+	if priority == "" || priority == PriorityNormal || !IsPriority(priority) {
+		return modelQueueName(model)
+	}
+	return modelQueueName(model) + ":" + priority
+}
+
+// pendingNames returns a model's pending lists, without the queue's key
+// prefix, highest priority first
+func pendingNames(model string) []string {
+	names := make([]string, len(Priorities))
+	for i, p := range Priorities {
+		names[i] = pendingName(model, p)
+	}
+	return names
+}
+
+// pendingName returns the pending list the job waits in, without the
+// queue's key prefix
+func (j *Job) pendingName() string {
+	return pendingName(j.Model, j.Priority)
+}
+
+// pendingKey returns the pending list for jobs requesting a model at a
+// priority
+func (k redisKeys) pendingKey(model, priority string) string {
+	return k.prefix + pendingName(model, priority)
+}
+
+// pendingKeys returns a model's pending lists, highest priority first
+func (k redisKeys) pendingKeys(model string) []string {
+	return k.prefixed(pendingNames(model))
+}
+
+// jobPendingKey returns the pending list the job waits in
+func (k redisKeys) jobPendingKey(j *Job) string {
+	return k.pendingKey(j.Model, j.Priority)
+}
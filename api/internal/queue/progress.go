@@ -0,0 +1,55 @@
+package queue
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// ProgressTTL bounds how long a job's progress outlives its last update, so
+// a worker that dies mid-job doesn't leave it behind for good
+const ProgressTTL = time.Hour
+
+// progressKey returns the Redis hash of how far a job's processing has got.
+// It's kept apart from the job's record so reporting progress never
+// rewrites the record or moves its UpdatedAt.
+func (k redisKeys) progressKey(jobID string) string {
+	return k.prefix + "progress:" + jobID
+}
+
+// UpdateProgress records how far a job's processing has got, from 0 to
+// 100, and the stage it's in. Only the progress hash is written.
+func (q *RedisQueue) UpdateProgress(ctx context.Context, jobID string, progress int, stage string) error {
+	if progress < 0 {
+		progress = 0
+	} else if progress > 100 {
+		progress = 100
+	}
+	key := q.progressKey(jobID)
+	pipe := q.client.TxPipeline()
+	pipe.HSet(ctx, key, "progress", progress, "stage", stage)
+	pipe.Expire(ctx, key, ProgressTTL)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// LoadProgress fills in the job's Progress and Stage from the last progress
+// its worker reported, leaving them unset if it reported none
+func (q *RedisQueue) LoadProgress(ctx context.Context, job *Job) error {
+	values, err := q.client.HMGet(ctx, q.progressKey(job.ID), "progress", "stage").Result()
+	if err == redis.Nil {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if progress, ok := values[0].(string); ok {
+		job.Progress, _ = strconv.Atoi(progress)
+	}
+	if stage, ok := values[1].(string); ok {
+		job.Stage = stage
+	}
+	return nil
+}
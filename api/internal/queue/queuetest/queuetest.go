@@ -0,0 +1,497 @@
+// Package queuetest checks that a JobQueue backend behaves as the JobQueue
+// contract says, so backends can't drift apart in how they order, store,
+// and hand out jobs
+package queuetest
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"rembg-v2/api/internal/queue"
+)
+
+// testTimeout bounds each check, SQS claims waiting out ClaimWait included
+const testTimeout = 30 * time.Second
+
+// expirer is implemented by backends that report when a job's record is
+// removed
+type expirer interface {
+	JobExpiresAt(job *queue.Job) time.Time
+}
+
+// scheduler is implemented by backends that can order claims other than
+// oldest first
+type scheduler interface {
+	Scheduling() queue.Scheduling
+}
+
+// prioritizer is implemented by backends that report whether claims take
+// higher priorities first
+type prioritizer interface {
+	HonorsPriorities() bool
+}
+
+// RunConformanceTests runs the JobQueue contract checks against the backend
+// newQueue creates. It's called once per check and must return an empty
+// queue each time; one that implements io.Closer is closed after the check.
+// Checks of optional behavior, such as reporting expiry, fair scheduling, or
+// priorities, are skipped for backends without it.
+func RunConformanceTests(t *testing.T, newQueue func() queue.JobQueue) {
+	checks := []struct {
+		name  string
+		check func(t *testing.T, ctx context.Context, q queue.JobQueue)
+	}{
+		{"AddGet", testAddGet},
+		{"AddKeepsCreatedAt", testAddKeepsCreatedAt},
+		{"AddDuplicateID", testAddDuplicateID},
+		{"GetMissing", testGetMissing},
+		{"Update", testUpdate},
+		{"UpdateStaleVersion", testUpdateStaleVersion},
+		{"UpdateDeleted", testUpdateDeleted},
+		{"Delete", testDelete},
+		{"DeleteMissing", testDeleteMissing},
+		{"CancelPending", testCancelPending},
+		{"CancelMissing", testCancelMissing},
+		{"ClaimEmpty", testClaimEmpty},
+		{"ClaimOrder", testClaimOrder},
+		{"ClaimPriority", testClaimPriority},
+		{"ClaimExclusive", testClaimExclusive},
+		{"ClaimFair", testClaimFair},
+		{"PendingJobs", testPendingJobs},
+		{"Stats", testStats},
+		{"RetentionExpiry", testRetentionExpiry},
+		{"StatusExpiry", testStatusExpiry},
+		{"HealthCheck", testHealthCheck},
+	}
+	for _, c := range checks {
+		c := c
+		t.Run(c.name, func(t *testing.T) {
+			q := newQueue()
+			if closer, ok := q.(io.Closer); ok {
+				t.Cleanup(func() { closer.Close() })
+			}
+			ctx, cancel := context.WithTimeout(context.Background(), testTimeout)
+			defer cancel()
+			c.check(t, ctx, q)
+		})
+	}
+}
+
+// addJob adds a pending job with the ID, failing the check if it can't
+func addJob(t *testing.T, ctx context.Context, q queue.JobQueue, job *queue.Job) {
+	t.Helper()
+	if err := q.AddJob(ctx, job); err != nil {
+		t.Fatalf("AddJob(%s): %v", job.ID, err)
+	}
+}
+
+// getJob reads a job that must exist
+func getJob(t *testing.T, ctx context.Context, q queue.JobQueue, jobID string) *queue.Job {
+	t.Helper()
+	job, err := q.GetJob(ctx, jobID)
+	if err != nil {
+		t.Fatalf("GetJob(%s): %v", jobID, err)
+	}
+	if job == nil {
+		t.Fatalf("GetJob(%s) found no job", jobID)
+	}
+	return job
+}
+
+// claimAll claims jobs for the worker until none is left, returning their
+// IDs in the order they were claimed
+func claimAll(t *testing.T, ctx context.Context, q queue.JobQueue, workerID string) []string {
+	t.Helper()
+	var ids []string
+	for {
+		job, err := q.ClaimJob(ctx, workerID)
+		if err != nil {
+			t.Fatalf("ClaimJob: %v", err)
+		}
+		if job == nil {
+			return ids
+		}
+		ids = append(ids, job.ID)
+	}
+}
+
+// sameIDs reports whether two claim orders are the same
+func sameIDs(got, want []string) bool {
+	if len(got) != len(want) {
+		return false
+	}
+	for i := range got {
+		if got[i] != want[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func testAddGet(t *testing.T, ctx context.Context, q queue.JobQueue) {
+	addJob(t, ctx, q, &queue.Job{ID: "job-1", Owner: "alice", Filename: "cat.png"})
+
+	job := getJob(t, ctx, q, "job-1")
+	if job.Status != queue.StatusPending {
+		t.Errorf("Status = %q, want %q for a job added without one", job.Status, queue.StatusPending)
+	}
+	if job.Owner != "alice" || job.Filename != "cat.png" {
+		t.Errorf("got owner %q and filename %q, want the ones added", job.Owner, job.Filename)
+	}
+	if job.CreatedAt.IsZero() || job.UpdatedAt.IsZero() {
+		t.Errorf("CreatedAt %v and UpdatedAt %v should be stamped", job.CreatedAt, job.UpdatedAt)
+	}
+	if job.Version != 1 {
+		t.Errorf("Version = %d, want 1 for a new job", job.Version)
+	}
+}
+
+func testAddKeepsCreatedAt(t *testing.T, ctx context.Context, q queue.JobQueue) {
+	created := time.Now().Add(-time.Hour).UTC().Truncate(time.Second)
+	addJob(t, ctx, q, &queue.Job{ID: "job-1", CreatedAt: created})
+
+	job := getJob(t, ctx, q, "job-1")
+	if !job.CreatedAt.Equal(created) {
+		t.Errorf("CreatedAt = %v, want the %v it was added with", job.CreatedAt, created)
+	}
+	if !job.UpdatedAt.After(created) {
+		t.Errorf("UpdatedAt = %v, want it stamped after CreatedAt", job.UpdatedAt)
+	}
+}
+
+func testAddDuplicateID(t *testing.T, ctx context.Context, q queue.JobQueue) {
+	addJob(t, ctx, q, &queue.Job{ID: "job-1", Filename: "first.png"})
+	first := getJob(t, ctx, q, "job-1")
+
+	addJob(t, ctx, q, &queue.Job{ID: "job-1", Filename: "second.png", CreatedAt: first.CreatedAt})
+	job := getJob(t, ctx, q, "job-1")
+	if job.Filename != "second.png" {
+		t.Errorf("Filename = %q, want the record of the job added last", job.Filename)
+	}
+	if !job.CreatedAt.Equal(first.CreatedAt) {
+		t.Errorf("CreatedAt = %v, want the first add's %v", job.CreatedAt, first.CreatedAt)
+	}
+	if job.Version != 1 {
+		t.Errorf("Version = %d, want 1 for a job added again", job.Version)
+	}
+
+	claimed, err := q.ClaimJob(ctx, "worker-1")
+	if err != nil {
+		t.Fatalf("ClaimJob: %v", err)
+	}
+	if claimed == nil || claimed.ID != "job-1" {
+		t.Fatalf("ClaimJob = %v, want the job added twice", claimed)
+	}
+}
+
+func testGetMissing(t *testing.T, ctx context.Context, q queue.JobQueue) {
+	job, err := q.GetJob(ctx, "missing")
+	if job != nil || !errors.Is(err, queue.ErrJobNotFound) {
+		t.Errorf("GetJob of a missing job = %v, %v, want ErrJobNotFound", job, err)
+	}
+}
+
+func testUpdate(t *testing.T, ctx context.Context, q queue.JobQueue) {
+	addJob(t, ctx, q, &queue.Job{ID: "job-1"})
+	job := getJob(t, ctx, q, "job-1")
+
+	job.Status = queue.StatusCompleted
+	job.OutputPath = "results/job-1.png"
+	if err := q.UpdateJob(ctx, job); err != nil {
+		t.Fatalf("UpdateJob: %v", err)
+	}
+	if job.Version != 2 {
+		t.Errorf("Version = %d after UpdateJob, want 2", job.Version)
+	}
+
+	stored := getJob(t, ctx, q, "job-1")
+	if stored.Status != queue.StatusCompleted || stored.OutputPath != "results/job-1.png" {
+		t.Errorf("got status %q and result %q, want the update", stored.Status, stored.OutputPath)
+	}
+	if stored.Version != job.Version {
+		t.Errorf("stored Version = %d, want %d", stored.Version, job.Version)
+	}
+}
+
+func testUpdateStaleVersion(t *testing.T, ctx context.Context, q queue.JobQueue) {
+	addJob(t, ctx, q, &queue.Job{ID: "job-1"})
+	first := getJob(t, ctx, q, "job-1")
+	stale := getJob(t, ctx, q, "job-1")
+
+	first.Filename = "first.png"
+	if err := q.UpdateJob(ctx, first); err != nil {
+		t.Fatalf("UpdateJob: %v", err)
+	}
+	stale.Filename = "stale.png"
+	if err := q.UpdateJob(ctx, stale); !errors.Is(err, queue.ErrVersionConflict) {
+		t.Errorf("UpdateJob of a stale copy = %v, want ErrVersionConflict", err)
+	}
+	if job := getJob(t, ctx, q, "job-1"); job.Filename != "first.png" {
+		t.Errorf("Filename = %q, want the first update kept", job.Filename)
+	}
+}
+
+func testUpdateDeleted(t *testing.T, ctx context.Context, q queue.JobQueue) {
+	addJob(t, ctx, q, &queue.Job{ID: "job-1"})
+	job := getJob(t, ctx, q, "job-1")
+	if err := q.DeleteJob(ctx, "job-1"); err != nil {
+		t.Fatalf("DeleteJob: %v", err)
+	}
+
+	// A worker's last write of a job deleted under it
+	job.Status = queue.StatusCompleted
+	if err := q.UpdateJob(ctx, job); !errors.Is(err, queue.ErrJobNotFound) {
+		t.Errorf("UpdateJob of a deleted job = %v, want ErrJobNotFound", err)
+	}
+	stored, err := q.GetJob(ctx, "job-1")
+	if !queue.JobMissing(stored, err) {
+		t.Errorf("GetJob after updating a deleted job = %v, %v, want it still missing", stored, err)
+	}
+}
+
+func testDelete(t *testing.T, ctx context.Context, q queue.JobQueue) {
+	addJob(t, ctx, q, &queue.Job{ID: "job-1"})
+	if err := q.DeleteJob(ctx, "job-1"); err != nil {
+		t.Fatalf("DeleteJob: %v", err)
+	}
+	job, err := q.GetJob(ctx, "job-1")
+	if !queue.JobMissing(job, err) {
+		t.Errorf("GetJob after DeleteJob = %v, %v, want it reported missing", job, err)
+	}
+	if claimed := claimAll(t, ctx, q, "worker-1"); len(claimed) != 0 {
+		t.Errorf("claimed %v, want a deleted job never claimed", claimed)
+	}
+}
+
+func testDeleteMissing(t *testing.T, ctx context.Context, q queue.JobQueue) {
+	if err := q.DeleteJob(ctx, "missing"); !errors.Is(err, queue.ErrJobNotFound) {
+		t.Errorf("DeleteJob of a missing job = %v, want ErrJobNotFound", err)
+	}
+}
+
+func testCancelPending(t *testing.T, ctx context.Context, q queue.JobQueue) {
+	addJob(t, ctx, q, &queue.Job{ID: "job-1"})
+	if err := q.CancelJob(ctx, "job-1"); err != nil {
+		t.Fatalf("CancelJob: %v", err)
+	}
+	if job := getJob(t, ctx, q, "job-1"); job.Status != queue.StatusCancelled {
+		t.Errorf("Status = %q, want %q", job.Status, queue.StatusCancelled)
+	}
+	if claimed := claimAll(t, ctx, q, "worker-1"); len(claimed) != 0 {
+		t.Errorf("claimed %v, want a cancelled job never claimed", claimed)
+	}
+	if err := q.CancelJob(ctx, "job-1"); !errors.Is(err, queue.ErrJobFinished) {
+		t.Errorf("CancelJob of a cancelled job = %v, want ErrJobFinished", err)
+	}
+}
+
+func testCancelMissing(t *testing.T, ctx context.Context, q queue.JobQueue) {
+	if err := q.CancelJob(ctx, "missing"); !errors.Is(err, queue.ErrJobNotFound) {
+		t.Errorf("CancelJob of a missing job = %v, want ErrJobNotFound", err)
+	}
+}
+
+func testClaimEmpty(t *testing.T, ctx context.Context, q queue.JobQueue) {
+	job, err := q.ClaimJob(ctx, "worker-1")
+	if err != nil || job != nil {
+		t.Errorf("ClaimJob of an empty queue = %v, %v, want nil, nil", job, err)
+	}
+}
+
+func testClaimOrder(t *testing.T, ctx context.Context, q queue.JobQueue) {
+	want := []string{"job-1", "job-2", "job-3"}
+	for _, id := range want {
+		addJob(t, ctx, q, &queue.Job{ID: id})
+	}
+	if got := claimAll(t, ctx, q, "worker-1"); !sameIDs(got, want) {
+		t.Errorf("claimed %v, want the oldest first: %v", got, want)
+	}
+}
+
+func testClaimPriority(t *testing.T, ctx context.Context, q queue.JobQueue) {
+	if p, ok := q.(prioritizer); ok && !p.HonorsPriorities() {
+		t.Skip("backend ignores priorities")
+	}
+	added := []struct{ id, priority string }{
+		{"low-1", queue.PriorityLow},
+		{"normal-1", queue.PriorityNormal},
+		{"high-1", queue.PriorityHigh},
+		{"normal-2", ""},
+		{"high-2", queue.PriorityHigh},
+	}
+	for _, a := range added {
+		addJob(t, ctx, q, &queue.Job{ID: a.id, Priority: a.priority})
+	}
+	want := []string{"high-1", "high-2", "normal-1", "normal-2", "low-1"}
+	if got := claimAll(t, ctx, q, "worker-1"); !sameIDs(got, want) {
+		t.Errorf("claimed %v, want higher priorities first: %v", got, want)
+	}
+}
+
+func testClaimFair(t *testing.T, ctx context.Context, q queue.JobQueue) {
+	if s, ok := q.(scheduler); !ok || s.Scheduling() != queue.SchedulingFair {
+		t.Skip("backend doesn't schedule fairly")
+	}
+	// alice's batch is queued before bob's single jobs
+	for _, id := range []string{"alice-1", "alice-2", "alice-3", "alice-4"} {
+		addJob(t, ctx, q, &queue.Job{ID: id, Owner: "alice"})
+	}
+	for _, id := range []string{"bob-1", "bob-2"} {
+		addJob(t, ctx, q, &queue.Job{ID: id, Owner: "bob"})
+	}
+	want := []string{"alice-1", "bob-1", "alice-2", "bob-2", "alice-3", "alice-4"}
+	if got := claimAll(t, ctx, q, "worker-1"); !sameIDs(got, want) {
+		t.Errorf("claimed %v, want the owners taking turns: %v", got, want)
+	}
+}
+
+func testClaimExclusive(t *testing.T, ctx context.Context, q queue.JobQueue) {
+	const jobs, workers = 50, 8
+	for i := 0; i < jobs; i++ {
+		addJob(t, ctx, q, &queue.Job{ID: fmt.Sprintf("job-%d", i)})
+	}
+
+	var mu sync.Mutex
+	claimedBy := make(map[string][]string)
+	var wg sync.WaitGroup
+	errs := make(chan error, workers)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(workerID string) {
+			defer wg.Done()
+			for {
+				job, err := q.ClaimJob(ctx, workerID)
+				if err != nil {
+					errs <- err
+					return
+				}
+				if job == nil {
+					return
+				}
+				mu.Lock()
+				claimedBy[job.ID] = append(claimedBy[job.ID], workerID)
+				mu.Unlock()
+			}
+		}(fmt.Sprintf("worker-%d", w))
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("ClaimJob: %v", err)
+	}
+
+	if len(claimedBy) != jobs {
+		t.Errorf("%d jobs claimed, want all %d", len(claimedBy), jobs)
+	}
+	for id, by := range claimedBy {
+		if len(by) != 1 {
+			t.Errorf("job %s claimed by %v, want exactly one worker", id, by)
+		}
+	}
+}
+
+func testPendingJobs(t *testing.T, ctx context.Context, q queue.JobQueue) {
+	jobs, dangling, err := q.GetPendingJobs(ctx, 0)
+	if err != nil {
+		t.Fatalf("GetPendingJobs: %v", err)
+	}
+	if len(jobs) != 0 || dangling != 0 {
+		t.Errorf("GetPendingJobs of an empty queue = %d jobs, %d dangling, want none", len(jobs), dangling)
+	}
+
+	for _, id := range []string{"job-1", "job-2", "job-3"} {
+		addJob(t, ctx, q, &queue.Job{ID: id})
+	}
+	if jobs, _, err = q.GetPendingJobs(ctx, 0); err != nil || len(jobs) != 3 {
+		t.Errorf("GetPendingJobs(0) = %d jobs, %v, want all 3", len(jobs), err)
+	}
+	if jobs, _, err = q.GetPendingJobs(ctx, 2); err != nil || len(jobs) != 2 {
+		t.Errorf("GetPendingJobs(2) = %d jobs, %v, want 2", len(jobs), err)
+	}
+
+	// Backends that list jobs by their records see a claimed job leave the
+	// pending ones once its worker starts it, as workers do at once
+	claimed, err := q.ClaimJob(ctx, "worker-1")
+	if err != nil || claimed == nil {
+		t.Fatalf("ClaimJob = %v, %v, want a job", claimed, err)
+	}
+	claimed.Status = queue.StatusProcessing
+	if err := q.UpdateJob(ctx, claimed); err != nil {
+		t.Fatalf("UpdateJob: %v", err)
+	}
+	if jobs, _, err = q.GetPendingJobs(ctx, 0); err != nil || len(jobs) != 2 {
+		t.Errorf("GetPendingJobs after a claim = %d jobs, %v, want 2", len(jobs), err)
+	}
+}
+
+func testStats(t *testing.T, ctx context.Context, q queue.JobQueue) {
+	stats, err := q.Stats(ctx)
+	if err != nil {
+		t.Fatalf("Stats: %v", err)
+	}
+	if stats.Pending != 0 || stats.Processing != 0 {
+		t.Errorf("Stats of an empty queue = %+v, want nothing pending or processing", stats)
+	}
+
+	addJob(t, ctx, q, &queue.Job{ID: "job-1"})
+	addJob(t, ctx, q, &queue.Job{ID: "job-2"})
+	if stats, err = q.Stats(ctx); err != nil || stats.Pending != 2 {
+		t.Errorf("Stats = %+v, %v, want 2 pending", stats, err)
+	}
+}
+
+func testRetentionExpiry(t *testing.T, ctx context.Context, q queue.JobQueue) {
+	e, ok := q.(expirer)
+	if !ok {
+		t.Skip("backend doesn't report expiry")
+	}
+	addJob(t, ctx, q, &queue.Job{ID: "job-1", Retention: &queue.Retention{ResultSeconds: 600, Source: queue.RetentionFromJob}})
+	job := getJob(t, ctx, q, "job-1")
+
+	want := job.CreatedAt.Add(10 * time.Minute)
+	if got := e.JobExpiresAt(job); !got.Equal(want) {
+		t.Errorf("JobExpiresAt = %v, want the end of its retention, %v", got, want)
+	}
+
+	// Retention counts from creation, so updates don't extend it
+	time.Sleep(10 * time.Millisecond)
+	if err := q.UpdateJob(ctx, job); err != nil {
+		t.Fatalf("UpdateJob: %v", err)
+	}
+	if got := e.JobExpiresAt(getJob(t, ctx, q, "job-1")); !got.Equal(want) {
+		t.Errorf("JobExpiresAt after an update = %v, want %v kept", got, want)
+	}
+}
+
+func testStatusExpiry(t *testing.T, ctx context.Context, q queue.JobQueue) {
+	e, ok := q.(expirer)
+	if !ok {
+		t.Skip("backend doesn't report expiry")
+	}
+	addJob(t, ctx, q, &queue.Job{ID: "job-1"})
+	job := getJob(t, ctx, q, "job-1")
+	added := e.JobExpiresAt(job)
+	if !added.After(job.UpdatedAt) {
+		t.Errorf("JobExpiresAt = %v, want after the job was added at %v", added, job.UpdatedAt)
+	}
+
+	// Without a retention the TTL restarts with each update
+	time.Sleep(10 * time.Millisecond)
+	if err := q.UpdateJob(ctx, job); err != nil {
+		t.Fatalf("UpdateJob: %v", err)
+	}
+	if updated := e.JobExpiresAt(getJob(t, ctx, q, "job-1")); !updated.After(added) {
+		t.Errorf("JobExpiresAt after an update = %v, want later than %v", updated, added)
+	}
+}
+
+func testHealthCheck(t *testing.T, ctx context.Context, q queue.JobQueue) {
+	if err := q.HealthCheck(ctx); err != nil {
+		t.Errorf("HealthCheck: %v", err)
+	}
+}
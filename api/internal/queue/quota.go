@@ -0,0 +1,149 @@
+package queue
+
+import (
+	"context"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// QuotaLimits are the daily budgets of one owner. Zero means unlimited.
+type QuotaLimits struct {
+	Requests int64
+	// MilliMegapixels is the megapixel budget in thousandths of a megapixel
+	MilliMegapixels int64
+}
+
+// QuotaUsage is an owner's consumption for the current day
+type QuotaUsage struct {
+	Requests        int64
+	MilliMegapixels int64
+	// Day is the usage bucket, recorded on jobs so refunds hit the right day
+	Day string
+	// ResetAt is when the daily budget starts over
+	ResetAt time.Time
+}
+
+// Server-side failures refund the reservation; these user errors don't
+var userErrorCodes = map[string]bool{
+	ErrorCodeInvalidImage: true,
+}
+
+// usageTTL keeps a day's usage counters around a little longer than the day
+const usageTTL = 48 * time.Hour
+
+// usageKey returns the Redis hash holding an owner's usage for a day
+func (k redisKeys) usageKey(owner, day string) string {
+	return k.prefix + "usage:" + owner + ":" + day
+}
+
+// refundKey returns the Redis key marking a job's reservation as refunded
+func (k redisKeys) refundKey(jobID string) string {
+	return k.prefix + "quota_refund:" + jobID
+}
+
+// newQuotaUsage returns empty usage for the day containing t
+func newQuotaUsage(t time.Time) QuotaUsage {
+	day := t.UTC().Truncate(24 * time.Hour)
+	return QuotaUsage{
+		Day:     day.Format("2006-01-02"),
+		ResetAt: day.Add(24 * time.Hour),
+	}
+}
+
+// reserveQuotaScript charges one request and a megapixel cost against the
+// owner's daily usage if both stay within their limits.
+// Returns {allowed, requests, milli_megapixels}.
+var reserveQuotaScript = redis.NewScript(`
+local requests = tonumber(redis.call("HGET", KEYS[1], "requests") or "0")
+local mp = tonumber(redis.call("HGET", KEYS[1], "mp") or "0")
+local cost = tonumber(ARGV[1])
+local request_limit = tonumber(ARGV[2])
+local mp_limit = tonumber(ARGV[3])
+
+if (request_limit > 0 and requests + 1 > request_limit) or (mp_limit > 0 and mp + cost > mp_limit) then
+	return {0, requests, mp}
+end
+
+requests = redis.call("HINCRBY", KEYS[1], "requests", 1)
+mp = redis.call("HINCRBY", KEYS[1], "mp", cost)
+redis.call("EXPIRE", KEYS[1], ARGV[4])
+return {1, requests, mp}
+`)
+
+// refundQuotaScript returns a job's megapixel cost to the owner's usage
+// exactly once, never letting usage drop below zero
+var refundQuotaScript = redis.NewScript(`
+if redis.call("SET", KEYS[2], "1", "NX", "EX", ARGV[2]) == false then
+	return 0
+end
+local mp = tonumber(redis.call("HGET", KEYS[1], "mp") or "0")
+local refund = math.min(mp, tonumber(ARGV[1]))
+if refund > 0 then
+	redis.call("HINCRBY", KEYS[1], "mp", -refund)
+end
+return refund
+`)
+
+// ReserveQuota charges a submission of the given cost to the owner's daily
+// usage. It reports whether the submission fits in the limits, along with
+// the usage after the reservation (or the current usage if it was denied).
+func (q *RedisQueue) ReserveQuota(ctx context.Context, owner string, milliMegapixels int64, limits QuotaLimits) (bool, QuotaUsage, error) {
+	now := q.opts.Clock.Now()
+	usage := newQuotaUsage(now)
+
+	res, err := reserveQuotaScript.Run(ctx, q.client,
+		[]string{q.usageKey(owner, usage.Day)},
+		milliMegapixels, limits.Requests, limits.MilliMegapixels, int(usageTTL.Seconds()),
+	).Int64Slice()
+	if err != nil {
+		return false, usage, err
+	}
+
+	usage.Requests = res[1]
+	usage.MilliMegapixels = res[2]
+	return res[0] == 1, usage, nil
+}
+
+// GetQuotaUsage returns the owner's usage for the current day
+func (q *RedisQueue) GetQuotaUsage(ctx context.Context, owner string) (QuotaUsage, error) {
+	now := q.opts.Clock.Now()
+	usage := newQuotaUsage(now)
+
+	values, err := q.client.HMGet(ctx, q.usageKey(owner, usage.Day), "requests", "mp").Result()
+	if err != nil {
+		return usage, err
+	}
+
+	usage.Requests = parseCount(values[0])
+	usage.MilliMegapixels = parseCount(values[1])
+	return usage, nil
+}
+
+// RefundQuota returns a terminally failed job's megapixel reservation to
+// its owner if the failure was server-side. Refunds are idempotent per job,
+// so the many places that observe the failure can all call it safely.
+func (q *RedisQueue) RefundQuota(ctx context.Context, job *Job) error {
+	if job.Status != StatusFailed || job.Owner == "" || job.QuotaDay == "" || job.MilliMegapixels == 0 {
+		return nil
+	}
+	if userErrorCodes[job.ErrorCode] {
+		return nil
+	}
+
+	return refundQuotaScript.Run(ctx, q.client,
+		[]string{q.usageKey(job.Owner, job.QuotaDay), q.refundKey(job.ID)},
+		job.MilliMegapixels, int(usageTTL.Seconds()),
+	).Err()
+}
+
+// parseCount converts an HMGET value to a count, treating missing fields as zero
+func parseCount(value interface{}) int64 {
+	s, ok := value.(string)
+	if !ok {
+		return 0
+	}
+	n, _ := strconv.ParseInt(s, 10, 64)
+	return n
+}
@@ -0,0 +1,33 @@
+package queue
+
+import (
+	"context"
+	"time"
+)
+
+// recentJobKey returns the Redis key marking a job as just accepted, so
+// status reads racing its first write answer pending rather than not found
+func (k redisKeys) recentJobKey(jobID string) string {
+	return k.prefix + "recent_job:" + jobID
+}
+
+// MarkRecentJobs records that jobs were just accepted, for ttl
+func (q *RedisQueue) MarkRecentJobs(ctx context.Context, ttl time.Duration, jobIDs ...string) error {
+	pipe := q.client.Pipeline()
+	for _, id := range jobIDs {
+		pipe.Set(ctx, q.recentJobKey(id), "1", ttl)
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// ForgetRecentJob removes the mark of a job that wasn't queued after all
+func (q *RedisQueue) ForgetRecentJob(ctx context.Context, jobID string) error {
+	return q.client.Del(ctx, q.recentJobKey(jobID)).Err()
+}
+
+// IsRecentJob reports whether a job was accepted within the ttl it was marked with
+func (q *RedisQueue) IsRecentJob(ctx context.Context, jobID string) (bool, error) {
+	n, err := q.client.Exists(ctx, q.recentJobKey(jobID)).Result()
+	return n > 0, err
+}
@@ -0,0 +1,36 @@
+package queue_test
+
+import (
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+
+	"rembg-v2/api/internal/queue"
+	"rembg-v2/api/internal/queue/queuetest"
+)
+
+// miniredisQueues returns a factory of RedisQueues with opts, each on its
+// own in-process Redis server
+func miniredisQueues(t *testing.T, opts queue.Options) func() queue.JobQueue {
+	return func() queue.JobQueue {
+		server := miniredis.RunT(t)
+		q, err := queue.NewRedisQueueWithClient(redis.NewClient(&redis.Options{Addr: server.Addr()}), opts)
+		if err != nil {
+			t.Fatalf("NewRedisQueueWithClient: %v", err)
+		}
+		return q
+	}
+}
+
+func TestRedisQueueConformance(t *testing.T) {
+	queuetest.RunConformanceTests(t, miniredisQueues(t, queue.Options{}))
+}
+
+func TestRedisQueueConformanceFair(t *testing.T) {
+	queuetest.RunConformanceTests(t, miniredisQueues(t, queue.Options{Scheduling: queue.SchedulingFair}))
+}
+
+func TestRedisQueueConformanceStreams(t *testing.T) {
+	queuetest.RunConformanceTests(t, miniredisQueues(t, queue.Options{PendingStreams: true}))
+}
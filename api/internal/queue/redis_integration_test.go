@@ -0,0 +1,38 @@
+//go:build redis
+
+package queue_test
+
+import (
+	"context"
+	"os"
+	"testing"
+
+	"github.com/redis/go-redis/v9"
+
+	"rembg-v2/api/internal/queue"
+	"rembg-v2/api/internal/queue/queuetest"
+)
+
+// integrationDB is the database of the Redis server at REDIS_ADDR the
+// integration tests flush and use
+const integrationDB = 15
+
+// Run with: REDIS_ADDR=localhost:6379 go test -tags redis ./internal/queue/
+func TestRedisQueueConformanceRealRedis(t *testing.T) {
+	addr := os.Getenv("REDIS_ADDR")
+	if addr == "" {
+		addr = "localhost:6379"
+	}
+	queuetest.RunConformanceTests(t, func() queue.JobQueue {
+		client := redis.NewClient(&redis.Options{Addr: addr, DB: integrationDB})
+		if err := client.FlushDB(context.Background()).Err(); err != nil {
+			t.Fatalf("flushing Redis at %s: %v", addr, err)
+		}
+		client.Close()
+		q, err := queue.NewRedisQueue(addr, integrationDB, queue.Options{})
+		if err != nil {
+			t.Fatalf("NewRedisQueue: %v", err)
+		}
+		return q
+	})
+}
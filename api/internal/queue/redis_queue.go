@@ -2,10 +2,14 @@ package queue
 
 import (
 	"context"
-	"encoding/json"
+	"errors"
+	"fmt"
+	"sync"
 	"time"
 
-	"github.com/go-redis/redis/v8"
+	"github.com/redis/go-redis/v9"
+
+	"rembg-v2/api/internal/fault"
 )
 
 // JobStatus represents the current status of a processing job
@@ -13,11 +17,59 @@ type JobStatus string
 
 const (
 	StatusPending   JobStatus = "pending"
+	// StatusScheduled jobs wait for their ProcessAt before becoming pending
+	StatusScheduled JobStatus = "scheduled"
+	// StatusRetrying jobs wait for their RetryAt after a failed attempt
+	StatusRetrying JobStatus = "retrying"
 	StatusProcessing JobStatus = "processing"
 	StatusCompleted JobStatus = "completed"
 	StatusFailed    JobStatus = "failed"
+	// StatusCancelled jobs were stopped at their owner's request
+	StatusCancelled JobStatus = "cancelled"
+)
+
+// Job options versions. Bump OptionsVersion whenever workers must understand
+// a new option to process a job correctly; workers release jobs whose version
+// they don't support. Jobs that use no newer options are stamped with the
+// oldest version that describes them, so older workers keep processing them.
+const (
+	// OptionsVersionBase covers jobs without post-processing
+	OptionsVersionBase = 1
+	// OptionsVersionPostProcessing added post-processing options and pipelines
+	OptionsVersionPostProcessing = 2
+	// OptionsVersionDeliveries added external result deliveries
+	OptionsVersionDeliveries = 3
+	// OptionsVersion is the newest version written by this API
+	OptionsVersion = OptionsVersionDeliveries
 )
 
+// RequiredOptionsVersion returns the oldest options version that describes the job
+func (j *Job) RequiredOptionsVersion() int {
+	switch {
+	case len(j.Deliveries) > 0:
+		return OptionsVersionDeliveries
+	case len(j.Options) > 0 || len(j.Pipeline) > 0:
+		return OptionsVersionPostProcessing
+	}
+	return OptionsVersionBase
+}
+
+// StageTiming is how long one post-processing stage took, measured by the worker
+type StageTiming struct {
+	Stage string `json:"stage"`
+	Ms    int64  `json:"ms"`
+}
+
+// OutputInputPreview is the kind of the thumbnail of a job's input made at
+// submission
+const OutputInputPreview = "input_preview"
+
+// Output is a file stored for a job besides its result
+type Output struct {
+	Kind string `json:"kind"`
+	Path string `json:"path"`
+}
+
 // Job represents an image processing job
 type Job struct {
 	ID         string    `json:"id"`
@@ -25,31 +77,322 @@ type Job struct {
 	InputPath  string    `json:"input_path"`
 	OutputPath string    `json:"output_path,omitempty"`
 	Error      string    `json:"error,omitempty"`
+	ErrorCode  string    `json:"error_code,omitempty"`
+	Warnings   []Warning `json:"warnings,omitempty"`
 	CreatedAt  time.Time `json:"created_at"`
 	UpdatedAt  time.Time `json:"updated_at"`
+	// EnqueuedAtMs is the Redis server time in milliseconds when the job was
+	// queued, so the worker can measure queue wait against the same clock
+	EnqueuedAtMs int64 `json:"enqueued_at_ms,omitempty"`
+	// QueueWaitMs and ProcessingMs are measured by the worker
+	QueueWaitMs  int64 `json:"queue_wait_ms,omitempty"`
+	ProcessingMs int64 `json:"processing_ms,omitempty"`
+	// OptionsVersion is the options version the job was submitted with
+	OptionsVersion int `json:"options_version,omitempty"`
+	// Owner identifies who submitted the job, for quotas and ownership
+	Owner string `json:"owner,omitempty"`
+	// Tier is the submitter's service tier
+	Tier string `json:"tier,omitempty"`
+	// Megapixel quota reservation, refunded on server-side failure
+	MilliMegapixels int64  `json:"milli_megapixels,omitempty"`
+	QuotaDay        string `json:"quota_day,omitempty"`
+	// Options configure the post-processing stages
+	Options map[string]string `json:"options,omitempty"`
+	// Pipeline is an explicit stage order; empty means the default order
+	Pipeline     []string      `json:"pipeline,omitempty"`
+	StageTimings []StageTiming `json:"stage_timings,omitempty"`
+	// Progress is how far processing has got, from 0 to 100, in Stage. Both
+	// are kept apart from the record and filled in by LoadProgress.
+	Progress int    `json:"-"`
+	Stage    string `json:"-"`
+	// Deliveries push the result to external destinations after completion
+	Deliveries []Delivery `json:"deliveries,omitempty"`
+	// Metadata is what the client attached to the job at submission,
+	// returned with it as submitted
+	Metadata map[string]string `json:"metadata,omitempty"`
+	// Filename is the name the client uploaded the image under
+	Filename string `json:"filename,omitempty"`
+	// InputBytes is the size of the uploaded image
+	InputBytes int64 `json:"input_bytes,omitempty"`
+	// InputHash is the hex SHA-256 of the uploaded image
+	InputHash string `json:"input_hash,omitempty"`
+	// UploadFingerprint identifies the owner, upload, and processing options
+	// of a job that later identical submissions may be answered with
+	UploadFingerprint string `json:"upload_fingerprint,omitempty"`
+	// InputFormat is the format sniffed from the upload's contents, whatever
+	// its name claimed; empty if it wasn't an image the API can read
+	InputFormat string `json:"input_format,omitempty"`
+	// OutputFormat is the format the worker wrote the result in
+	OutputFormat string `json:"output_format,omitempty"`
+	// OutputBytes is the size of the result the worker wrote
+	OutputBytes int64 `json:"output_bytes,omitempty"`
+	// InputHasAlpha is set by the worker when the input had transparency
+	InputHasAlpha bool `json:"input_has_alpha,omitempty"`
+	// CompositeMode is how the worker blended the result over its
+	// background, linear or fast; empty if nothing was composited
+	CompositeMode string `json:"composite_mode,omitempty"`
+	// Model is the requested model; empty means the default
+	Model          string          `json:"model,omitempty"`
+	ModelSelection *ModelSelection `json:"model_selection,omitempty"`
+	// Priority is the pending list the job waits in; empty means normal
+	Priority string `json:"priority,omitempty"`
+	// ProcessAt is when a scheduled job is queued; nil queues it on submission
+	ProcessAt *time.Time `json:"process_at,omitempty"`
+	// FanoutID groups jobs sharing one input, which is reference counted
+	FanoutID string `json:"fanout_id,omitempty"`
+	// Retention is how long the job and its files are kept; nil keeps the
+	// job 24 hours from its last update and never removes its files
+	Retention *Retention `json:"retention,omitempty"`
+	// MaxLifetimeSeconds is how long after creation the job may stay
+	// unfinished before it's failed with ErrorCodeLifetimeExceeded; 0 is unbounded
+	MaxLifetimeSeconds int64 `json:"max_lifetime_seconds,omitempty"`
+	// Attempts counts the times workers have started processing the job
+	Attempts int `json:"attempts,omitempty"`
+	// AttemptStartedAt and WorkerID are when the current attempt started
+	// and the worker making it, set by the worker as it starts
+	AttemptStartedAt *time.Time `json:"attempt_started_at,omitempty"`
+	WorkerID         string     `json:"worker_id,omitempty"`
+	// ClaimToken identifies the claim the current attempt runs under, new
+	// with each; writes carrying an older one fail with ErrFenced
+	ClaimToken string `json:"claim_token,omitempty"`
+	// Version counts the writes of the job's record, from 1 when it's
+	// added; writes of a copy read at an older one fail with
+	// ErrVersionConflict
+	Version int64 `json:"version,omitempty"`
+	// MaxAttempts is how many attempts a job failing on transient errors
+	// gets; 0 allows one
+	MaxAttempts int `json:"max_attempts,omitempty"`
+	// RetryAt is when a retrying job is queued again
+	RetryAt *time.Time `json:"retry_at,omitempty"`
+	// AttemptHistory records the failed attempts, oldest first, up to
+	// MaxAttemptHistory of the latest
+	AttemptHistory []Attempt `json:"attempt_history,omitempty"`
+	// Timeline records the job's changes of status, oldest first, up to
+	// MaxTimelineEvents
+	Timeline []JobEvent `json:"timeline,omitempty"`
+	// IdempotencyKey is the key the job was submitted under, removed with the job
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	// Transfers are the job's changes of owner, oldest first
+	Transfers []Transfer `json:"transfers,omitempty"`
+	// Outputs are the job's other stored files, removed with its input
+	Outputs []Output `json:"outputs,omitempty"`
+}
+
+// Output returns the job's output of kind, or nil if it has none
+func (j *Job) Output(kind string) *Output {
+	for i := range j.Outputs {
+		if j.Outputs[i].Kind == kind {
+			return &j.Outputs[i]
+		}
+	}
+	return nil
 }
 
 // JobQueue defines the interface for job queue operations
 type JobQueue interface {
+	// AddJob stores and queues a new job, stamping its CreatedAt unless
+	// it's set, as on a job added again, and its UpdatedAt
 	AddJob(ctx context.Context, job *Job) error
+	// AddJobs adds several jobs at once. A backend that can't batch the
+	// writes implements it with AddJobsOneByOne.
+	AddJobs(ctx context.Context, jobs []*Job) error
+	// GetJob returns the job with the ID. A job that doesn't exist is
+	// reported as ErrJobNotFound with a nil job. Any other error is the
+	// backend's own, as when Redis is unreachable.
 	GetJob(ctx context.Context, jobID string) (*Job, error)
+	// UpdateJob writes a job read at its Version, failing with
+	// ErrVersionConflict if it changed since and ErrJobNotFound if its
+	// record is gone, so a deleted job isn't brought back
 	UpdateJob(ctx context.Context, job *Job) error
-	GetPendingJobs(ctx context.Context) ([]*Job, error)
+	// GetPendingJobs returns up to limit pending jobs, all of them if limit
+	// isn't positive, the highest priority first, and how many of the
+	// listed IDs have no job record, which are removed from the queue
+	GetPendingJobs(ctx context.Context, limit int) ([]*Job, int, error)
+	// ClaimJob takes the next pending job for a worker, which must
+	// acknowledge it once finished for the claim to be released, or returns
+	// nil if none is pending. It doesn't wait for one to arrive.
+	ClaimJob(ctx context.Context, workerID string) (*Job, error)
+	// ListJobs returns a page of the jobs with a status, the longest
+	// unchanged first, and how many have it
+	ListJobs(ctx context.Context, status JobStatus, offset, limit int) ([]*Job, int, error)
+	// CancelJob stops a job that hasn't finished, at once if it's waiting
+	// to run and at the worker's next pipeline stage if it's being processed
+	CancelJob(ctx context.Context, jobID string) error
+	// DeleteJob removes a job's record and queue entries whatever its
+	// status, failing with ErrJobNotFound if there is none
+	DeleteJob(ctx context.Context, jobID string) error
+	// Stats reports the queue's depth, its throughput over the last hour,
+	// and how long its oldest pending job has waited
+	Stats(ctx context.Context) (QueueStats, error)
+	// HealthCheck checks that the backend answers and can take the writes
+	// jobs need, for readiness probes
+	HealthCheck(ctx context.Context) error
+}
+
+// Options configures optional queue behavior
+type Options struct {
+	// PublishEvents enables publishing lifecycle events on EventsChannel
+	PublishEvents bool
+	// EventsChannel is the Pub/Sub channel for lifecycle events
+	EventsChannel string
+	// KeyCaps caps the approximate number of Redis keys per feature
+	KeyCaps map[string]int64
+	// MinIdleConns is the number of connections kept open and dialed by Warm
+	MinIdleConns int
+	// PoolSize caps the connections open per Redis node, and PoolTimeout
+	// is how long a call waits for one when all are busy; zero leaves
+	// go-redis's defaults of ten per CPU and ReadTimeout plus a second
+	PoolSize    int
+	PoolTimeout time.Duration
+	// DialTimeout, ReadTimeout, and WriteTimeout bound connecting and each
+	// network read and write, defaulting to 5, 3, and 3 seconds
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// MaxRetries is how many times a command failing on a network error is
+	// retried, -1 for never and 0 for go-redis's default of 3, backing off
+	// between MinRetryBackoff and MaxRetryBackoff
+	MaxRetries      int
+	MinRetryBackoff time.Duration
+	MaxRetryBackoff time.Duration
+	// CommandTimeout bounds a command or pipeline, retries included, sent
+	// with a context without a deadline, defaulting to 10 seconds
+	CommandTimeout time.Duration
+	// Password authenticates to Redis
+	Password string
+	// SentinelAddrs lists the Sentinels managing the master SentinelMaster,
+	// which RedisQueue follows through failovers instead of connecting to
+	// one address; SentinelPassword authenticates to them
+	SentinelAddrs    []string
+	SentinelMaster   string
+	SentinelPassword string
+	// ClusterAddrs lists nodes of a Redis Cluster to connect to instead,
+	// from which the client discovers the rest
+	ClusterAddrs []string
+	// Clock provides timestamps for jobs, defaulting to the system time
+	Clock Clock
+	// Codec encodes stored job records, defaulting to plain JSON
+	Codec Codec
+	// PendingTTL, CompletedTTL, and FailedTTL are how long a job record
+	// without a retention snapshot is kept after its last update, by the
+	// status it was updated to; PendingTTL covers every unfinished status
+	// and FailedTTL cancelled jobs too. Zero keeps the record a day.
+	PendingTTL   time.Duration
+	CompletedTTL time.Duration
+	FailedTTL    time.Duration
+	// HistoryTTL is how long the summary of a completed or failed job is
+	// kept for JobHistory. Zero keeps it 30 days.
+	HistoryTTL time.Duration
+	// PendingStreams queues pending jobs on Redis Streams, read by the
+	// consumer group StreamGroup, instead of lists, so the group tracks
+	// which worker holds each job until it's acknowledged. A delivery left
+	// unacknowledged for StreamClaimIdle, as when its worker died, is
+	// reclaimed. Workers must be run with the same settings. The group
+	// defaults to DefaultStreamGroup and the idle time to HeartbeatTTL.
+	PendingStreams  bool
+	StreamGroup     string
+	StreamClaimIdle time.Duration
+	// Scheduling orders the jobs waiting at the same model and priority:
+	// SchedulingFIFO, the default, keeps one list, and SchedulingFair one
+	// per owner claimed from in turn. Fair scheduling needs pending lists,
+	// not PendingStreams. Workers must be run with the same scheduling.
+	Scheduling Scheduling
+	// Breaker stops workers claiming new jobs for a cool-down once too many
+	// of the latest finished jobs failed. It's off unless Breaker.Window is
+	// set. The settings are written to Redis for the workers to follow.
+	Breaker BreakerConfig
+	// KeyPrefix begins every Redis key the queue writes, so deployments
+	// sharing a database, such as staging and production, don't see each
+	// other's jobs, e.g. "staging:". Empty keeps the unprefixed keys. In
+	// cluster mode it's made the keys' hash tag. Workers must be run with
+	// the same prefix.
+	KeyPrefix string
+}
+
+// setDefaults fills in the options left unset
+func (o *Options) setDefaults() {
+	if o.EventsChannel == "" {
+		o.EventsChannel = DefaultEventsChannel
+	}
+	if o.Clock == nil {
+		o.Clock = SystemClock{}
+	}
+	if o.CommandTimeout <= 0 {
+		o.CommandTimeout = redisCommandTimeout
+	}
+	if o.HistoryTTL <= 0 {
+		o.HistoryTTL = defaultHistoryTTL
+	}
+	if o.StreamGroup == "" {
+		o.StreamGroup = DefaultStreamGroup
+	}
+	if o.StreamClaimIdle <= 0 {
+		o.StreamClaimIdle = HeartbeatTTL
+	}
+	if o.Scheduling == "" {
+		o.Scheduling = SchedulingFIFO
+	}
+	for _, ttl := range []*time.Duration{&o.PendingTTL, &o.CompletedTTL, &o.FailedTTL} {
+		if *ttl <= 0 {
+			*ttl = defaultJobTTL
+		}
+	}
 }
 
 // RedisQueue implements JobQueue using Redis
 type RedisQueue struct {
-	client *redis.Client
+	redisKeys
+	client   redis.UniversalClient
+	opts     Options
+	keyUsage keyUsageState
+	// modelTurn is the model ClaimPendingJob tries first
+	modelTurn uint32
+	// events holds the lifecycle events waiting for runPublisher, which
+	// stops once closed is closed
+	events    chan []byte
+	closed    chan struct{}
+	closeOnce sync.Once
 }
 
-// NewRedisQueue creates a new Redis-backed job queue
-func NewRedisQueue(addr string, db int) (*RedisQueue, error) {
-	client := redis.NewClient(&redis.Options{
-		Addr: addr,
-		DB:   db,
-	})
+// NewRedisQueue creates a new Redis-backed job queue. addr is a host:port,
+// a comma-separated list of Redis Cluster nodes as opts.ClusterAddrs is, or
+// a redis-sentinel:// URL to follow a Sentinel-managed master through
+// failovers, as opts.SentinelAddrs does. In cluster mode every key begins
+// with a hash tag made of opts.KeyPrefix, so a cluster holds none of a
+// standalone deployment's data. It builds the client and hands it to
+// NewRedisQueueWithClient.
+func NewRedisQueue(addr string, db int, opts Options) (*RedisQueue, error) {
+	if err := checkKeyPrefix(opts.KeyPrefix); err != nil {
+		return nil, err
+	}
+	if err := checkScheduling(opts); err != nil {
+		return nil, err
+	}
+	client, err := newRedisClient(addr, db, opts)
+	if err != nil {
+		return nil, err
+	}
+	q, err := NewRedisQueueWithClient(client, opts)
+	if errors.Is(err, ErrInvalidKeyPrefix) || errors.Is(err, ErrInvalidScheduling) {
+		client.Close()
+		return nil, err
+	}
+	if err != nil {
+		client.Close()
+		return nil, fmt.Errorf("cannot reach Redis at %s: %w", redactRedisAddr(addr), err)
+	}
+	return q, nil
+}
 
-	// Test connection
+// NewRedisQueueWithClient creates a job queue on an existing client to a
+// standalone Redis, a Sentinel-managed master, or a Redis Cluster, which
+// it pings first. It fails with ErrInvalidKeyPrefix if opts.KeyPrefix can't
+// be used, and with ErrInvalidScheduling if opts.Scheduling can't be. A hook it adds to the client gives commands sent without
+// a context deadline opts.CommandTimeout, and wraps their failures in
+// CommandError. Closing the queue closes the client.
+func NewRedisQueueWithClient(client redis.UniversalClient, opts Options) (*RedisQueue, error) {
+	// Test connection, to whichever master the Sentinels name or any
+	// cluster node
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	
@@ -57,117 +400,343 @@ func NewRedisQueue(addr string, db int) (*RedisQueue, error) {
 		return nil, err
 	}
 
-	return &RedisQueue{
-		client: client,
-	}, nil
+	opts.setDefaults()
+	if err := checkScheduling(opts); err != nil {
+		return nil, err
+	}
+	if err := checkKeyPrefix(opts.KeyPrefix); err != nil {
+		return nil, err
+	}
+	_, cluster := client.(*redis.ClusterClient)
+	client.AddHook(commandHook{timeout: opts.CommandTimeout})
+
+	q := &RedisQueue{
+		redisKeys: newRedisKeys(opts.KeyPrefix, cluster),
+		client:    client,
+		opts:      opts,
+		closed:    make(chan struct{}),
+	}
+	if opts.PendingStreams {
+		if err := q.createStreamGroups(ctx); err != nil {
+			return nil, err
+		}
+	}
+	if err := q.configureBreaker(ctx); err != nil {
+		return nil, err
+	}
+	if opts.PublishEvents {
+		q.events = make(chan []byte, eventBuffer)
+		go q.runPublisher()
+	}
+	return q, nil
 }
 
-// jobKey returns the Redis key for a job
-func jobKey(jobID string) string {
-	return "job:" + jobID
+// Close stops the event publisher and releases the queue's Redis
+// connections
+func (q *RedisQueue) Close() error {
+	q.closeOnce.Do(func() { close(q.closed) })
+	return q.client.Close()
 }
 
-// queueKey returns the Redis key for the pending jobs queue
-func queueKey() string {
-	return "pending_jobs"
+// jobKey returns the Redis key for a job
+func (k redisKeys) jobKey(jobID string) string {
+	return k.prefix + "job:" + jobID
 }
 
-// AddJob adds a new job to the queue
+// queueName is the pending jobs queue, without the queue's key prefix
+const queueName = "pending_jobs"
+
+// AddJob adds a new job to the queue. A job that already has a CreatedAt,
+// as one the write-behind buffer adds again, keeps it.
 func (q *RedisQueue) AddJob(ctx context.Context, job *Job) error {
-	// Set current time
-	job.CreatedAt = time.Now()
-	job.UpdatedAt = job.CreatedAt
+	if err := fault.Maybe(ctx, fault.Redis, "job_id", job.ID, "owner", job.Owner); err != nil {
+		return err
+	}
+
+	// Set current time, keeping the creation time of a job added again, as
+	// the write-behind buffer retries one
+	now := q.opts.Clock.Now()
+	if job.CreatedAt.IsZero() {
+		job.CreatedAt = now
+	}
+	job.UpdatedAt = now
 	
 	// Default status is pending
 	if job.Status == "" {
 		job.Status = StatusPending
 	}
 	
+	// Stamp the enqueue time from the Redis clock shared with the workers
+	if job.Status == StatusPending {
+		now, err := q.client.Time(ctx).Result()
+		if err != nil {
+			return err
+		}
+		job.EnqueuedAtMs = now.UnixMilli()
+	}
+	
+	job.Version = 1
+	job.recordStatus(job.UpdatedAt)
+	
 	// Serialize job to JSON
-	jobJSON, err := json.Marshal(job)
+	jobJSON, err := q.opts.Codec.Encode(job)
 	if err != nil {
 		return err
 	}
 	
-	// Store job data
-	err = q.client.Set(ctx, jobKey(job.ID), jobJSON, 24*time.Hour).Err()
-	if err != nil {
+	// Store job data, indexed by its status
+	store := q.client.TxPipeline()
+	store.Set(ctx, q.jobKey(job.ID), jobJSON, q.jobTTL(job))
+	q.indexStatus(ctx, store, job)
+	if _, err := store.Exec(ctx); err != nil {
 		return err
 	}
+
+	// Schedule its files' removal at the end of its retention, the forced
+	// end of its lifetime, and its queueing if it's scheduled for later
+	if job.Retention != nil || job.MaxLifetimeSeconds > 0 || job.Status == StatusScheduled {
+		pipe := q.client.Pipeline()
+		q.scheduleRemovals(ctx, pipe, job)
+		q.scheduleLifetime(ctx, pipe, job)
+		if job.Status == StatusScheduled {
+			q.schedule(ctx, pipe, job)
+		}
+		if _, err := pipe.Exec(ctx); err != nil {
+			return err
+		}
+	}
 	
 	// Add to pending queue if status is pending
 	if job.Status == StatusPending {
-		err = q.client.LPush(ctx, queueKey(), job.ID).Err()
+		err = q.enqueue(ctx, q.client, job).Err()
 		if err != nil {
 			return err
 		}
 	}
 	
+	q.publishEvent(job)
+	
 	return nil
 }
 
-// GetJob retrieves a job by ID
+// GetJob retrieves a job by ID, reporting a missing one as JobQueue says
 func (q *RedisQueue) GetJob(ctx context.Context, jobID string) (*Job, error) {
-	jobJSON, err := q.client.Get(ctx, jobKey(jobID)).Bytes()
+	if err := fault.Maybe(ctx, fault.Redis, "job_id", jobID); err != nil {
+		return nil, err
+	}
+	jobJSON, err := q.client.Get(ctx, q.jobKey(jobID)).Bytes()
 	if err != nil {
 		if err == redis.Nil {
-			return nil, nil // Job not found
+			return nil, missingJob(jobID)
 		}
 		return nil, err
 	}
 	
 	var job Job
-	if err := json.Unmarshal(jobJSON, &job); err != nil {
+	if err := q.opts.Codec.Decode(jobJSON, &job); err != nil {
 		return nil, err
 	}
 	
 	return &job, nil
 }
 
-// UpdateJob updates an existing job
+// UpdateJob updates an existing job, incrementing its Version. It's written
+// in a transaction only if the stored job is still at job's version,
+// failing with ErrVersionConflict otherwise, so a concurrent update isn't
+// silently lost; the caller re-reads the job and retries. It fails with
+// ErrFenced if the job has since been claimed under a claim token other
+// than job's, so a worker that lost its claim can't overwrite the one that
+// took over. It fails with ErrJobNotFound if the job's record is gone,
+// unless job was never stored, which creates it.
 func (q *RedisQueue) UpdateJob(ctx context.Context, job *Job) error {
-	job.UpdatedAt = time.Now()
+	if err := fault.Maybe(ctx, fault.Redis, "job_id", job.ID, "owner", job.Owner); err != nil {
+		return err
+	}
+	key := q.jobKey(job.ID)
+	written := *job
+	txf := func(tx *redis.Tx) error {
+		data, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			if err := checkMissing(job); err != nil {
+				return err
+			}
+		} else if err != nil {
+			return err
+		} else {
+			var stored Job
+			if err := q.opts.Codec.Decode(data, &stored); err != nil {
+				return err
+			}
+			if err := checkUpdate(job, &stored); err != nil {
+				return err
+			}
+		}
+		
+		written.Version = job.Version + 1
+		written.UpdatedAt = q.opts.Clock.Now()
+		written.recordStatus(written.UpdatedAt)
+		jobJSON, err := q.opts.Codec.Encode(&written)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, jobJSON, q.jobTTL(&written))
+			q.indexStatus(ctx, pipe, &written)
+			q.recordHistory(ctx, pipe, &written)
+			return nil
+		})
+		return err
+	}
 	
-	jobJSON, err := json.Marshal(job)
+	err := q.client.Watch(ctx, txf, key)
+	if err == redis.TxFailedErr {
+		return fmt.Errorf("%w: job %s was written during the update", ErrVersionConflict, job.ID)
+	}
 	if err != nil {
 		return err
 	}
+	job.Version, job.UpdatedAt, job.Timeline = written.Version, written.UpdatedAt, written.Timeline
 	
-	return q.client.Set(ctx, jobKey(job.ID), jobJSON, 24*time.Hour).Err()
+	q.publishEvent(job)
+	
+	return nil
 }
 
-// GetPendingJobs returns pending jobs from the queue
-func (q *RedisQueue) GetPendingJobs(ctx context.Context) ([]*Job, error) {
-	// Get job IDs from the pending queue
-	jobIDs, err := q.client.LRange(ctx, queueKey(), 0, -1).Result()
-	if err != nil {
-		return nil, err
+// pendingFetchBatch bounds the job records read by one MGET
+const pendingFetchBatch = 1000
+
+// GetPendingJobs returns up to limit pending jobs, or all of them if limit
+// isn't positive, of every model, the highest priority first and the newest
+// first within a model's list at a priority, or with SchedulingFair within
+// each owner's. Their records are read with one MGET per pendingFetchBatch jobs.
+// IDs whose record expired or was removed are skipped, counted as dangling,
+// and removed from their pending lists, so the lists heal as they're read.
+// With PendingStreams their entries are left for the worker reading them to
+// skip, as those of removed jobs are.
+func (q *RedisQueue) GetPendingJobs(ctx context.Context, limit int) ([]*Job, int, error) {
+	if err := fault.Maybe(ctx, fault.Redis); err != nil {
+		return nil, 0, err
 	}
-	
+
+	// Get job IDs from each model's pending queue at each priority, until
+	// limit are listed
+	var jobIDs, listKeys []string
+	var keys []string
+	if q.opts.PendingStreams {
+		keys = q.allPendingStreamKeys()
+	} else {
+		lists, err := q.pendingLists(ctx, q.allPendingKeys())
+		if err != nil {
+			return nil, 0, err
+		}
+		for _, l := range lists {
+			keys = append(keys, l...)
+		}
+	}
+	for _, key := range keys {
+		remaining := 0
+		if limit > 0 {
+			if len(jobIDs) >= limit {
+				break
+			}
+			remaining = limit - len(jobIDs)
+		}
+		ids, err := q.pendingIDs(ctx, key, remaining)
+		if err != nil {
+			return nil, 0, err
+		}
+		jobIDs = append(jobIDs, ids...)
+		for range ids {
+			listKeys = append(listKeys, key)
+		}
+	}
+
 	var jobs []*Job
-	for _, jobID := range jobIDs {
-		job, err := q.GetJob(ctx, jobID)
+	dangling := 0
+	for start := 0; start < len(jobIDs); start += pendingFetchBatch {
+		end := start + pendingFetchBatch
+		if end > len(jobIDs) {
+			end = len(jobIDs)
+		}
+		keys := make([]string, 0, end-start)
+		for _, jobID := range jobIDs[start:end] {
+			keys = append(keys, q.jobKey(jobID))
+		}
+
+		values, err := q.client.MGet(ctx, keys...).Result()
 		if err != nil {
-			continue // Skip jobs with errors
+			return nil, 0, err
 		}
-		if job != nil {
-			jobs = append(jobs, job)
+		var gone []int
+		for i, value := range values {
+			data, ok := value.(string)
+			if !ok {
+				dangling++
+				gone = append(gone, start+i)
+				continue
+			}
+			var job Job
+			if err := q.opts.Codec.Decode([]byte(data), &job); err != nil {
+				continue // Skip jobs with errors
+			}
+			jobs = append(jobs, &job)
+		}
+		if err := q.removeDangling(ctx, jobIDs, listKeys, gone); err != nil {
+			return nil, 0, err
 		}
 	}
-	
-	return jobs, nil
+	return jobs, dangling, nil
 }
 
-// PopPendingJob removes and returns the oldest pending job
-func (q *RedisQueue) PopPendingJob(ctx context.Context) (*Job, error) {
-	// Pop a job ID from the pending queue
-	jobID, err := q.client.RPop(ctx, queueKey()).Result()
+// removeDangling removes the IDs at the given indexes of jobIDs, whose
+// records are gone, from the pending lists they were listed from. A job's
+// record is written before it's queued, so a listed ID without one is never
+// about to be claimed.
+func (q *RedisQueue) removeDangling(ctx context.Context, jobIDs, listKeys []string, gone []int) error {
+	if len(gone) == 0 || q.opts.PendingStreams {
+		return nil
+	}
+	pipe := q.client.Pipeline()
+	for _, i := range gone {
+		pipe.LRem(ctx, listKeys[i], 0, jobIDs[i])
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// pendingIDs returns up to limit job IDs waiting in a pending list or
+// stream, or all of them if limit isn't positive, newest first
+func (q *RedisQueue) pendingIDs(ctx context.Context, key string, limit int) ([]string, error) {
+	if q.opts.PendingStreams {
+		return q.waitingStreamIDs(ctx, key, limit)
+	}
+	return q.client.LRange(ctx, key, 0, int64(limit-1)).Result()
+}
+
+// RequeueJob resets a job to pending and pushes it back onto the pending
+// queue. It keeps the job's CreatedAt, the retention and lifetime are
+// counted from, and its attempts, which the worker counts as it starts the
+// next; UpdatedAt advances. It fails with ErrInvalidTransition if the
+// job's status changed since it was read.
+func (q *RedisQueue) RequeueJob(ctx context.Context, job *Job) error {
+	now, err := q.client.Time(ctx).Result()
 	if err != nil {
-		if err == redis.Nil {
-			return nil, nil // No pending jobs
-		}
-		return nil, err
+		return err
 	}
-	
-	return q.GetJob(ctx, jobID)
-} 
\ No newline at end of file
+
+	from := job.Status
+	job.Status = StatusPending
+	job.Error = ""
+	job.ErrorCode = ""
+	job.EnqueuedAtMs = now.UnixMilli()
+
+	if err := q.transition(ctx, job, from); err != nil {
+		return err
+	}
+	// A job requeued before it was due isn't promoted again
+	pipe := q.client.TxPipeline()
+	pipe.ZRem(ctx, q.scheduledJobsKey(), job.ID)
+	q.enqueue(ctx, pipe, job)
+	_, err = pipe.Exec(ctx)
+	return err
+}
@@ -0,0 +1,270 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/redis/go-redis/v9"
+)
+
+// newTestRedisQueue creates a RedisQueue on an in-process Redis server,
+// returned to fast-forward its key expiry
+func newTestRedisQueue(t testing.TB, opts Options) (*RedisQueue, *miniredis.Miniredis) {
+	t.Helper()
+	server := miniredis.RunT(t)
+	q, err := NewRedisQueueWithClient(redis.NewClient(&redis.Options{Addr: server.Addr()}), opts)
+	if err != nil {
+		t.Fatalf("NewRedisQueueWithClient: %v", err)
+	}
+	t.Cleanup(func() { q.Close() })
+	return q, server
+}
+
+// roundTrips counts the requests a client sends Redis, a pipeline counting once
+type roundTrips struct{ n atomic.Int64 }
+
+func (r *roundTrips) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (r *roundTrips) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		r.n.Add(1)
+		return next(ctx, cmd)
+	}
+}
+
+func (r *roundTrips) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		r.n.Add(1)
+		return next(ctx, cmds)
+	}
+}
+
+// countRoundTrips starts counting the round trips q makes to Redis
+func countRoundTrips(q *RedisQueue) *roundTrips {
+	counter := &roundTrips{}
+	q.client.AddHook(counter)
+	return counter
+}
+
+func TestUpdateJobOfExpiredRecord(t *testing.T) {
+	q, server := newTestRedisQueue(t, Options{PendingTTL: time.Minute})
+	ctx := context.Background()
+	if err := q.AddJob(ctx, &Job{ID: "job-1"}); err != nil {
+		t.Fatalf("AddJob: %v", err)
+	}
+	job, err := q.GetJob(ctx, "job-1")
+	if err != nil || job == nil {
+		t.Fatalf("GetJob: %v, %v", job, err)
+	}
+
+	server.FastForward(2 * time.Minute)
+	job.Status = StatusProcessing
+	if err := q.UpdateJob(ctx, job); !errors.Is(err, ErrJobNotFound) {
+		t.Fatalf("UpdateJob of an expired job = %v, want ErrJobNotFound", err)
+	}
+	if server.Exists(q.jobKey("job-1")) {
+		t.Fatalf("UpdateJob brought back an expired job")
+	}
+
+	// A job never stored is created
+	if err := q.UpdateJob(ctx, &Job{ID: "job-2", Status: StatusPending}); err != nil {
+		t.Fatalf("UpdateJob of a new job: %v", err)
+	}
+	if job, err := q.GetJob(ctx, "job-2"); err != nil || job == nil || job.Version != 1 {
+		t.Fatalf("GetJob of the created job = %v, %v", job, err)
+	}
+}
+
+func TestClusterKeysTaggedPerQueue(t *testing.T) {
+	for _, tt := range []struct {
+		prefix  string
+		cluster bool
+		want    string
+	}{
+		{"", false, "job:job-1"},
+		{"staging:", false, "staging:job:job-1"},
+		{"", true, "{rmbg}:job:job-1"},
+		{"staging:", true, "{staging:}job:job-1"},
+	} {
+		if got := newRedisKeys(tt.prefix, tt.cluster).jobKey("job-1"); got != tt.want {
+			t.Errorf("jobKey with prefix %q, cluster %v = %q, want %q", tt.prefix, tt.cluster, got, tt.want)
+		}
+	}
+}
+
+func TestKeyPrefixIsolatesQueues(t *testing.T) {
+	server := miniredis.RunT(t)
+	ctx := context.Background()
+	open := func(prefix string) *RedisQueue {
+		q, err := NewRedisQueueWithClient(redis.NewClient(&redis.Options{Addr: server.Addr()}), Options{KeyPrefix: prefix})
+		if err != nil {
+			t.Fatalf("NewRedisQueueWithClient with prefix %q: %v", prefix, err)
+		}
+		t.Cleanup(func() { q.Close() })
+		return q
+	}
+	staging, production := open("staging:"), open("production:")
+
+	if err := staging.AddJob(ctx, &Job{ID: "job-1"}); err != nil {
+		t.Fatalf("AddJob: %v", err)
+	}
+	if err := staging.Pause(ctx); err != nil {
+		t.Fatalf("Pause: %v", err)
+	}
+	if !server.Exists("staging:job:job-1") {
+		t.Fatalf("job written outside its queue's prefix: %v", server.Keys())
+	}
+
+	if job, err := production.GetJob(ctx, "job-1"); !errors.Is(err, ErrJobNotFound) {
+		t.Fatalf("GetJob on another prefix = %v, %v, want ErrJobNotFound", job, err)
+	}
+	if n, err := production.PendingCount(ctx); err != nil || n != 0 {
+		t.Fatalf("PendingCount on another prefix = %d, %v, want 0", n, err)
+	}
+	if job, err := production.ClaimJob(ctx, "worker-1"); err != nil || job != nil {
+		t.Fatalf("claimed a job of another prefix: %v, %v", job, err)
+	}
+	if paused, err := production.IsPaused(ctx); err != nil || paused {
+		t.Fatalf("IsPaused on another prefix = %v, %v, want false", paused, err)
+	}
+
+	if err := staging.Resume(ctx); err != nil {
+		t.Fatalf("Resume: %v", err)
+	}
+	job, err := staging.ClaimJob(ctx, "worker-1")
+	if err != nil || job == nil || job.ID != "job-1" {
+		t.Fatalf("ClaimJob under its own prefix: %v, %v", job, err)
+	}
+}
+
+func TestInvalidKeyPrefix(t *testing.T) {
+	server := miniredis.RunT(t)
+	for _, tc := range []struct {
+		prefix string
+		valid  bool
+	}{
+		{"", true},
+		{"staging:", true},
+		{"tenant-1/rmbg.v2_", true},
+		{"jobs*", false},
+		{"job?", false},
+		{"[a]", false},
+		{"a]", false},
+		{"back\\slash", false},
+		{"{tag}", false},
+		{"tag}", false},
+	} {
+		q, err := NewRedisQueueWithClient(redis.NewClient(&redis.Options{Addr: server.Addr()}), Options{KeyPrefix: tc.prefix})
+		if q != nil {
+			q.Close()
+		}
+		if tc.valid && err != nil {
+			t.Fatalf("NewRedisQueueWithClient with prefix %q: %v", tc.prefix, err)
+		}
+		if !tc.valid && (q != nil || !errors.Is(err, ErrInvalidKeyPrefix)) {
+			t.Fatalf("NewRedisQueueWithClient with prefix %q = %v, %v, want ErrInvalidKeyPrefix", tc.prefix, q, err)
+		}
+		// Rejected before connecting, and not reported as Redis being unreachable
+		if !tc.valid {
+			if q, err := NewRedisQueue("127.0.0.1:1", 0, Options{KeyPrefix: tc.prefix}); q != nil || !errors.Is(err, ErrInvalidKeyPrefix) {
+				t.Fatalf("NewRedisQueue with prefix %q = %v, %v, want ErrInvalidKeyPrefix", tc.prefix, q, err)
+			}
+		}
+	}
+	if keys := server.Keys(); len(keys) != 0 {
+		t.Fatalf("rejected queues wrote %v", keys)
+	}
+}
+
+// BenchmarkGetPendingJobs lists queues of growing depth, reporting the
+// round trips each listing takes, which batching keeps to a few per
+// pendingFetchBatch jobs rather than one per job
+func BenchmarkGetPendingJobs(b *testing.B) {
+	for _, mode := range []struct {
+		name string
+		opts Options
+	}{
+		{"lists", Options{}},
+		{"fair", Options{Scheduling: SchedulingFair}},
+		{"streams", Options{PendingStreams: true}},
+	} {
+		for _, depth := range []int{100, 1000, 5000} {
+			for _, limit := range []int{0, 50} {
+				name := fmt.Sprintf("%s/depth=%d/limit=%d", mode.name, depth, limit)
+				b.Run(name, func(b *testing.B) {
+					q, _ := newTestRedisQueue(b, mode.opts)
+					ctx := context.Background()
+					jobs := make([]*Job, depth)
+					for i := range jobs {
+						jobs[i] = &Job{ID: fmt.Sprintf("job-%05d", i), Owner: fmt.Sprintf("owner-%d", i%7)}
+					}
+					if err := q.AddJobs(ctx, jobs); err != nil {
+						b.Fatalf("AddJobs: %v", err)
+					}
+					want := depth
+					if limit > 0 {
+						want = limit
+					}
+
+					trips := countRoundTrips(q)
+					b.ReportAllocs()
+					b.ResetTimer()
+					for i := 0; i < b.N; i++ {
+						listed, dangling, err := q.GetPendingJobs(ctx, limit)
+						if err != nil || len(listed) != want || dangling != 0 {
+							b.Fatalf("GetPendingJobs = %d jobs, %d dangling, %v, want %d jobs", len(listed), dangling, err, want)
+						}
+					}
+					b.ReportMetric(float64(trips.n.Load())/float64(b.N), "round-trips/op")
+				})
+			}
+		}
+	}
+}
+
+func TestPoolExhaustionFailsFast(t *testing.T) {
+	server := miniredis.RunT(t)
+	const poolTimeout = 100 * time.Millisecond
+	q, err := NewRedisQueue(server.Addr(), 0, Options{PoolSize: 1, PoolTimeout: poolTimeout})
+	if err != nil {
+		t.Fatalf("NewRedisQueue: %v", err)
+	}
+	t.Cleanup(func() { q.Close() })
+	ctx := context.Background()
+	if err := q.AddJob(ctx, &Job{ID: "job-1"}); err != nil {
+		t.Fatalf("AddJob: %v", err)
+	}
+
+	// Hold the pool's only connection
+	conn := q.client.(*redis.Client).Conn()
+	if err := conn.Ping(ctx).Err(); err != nil {
+		t.Fatalf("Ping: %v", err)
+	}
+
+	started := time.Now()
+	_, err = q.GetJob(ctx, "job-1")
+	waited := time.Since(started)
+	if err == nil {
+		t.Fatalf("GetJob with the pool exhausted succeeded")
+	}
+	var commandErr *CommandError
+	if !errors.As(err, &commandErr) || !IsTransient(err) {
+		t.Fatalf("GetJob with the pool exhausted = %v, want a transient CommandError", err)
+	}
+	if waited < poolTimeout || waited > poolTimeout+time.Second {
+		t.Fatalf("GetJob with the pool exhausted failed after %s, want about the %s pool timeout", waited, poolTimeout)
+	}
+
+	// The connection serves calls again once it's back in the pool
+	conn.Close()
+	if _, err := q.GetJob(ctx, "job-1"); err != nil {
+		t.Fatalf("GetJob once the connection is released: %v", err)
+	}
+}
@@ -0,0 +1,454 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// SentinelScheme is the URL scheme naming Redis Sentinels and the master
+// they manage: redis-sentinel://[:password@]host:port[,host:port]/master[/db],
+// optionally with ?sentinel_password= for Sentinels requiring their own.
+const SentinelScheme = "redis-sentinel"
+
+// defaultSentinelPort is the port of a Sentinel named without one
+const defaultSentinelPort = ":26379"
+
+// defaultClusterTag begins every key of a queue without a key prefix in
+// cluster mode
+const defaultClusterTag = "{rmbg}:"
+
+// redisKeys builds the Redis keys of one queue, each beginning with its
+// prefix, so queues with different prefixes share a process and a database
+// without seeing each other's keys
+type redisKeys struct {
+	prefix string
+}
+
+// newRedisKeys returns the keys of a queue with a key prefix, made a hash
+// tag by clusterKeyPrefix if cluster is set
+func newRedisKeys(prefix string, cluster bool) redisKeys {
+	if cluster {
+		prefix = clusterKeyPrefix(prefix)
+	}
+	return redisKeys{prefix: prefix}
+}
+
+// clusterKeyPrefix returns the prefix a queue's keys begin with in cluster
+// mode: its key prefix as a hash tag, or defaultClusterTag without one.
+// Redis Cluster hashes only the braced part, so a queue's keys share a slot
+// and the scripts and transactions spanning several of them keep working,
+// while queues with different prefixes hash to different slots and spread
+// over the cluster's shards.
+func clusterKeyPrefix(prefix string) string {
+	if prefix == "" {
+		return defaultClusterTag
+	}
+	return "{" + prefix + "}"
+}
+
+// prefixed returns names, keys without the prefix, with it
+func (k redisKeys) prefixed(names []string) []string {
+	keys := make([]string, len(names))
+	for i, name := range names {
+		keys[i] = k.prefix + name
+	}
+	return keys
+}
+
+// ErrInvalidKeyPrefix means Options.KeyPrefix can't be used: it holds a
+// character that SCAN patterns or cluster hash tags give a meaning to
+var ErrInvalidKeyPrefix = errors.New("invalid Redis key prefix")
+
+// checkKeyPrefix returns ErrInvalidKeyPrefix for a prefix that would change
+// the meaning of the SCAN patterns built from it, or the slot of a key
+func checkKeyPrefix(prefix string) error {
+	if strings.ContainsAny(prefix, "*?[]\\{}") {
+		return fmt.Errorf("%w: %q may not contain *, ?, [, ], \\, {, or }", ErrInvalidKeyPrefix, prefix)
+	}
+	return nil
+}
+
+// ErrInvalidRedisURL means a Redis address couldn't be parsed, as opposed to
+// naming a Redis that couldn't be reached
+var ErrInvalidRedisURL = errors.New("invalid Redis URL")
+
+// invalidRedisURL wraps a parse error in ErrInvalidRedisURL. The URL that
+// net/url quotes is dropped, since it may hold a password.
+func invalidRedisURL(err error) error {
+	var urlErr *url.Error
+	if errors.As(err, &urlErr) {
+		err = urlErr.Err
+	}
+	return fmt.Errorf("%w: %v", ErrInvalidRedisURL, err)
+}
+
+// redactRedisAddr returns addr fit for logs, without its credentials or query
+func redactRedisAddr(addr string) string {
+	addr, _, _ = strings.Cut(addr, "?")
+	scheme, rest, ok := strings.Cut(addr, "://")
+	if !ok {
+		return addr
+	}
+	if at := strings.LastIndex(rest, "@"); at >= 0 {
+		rest = rest[at+1:]
+	}
+	return scheme + "://" + rest
+}
+
+// Default bounds of a Redis call, so one caught by a failover fails with a
+// transient error instead of hanging. The client honors context deadlines,
+// so a caller's shorter deadline wins over the read and write timeouts.
+const (
+	redisDialTimeout  = 5 * time.Second
+	redisReadTimeout  = 3 * time.Second
+	redisWriteTimeout = 3 * time.Second
+	// redisCommandTimeout bounds a whole command or pipeline, with its
+	// retries, when the caller's context has no deadline of its own
+	redisCommandTimeout = 10 * time.Second
+)
+
+// setConnDefaults fills in the connection timeouts left unset
+func (o *Options) setConnDefaults() {
+	if o.DialTimeout <= 0 {
+		o.DialTimeout = redisDialTimeout
+	}
+	if o.ReadTimeout <= 0 {
+		o.ReadTimeout = redisReadTimeout
+	}
+	if o.WriteTimeout <= 0 {
+		o.WriteTimeout = redisWriteTimeout
+	}
+}
+
+// CommandError is a failed Redis command, naming the command and the first
+// key it touched, if any, so a timeout can be traced to the call that hit it
+type CommandError struct {
+	Command string
+	Key     string
+	Err     error
+}
+
+func (e *CommandError) Error() string {
+	if e.Key == "" {
+		return fmt.Sprintf("redis %s: %v", e.Command, e.Err)
+	}
+	return fmt.Sprintf("redis %s %s: %v", e.Command, e.Key, e.Err)
+}
+
+func (e *CommandError) Unwrap() error {
+	return e.Err
+}
+
+// commandKey returns the first key a command names, or "" for one naming
+// none. Scripts name theirs after the script and the key count.
+func commandKey(cmd redis.Cmder) string {
+	args := cmd.Args()
+	pos := 1
+	switch cmd.Name() {
+	case "eval", "evalsha", "eval_ro", "evalsha_ro":
+		if len(args) <= 3 {
+			return ""
+		}
+		if n, ok := args[2].(int); !ok || n == 0 {
+			return ""
+		}
+		pos = 3
+	case "ping", "time", "dbsize", "info", "scan", "multi", "exec", "discard", "unwatch":
+		return ""
+	}
+	if len(args) <= pos {
+		return ""
+	}
+	key, _ := args[pos].(string)
+	return key
+}
+
+// describeError returns the error a command failed with as a CommandError,
+// setting it on the command. Replies that aren't failures, a missing key
+// and an aborted transaction, are left as they are, since callers compare
+// them by value.
+func describeError(cmd redis.Cmder, err error) error {
+	if err == nil || err == redis.Nil || err == redis.TxFailedErr {
+		return err
+	}
+	var described *CommandError
+	if errors.As(err, &described) {
+		return err
+	}
+	described = &CommandError{Command: cmd.Name(), Key: commandKey(cmd), Err: err}
+	cmd.SetErr(described)
+	return described
+}
+
+// blockingCommands wait server-side for up to a timeout they carry, so
+// they're left to the client's read timeout, which it extends by that wait
+var blockingCommands = map[string]bool{
+	"blpop": true, "brpop": true, "brpoplpush": true, "blmove": true, "blmpop": true,
+	"bzpopmin": true, "bzpopmax": true, "bzmpop": true, "xread": true, "xreadgroup": true,
+	"wait": true,
+}
+
+// commandHook is a client hook giving each command or pipeline sent without
+// a context deadline one of timeout, so no call waits on Redis indefinitely
+// whatever its caller passed, and describing each failure as a CommandError
+type commandHook struct {
+	timeout time.Duration
+}
+
+func (commandHook) DialHook(next redis.DialHook) redis.DialHook {
+	return next
+}
+
+func (h commandHook) ProcessHook(next redis.ProcessHook) redis.ProcessHook {
+	return func(ctx context.Context, cmd redis.Cmder) error {
+		if _, ok := ctx.Deadline(); !ok && !blockingCommands[cmd.Name()] {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, h.timeout)
+			defer cancel()
+		}
+		return describeError(cmd, next(ctx, cmd))
+	}
+}
+
+func (h commandHook) ProcessPipelineHook(next redis.ProcessPipelineHook) redis.ProcessPipelineHook {
+	return func(ctx context.Context, cmds []redis.Cmder) error {
+		if _, ok := ctx.Deadline(); !ok {
+			var cancel context.CancelFunc
+			ctx, cancel = context.WithTimeout(ctx, h.timeout)
+			defer cancel()
+		}
+		err := next(ctx, cmds)
+		var first error
+		for _, cmd := range cmds {
+			if described := describeError(cmd, cmd.Err()); described != nil && first == nil {
+				first = described
+			}
+		}
+		if err == nil || first == nil {
+			return err
+		}
+		return first
+	}
+}
+
+// newRedisClient returns a client for the Redis at addr: a host:port, a
+// redis:// or rediss:// URL, a comma-separated list of cluster nodes, or a
+// redis-sentinel:// URL. The cluster nodes or Sentinels in opts are used
+// instead when it names any. The pool, timeouts, and retries are those of
+// opts, with go-redis's defaults for those left zero, except for the
+// timeouts, which default to the bounds above.
+func newRedisClient(addr string, db int, opts Options) (redis.UniversalClient, error) {
+	opts.setConnDefaults()
+	if strings.HasPrefix(addr, SentinelScheme+"://") {
+		sentinel, err := parseSentinelURL(addr)
+		if err != nil {
+			return nil, invalidRedisURL(err)
+		}
+		opts.SentinelAddrs = sentinel.SentinelAddrs
+		opts.SentinelMaster = sentinel.SentinelMaster
+		opts.SentinelPassword = sentinel.SentinelPassword
+		opts.Password = sentinel.Password
+		db = sentinel.DB
+	} else if strings.Contains(addr, ",") && !strings.Contains(addr, "://") && len(opts.ClusterAddrs) == 0 {
+		for _, node := range strings.Split(addr, ",") {
+			if node = strings.TrimSpace(node); node != "" {
+				opts.ClusterAddrs = append(opts.ClusterAddrs, node)
+			}
+		}
+	}
+
+	if len(opts.ClusterAddrs) > 0 {
+		if db != 0 {
+			return nil, fmt.Errorf("a Redis Cluster has only database 0, not %d", db)
+		}
+		return redis.NewClusterClient(&redis.ClusterOptions{
+			Addrs:           opts.ClusterAddrs,
+			Password:        opts.Password,
+			PoolSize:        opts.PoolSize,
+			PoolTimeout:     opts.PoolTimeout,
+			MinIdleConns:    opts.MinIdleConns,
+			DialTimeout:     opts.DialTimeout,
+			ReadTimeout:     opts.ReadTimeout,
+			WriteTimeout:    opts.WriteTimeout,
+			MaxRetries:      opts.MaxRetries,
+			MinRetryBackoff: opts.MinRetryBackoff,
+			MaxRetryBackoff: opts.MaxRetryBackoff,
+
+			ContextTimeoutEnabled: true,
+		}), nil
+	}
+
+	if len(opts.SentinelAddrs) > 0 {
+		if opts.SentinelMaster == "" {
+			return nil, fmt.Errorf("a Sentinel master name is required with Sentinel addresses")
+		}
+		return redis.NewFailoverClient(&redis.FailoverOptions{
+			MasterName:       opts.SentinelMaster,
+			SentinelAddrs:    opts.SentinelAddrs,
+			SentinelPassword: opts.SentinelPassword,
+			Password:         opts.Password,
+			DB:               db,
+			PoolSize:         opts.PoolSize,
+			PoolTimeout:      opts.PoolTimeout,
+			MinIdleConns:     opts.MinIdleConns,
+			DialTimeout:      opts.DialTimeout,
+			ReadTimeout:      opts.ReadTimeout,
+			WriteTimeout:     opts.WriteTimeout,
+			MaxRetries:       opts.MaxRetries,
+			MinRetryBackoff:  opts.MinRetryBackoff,
+			MaxRetryBackoff:  opts.MaxRetryBackoff,
+
+			ContextTimeoutEnabled: true,
+		}), nil
+	}
+
+	if strings.HasPrefix(addr, "redis://") || strings.HasPrefix(addr, "rediss://") {
+		return parseRedisURL(addr, db, opts)
+	}
+	return redis.NewClient(&redis.Options{
+		Addr:            addr,
+		DB:              db,
+		Password:        opts.Password,
+		PoolSize:        opts.PoolSize,
+		PoolTimeout:     opts.PoolTimeout,
+		MinIdleConns:    opts.MinIdleConns,
+		DialTimeout:     opts.DialTimeout,
+		ReadTimeout:     opts.ReadTimeout,
+		WriteTimeout:    opts.WriteTimeout,
+		MaxRetries:      opts.MaxRetries,
+		MinRetryBackoff: opts.MinRetryBackoff,
+		MaxRetryBackoff: opts.MaxRetryBackoff,
+
+		ContextTimeoutEnabled: true,
+	}), nil
+}
+
+// sentinelTarget is what a redis-sentinel:// URL names
+type sentinelTarget struct {
+	SentinelAddrs    []string
+	SentinelMaster   string
+	SentinelPassword string
+	Password         string
+	DB               int
+}
+
+// parseSentinelURL parses a redis-sentinel:// URL. Its host list is split
+// by hand, since net/url accepts only one host.
+func parseSentinelURL(raw string) (sentinelTarget, error) {
+	var target sentinelTarget
+	rest := strings.TrimPrefix(raw, SentinelScheme+"://")
+	if rest == raw {
+		return target, fmt.Errorf("sentinel URL must start with %s://", SentinelScheme)
+	}
+
+	rest, query, _ := strings.Cut(rest, "?")
+	if query != "" {
+		values, err := url.ParseQuery(query)
+		if err != nil {
+			return target, fmt.Errorf("invalid sentinel URL query: %w", err)
+		}
+		target.SentinelPassword = values.Get("sentinel_password")
+	}
+	if at := strings.LastIndex(rest, "@"); at >= 0 {
+		_, password, _ := strings.Cut(rest[:at], ":")
+		unescaped, err := url.PathUnescape(password)
+		if err != nil {
+			return target, fmt.Errorf("invalid sentinel URL password: %w", err)
+		}
+		target.Password = unescaped
+		rest = rest[at+1:]
+	}
+
+	hosts, path, _ := strings.Cut(rest, "/")
+	for _, host := range strings.Split(hosts, ",") {
+		host = strings.TrimSpace(host)
+		if host == "" {
+			continue
+		}
+		if !strings.Contains(host, ":") {
+			host += defaultSentinelPort
+		}
+		target.SentinelAddrs = append(target.SentinelAddrs, host)
+	}
+	if len(target.SentinelAddrs) == 0 {
+		return target, fmt.Errorf("sentinel URL names no Sentinels")
+	}
+
+	master, db, _ := strings.Cut(path, "/")
+	if master == "" {
+		return target, fmt.Errorf("sentinel URL names no master")
+	}
+	target.SentinelMaster = master
+	if db != "" {
+		n, err := strconv.Atoi(db)
+		if err != nil || n < 0 {
+			return target, fmt.Errorf("invalid sentinel URL database %q", db)
+		}
+		target.DB = n
+	}
+	return target, nil
+}
+
+// keyspace returns the client for SCAN and DBSIZE, which name no key: in
+// cluster mode the master of the slot the queue's keys hash to, whose
+// keyspace holds them, and the queue's client otherwise
+func (q *RedisQueue) keyspace(ctx context.Context) (redis.UniversalClient, error) {
+	cluster, ok := q.client.(*redis.ClusterClient)
+	if !ok {
+		return q.client, nil
+	}
+	return cluster.MasterForKey(ctx, q.prefix)
+}
+
+// parseRedisURL returns a client for a redis:// or rediss:// URL, which may
+// carry a username and password, a database as its path, replacing db, and
+// go-redis connection options as its query, which win over those of opts.
+// rediss:// connects over TLS.
+func parseRedisURL(raw string, db int, opts Options) (*redis.Client, error) {
+	parsed, err := redis.ParseURL(raw)
+	if err != nil {
+		return nil, invalidRedisURL(err)
+	}
+	if parsed.DB == 0 {
+		parsed.DB = db
+	}
+	if parsed.Password == "" {
+		parsed.Password = opts.Password
+	}
+	if parsed.PoolSize == 0 {
+		parsed.PoolSize = opts.PoolSize
+	}
+	if parsed.PoolTimeout == 0 {
+		parsed.PoolTimeout = opts.PoolTimeout
+	}
+	if parsed.MinIdleConns == 0 {
+		parsed.MinIdleConns = opts.MinIdleConns
+	}
+	if parsed.DialTimeout == 0 {
+		parsed.DialTimeout = opts.DialTimeout
+	}
+	if parsed.ReadTimeout == 0 {
+		parsed.ReadTimeout = opts.ReadTimeout
+	}
+	if parsed.WriteTimeout == 0 {
+		parsed.WriteTimeout = opts.WriteTimeout
+	}
+	if parsed.MaxRetries == 0 {
+		parsed.MaxRetries = opts.MaxRetries
+	}
+	if parsed.MinRetryBackoff == 0 {
+		parsed.MinRetryBackoff = opts.MinRetryBackoff
+	}
+	if parsed.MaxRetryBackoff == 0 {
+		parsed.MaxRetryBackoff = opts.MaxRetryBackoff
+	}
+	parsed.ContextTimeoutEnabled = true
+	return redis.NewClient(parsed), nil
+}
@@ -0,0 +1,49 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// RequeueFailed requeues, as RequeueJob does, the failed jobs last updated
+// at or after since, or every failed job if since is zero, that requeue
+// accepts; it's called with each, so the caller can skip jobs that can't be
+// processed again. Jobs keep their input and attempt history, and the
+// worker's next claim counts the new attempt. Jobs are found through the
+// failed status index; a job that changed status before it was requeued is
+// left as it is. It returns how many jobs were requeued, and with an error
+// how many were before it.
+func (q *RedisQueue) RequeueFailed(ctx context.Context, since time.Time, requeue func(job *Job) bool) (int, error) {
+	lowest := "-inf"
+	if !since.IsZero() {
+		lowest = strconv.FormatInt(since.UnixMilli(), 10)
+	}
+	ids, err := q.client.ZRangeByScore(ctx, q.statusIndexKey(StatusFailed), &redis.ZRangeBy{Min: lowest, Max: "+inf"}).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	requeued := 0
+	for _, id := range ids {
+		job, err := NilIfNotFound(q.GetJob(ctx, id))
+		if err != nil {
+			return requeued, err
+		}
+		if job == nil || job.Status != StatusFailed || !requeue(job) {
+			continue
+		}
+		err = q.RequeueJob(ctx, job)
+		if errors.Is(err, ErrInvalidTransition) || errors.Is(err, ErrJobNotFound) {
+			continue
+		}
+		if err != nil {
+			return requeued, err
+		}
+		requeued++
+	}
+	return requeued, nil
+}
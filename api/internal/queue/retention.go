@@ -0,0 +1,255 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Where a job's retention came from, highest precedence first
+const (
+	// RetentionFromJob is retention requested with the submission
+	RetentionFromJob = "job"
+	// RetentionFromPolicy is retention from the owner's lifecycle policy
+	RetentionFromPolicy = "policy"
+	// RetentionFromDefault is the deployment's default retention
+	RetentionFromDefault = "default"
+)
+
+// Kinds of scheduled file removal
+const (
+	// RemovalResults removes a job's record, result, and input
+	RemovalResults = "results"
+	// RemovalInputs removes only a job's input, ahead of its result
+	RemovalInputs = "inputs"
+)
+
+// defaultJobTTL is how long a job without a retention snapshot is kept
+const defaultJobTTL = 24 * time.Hour
+
+// RetentionGrace keeps a job record's Redis TTL well past its expiry. The
+// sweeper tears expired jobs down itself, so the TTL is only a safety net
+// for a sweeper that has stopped. Workers use the same grace.
+const RetentionGrace = 7 * 24 * time.Hour
+
+// Retention is how long a job is kept, snapshotted at creation so later
+// policy changes leave it alone
+type Retention struct {
+	// ResultSeconds is how long the job and its result are kept after creation
+	ResultSeconds int64 `json:"result_seconds"`
+	// InputSeconds is how long the upload is kept after creation; 0 keeps
+	// it as long as the result
+	InputSeconds int64 `json:"input_seconds,omitempty"`
+	// Source is where the retention came from
+	Source string `json:"source"`
+}
+
+// LifecyclePolicy overrides the deployment's retention defaults for the
+// new jobs of one owner. Zero durations fall back to the defaults.
+type LifecyclePolicy struct {
+	ResultRetentionSeconds int64 `json:"result_retention_seconds,omitempty"`
+	InputRetentionSeconds  int64 `json:"input_retention_seconds,omitempty"`
+	// MaxLifetimeSeconds bounds how long new jobs may stay unfinished
+	MaxLifetimeSeconds int64 `json:"max_lifetime_seconds,omitempty"`
+	// RequireWebhook rejects submissions without a webhook delivery
+	RequireWebhook bool      `json:"require_webhook,omitempty"`
+	UpdatedAt      time.Time `json:"updated_at"`
+}
+
+// ExpiresAt returns when the job and its result are removed, or the zero
+// time for jobs kept for their status's TTL from their last update
+func (j *Job) ExpiresAt() time.Time {
+	if j.Retention == nil {
+		return time.Time{}
+	}
+	return j.CreatedAt.Add(time.Duration(j.Retention.ResultSeconds) * time.Second)
+}
+
+// InputExpiresAt returns when the job's upload is removed, or the zero time
+// if it's kept until the job expires
+func (j *Job) InputExpiresAt() time.Time {
+	if j.Retention == nil || j.Retention.InputSeconds <= 0 || j.Retention.InputSeconds >= j.Retention.ResultSeconds {
+		return time.Time{}
+	}
+	return j.CreatedAt.Add(time.Duration(j.Retention.InputSeconds) * time.Second)
+}
+
+// lifecyclePoliciesKey returns the Redis hash of lifecycle policies by owner
+func (k redisKeys) lifecyclePoliciesKey() string {
+	return k.prefix + "lifecycle_policies"
+}
+
+// removalScheduleKey returns the sorted set of job IDs due a kind of
+// removal, scored by when it's due in Unix seconds
+func (k redisKeys) removalScheduleKey(kind string) string {
+	return k.prefix + "retention:" + kind
+}
+
+// statusTTL returns how long a job record without a retention snapshot is
+// kept after an update to status
+func (o *Options) statusTTL(status JobStatus) time.Duration {
+	switch status {
+	case StatusCompleted:
+		return o.CompletedTTL
+	case StatusFailed, StatusCancelled:
+		return o.FailedTTL
+	}
+	return o.PendingTTL
+}
+
+// JobExpiresAt returns when the job's record is removed: at the end of its
+// retention, or its status's TTL after its last update without one. The
+// TTL restarts whenever the job is updated.
+func (q *RedisQueue) JobExpiresAt(job *Job) time.Time {
+	return q.opts.jobExpiresAt(job)
+}
+
+// jobExpiresAt is JobExpiresAt for any backend
+func (o *Options) jobExpiresAt(job *Job) time.Time {
+	if at := job.ExpiresAt(); !at.IsZero() {
+		return at
+	}
+	ttl := o.statusTTL(job.Status)
+	if at := job.ScheduledUntil(); (job.Status == StatusScheduled || job.Status == StatusRetrying) && at.After(job.UpdatedAt) {
+		return at.Add(ttl)
+	}
+	return job.UpdatedAt.Add(ttl)
+}
+
+// jobTTL returns how long the job's record is kept from now
+func (q *RedisQueue) jobTTL(job *Job) time.Duration {
+	return q.opts.recordTTL(job)
+}
+
+// recordTTL is jobTTL for any backend
+func (o *Options) recordTTL(job *Job) time.Duration {
+	if job.Retention == nil {
+		ttl := o.statusTTL(job.Status)
+		// Kept as long once due as a job queued on submission
+		if at := job.ScheduledUntil(); (job.Status == StatusScheduled || job.Status == StatusRetrying) && at.After(o.Clock.Now()) {
+			return ttl + at.Sub(o.Clock.Now())
+		}
+		return ttl
+	}
+	ttl := job.ExpiresAt().Add(RetentionGrace).Sub(o.Clock.Now())
+	if ttl < time.Second {
+		ttl = time.Second
+	}
+	return ttl
+}
+
+// scheduleRemovals queues the removal of the job's files at their expiry
+func (q *RedisQueue) scheduleRemovals(ctx context.Context, pipe redis.Pipeliner, job *Job) {
+	if job.Retention == nil {
+		return
+	}
+	pipe.ZAdd(ctx, q.removalScheduleKey(RemovalResults), redis.Z{Score: float64(job.ExpiresAt().Unix()), Member: job.ID})
+	if at := job.InputExpiresAt(); !at.IsZero() {
+		pipe.ZAdd(ctx, q.removalScheduleKey(RemovalInputs), redis.Z{Score: float64(at.Unix()), Member: job.ID})
+	} else {
+		pipe.ZRem(ctx, q.removalScheduleKey(RemovalInputs), job.ID)
+	}
+}
+
+// RescheduleRemovals schedules the job's removals by the retention it has
+// now, unscheduling them if it has none
+func (q *RedisQueue) RescheduleRemovals(ctx context.Context, job *Job) error {
+	pipe := q.client.TxPipeline()
+	if job.Retention == nil {
+		pipe.ZRem(ctx, q.removalScheduleKey(RemovalResults), job.ID)
+		pipe.ZRem(ctx, q.removalScheduleKey(RemovalInputs), job.ID)
+	}
+	q.scheduleRemovals(ctx, pipe, job)
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// DueRemovals returns up to limit job IDs whose kind of removal was due by now
+func (q *RedisQueue) DueRemovals(ctx context.Context, kind string, now time.Time, limit int64) ([]string, error) {
+	return q.client.ZRangeByScore(ctx, q.removalScheduleKey(kind), &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now.Unix(), 10),
+		Count: limit,
+	}).Result()
+}
+
+// CompleteRemoval unschedules a removal whose files are gone. Removing a
+// job's results deletes its record too.
+func (q *RedisQueue) CompleteRemoval(ctx context.Context, kind, jobID string) error {
+	pipe := q.client.TxPipeline()
+	pipe.ZRem(ctx, q.removalScheduleKey(kind), jobID)
+	if kind == RemovalResults {
+		pipe.ZRem(ctx, q.removalScheduleKey(RemovalInputs), jobID)
+		q.unindexStatus(ctx, pipe, jobID)
+		pipe.Del(ctx, q.jobKey(jobID))
+	}
+	_, err := pipe.Exec(ctx)
+	return err
+}
+
+// SetLifecyclePolicy stores an owner's policy, replacing any previous one
+func (q *RedisQueue) SetLifecyclePolicy(ctx context.Context, owner string, policy LifecyclePolicy) error {
+	data, err := json.Marshal(policy)
+	if err != nil {
+		return err
+	}
+	return q.client.HSet(ctx, q.lifecyclePoliciesKey(), owner, data).Err()
+}
+
+// LifecyclePolicy returns an owner's policy, or nil if it has none
+func (q *RedisQueue) LifecyclePolicy(ctx context.Context, owner string) (*LifecyclePolicy, error) {
+	data, err := q.client.HGet(ctx, q.lifecyclePoliciesKey(), owner).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var policy LifecyclePolicy
+	if err := json.Unmarshal(data, &policy); err != nil {
+		return nil, err
+	}
+	return &policy, nil
+}
+
+// ClearLifecyclePolicy removes an owner's policy
+func (q *RedisQueue) ClearLifecyclePolicy(ctx context.Context, owner string) error {
+	return q.client.HDel(ctx, q.lifecyclePoliciesKey(), owner).Err()
+}
+
+// RetainOwnerJobs replaces the retention of the owner's stored jobs with
+// retention, except those whose submission asked for their own, and
+// reschedules their removal. It returns how many jobs changed and whether
+// every job was scanned.
+func (q *RedisQueue) RetainOwnerJobs(ctx context.Context, owner string, retention Retention) (int, bool, error) {
+	var jobs []*Job
+	complete, err := q.scanJobs(ctx, func(job *Job) bool {
+		if job.Owner == owner && (job.Retention == nil || job.Retention.Source != RetentionFromJob) {
+			jobs = append(jobs, job)
+		}
+		return true
+	})
+	if err != nil {
+		return 0, false, err
+	}
+
+	for i, job := range jobs {
+		r := retention
+		job.Retention = &r
+		job.Version++
+		data, err := q.opts.Codec.Encode(job)
+		if err != nil {
+			return i, false, err
+		}
+		pipe := q.client.TxPipeline()
+		pipe.Set(ctx, q.jobKey(job.ID), data, q.jobTTL(job))
+		q.scheduleRemovals(ctx, pipe, job)
+		if _, err := pipe.Exec(ctx); err != nil {
+			return i, false, err
+		}
+	}
+	return len(jobs), complete, nil
+}
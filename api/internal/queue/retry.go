@@ -0,0 +1,146 @@
+package queue
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Backoff between attempts at a job failing on transient errors
+const (
+	// RetryBaseDelay is the wait before a job's second attempt
+	RetryBaseDelay = time.Second
+	// retryBackoffFactor multiplies the wait before each further attempt
+	retryBackoffFactor = 4
+	// MaxRetryDelay caps the wait before any attempt
+	MaxRetryDelay = 5 * time.Minute
+)
+
+// MaxAttemptHistory caps the attempts kept in a job's AttemptHistory, so a
+// job requeued over and over doesn't grow its record without bound; the
+// oldest are dropped first
+const MaxAttemptHistory = 20
+
+// Attempt records one failed attempt at processing a job: when and by which
+// worker it started, if known, and when and how it ended
+type Attempt struct {
+	Attempt   int        `json:"attempt"`
+	Error     string     `json:"error"`
+	ErrorCode string     `json:"error_code,omitempty"`
+	StartedAt *time.Time `json:"started_at,omitempty"`
+	WorkerID  string     `json:"worker_id,omitempty"`
+	FailedAt  time.Time  `json:"failed_at"`
+}
+
+// RetryDelay returns how long a job waits after its attempt-th failed
+// attempt: 1s, 4s, 16s, and so on, up to MaxRetryDelay
+func RetryDelay(attempt int) time.Duration {
+	delay := RetryBaseDelay
+	for i := 1; i < attempt && delay < MaxRetryDelay; i++ {
+		delay *= retryBackoffFactor
+	}
+	if delay > MaxRetryDelay {
+		delay = MaxRetryDelay
+	}
+	return delay
+}
+
+// CanRetry reports whether the job has attempts left after its current one
+func (j *Job) CanRetry() bool {
+	return j.Attempts < j.MaxAttempts
+}
+
+// recordAttempt adds the job's current attempt, ending now with its
+// current error, to its attempt history
+func (j *Job) recordAttempt(now time.Time) {
+	j.appendAttempt(Attempt{
+		Attempt:   j.Attempts,
+		Error:     j.Error,
+		ErrorCode: j.ErrorCode,
+		StartedAt: j.AttemptStartedAt,
+		WorkerID:  j.WorkerID,
+		FailedAt:  now,
+	})
+}
+
+// appendAttempt adds an attempt to the job's history, dropping the oldest
+// beyond MaxAttemptHistory
+func (j *Job) appendAttempt(attempt Attempt) {
+	j.AttemptHistory = append(j.AttemptHistory, attempt)
+	if n := len(j.AttemptHistory) - MaxAttemptHistory; n > 0 {
+		j.AttemptHistory = append([]Attempt(nil), j.AttemptHistory[n:]...)
+	}
+}
+
+// AppendAttempt adds an attempt to a job's history, leaving the rest of its
+// record alone. The record is rewritten only if nothing else wrote it since
+// it was read, retrying otherwise, so a status change racing the append
+// isn't undone; progress is kept apart from the record and never touched.
+// It fails with ErrJobNotFound if the job has no record, and with
+// ErrTransitionConflict if the record kept changing.
+func (q *RedisQueue) AppendAttempt(ctx context.Context, jobID string, attempt Attempt) error {
+	key := q.jobKey(jobID)
+	txf := func(tx *redis.Tx) error {
+		data, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			return fmt.Errorf("%w: %s", ErrJobNotFound, jobID)
+		}
+		if err != nil {
+			return err
+		}
+		var job Job
+		if err := q.opts.Codec.Decode(data, &job); err != nil {
+			return err
+		}
+		job.appendAttempt(attempt)
+		job.Version++
+		encoded, err := q.opts.Codec.Encode(&job)
+		if err != nil {
+			return err
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, encoded, q.jobTTL(&job))
+			return nil
+		})
+		return err
+	}
+	for i := 0; i < maxTransitionRetries; i++ {
+		err := q.client.Watch(ctx, txf, key)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return ErrTransitionConflict
+}
+
+// RetryJob handles a claimed job whose attempt failed with a transient
+// error, set in its Error and ErrorCode. The attempt is added to the job's
+// AttemptHistory. A job with attempts left is scheduled to be queued again
+// after delay, usually RetryDelay(job.Attempts), as retrying with its error
+// cleared; one without is failed, keeping the error, as FailJob does. The
+// worker still acknowledges its claim with AckJob.
+func (q *RedisQueue) RetryJob(ctx context.Context, job *Job, delay time.Duration) error {
+	now, err := q.client.Time(ctx).Result()
+	if err != nil {
+		return err
+	}
+	job.recordAttempt(now)
+	if !job.CanRetry() {
+		return q.FailJob(ctx, job, job.ErrorCode, job.Error)
+	}
+
+	retryAt := now.Add(delay).UTC()
+	from := job.Status
+	job.Status = StatusRetrying
+	job.RetryAt = &retryAt
+	job.Error, job.ErrorCode = "", ""
+	if err := q.transition(ctx, job, from); err != nil {
+		return err
+	}
+	pipe := q.client.Pipeline()
+	q.schedule(ctx, pipe, job)
+	_, err = pipe.Exec(ctx)
+	return err
+}
@@ -0,0 +1,137 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// PromoteBatch is how many due jobs one PromoteDueJobs call moves at most
+const PromoteBatch = 500
+
+// scheduledJobsKey returns the sorted set of scheduled job IDs, scored by
+// when they're due in Unix milliseconds
+func (k redisKeys) scheduledJobsKey() string {
+	return k.prefix + "scheduled_jobs"
+}
+
+// promotingJobsKey returns the list of due job IDs taken off the schedule
+// but not yet pushed onto their pending lists
+func (k redisKeys) promotingJobsKey() string {
+	return k.prefix + "promoting_jobs"
+}
+
+// takeDueScript moves up to ARGV[2] IDs scored at most ARGV[1] from the
+// sorted set at KEYS[1] onto the list at KEYS[2]. Each ID is taken by one
+// caller only, however many replicas promote at once.
+var takeDueScript = redis.NewScript(`
+local ids = redis.call("ZRANGEBYSCORE", KEYS[1], "-inf", ARGV[1], "LIMIT", 0, ARGV[2])
+for _, id in ipairs(ids) do
+	redis.call("ZREM", KEYS[1], id)
+	redis.call("RPUSH", KEYS[2], id)
+end
+return #ids
+`)
+
+// ScheduledUntil returns when the job is due to be queued: its RetryAt while
+// retrying, otherwise its ProcessAt, or the zero time if it was queued on
+// submission
+func (j *Job) ScheduledUntil() time.Time {
+	if j.Status == StatusRetrying && j.RetryAt != nil {
+		return *j.RetryAt
+	}
+	if j.ProcessAt == nil {
+		return time.Time{}
+	}
+	return *j.ProcessAt
+}
+
+// schedule adds the job to the scheduled set, due at its ScheduledUntil
+func (q *RedisQueue) schedule(ctx context.Context, pipe redis.Pipeliner, job *Job) {
+	pipe.ZAdd(ctx, q.scheduledJobsKey(), redis.Z{Score: float64(job.ScheduledUntil().UnixMilli()), Member: job.ID})
+}
+
+// PromoteDueJobs moves scheduled and retrying jobs that are due onto their
+// pending lists, resetting them to pending, and returns how many were
+// promoted. Due IDs are first moved atomically onto a staging list, so two
+// replicas never promote the same job, and each job is marked pending before
+// it's pushed, so the worker that claims it never reads it as scheduled. IDs
+// left on the staging list by a crash are promoted on the next call.
+func (q *RedisQueue) PromoteDueJobs(ctx context.Context) (int, error) {
+	now, err := q.client.Time(ctx).Result()
+	if err != nil {
+		return 0, err
+	}
+	err = takeDueScript.Run(ctx, q.client, []string{q.scheduledJobsKey(), q.promotingJobsKey()},
+		strconv.FormatInt(now.UnixMilli(), 10), PromoteBatch).Err()
+	if err != nil {
+		return 0, err
+	}
+
+	jobIDs, err := q.client.LRange(ctx, q.promotingJobsKey(), 0, -1).Result()
+	if err != nil {
+		return 0, err
+	}
+	promoted := 0
+	for _, jobID := range jobIDs {
+		ok, err := q.promote(ctx, jobID, now)
+		if err != nil {
+			return promoted, err
+		}
+		if ok {
+			promoted++
+		}
+	}
+	return promoted, nil
+}
+
+// promote resets one due job to pending and pushes it onto its pending list,
+// reporting whether it was pushed. Jobs that expired or were stopped while
+// waiting are only dropped from the staging list.
+func (q *RedisQueue) promote(ctx context.Context, jobID string, now time.Time) (bool, error) {
+	job, err := NilIfNotFound(q.GetJob(ctx, jobID))
+	if err != nil {
+		return false, err
+	}
+	push := false
+	switch {
+	case job == nil:
+	case job.Status == StatusScheduled || job.Status == StatusRetrying:
+		from := job.Status
+		job.Status = StatusPending
+		job.RetryAt = nil
+		job.EnqueuedAtMs = now.UnixMilli()
+		if err := q.transition(ctx, job, from); errors.Is(err, ErrInvalidTransition) {
+			// Cancelled or promoted meanwhile; only dropped from the staging list
+			break
+		} else if err != nil {
+			return false, err
+		}
+		push = true
+	case job.Status == StatusPending && q.opts.PendingStreams:
+		// A stream can't be searched for the job, so it's added again; a
+		// duplicate entry is skipped by the worker that reads it
+		push = true
+	case job.Status == StatusPending:
+		// Marked pending by a promotion that crashed before pushing it, or
+		// requeued meanwhile; pushed unless it's already waiting
+		_, err := q.client.LPos(ctx, q.pendingList(job), job.ID, redis.LPosArgs{}).Result()
+		if err != nil && err != redis.Nil {
+			return false, err
+		}
+		push = err == redis.Nil
+	}
+
+	pipe := q.client.TxPipeline()
+	if push {
+		q.enqueue(ctx, pipe, job)
+	}
+	pipe.LRem(ctx, q.promotingJobsKey(), 1, jobID)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return false, err
+	}
+	return push, nil
+}
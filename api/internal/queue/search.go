@@ -0,0 +1,124 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"strconv"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Search index kinds
+const (
+	SearchByHash     = "hash"
+	SearchByFilename = "filename"
+)
+
+const (
+	// searchIndexTTL is a safety net outliving the default maximum
+	// retention; the sweeper removes jobs from the index as they expire
+	searchIndexTTL = 30*24*time.Hour + RetentionGrace
+	// maxSearchValues is how many distinct hashes or filenames are indexed per
+	// owner; the least recently used are evicted beyond it
+	maxSearchValues = 500
+	// maxJobsPerSearchValue is how many jobs are kept per hash or filename
+	maxJobsPerSearchValue = 20
+)
+
+// searchIndexKey returns the per-owner Redis hash mapping an indexed value
+// to its job IDs, newest first
+func (k redisKeys) searchIndexKey(owner, kind string) string {
+	return k.prefix + "search:" + kind + ":" + owner
+}
+
+// searchRecentKey returns the per-owner sorted set of indexed values scored
+// by last use, which bounds the index
+func (k redisKeys) searchRecentKey(owner, kind string) string {
+	return k.prefix + "search_recent:" + kind + ":" + owner
+}
+
+// indexSearchScript prepends job ARGV[2] to value ARGV[1]'s job list, capped
+// at ARGV[5] jobs, and evicts the least recently used values beyond ARGV[4]
+var indexSearchScript = redis.NewScript(`
+local ids = {ARGV[2]}
+local existing = redis.call("HGET", KEYS[1], ARGV[1])
+if existing then
+	for _, id in ipairs(cjson.decode(existing)) do
+		if #ids >= tonumber(ARGV[5]) then
+			break
+		end
+		if id ~= ARGV[2] then
+			table.insert(ids, id)
+		end
+	end
+end
+redis.call("HSET", KEYS[1], ARGV[1], cjson.encode(ids))
+redis.call("ZADD", KEYS[2], ARGV[3], ARGV[1])
+
+local excess = redis.call("ZCARD", KEYS[2]) - tonumber(ARGV[4])
+if excess > 0 then
+	local evicted = redis.call("ZRANGE", KEYS[2], 0, excess - 1)
+	redis.call("ZREMRANGEBYRANK", KEYS[2], 0, excess - 1)
+	redis.call("HDEL", KEYS[1], unpack(evicted))
+end
+redis.call("EXPIRE", KEYS[1], ARGV[6])
+redis.call("EXPIRE", KEYS[2], ARGV[6])
+return #ids
+`)
+
+// unindexSearchScript removes job ARGV[2] from value ARGV[1]'s job list,
+// dropping the value once no job is left under it
+var unindexSearchScript = redis.NewScript(`
+local existing = redis.call("HGET", KEYS[1], ARGV[1])
+if not existing then
+	return 0
+end
+local ids = {}
+for _, id in ipairs(cjson.decode(existing)) do
+	if id ~= ARGV[2] then
+		table.insert(ids, id)
+	end
+end
+if #ids == 0 then
+	redis.call("HDEL", KEYS[1], ARGV[1])
+	redis.call("ZREM", KEYS[2], ARGV[1])
+else
+	redis.call("HSET", KEYS[1], ARGV[1], cjson.encode(ids))
+end
+return 1
+`)
+
+// IndexJob records a job under an owner's hash or filename index. The value
+// is stored as given; callers normalize or hash it first.
+func (q *RedisQueue) IndexJob(ctx context.Context, owner, kind, value, jobID string) error {
+	return indexSearchScript.Run(ctx, q.client,
+		[]string{q.searchIndexKey(owner, kind), q.searchRecentKey(owner, kind)},
+		value, jobID, q.opts.Clock.Now().UnixMilli(), maxSearchValues, maxJobsPerSearchValue,
+		strconv.Itoa(int(searchIndexTTL/time.Second))).Err()
+}
+
+// UnindexJob removes a job from an owner's hash or filename index
+func (q *RedisQueue) UnindexJob(ctx context.Context, owner, kind, value, jobID string) error {
+	return unindexSearchScript.Run(ctx, q.client,
+		[]string{q.searchIndexKey(owner, kind), q.searchRecentKey(owner, kind)},
+		value, jobID).Err()
+}
+
+// SearchJobs returns the IDs of an owner's jobs indexed under an exact
+// value, newest first. Jobs may have expired since they were indexed.
+func (q *RedisQueue) SearchJobs(ctx context.Context, owner, kind, value string) ([]string, error) {
+	data, err := q.client.HGet(ctx, q.searchIndexKey(owner, kind), value).Result()
+	if err != nil {
+		if err == redis.Nil {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	var ids []string
+	if err := json.Unmarshal([]byte(data), &ids); err != nil {
+		return nil, err
+	}
+	return ids, nil
+}
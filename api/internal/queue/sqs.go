@@ -0,0 +1,398 @@
+package queue
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+)
+
+const (
+	// sqsMaxDelay is the longest SQS delays a message's first delivery
+	sqsMaxDelay = 15 * time.Minute
+	// sqsMaxVisibility is the longest SQS hides a received message
+	sqsMaxVisibility = 12 * time.Hour
+	// sqsPendingListLimit bounds how many jobs GetPendingJobs reads
+	sqsPendingListLimit = 1000
+	// DefaultSQSVisibilityTimeout is how long a claimed job stays hidden
+	// from other workers unless SQSConfig says otherwise
+	DefaultSQSVisibilityTimeout = 5 * time.Minute
+)
+
+// errNoClaim means the worker holds no claim on the job
+var errNoClaim = errors.New("job not claimed by this queue")
+
+// SQSAPI is the part of the SQS client an SQSQueue uses, implemented by
+// *sqs.Client
+type SQSAPI interface {
+	SendMessage(ctx context.Context, in *sqs.SendMessageInput, optFns ...func(*sqs.Options)) (*sqs.SendMessageOutput, error)
+	ReceiveMessage(ctx context.Context, in *sqs.ReceiveMessageInput, optFns ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error)
+	DeleteMessage(ctx context.Context, in *sqs.DeleteMessageInput, optFns ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error)
+	ChangeMessageVisibility(ctx context.Context, in *sqs.ChangeMessageVisibilityInput, optFns ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error)
+	GetQueueAttributes(ctx context.Context, in *sqs.GetQueueAttributesInput, optFns ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error)
+}
+
+// SQSConfig configures an SQSQueue
+type SQSConfig struct {
+	// QueueURL is the SQS queue pending jobs are sent to
+	QueueURL string
+	// VisibilityTimeout is how long a claimed job is hidden from other
+	// workers; one not acknowledged in time is delivered again, and after
+	// the queue's maxReceiveCount moved to its dead-letter queue
+	VisibilityTimeout time.Duration
+	// Store keeps the job records, which SQS can't look up
+	Store MetadataStore
+}
+
+// SQSQueue implements JobQueue with the pending jobs in an Amazon SQS queue
+// and the job records in a MetadataStore. SQS has one order for every
+// message, so priorities aren't honored, and delivers a message at least
+// once, so a job may be claimed again if its worker outlives the
+// visibility timeout. The records in the store are authoritative: a
+// message whose job was cancelled, finished, or expired is dropped.
+type SQSQueue struct {
+	client SQSAPI
+	cfg    SQSConfig
+	opts   Options
+
+	mu sync.Mutex
+	// receipts holds the receipt handles of the messages of claimed jobs,
+	// by worker and job ID
+	receipts map[string]map[string]string
+}
+
+// NewSQSQueue creates a job queue on the SQS queue and store in cfg
+func NewSQSQueue(client SQSAPI, cfg SQSConfig, opts Options) *SQSQueue {
+	opts.setDefaults()
+	if cfg.VisibilityTimeout <= 0 {
+		cfg.VisibilityTimeout = DefaultSQSVisibilityTimeout
+	}
+	return &SQSQueue{
+		client:   client,
+		cfg:      cfg,
+		opts:     opts,
+		receipts: make(map[string]map[string]string),
+	}
+}
+
+// HonorsPriorities reports that claims ignore job priorities, as SQS has
+// one order for every message
+func (q *SQSQueue) HonorsPriorities() bool {
+	return false
+}
+
+// send queues a message for the job, delivered once it's due
+func (q *SQSQueue) send(ctx context.Context, job *Job) error {
+	body, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	delay := job.ScheduledUntil().Sub(q.opts.Clock.Now())
+	if delay > sqsMaxDelay {
+		delay = sqsMaxDelay
+	}
+	if delay < 0 {
+		delay = 0
+	}
+	_, err = q.client.SendMessage(ctx, &sqs.SendMessageInput{
+		QueueUrl:     aws.String(q.cfg.QueueURL),
+		MessageBody:  aws.String(string(body)),
+		DelaySeconds: int32(delay / time.Second),
+	})
+	return err
+}
+
+// AddJob stores a new job and sends it to the queue as JSON, delivered once
+// it's due if it's scheduled
+func (q *SQSQueue) AddJob(ctx context.Context, job *Job) error {
+	now := q.opts.Clock.Now()
+	if job.CreatedAt.IsZero() {
+		job.CreatedAt = now
+	}
+	job.UpdatedAt = now
+	job.Version = 1
+	if job.Status == "" {
+		job.Status = StatusPending
+	}
+	if job.Status == StatusPending {
+		job.EnqueuedAtMs = now.UnixMilli()
+	}
+	if err := q.cfg.Store.PutJob(ctx, job, q.opts.recordTTL(job)); err != nil {
+		return err
+	}
+	if job.Status == StatusPending || job.Status == StatusScheduled {
+		return q.send(ctx, job)
+	}
+	return nil
+}
+
+// AddJobs adds jobs one at a time
+func (q *SQSQueue) AddJobs(ctx context.Context, jobs []*Job) error {
+	return AddJobsOneByOne(ctx, q, jobs)
+}
+
+// GetJob retrieves a job by ID from the store, reporting a missing one as
+// JobQueue says
+func (q *SQSQueue) GetJob(ctx context.Context, jobID string) (*Job, error) {
+	job, err := q.cfg.Store.GetJob(ctx, jobID)
+	if job == nil && err == nil {
+		return nil, missingJob(jobID)
+	}
+	return job, err
+}
+
+// UpdateJob updates an existing job in the store, checking its version and
+// claim token and incrementing the version as RedisQueue does, and failing
+// with ErrJobNotFound as it does if the record is gone. The store
+// writes unconditionally, so the check can't catch a write racing this
+// one, only a copy that was already stale.
+func (q *SQSQueue) UpdateJob(ctx context.Context, job *Job) error {
+	stored, err := q.cfg.Store.GetJob(ctx, job.ID)
+	if err != nil {
+		return err
+	}
+	if stored == nil {
+		if err := checkMissing(job); err != nil {
+			return err
+		}
+	} else if err := checkUpdate(job, stored); err != nil {
+		return err
+	}
+	job.Version++
+	job.UpdatedAt = q.opts.Clock.Now()
+	return q.cfg.Store.PutJob(ctx, job, q.opts.recordTTL(job))
+}
+
+// GetPendingJobs returns up to limit pending jobs from the store, and never
+// more than sqsPendingListLimit, the highest priority first. They're found
+// by their records, so none are dangling.
+func (q *SQSQueue) GetPendingJobs(ctx context.Context, limit int) ([]*Job, int, error) {
+	if limit <= 0 || limit > sqsPendingListLimit {
+		limit = sqsPendingListLimit
+	}
+	jobs, _, err := q.cfg.Store.ListJobs(ctx, StatusPending, 0, limit)
+	if err != nil {
+		return nil, 0, err
+	}
+	sort.SliceStable(jobs, func(i, j int) bool {
+		return PriorityRank(jobs[i].Priority) < PriorityRank(jobs[j].Priority)
+	})
+	return jobs, 0, nil
+}
+
+// ClaimJob receives the next message for the worker, hiding it from other
+// workers for the visibility timeout, and returns its job, or nil if none
+// arrived within ClaimWait. Unlike the other backends it waits: a receive
+// that doesn't can miss messages, as SQS samples only some of its servers. The worker must acknowledge the job with
+// AckJob for its message to be deleted.
+func (q *SQSQueue) ClaimJob(ctx context.Context, workerID string) (*Job, error) {
+	out, err := q.client.ReceiveMessage(ctx, &sqs.ReceiveMessageInput{
+		QueueUrl:            aws.String(q.cfg.QueueURL),
+		MaxNumberOfMessages: 1,
+		VisibilityTimeout:   int32(q.cfg.VisibilityTimeout / time.Second),
+		WaitTimeSeconds:     int32(ClaimWait / time.Second),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(out.Messages) == 0 {
+		return nil, nil
+	}
+	receipt := aws.ToString(out.Messages[0].ReceiptHandle)
+
+	// The message holds the job as it was queued; the stored record is current
+	var queued Job
+	if err := json.Unmarshal([]byte(aws.ToString(out.Messages[0].Body)), &queued); err != nil || queued.ID == "" {
+		// Nothing can process it; the queue's redrive policy dead-letters it
+		return nil, err
+	}
+	job, err := q.cfg.Store.GetJob(ctx, queued.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case job == nil || job.Status == StatusCompleted || job.Status == StatusFailed || job.Status == StatusCancelled:
+		// There is nothing left to process
+		return nil, q.deleteMessage(ctx, receipt)
+	case job.ScheduledUntil().After(q.opts.Clock.Now()):
+		// Scheduled past the longest delay SQS allows; hide it until due
+		return nil, q.hide(ctx, receipt, job.ScheduledUntil().Sub(q.opts.Clock.Now()))
+	case job.Status == StatusScheduled || job.Status == StatusRetrying:
+		job.Status = StatusPending
+		job.EnqueuedAtMs = q.opts.Clock.Now().UnixMilli()
+		if err := q.UpdateJob(ctx, job); err != nil {
+			return nil, err
+		}
+	}
+
+	q.mu.Lock()
+	if q.receipts[workerID] == nil {
+		q.receipts[workerID] = make(map[string]string)
+	}
+	q.receipts[workerID][job.ID] = receipt
+	q.mu.Unlock()
+	return job, nil
+}
+
+// takeReceipt removes and returns the receipt handle of the worker's claim
+// on a job
+func (q *SQSQueue) takeReceipt(workerID, jobID string) (string, bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	receipt, ok := q.receipts[workerID][jobID]
+	delete(q.receipts[workerID], jobID)
+	if len(q.receipts[workerID]) == 0 {
+		delete(q.receipts, workerID)
+	}
+	return receipt, ok
+}
+
+// deleteMessage deletes a received message from the queue
+func (q *SQSQueue) deleteMessage(ctx context.Context, receipt string) error {
+	_, err := q.client.DeleteMessage(ctx, &sqs.DeleteMessageInput{
+		QueueUrl:      aws.String(q.cfg.QueueURL),
+		ReceiptHandle: aws.String(receipt),
+	})
+	return err
+}
+
+// hide makes a received message visible again after d, up to the longest
+// SQS allows
+func (q *SQSQueue) hide(ctx context.Context, receipt string, d time.Duration) error {
+	if d > sqsMaxVisibility {
+		d = sqsMaxVisibility
+	}
+	_, err := q.client.ChangeMessageVisibility(ctx, &sqs.ChangeMessageVisibilityInput{
+		QueueUrl:          aws.String(q.cfg.QueueURL),
+		ReceiptHandle:     aws.String(receipt),
+		VisibilityTimeout: int32(d / time.Second),
+	})
+	return err
+}
+
+// AckJob deletes the message of a job the worker has finished
+func (q *SQSQueue) AckJob(ctx context.Context, workerID, jobID string) error {
+	receipt, ok := q.takeReceipt(workerID, jobID)
+	if !ok {
+		return errNoClaim
+	}
+	return q.deleteMessage(ctx, receipt)
+}
+
+// NackJob returns a claimed job to the queue for another worker, reset to
+// pending, by making its message visible again. A job that finished or
+// expired meanwhile is only acknowledged.
+func (q *SQSQueue) NackJob(ctx context.Context, workerID, jobID string) error {
+	receipt, ok := q.takeReceipt(workerID, jobID)
+	if !ok {
+		return errNoClaim
+	}
+	job, err := q.cfg.Store.GetJob(ctx, jobID)
+	if err != nil {
+		return err
+	}
+	if job == nil || job.Status == StatusCompleted || job.Status == StatusFailed || job.Status == StatusCancelled {
+		return q.deleteMessage(ctx, receipt)
+	}
+	job.Status = StatusPending
+	job.EnqueuedAtMs = q.opts.Clock.Now().UnixMilli()
+	if err := q.UpdateJob(ctx, job); err != nil {
+		return err
+	}
+	return q.hide(ctx, receipt, 0)
+}
+
+// Stats counts jobs by status in the store. Finished jobs are counted by
+// when their record was last updated, and like any listing the counts are
+// eventually consistent.
+func (q *SQSQueue) Stats(ctx context.Context) (QueueStats, error) {
+	now := q.opts.Clock.Now()
+	oldest, pending, err := q.cfg.Store.ListJobs(ctx, StatusPending, 0, 1)
+	if err != nil {
+		return QueueStats{}, err
+	}
+	stats := QueueStats{Pending: int64(pending)}
+	if len(oldest) > 0 {
+		stats.OldestPendingAgeMs = pendingAge(now, oldest[0].UpdatedAt.UnixMilli())
+	}
+
+	counts := []struct {
+		status JobStatus
+		since  time.Time
+		n      *int64
+	}{
+		{StatusProcessing, time.Time{}, &stats.Processing},
+		{StatusCompleted, now.Add(-statsWindow), &stats.CompletedLastHour},
+		{StatusFailed, now.Add(-statsWindow), &stats.FailedLastHour},
+	}
+	for _, c := range counts {
+		n, err := q.cfg.Store.CountJobs(ctx, c.status, c.since)
+		if err != nil {
+			return QueueStats{}, err
+		}
+		*c.n = int64(n)
+	}
+	return stats, nil
+}
+
+// ListJobs returns a page of the jobs with a status from the store
+func (q *SQSQueue) ListJobs(ctx context.Context, status JobStatus, offset, limit int) ([]*Job, int, error) {
+	return q.cfg.Store.ListJobs(ctx, status, offset, limit)
+}
+
+// CancelJob cancels a job as RedisQueue.CancelJob does: one waiting to run
+// is marked cancelled at once, and its message dropped when it's received,
+// and one being processed is flagged for its worker to stop. The flag is
+// set either way. It fails with ErrJobNotFound or ErrJobFinished.
+func (q *SQSQueue) CancelJob(ctx context.Context, jobID string) error {
+	job, err := q.cfg.Store.GetJob(ctx, jobID)
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		return ErrJobNotFound
+	}
+	switch job.Status {
+	case StatusCompleted, StatusFailed, StatusCancelled:
+		return ErrJobFinished
+	case StatusProcessing:
+		return q.cfg.Store.RequestCancel(ctx, jobID, q.opts.recordTTL(job))
+	}
+
+	job.Status = StatusCancelled
+	for i := range job.Deliveries {
+		if job.Deliveries[i].Status == DeliveryPending {
+			job.Deliveries[i].Status = DeliveryFailed
+			job.Deliveries[i].LastError = cancelledDeliveryError
+		}
+	}
+	if err := q.UpdateJob(ctx, job); err != nil {
+		return err
+	}
+	return q.cfg.Store.RequestCancel(ctx, jobID, q.opts.recordTTL(job))
+}
+
+// DeleteJob removes a job's record from the store. Its message is dropped
+// when it's next received. It fails with ErrJobNotFound.
+func (q *SQSQueue) DeleteJob(ctx context.Context, jobID string) error {
+	job, err := q.cfg.Store.GetJob(ctx, jobID)
+	if err != nil {
+		return err
+	}
+	if job == nil {
+		return ErrJobNotFound
+	}
+	return q.cfg.Store.DeleteJob(ctx, jobID)
+}
+
+// CancelRequested reports whether the job was asked to stop
+func (q *SQSQueue) CancelRequested(ctx context.Context, jobID string) (bool, error) {
+	return q.cfg.Store.CancelRequested(ctx, jobID)
+}
@@ -0,0 +1,248 @@
+package queue_test
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go-v2/aws"
+	"github.com/aws/aws-sdk-go-v2/service/sqs"
+	"github.com/aws/aws-sdk-go-v2/service/sqs/types"
+
+	"rembg-v2/api/internal/queue"
+	"rembg-v2/api/internal/queue/queuetest"
+)
+
+// fakeSQS is an in-process SQS queue that delivers messages oldest first,
+// honoring delays and visibility timeouts, without waiting for any
+type fakeSQS struct {
+	mu       sync.Mutex
+	messages []*fakeMessage
+	receipts int
+}
+
+type fakeMessage struct {
+	body      string
+	receipt   string
+	visibleAt time.Time
+}
+
+func (f *fakeSQS) SendMessage(ctx context.Context, in *sqs.SendMessageInput, _ ...func(*sqs.Options)) (*sqs.SendMessageOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.messages = append(f.messages, &fakeMessage{
+		body:      aws.ToString(in.MessageBody),
+		visibleAt: time.Now().Add(time.Duration(in.DelaySeconds) * time.Second),
+	})
+	return &sqs.SendMessageOutput{}, nil
+}
+
+func (f *fakeSQS) ReceiveMessage(ctx context.Context, in *sqs.ReceiveMessageInput, _ ...func(*sqs.Options)) (*sqs.ReceiveMessageOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	now := time.Now()
+	for _, m := range f.messages {
+		if m.visibleAt.After(now) {
+			continue
+		}
+		f.receipts++
+		m.receipt = fmt.Sprintf("receipt-%d", f.receipts)
+		m.visibleAt = now.Add(time.Duration(in.VisibilityTimeout) * time.Second)
+		return &sqs.ReceiveMessageOutput{Messages: []types.Message{{
+			Body:          aws.String(m.body),
+			ReceiptHandle: aws.String(m.receipt),
+		}}}, nil
+	}
+	return &sqs.ReceiveMessageOutput{}, nil
+}
+
+func (f *fakeSQS) DeleteMessage(ctx context.Context, in *sqs.DeleteMessageInput, _ ...func(*sqs.Options)) (*sqs.DeleteMessageOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for i, m := range f.messages {
+		if m.receipt == aws.ToString(in.ReceiptHandle) {
+			f.messages = append(f.messages[:i], f.messages[i+1:]...)
+			break
+		}
+	}
+	return &sqs.DeleteMessageOutput{}, nil
+}
+
+func (f *fakeSQS) ChangeMessageVisibility(ctx context.Context, in *sqs.ChangeMessageVisibilityInput, _ ...func(*sqs.Options)) (*sqs.ChangeMessageVisibilityOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, m := range f.messages {
+		if m.receipt == aws.ToString(in.ReceiptHandle) {
+			m.visibleAt = time.Now().Add(time.Duration(in.VisibilityTimeout) * time.Second)
+		}
+	}
+	return &sqs.ChangeMessageVisibilityOutput{}, nil
+}
+
+func (f *fakeSQS) GetQueueAttributes(ctx context.Context, in *sqs.GetQueueAttributesInput, _ ...func(*sqs.Options)) (*sqs.GetQueueAttributesOutput, error) {
+	return &sqs.GetQueueAttributesOutput{}, nil
+}
+
+// fakeStore is an in-process MetadataStore
+type fakeStore struct {
+	mu      sync.Mutex
+	records map[string]fakeRecord
+	cancels map[string]bool
+}
+
+type fakeRecord struct {
+	data      []byte
+	expiresAt time.Time
+}
+
+func newFakeStore() *fakeStore {
+	return &fakeStore{records: make(map[string]fakeRecord), cancels: make(map[string]bool)}
+}
+
+func (s *fakeStore) GetJob(ctx context.Context, jobID string) (*queue.Job, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.get(jobID)
+}
+
+// get decodes a live record. s.mu must be held.
+func (s *fakeStore) get(jobID string) (*queue.Job, error) {
+	record, ok := s.records[jobID]
+	if !ok || !time.Now().Before(record.expiresAt) {
+		return nil, nil
+	}
+	var job queue.Job
+	if err := json.Unmarshal(record.data, &job); err != nil {
+		return nil, err
+	}
+	return &job, nil
+}
+
+func (s *fakeStore) PutJob(ctx context.Context, job *queue.Job, ttl time.Duration) error {
+	data, err := json.Marshal(job)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.records[job.ID] = fakeRecord{data: data, expiresAt: time.Now().Add(ttl)}
+	return nil
+}
+
+// withStatus returns the live jobs with a status, the longest unchanged
+// first. s.mu must be held.
+func (s *fakeStore) withStatus(status queue.JobStatus) ([]*queue.Job, error) {
+	var jobs []*queue.Job
+	for id := range s.records {
+		job, err := s.get(id)
+		if err != nil {
+			return nil, err
+		}
+		if job != nil && job.Status == status {
+			jobs = append(jobs, job)
+		}
+	}
+	sort.Slice(jobs, func(i, j int) bool { return jobs[i].UpdatedAt.Before(jobs[j].UpdatedAt) })
+	return jobs, nil
+}
+
+func (s *fakeStore) ListJobs(ctx context.Context, status queue.JobStatus, offset, limit int) ([]*queue.Job, int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs, err := s.withStatus(status)
+	if err != nil {
+		return nil, 0, err
+	}
+	total := len(jobs)
+	if offset > total {
+		offset = total
+	}
+	jobs = jobs[offset:]
+	if limit > 0 && limit < len(jobs) {
+		jobs = jobs[:limit]
+	}
+	return jobs, total, nil
+}
+
+func (s *fakeStore) CountJobs(ctx context.Context, status queue.JobStatus, since time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	jobs, err := s.withStatus(status)
+	if err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, job := range jobs {
+		if job.UpdatedAt.After(since) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func (s *fakeStore) RequestCancel(ctx context.Context, jobID string, ttl time.Duration) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cancels[jobID] = true
+	return nil
+}
+
+func (s *fakeStore) CancelRequested(ctx context.Context, jobID string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.cancels[jobID], nil
+}
+
+func (s *fakeStore) DeleteJob(ctx context.Context, jobID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.records, jobID)
+	delete(s.cancels, jobID)
+	return nil
+}
+
+// newFakeSQSQueue creates an SQSQueue on a fake SQS queue and store
+func newFakeSQSQueue() *queue.SQSQueue {
+	return queue.NewSQSQueue(&fakeSQS{}, queue.SQSConfig{
+		QueueURL: "https://sqs.test/jobs",
+		Store:    newFakeStore(),
+	}, queue.Options{})
+}
+
+func TestSQSQueueConformance(t *testing.T) {
+	queuetest.RunConformanceTests(t, func() queue.JobQueue {
+		return newFakeSQSQueue()
+	})
+}
+
+func TestSQSQueueNackRedelivers(t *testing.T) {
+	q := newFakeSQSQueue()
+	ctx := context.Background()
+	if err := q.AddJob(ctx, &queue.Job{ID: "job-1"}); err != nil {
+		t.Fatalf("AddJob: %v", err)
+	}
+	job, err := q.ClaimJob(ctx, "worker-1")
+	if err != nil || job == nil {
+		t.Fatalf("ClaimJob: %v, %v", job, err)
+	}
+	if other, err := q.ClaimJob(ctx, "worker-2"); err != nil || other != nil {
+		t.Fatalf("claimed job delivered while hidden: %v, %v", other, err)
+	}
+	if err := q.NackJob(ctx, "worker-1", job.ID); err != nil {
+		t.Fatalf("NackJob: %v", err)
+	}
+	job, err = q.ClaimJob(ctx, "worker-2")
+	if err != nil || job == nil || job.ID != "job-1" {
+		t.Fatalf("claim after NackJob: %v, %v", job, err)
+	}
+	if err := q.AckJob(ctx, "worker-1", job.ID); err == nil {
+		t.Fatalf("AckJob by a worker without the claim succeeded")
+	}
+	if err := q.AckJob(ctx, "worker-2", job.ID); err != nil {
+		t.Fatalf("AckJob: %v", err)
+	}
+}
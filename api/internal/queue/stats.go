@@ -0,0 +1,62 @@
+package queue
+
+import (
+	"context"
+	"time"
+)
+
+// statsWindow is how far back QueueStats counts finished jobs
+const statsWindow = time.Hour
+
+// QueueStats is a snapshot of how well the queue keeps up
+type QueueStats struct {
+	// Pending and Processing count the jobs waiting to run and running
+	Pending    int64 `json:"pending"`
+	Processing int64 `json:"processing"`
+	// CompletedLastHour and FailedLastHour count the jobs that finished
+	// over the last hour
+	CompletedLastHour int64 `json:"completed_last_hour"`
+	FailedLastHour    int64 `json:"failed_last_hour"`
+	// OldestPendingAgeMs is how long the pending job unchanged the longest
+	// has waited since it was queued, or 0 with none pending
+	OldestPendingAgeMs int64 `json:"oldest_pending_age_ms"`
+}
+
+// pendingAge returns the age at now of a pending job last updated at
+// updatedAtMs, never negative
+func pendingAge(now time.Time, updatedAtMs int64) int64 {
+	if age := now.UnixMilli() - updatedAtMs; age > 0 {
+		return age
+	}
+	return 0
+}
+
+// Stats reads the queue's depth from the status index and its throughput
+// from the outcome counters. Index entries of expired jobs are counted
+// until the index is next pruned.
+func (q *RedisQueue) Stats(ctx context.Context) (QueueStats, error) {
+	now := q.opts.Clock.Now()
+
+	pipe := q.client.Pipeline()
+	pending := pipe.ZCard(ctx, q.statusIndexKey(StatusPending))
+	processing := pipe.ZCard(ctx, q.statusIndexKey(StatusProcessing))
+	oldest := pipe.ZRangeWithScores(ctx, q.statusIndexKey(StatusPending), 0, 0)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return QueueStats{}, err
+	}
+	counts, err := q.OutcomeCounts(ctx, now.Add(-statsWindow), now)
+	if err != nil {
+		return QueueStats{}, err
+	}
+
+	stats := QueueStats{
+		Pending:           pending.Val(),
+		Processing:        processing.Val(),
+		CompletedLastHour: counts["total"] - counts["failed"],
+		FailedLastHour:    counts["failed"],
+	}
+	if z := oldest.Val(); len(z) > 0 {
+		stats.OldestPendingAgeMs = pendingAge(now, int64(z[0].Score))
+	}
+	return stats, nil
+}
@@ -0,0 +1,274 @@
+package queue
+
+import (
+	"context"
+	"strconv"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// JobStatuses lists every job status, each with its own index
+var JobStatuses = []JobStatus{
+	StatusScheduled, StatusPending, StatusRetrying, StatusProcessing,
+	StatusCompleted, StatusFailed, StatusCancelled,
+}
+
+const (
+	// maxListReads bounds the index reads one listing makes to fill a page
+	// around entries of expired jobs
+	maxListReads = 10
+	// statusIndexPruneBatch is how many entries of each index one prune
+	// pass checks
+	statusIndexPruneBatch = 500
+)
+
+// statusIndexKey returns the sorted set of the IDs of jobs with status,
+// scored by when they were last updated in Unix milliseconds
+func (k redisKeys) statusIndexKey(status JobStatus) string {
+	return k.prefix + "jobs_by_status:" + string(status)
+}
+
+// statusIndexPruneKey returns the hash of where the next prune pass of each
+// index starts
+func (k redisKeys) statusIndexPruneKey() string {
+	return k.prefix + "jobs_by_status_prune"
+}
+
+// ValidStatus reports whether status is a job status
+func ValidStatus(status JobStatus) bool {
+	for _, s := range JobStatuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// indexStatus moves the job to its status's index, scored by its last
+// update, as part of the write of its record
+func (q *RedisQueue) indexStatus(ctx context.Context, pipe redis.Pipeliner, job *Job) {
+	for _, status := range JobStatuses {
+		if status != job.Status {
+			pipe.ZRem(ctx, q.statusIndexKey(status), job.ID)
+		}
+	}
+	pipe.ZAdd(ctx, q.statusIndexKey(job.Status), redis.Z{Score: float64(job.UpdatedAt.UnixMilli()), Member: job.ID})
+}
+
+// unindexStatus removes a job from every status index
+func (q *RedisQueue) unindexStatus(ctx context.Context, pipe redis.Pipeliner, jobID string) {
+	for _, status := range JobStatuses {
+		pipe.ZRem(ctx, q.statusIndexKey(status), jobID)
+	}
+}
+
+// JobCursor is where a listing of a status resumes: after the job JobID,
+// last updated at UpdatedAtMs. The zero cursor starts at the beginning.
+type JobCursor struct {
+	UpdatedAtMs int64
+	JobID       string
+}
+
+// ListJobs returns up to limit jobs with status from position offset, the
+// longest unchanged first, and how many jobs have the status. Entries of
+// jobs that expired are removed as they're found, and the page is filled
+// from further on. Positions shift as jobs leave the status, so a listing
+// paged by offset can miss jobs; ListJobsAfter pages stably.
+func (q *RedisQueue) ListJobs(ctx context.Context, status JobStatus, offset, limit int) ([]*Job, int, error) {
+	key := q.statusIndexKey(status)
+	jobs := []*Job{}
+	start := int64(offset)
+	for reads := 0; len(jobs) < limit && reads < maxListReads; reads++ {
+		need := int64(limit - len(jobs))
+		ids, err := q.client.ZRange(ctx, key, start, start+need-1).Result()
+		if err != nil {
+			return nil, 0, err
+		}
+		found, removed, err := q.indexedJobs(ctx, status, ids)
+		if err != nil {
+			return nil, 0, err
+		}
+		jobs = append(jobs, found...)
+		if int64(len(ids)) < need {
+			break
+		}
+		// Removed entries no longer take up positions
+		start += int64(len(ids) - removed)
+	}
+
+	total, err := q.client.ZCard(ctx, key).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	return jobs, int(total), nil
+}
+
+// ListJobsAfter returns up to limit jobs with status after the cursor, the
+// longest unchanged first, and how many jobs have the status. A job that
+// changes status moves to the end of its new status's index, so a listing
+// paged by the cursor never misses a job that stays in the status, and
+// lists a job twice only if it left the status and came back. It returns
+// the cursor after the last entry read, which is the original cursor if
+// nothing was left to read.
+func (q *RedisQueue) ListJobsAfter(ctx context.Context, status JobStatus, after JobCursor, limit int) ([]*Job, int, JobCursor, error) {
+	key := q.statusIndexKey(status)
+	jobs := []*Job{}
+	for reads := 0; len(jobs) < limit && reads < maxListReads; reads++ {
+		need := limit - len(jobs)
+		entries, err := q.entriesAfter(ctx, key, after, need)
+		if err != nil {
+			return nil, 0, after, err
+		}
+		if len(entries) == 0 {
+			break
+		}
+		ids := make([]string, len(entries))
+		for i, entry := range entries {
+			ids[i] = entry.Member.(string)
+		}
+		found, _, err := q.indexedJobs(ctx, status, ids)
+		if err != nil {
+			return nil, 0, after, err
+		}
+		jobs = append(jobs, found...)
+		last := entries[len(entries)-1]
+		after = JobCursor{UpdatedAtMs: int64(last.Score), JobID: last.Member.(string)}
+		if len(entries) < need {
+			break
+		}
+	}
+
+	total, err := q.client.ZCard(ctx, key).Result()
+	if err != nil {
+		return nil, 0, after, err
+	}
+	return jobs, int(total), after, nil
+}
+
+// entriesAfter returns up to n index entries after the cursor. Entries
+// with the same score are ordered by ID, as Redis orders them.
+func (q *RedisQueue) entriesAfter(ctx context.Context, key string, after JobCursor, n int) ([]redis.Z, error) {
+	if after.JobID == "" {
+		return q.client.ZRangeWithScores(ctx, key, 0, int64(n-1)).Result()
+	}
+	score := strconv.FormatInt(after.UpdatedAtMs, 10)
+	// Entries sharing the cursor's score may come before it
+	ties, err := q.client.ZCount(ctx, key, score, score).Result()
+	if err != nil {
+		return nil, err
+	}
+	entries, err := q.client.ZRangeByScoreWithScores(ctx, key, &redis.ZRangeBy{
+		Min:   score,
+		Max:   "+inf",
+		Count: int64(n) + ties,
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	kept := entries[:0]
+	for _, entry := range entries {
+		if int64(entry.Score) == after.UpdatedAtMs && entry.Member.(string) <= after.JobID {
+			continue
+		}
+		kept = append(kept, entry)
+	}
+	if len(kept) > n {
+		kept = kept[:n]
+	}
+	return kept, nil
+}
+
+// indexedJobs reads the jobs whose IDs were listed in status's index. It
+// removes the entries of jobs that expired, reporting how many, and skips
+// jobs whose status changed since, which their next write re-indexes.
+func (q *RedisQueue) indexedJobs(ctx context.Context, status JobStatus, ids []string) ([]*Job, int, error) {
+	if len(ids) == 0 {
+		return nil, 0, nil
+	}
+	pipe := q.client.Pipeline()
+	reads := make([]*redis.StringCmd, len(ids))
+	for i, id := range ids {
+		reads[i] = pipe.Get(ctx, q.jobKey(id))
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, 0, err
+	}
+
+	var jobs []*Job
+	var expired []interface{}
+	for i, read := range reads {
+		data, err := read.Bytes()
+		if err == redis.Nil {
+			expired = append(expired, ids[i])
+			continue
+		}
+		if err != nil {
+			return nil, 0, err
+		}
+		var job Job
+		if err := q.opts.Codec.Decode(data, &job); err != nil {
+			return nil, 0, err
+		}
+		if job.Status == status {
+			jobs = append(jobs, &job)
+		}
+	}
+	if len(expired) > 0 {
+		if err := q.client.ZRem(ctx, q.statusIndexKey(status), expired...).Err(); err != nil {
+			return nil, 0, err
+		}
+	}
+	return jobs, len(expired), nil
+}
+
+// PruneStatusIndexes removes the entries of expired jobs from the status
+// indexes, which only listings otherwise remove. Each pass checks the next
+// statusIndexPruneBatch entries of every index, starting over at the end,
+// so every entry is checked in turn however the jobs' lifetimes differ. It
+// returns how many entries were removed.
+func (q *RedisQueue) PruneStatusIndexes(ctx context.Context) (int, error) {
+	pruned := 0
+	for _, status := range JobStatuses {
+		key := q.statusIndexKey(status)
+		start, err := q.client.HGet(ctx, q.statusIndexPruneKey(), string(status)).Int64()
+		if err != nil && err != redis.Nil {
+			return pruned, err
+		}
+		ids, err := q.client.ZRange(ctx, key, start, start+statusIndexPruneBatch-1).Result()
+		if err != nil {
+			return pruned, err
+		}
+
+		pipe := q.client.Pipeline()
+		checks := make([]*redis.IntCmd, len(ids))
+		for i, id := range ids {
+			checks[i] = pipe.Exists(ctx, q.jobKey(id))
+		}
+		if len(ids) > 0 {
+			if _, err := pipe.Exec(ctx); err != nil {
+				return pruned, err
+			}
+		}
+		var expired []interface{}
+		for i, check := range checks {
+			if check.Val() == 0 {
+				expired = append(expired, ids[i])
+			}
+		}
+		if len(expired) > 0 {
+			if err := q.client.ZRem(ctx, key, expired...).Err(); err != nil {
+				return pruned, err
+			}
+			pruned += len(expired)
+		}
+
+		next := start + int64(len(ids)-len(expired))
+		if len(ids) < statusIndexPruneBatch {
+			next = 0
+		}
+		if err := q.client.HSet(ctx, q.statusIndexPruneKey(), string(status), next).Err(); err != nil {
+			return pruned, err
+		}
+	}
+	return pruned, nil
+}
@@ -0,0 +1,375 @@
+package queue
+
+import (
+	"context"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+const (
+	// DefaultStreamGroup is the consumer group workers read the pending
+	// streams with
+	DefaultStreamGroup = "workers"
+	// streamJobField is the entry field holding a pending job's ID
+	streamJobField = "job_id"
+	// streamReclaimer is the consumer the API takes abandoned deliveries
+	// over as before requeueing them
+	streamReclaimer = "api-reclaimer"
+	// reclaimBatch bounds the deliveries one XAUTOCLAIM call takes over
+	reclaimBatch = 100
+	// maxPositionScan bounds the entries QueuePosition counts ahead of a job
+	// in its own stream
+	maxPositionScan = 10000
+)
+
+// pendingStreamKey returns the stream that, with PendingStreams, replaces the
+// pending list for jobs requesting a model at a priority
+func (k redisKeys) pendingStreamKey(model, priority string) string {
+	return k.prefix + "stream:" + pendingName(model, priority)
+}
+
+// jobPendingStreamKey returns the pending stream the job waits in
+func (k redisKeys) jobPendingStreamKey(j *Job) string {
+	return k.pendingStreamKey(j.Model, j.Priority)
+}
+
+// allPendingStreamKeys returns every model's pending streams, highest
+// priority first, in the order of allPendingKeys
+func (k redisKeys) allPendingStreamKeys() []string {
+	models := queuedModels()
+	keys := make([]string, 0, len(Priorities)*len(models))
+	for _, p := range Priorities {
+		for _, model := range models {
+			keys = append(keys, k.pendingStreamKey(model, p))
+		}
+	}
+	return keys
+}
+
+// streamClaimsKey returns the hash of the stream and entry of each job a
+// worker has read from the pending streams but not yet acknowledged
+func (k redisKeys) streamClaimsKey(workerID string) string {
+	return k.prefix + "stream_claims:" + workerID
+}
+
+// streamClaimRef encodes where a claimed job's entry is, as stored in the
+// worker's claims hash
+func streamClaimRef(stream, entry string) string {
+	return stream + " " + entry
+}
+
+// createStreamGroups creates the consumer group on every pending stream,
+// creating the streams too, so workers can read from and XAUTOCLAIM can
+// scan streams no job was added to yet
+func (q *RedisQueue) createStreamGroups(ctx context.Context) error {
+	for _, key := range q.allPendingStreamKeys() {
+		err := q.client.XGroupCreateMkStream(ctx, key, q.opts.StreamGroup, "0").Err()
+		if err != nil && !strings.HasPrefix(err.Error(), "BUSYGROUP") {
+			return err
+		}
+	}
+	return nil
+}
+
+// enqueue queues a pending job: onto its pending list, with SchedulingFair
+// its owner's, or with PendingStreams as a new entry on its pending stream. Entries of jobs
+// removed from the queue stay until a worker reads and skips them, as
+// duplicate list entries are.
+func (q *RedisQueue) enqueue(ctx context.Context, c redis.Cmdable, job *Job) redis.Cmder {
+	if q.opts.PendingStreams {
+		return c.XAdd(ctx, &redis.XAddArgs{Stream: q.jobPendingStreamKey(job), Values: []string{streamJobField, job.ID}})
+	}
+	if q.opts.Scheduling == SchedulingFair {
+		return q.enqueueFair(ctx, c, job)
+	}
+	return c.LPush(ctx, q.jobPendingKey(job), job.ID)
+}
+
+// readPendingStream delivers the next new entry of a pending stream to the
+// worker, waiting up to block for one if it's positive, and records the
+// claim. It returns the entry's job ID, or "" if none arrived.
+func (q *RedisQueue) readPendingStream(ctx context.Context, workerID, key string, block time.Duration) (string, error) {
+	if block <= 0 {
+		// A zero block would wait forever
+		block = -1
+	} else if block < time.Millisecond {
+		// As would a wait that rounds down to it
+		block = time.Millisecond
+	}
+	streams, err := q.client.XReadGroup(ctx, &redis.XReadGroupArgs{
+		Group:    q.opts.StreamGroup,
+		Consumer: workerID,
+		Streams:  []string{key, ">"},
+		Count:    1,
+		Block:    block,
+	}).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	for _, stream := range streams {
+		for _, msg := range stream.Messages {
+			jobID, _ := msg.Values[streamJobField].(string)
+			// Until recorded the delivery is only in the group's pending
+			// entries, from which XAUTOCLAIM recovers it if the worker dies
+			if err := q.client.HSet(ctx, q.streamClaimsKey(workerID), jobID, streamClaimRef(key, msg.ID)).Err(); err != nil {
+				return "", err
+			}
+			return jobID, nil
+		}
+	}
+	return "", nil
+}
+
+// claimRelease returns what releases the worker's claim on a job as part
+// of a transaction: the entry is removed from its processing list, or with
+// PendingStreams acknowledged, deleted from its stream, and forgotten
+func (q *RedisQueue) claimRelease(ctx context.Context, workerID, jobID string) (func(pipe redis.Pipeliner), error) {
+	if !q.opts.PendingStreams {
+		return func(pipe redis.Pipeliner) {
+			pipe.LRem(ctx, q.processingKey(workerID), 1, jobID)
+		}, nil
+	}
+	ref, err := q.client.HGet(ctx, q.streamClaimsKey(workerID), jobID).Result()
+	if err != nil && err != redis.Nil {
+		return nil, err
+	}
+	stream, entry, _ := strings.Cut(ref, " ")
+	return func(pipe redis.Pipeliner) {
+		if entry != "" {
+			q.releaseEntry(ctx, pipe, stream, entry)
+		}
+		pipe.HDel(ctx, q.streamClaimsKey(workerID), jobID)
+	}, nil
+}
+
+// forgetConsumer deletes a PopPendingJob worker's consumer from the group
+// of each default-model pending stream, the only ones it reads, so a
+// consumer isn't left behind for every call. Deleting a consumer drops the
+// deliveries pending to it, so it's only done once they're acknowledged.
+func (q *RedisQueue) forgetConsumer(ctx context.Context, workerID string) error {
+	if !q.opts.PendingStreams {
+		return nil
+	}
+	_, err := q.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for _, priority := range Priorities {
+			pipe.XGroupDelConsumer(ctx, q.pendingStreamKey(ModelDefault, priority), q.opts.StreamGroup, workerID)
+		}
+		return nil
+	})
+	return err
+}
+
+// releaseEntry acknowledges a delivered entry and deletes it, so the
+// stream's length stays its undelivered and unacknowledged entries
+func (q *RedisQueue) releaseEntry(ctx context.Context, pipe redis.Pipeliner, stream, entry string) {
+	pipe.XAck(ctx, stream, q.opts.StreamGroup, entry)
+	pipe.XDel(ctx, stream, entry)
+}
+
+// reclaimStreams takes over, with XAUTOCLAIM, the deliveries of every
+// pending stream left unacknowledged for StreamClaimIdle, which a live
+// worker never lets happen as it refreshes its own with each heartbeat,
+// and requeues their jobs as NackJob does. It returns how many jobs were
+// requeued.
+func (q *RedisQueue) reclaimStreams(ctx context.Context) (int, error) {
+	recovered := 0
+	for _, key := range q.allPendingStreamKeys() {
+		start := "0-0"
+		for {
+			msgs, next, err := q.client.XAutoClaim(ctx, &redis.XAutoClaimArgs{
+				Stream:   key,
+				Group:    q.opts.StreamGroup,
+				MinIdle:  q.opts.StreamClaimIdle,
+				Start:    start,
+				Count:    reclaimBatch,
+				Consumer: streamReclaimer,
+			}).Result()
+			if err != nil {
+				return recovered, err
+			}
+			for _, msg := range msgs {
+				requeued, err := q.reclaim(ctx, key, msg)
+				if err != nil {
+					return recovered, err
+				}
+				if requeued {
+					recovered++
+				}
+			}
+			if next == "0-0" || next == "" {
+				break
+			}
+			start = next
+		}
+	}
+	return recovered, nil
+}
+
+// reclaim requeues the job of an abandoned delivery, releasing the entry
+// and the claim its worker recorded, and reports whether it was requeued
+func (q *RedisQueue) reclaim(ctx context.Context, stream string, msg redis.XMessage) (bool, error) {
+	jobID, _ := msg.Values[streamJobField].(string)
+	job, err := NilIfNotFound(q.GetJob(ctx, jobID))
+	if err != nil {
+		return false, err
+	}
+	return q.requeueClaim(ctx, jobID, func(pipe redis.Pipeliner) {
+		q.releaseEntry(ctx, pipe, stream, msg.ID)
+		if job != nil && job.WorkerID != "" {
+			pipe.HDel(ctx, q.streamClaimsKey(job.WorkerID), jobID)
+		}
+	})
+}
+
+// streamDepths returns how many entries of each pending stream are
+// waiting: its length less those delivered and not yet acknowledged
+func (q *RedisQueue) streamDepths(ctx context.Context, keys []string) ([]int64, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+	pipe := q.client.Pipeline()
+	lengths := make([]*redis.IntCmd, len(keys))
+	delivered := make([]*redis.XPendingCmd, len(keys))
+	for i, key := range keys {
+		lengths[i] = pipe.XLen(ctx, key)
+		delivered[i] = pipe.XPending(ctx, key, q.opts.StreamGroup)
+	}
+	if _, err := pipe.Exec(ctx); err != nil && err != redis.Nil {
+		return nil, err
+	}
+
+	depths := make([]int64, len(keys))
+	for i := range keys {
+		depths[i] = lengths[i].Val()
+		if pending := delivered[i].Val(); pending != nil {
+			depths[i] -= pending.Count
+		}
+		if depths[i] < 0 {
+			depths[i] = 0
+		}
+	}
+	return depths, nil
+}
+
+// streamModelDepths is PendingDepths with PendingStreams
+func (q *RedisQueue) streamModelDepths(ctx context.Context, models []string) (map[string]int64, error) {
+	var keys []string
+	for _, model := range models {
+		for _, p := range Priorities {
+			keys = append(keys, q.pendingStreamKey(model, p))
+		}
+	}
+	lengths, err := q.streamDepths(ctx, keys)
+	if err != nil {
+		return nil, err
+	}
+
+	depths := make(map[string]int64, len(models))
+	for i, model := range models {
+		for _, n := range lengths[i*len(Priorities) : (i+1)*len(Priorities)] {
+			depths[model] += n
+		}
+	}
+	return depths, nil
+}
+
+// lastDelivered returns the ID of the last entry of a stream delivered to
+// the consumer group, after which entries are waiting
+func (q *RedisQueue) lastDelivered(ctx context.Context, key string) (string, error) {
+	groups, err := q.client.XInfoGroups(ctx, key).Result()
+	if err != nil {
+		return "", err
+	}
+	for _, group := range groups {
+		if group.Name == q.opts.StreamGroup {
+			return group.LastDeliveredID, nil
+		}
+	}
+	return "0-0", nil
+}
+
+// waitingStreamIDs returns the job IDs of up to limit waiting entries of a
+// pending stream, or all of them if limit isn't positive, newest first as
+// a pending list is read
+func (q *RedisQueue) waitingStreamIDs(ctx context.Context, key string, limit int) ([]string, error) {
+	last, err := q.lastDelivered(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	var msgs []redis.XMessage
+	if limit > 0 {
+		msgs, err = q.client.XRevRangeN(ctx, key, "+", "("+last, int64(limit)).Result()
+	} else {
+		msgs, err = q.client.XRevRange(ctx, key, "+", "("+last).Result()
+	}
+	if err != nil {
+		return nil, err
+	}
+	return streamJobIDs(msgs), nil
+}
+
+// nextStreamIDs returns the job IDs of the next n entries of a pending
+// stream to be delivered, in delivery order
+func (q *RedisQueue) nextStreamIDs(ctx context.Context, key string, n int64) ([]string, error) {
+	last, err := q.lastDelivered(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	msgs, err := q.client.XRangeN(ctx, key, "("+last, "+", n).Result()
+	if err != nil {
+		return nil, err
+	}
+	return streamJobIDs(msgs), nil
+}
+
+// streamJobIDs returns the job IDs of pending stream entries
+func streamJobIDs(msgs []redis.XMessage) []string {
+	ids := make([]string, 0, len(msgs))
+	for _, msg := range msgs {
+		if jobID, ok := msg.Values[streamJobField].(string); ok {
+			ids = append(ids, jobID)
+		}
+	}
+	return ids
+}
+
+// streamPosition is QueuePosition with PendingStreams: the entries waiting
+// in the model's streams of higher priorities, and those in its own added
+// in a millisecond before the job was enqueued, counted up to maxPositionScan. Entry IDs
+// start with the Redis time they were added at, the clock EnqueuedAtMs is
+// stamped from.
+func (q *RedisQueue) streamPosition(ctx context.Context, job *Job) (int64, error) {
+	key := q.jobPendingStreamKey(job)
+	var ahead []string
+	for _, p := range Priorities {
+		k := q.pendingStreamKey(job.Model, p)
+		if k == key {
+			break
+		}
+		ahead = append(ahead, k)
+	}
+	depths, err := q.streamDepths(ctx, ahead)
+	if err != nil {
+		return 0, err
+	}
+	last, err := q.lastDelivered(ctx, key)
+	if err != nil {
+		return 0, err
+	}
+	before, err := q.client.XRangeN(ctx, key, "("+last, strconv.FormatInt(job.EnqueuedAtMs-1, 10), maxPositionScan).Result()
+	if err != nil {
+		return 0, err
+	}
+
+	position := int64(len(before))
+	for _, n := range depths {
+		position += n
+	}
+	return position, nil
+}
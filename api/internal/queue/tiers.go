@@ -0,0 +1,24 @@
+package queue
+
+// Service tiers a caller's credentials can name
+const (
+	// TierFree is the tier of anonymous callers and tokens without a tier
+	TierFree = "free"
+	// TierPro is the paid tier
+	TierPro = "pro"
+	// TierEnterprise is the highest tier
+	TierEnterprise = "enterprise"
+)
+
+// Tiers lists the service tiers from lowest to highest
+var Tiers = []string{TierFree, TierPro, TierEnterprise}
+
+// IsTier reports whether name is a known service tier
+func IsTier(name string) bool {
+	for _, t := range Tiers {
+		if t == name {
+			return true
+		}
+	}
+	return false
+}
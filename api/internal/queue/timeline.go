@@ -0,0 +1,62 @@
+package queue
+
+import "time"
+
+// MaxTimelineEvents caps the events kept in a job's Timeline, so a job
+// retried over and over doesn't grow its record without bound. The first
+// event, when the job was added, is always kept; the oldest after it are
+// dropped first.
+const MaxTimelineEvents = 50
+
+// JobEvent records a change of a job's status: the status it changed to
+// and when, the worker that claimed it for a change to processing, and a
+// note, such as the error code it failed or was retried with
+type JobEvent struct {
+	Status   JobStatus `json:"status"`
+	At       time.Time `json:"at"`
+	WorkerID string    `json:"worker_id,omitempty"`
+	Note     string    `json:"note,omitempty"`
+}
+
+// recordStatus adds the job's status to its Timeline as of at, unless it's
+// the status of the latest event, so writes that leave the status alone,
+// as progress and deliveries do, add nothing. Every write of a record that
+// may change its status calls it, inside whatever makes the write atomic.
+func (j *Job) recordStatus(at time.Time) {
+	if n := len(j.Timeline); n > 0 && j.Timeline[n-1].Status == j.Status {
+		return
+	}
+	event := JobEvent{Status: j.Status, At: at, Note: j.ErrorCode}
+	if j.Status == StatusProcessing {
+		event.WorkerID = j.WorkerID
+	}
+	j.Timeline = append(j.Timeline, event)
+	if n := len(j.Timeline) - MaxTimelineEvents; n > 0 {
+		j.Timeline = append(j.Timeline[:1:1], j.Timeline[1+n:]...)
+	}
+}
+
+// StatusDurations returns how long the job waited to be claimed, pending or
+// retrying, and how long it was processing, summed over its Timeline up to
+// the latest event. ok is false for a job without a timeline, as one
+// written before timelines were recorded. Events dropped beyond
+// MaxTimelineEvents aren't counted.
+func (j *Job) StatusDurations() (queued, processing time.Duration, ok bool) {
+	if len(j.Timeline) == 0 {
+		return 0, 0, false
+	}
+	for i := 0; i < len(j.Timeline)-1; i++ {
+		d := j.Timeline[i+1].At.Sub(j.Timeline[i].At)
+		if d < 0 {
+			// Written by clocks that disagree; nothing to count
+			continue
+		}
+		switch j.Timeline[i].Status {
+		case StatusPending, StatusRetrying:
+			queued += d
+		case StatusProcessing:
+			processing += d
+		}
+	}
+	return queued, processing, true
+}
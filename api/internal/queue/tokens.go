@@ -0,0 +1,38 @@
+package queue
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// downloadTokenKey returns the Redis key mapping a download token to its job
+func (k redisKeys) downloadTokenKey(token string) string {
+	return k.prefix + "download_token:" + token
+}
+
+// CreateDownloadToken issues an opaque single-use token for downloading the
+// result of a job, valid for ttl
+func (q *RedisQueue) CreateDownloadToken(ctx context.Context, jobID string, ttl time.Duration) (string, error) {
+	token, err := generateToken()
+	if err != nil {
+		return "", err
+	}
+
+	if err := q.client.Set(ctx, q.downloadTokenKey(token), jobID, ttl).Err(); err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RedeemDownloadToken consumes a download token and returns its job ID.
+// The token is deleted atomically, so only one redemption can succeed; an
+// unknown, expired, or already used token returns an empty job ID.
+func (q *RedisQueue) RedeemDownloadToken(ctx context.Context, token string) (string, error) {
+	jobID, err := q.client.GetDel(ctx, q.downloadTokenKey(token)).Result()
+	if err == redis.Nil {
+		return "", nil
+	}
+	return jobID, err
+}
@@ -0,0 +1,66 @@
+package queue
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestRedeemDownloadTokenOnce(t *testing.T) {
+	q, server := newTestRedisQueue(t, Options{})
+	ctx := context.Background()
+	token, err := q.CreateDownloadToken(ctx, "job-1", time.Minute)
+	if err != nil {
+		t.Fatalf("CreateDownloadToken: %v", err)
+	}
+
+	const redeemers = 16
+	jobIDs := make([]string, redeemers)
+	errs := make([]error, redeemers)
+	start := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < redeemers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			<-start
+			jobIDs[i], errs[i] = q.RedeemDownloadToken(ctx, token)
+		}(i)
+	}
+	close(start)
+	wg.Wait()
+
+	redeemed := 0
+	for i := range jobIDs {
+		if errs[i] != nil {
+			t.Fatalf("RedeemDownloadToken: %v", errs[i])
+		}
+		switch jobIDs[i] {
+		case "job-1":
+			redeemed++
+		case "":
+		default:
+			t.Fatalf("RedeemDownloadToken = %q, want job-1 or nothing", jobIDs[i])
+		}
+	}
+	if redeemed != 1 {
+		t.Fatalf("token redeemed %d times by %d concurrent requests, want once", redeemed, redeemers)
+	}
+	if server.Exists(q.downloadTokenKey(token)) {
+		t.Fatalf("token left in Redis after it was redeemed")
+	}
+}
+
+func TestRedeemDownloadTokenExpired(t *testing.T) {
+	q, server := newTestRedisQueue(t, Options{})
+	ctx := context.Background()
+	token, err := q.CreateDownloadToken(ctx, "job-1", time.Minute)
+	if err != nil {
+		t.Fatalf("CreateDownloadToken: %v", err)
+	}
+	server.FastForward(2 * time.Minute)
+	if jobID, err := q.RedeemDownloadToken(ctx, token); err != nil || jobID != "" {
+		t.Fatalf("RedeemDownloadToken of an expired token = %q, %v, want nothing", jobID, err)
+	}
+}
@@ -0,0 +1,186 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// maxTransferRetries bounds the attempts at a transfer racing other writes
+// to the job or the owners' usage
+const maxTransferRetries = 5
+
+var (
+	// ErrTransferQuota means the job doesn't fit in the target owner's
+	// quota for the day it was charged to
+	ErrTransferQuota = errors.New("job exceeds the target owner's daily quota")
+	// ErrTransferConflict means the job kept changing during the transfer
+	ErrTransferConflict = errors.New("job changed during the transfer")
+)
+
+// Transfer records one change of a job's owner
+type Transfer struct {
+	From string `json:"from"`
+	To   string `json:"to"`
+	// Actor made the transfer, the previous owner or an admin
+	Actor string    `json:"actor"`
+	At    time.Time `json:"at"`
+}
+
+// TransferRequest describes a change of a job's owner
+type TransferRequest struct {
+	JobID string
+	// From is the owner the job must have; empty transfers whoever owns it
+	From  string
+	To    string
+	Actor string
+	// Limits are the target's daily quota, checked if the job's charge is
+	// for the current day
+	Limits QuotaLimits
+	// Deliveries, if not nil, replace the job's pending deliveries; those
+	// already delivered or failed are kept
+	Deliveries []Delivery
+}
+
+// TransferJob gives a job to another owner. In one transaction it sets the
+// job's owner, appends to its transfer history, replaces its pending
+// deliveries if asked, and moves its quota charge for the day from the old
+// owner's usage to the new one's, failing with ErrTransferQuota if that
+// doesn't fit. A charge already refunded moves only the request. It returns
+// nil if the job doesn't exist or isn't From's, and the transferred job
+// otherwise. Search indexes and idempotency keys are the caller's to move.
+func (q *RedisQueue) TransferJob(ctx context.Context, req TransferRequest) (*Job, error) {
+	key := q.jobKey(req.JobID)
+	var transferred *Job
+	txf := func(tx *redis.Tx) error {
+		transferred = nil
+		data, err := tx.Get(ctx, key).Bytes()
+		if err == redis.Nil {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		var job Job
+		if err := q.opts.Codec.Decode(data, &job); err != nil {
+			return err
+		}
+		if req.From != "" && job.Owner != req.From {
+			return nil
+		}
+
+		now := q.opts.Clock.Now()
+		from := job.Owner
+		charge, err := q.transferCharge(ctx, tx, &job, req, now)
+		if err != nil {
+			return err
+		}
+
+		job.Owner = req.To
+		job.Transfers = append(job.Transfers, Transfer{From: from, To: req.To, Actor: req.Actor, At: now})
+		if req.Deliveries != nil {
+			kept := make([]Delivery, 0, len(job.Deliveries)+len(req.Deliveries))
+			for _, d := range job.Deliveries {
+				if d.Status != DeliveryPending {
+					kept = append(kept, d)
+				}
+			}
+			job.Deliveries = append(kept, req.Deliveries...)
+			if v := job.RequiredOptionsVersion(); v > job.OptionsVersion {
+				job.OptionsVersion = v
+			}
+		}
+		job.UpdatedAt = now
+		job.Version++
+		encoded, err := q.opts.Codec.Encode(&job)
+		if err != nil {
+			return err
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, key, encoded, q.jobTTL(&job))
+			q.indexStatus(ctx, pipe, &job)
+			if charge != nil {
+				charge(pipe)
+			}
+			// A completed job's new deliveries are due now
+			if req.Deliveries != nil && job.Status == StatusCompleted && len(req.Deliveries) > 0 {
+				pipe.ZAdd(ctx, q.deliveryQueueKey(), redis.Z{Score: float64(now.UnixMilli()), Member: job.ID})
+			}
+			return nil
+		})
+		if err == nil {
+			transferred = &job
+		}
+		return err
+	}
+
+	for i := 0; i < maxTransferRetries; i++ {
+		err := q.client.Watch(ctx, txf, key)
+		if err == redis.TxFailedErr {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		if transferred != nil {
+			q.publishTransfer(transferred)
+		}
+		return transferred, nil
+	}
+	return nil, ErrTransferConflict
+}
+
+// transferCharge watches the usage the job was charged to and checks that
+// its charge fits in the target's limits. It returns the writes moving the
+// charge, or nil if the job has no charge for the current day to move.
+func (q *RedisQueue) transferCharge(ctx context.Context, tx *redis.Tx, job *Job, req TransferRequest, now time.Time) (func(redis.Pipeliner), error) {
+	// Usage of days gone by no longer limits anyone
+	if job.Owner == "" || job.QuotaDay == "" || job.QuotaDay != newQuotaUsage(now).Day || job.Owner == req.To {
+		return nil, nil
+	}
+	fromKey, toKey := q.usageKey(job.Owner, job.QuotaDay), q.usageKey(req.To, job.QuotaDay)
+	if err := tx.Watch(ctx, fromKey, toKey, q.refundKey(job.ID)).Err(); err != nil {
+		return nil, err
+	}
+	refunded, err := tx.Exists(ctx, q.refundKey(job.ID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	mp := job.MilliMegapixels
+	if refunded > 0 {
+		mp = 0
+	}
+
+	values, err := tx.HMGet(ctx, toKey, "requests", "mp").Result()
+	if err != nil {
+		return nil, err
+	}
+	if (req.Limits.Requests > 0 && parseCount(values[0])+1 > req.Limits.Requests) ||
+		(req.Limits.MilliMegapixels > 0 && parseCount(values[1])+mp > req.Limits.MilliMegapixels) {
+		return nil, ErrTransferQuota
+	}
+
+	// Never take the old owner's usage below zero
+	values, err = tx.HMGet(ctx, fromKey, "requests", "mp").Result()
+	if err != nil {
+		return nil, err
+	}
+	fromRequests, fromMP := parseCount(values[0]), parseCount(values[1])
+	if fromRequests > 1 {
+		fromRequests = 1
+	}
+	if fromMP > mp {
+		fromMP = mp
+	}
+
+	return func(pipe redis.Pipeliner) {
+		pipe.HIncrBy(ctx, fromKey, "requests", -fromRequests)
+		pipe.HIncrBy(ctx, fromKey, "mp", -fromMP)
+		pipe.HIncrBy(ctx, toKey, "requests", 1)
+		pipe.HIncrBy(ctx, toKey, "mp", mp)
+		pipe.Expire(ctx, toKey, usageTTL)
+	}, nil
+}
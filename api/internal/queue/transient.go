@@ -0,0 +1,12 @@
+package queue
+
+import (
+	"rembg-v2/api/internal/errclass"
+)
+
+// IsTransient reports whether a queue error is likely to clear on its own,
+// such as a timeout, a dropped connection, or a Redis failover in progress.
+// Throttled errors, such as Redis running out of memory, count as transient.
+func IsTransient(err error) bool {
+	return errclass.Retryable(err)
+}
@@ -0,0 +1,131 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/redis/go-redis/v9"
+
+	"rembg-v2/api/internal/fault"
+)
+
+// maxTransitionRetries bounds the attempts at a transition racing writes
+// that leave the job's status alone
+const maxTransitionRetries = 5
+
+var (
+	// ErrInvalidTransition means a job's status wasn't the one a transition
+	// expected, as when another worker or the API changed it first
+	ErrInvalidTransition = errors.New("invalid job status transition")
+	// ErrTransitionConflict means the job kept changing during the transition
+	ErrTransitionConflict = errors.New("job changed during the transition")
+)
+
+// transitionScript replaces the record at KEYS[1] with ARGV[2] only if it's
+// still ARGV[1], the record the new one was made from, and moves job
+// ARGV[5] from the status index KEYS[2] to KEYS[3], scored ARGV[4]. The
+// record expires after ARGV[3] milliseconds, or never if that's 0. Returns
+// 0 if the record changed.
+var transitionScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) ~= ARGV[1] then
+	return 0
+end
+if tonumber(ARGV[3]) > 0 then
+	redis.call("SET", KEYS[1], ARGV[2], "PX", ARGV[3])
+else
+	redis.call("SET", KEYS[1], ARGV[2])
+end
+redis.call("ZREM", KEYS[2], ARGV[5])
+redis.call("ZADD", KEYS[3], ARGV[4], ARGV[5])
+return 1
+`)
+
+// TransitionJob changes a job's status from from to to, applying mutate,
+// which may be nil, to the stored job first. The new record is written by a
+// script only if the stored one is still the one it was made from, so two
+// writers can't both move a job out of the same status: the second fails
+// with ErrInvalidTransition once it sees the status the first wrote. A
+// write that changed the record but not its status is retried on. The
+// job's Version is incremented; a mutate leaving another, as a stale copy
+// written back does, fails with ErrVersionConflict. Only a claim, from
+// pending to processing, may change the job's claim token; a mutate
+// leaving another than the stored one fails with ErrFenced. It fails with
+// ErrJobNotFound if there is no job.
+func (q *RedisQueue) TransitionJob(ctx context.Context, jobID string, from, to JobStatus, mutate func(*Job)) error {
+	if err := fault.Maybe(ctx, fault.Redis, "job_id", jobID); err != nil {
+		return err
+	}
+	key := q.jobKey(jobID)
+	for i := 0; i < maxTransitionRetries; i++ {
+		stored, err := q.client.Get(ctx, key).Result()
+		if err == redis.Nil {
+			return ErrJobNotFound
+		}
+		if err != nil {
+			return err
+		}
+		var job Job
+		if err := q.opts.Codec.Decode([]byte(stored), &job); err != nil {
+			return err
+		}
+		if job.Status != from {
+			return fmt.Errorf("%w: job %s is %s, not %s", ErrInvalidTransition, jobID, job.Status, from)
+		}
+
+		token, version := job.ClaimToken, job.Version
+		if mutate != nil {
+			mutate(&job)
+		}
+		if !claimsJob(from, to) {
+			if err := fenced(jobID, job.ClaimToken, token); err != nil {
+				return err
+			}
+		}
+		if err := versioned(jobID, job.Version, version); err != nil {
+			return err
+		}
+		job.Version++
+		job.Status = to
+		job.UpdatedAt = q.opts.Clock.Now()
+		job.recordStatus(job.UpdatedAt)
+		encoded, err := q.opts.Codec.Encode(&job)
+		if err != nil {
+			return err
+		}
+		written, err := transitionScript.Run(ctx, q.client,
+			[]string{key, q.statusIndexKey(from), q.statusIndexKey(to)},
+			stored, encoded, q.jobTTL(&job).Milliseconds(), job.UpdatedAt.UnixMilli(), jobID,
+		).Int()
+		if err != nil {
+			return err
+		}
+		if written == 1 {
+			if finished(to) {
+				// The script can't write the summary hash, so history is
+				// recorded after the transition, as events are published
+				pipe := q.client.Pipeline()
+				q.recordHistory(ctx, pipe, &job)
+				pipe.Exec(ctx)
+			}
+			q.publishEvent(&job)
+			return nil
+		}
+	}
+	return ErrTransitionConflict
+}
+
+// transition writes job in full, as UpdateJob does, but only if its stored
+// status and version are still the ones it had when it was read. The
+// caller's job gets the UpdatedAt, Version, and Timeline written.
+func (q *RedisQueue) transition(ctx context.Context, job *Job, from JobStatus) error {
+	var written *Job
+	err := q.TransitionJob(ctx, job.ID, from, job.Status, func(stored *Job) {
+		*stored = *job
+		written = stored
+	})
+	if err == nil {
+		job.UpdatedAt, job.Version, job.Timeline = written.UpdatedAt, written.Version, written.Timeline
+	}
+	return err
+}
@@ -0,0 +1,66 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+)
+
+func TestTransitionJobLetsOneRacingWorkerWin(t *testing.T) {
+	q, _ := newTestRedisQueue(t, Options{})
+	ctx := context.Background()
+
+	const rounds, workers = 20, 2
+	for round := 0; round < rounds; round++ {
+		jobID := fmt.Sprintf("job-%d", round)
+		if err := q.AddJob(ctx, &Job{ID: jobID}); err != nil {
+			t.Fatalf("AddJob: %v", err)
+		}
+		if err := q.TransitionJob(ctx, jobID, StatusPending, StatusProcessing, nil); err != nil {
+			t.Fatalf("TransitionJob to processing: %v", err)
+		}
+
+		// Both workers finish the same attempt, as after a requeue that
+		// handed the job out twice
+		errs := make([]error, workers)
+		var wg sync.WaitGroup
+		for w := 0; w < workers; w++ {
+			wg.Add(1)
+			go func(w int) {
+				defer wg.Done()
+				errs[w] = q.TransitionJob(ctx, jobID, StatusProcessing, StatusCompleted, func(job *Job) {
+					job.OutputPath = fmt.Sprintf("worker-%d", w)
+				})
+			}(w)
+		}
+		wg.Wait()
+
+		winner := -1
+		for w, err := range errs {
+			switch {
+			case err == nil && winner >= 0:
+				t.Fatalf("round %d: workers %d and %d both completed the job", round, winner, w)
+			case err == nil:
+				winner = w
+			case !errors.Is(err, ErrInvalidTransition):
+				t.Fatalf("round %d: losing worker %d failed with %v, want ErrInvalidTransition", round, w, err)
+			}
+		}
+		if winner < 0 {
+			t.Fatalf("round %d: no worker completed the job: %v", round, errs)
+		}
+
+		job, err := q.GetJob(ctx, jobID)
+		if err != nil {
+			t.Fatalf("GetJob: %v", err)
+		}
+		if job.Status != StatusCompleted || job.OutputPath != fmt.Sprintf("worker-%d", winner) {
+			t.Fatalf("round %d: stored job is %s with output %q, want completed by worker %d", round, job.Status, job.OutputPath, winner)
+		}
+		if job.Version != 3 {
+			t.Fatalf("round %d: Version = %d, want 3 after add, claim, and one completion", round, job.Version)
+		}
+	}
+}
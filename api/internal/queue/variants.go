@@ -0,0 +1,44 @@
+package queue
+
+import (
+	"context"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// variantsKey returns the Redis sorted set of transcoded result files,
+// scored by last use, which bounds the variant cache across replicas
+func (k redisKeys) variantsKey() string {
+	return k.prefix + "result_variants"
+}
+
+// trackVariantScript marks variant ARGV[1] as used at ARGV[2] and returns
+// the least recently used variants beyond ARGV[3], which it forgets
+var trackVariantScript = redis.NewScript(`
+redis.call("ZADD", KEYS[1], ARGV[2], ARGV[1])
+local excess = redis.call("ZCARD", KEYS[1]) - tonumber(ARGV[3])
+if excess <= 0 then
+	return {}
+end
+local evicted = redis.call("ZRANGE", KEYS[1], 0, excess - 1)
+redis.call("ZREMRANGEBYRANK", KEYS[1], 0, excess - 1)
+return evicted
+`)
+
+// TrackVariant records a use of a transcoded result file. It returns the
+// files evicted to keep at most max variants, which the caller removes.
+func (q *RedisQueue) TrackVariant(ctx context.Context, path string, max int) ([]string, error) {
+	return trackVariantScript.Run(ctx, q.client, []string{q.variantsKey()}, path, q.opts.Clock.Now().UnixMilli(), max).StringSlice()
+}
+
+// ForgetVariants drops transcoded result files removed with their result
+func (q *RedisQueue) ForgetVariants(ctx context.Context, paths ...string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+	members := make([]interface{}, len(paths))
+	for i, path := range paths {
+		members[i] = path
+	}
+	return q.client.ZRem(ctx, q.variantsKey(), members...).Err()
+}
@@ -0,0 +1,40 @@
+package queue
+
+import (
+	"errors"
+	"fmt"
+)
+
+// ErrVersionConflict means a job was written since the copy being written
+// back was read; the caller re-reads the job and applies its change again
+var ErrVersionConflict = errors.New("job changed since it was read")
+
+// versioned returns ErrVersionConflict for a write of a job at version over
+// a stored job at another
+func versioned(jobID string, version, stored int64) error {
+	if version == stored {
+		return nil
+	}
+	return fmt.Errorf("%w: job %s is at version %d, not %d", ErrVersionConflict, jobID, stored, version)
+}
+
+// checkUpdate returns why job can't be written over the stored job: it's
+// claimed under another token, which no retry fixes, or was read at another
+// version
+func checkUpdate(job, stored *Job) error {
+	if err := fenced(job.ID, job.ClaimToken, stored.ClaimToken); err != nil {
+		return err
+	}
+	return versioned(job.ID, job.Version, stored.Version)
+}
+
+// checkMissing returns ErrJobNotFound for a write of a job whose record is
+// gone, as when it was deleted or expired while a worker held it, so the
+// write doesn't bring it back. A job never stored, at version 0, is
+// created.
+func checkMissing(job *Job) error {
+	if job.Version == 0 {
+		return nil
+	}
+	return fmt.Errorf("%w: job %s was removed", ErrJobNotFound, job.ID)
+}
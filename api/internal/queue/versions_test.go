@@ -0,0 +1,66 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+)
+
+func TestUpdateJobDropsNoConcurrentUpdate(t *testing.T) {
+	q, _ := newTestRedisQueue(t, Options{})
+	ctx := context.Background()
+	if err := q.AddJob(ctx, &Job{ID: "job-1"}); err != nil {
+		t.Fatalf("AddJob: %v", err)
+	}
+
+	const writers, increments = 8, 25
+	var conflicts int64
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	errs := make(chan error, writers)
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < increments; i++ {
+				// Read, change, and write back, again after each conflict
+				for {
+					job, err := q.GetJob(ctx, "job-1")
+					if err != nil {
+						errs <- err
+						return
+					}
+					job.Attempts++
+					err = q.UpdateJob(ctx, job)
+					if err == nil {
+						break
+					}
+					if !errors.Is(err, ErrVersionConflict) {
+						errs <- err
+						return
+					}
+					mu.Lock()
+					conflicts++
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatalf("updating the job: %v", err)
+	}
+
+	job, err := q.GetJob(ctx, "job-1")
+	if err != nil {
+		t.Fatalf("GetJob: %v", err)
+	}
+	if job.Attempts != writers*increments {
+		t.Fatalf("Attempts = %d after %d increments, %d conflicts: updates were lost", job.Attempts, writers*increments, conflicts)
+	}
+	if job.Version != 1+writers*increments {
+		t.Fatalf("Version = %d, want one per write: %d", job.Version, 1+writers*increments)
+	}
+}
@@ -0,0 +1,95 @@
+package queue
+
+import (
+	"context"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// waitRecheckInterval is how often WaitForJob reads the job regardless of
+// notifications, in case one was lost
+const waitRecheckInterval = 5 * time.Second
+
+// errSubscriptionClosed means the Pub/Sub connection of a wait was closed
+// under it
+var errSubscriptionClosed = errors.New("job notification subscription closed")
+
+// Finished reports whether a job with the status has completed, failed, or
+// been cancelled, and won't change unless it's requeued
+func (s JobStatus) Finished() bool {
+	return s == StatusCompleted || s == StatusFailed || s == StatusCancelled
+}
+
+// jobEventsChannel returns the Pub/Sub channel a job's finish is announced on
+func (k redisKeys) jobEventsChannel(jobID string) string {
+	return k.prefix + "job_events:" + jobID
+}
+
+// notifyFinished announces on its channel that the job finished, with its
+// status. Like lifecycle events it's fire-and-forget, but it's published
+// whether or not those are enabled, since waiters rely on it.
+func (q *RedisQueue) notifyFinished(job *Job) {
+	if !job.Status.Finished() {
+		return
+	}
+	channel, status := q.jobEventsChannel(job.ID), string(job.Status)
+	go func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		if err := q.client.Publish(ctx, channel, status).Err(); err != nil {
+			eventPublishFailures.Add(1)
+			log.Printf("Failed to announce that job %s finished: %v", job.ID, err)
+		}
+	}()
+}
+
+// WaitForJob returns the job once it has finished, or as it is when timeout
+// passes, if timeout is positive, or nil if there is no such job. It listens
+// on the job's channel, reading the job first and again whenever it
+// subscribes, so a finish announced before the subscription, or during a
+// reconnect, isn't missed; it also reads the job every waitRecheckInterval.
+// It fails with ctx's error once ctx is done. The subscription is always
+// closed before it returns.
+func (q *RedisQueue) WaitForJob(ctx context.Context, jobID string, timeout time.Duration) (*Job, error) {
+	job, err := NilIfNotFound(q.GetJob(ctx, jobID))
+	if err != nil || job == nil || job.Status.Finished() {
+		return job, err
+	}
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	recheck := time.NewTicker(waitRecheckInterval)
+	defer recheck.Stop()
+
+	pubsub := q.client.Subscribe(ctx, q.jobEventsChannel(jobID))
+	defer pubsub.Close()
+	// Subscriptions are delivered too, including the one made after a reconnect
+	messages := pubsub.ChannelWithSubscriptions(redis.WithChannelSize(1))
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-expired:
+			return job, nil
+		case _, ok := <-messages:
+			if !ok {
+				return nil, errSubscriptionClosed
+			}
+		case <-recheck.C:
+		}
+
+		job, err = NilIfNotFound(q.GetJob(ctx, jobID))
+		if err != nil || job == nil || job.Status.Finished() {
+			return job, err
+		}
+	}
+}
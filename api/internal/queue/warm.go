@@ -0,0 +1,47 @@
+package queue
+
+import (
+	"context"
+	"sync"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Warm dials MinIdleConns connections up front so the first requests after
+// startup don't pay for lazy connection setup
+func (q *RedisQueue) Warm(ctx context.Context) error {
+	n := q.opts.MinIdleConns
+	if n < 1 {
+		n = 1
+	}
+
+	// Concurrent pings force the pool to open distinct connections
+	var wg sync.WaitGroup
+	errs := make(chan error, n)
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			errs <- q.client.Ping(ctx).Err()
+		}()
+	}
+	wg.Wait()
+	close(errs)
+
+	for err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Ping checks that Redis answers
+func (q *RedisQueue) Ping(ctx context.Context) error {
+	return q.client.Ping(ctx).Err()
+}
+
+// PoolStats returns the connection pool statistics of the Redis client
+func (q *RedisQueue) PoolStats() *redis.PoolStats {
+	return q.client.PoolStats()
+}
@@ -0,0 +1,42 @@
+package queue
+
+import "expvar"
+
+// Warning codes describing non-fatal issues with a job
+const (
+	// WarningAnimatedInput means only the first frame of an animated input is processed
+	WarningAnimatedInput = "animated_input"
+	// WarningMetadataDropped means input metadata such as EXIF is not copied to the output
+	WarningMetadataDropped = "metadata_dropped"
+	// WarningEmptyMask means almost no foreground was detected
+	WarningEmptyMask = "empty_mask"
+	// WarningDownscaledOutput means the output is smaller than the input
+	WarningDownscaledOutput = "downscaled_output"
+	// WarningPreviewSkipped means no input preview was made for a submission
+	// that asked for one
+	WarningPreviewSkipped = "preview_skipped"
+)
+
+// warningCounts counts attached warnings per code
+var warningCounts = expvar.NewMap("job_warnings")
+
+// Warning is a non-fatal issue reported to the client alongside the job
+type Warning struct {
+	Code    string            `json:"code"`
+	Message string            `json:"message"`
+	Params  map[string]string `json:"params,omitempty"`
+}
+
+// AddWarning appends a warning to the job unless one with the same code is
+// already present. It reports whether the warning was added.
+func (j *Job) AddWarning(w Warning) bool {
+	for _, existing := range j.Warnings {
+		if existing.Code == w.Code {
+			return false
+		}
+	}
+
+	j.Warnings = append(j.Warnings, w)
+	warningCounts.Add(w.Code, 1)
+	return true
+}
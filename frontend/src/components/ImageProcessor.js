@@ -11,7 +11,7 @@ import axios from 'axios';
 import DownloadIcon from '@mui/icons-material/Download';
 import RefreshIcon from '@mui/icons-material/Refresh';
 
-// Polling interval in ms
+// Polling interval in ms, used when the server sends no retry_after_ms hint
 const POLLING_INTERVAL = 2000;
 
 // Styled components
@@ -112,8 +112,9 @@ const ImageProcessor = ({
           }
         }
         
-        // Continue polling
-        const timeout = setTimeout(() => poll(), POLLING_INTERVAL);
+        // Continue polling, honoring the server's hint when present
+        const delay = response.data?.retry_after_ms || POLLING_INTERVAL;
+        const timeout = setTimeout(() => poll(), delay);
         setPollingTimeout(timeout);
       } catch (err) {
         console.error('Error polling for results:', err);
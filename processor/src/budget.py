@@ -0,0 +1,96 @@
+"""
+Per-stage timing budget for a job.
+The total job timeout is split across the stages by weight. Each stage's
+allowance is computed when it starts from the time still left, so time a
+fast stage didn't use rolls over to the stages after it.
+"""
+
+import time
+from typing import Callable, Dict, List, Optional
+
+
+# Relative share of the job timeout each stage gets
+DEFAULT_STAGE_WEIGHTS = {
+    "inference": 6.0,
+    "trim": 0.5,
+    "shadow": 1.0,
+    "composite": 0.5,
+    "resize": 0.5,
+    "encode": 1.5,
+}
+
+# Weight of stages missing from the weights
+FALLBACK_STAGE_WEIGHT = 1.0
+
+
+def parse_stage_weights(value: str) -> Dict[str, float]:
+    """Parse a "stage=weight,stage=weight" list over the default weights."""
+    weights = dict(DEFAULT_STAGE_WEIGHTS)
+    for entry in value.split(","):
+        name, sep, weight = entry.strip().partition("=")
+        if not sep:
+            continue
+        try:
+            parsed = float(weight)
+        except ValueError:
+            continue
+        if parsed > 0:
+            weights[name.strip()] = parsed
+    return weights
+
+
+class StageTimeout(Exception):
+    """A stage ran past its share of the job timeout."""
+
+    def __init__(self, stage: str, elapsed: float, allowance: float):
+        super().__init__(f"Stage {stage} took {elapsed:.1f}s, over its {allowance:.1f}s budget")
+        self.stage = stage
+
+    @property
+    def error_code(self) -> str:
+        return f"timeout_{self.stage}"
+
+
+class Budget:
+    """Tracks the time left for a job's stages and each stage's deadline."""
+
+    def __init__(self, total_seconds: float, stages: List[str],
+                 weights: Optional[Dict[str, float]] = None,
+                 clock: Callable[[], float] = time.monotonic):
+        self.total_seconds = total_seconds
+        self.weights = weights or DEFAULT_STAGE_WEIGHTS
+        self.clock = clock
+        self.pending = list(stages)
+        self.deadline = clock() + total_seconds if total_seconds > 0 else None
+        self.timings: List[Dict[str, object]] = []
+        self.started: Optional[float] = None
+        self.allowance: Optional[float] = None
+
+    def weight(self, stage: str) -> float:
+        return self.weights.get(stage, FALLBACK_STAGE_WEIGHT)
+
+    def remaining(self) -> Optional[float]:
+        """Seconds left in the whole job, or None without a timeout."""
+        if self.deadline is None:
+            return None
+        return max(0.0, self.deadline - self.clock())
+
+    def start(self, stage: str) -> Optional[float]:
+        """Begin a stage and return its deadline on the budget's clock."""
+        self.started = self.clock()
+        left = self.remaining()
+        if left is None:
+            self.allowance = None
+        else:
+            pending_weight = sum(self.weight(s) for s in self.pending) or self.weight(stage)
+            self.allowance = left * self.weight(stage) / pending_weight
+        if stage in self.pending:
+            self.pending.remove(stage)
+        return None if self.allowance is None else self.started + self.allowance
+
+    def finish(self, stage: str) -> None:
+        """End a stage, recording its timing and raising if it overran."""
+        elapsed = self.clock() - self.started
+        self.timings.append({"stage": stage, "ms": int(elapsed * 1000)})
+        if self.allowance is not None and elapsed > self.allowance:
+            raise StageTimeout(stage, elapsed, self.allowance)
@@ -0,0 +1,39 @@
+"""
+Job record codec, kept in sync with the API's queue codec.
+Records above a size threshold can be zlib-compressed; compressed records
+start with a marker byte followed by base64, so they stay valid text for
+Redis clients that decode responses. Plain records are JSON objects.
+"""
+
+import base64
+import json
+import zlib
+from typing import Any, Dict
+
+
+COMPRESSION_NONE = "none"
+COMPRESSION_ZLIB = "zlib"
+
+# Record size in bytes above which records are compressed
+DEFAULT_COMPRESSION_THRESHOLD = 4096
+
+# First character of a zlib record; plain records start with "{"
+ZLIB_MARKER = "z"
+
+
+def encode_record(record: Dict[str, Any], algorithm: str = COMPRESSION_NONE,
+                  threshold: int = DEFAULT_COMPRESSION_THRESHOLD) -> str:
+    """Serialize a job record, compressing it if it is large enough to pay off."""
+    data = json.dumps(record)
+    if algorithm != COMPRESSION_ZLIB or len(data.encode()) <= threshold:
+        return data
+    
+    encoded = ZLIB_MARKER + base64.b64encode(zlib.compress(data.encode())).decode("ascii")
+    return encoded if len(encoded) < len(data.encode()) else data
+
+
+def decode_record(data: str) -> Dict[str, Any]:
+    """Deserialize a job record in any stored format."""
+    if data.startswith(ZLIB_MARKER):
+        return json.loads(zlib.decompress(base64.b64decode(data[1:])))
+    return json.loads(data)
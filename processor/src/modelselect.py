@@ -0,0 +1,65 @@
+"""
+Automatic model selection for model=auto jobs.
+A cheap, deterministic pre-pass over a thumbnail of the input scores how
+portrait-like and how product-like the image is and picks a model, falling
+back to the default model when neither score is confident.
+"""
+
+from typing import Any, Dict
+
+import numpy as np
+from PIL import Image
+
+
+# Models, kept in sync with the API
+DEFAULT_MODEL = "u2net"
+PORTRAIT_MODEL = "u2net_human_seg"
+PRODUCT_MODEL = "isnet-general-use"
+
+# Below this confidence the default model is used
+CONFIDENCE_THRESHOLD = 0.6
+
+# Side of the square thumbnail the heuristics run on
+THUMBNAIL_SIZE = 64
+
+# Fraction of skin-toned pixels in the center at which an image is surely a portrait
+PORTRAIT_SKIN_RATIO = 0.25
+
+# Border standard deviation (0-255) at which a background stops looking plain
+PRODUCT_BORDER_STD = 40.0
+
+
+def skin_ratio(rgb: np.ndarray) -> float:
+    """Fraction of pixels whose YCbCr chroma falls in the usual skin range."""
+    r, g, b = (rgb[..., i].astype(np.float32) for i in range(3))
+    cb = 128 - 0.168736 * r - 0.331264 * g + 0.5 * b
+    cr = 128 + 0.5 * r - 0.418688 * g - 0.081312 * b
+    skin = (cr >= 133) & (cr <= 173) & (cb >= 77) & (cb <= 127)
+    return float(skin.mean()) if skin.size else 0.0
+
+
+def border_std(rgb: np.ndarray) -> float:
+    """Color spread along the image border; low for plain studio backgrounds."""
+    border = np.concatenate([rgb[0], rgb[-1], rgb[:, 0], rgb[:, -1]]).astype(np.float32)
+    return float(border.std(axis=0).mean())
+
+
+def select_model(image: Image.Image) -> Dict[str, Any]:
+    """Pick a model for the image, returning the model, confidence, and reason."""
+    thumb = image.convert("RGB").resize((THUMBNAIL_SIZE, THUMBNAIL_SIZE), Image.BILINEAR)
+    rgb = np.asarray(thumb)
+
+    # People are usually centered, so look for skin in the middle half
+    q = THUMBNAIL_SIZE // 4
+    portrait = min(1.0, skin_ratio(rgb[q:-q, q:-q]) / PORTRAIT_SKIN_RATIO)
+    product = max(0.0, 1.0 - border_std(rgb) / PRODUCT_BORDER_STD)
+
+    if portrait >= product:
+        model, confidence, reason = PORTRAIT_MODEL, portrait, "skin tones in the center"
+    else:
+        model, confidence, reason = PRODUCT_MODEL, product, "plain background"
+
+    if confidence < CONFIDENCE_THRESHOLD:
+        model, reason = DEFAULT_MODEL, f"low confidence for {model}"
+
+    return {"model": model, "confidence": round(confidence, 3), "reason": reason}
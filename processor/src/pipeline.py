@@ -0,0 +1,208 @@
+"""
+Post-processing pipeline applied to the cut-out image.
+Each stage is a small step built from the job options; the API validates
+explicit stage orders against the same DAG before a job is queued.
+"""
+
+from typing import Any, Callable, Dict, List, Optional
+
+import numpy as np
+from PIL import Image, ImageColor, ImageFilter
+
+from budget import Budget
+
+
+# Default stage order
+DEFAULT_ORDER = ["trim", "shadow", "composite", "resize", "encode"]
+
+# Offset and blur radius of the drop shadow, in pixels
+SHADOW_OFFSET = 10
+SHADOW_BLUR = 8
+SHADOW_OPACITY = 0.5
+
+# Ways the composite stage blends the image over its background
+COMPOSITE_LINEAR = "linear"
+COMPOSITE_FAST = "fast"
+
+
+class JobCancelled(Exception):
+    """The job was cancelled before a stage started."""
+
+    def __init__(self, stage: str):
+        super().__init__(f"Job cancelled before {stage}")
+        self.stage = stage
+
+
+# Progress reported as the post-processing stages start, after inference
+PIPELINE_PROGRESS = 80
+
+
+class PipelineContext:
+    """State shared by the stages of one job."""
+
+    def __init__(self, options: Dict[str, str], output_path: str,
+                 cancelled: Optional[Callable[[], bool]] = None,
+                 progress: Optional[Callable[[int, str], None]] = None):
+        self.options = options
+        self.output_path = output_path
+        # Asked between stages whether the job was cancelled
+        self.cancelled = cancelled
+        # Told the job's progress and the stage it's in as each stage starts
+        self.progress = progress
+        # Monotonic deadline of the running stage, or None without a timeout
+        self.deadline: Optional[float] = None
+        # How the composite stage blended, or None if it didn't run
+        self.composite_mode: Optional[str] = None
+
+
+class Stage:
+    """A post-processing step. Stages take and return an image."""
+    name = ""
+
+    def apply(self, image: Image.Image, ctx: PipelineContext) -> Image.Image:
+        raise NotImplementedError
+
+
+class TrimStage(Stage):
+    """Crops transparent borders around the subject."""
+    name = "trim"
+
+    def apply(self, image: Image.Image, ctx: PipelineContext) -> Image.Image:
+        bbox = image.getchannel("A").getbbox()
+        return image.crop(bbox) if bbox else image
+
+
+class ShadowStage(Stage):
+    """Adds a soft drop shadow under the subject, growing the canvas to fit it."""
+    name = "shadow"
+
+    def apply(self, image: Image.Image, ctx: PipelineContext) -> Image.Image:
+        pad = SHADOW_OFFSET + SHADOW_BLUR * 2
+        canvas = Image.new("RGBA", (image.width + pad * 2, image.height + pad * 2), (0, 0, 0, 0))
+
+        alpha = image.getchannel("A").point(lambda a: int(a * SHADOW_OPACITY))
+        shadow = Image.new("RGBA", image.size, (0, 0, 0, 255))
+        shadow.putalpha(alpha)
+        canvas.alpha_composite(shadow, (pad + SHADOW_OFFSET, pad + SHADOW_OFFSET))
+        canvas = canvas.filter(ImageFilter.GaussianBlur(SHADOW_BLUR))
+
+        canvas.alpha_composite(image, (pad, pad))
+        return canvas
+
+
+class CompositeStage(Stage):
+    """Replaces transparency with a solid background color.
+
+    By default the blend is done in linear light, so semi-transparent edges
+    don't darken the way they do when sRGB bytes are mixed directly; the
+    fast mode mixes the bytes.
+    """
+    name = "composite"
+
+    def apply(self, image: Image.Image, ctx: PipelineContext) -> Image.Image:
+        ctx.composite_mode = ctx.options.get("composite_mode") or COMPOSITE_LINEAR
+        if ctx.composite_mode == COMPOSITE_FAST:
+            background = Image.new("RGBA", image.size, ctx.options["background"])
+            background.alpha_composite(image)
+            return background
+        return composite_linear(image, ImageColor.getrgb(ctx.options["background"]))
+
+
+def srgb_to_linear(values: np.ndarray) -> np.ndarray:
+    """Decode sRGB values in [0, 1] to linear light."""
+    return np.where(values <= 0.04045, values / 12.92, ((values + 0.055) / 1.055) ** 2.4)
+
+
+def linear_to_srgb(values: np.ndarray) -> np.ndarray:
+    """Encode linear light values in [0, 1] as sRGB."""
+    return np.where(values <= 0.0031308, values * 12.92, 1.055 * values ** (1 / 2.4) - 0.055)
+
+
+def composite_linear(image: Image.Image, color: tuple) -> Image.Image:
+    """Blend an RGBA image over an opaque color in linear light.
+
+    The layers stay in floating point from decoding to encoding, so the
+    result is rounded to 8 bits once rather than after each step.
+    """
+    pixels = np.asarray(image.convert("RGBA"), dtype=np.float32) / 255
+    alpha = pixels[..., 3:]
+    # Premultiplying the foreground makes the blend one multiply-add
+    foreground = srgb_to_linear(pixels[..., :3]) * alpha
+    background = srgb_to_linear(np.asarray(color[:3], dtype=np.float32) / 255)
+    blended = linear_to_srgb(np.clip(foreground + background * (1 - alpha), 0, 1))
+
+    out = np.empty(pixels.shape, dtype=np.uint8)
+    out[..., :3] = np.round(blended * 255)
+    out[..., 3] = 255
+    return Image.fromarray(out, "RGBA")
+
+
+class ResizeStage(Stage):
+    """Shrinks the image to fit within max_size, keeping its aspect ratio."""
+    name = "resize"
+
+    def apply(self, image: Image.Image, ctx: PipelineContext) -> Image.Image:
+        max_size = int(ctx.options["max_size"])
+        if image.width <= max_size and image.height <= max_size:
+            return image
+        resized = image.copy()
+        resized.thumbnail((max_size, max_size), Image.LANCZOS)
+        return resized
+
+
+class EncodeStage(Stage):
+    """Writes the image to the output path in the requested format."""
+    name = "encode"
+
+    def apply(self, image: Image.Image, ctx: PipelineContext) -> Image.Image:
+        image_format = ctx.options.get("format")
+        image.save(ctx.output_path, format=image_format.upper() if image_format else None)
+        return image
+
+
+STAGES = {stage.name: stage for stage in (
+    TrimStage, ShadowStage, CompositeStage, ResizeStage, EncodeStage,
+)}
+
+
+def default_stages(options: Dict[str, str]) -> List[str]:
+    """Pick the stages the options enable, in the default order."""
+    enabled = {
+        "trim": options.get("trim") == "true",
+        "shadow": options.get("shadow") == "true",
+        "composite": bool(options.get("background")),
+        "resize": bool(options.get("max_size")),
+        "encode": True,
+    }
+    return [name for name in DEFAULT_ORDER if enabled[name]]
+
+
+def build_pipeline(options: Dict[str, str], order: Optional[List[str]] = None) -> List[Stage]:
+    """Build the stages for a job, from its explicit order or from its options."""
+    names = order or default_stages(options)
+    unknown = [name for name in names if name not in STAGES]
+    if unknown:
+        raise ValueError(f"Unknown pipeline stages: {', '.join(unknown)}")
+    if names[-1] != "encode":
+        raise ValueError("Pipeline must end with encode")
+    return [STAGES[name]() for name in names]
+
+
+def run_pipeline(image: Image.Image, stages: List[Stage], ctx: PipelineContext,
+                 budget: Optional[Budget] = None) -> List[Dict[str, Any]]:
+    """Run the stages in order within the budget and return how long each one took.
+
+    Raises StageTimeout when a stage overruns its share of the budget, and
+    JobCancelled when the job was cancelled before a stage.
+    """
+    budget = budget or Budget(0, [stage.name for stage in stages])
+    for i, stage in enumerate(stages):
+        if ctx.cancelled and ctx.cancelled():
+            raise JobCancelled(stage.name)
+        if ctx.progress:
+            # Inference is most of the work; the stages share what's left
+            ctx.progress(PIPELINE_PROGRESS + (100 - PIPELINE_PROGRESS) * i // len(stages), stage.name)
+        ctx.deadline = budget.start(stage.name)
+        image = stage.apply(image, ctx)
+        budget.finish(stage.name)
+    return budget.timings
@@ -6,20 +6,35 @@ This worker polls the Redis queue for pending jobs and processes them.
 
 import json
 import logging
+import math
 import multiprocessing
 import os
+import random
+import socket
 import sys
+import threading
 import time
 import traceback
-from dataclasses import dataclass
+import uuid
+from dataclasses import dataclass, field
+from datetime import datetime, timezone
 from pathlib import Path
-from typing import Optional, Dict, Any, List
+from typing import Callable, Optional, Dict, Any, List
+from urllib.parse import parse_qs, unquote
 
 import redis
+from redis.cluster import ClusterNode, RedisCluster
+from redis.exceptions import ClusterDownError, MovedError, ReadOnlyError
+from redis.sentinel import Sentinel
 from rembg import remove, new_session
-from PIL import Image
+from PIL import Image, ImageChops
 import numpy as np
 
+from budget import Budget, StageTimeout, parse_stage_weights
+from codec import COMPRESSION_NONE, DEFAULT_COMPRESSION_THRESHOLD, decode_record, encode_record
+from modelselect import DEFAULT_MODEL, select_model
+from pipeline import JobCancelled, PipelineContext, build_pipeline, run_pipeline
+
 
 # Configure logging
 logging.basicConfig(
@@ -29,6 +44,65 @@ logging.basicConfig(
 )
 logger = logging.getLogger("rembg-worker")
 
+# Version of the lifecycle event payload, kept in sync with the Go API
+EVENT_SCHEMA_VERSION = 1
+
+# Begins every key of a queue without a key prefix in a Redis Cluster
+DEFAULT_CLUSTER_TAG = "{rmbg}:"
+
+
+def is_cluster_url(redis_url: str) -> bool:
+    """Whether REDIS_URL lists Redis Cluster nodes, as host:port,host:port."""
+    return "," in redis_url and "://" not in redis_url
+
+
+def cluster_key_prefix(prefix: str) -> str:
+    """Returns the prefix keys begin with in a Redis Cluster, as the API
+    builds it: the key prefix as a hash tag, so all of the queue's keys
+    share a slot."""
+    return "{" + prefix + "}" if prefix else DEFAULT_CLUSTER_TAG
+
+
+# Begins every Redis key and job channel, so deployments sharing a database
+# stay apart; must match the API's REDIS_KEY_PREFIX
+KEY_PREFIX = os.environ.get("REDIS_KEY_PREFIX", "")
+if is_cluster_url(os.environ.get("REDIS_URL", "")):
+    KEY_PREFIX = cluster_key_prefix(KEY_PREFIX)
+
+
+def prefixed(name: str) -> str:
+    """Returns the Redis key for name under KEY_PREFIX."""
+    return KEY_PREFIX + name
+
+
+# How long a job without a retention snapshot is kept after each update,
+# unless JOB_PENDING_TTL_SECONDS, JOB_COMPLETED_TTL_SECONDS, or
+# JOB_FAILED_TTL_SECONDS set it for the status it was updated to
+DEFAULT_JOB_TTL_SECONDS = 86400
+
+# How long the summary of a completed or failed job is kept for the API's
+# history queries unless JOB_HISTORY_TTL_SECONDS sets it, as the API does
+DEFAULT_HISTORY_TTL_SECONDS = 30 * 86400
+
+# How long a job record's Redis TTL outlives its retention, only a safety
+# net as the API's sweeper removes expired jobs itself; kept in sync with
+# queue.RetentionGrace
+RETENTION_GRACE_SECONDS = 7 * 86400
+
+# Fields a transfer of the job to another owner rewrites, which the worker
+# takes from the stored record on every update
+TRANSFER_FIELDS = ("owner", "transfers", "deliveries", "options_version")
+
+# Lifecycle event types keyed by job status
+EVENT_TYPES = {
+    "pending": "submitted",
+    "processing": "started",
+    "completed": "completed",
+    "failed": "failed",
+    "retrying": "retrying",
+    "cancelled": "cancelled",
+}
+
 
 @dataclass
 class Job:
@@ -40,19 +114,538 @@ class Job:
     error: Optional[str] = None
     created_at: Optional[str] = None
     updated_at: Optional[str] = None
+    warnings: List[Dict[str, Any]] = field(default_factory=list)
+    # Durations measured by the worker, in milliseconds
+    queue_wait_ms: Optional[int] = None
+    processing_ms: Optional[int] = None
+    stage_timings: List[Dict[str, Any]] = field(default_factory=list)
+    # Fields written by the API that the worker doesn't manage, preserved on update
+    extra: Dict[str, Any] = field(default_factory=dict)
+    
+    def add_warning(self, code: str, message: str, params: Optional[Dict[str, str]] = None) -> None:
+        """Append a warning unless one with the same code is already recorded."""
+        if any(w.get("code") == code for w in self.warnings):
+            return
+        warning = {"code": code, "message": message}
+        if params:
+            warning["params"] = params
+        self.warnings.append(warning)
+        logger.info(f"Job {self.id} warning {code}: {message}")
+
+
+# Range of job options versions this worker understands
+MIN_OPTIONS_VERSION = 1
+MAX_OPTIONS_VERSION = 3
+
+# Seconds to wait before releasing a job this worker can't process
+OPTIONS_VERSION_DEFER_DELAY = 2
+
+# Warning codes attached by the worker
+WARNING_METADATA_DROPPED = "metadata_dropped"
+WARNING_EMPTY_MASK = "empty_mask"
+
+# Fraction of foreground pixels below which the mask is considered empty
+EMPTY_MASK_THRESHOLD = 0.01
+
+# Background the model sees behind transparent input pixels
+NEUTRAL_BACKGROUND = (128, 128, 128)
+
+# Modes Pillow decodes 16-bit grayscale PNGs to
+SIXTEEN_BIT_MODES = ("I", "I;16", "I;16B", "I;16L")
+
+# Error codes shared with the API; only server-side failures refund quota
+ERROR_CODE_INVALID_IMAGE = "invalid_image"
+ERROR_CODE_PROCESSING_ERROR = "processing_error"
+ERROR_CODE_ATTEMPT_ABANDONED = "attempt_abandoned"
+USER_ERROR_CODES = {ERROR_CODE_INVALID_IMAGE}
+
+# Error codes of failures worth another attempt, retried with a backoff of
+# 1s, 4s, 16s, and so on, matching the API's queue.RetryDelay
+RETRYABLE_ERROR_CODES = {ERROR_CODE_PROCESSING_ERROR}
+RETRY_BASE_DELAY = 1
+RETRY_BACKOFF_FACTOR = 4
+MAX_RETRY_DELAY = 300
+
+# Failed attempts kept in a job's history, the latest, matching the API's
+# queue.MaxAttemptHistory
+MAX_ATTEMPT_HISTORY = 20
+
+# Status changes kept in a job's timeline, the first and the latest,
+# matching the API's queue.MaxTimelineEvents
+MAX_TIMELINE_EVENTS = 50
+
+# Times write_job reads a job again after a version conflict before giving up
+MAX_WRITE_RETRIES = 5
+
+# Jobs waiting to be queued, scored by when they're due in Unix
+# milliseconds, which the API promotes onto the pending lists
+SCHEDULED_JOBS_KEY = prefixed("scheduled_jobs")
+
+# Seconds a refund marker is kept, matching the API's usage counter TTL
+QUOTA_REFUND_TTL = 48 * 3600
+
+# Returns a job's megapixel reservation exactly once, flooring usage at zero.
+# Kept in sync with refundQuotaScript in the Go API.
+REFUND_QUOTA_SCRIPT = """
+if redis.call("SET", KEYS[2], "1", "NX", "EX", ARGV[2]) == false then
+	return 0
+end
+local mp = tonumber(redis.call("HGET", KEYS[1], "mp") or "0")
+local refund = math.min(mp, tonumber(ARGV[1]))
+if refund > 0 then
+	redis.call("HINCRBY", KEYS[1], "mp", -refund)
+end
+return refund
+"""
+
+# Folds a processing duration into the rolling average in one step, so
+# workers finishing at once don't overwrite each other's updates
+RECORD_PROCESSING_TIME_SCRIPT = """
+local current = tonumber(redis.call("GET", KEYS[1]))
+local duration = tonumber(ARGV[1])
+local average = duration
+if current then
+	average = 0.8 * current + 0.2 * duration
+end
+redis.call("SET", KEYS[1], string.format("%.1f", average))
+return tostring(average)
+"""
+
+# Outcome counters kept for failure-rate alerting, matching the API's
+# outcomes:<minute> buckets
+OUTCOMES_TTL = 26 * 3600
+MAX_FAILURE_EXAMPLES = 5
+
+# Circuit breaker keys, configured by the API's BREAKER_* settings: the
+# latest outcomes, the key that stops claims while set, the settings, and
+# the trip counter
+BREAKER_OUTCOMES_KEY = prefixed("breaker:outcomes")
+BREAKER_OPEN_KEY = prefixed("breaker:open")
+BREAKER_CONFIG_KEY = prefixed("breaker:config")
+BREAKER_TRIPS_KEY = prefixed("breaker:trips")
+
+# Adds an outcome to the breaker's window and opens the breaker once too
+# many of a full window failed, returning 1 if it did.
+# Kept in sync with recordBreakerScript in the Go API.
+RECORD_BREAKER_SCRIPT = """
+local window = tonumber(redis.call("HGET", KEYS[3], "window") or "0")
+if window <= 0 then
+	return 0
+end
+redis.call("LPUSH", KEYS[1], ARGV[1])
+redis.call("LTRIM", KEYS[1], 0, window - 1)
+if redis.call("EXISTS", KEYS[2]) == 1 then
+	return 0
+end
+local outcomes = redis.call("LRANGE", KEYS[1], 0, -1)
+if #outcomes < window then
+	return 0
+end
+local failed = 0
+for _, outcome in ipairs(outcomes) do
+	if outcome == "1" then
+		failed = failed + 1
+	end
+end
+if failed < window * tonumber(redis.call("HGET", KEYS[3], "failure_rate")) then
+	return 0
+end
+redis.call("SET", KEYS[2], ARGV[2] .. " " .. failed .. " " .. window, "PX", redis.call("HGET", KEYS[3], "cooldown_ms"))
+redis.call("DEL", KEYS[1])
+redis.call("INCR", KEYS[4])
+return 1
+"""
+
+# Fault injection point the worker applies, configured through the API
+FAULT_RULES_KEY = prefixed("fault_rules")
+FAULT_WORKER_PROCESS = "worker.process"
+
+
+class InjectedFault(Exception):
+    """A failure injected for resilience testing."""
+
+
+class InvalidTransition(Exception):
+    """A job's stored status wasn't the one a write expected, as when the API
+    or another worker changed it first, matching the API's ErrInvalidTransition."""
+
+    def __init__(self, job_id: str, expected: str, current: Optional[str], detail: str = ""):
+        super().__init__(f"job {job_id} is {current or 'gone'}{detail}, not {expected}{detail and ' on this attempt'}")
+        self.current = current
+
+
+class JobNotFound(InvalidTransition):
+    """A job's record is gone, deleted or expired while this worker held it,
+    matching the API's ErrJobNotFound; writing it would bring it back."""
+
+    def __init__(self, job_id: str):
+        Exception.__init__(self, f"job {job_id} was removed")
+        self.current = None
+
+
+class VersionConflict(Exception):
+    """A job was written since this worker read it, matching the API's
+    ErrVersionConflict: read it again and reapply the change."""
+
+    def __init__(self, job_id: str, version: int, current: int):
+        super().__init__(f"job {job_id} is at version {current}, not {version}")
+
+
+class FencedWrite(InvalidTransition):
+    """A job was claimed again under another claim token since this worker
+    claimed it, as after a partition got it requeued, matching the API's
+    ErrFenced: someone else owns it now."""
+
+    def __init__(self, job_id: str, current: Optional[str]):
+        Exception.__init__(self, f"job {job_id} was claimed by another worker")
+        self.current = current
+
+
+# Extension results of each format are stored under, kept in sync with the
+# API's queue.FormatExt; formats are named as the API sniffs them
+FORMAT_EXTS = {"png": ".png", "jpeg": ".jpg", "gif": ".gif", "webp": ".webp"}
+
+
+def output_format(job: "Job") -> str:
+    """Returns the format a job's result is written in: the requested one,
+    otherwise the input's as the API sniffed it from the contents. JPEG can't
+    hold the cut-out's transparency, so JPEG inputs, and inputs the API
+    couldn't read, give PNG results."""
+    requested = (job.extra.get("options") or {}).get("format")
+    if requested:
+        return requested
+    input_format = job.extra.get("input_format")
+    if not input_format:
+        # Jobs submitted before the API sniffed inputs go by the extension
+        suffix = Path(job.input_path).suffix.lower()
+        input_format = "jpeg" if suffix == ".jpeg" else next((f for f, ext in FORMAT_EXTS.items() if ext == suffix), None)
+    if input_format not in FORMAT_EXTS or input_format == "jpeg":
+        return "png"
+    return input_format
+
+
+# Models a job can request, kept in sync with the API
+KNOWN_MODELS = ["u2net", "u2net_human_seg", "isnet-general-use"]
+AUTO_MODEL = "auto"
+
+# Job priorities, highest first, the order pending lists are drained in; kept in sync with the API
+PRIORITIES = ["high", "normal", "low"]
+NORMAL_PRIORITY = "normal"
+
+# Seconds between worker heartbeats; the API treats a worker silent for
+# 30 seconds as gone
+HEARTBEAT_INTERVAL = 10
+
+# Workers that may hold claims, each on its processing:<worker> list, which
+# the API requeues once the worker stops heartbeating
+CLAIM_WORKERS_KEY = prefixed("claim_workers")
+
+# Seconds an idle worker blocks waiting for a job, matching the API's ClaimWait
+CLAIM_WAIT = 1
+
+
+def record_status(timeline: List[Dict[str, Any]], job_dict: Dict[str, Any]) -> List[Dict[str, Any]]:
+    """Returns the timeline with the job's status added as of now unless it's
+    the latest event's, as the API's recordStatus does, keeping the first
+    event and the latest after it up to MAX_TIMELINE_EVENTS."""
+    status = job_dict["status"]
+    if timeline and timeline[-1].get("status") == status:
+        return timeline
+    event = {"status": status, "at": datetime.now(timezone.utc).isoformat(timespec="milliseconds").replace("+00:00", "Z")}
+    if status == "processing" and job_dict.get("worker_id"):
+        event["worker_id"] = job_dict["worker_id"]
+    if job_dict.get("error_code"):
+        event["note"] = job_dict["error_code"]
+    timeline = timeline + [event]
+    if len(timeline) > MAX_TIMELINE_EVENTS:
+        timeline = timeline[:1] + timeline[len(timeline) - MAX_TIMELINE_EVENTS + 1:]
+    return timeline
+
+
+def processing_key(worker_id: str) -> str:
+    """Returns the list of jobs a worker has claimed but not finished."""
+    return prefixed(f"processing:{worker_id}")
+
+
+# With REDIS_PENDING_STREAMS, pending jobs are entries of streams read by a
+# consumer group instead of list items, matching the API
+DEFAULT_STREAM_GROUP = "workers"
+STREAM_JOB_FIELD = "job_id"
+
+
+def stream_claims_key(worker_id: str) -> str:
+    """Returns the hash of the stream and entry of each job a worker has
+    read from the pending streams but not yet acknowledged."""
+    return prefixed(f"stream_claims:{worker_id}")
+
+
+# With QUEUE_SCHEDULING=fair, each pending list is split into a list per
+# owner, <list>:owner:<owner>, claimed from in the turns kept by the
+# rotation <list>:owners, matching the API. Jobs without an owner stay in
+# the list itself. Each queued job pushes a token onto <list>:notify, which
+# waiting claims block on.
+SCHEDULING_FIFO = "fifo"
+SCHEDULING_FAIR = "fair"
+
+# Times a claim reads the owner rotation again after owners joined it
+# while the pop script was being called
+FAIR_STALE_RETRIES = 3
+
+ENQUEUE_FAIR_SCRIPT = """
+redis.call("LPUSH", KEYS[1], ARGV[1])
+if not redis.call("LPOS", KEYS[2], ARGV[2]) then
+	redis.call("LPUSH", KEYS[2], ARGV[2])
+end
+redis.call("LPUSH", KEYS[3], 1)
+return 1
+"""
+
+# Takes the next owner's oldest job as the API's popFairScript does: the
+# list of owner ARGV[i] is KEYS[4+i], and 0 means an owner joined the
+# rotation since it was read
+POP_FAIR_SCRIPT = """
+local lists = {[""] = KEYS[3]}
+for i, owner in ipairs(ARGV) do
+	lists[owner] = KEYS[4 + i]
+end
+for i = 1, redis.call("LLEN", KEYS[1]) do
+	local owner = redis.call("RPOPLPUSH", KEYS[1], KEYS[1])
+	local list = lists[owner]
+	if not list then
+		redis.call("LPOP", KEYS[1])
+		redis.call("RPUSH", KEYS[1], owner)
+		return 0
+	end
+	local jobID = redis.call("RPOPLPUSH", list, KEYS[2])
+	if redis.call("LLEN", list) == 0 then
+		redis.call("LREM", KEYS[1], 0, owner)
+	end
+	if jobID then
+		redis.call("RPOP", KEYS[4])
+		return jobID
+	end
+end
+local jobID = redis.call("RPOPLPUSH", KEYS[3], KEYS[2])
+if jobID then
+	redis.call("RPOP", KEYS[4])
+else
+	redis.call("DEL", KEYS[4])
+end
+return jobID
+"""
+
+
+# Every job status, each with an index of its jobs matching the API's
+JOB_STATUSES = ("scheduled", "pending", "retrying", "processing", "completed", "failed", "cancelled")
+
+
+def status_index_key(status: str) -> str:
+    """Returns the sorted set of the jobs with a status, scored by when they
+    were last updated in Unix milliseconds."""
+    return prefixed(f"jobs_by_status:{status}")
+
+
+def finished_jobs_key() -> str:
+    """Returns the sorted set of the completed and failed jobs, scored by
+    when they finished in Unix milliseconds."""
+    return prefixed("completed_jobs")
+
+
+def job_summary_key(job_id: str) -> str:
+    """Returns the hash summarising a finished job for the API's history."""
+    return prefixed(f"job_summary:{job_id}")
+
+
+def job_summary(job_dict: Dict[str, Any]) -> Dict[str, Any]:
+    """Returns the fields of a finished job's summary hash, as the API
+    writes them."""
+    created = parse_timestamp(job_dict.get("created_at"))
+    return {
+        "status": job_dict["status"],
+        "owner": job_dict.get("owner") or "",
+        "model": job_dict.get("model") or "",
+        "error_code": job_dict.get("error_code") or "",
+        "created_at": int(created.timestamp() * 1000) if created else 0,
+        "queue_wait_ms": job_dict.get("queue_wait_ms") or 0,
+        "processing_ms": job_dict.get("processing_ms") or 0,
+        "input_bytes": job_dict.get("input_bytes") or 0,
+        "milli_megapixels": job_dict.get("milli_megapixels") or 0,
+        "attempts": job_dict.get("attempts") or 0,
+    }
+
+
+def cancel_key(job_id: str) -> str:
+    """Returns the key that, while set, asks workers to stop a job."""
+    return prefixed(f"cancel:{job_id}")
+
+
+# Statuses a job has once it won't change unless it's requeued
+FINISHED_STATUSES = ("completed", "failed", "cancelled")
+
+
+def job_events_channel(job_id: str) -> str:
+    """Returns the Pub/Sub channel a job's finish is announced on, matching the API's."""
+    return prefixed(f"job_events:{job_id}")
+
+
+def progress_key(job_id: str) -> str:
+    """Returns the hash of how far a job's processing has got, kept apart
+    from its record so reporting progress never rewrites the record."""
+    return prefixed(f"progress:{job_id}")
+
+
+# Seconds a job's progress outlives its last update, matching the API's ProgressTTL
+PROGRESS_TTL = 3600
+
+# Progress reported as inference starts, once the input is decoded
+INFERENCE_PROGRESS = 10
+
+
+# Recorded on the deliveries a cancelled job gives up
+CANCELLED_DELIVERY_ERROR = "Job cancelled"
+
+# Job fields the worker reads and writes itself
+JOB_FIELDS = {
+    "id", "status", "input_path", "output_path", "error", "created_at", "updated_at",
+    "warnings", "queue_wait_ms", "processing_ms", "stage_timings",
+}
+
+
+SENTINEL_SCHEME = "redis-sentinel://"
+DEFAULT_SENTINEL_PORT = 26379
+
+
+def connect_redis(redis_url: str, db: int = 0) -> redis.Redis:
+    """Connect to REDIS_URL: a host:port, a redis:// or rediss:// URL, a
+    comma-separated list of Redis Cluster nodes, or a redis-sentinel:// URL.
+
+    A redis:// URL may carry a password and a database as its path, which
+    replaces db; rediss:// connects over TLS. A cluster is reached through
+    connect_cluster. A Sentinel URL,
+    redis-sentinel://[:password@]host:port[,host:port]/master[/db] with an
+    optional ?sentinel_password=, names Sentinels and the master they manage;
+    the connection follows the master through failovers.
+    """
+    if is_cluster_url(redis_url):
+        return connect_cluster(redis_url)
+    if redis_url.startswith(("redis://", "rediss://")):
+        return redis.Redis.from_url(redis_url, db=db, decode_responses=True)
+    if not redis_url.startswith(SENTINEL_SCHEME):
+        return redis.Redis.from_url(f"redis://{redis_url}/{db}", decode_responses=True)
+
+    rest, _, query = redis_url[len(SENTINEL_SCHEME):].partition("?")
+    sentinel_password = parse_qs(query).get("sentinel_password", [None])[0]
+    password = None
+    if "@" in rest:
+        userinfo, _, rest = rest.rpartition("@")
+        password = unquote(userinfo.partition(":")[2]) or None
+
+    hosts, _, path = rest.partition("/")
+    sentinels = []
+    for host in hosts.split(","):
+        host = host.strip()
+        if not host:
+            continue
+        name, _, port = host.rpartition(":")
+        sentinels.append((name, int(port)) if name else (host, DEFAULT_SENTINEL_PORT))
+    master, _, db_part = path.partition("/")
+    if not sentinels or not master:
+        raise ValueError(f"Sentinel URL must name Sentinels and a master: {redis_url}")
+
+    sentinel = Sentinel(
+        sentinels,
+        socket_timeout=3,
+        sentinel_kwargs={"password": sentinel_password} if sentinel_password else None,
+    )
+    return sentinel.master_for(
+        master,
+        db=int(db_part) if db_part else db,
+        password=password,
+        socket_timeout=3,
+        decode_responses=True,
+    )
+
+
+def connect_cluster(redis_url: str) -> redis.Redis:
+    """Connect to the master of the Redis Cluster slot the queue's keys hash
+    to, found through the nodes listed.
+
+    Every key the worker touches begins with the KEY_PREFIX hash tag, so
+    that one node serves them all, and a plain client to it keeps the WATCH
+    transactions that redis-py 4.6's cluster client lacks. Once a failover
+    or resharding moves the slot, commands fail as slot_moved says; the
+    worker then exits and is restarted, connecting to the new master.
+    """
+    nodes = []
+    for host in redis_url.split(","):
+        host = host.strip()
+        if not host:
+            continue
+        name, _, port = host.rpartition(":")
+        nodes.append(ClusterNode(name, int(port)) if name else ClusterNode(host))
+    cluster = RedisCluster(startup_nodes=nodes, socket_timeout=3)
+    try:
+        node = cluster.get_node_from_key(KEY_PREFIX)
+        return redis.Redis(host=node.host, port=node.port, socket_timeout=3, decode_responses=True)
+    finally:
+        cluster.close()
+
+
+def slot_moved(e: Exception) -> bool:
+    """Whether e means the cluster node the worker is connected to no longer
+    serves the queue's slot, as after a failover or resharding."""
+    return isinstance(e, (redis.ConnectionError, MovedError, ReadOnlyError, ClusterDownError))
 
 
 class RedisJobQueue:
     """Redis-based job queue implementation."""
     
-    def __init__(self, redis_url: str = "localhost:6379", db: int = 0):
-        """Initialize the Redis connection."""
-        self.redis = redis.Redis.from_url(f"redis://{redis_url}/{db}", decode_responses=True)
+    def __init__(self, redis_url: str = "localhost:6379", db: int = 0,
+                 publish_events: bool = False, events_channel: str = "events:jobs",
+                 compression: str = COMPRESSION_NONE,
+                 compression_threshold: int = DEFAULT_COMPRESSION_THRESHOLD,
+                 job_ttls: Optional[Dict[str, int]] = None,
+                 history_ttl: int = 0,
+                 pending_streams: bool = False,
+                 stream_group: str = DEFAULT_STREAM_GROUP,
+                 scheduling: str = SCHEDULING_FIFO):
+        """Initialize the Redis connection.
+        
+        job_ttls maps pending, completed, and failed to the seconds a job
+        record without a retention snapshot is kept after an update to that
+        status; pending covers every unfinished status. history_ttl is the
+        seconds a finished job's summary is kept. With pending_streams, jobs
+        are claimed from the pending streams as stream_group, which must
+        match the API's. With scheduling fair, each owner's jobs wait in a
+        list of their own and owners are claimed from in turn, as the API's
+        QUEUE_SCHEDULING says.
+        """
+        self.redis = connect_redis(redis_url, db)
+        # A cluster connection is to one master, which slot_moved tells has lost the queue's slot
+        self.cluster = is_cluster_url(redis_url)
         self.pending_queue = "pending_jobs"
+        self.publish_events = publish_events
+        self.events_channel = events_channel
+        self.compression = compression
+        self.compression_threshold = compression_threshold
+        self.job_ttls = job_ttls or {}
+        self.history_ttl = history_ttl or DEFAULT_HISTORY_TTL_SECONDS
+        # The claimable model claim_job tries first, so models take turns
+        self.model_turn = 0
+        self.refund_quota_script = self.redis.register_script(REFUND_QUOTA_SCRIPT)
+        self.record_breaker_script = self.redis.register_script(RECORD_BREAKER_SCRIPT)
+        self.record_processing_time_script = self.redis.register_script(RECORD_PROCESSING_TIME_SCRIPT)
+        self.pending_streams = pending_streams
+        self.stream_group = stream_group
+        if pending_streams:
+            self.create_stream_groups()
+        self.scheduling = scheduling
+        self.enqueue_fair_script = self.redis.register_script(ENQUEUE_FAIR_SCRIPT)
+        self.pop_fair_script = self.redis.register_script(POP_FAIR_SCRIPT)
     
     def job_key(self, job_id: str) -> str:
         """Returns the Redis key for a job."""
-        return f"job:{job_id}"
+        return prefixed(f"job:{job_id}")
     
     def get_job(self, job_id: str) -> Optional[Job]:
         """Get a job by its ID."""
@@ -61,7 +654,7 @@ class RedisJobQueue:
             return None
         
         try:
-            job_dict = json.loads(job_data)
+            job_dict = decode_record(job_data)
             return Job(
                 id=job_dict["id"],
                 status=job_dict["status"],
@@ -69,20 +662,42 @@ class RedisJobQueue:
                 output_path=job_dict.get("output_path"),
                 error=job_dict.get("error"),
                 created_at=job_dict.get("created_at"),
-                updated_at=job_dict.get("updated_at")
+                updated_at=job_dict.get("updated_at"),
+                warnings=job_dict.get("warnings") or [],
+                queue_wait_ms=job_dict.get("queue_wait_ms"),
+                processing_ms=job_dict.get("processing_ms"),
+                stage_timings=job_dict.get("stage_timings") or [],
+                extra={k: v for k, v in job_dict.items() if k not in JOB_FIELDS}
             )
         except Exception as e:
             logger.error(f"Error parsing job data: {e}")
             return None
     
-    def update_job(self, job: Job) -> None:
-        """Update a job's status in Redis."""
-        job_dict = {
+    def update_job(self, job: Job, expected: Optional[str] = None, attempt: Optional[int] = None,
+                   token: Optional[str] = None) -> None:
+        """Update a job's status in Redis.
+        
+        The job is written only if the stored one is still at the version it
+        was read at, raising VersionConflict otherwise, and JobNotFound if its
+        record is gone, so a deleted job isn't brought back. With expected,
+        the job is written only if its stored status still is that, and with
+        attempt, only if it's still on that attempt, so a worker whose
+        attempt was given up on can't overwrite the one that took over.
+        Raises InvalidTransition otherwise, writing nothing. With token, the
+        job is written only if it's still claimed under that claim token,
+        raising FencedWrite otherwise. Use write_job to retry conflicts."""
+        # The status index is scored by the same second updated_at records
+        updated = int(time.time())
+        job_dict = dict(job.extra)
+        job_dict.update({
             "id": job.id,
             "status": job.status,
             "input_path": job.input_path,
-            "updated_at": time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime())
-        }
+            "updated_at": time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime(updated))
+        })
+        
+        if job.created_at:
+            job_dict["created_at"] = job.created_at
         
         if job.output_path:
             job_dict["output_path"] = job.output_path
@@ -90,104 +705,944 @@ class RedisJobQueue:
         if job.error:
             job_dict["error"] = job.error
         
-        self.redis.set(
-            self.job_key(job.id),
-            json.dumps(job_dict),
-            ex=86400  # 24 hours expiry
+        if job.warnings:
+            job_dict["warnings"] = job.warnings
+        
+        if job.queue_wait_ms is not None:
+            job_dict["queue_wait_ms"] = job.queue_wait_ms
+        
+        if job.processing_ms is not None:
+            job_dict["processing_ms"] = job.processing_ms
+        
+        if job.stage_timings:
+            job_dict["stage_timings"] = job.stage_timings
+        
+        # The API may give the job to another owner while it runs; keep what
+        # the transfer wrote rather than the copy claimed before it
+        key = self.job_key(job.id)
+        with self.redis.pipeline() as pipe:
+            while True:
+                try:
+                    pipe.watch(key)
+                    stored = pipe.get(key)
+                    if not stored:
+                        raise JobNotFound(job.id)
+                    current = decode_record(stored)
+                    if current.get("version", 0) != job.extra.get("version", 0):
+                        raise VersionConflict(job.id, job.extra.get("version", 0), current.get("version", 0))
+                    if expected is not None and current.get("status") != expected:
+                        raise InvalidTransition(job.id, expected, current.get("status"))
+                    if attempt is not None and current.get("attempts", 0) != attempt:
+                        raise InvalidTransition(job.id, expected, current.get("status"), f" on attempt {current.get('attempts', 0)}")
+                    if token is not None and current.get("claim_token", "") != token:
+                        raise FencedWrite(job.id, current.get("status"))
+                    for name in TRANSFER_FIELDS:
+                        if name in current:
+                            job_dict[name] = job.extra[name] = current[name]
+                    if job.status == "cancelled":
+                        for delivery in job_dict.get("deliveries") or []:
+                            if delivery.get("status") == "pending":
+                                delivery["status"] = "failed"
+                                delivery["last_error"] = CANCELLED_DELIVERY_ERROR
+                    job_dict["version"] = job.extra["version"] = current.get("version", 0) + 1
+                    # A change of status is added to the stored timeline
+                    timeline = current.get("timeline", [])
+                    job_dict["timeline"] = job.extra["timeline"] = record_status(timeline or [], job_dict)
+                    pipe.multi()
+                    pipe.set(
+                        key,
+                        encode_record(job_dict, self.compression, self.compression_threshold),
+                        ex=record_ttl(job, self.job_ttls)
+                    )
+                    for status in JOB_STATUSES:
+                        if status != job.status:
+                            pipe.zrem(status_index_key(status), job.id)
+                    pipe.zadd(status_index_key(job.status), {job.id: updated * 1000})
+                    if job.status in ("completed", "failed"):
+                        pipe.hset(job_summary_key(job.id), mapping=job_summary(job_dict))
+                        pipe.expire(job_summary_key(job.id), self.history_ttl)
+                        pipe.zadd(finished_jobs_key(), {job.id: updated * 1000})
+                    # Progress is shown only while processing; a new attempt reports afresh
+                    pipe.delete(progress_key(job.id))
+                    pipe.execute()
+                    break
+                except redis.WatchError:
+                    continue
+        
+        self.publish_event(job_dict)
+        self.notify_finished(job)
+    
+    def write_job(self, job: Job, expected: Optional[str] = None, attempt: Optional[int] = None,
+                  token: Optional[str] = None) -> None:
+        """update_job, reading the job again and reapplying the change after a
+        VersionConflict, as the API's callers do. The fields the API rewrites
+        while a job runs are taken from the stored job, the rest of this
+        worker's copy written over it, still guarded by expected, attempt,
+        and token. Raises VersionConflict after MAX_WRITE_RETRIES conflicts,
+        and JobNotFound once the record is gone."""
+        for retry in range(MAX_WRITE_RETRIES + 1):
+            try:
+                self.update_job(job, expected=expected, attempt=attempt, token=token)
+                return
+            except VersionConflict:
+                if retry == MAX_WRITE_RETRIES:
+                    raise
+            current = self.get_job(job.id)
+            if current is None:
+                raise JobNotFound(job.id)
+            for name in TRANSFER_FIELDS + ("version",):
+                if name in current.extra:
+                    job.extra[name] = current.extra[name]
+    
+    def notify_finished(self, job: Job) -> None:
+        """Announce on the job's channel that it finished, with its status,
+        for the API's WaitForJob. Published whether or not lifecycle events
+        are enabled, never raising on failure."""
+        if job.status not in FINISHED_STATUSES:
+            return
+        try:
+            self.redis.publish(job_events_channel(job.id), job.status)
+        except Exception as e:
+            logger.warning(f"Failed to announce that job {job.id} finished: {e}")
+    
+    def publish_event(self, job_dict: Dict[str, Any]) -> None:
+        """Publish a lifecycle event for the job, never raising on failure."""
+        if not self.publish_events:
+            return
+        
+        now = datetime.now(timezone.utc)
+        duration_ms = 0
+        created_at = parse_timestamp(job_dict.get("created_at"))
+        if created_at:
+            duration_ms = max(0, int((now - created_at).total_seconds() * 1000))
+        
+        selection = job_dict.get("model_selection") or {}
+        event = {
+            "v": EVENT_SCHEMA_VERSION,
+            "type": EVENT_TYPES.get(job_dict["status"], job_dict["status"]),
+            "job_id": job_dict["id"],
+            "status": job_dict["status"],
+            "model": selection.get("model") or job_dict.get("model") or DEFAULT_MODEL,
+            "duration_ms": duration_ms,
+            "ts": now.strftime("%Y-%m-%dT%H:%M:%SZ"),
+        }
+        for field in ("owner", "input_bytes", "output_bytes", "error_code"):
+            if job_dict.get(field):
+                event[field] = job_dict[field]
+        if job_dict.get("queue_wait_ms"):
+            event["queue_wait_ms"] = job_dict["queue_wait_ms"]
+            event["duration_ms"] = job_dict["queue_wait_ms"] + job_dict.get("processing_ms", 0)
+        if job_dict.get("processing_ms"):
+            event["processing_ms"] = job_dict["processing_ms"]
+        if job_dict.get("stage_timings"):
+            event["stage_timings"] = job_dict["stage_timings"]
+        if job_dict.get("error"):
+            event["error"] = job_dict["error"]
+        
+        try:
+            self.redis.publish(self.events_channel, json.dumps(event))
+        except Exception as e:
+            logger.warning(f"Failed to publish job event: {e}")
+    
+    def queue_wait_ms(self, job: Job) -> Optional[int]:
+        """Measure how long a claimed job waited, using the Redis clock the API stamped it with."""
+        enqueued_at_ms = job.extra.get("enqueued_at_ms")
+        if not enqueued_at_ms:
+            return None
+        seconds, microseconds = self.redis.time()
+        wait_ms = seconds * 1000 + microseconds // 1000 - int(enqueued_at_ms)
+        if wait_ms < 0:
+            logger.warning(f"Clamping negative queue wait of {wait_ms}ms for job {job.id}")
+            return 0
+        return wait_ms
+    
+    def record_processing_time(self, duration_ms: float) -> None:
+        """Fold a processing duration into the rolling average used for polling hints."""
+        try:
+            self.record_processing_time_script(keys=[prefixed("stats:avg_processing_ms")], args=[duration_ms])
+        except Exception as e:
+            logger.warning(f"Failed to record processing time: {e}")
+    
+    def refund_quota(self, job: Job) -> None:
+        """Return a failed job's megapixel reservation unless the failure was the user's."""
+        owner = job.extra.get("owner")
+        day = job.extra.get("quota_day")
+        cost = job.extra.get("milli_megapixels")
+        if job.status != "failed" or not owner or not day or not cost:
+            return
+        if job.extra.get("error_code") in USER_ERROR_CODES:
+            return
+        try:
+            self.refund_quota_script(
+                keys=[prefixed(f"usage:{owner}:{day}"), prefixed(f"quota_refund:{job.id}")],
+                args=[cost, QUOTA_REFUND_TTL],
+            )
+        except Exception as e:
+            logger.warning(f"Failed to refund quota for job {job.id}: {e}")
+    
+    def record_outcome(self, job: Job) -> None:
+        """Count a finished job in the current minute's outcome counters and
+        the circuit breaker's window."""
+        key = prefixed("outcomes:" + time.strftime("%Y%m%d%H%M", time.gmtime()))
+        selection = job.extra.get("model_selection") or {}
+        model = selection.get("model") or job.extra.get("model") or DEFAULT_MODEL
+        try:
+            pipe = self.redis.pipeline()
+            pipe.hincrby(key, "total", 1)
+            pipe.hincrby(key, f"model:{model}:total", 1)
+            if job.status == "failed":
+                code = job.extra.get("error_code") or "unknown"
+                pipe.hincrby(key, "failed", 1)
+                pipe.hincrby(key, f"code:{code}", 1)
+                pipe.hincrby(key, f"model:{model}:failed", 1)
+                for dimension in (f"code:{code}", f"model:{model}"):
+                    examples = prefixed(f"outcome_examples:{dimension}")
+                    pipe.lpush(examples, job.id)
+                    pipe.ltrim(examples, 0, MAX_FAILURE_EXAMPLES - 1)
+                    pipe.expire(examples, OUTCOMES_TTL)
+            pipe.expire(key, OUTCOMES_TTL)
+            pipe.execute()
+            opened = self.record_breaker_script(
+                keys=[BREAKER_OUTCOMES_KEY, BREAKER_OPEN_KEY, BREAKER_CONFIG_KEY, BREAKER_TRIPS_KEY],
+                args=["1" if job.status == "failed" else "0", int(time.time() * 1000)],
+            )
+            if opened:
+                config = self.redis.hgetall(BREAKER_CONFIG_KEY)
+                logger.critical(
+                    f"CIRCUIT BREAKER OPEN: at least {float(config.get('failure_rate', 0)):.0%} "
+                    f"of the last {config.get('window')} jobs failed, the latest {job.id} "
+                    f"({job.extra.get('error_code')}); workers stop claiming jobs for "
+                    f"{int(config.get('cooldown_ms', 0)) // 1000}s"
+                )
+        except Exception as e:
+            logger.warning(f"Failed to record outcome of job {job.id}: {e}")
+    
+    def maybe_fault(self, point: str, labels: Dict[str, Any]) -> None:
+        """Apply the shared fault rule for a point, raising InjectedFault if it fails the call."""
+        raw = self.redis.hget(FAULT_RULES_KEY, point)
+        if not raw:
+            return
+        rule = json.loads(raw)
+        if any(labels.get(name) != value for name, value in (rule.get("match") or {}).items()):
+            return
+        if random.random() >= rule.get("probability", 0):
+            return
+        if rule.get("latency_ms"):
+            time.sleep(rule["latency_ms"] / 1000)
+        if rule.get("fail"):
+            raise InjectedFault(f"{point}: injected fault")
+    
+    def schedule_deliveries(self, job: Job) -> None:
+        """Hand a completed job with external destinations to the API's delivery workers."""
+        if not job.extra.get("deliveries"):
+            return
+        self.redis.zadd(prefixed("delivery_queue"), {job.id: int(time.time() * 1000)})
+    
+    def heartbeat(self, worker_id: str, models: List[str]) -> None:
+        """Report this worker as alive with its loaded models, stamped with
+        the Redis clock, and keep its stream deliveries from being reclaimed."""
+        seconds, _ = self.redis.time()
+        self.redis.hset(prefixed("worker_heartbeats"), worker_id, json.dumps({
+            "model": models[0],
+            "models": models,
+            "ts": time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime(seconds)),
+        }))
+        if self.pending_streams:
+            self.refresh_claims(worker_id)
+    
+    def defer_job(self, worker_id: str, job: Job) -> None:
+        """Release a claimed job back to the pending queue for another worker."""
+        time.sleep(OPTIONS_VERSION_DEFER_DELAY)
+        self.release_job(worker_id, job.id)
+        self.redis.incr(prefixed("stats:options_version_deferrals"))
+    
+    def pending_name(self, model: Optional[str], priority: Optional[str] = None) -> str:
+        """Returns the name, without KEY_PREFIX, of the pending list for jobs
+        requesting a model at a priority, matching the API's routing."""
+        queue = self.pending_queue
+        if model and model != DEFAULT_MODEL:
+            queue = f"{queue}:{model}"
+        if priority in PRIORITIES and priority != NORMAL_PRIORITY:
+            queue = f"{queue}:{priority}"
+        return queue
+    
+    def queue_for(self, model: Optional[str], priority: Optional[str] = None) -> str:
+        """Returns the pending list for jobs requesting a model at a priority."""
+        return prefixed(self.pending_name(model, priority))
+    
+    def stream_for(self, model: Optional[str], priority: Optional[str] = None) -> str:
+        """Returns the pending stream replacing queue_for's list with pending_streams."""
+        return prefixed(f"stream:{self.pending_name(model, priority)}")
+    
+    def create_stream_groups(self) -> None:
+        """Create the consumer group on every pending stream, as the API does
+        at startup, so a worker started first can claim."""
+        for priority in PRIORITIES:
+            for model in [AUTO_MODEL] + KNOWN_MODELS:
+                try:
+                    self.redis.xgroup_create(self.stream_for(model, priority), self.stream_group, id="0", mkstream=True)
+                except redis.ResponseError as e:
+                    if not str(e).startswith("BUSYGROUP"):
+                        raise
+    
+    def enqueue(self, pipe, job: Job) -> None:
+        """Queue a pending job at the end of its list or stream."""
+        model, priority = job.extra.get("model"), job.extra.get("priority")
+        if self.pending_streams:
+            pipe.xadd(self.stream_for(model, priority), {STREAM_JOB_FIELD: job.id})
+        elif self.scheduling == SCHEDULING_FAIR:
+            key, owner = self.queue_for(model, priority), job.extra.get("owner") or ""
+            owner_list = f"{key}:owner:{owner}" if owner else key
+            self.enqueue_fair_script(keys=[owner_list, f"{key}:owners", f"{key}:notify"], args=[job.id, owner], client=pipe)
+        else:
+            pipe.lpush(self.queue_for(model, priority), job.id)
+    
+    def pop_pending(self, worker_id: str, model: str, priority: str, wait: int = 0) -> Optional[str]:
+        """Take the oldest job ID of a model's pending list or stream at a
+        priority as the worker's claim, blocking up to wait seconds if set."""
+        if self.scheduling == SCHEDULING_FAIR and not self.pending_streams:
+            return self.pop_fair(worker_id, self.queue_for(model, priority), wait)
+        if not self.pending_streams:
+            key = self.queue_for(model, priority)
+            if wait:
+                return self.redis.brpoplpush(key, processing_key(worker_id), wait)
+            return self.redis.rpoplpush(key, processing_key(worker_id))
+        stream = self.stream_for(model, priority)
+        delivered = self.redis.xreadgroup(
+            self.stream_group, worker_id, {stream: ">"}, count=1, block=wait * 1000 if wait else None,
         )
+        for _, entries in delivered or []:
+            for entry_id, fields in entries:
+                job_id = fields.get(STREAM_JOB_FIELD)
+                # Until recorded the delivery is only in the group's pending entries, which the API reclaims
+                self.redis.hset(stream_claims_key(worker_id), job_id, f"{stream} {entry_id}")
+                return job_id
+        return None
+    
+    def pop_fair(self, worker_id: str, key: str, wait: int = 0) -> Optional[str]:
+        """Take the oldest job ID of the next owner in turn with jobs in the
+        pending list key as the worker's claim, blocking on the key's notify
+        list for up to wait seconds if set until one is queued."""
+        deadline = time.monotonic() + wait
+        while True:
+            job_id = self.pop_fair_once(worker_id, key)
+            remaining = deadline - time.monotonic()
+            if job_id or remaining <= 0:
+                return job_id
+            # BLPOP waits whole seconds
+            self.redis.blpop([f"{key}:notify"], timeout=max(1, math.ceil(remaining)))
+    
+    def pop_fair_once(self, worker_id: str, key: str) -> Optional[str]:
+        """Run the pop script on the owner rotation of the pending list key as
+        just read, reading it again if owners joined it in between."""
+        for _ in range(FAIR_STALE_RETRIES):
+            owners = [owner for owner in self.redis.lrange(f"{key}:owners", 0, -1) if owner]
+            job_id = self.pop_fair_script(
+                keys=[f"{key}:owners", processing_key(worker_id), key, f"{key}:notify"]
+                + [f"{key}:owner:{owner}" for owner in owners],
+                args=owners,
+            )
+            if job_id != 0:
+                return job_id
+        return None
+    
+    def release_claim(self, pipe, worker_id: str, job_id: str) -> None:
+        """Release the worker's claim on a job as part of pipe: removed from
+        its processing list, or its stream entry acknowledged and deleted."""
+        if not self.pending_streams:
+            pipe.lrem(processing_key(worker_id), 1, job_id)
+            return
+        ref = self.redis.hget(stream_claims_key(worker_id), job_id)
+        if ref:
+            stream, _, entry_id = ref.partition(" ")
+            pipe.xack(stream, self.stream_group, entry_id)
+            pipe.xdel(stream, entry_id)
+        pipe.hdel(stream_claims_key(worker_id), job_id)
+    
+    def refresh_claims(self, worker_id: str) -> None:
+        """Reset the idle time of the worker's stream deliveries, so the API
+        only reclaims those of a worker that stopped."""
+        for ref in self.redis.hvals(stream_claims_key(worker_id)):
+            stream, _, entry_id = ref.partition(" ")
+            self.redis.xclaim(stream, self.stream_group, worker_id, 0, [entry_id], justid=True)
+    
+    def paused(self) -> bool:
+        """Whether an operator has paused job claiming, e.g. with `rmbgctl maintenance pause`,
+        or the circuit breaker has stopped it for a cool-down."""
+        return bool(self.redis.exists(prefixed("maintenance:paused"), BREAKER_OPEN_KEY))
+    
+    def claim_job(self, worker_id: str, models: List[str], wait: int = 0) -> Optional[Job]:
+        """Claim the next pending job for one of the loaded models.
+        
+        The job ID is moved atomically onto the worker's processing list, so it
+        isn't lost if the worker dies before finishing; release the claim
+        with ack_job or release_job. With wait, blocks up to that many seconds
+        for a normal-priority job of the worker's first model when every list
+        is empty. Higher priorities are drained first, across every model;
+        within a priority the models take turns, so a burst of jobs for a
+        slow model doesn't hold back those of a fast one.
+        """
+        # Auto jobs may need any model, so only workers with all of them claim those
+        claimable = [AUTO_MODEL] if set(KNOWN_MODELS) <= set(models) else []
+        claimable += models
+        
+        # Take a job ID from the first pending list that has one
+        if claimable:
+            turn = self.model_turn % len(claimable)
+            for priority in PRIORITIES:
+                for i in range(len(claimable)):
+                    index = (turn + i) % len(claimable)
+                    job_id = self.pop_pending(worker_id, claimable[index], priority)
+                    if job_id:
+                        self.model_turn = index + 1
+                    job = self._claim(worker_id, job_id)
+                    if job:
+                        return job
+        if wait and models:
+            # Redis can block on one list only; the others are seen on the next call
+            return self._claim(worker_id, self.pop_pending(worker_id, models[0], NORMAL_PRIORITY, wait))
+        return None
     
-    def get_pending_job(self) -> Optional[Job]:
-        """Get the next pending job from the queue."""
-        # Get a job ID from the pending jobs queue
-        job_id = self.redis.rpop(self.pending_queue)
+    def _claim(self, worker_id: str, job_id: Optional[str]) -> Optional[Job]:
+        """Returns the job just moved onto the worker's processing list."""
         if not job_id:
             return None
-        
-        return self.get_job(job_id)
+        # Recorded after the move, so the API's recovery never forgets a worker about to hold claims
+        if not self.pending_streams:
+            self.redis.sadd(CLAIM_WORKERS_KEY, worker_id)
+        job = self.get_job(job_id)
+        if job is None:
+            # The job expired while queued
+            self.ack_job(worker_id, job_id)
+        return job
+    
+    def cancel_requested(self, job_id: str) -> bool:
+        """Whether the API was asked to cancel the job."""
+        return bool(self.redis.exists(cancel_key(job_id)))
+    
+    def update_progress(self, job_id: str, progress: int, stage: str) -> None:
+        """Record how far a job's processing has got, from 0 to 100, and the
+        stage it's in, never raising on failure."""
+        key = progress_key(job_id)
+        try:
+            with self.redis.pipeline() as pipe:
+                pipe.hset(key, mapping={"progress": max(0, min(100, progress)), "stage": stage})
+                pipe.expire(key, PROGRESS_TTL)
+                pipe.execute()
+        except redis.RedisError as e:
+            logger.warning(f"Failed to record the progress of job {job_id}: {e}")
+    
+    def cancel_job(self, job: Job) -> None:
+        """Mark a job cancelled at the API's request, giving up its undelivered
+        destinations, and clear the request. A job the API finished meanwhile,
+        e.g. at the end of its lifetime, is left as it is."""
+        current = self.get_job(job.id)
+        if current is not None and current.status not in ("completed", "failed", "cancelled"):
+            job.status = "cancelled"
+            try:
+                self.write_job(job, expected=current.status, token=job.extra.get("claim_token", ""))
+            except InvalidTransition as e:
+                logger.info(f"Not cancelling job {job.id}: {e}")
+        self.redis.delete(cancel_key(job.id))
+    
+    def ack_job(self, worker_id: str, job_id: str) -> None:
+        """Release the worker's claim on a job it has finished with."""
+        pipe = self.redis.pipeline()
+        self.release_claim(pipe, worker_id, job_id)
+        pipe.execute()
+    
+    def release_job(self, worker_id: str, job_id: str, error: Optional[str] = None,
+                    token: Optional[str] = None) -> bool:
+        """Return a claimed job to its pending list, reset to pending, matching
+        the API's NackJob. A job being processed has the attempt added to its
+        history, failed with error if given, otherwise as abandoned. A job
+        that finished meanwhile, or with token was claimed again under
+        another, is only released. Returns whether the job was requeued."""
+        job = self.get_job(job_id)
+        if job is None or job.status in ("completed", "failed", "cancelled"):
+            self.ack_job(worker_id, job_id)
+            return False
+        if job.status == "processing":
+            job.error = error or "The attempt was abandoned before it finished"
+            job.extra["error_code"] = ERROR_CODE_PROCESSING_ERROR if error else ERROR_CODE_ATTEMPT_ABANDONED
+            self.record_attempt(job)
+            job.error = None
+            job.extra.pop("error_code", None)
+        if job.status != "pending":
+            status, job.status = job.status, "pending"
+            try:
+                self.write_job(job, expected=status, token=token)
+            except InvalidTransition:
+                # Finished or requeued by someone else meanwhile
+                self.ack_job(worker_id, job_id)
+                return False
+        # Push back before releasing, so a crash in between duplicates the entry rather than losing it
+        pipe = self.redis.pipeline()
+        self.enqueue(pipe, job)
+        self.release_claim(pipe, worker_id, job.id)
+        pipe.execute()
+        return True
+    
+    def record_attempt(self, job: Job) -> None:
+        """Add the job's current attempt, ending now with its current error, to
+        its attempt history, as the API's RetryJob does, keeping the latest
+        MAX_ATTEMPT_HISTORY."""
+        attempt = {
+            "attempt": job.extra.get("attempts", 0),
+            "error": job.error or "",
+            "error_code": job.extra.get("error_code"),
+            "failed_at": time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime()),
+        }
+        if job.extra.get("attempt_started_at"):
+            attempt["started_at"] = job.extra["attempt_started_at"]
+        if job.extra.get("worker_id"):
+            attempt["worker_id"] = job.extra["worker_id"]
+        history = job.extra.get("attempt_history") or []
+        job.extra["attempt_history"] = (history + [attempt])[-MAX_ATTEMPT_HISTORY:]
+    
+    def retry_job(self, worker_id: str, job: Job, delay: float) -> None:
+        """Schedule a job whose attempt failed to be queued again after delay,
+        matching the API's RetryJob. The attempt is recorded and its error
+        cleared, and the worker's claim released. Raises InvalidTransition if
+        the job is no longer on this attempt or claimed under its token."""
+        self.record_attempt(job)
+        seconds, microseconds = self.redis.time()
+        due = seconds + microseconds / 1e6 + delay
+        job.status = "retrying"
+        job.extra["retry_at"] = time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime(math.ceil(due)))
+        job.error = None
+        job.extra.pop("error_code", None)
+        self.write_job(job, expected="processing", attempt=job.extra.get("attempts", 0), token=job.extra.get("claim_token", ""))
+        pipe = self.redis.pipeline()
+        pipe.zadd(SCHEDULED_JOBS_KEY, {job.id: int(due * 1000)})
+        self.release_claim(pipe, worker_id, job.id)
+        pipe.execute()
+    
+    def recover_claims(self, worker_id: str) -> int:
+        """Requeue the jobs a previous run of this worker claimed but never finished."""
+        if self.pending_streams:
+            claimed = self.redis.hkeys(stream_claims_key(worker_id))
+        else:
+            claimed = self.redis.lrange(processing_key(worker_id), 0, -1)
+        return sum(self.release_job(worker_id, job_id) for job_id in claimed)
+
+
+def parse_timestamp(value: Optional[str]) -> Optional[datetime]:
+    """Parse an RFC3339 timestamp written by the API or the worker."""
+    if not value:
+        return None
+    try:
+        # Go writes nanosecond precision, which fromisoformat doesn't accept
+        value = value.replace("Z", "+00:00")
+        if "." in value:
+            head, rest = value.split(".", 1)
+            digits = len(rest) - len(rest.lstrip("0123456789"))
+            value = f"{head}.{rest[:min(digits, 6)]:0<6}{rest[digits:]}"
+        return datetime.fromisoformat(value)
+    except ValueError:
+        return None
+
+
+def record_ttl(job: Job, ttls: Dict[str, int]) -> int:
+    """Seconds a job record is kept from now: until the end of the retention
+    snapshotted onto it by the API, plus grace, or its status's TTL in ttls
+    without one."""
+    retention = job.extra.get("retention") or {}
+    created = parse_timestamp(job.created_at)
+    if not retention.get("result_seconds") or created is None:
+        # Cancelled jobs are kept as long as failed ones
+        status = {"completed": "completed", "failed": "failed", "cancelled": "failed"}.get(job.status, "pending")
+        return ttls.get(status) or DEFAULT_JOB_TTL_SECONDS
+    expires = created.timestamp() + retention["result_seconds"] + RETENTION_GRACE_SECONDS
+    return max(1, int(expires - time.time()))
+
+
+def retry_delay(attempt: int) -> float:
+    """Seconds to wait after a job's attempt-th failed attempt."""
+    return min(RETRY_BASE_DELAY * RETRY_BACKOFF_FACTOR ** (attempt - 1), MAX_RETRY_DELAY)
+
+
+def can_retry(job: Job) -> bool:
+    """Whether the job failed in a way worth retrying and has attempts left."""
+    if job.extra.get("error_code") not in RETRYABLE_ERROR_CODES:
+        return False
+    return job.extra.get("attempts", 0) < (job.extra.get("max_attempts") or 1)
+
+
+def lifetime_exceeded(job: Job) -> bool:
+    """Whether the job is past the maximum lifetime snapshotted onto it by the
+    API, which stops such jobs with error code lifetime_exceeded."""
+    lifetime = job.extra.get("max_lifetime_seconds")
+    created = parse_timestamp(job.created_at)
+    if not lifetime or created is None:
+        return False
+    return time.time() >= created.timestamp() + lifetime
 
 
 class ImageProcessor:
     """Handles the background removal processing."""
     
-    def __init__(self, model_name: str = "u2net"):
-        """Initialize the processor with the specified model."""
-        self.model_name = model_name
-        self.session = new_session(model_name)
+    def __init__(self, model_names: Optional[List[str]] = None, job_timeout: float = 0,
+                 stage_weights: Optional[Dict[str, float]] = None):
+        """Initialize the processor with a session for each of the specified models.
+        
+        A positive job_timeout is split across inference and the post-processing
+        stages by stage_weights.
+        """
+        self.model_names = model_names or [DEFAULT_MODEL]
+        self.sessions = {name: new_session(name) for name in self.model_names}
+        self.job_timeout = job_timeout
+        self.stage_weights = stage_weights
+        
+    def process_image(self, input_path: str, output_path: str, job: Optional[Job] = None,
+                      cancelled: Optional[Callable[[], bool]] = None,
+                      progress: Optional[Callable[[int, str], None]] = None) -> bool:
+        """Process an image to remove its background.
         
-    def process_image(self, input_path: str, output_path: str) -> bool:
-        """Process an image to remove its background."""
+        Raises JobCancelled if cancelled reports the job was cancelled before
+        inference or a post-processing stage. progress, if given, is told the
+        job's progress and stage as decoding, inference, and each
+        post-processing stage start.
+        """
+        report = progress or (lambda percent, stage: None)
         try:
             # Read input image
-            input_image = Image.open(input_path)
+            report(0, "decode")
+            input_image = to_8bit(Image.open(input_path))
+        except Exception as e:
+            logger.error(f"Error reading image: {str(e)}")
+            if job:
+                job.extra["error_code"] = ERROR_CODE_INVALID_IMAGE
+            return False
+        
+        budget = None
+        try:
+            options = (job.extra.get("options") or {}) if job else {}
+            order = job.extra.get("pipeline") if job else None
+            stages = build_pipeline(options, order)
+            budget = Budget(self.job_timeout, ["inference"] + [stage.name for stage in stages], self.stage_weights)
+            
+            if cancelled and cancelled():
+                raise JobCancelled("inference")
+            report(INFERENCE_PROGRESS, "inference")
+            budget.start("inference")
+            
+            # Show the model transparent inputs over a neutral background,
+            # keeping their alpha to combine with the mask
+            alpha = input_alpha(input_image)
+            if job:
+                job.extra["input_has_alpha"] = alpha is not None
+            if options.get("respect_input_alpha") == "false":
+                alpha = None
+            model_input = input_image if alpha is None else flatten(input_image)
+            
+            model = self.choose_model(model_input, job)
+            
+            if job and "exif" in input_image.info:
+                job.add_warning(WARNING_METADATA_DROPPED, "EXIF metadata is not copied to the output")
             
             # Process image using rembg
             output_data = remove(
-                input_image,
-                session=self.session,
+                model_input,
+                session=self.sessions[model],
                 alpha_matting=True,
                 alpha_matting_foreground_threshold=240,
                 alpha_matting_background_threshold=10,
                 alpha_matting_erode_size=10
             )
+            if alpha is not None:
+                output_data = apply_input_alpha(input_image, output_data, alpha)
+            budget.finish("inference")
+            
+            if job:
+                alpha = np.asarray(output_data.getchannel("A"))
+                foreground = float((alpha >= 128).mean()) if alpha.size else 0.0
+                if foreground < EMPTY_MASK_THRESHOLD:
+                    job.add_warning(
+                        WARNING_EMPTY_MASK,
+                        "Almost no foreground was detected in the image",
+                        {"foreground_ratio": f"{foreground:.4f}"},
+                    )
             
-            # Save processed image
-            output_data.save(output_path)
+            # Run the post-processing stages, the last of which saves the image
+            ctx = PipelineContext(options, output_path, cancelled, progress)
+            run_pipeline(output_data.convert("RGBA"), stages, ctx, budget)
+            if job and ctx.composite_mode:
+                job.extra["composite_mode"] = ctx.composite_mode
             return True
+        except StageTimeout as e:
+            logger.error(f"Timed out processing image: {e}")
+            if job:
+                job.extra["error_code"] = e.error_code
+            return False
+        except JobCancelled:
+            raise
         except Exception as e:
             logger.error(f"Error processing image: {str(e)}")
             traceback.print_exc()
+            if job:
+                job.extra["error_code"] = ERROR_CODE_PROCESSING_ERROR
             return False
+        finally:
+            # Timings of the stages that ran are kept on failure too
+            if job and budget:
+                job.stage_timings = budget.timings
+
+
+    def choose_model(self, image: Image.Image, job: Optional[Job]) -> str:
+        """Resolve the job's requested model, selecting one from the content for auto jobs."""
+        requested = (job.extra.get("model") if job else None) or DEFAULT_MODEL
+        if requested == AUTO_MODEL:
+            selection = select_model(image)
+            job.extra["model_selection"] = selection
+            logger.info(f"Job {job.id} auto-selected {selection['model']} ({selection['confidence']}): {selection['reason']}")
+            requested = selection["model"]
+        if requested not in self.sessions:
+            raise ValueError(f"Model {requested} is not loaded by this worker")
+        return requested
+
+
+def to_8bit(image: Image.Image) -> Image.Image:
+    """Load the image, scaling 16-bit grayscale down to 8 bits.
+    
+    Pillow converts such images to RGB by clipping each value at 255, which
+    turns all but the darkest pixels white, so they're scaled here instead.
+    """
+    image.load()
+    if image.mode not in SIXTEEN_BIT_MODES:
+        return image
+    values = np.asarray(image, dtype=np.float32) / 65535 * 255
+    return Image.fromarray(np.round(np.clip(values, 0, 255)).astype(np.uint8), "L")
+
+
+def input_alpha(image: Image.Image) -> Optional[Image.Image]:
+    """Return the image's alpha channel if any pixel is not fully opaque."""
+    if image.mode not in ("RGBA", "LA", "PA") and "transparency" not in image.info:
+        return None
+    alpha = image.convert("RGBA").getchannel("A")
+    return alpha if alpha.getextrema()[0] < 255 else None
+
+
+def flatten(image: Image.Image) -> Image.Image:
+    """Composite the image onto the neutral background as the model input."""
+    rgba = image.convert("RGBA")
+    flat = Image.new("RGB", rgba.size, NEUTRAL_BACKGROUND)
+    flat.paste(rgba, mask=rgba.getchannel("A"))
+    return flat
+
+
+def apply_input_alpha(image: Image.Image, output: Image.Image, alpha: Image.Image) -> Image.Image:
+    """Combine the model's mask with the input alpha over the input's own colors.
+    
+    Multiplying keeps transparent input regions transparent and soft edges
+    soft, and using the input colors avoids fringes of the neutral background.
+    """
+    result = image.convert("RGBA")
+    result.putalpha(ImageChops.multiply(output.convert("RGBA").getchannel("A"), alpha))
+    return result
+
+
+def supports_options_version(job: Job) -> bool:
+    """Check whether this worker understands the options the API wrote for the job."""
+    version = job.extra.get("options_version", MIN_OPTIONS_VERSION)
+    return MIN_OPTIONS_VERSION <= version <= MAX_OPTIONS_VERSION
 
 
 def worker_process(worker_id: int, redis_url: str, results_dir: str):
     """Worker process function that processes jobs from the queue."""
     logger.info(f"Worker {worker_id} started")
+    ignore_options_version = os.environ.get("IGNORE_OPTIONS_VERSION", "false") == "true"
+    fault_injection = os.environ.get("FAULT_INJECTION", "false") == "true"
     
     # Initialize the job queue and image processor
-    job_queue = RedisJobQueue(redis_url)
-    processor = ImageProcessor()
+    job_queue = RedisJobQueue(
+        redis_url,
+        publish_events=os.environ.get("PUBLISH_JOB_EVENTS", "false") == "true",
+        events_channel=os.environ.get("JOB_EVENTS_CHANNEL", "events:jobs"),
+        compression=os.environ.get("JOB_COMPRESSION", COMPRESSION_NONE),
+        compression_threshold=int(os.environ.get("JOB_COMPRESSION_THRESHOLD", DEFAULT_COMPRESSION_THRESHOLD)),
+        job_ttls={
+            status: int(os.environ.get(f"JOB_{status.upper()}_TTL_SECONDS", "0"))
+            for status in ("pending", "completed", "failed")
+        },
+        history_ttl=int(os.environ.get("JOB_HISTORY_TTL_SECONDS", "0")),
+        pending_streams=os.environ.get("REDIS_PENDING_STREAMS", "false") == "true",
+        stream_group=os.environ.get("REDIS_STREAM_GROUP", DEFAULT_STREAM_GROUP),
+        scheduling=os.environ.get("QUEUE_SCHEDULING", SCHEDULING_FIFO),
+    )
+    models = [m.strip() for m in os.environ.get("MODELS", DEFAULT_MODEL).split(",") if m.strip()]
+    processor = ImageProcessor(
+        models,
+        job_timeout=float(os.environ.get("JOB_TIMEOUT_SECONDS", "0")),
+        stage_weights=parse_stage_weights(os.environ.get("STAGE_BUDGET_WEIGHTS", "")),
+    )
+    
+    # Report liveness from a thread so long jobs don't look like a dead worker
+    heartbeat_id = f"{socket.gethostname()}-{worker_id}"
+    def send_heartbeats():
+        while True:
+            try:
+                job_queue.heartbeat(heartbeat_id, processor.model_names)
+            except Exception as e:
+                logger.warning(f"Worker {worker_id} heartbeat failed: {e}")
+            time.sleep(HEARTBEAT_INTERVAL)
+    threading.Thread(target=send_heartbeats, daemon=True).start()
+    
+    # Jobs still claimed under this worker's ID were left by a run that died
+    recovered = job_queue.recover_claims(heartbeat_id)
+    if recovered:
+        logger.info(f"Worker {worker_id} requeued {recovered} jobs left claimed by its previous run")
     
     while True:
+        job = None
         try:
-            # Get a pending job
-            job = job_queue.get_pending_job()
-            if not job:
-                # No job available, sleep before trying again
+            # Leave pending jobs alone while an operator or the circuit breaker has paused processing
+            if job_queue.paused():
                 time.sleep(1)
                 continue
             
+            # Get a pending job, waiting for one rather than polling
+            job = job_queue.claim_job(heartbeat_id, processor.model_names, wait=CLAIM_WAIT)
+            if not job:
+                continue
+            
+            # Skip duplicate queue entries, e.g. from a retried write whose reply was lost
+            if job.status != "pending":
+                logger.info(f"Worker {worker_id} skipping job {job.id} with status {job.status}")
+                job_queue.ack_job(heartbeat_id, job.id)
+                continue
+            
+            # A job cancelled as it was claimed, or while claimed by a worker
+            # that crashed, is marked cancelled rather than started
+            if job_queue.cancel_requested(job.id):
+                logger.info(f"Worker {worker_id} skipping cancelled job {job.id}")
+                job_queue.cancel_job(job)
+                job_queue.ack_job(heartbeat_id, job.id)
+                continue
+            
+            # Jobs past their lifetime are failed by the API; don't start them
+            if lifetime_exceeded(job):
+                logger.info(f"Worker {worker_id} skipping job {job.id} past its maximum lifetime")
+                job_queue.ack_job(heartbeat_id, job.id)
+                continue
+            
+            # Leave jobs written by a newer API for workers that understand them
+            if not ignore_options_version and not supports_options_version(job):
+                logger.warning(
+                    f"Worker {worker_id} deferring job {job.id} with unsupported "
+                    f"options version {job.extra.get('options_version')}"
+                )
+                job_queue.defer_job(heartbeat_id, job)
+                continue
+            
             logger.info(f"Worker {worker_id} processing job {job.id}")
             
-            # Update job status to processing
+            # Update job status to processing, counting the attempt under a
+            # new claim token that fences off whoever held the job before
             job.status = "processing"
-            job_queue.update_job(job)
+            job.extra["attempts"] = job.extra.get("attempts", 0) + 1
+            job.extra["attempt_started_at"] = time.strftime("%Y-%m-%dT%H:%M:%SZ", time.gmtime())
+            job.extra["worker_id"] = heartbeat_id
+            job.extra["claim_token"] = uuid.uuid4().hex
+            job.queue_wait_ms = job_queue.queue_wait_ms(job)
+            try:
+                job_queue.write_job(job, expected="pending")
+            except InvalidTransition as e:
+                # Claimed twice, as after a requeue that pushed it again
+                logger.info(f"Worker {worker_id} skipping job {job.id}: {e}")
+                job_queue.ack_job(heartbeat_id, job.id)
+                continue
             
-            # Create output path
-            input_path = Path(job.input_path)
-            output_filename = f"{job.id}-output{input_path.suffix}"
+            # Simulate the worker crashing with the job claimed; the pool restarts it
+            if fault_injection:
+                try:
+                    job_queue.maybe_fault(FAULT_WORKER_PROCESS, {"job_id": job.id, "owner": job.extra.get("owner")})
+                except InjectedFault as e:
+                    logger.error(f"Worker {worker_id} crashing with job {job.id} claimed: {e}")
+                    os._exit(1)
+            
+            # Name the result after the format it's written in, which the API
+            # serves it as; lowercase like every other storage key
+            result_format = output_format(job)
+            output_filename = f"{job.id}-output{FORMAT_EXTS[result_format]}"
             output_path = str(Path(results_dir) / output_filename)
             
             # Ensure results directory exists
             os.makedirs(results_dir, exist_ok=True)
             
-            # Process the image
-            success = processor.process_image(job.input_path, output_path)
+            # Process the image, stopping between stages if the job is cancelled
+            started = time.monotonic()
+            try:
+                success = processor.process_image(
+                    job.input_path, output_path, job, lambda: job_queue.cancel_requested(job.id),
+                    lambda percent, stage: job_queue.update_progress(job.id, percent, stage)
+                )
+                # A result finished after the cancellation is dropped too
+                if job_queue.cancel_requested(job.id):
+                    raise JobCancelled("completion")
+            except JobCancelled as e:
+                job.processing_ms = int((time.monotonic() - started) * 1000)
+                logger.info(f"Worker {worker_id} stopped job {job.id}: {e}")
+                if os.path.exists(output_path):
+                    os.remove(output_path)
+                job_queue.cancel_job(job)
+                job_queue.ack_job(heartbeat_id, job.id)
+                continue
+            job.processing_ms = int((time.monotonic() - started) * 1000)
             
-            if success:
-                # Update job status to completed
-                job.status = "completed"
-                job.output_path = output_path
-            else:
-                # Update job status to failed
-                job.status = "failed"
-                job.error = "Failed to process image"
+            # The API may have stopped the job at the end of its lifetime, or
+            # given it to another worker after this attempt overran, meanwhile;
+            # the result is only written if the job is still on this attempt
+            try:
+                if success:
+                    # Update job status to completed
+                    job.status = "completed"
+                    job.output_path = output_path
+                    job.extra["output_format"] = result_format
+                    job.extra["output_bytes"] = os.path.getsize(output_path)
+                else:
+                    job.error = "Failed to process image"
+                    if can_retry(job):
+                        delay = retry_delay(job.extra["attempts"])
+                        job_queue.retry_job(heartbeat_id, job, delay)
+                        logger.info(f"Worker {worker_id} retrying job {job.id} in {delay}s after attempt {job.extra['attempts']} failed")
+                        continue
+                    # Update job status to failed, recording the last attempt
+                    job.status = "failed"
+                    job_queue.record_attempt(job)
+                
+                job_queue.write_job(job, expected="processing", attempt=job.extra["attempts"], token=job.extra["claim_token"])
+            except InvalidTransition as e:
+                logger.info(f"Worker {worker_id} dropping result of job {job.id}: {e}")
+                # A completed job's result is at the same path, as is the one
+                # the worker that took over is writing; keep it
+                if success and e.current not in ("completed", "processing") and os.path.exists(output_path):
+                    os.remove(output_path)
+                job_queue.ack_job(heartbeat_id, job.id)
+                continue
             
-            job_queue.update_job(job)
+            if job.status == "completed":
+                job_queue.record_processing_time(job.processing_ms)
+                job_queue.schedule_deliveries(job)
+            else:
+                job_queue.refund_quota(job)
+            job_queue.record_outcome(job)
+            job_queue.ack_job(heartbeat_id, job.id)
             logger.info(f"Worker {worker_id} completed job {job.id} with status {job.status}")
             
         except Exception as e:
             logger.error(f"Worker {worker_id} error: {str(e)}")
             traceback.print_exc()
+            # Give the job to another worker rather than leaving it claimed
+            if job:
+                try:
+                    job_queue.release_job(heartbeat_id, job.id, error=str(e), token=job.extra.get("claim_token"))
+                except Exception as release_error:
+                    logger.error(f"Worker {worker_id} failed to release job {job.id}: {release_error}")
+            if job_queue.cluster and slot_moved(e):
+                # Restarted, the worker connects to the slot's new master and requeues its claims
+                logger.error(f"Worker {worker_id} exiting: its cluster node no longer serves the queue")
+                os._exit(1)
             time.sleep(5)  # Sleep to avoid tight error loop
 
 
@@ -200,21 +1655,26 @@ def main():
     
     logger.info(f"Starting {num_workers} workers")
     
-    # Create worker processes
-    processes = []
-    for i in range(num_workers):
+    def start_worker(i: int) -> multiprocessing.Process:
         p = multiprocessing.Process(
             target=worker_process,
             args=(i, redis_url, results_dir)
         )
         p.daemon = True
         p.start()
-        processes.append(p)
+        return p
+    
+    # Create worker processes
+    processes = [start_worker(i) for i in range(num_workers)]
     
     try:
-        # Wait for all processes to finish (they won't)
-        for p in processes:
-            p.join()
+        # Restart workers that die; a restarted worker requeues the jobs it had claimed
+        while True:
+            time.sleep(1)
+            for i, p in enumerate(processes):
+                if not p.is_alive():
+                    logger.warning(f"Worker {i} exited with code {p.exitcode}, restarting")
+                    processes[i] = start_worker(i)
     except KeyboardInterrupt:
         logger.info("Shutting down workers")
         for p in processes:
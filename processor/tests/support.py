@@ -0,0 +1,44 @@
+"""
+Shared setup for the processor tests: puts the worker sources on the path
+and stands in for rembg, whose sessions download and load models, so the
+tests run without them. Tests replace worker.remove with a fake model.
+"""
+
+import os
+import sys
+import types
+
+sys.path.insert(0, os.path.join(os.path.dirname(os.path.abspath(__file__)), "..", "src"))
+
+if "rembg" not in sys.modules:
+    rembg = types.ModuleType("rembg")
+    rembg.new_session = lambda name: name
+
+    def remove(*args, **kwargs):
+        raise AssertionError("the model isn't available in tests; patch worker.remove")
+
+    rembg.remove = remove
+    sys.modules["rembg"] = rembg
+
+
+def fake_queue(**options):
+    """A RedisJobQueue over an in-memory fakeredis server, with the options
+    given, and the server's client for inspecting what it wrote."""
+    import fakeredis
+    from unittest import mock
+
+    import worker
+
+    client = fakeredis.FakeRedis(decode_responses=True)
+    with mock.patch.object(worker, "connect_redis", lambda url, db=0: client):
+        return worker.RedisJobQueue(**options), client
+
+
+def add_job(client, job_id, **fields):
+    """Store a job record as the API writes it, with the fields given."""
+    import worker
+
+    record = {"id": job_id, "status": "pending", "input_path": f"/uploads/{job_id}.png", "version": 1}
+    record.update(fields)
+    client.set(worker.prefixed(f"job:{job_id}"), worker.encode_record(record))
+    return record
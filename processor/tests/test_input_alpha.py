@@ -0,0 +1,127 @@
+"""
+Golden tests for keeping the alpha of transparent inputs: the model sees
+the input flattened onto the neutral background, and its mask is combined
+with the input alpha over the input's own colors unless the job opts out.
+"""
+
+import os
+import tempfile
+import unittest
+from unittest import mock
+
+import support  # noqa: F401  Puts the worker on the path without rembg
+
+from PIL import Image
+
+import worker
+
+# A 2x2 input: opaque, fully transparent, half transparent, and faint
+INPUT = [(200, 100, 50, 255), (10, 20, 30, 0), (60, 120, 180, 128), (255, 255, 255, 51)]
+
+# The alpha the fake model's mask gives each pixel
+MASK = [64, 200, 255, 85]
+
+# The mask multiplied with the input alpha, over the input's colors
+GOLDEN_RESPECTED = [(200, 100, 50, 64), (10, 20, 30, 0), (60, 120, 180, 128), (255, 255, 255, 17)]
+
+# The mask alone, as the model returns it for the unflattened input
+GOLDEN_IGNORED = [(200, 100, 50, 64), (10, 20, 30, 200), (60, 120, 180, 255), (255, 255, 255, 85)]
+
+
+class FakeModel:
+    """Stands in for rembg.remove: returns its input's colors with MASK as
+    their alpha, and records the images it was given."""
+
+    def __init__(self):
+        self.inputs = []
+
+    def __call__(self, image, **kwargs):
+        self.inputs.append(image.copy())
+        output = image.convert("RGBA")
+        mask = Image.new("L", image.size)
+        mask.putdata(MASK)
+        output.putalpha(mask)
+        return output
+
+
+class InputAlphaTest(unittest.TestCase):
+    def setUp(self):
+        self.dir = tempfile.TemporaryDirectory()
+        self.addCleanup(self.dir.cleanup)
+        self.input_path = os.path.join(self.dir.name, "input.png")
+        self.output_path = os.path.join(self.dir.name, "output.png")
+        self.model = FakeModel()
+        patcher = mock.patch.object(worker, "remove", self.model)
+        patcher.start()
+        self.addCleanup(patcher.stop)
+        self.processor = worker.ImageProcessor()
+
+    def write_input(self, mode="RGBA"):
+        image = Image.new("RGBA", (2, 2))
+        image.putdata(INPUT)
+        image.convert(mode).save(self.input_path)
+
+    def process(self, options):
+        job = worker.Job(id="job-1", status="processing", input_path=self.input_path,
+                         extra={"options": options})
+        self.assertTrue(self.processor.process_image(self.input_path, self.output_path, job))
+        with Image.open(self.output_path) as output:
+            return job, list(output.convert("RGBA").getdata())
+
+    def test_partial_alpha_is_kept(self):
+        self.write_input()
+        job, pixels = self.process({})
+
+        self.assertEqual(pixels, GOLDEN_RESPECTED)
+        self.assertTrue(job.extra["input_has_alpha"])
+        # The model saw opaque pixels as they are and the rest over the
+        # neutral background, never the input's hidden colors
+        model_input = list(self.model.inputs[0].convert("RGB").getdata())
+        self.assertEqual(self.model.inputs[0].mode, "RGB")
+        self.assertEqual(model_input[0], INPUT[0][:3])
+        self.assertEqual(model_input[1], worker.NEUTRAL_BACKGROUND)
+        for got, want in zip(model_input[2], (94, 124, 154)):
+            self.assertLessEqual(abs(got - want), 1, f"half-transparent pixel flattened to {model_input[2]}")
+
+    def test_respect_input_alpha_false_uses_the_mask_alone(self):
+        self.write_input()
+        job, pixels = self.process({"respect_input_alpha": "false"})
+
+        self.assertEqual(pixels, GOLDEN_IGNORED)
+        # Still reported, so clients can tell the input had alpha
+        self.assertTrue(job.extra["input_has_alpha"])
+        self.assertEqual(self.model.inputs[0].mode, "RGBA")
+
+    def test_opaque_input_uses_the_mask(self):
+        self.write_input("RGB")
+        job, pixels = self.process({})
+
+        self.assertEqual(pixels, [(r, g, b, a) for (r, g, b, _), a in zip(INPUT, MASK)])
+        self.assertFalse(job.extra["input_has_alpha"])
+
+
+class ApplyInputAlphaTest(unittest.TestCase):
+    def test_golden(self):
+        image = Image.new("RGBA", (2, 2))
+        image.putdata(INPUT)
+        # The model's colors are the neutral background, which must not leak
+        output = Image.new("RGBA", (2, 2), worker.NEUTRAL_BACKGROUND + (255,))
+        mask = Image.new("L", (2, 2))
+        mask.putdata(MASK)
+        output.putalpha(mask)
+
+        result = worker.apply_input_alpha(image, output, worker.input_alpha(image))
+        self.assertEqual(list(result.getdata()), GOLDEN_RESPECTED)
+
+    def test_input_alpha(self):
+        opaque = Image.new("RGBA", (2, 2), (1, 2, 3, 255))
+        self.assertIsNone(worker.input_alpha(opaque))
+        self.assertIsNone(worker.input_alpha(opaque.convert("RGB")))
+
+        image = Image.new("RGBA", (2, 2))
+        image.putdata(INPUT)
+        self.assertEqual(list(worker.input_alpha(image).getdata()), [a for *_, a in INPUT])
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,156 @@
+"""
+Golden tests for the post-processing stages and the pipeline running them.
+"""
+
+import os
+import tempfile
+import unittest
+
+import support  # noqa: F401  Puts the worker on the path
+
+from PIL import Image
+
+from pipeline import (
+    COMPOSITE_FAST, COMPOSITE_LINEAR, SHADOW_BLUR, SHADOW_OFFSET, JobCancelled,
+    PipelineContext, build_pipeline, composite_linear, default_stages, run_pipeline,
+)
+
+# Pixels blended over white and over #336699, with their expected results
+# in linear light: red and blue at partial alpha, opaque green, a hidden
+# pixel, and an orange at three quarters
+PIXELS = [(255, 0, 0, 128), (0, 0, 255, 64), (0, 255, 0, 255), (12, 34, 56, 0), (200, 100, 50, 192)]
+GOLDEN_LINEAR = {
+    "#ffffff": [(255, 187, 187, 255), (224, 224, 255, 255), (0, 255, 0, 255), (255, 255, 255, 255), (215, 158, 142, 255)],
+    "#336699": [(191, 73, 111, 255), (44, 89, 186, 255), (0, 255, 0, 255), (51, 102, 153, 255), (178, 100, 90, 255)],
+}
+
+
+def row(pixels):
+    image = Image.new("RGBA", (len(pixels), 1))
+    image.putdata(pixels)
+    return image
+
+
+def run(image, options, order=None):
+    """Run the stages the options enable, saving to a temporary PNG, and
+    return the saved image and the context"""
+    with tempfile.TemporaryDirectory() as tmp:
+        ctx = PipelineContext(options, os.path.join(tmp, "output.png"))
+        run_pipeline(image, build_pipeline(options, order), ctx)
+        with Image.open(ctx.output_path) as saved:
+            return saved.convert("RGBA"), ctx
+
+
+class CompositeTest(unittest.TestCase):
+    def test_linear_golden(self):
+        for background, want in GOLDEN_LINEAR.items():
+            output, ctx = run(row(PIXELS), {"background": background})
+            self.assertEqual(list(output.getdata()), want, background)
+            self.assertEqual(ctx.composite_mode, COMPOSITE_LINEAR)
+
+    def test_linear_keeps_edges_bright(self):
+        # Mixing sRGB bytes darkens a half-transparent red edge over white
+        # to about 127 in green and blue; linear light keeps it near 187
+        fast, ctx = run(row(PIXELS[:1]), {"background": "#ffffff", "composite_mode": COMPOSITE_FAST})
+        self.assertEqual(ctx.composite_mode, COMPOSITE_FAST)
+        r, g, b, a = fast.getpixel((0, 0))
+        self.assertEqual((r, a), (255, 255))
+        self.assertLessEqual(abs(g - 127), 1)
+        self.assertLessEqual(abs(b - 127), 1)
+
+    def test_composite_linear_is_opaque(self):
+        output = composite_linear(row(PIXELS), (255, 255, 255))
+        self.assertEqual({a for *_, a in output.getdata()}, {255})
+
+
+class StagesTest(unittest.TestCase):
+    def test_trim(self):
+        image = Image.new("RGBA", (6, 4))
+        image.putpixel((2, 1), (255, 0, 0, 255))
+        image.putpixel((3, 1), (0, 255, 0, 10))
+        output, _ = run(image, {"trim": "true"})
+        self.assertEqual(output.size, (2, 1))
+        self.assertEqual(list(output.getdata()), [(255, 0, 0, 255), (0, 255, 0, 10)])
+
+    def test_trim_leaves_empty_images(self):
+        output, _ = run(Image.new("RGBA", (3, 3)), {"trim": "true"})
+        self.assertEqual(output.size, (3, 3))
+
+    def test_shadow(self):
+        image = Image.new("RGBA", (4, 4), (255, 0, 0, 255))
+        output, _ = run(image, {"shadow": "true"})
+        pad = SHADOW_OFFSET + SHADOW_BLUR * 2
+        self.assertEqual(output.size, (4 + 2 * pad, 4 + 2 * pad))
+        # The subject is drawn over its shadow unchanged
+        self.assertEqual(output.getpixel((pad, pad)), (255, 0, 0, 255))
+        # The shadow falls down and to the right of the subject, not up and to the left
+        center = pad + SHADOW_OFFSET + 2
+        self.assertGreater(output.getpixel((center, center))[3], 0)
+        self.assertEqual(output.getpixel((0, 0))[3], 0)
+
+    def test_resize(self):
+        output, _ = run(Image.new("RGBA", (400, 200), (0, 0, 255, 255)), {"max_size": "100"})
+        self.assertEqual(output.size, (100, 50))
+        self.assertEqual(output.getpixel((50, 25)), (0, 0, 255, 255))
+
+    def test_resize_never_enlarges(self):
+        output, _ = run(Image.new("RGBA", (40, 20)), {"max_size": "100"})
+        self.assertEqual(output.size, (40, 20))
+
+    def test_encode_format(self):
+        with tempfile.TemporaryDirectory() as tmp:
+            ctx = PipelineContext({"format": "webp"}, os.path.join(tmp, "output.png"))
+            run_pipeline(Image.new("RGBA", (2, 2)), build_pipeline(ctx.options), ctx)
+            with Image.open(ctx.output_path) as saved:
+                self.assertEqual(saved.format, "WEBP")
+
+
+class PipelineTest(unittest.TestCase):
+    def test_default_stages(self):
+        self.assertEqual(default_stages({}), ["encode"])
+        self.assertEqual(
+            default_stages({"max_size": "64", "background": "#fff", "trim": "true", "shadow": "true"}),
+            ["trim", "shadow", "composite", "resize", "encode"],
+        )
+
+    def test_explicit_order(self):
+        # Resizing before compositing blends fewer pixels, with the same result size
+        image = Image.new("RGBA", (400, 200), (255, 0, 0, 128))
+        options = {"max_size": "100", "background": "#ffffff"}
+        output, _ = run(image, options, ["resize", "composite", "encode"])
+        self.assertEqual(output.size, (100, 50))
+        for got, want in zip(output.getpixel((50, 25)), (255, 187, 187, 255)):
+            self.assertLessEqual(abs(got - want), 1, output.getpixel((50, 25)))
+
+    def test_invalid_orders(self):
+        with self.assertRaisesRegex(ValueError, "Unknown pipeline stages: blur"):
+            build_pipeline({}, ["blur", "encode"])
+        with self.assertRaisesRegex(ValueError, "must end with encode"):
+            build_pipeline({}, ["encode", "trim"])
+
+    def test_progress_and_timings(self):
+        reported = []
+        with tempfile.TemporaryDirectory() as tmp:
+            options = {"trim": "true", "background": "#ffffff", "max_size": "8"}
+            ctx = PipelineContext(options, os.path.join(tmp, "output.png"),
+                                  progress=lambda percent, stage: reported.append((percent, stage)))
+            timings = run_pipeline(Image.new("RGBA", (16, 16), (1, 2, 3, 255)), build_pipeline(options), ctx)
+        self.assertEqual(reported, [(80, "trim"), (85, "composite"), (90, "resize"), (95, "encode")])
+        self.assertEqual([t["stage"] for t in timings], ["trim", "composite", "resize", "encode"])
+
+    def test_cancelled_between_stages(self):
+        started = []
+        with tempfile.TemporaryDirectory() as tmp:
+            options = {"trim": "true", "background": "#ffffff"}
+            ctx = PipelineContext(options, os.path.join(tmp, "output.png"),
+                                  cancelled=lambda: len(started) == 2,
+                                  progress=lambda percent, stage: started.append(stage))
+            with self.assertRaises(JobCancelled) as cancelled:
+                run_pipeline(Image.new("RGBA", (4, 4)), build_pipeline(options), ctx)
+            self.assertFalse(os.path.exists(ctx.output_path))
+        self.assertEqual(cancelled.exception.stage, "encode")
+        self.assertEqual(started, ["trim", "composite"])
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,59 @@
+"""
+Tests for the rolling average processing time the API's polling hints read,
+which workers fold their durations into with a script so concurrent updates
+aren't lost.
+"""
+
+import threading
+import unittest
+from unittest import mock
+
+import redis
+
+import support  # noqa: F401  Puts the worker on the path without rembg
+
+import worker
+
+AVERAGE_KEY = worker.prefixed("stats:avg_processing_ms")
+
+
+class RecordProcessingTimeTest(unittest.TestCase):
+    def setUp(self):
+        self.queue, self.redis = support.fake_queue()
+
+    def test_first_duration_is_the_average(self):
+        self.queue.record_processing_time(1234.56)
+        self.assertEqual(self.redis.get(AVERAGE_KEY), "1234.6")
+
+    def test_folds_durations(self):
+        for duration in (1000, 2000, 500):
+            self.queue.record_processing_time(duration)
+        # 1000, then 0.8*1000 + 0.2*2000 = 1200, then 0.8*1200 + 0.2*500 = 1060
+        self.assertEqual(self.redis.get(AVERAGE_KEY), "1060.0")
+
+    def test_updates_in_one_step(self):
+        # Reading the average and writing it back as separate commands
+        # would let concurrent workers overwrite each other
+        with mock.patch.object(self.queue.redis, "get", side_effect=AssertionError("read outside the script")), \
+                mock.patch.object(self.queue.redis, "set", side_effect=AssertionError("written outside the script")):
+            self.queue.record_processing_time(100)
+        self.assertEqual(self.redis.get(AVERAGE_KEY), "100.0")
+
+    def test_concurrent_updates_all_count(self):
+        self.queue.record_processing_time(0)
+        threads = [threading.Thread(target=self.queue.record_processing_time, args=(1000,)) for _ in range(10)]
+        for thread in threads:
+            thread.start()
+        for thread in threads:
+            thread.join()
+        # Ten folds of 1000 into 0 leave 1000 * (1 - 0.8**10)
+        self.assertAlmostEqual(float(self.redis.get(AVERAGE_KEY)), 1000 * (1 - 0.8 ** 10), delta=0.5)
+
+    def test_never_raises(self):
+        with mock.patch.object(self.queue, "record_processing_time_script", side_effect=redis.ConnectionError("down")):
+            with self.assertLogs(worker.logger, "WARNING"):
+                self.queue.record_processing_time(100)
+
+
+if __name__ == "__main__":
+    unittest.main()
@@ -0,0 +1,102 @@
+"""
+Tests for reporting a job's progress: the hash update_progress keeps apart
+from the job's record, the stages process_image reports, and update_job
+clearing the progress when the job moves on.
+"""
+
+import os
+import tempfile
+import unittest
+from unittest import mock
+
+import redis
+
+import support  # noqa: F401  Puts the worker on the path without rembg
+
+from PIL import Image
+
+import worker
+
+
+class UpdateProgressTest(unittest.TestCase):
+    def setUp(self):
+        self.queue, self.redis = support.fake_queue()
+        support.add_job(self.redis, "job-1", status="processing")
+
+    def test_records_progress_and_stage(self):
+        self.queue.update_progress("job-1", 42, "inference")
+
+        key = worker.progress_key("job-1")
+        self.assertEqual(self.redis.hgetall(key), {"progress": "42", "stage": "inference"})
+        self.assertTrue(0 < self.redis.ttl(key) <= worker.PROGRESS_TTL)
+
+    def test_clamps_progress(self):
+        for progress, want in [(-5, "0"), (100, "100"), (250, "100")]:
+            self.queue.update_progress("job-1", progress, "encode")
+            self.assertEqual(self.redis.hget(worker.progress_key("job-1"), "progress"), want)
+
+    def test_leaves_the_record_alone(self):
+        before = self.redis.get(self.queue.job_key("job-1"))
+        self.queue.update_progress("job-1", 50, "trim")
+        self.assertEqual(self.redis.get(self.queue.job_key("job-1")), before)
+
+    def test_never_raises(self):
+        with mock.patch.object(self.queue.redis, "pipeline", side_effect=redis.ConnectionError("down")):
+            with self.assertLogs(worker.logger, "WARNING"):
+                self.queue.update_progress("job-1", 50, "trim")
+
+    def test_update_job_clears_progress(self):
+        for status in ("completed", "failed", "pending"):
+            with self.subTest(status=status):
+                self.queue.update_progress("job-1", 90, "encode")
+                job = self.queue.get_job("job-1")
+                job.status = status
+                self.queue.update_job(job)
+                self.assertFalse(self.redis.exists(worker.progress_key("job-1")))
+
+    def test_update_job_that_fails_keeps_progress(self):
+        self.queue.update_progress("job-1", 90, "encode")
+        job = self.queue.get_job("job-1")
+        job.status = "completed"
+        with self.assertRaises(worker.InvalidTransition):
+            self.queue.update_job(job, expected="pending")
+        self.assertEqual(self.redis.hget(worker.progress_key("job-1"), "stage"), "encode")
+
+
+class ProcessImageProgressTest(unittest.TestCase):
+    def setUp(self):
+        self.dir = tempfile.TemporaryDirectory()
+        self.addCleanup(self.dir.cleanup)
+        self.input_path = os.path.join(self.dir.name, "input.png")
+        self.output_path = os.path.join(self.dir.name, "output.png")
+        Image.new("RGB", (8, 8), (200, 100, 50)).save(self.input_path)
+        patcher = mock.patch.object(worker, "remove", lambda image, **kwargs: image.convert("RGBA"))
+        patcher.start()
+        self.addCleanup(patcher.stop)
+
+    def test_reports_each_stage(self):
+        reported = []
+        job = worker.Job(id="job-1", status="processing", input_path=self.input_path,
+                         extra={"options": {"trim": "true", "background": "#ffffff"}})
+        ok = worker.ImageProcessor().process_image(
+            self.input_path, self.output_path, job,
+            progress=lambda percent, stage: reported.append((percent, stage)),
+        )
+        self.assertTrue(ok)
+        self.assertEqual(reported, [
+            (0, "decode"), (worker.INFERENCE_PROGRESS, "inference"),
+            (80, "trim"), (86, "composite"), (93, "encode"),
+        ])
+
+    def test_reports_through_the_queue(self):
+        queue, client = support.fake_queue()
+        job = worker.Job(id="job-1", status="processing", input_path=self.input_path)
+        worker.ImageProcessor().process_image(
+            self.input_path, self.output_path, job,
+            progress=lambda percent, stage: queue.update_progress(job.id, percent, stage),
+        )
+        self.assertEqual(client.hgetall(worker.progress_key("job-1")), {"progress": "80", "stage": "encode"})
+
+
+if __name__ == "__main__":
+    unittest.main()